@@ -30,8 +30,10 @@ import (
 	"github.com/eycorsican/go-tun2socks/common/log"
 
 	"github.com/celzero/firestack/intra"
+	"github.com/celzero/firestack/intra/diag"
 	"github.com/celzero/firestack/intra/doh"
 	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/xlog"
 	"github.com/celzero/firestack/tunnel"
 )
 
@@ -48,16 +50,21 @@ func init() {
 // `fd` is the TUN device.  The IntraTunnel acquires an additional reference to it, which
 //  is released by IntraTunnel.Disconnect(), so the caller must close `fd` _and_ call
 //  Disconnect() in order to close the TUN device.
+// `mtu` is the MTU the TUN device was set up with, or 0 for the default of 1500.  The MSS
+//  of tunneled TCP flows is clamped to fit it; it should be no larger than the MTU of the
+//  underlying network.
+// `stack` is the tcp/ip stack, intra.StackLWIP, the default if empty, or intra.StackGVisor.
 // `fakedns` is the DNS server that the system believes it is using, in "host:port" style.
 //  The port is normally 53.
 // `dohdns` is the initial DoH transport.  It must not be `nil`.
-// `protector` is a wrapper for Android's VpnService.protect() method.
+// `protector` is a wrapper for Android's VpnService.protect() method.  Sockets are
+//  also bound by protect.DefaultBinding, to an interface or Network, if set.
 // `blocker` implements firewall rules.
 // `listener` will be provided with a summary of each TCP and UDP socket when it is closed.
 //
 // Throws an exception if the TUN file descriptor cannot be opened, or if the tunnel fails to
 // connect.
-func ConnectIntraTunnel(fd int, fakedns string, dohdns doh.Transport, protector protect.Protector, blocker protect.Blocker, listener intra.Listener) (intra.Tunnel, error) {
+func ConnectIntraTunnel(fd int, mtu int, stack string, fakedns string, dohdns doh.Transport, protector protect.Protector, blocker protect.Blocker, listener intra.Listener) (intra.Tunnel, error) {
 	tun, err := tunnel.MakeTunFile(fd)
 	if err != nil {
 		return nil, err
@@ -65,11 +72,38 @@ func ConnectIntraTunnel(fd int, fakedns string, dohdns doh.Transport, protector
 
 	dialer := protect.MakeDialer(protector)
 	config := protect.MakeListenConfig(protector)
-	t, err := intra.NewTunnel(fakedns, dohdns, tun, dialer, blocker, config, listener)
+	t, err := intra.NewTunnel(fakedns, dohdns, tun, mtu, stack, dialer, blocker, config, listener)
 	if err != nil {
 		return nil, err
 	}
-	go tunnel.ProcessInputPackets(t, tun)
+	diag.Go(diag.Tunnel, func() {
+		tunnel.ProcessInputPackets(t, tun, mtu)
+	})
+	return t, nil
+}
+
+// ConnectIntraTunnelWithConfig is like ConnectIntraTunnel, but for a tunnel
+// set up as `config`, a json intra.Config, whose dns section names the DoH
+// server, in place of `dohdns`.
+func ConnectIntraTunnelWithConfig(fd int, config string, protector protect.Protector, blocker protect.Blocker, listener intra.Listener) (intra.Tunnel, error) {
+	c, err := intra.ParseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	tun, err := tunnel.MakeTunFile(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := protect.MakeDialer(protector)
+	lc := protect.MakeListenConfig(protector)
+	t, err := intra.NewTunnelWithConfig(config, tun, dialer, blocker, lc, listener)
+	if err != nil {
+		return nil, err
+	}
+	diag.Go(diag.Tunnel, func() {
+		tunnel.ProcessInputPackets(t, tun, c.MTU)
+	})
 	return t, nil
 }
 
@@ -90,6 +124,13 @@ func NewDoHTransport(url string, ips string, protector protect.Protector, auth d
 	return doh.NewTransport(url, split, dialer, auth, listener)
 }
 
+// NewDoHTransportBuilder returns a builder of DoH transports, for settings
+// NewDoHTransport doesn't take, whose network activity is protected by
+// `protector`.
+func NewDoHTransportBuilder(protector protect.Protector) *doh.TransportBuilder {
+	return doh.NewTransportBuilder().SetDialer(protect.MakeDialer(protector))
+}
+
 func EnableDebugLog() {
-	log.SetLevel(log.DEBUG)
+	xlog.SetLevel(xlog.LevelDebug)
 }
@@ -0,0 +1,239 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package codes is the one space of status and error codes of dns
+// transactions, the tunnel, proxies, and the network, so that apps can
+// branch on why something failed, rather than on error strings.  Codes are
+// stable: they are never renumbered, and new ones are only ever added.
+package codes
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Status codes of dns transactions, as in the Status of the Summaries of
+// DoH and DNSCrypt transports.
+const (
+	// OK is success.
+	OK = 0
+	// SendFailed is a query that couldn't be sent.
+	SendFailed = 1
+	// HTTPError is a non-200 HTTP status from a DoH server.
+	HTTPError = 2
+	// BadQuery is malformed input.
+	BadQuery = 3
+	// BadResponse is a response that was invalid.
+	BadResponse = 4
+	// InternalError should never happen.
+	InternalError = 5
+	// NoResponse is a query that got no response.
+	NoResponse = 6
+	// Overloaded is a query shed, unsent, as too many are in-flight.
+	Overloaded = 7
+)
+
+// Codes of tunnel errors.
+const (
+	// BadTun is a missing or unusable TUN device.
+	BadTun = 100 + iota
+	// BadMTU is an MTU out of range.
+	BadMTU
+	// BadConfig is a config that couldn't be parsed or applied.
+	BadConfig
+	// Paused is a flow dropped as the tunnel is paused.
+	Paused
+	// Firewalled is a flow dropped by the firewall, or the Blocker.
+	Firewalled
+	// Trapped is a DoT or DoQ flow refused, as set by SetTrapDoT.
+	Trapped
+	// OverQuota is a flow or query dropped as its app is over quota.
+	OverQuota
+	// Killed is a flow dropped by the kill switch.
+	Killed
+	// UnknownFakeIP is a flow to a fake ip that isn't handed out.
+	UnknownFakeIP
+	// NATFull is a udp flow dropped as the nat table is full.
+	NATFull
+	// NoDNS is a missing dns transport.
+	NoDNS
+	// DNSCryptBusy is a DNSCrypt proxy started, or stopped, when it can't be.
+	DNSCryptBusy
+	// Managed is a change the managed config doesn't allow, or a change to a
+	// sealed managed config.
+	Managed
+)
+
+// Codes of proxy errors.
+const (
+	// ProxyUnsupported is a proxy, or proxy scheme, that isn't supported.
+	ProxyUnsupported = 200 + iota
+	// ProxyFailed is a flow that its proxy failed to connect.
+	ProxyFailed
+	// NoOutbound is a flow routed to an outbound that isn't set.
+	NoOutbound
+	// ProxyNoUDP is a udp flow to a proxy that doesn't carry udp.
+	ProxyNoUDP
+)
+
+// Codes of network errors.
+const (
+	// Timeout is a timed-out connect, read, or write.
+	Timeout = 300 + iota
+	// Refused is a refused connection.
+	Refused
+	// Reset is a reset connection.
+	Reset
+	// Unreachable is a network or host that's unreachable.
+	Unreachable
+	// ResolveFailed is a name that failed to resolve.
+	ResolveFailed
+	// TLSFailed is a server certificate that failed to verify.
+	TLSFailed
+	// Canceled is an operation canceled before it was complete.
+	Canceled
+	// Closed is a closed, or ended, connection.
+	Closed
+)
+
+// Unknown is an error of no known cause.
+const Unknown = 999
+
+var names = map[int]string{
+	OK:               "ok",
+	SendFailed:       "send-failed",
+	HTTPError:        "http-error",
+	BadQuery:         "bad-query",
+	BadResponse:      "bad-response",
+	InternalError:    "internal-error",
+	NoResponse:       "no-response",
+	Overloaded:       "overloaded",
+	BadTun:           "bad-tun",
+	BadMTU:           "bad-mtu",
+	BadConfig:        "bad-config",
+	Paused:           "paused",
+	Firewalled:       "firewalled",
+	Trapped:          "trapped",
+	OverQuota:        "over-quota",
+	Killed:           "killed",
+	UnknownFakeIP:    "unknown-fake-ip",
+	NATFull:          "nat-full",
+	NoDNS:            "no-dns",
+	DNSCryptBusy:     "dnscrypt-busy",
+	Managed:          "managed",
+	ProxyUnsupported: "proxy-unsupported",
+	ProxyFailed:      "proxy-failed",
+	NoOutbound:       "no-outbound",
+	ProxyNoUDP:       "proxy-no-udp",
+	Timeout:          "timeout",
+	Refused:          "refused",
+	Reset:            "reset",
+	Unreachable:      "unreachable",
+	ResolveFailed:    "resolve-failed",
+	TLSFailed:        "tls-failed",
+	Canceled:         "canceled",
+	Closed:           "closed",
+	Unknown:          "unknown",
+}
+
+// Name returns the name of `code`, or "" if it is unknown.
+func Name(code int) string {
+	return names[code]
+}
+
+// coder is an error of a known code.
+type coder interface {
+	Code() int
+}
+
+// codedError is err, of code.
+type codedError struct {
+	code int
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+func (e *codedError) Code() int {
+	return e.code
+}
+
+// New returns an error of `code`, with message `msg`.
+func New(code int, msg string) error {
+	return &codedError{code, errors.New(msg)}
+}
+
+// Errorf returns an error of `code`, with its message formatted as in
+// fmt.Errorf.
+func Errorf(code int, format string, args ...interface{}) error {
+	return &codedError{code, fmt.Errorf(format, args...)}
+}
+
+// Wrap returns err as of `code`, or nil if err is nil.
+func Wrap(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code, err}
+}
+
+// Of returns the code of `err`: OK if nil, its own if it, or an error it
+// wraps, has one, else that of its network cause, if known, else Unknown.
+func Of(err error) int {
+	if err == nil {
+		return OK
+	}
+	var c coder
+	if errors.As(err, &c) {
+		return c.Code()
+	}
+	var dnserr *net.DNSError
+	var certerr x509.CertificateInvalidError
+	var unknownca x509.UnknownAuthorityError
+	var hosterr x509.HostnameError
+	var ne net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return Canceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return Timeout
+	case errors.As(err, &dnserr):
+		if dnserr.IsTimeout {
+			return Timeout
+		}
+		return ResolveFailed
+	case errors.As(err, &certerr), errors.As(err, &unknownca), errors.As(err, &hosterr):
+		return TLSFailed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return Refused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return Reset
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return Unreachable
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrClosedPipe):
+		return Closed
+	case errors.As(err, &ne) && ne.Timeout():
+		return Timeout
+	}
+	return Unknown
+}
+
+// NameOf returns the name of the code of `err`, as in Of.
+func NameOf(err error) string {
+	return Name(Of(err))
+}
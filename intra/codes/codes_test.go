@@ -0,0 +1,56 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package codes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{nil, OK},
+		{New(Paused, "paused"), Paused},
+		{fmt.Errorf("wrapped: %w", New(Killed, "killed")), Killed},
+		{Wrap(ProxyFailed, refused), ProxyFailed},
+		{refused, Refused},
+		{&net.DNSError{Err: "no such host", Name: "x.example"}, ResolveFailed},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, Timeout},
+		{context.Canceled, Canceled},
+		{fmt.Errorf("dial: %w", syscall.ENETUNREACH), Unreachable},
+		{errors.New("?"), Unknown},
+	} {
+		if got := Of(c.err); got != c.code {
+			t.Errorf("Of(%v) = %s, not %s", c.err, Name(got), Name(c.code))
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	seen := make(map[string]bool)
+	for code, name := range names {
+		if len(name) == 0 || seen[name] {
+			t.Errorf("code %d named %q", code, name)
+		}
+		seen[name] = true
+	}
+	if Wrap(Timeout, nil) != nil {
+		t.Error("nil wrapped")
+	}
+	if NameOf(Errorf(BadMTU, "mtu %d", 1)) != "bad-mtu" {
+		t.Error("bad name")
+	}
+}
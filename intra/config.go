@@ -0,0 +1,301 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/celzero/firestack/intra/codes"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/doh"
+	"github.com/celzero/firestack/intra/firewall"
+	"github.com/celzero/firestack/intra/outbound"
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// ConfigVersion is the version of Config this build reads.  Configs of
+// later versions are refused, rather than applied in part.
+const ConfigVersion = 1
+
+// Config is the setup of a tunnel, as json, for NewTunnelWithConfig and
+// Tunnel.ApplyConfig.  Sections left out of the config are left as they
+// are, and fields left out of a section take their defaults.
+type Config struct {
+	Version int `json:"version"`
+	// MTU, FakeDNS and Stack are as in NewTunnel, and apply to new tunnels
+	// alone.
+	MTU     int    `json:"mtu"`
+	FakeDNS string `json:"fakedns"`
+	Stack   string `json:"stack"`
+
+	DNS        *DNSConfig       `json:"dns"`
+	Blocklists *BlocklistConfig `json:"blocklists"`
+	Proxy      *ProxyConfig     `json:"proxy"`
+	Outbounds  []OutboundConfig `json:"outbounds"`
+	Firewall   *FirewallConfig  `json:"firewall"`
+	Options    *ConfigOptions   `json:"options"`
+}
+
+// DNSConfig is the dns transport of a Config.
+type DNSConfig struct {
+	// DoH is the url of the DoH server, and IPs, a csv of its ips, if known.
+	DoH string `json:"doh"`
+	IPs string `json:"ips"`
+	// Proxy is the ip:port of the dns proxy of DNSModeProxy*, if any.
+	Proxy string `json:"proxy"`
+	// DNSCryptResolvers and DNSCryptRelays are csvs of dns-stamps of the
+	// DNSCrypt proxy of DNSModeCrypt*, if any.
+	DNSCryptResolvers string `json:"dnscrypt_resolvers"`
+	DNSCryptRelays    string `json:"dnscrypt_relays"`
+}
+
+// BlocklistConfig is the blocklists of a Config: the paths of the files
+// of local blocklists, or else the file tags of remote ones.
+type BlocklistConfig struct {
+	Trie    string `json:"trie"`
+	Rank    string `json:"rank"`
+	Config  string `json:"config"`
+	Filetag string `json:"filetag"`
+	// Remote, if set, is the path of the file tags of blocklists that the
+	// DoH server applies, in place of local ones.
+	Remote string `json:"remote"`
+	// Lazy, if set, loads local blocklists in the background, as in
+	// dnsx.NewBraveDNSLazy, letting queries through, or, if Strict, blocking
+	// them, till they're ready.
+	Lazy   bool `json:"lazy"`
+	Strict bool `json:"strict"`
+}
+
+// ProxyConfig is the socks5 or http proxy of a Config, as in StartProxy.
+type ProxyConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	IP       string `json:"ip"`
+	Port     string `json:"port"`
+}
+
+// OutboundConfig is an outbound of a Config, as in outbound.Outbounds.AddURL.
+type OutboundConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// FirewallConfig is the firewall of a Config, as in firewall.Firewall.
+type FirewallConfig struct {
+	// Rules are the rules, one per line.
+	Rules string `json:"rules"`
+	// Bypass is a csv of ips and cidrs that bypass routes.
+	Bypass string `json:"bypass"`
+	// GeoIP is the path of the GeoIP database, if any.
+	GeoIP string `json:"geoip"`
+}
+
+// ConfigOptions are the options of a Config, as in the Tunnel's setters.
+type ConfigOptions struct {
+	DNSMode          int    `json:"dns_mode"`
+	BlockMode        int    `json:"block_mode"`
+	ProxyMode        int    `json:"proxy_mode"`
+	TrapDoT          bool   `json:"trap_dot"`
+	AlwaysSplitHTTPS bool   `json:"always_split_https"`
+	FakeIPs          string `json:"fake_ips"`
+	KillSwitch       bool   `json:"kill_switch"`
+	TCPKeepaliveSecs int    `json:"tcp_keepalive_secs"`
+	TCPIdleSecs      int    `json:"tcp_idle_secs"`
+	UDPTimeoutSecs   int    `json:"udp_timeout_secs"`
+	UDPMaxSessions   int    `json:"udp_max_sessions"`
+	UDPEvict         int    `json:"udp_evict"`
+	DNSCoalescingMs  int    `json:"dns_coalescing_ms"`
+}
+
+// UnmarshalJSON sets o from b, with its defaults for the fields b leaves out.
+func (o *ConfigOptions) UnmarshalJSON(b []byte) error {
+	type plain ConfigOptions
+	def := DefaultConfigOptions()
+	p := (*plain)(def)
+	if err := json.Unmarshal(b, p); err != nil {
+		return err
+	}
+	*o = *def
+	return nil
+}
+
+// DefaultConfigOptions returns the options of a tunnel just made.
+func DefaultConfigOptions() *ConfigOptions {
+	m := settings.DefaultTunMode()
+	return &ConfigOptions{DNSMode: m.DNSMode, BlockMode: m.BlockMode, ProxyMode: m.ProxyMode}
+}
+
+// ParseConfig returns the Config in `s`, json.
+func ParseConfig(s string) (*Config, error) {
+	c := &Config{}
+	if err := json.Unmarshal([]byte(s), c); err != nil {
+		return nil, codes.Errorf(codes.BadConfig, "bad config: %v", err)
+	}
+	if c.Version <= 0 {
+		return nil, codes.New(codes.BadConfig, "config has no version")
+	}
+	if c.Version > ConfigVersion {
+		return nil, codes.Errorf(codes.BadConfig, "config version %d newer than %d", c.Version, ConfigVersion)
+	}
+	if o := c.Options; o != nil && !validEvict(o.UDPEvict) {
+		return nil, codes.Errorf(codes.BadConfig, "config udp evict %d unknown", o.UDPEvict)
+	}
+	return c, nil
+}
+
+// NewTunnelWithConfig is like NewTunnel, but for a tunnel set up as
+// `config`, a json Config, whose dns section must name a DoH server.
+func NewTunnelWithConfig(config string, tunWriter io.WriteCloser, dialer *net.Dialer, blocker protect.Blocker, listenConfig *net.ListenConfig, listener Listener) (Tunnel, error) {
+	c, err := ParseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if c.DNS == nil || len(c.DNS.DoH) == 0 {
+		return nil, codes.New(codes.BadConfig, "config has no doh server")
+	}
+	dns, err := newDoH(c.DNS, dialer, listener)
+	if err != nil {
+		return nil, err
+	}
+	t, err := NewTunnel(c.FakeDNS, dns, tunWriter, c.MTU, c.Stack, dialer, blocker, listenConfig, listener)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.(*intratunnel).apply(c, false); err != nil {
+		t.Disconnect()
+		return nil, err
+	}
+	return t, nil
+}
+
+func newDoH(c *DNSConfig, dialer *net.Dialer, listener Listener) (doh.Transport, error) {
+	var ips []string
+	if len(c.IPs) > 0 {
+		ips = strings.Split(c.IPs, ",")
+	}
+	return doh.NewTransport(c.DoH, ips, dialer, nil, listener)
+}
+
+func (t *intratunnel) ApplyConfig(config string) error {
+	c, err := ParseConfig(config)
+	if err != nil {
+		return err
+	}
+	return t.apply(c, true)
+}
+
+// apply sets t up as c.  All that c makes anew is made before any of it is
+// set, so that bad configs leave t as it is, but for failures to start the
+// proxies, which are started last.  The DoH transport of c is set only if `setDNS`.
+func (t *intratunnel) apply(c *Config, setDNS bool) error {
+	var dns doh.Transport
+	if c.DNS != nil && len(c.DNS.DoH) > 0 && setDNS {
+		var err error
+		if dns, err = newDoH(c.DNS, t.dialer, t.listener); err != nil {
+			return codes.Errorf(codes.BadConfig, "config dns: %v", err)
+		}
+	}
+	var bravedns dnsx.BraveDNS
+	if b := c.Blocklists; b != nil {
+		var err error
+		if len(b.Remote) > 0 {
+			bravedns, err = dnsx.NewBraveDNSRemote(b.Remote)
+		} else if b.Lazy {
+			bravedns, err = dnsx.NewBraveDNSLazy(b.Trie, b.Rank, b.Config, b.Filetag, nil, b.Strict)
+		} else {
+			bravedns, err = dnsx.NewBraveDNSLocal(b.Trie, b.Rank, b.Config, b.Filetag)
+		}
+		if err != nil {
+			return codes.Errorf(codes.BadConfig, "config blocklists: %v", err)
+		}
+	}
+	var obs *outbound.Outbounds
+	if c.Outbounds != nil {
+		obs = outbound.NewOutbounds()
+		for _, o := range c.Outbounds {
+			if err := obs.AddURL(o.Name, o.URL); err != nil {
+				return codes.Errorf(codes.BadConfig, "config outbound %s: %v", o.Name, err)
+			}
+		}
+	}
+	var fw *firewall.Firewall
+	if f := c.Firewall; f != nil {
+		fw = firewall.NewFirewall()
+		if err := fw.Load(f.Rules); err != nil {
+			return codes.Errorf(codes.BadConfig, "config firewall: %v", err)
+		}
+		if err := fw.SetBypass(f.Bypass); err != nil {
+			return codes.Errorf(codes.BadConfig, "config firewall: %v", err)
+		}
+		if err := fw.LoadGeoIP(f.GeoIP); err != nil {
+			return codes.Errorf(codes.BadConfig, "config firewall: %v", err)
+		}
+	}
+	var fakeips *dnsx.FakeIPs
+	if o := c.Options; o != nil && len(o.FakeIPs) > 0 {
+		var err error
+		if fakeips, err = dnsx.NewFakeIPs(o.FakeIPs); err != nil {
+			return codes.Errorf(codes.BadConfig, "config fake ips: %v", err)
+		}
+	}
+
+	if o := c.Options; o != nil {
+		if err := t.SetTunMode(o.DNSMode, o.BlockMode, o.ProxyMode); err != nil {
+			return err
+		}
+		t.SetTrapDoT(o.TrapDoT)
+		t.SetAlwaysSplitHTTPS(o.AlwaysSplitHTTPS)
+		t.tcp.SetFakeIPs(fakeips)
+		t.udp.SetFakeIPs(fakeips)
+		t.SetKillSwitch(o.KillSwitch)
+		t.SetTCPTimeouts(o.TCPKeepaliveSecs, o.TCPIdleSecs)
+		if err := t.SetUDPNAT(o.UDPTimeoutSecs, o.UDPMaxSessions, o.UDPEvict); err != nil {
+			return err
+		}
+		t.SetDNSCoalescing(o.DNSCoalescingMs)
+	}
+	if c.Blocklists != nil {
+		if err := t.SetBraveDNS(bravedns); err != nil {
+			return codes.Errorf(codes.BadConfig, "config blocklists: %v", err)
+		}
+	}
+	if dns != nil {
+		if err := t.SetDNSTransport(dns); err != nil {
+			return codes.Errorf(codes.BadConfig, "config dns: %v", err)
+		}
+	}
+	if obs != nil {
+		t.SetOutbounds(obs)
+	}
+	if fw != nil {
+		t.SetFirewall(fw)
+	}
+	if p := c.Proxy; p != nil {
+		if err := t.StartProxy(p.Username, p.Password, p.IP, p.Port); err != nil {
+			return codes.Errorf(codes.BadConfig, "config proxy: %v", err)
+		}
+	}
+	if d := c.DNS; d != nil && len(d.Proxy) > 0 {
+		ip, port, err := net.SplitHostPort(d.Proxy)
+		if err == nil {
+			err = t.StartDNSProxy(ip, port)
+		}
+		if err != nil {
+			return codes.Errorf(codes.BadConfig, "config dns proxy: %v", err)
+		}
+	}
+	if d := c.DNS; d != nil && len(d.DNSCryptResolvers) > 0 {
+		if err := t.setDNSCrypt(d.DNSCryptResolvers, d.DNSCryptRelays); err != nil {
+			return codes.Errorf(codes.BadConfig, "config dnscrypt: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"testing"
+
+	"github.com/celzero/firestack/intra/codes"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig(`{"version": 1, "options": {"udp_evict": 1}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != 1 || c.Options == nil || c.Options.UDPEvict != EvictOldest {
+		t.Errorf("config %+v", c)
+	}
+}
+
+func TestParseConfigRejects(t *testing.T) {
+	for _, s := range []string{
+		``,
+		`{`,
+		`[]`,
+		`{"version": "1"}`,
+		`{"version": 1, "mtu": "big"}`,
+		`{}`,
+		`{"version": 0}`,
+		`{"version": 2}`,
+		`{"version": 1, "options": {"udp_evict": 3}}`,
+	} {
+		if _, err := ParseConfig(s); codes.Of(err) != codes.BadConfig {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package diag accounts for goroutines, sockets, and buffers held by each
+// subsystem, so that leaks can be diagnosed on devices where pprof isn't
+// practical.
+package diag
+
+import (
+	"encoding/json"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Subsystems that resources are accounted against.
+const (
+	DoH      = "doh"
+	DNSCrypt = "dnscrypt"
+	Tunnel   = "tunnel"
+	Proxy    = "proxy"
+	// Listeners are the local servers, like stub's, that listen for queries.
+	Listeners = "listeners"
+	// DNS is the machinery the transports share: caches, blocklists, portal
+	// probes, and the calls to their listeners.
+	DNS = "dns"
+)
+
+// counters must be allocated on its own so that the int64s are
+// 64-bit aligned for atomic ops on 32-bit platforms.
+type counters struct {
+	goroutines int64
+	sockets    int64
+	buffers    int64
+}
+
+var (
+	mu  sync.RWMutex
+	all = make(map[string]*counters)
+)
+
+func of(sub string) *counters {
+	mu.RLock()
+	c := all[sub]
+	mu.RUnlock()
+	if c != nil {
+		return c
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if c = all[sub]; c == nil {
+		c = &counters{}
+		all[sub] = c
+	}
+	return c
+}
+
+// Go runs f on a new goroutine accounted against subsystem `sub`.
+func Go(sub string, f func()) {
+	c := of(sub)
+	atomic.AddInt64(&c.goroutines, 1)
+	go func() {
+		defer atomic.AddInt64(&c.goroutines, -1)
+		f()
+	}()
+}
+
+// SocketOpened accounts a newly opened socket against subsystem `sub`.
+func SocketOpened(sub string) {
+	atomic.AddInt64(&of(sub).sockets, 1)
+}
+
+// SocketClosed releases a socket accounted against subsystem `sub`.
+func SocketClosed(sub string) {
+	atomic.AddInt64(&of(sub).sockets, -1)
+}
+
+// BufferTaken accounts a buffer in-use against subsystem `sub`.
+func BufferTaken(sub string) {
+	atomic.AddInt64(&of(sub).buffers, 1)
+}
+
+// BufferReturned releases a buffer accounted against subsystem `sub`.
+func BufferReturned(sub string) {
+	atomic.AddInt64(&of(sub).buffers, -1)
+}
+
+// Usage is the resource usage of a subsystem.
+type Usage struct {
+	Goroutines int64 `json:"goroutines"`
+	Sockets    int64 `json:"sockets"`
+	Buffers    int64 `json:"buffers"`
+}
+
+type snapshot struct {
+	// Goroutines is the total number of goroutines in the process.
+	Goroutines int `json:"goroutines"`
+	// HeapBytes is the number of bytes of allocated heap objects.
+	HeapBytes uint64 `json:"heap_bytes"`
+	// Subsystems is the accounted usage keyed by subsystem name.
+	Subsystems map[string]Usage `json:"subsystems"`
+}
+
+// Get returns the resource usage of subsystem `sub`.
+func Get(sub string) Usage {
+	c := of(sub)
+	return Usage{
+		Goroutines: atomic.LoadInt64(&c.goroutines),
+		Sockets:    atomic.LoadInt64(&c.sockets),
+		Buffers:    atomic.LoadInt64(&c.buffers),
+	}
+}
+
+// Subsystems returns the names of subsystems resources were accounted
+// against, sorted.
+func Subsystems() []string {
+	mu.RLock()
+	subs := make([]string, 0, len(all))
+	for sub := range all {
+		subs = append(subs, sub)
+	}
+	mu.RUnlock()
+	sort.Strings(subs)
+	return subs
+}
+
+// Snapshot returns the resource usage of all subsystems as json.
+func Snapshot() string {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	s := snapshot{
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  ms.HeapAlloc,
+		Subsystems: make(map[string]Usage),
+	}
+	for _, sub := range Subsystems() {
+		s.Subsystems[sub] = Get(sub)
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
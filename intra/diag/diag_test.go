@@ -0,0 +1,53 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package diag
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGo(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	Go("test-go", func() {
+		close(started)
+		<-release
+	})
+	<-started
+	if u := Get("test-go"); u.Goroutines != 1 {
+		t.Errorf("Expected 1 goroutine, got %d", u.Goroutines)
+	}
+	Go("test-go", func() {
+		close(done)
+	})
+	close(release)
+	<-done
+}
+
+func TestSnapshot(t *testing.T) {
+	SocketOpened("test-snap")
+	SocketOpened("test-snap")
+	SocketClosed("test-snap")
+	BufferTaken("test-snap")
+
+	var s snapshot
+	if err := json.Unmarshal([]byte(Snapshot()), &s); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := s.Subsystems["test-snap"]
+	if !ok {
+		t.Fatal("Subsystem missing from snapshot")
+	}
+	if u.Sockets != 1 || u.Buffers != 1 || u.Goroutines != 0 {
+		t.Errorf("Wrong usage %v", u)
+	}
+	if s.Goroutines <= 0 {
+		t.Error("Total goroutines missing")
+	}
+}
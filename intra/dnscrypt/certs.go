@@ -28,6 +28,7 @@ import (
 
 	"github.com/miekg/dns"
 
+	"github.com/celzero/firestack/intra/xbuf"
 	"github.com/celzero/firestack/intra/xdns"
 
 )
@@ -309,7 +310,7 @@ func _dnsExchange(proxy *Proxy, proto string, query *dns.Msg, serverAddress stri
 			return dnsExchangeResponse{err: err}
 		}
 		now := time.Now()
-		pc, err := net.DialUDP("udp", nil, upstreamAddr)
+		pc, err := proxy.dial("udp", upstreamAddr.String())
 		if err != nil {
 			return dnsExchangeResponse{err: err}
 		}
@@ -320,13 +321,14 @@ func _dnsExchange(proxy *Proxy, proto string, query *dns.Msg, serverAddress stri
 		if _, err := pc.Write(binQuery); err != nil {
 			return dnsExchangeResponse{err: err}
 		}
-		packet = make([]byte, xdns.MaxDNSPacketSize)
-		length, err := pc.Read(packet)
+		b := xbuf.Get(xdns.MaxDNSPacketSize)
+		defer xbuf.Put(b)
+		length, err := pc.Read(*b)
 		if err != nil {
 			return dnsExchangeResponse{err: err}
 		}
 		rtt = time.Since(now)
-		packet = packet[:length]
+		packet = append([]byte(nil), (*b)[:length]...)
 	} else {
 		binQuery, err := query.Pack()
 		if err != nil {
@@ -348,7 +350,7 @@ func _dnsExchange(proxy *Proxy, proto string, query *dns.Msg, serverAddress stri
 		*/
 		now := time.Now()
 		var pc net.Conn
-		pc, err = net.DialTCP("tcp", nil, upstreamAddr)
+		pc, err = proxy.dial("tcp", upstreamAddr.String())
 		if err != nil {
 			return dnsExchangeResponse{err: err}
 		}
@@ -270,7 +270,13 @@ func (ic *Intercept) requestBlockedByBraveDNS(q []byte) error {
 		return nil // nothing to do
 	}
 
-	ans, err := xdns.BlockResponseFromMessage(q)
+	if dnsx.DryRun() {
+		log.Debugf("dry-run: would have blocked with %s", blocklists)
+		state.blocklists = blocklists
+		return nil
+	}
+
+	ans, err := xdns.BlockResponseOfType(q, dnsx.BlockResponseType(b, q))
 	if err != nil {
 		return err // ignore this error? doh.Transport does.
 	}
@@ -302,7 +308,15 @@ func (ic *Intercept) responseBlockedByBraveDNS(ans []byte) error {
 		return nil // nothing to do
 	}
 
-	res, err := xdns.RefusedResponseFromMessage(state.question)
+	if dnsx.DryRun() {
+		log.Debugf("dry-run: would have blocked answer with %s", blocklists)
+		if len(state.blocklists) <= 0 {
+			state.blocklists = blocklists
+		}
+		return nil
+	}
+
+	res, err := xdns.BlockedResponseFromMessage(state.question, dnsx.BlockResponseType(b, ans))
 	if err != nil {
 		log.Warnf("could not pack blocked dns ans %v", err)
 		return err // ignore this error? doh.Transport does.
@@ -14,19 +14,26 @@
 
 package dnscrypt
 
+import (
+	"github.com/celzero/firestack/intra/codes"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/schema"
+)
+
+// Statuses of transactions, of the codes package's code space.
 const (
 	// Complete : Transaction completed successfully
-	Complete = iota
+	Complete = codes.OK
 	// SendFailed : Failed to send query
-	SendFailed
+	SendFailed = codes.SendFailed
 	// Error : Got no response
-	Error
+	Error = codes.NoResponse
 	// BadQuery : Malformed input
-	BadQuery
+	BadQuery = codes.BadQuery
 	// BadResponse : Response was invalid
-	BadResponse
+	BadResponse = codes.BadResponse
 	// InternalError : This should never happen
-	InternalError
+	InternalError = codes.InternalError
 )
 
 type dnscryptError struct {
@@ -42,8 +49,14 @@ func (e *dnscryptError) Unwrap() error {
 	return e.err
 }
 
+// Code returns the status of e, as a code of the codes package.
+func (e *dnscryptError) Code() int {
+	return e.status
+}
+
 // Summary is a summary of a DNS transaction, reported when it is complete.
 type Summary struct {
+	Version     int     // Schema version, schema.DNSSummary
 	Latency     float64 // Response (or failure) latency in seconds
 	Query       []byte
 	Response    []byte
@@ -51,6 +64,25 @@ type Summary struct {
 	RelayServer string
 	Status      int
 	Blocklists  string
+	// Since schema.DNSSummary 3, as in dnsx.Description
+	QName  string // The name queried, without the trailing dot.
+	QType  int    // The type queried.
+	RCode  int    // The rcode of Response, or -1 if there's none.
+	IPs    string // csv of the ips answered.
+	CNAMEs string // csv of the names QName is aliased to, in order.
+}
+
+// describe sets the fields of s parsed from its Query and Response.
+func (s *Summary) describe() *Summary {
+	d := dnsx.Describe(s.Query, s.Response)
+	s.QName, s.QType, s.RCode, s.IPs, s.CNAMEs = d.QName, d.QType, d.RCode, d.IPs, d.CNAMEs
+	return s
+}
+
+// Field returns the named field of s as a string, or "" if s has no such
+// field; see schema.Field.
+func (s *Summary) Field(name string) string {
+	return schema.Field(s, name)
 }
 
 // Listener receives Summaries.
@@ -58,3 +90,20 @@ type Listener interface {
 	OnDNSCryptQuery(url string) bool
 	OnDNSCryptResponse(*Summary)
 }
+
+// respond tells proxy's listener of s, through proxy's queue of listener calls.
+func (proxy *Proxy) respond(s *Summary) {
+	l := proxy.listener
+	// queries, as from gobind, may not be retained past the call
+	s.Query = append([]byte(nil), s.Query...)
+	proxy.events.Push(func() {
+		l.OnDNSCryptResponse(s.describe())
+	})
+}
+
+// SetListenerQueue sets up to `size` calls to the listener to be queued,
+// and made apart from queries, dropping the oldest once full; size <= 0 calls
+// the listener as queries complete (default: 64).
+func (proxy *Proxy) SetListenerQueue(size int) {
+	proxy.events.SetSize(size)
+}
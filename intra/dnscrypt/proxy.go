@@ -22,11 +22,15 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/metrics"
+	"github.com/celzero/firestack/intra/qlog"
+	"github.com/celzero/firestack/intra/schema"
 	"github.com/celzero/firestack/intra/xdns"
 	"github.com/eycorsican/go-tun2socks/common/log"
 
@@ -220,6 +224,8 @@ type Proxy struct {
 	routes                       []string
 	quit                         chan bool
 	listener                     Listener
+	events                       *dnsx.ListenerQueue // of calls to listener
+	dialer                       *net.Dialer         // of resolvers and relays, if set
 	liveServers                  []string
 	sigterm                      context.CancelFunc
 	bravedns                     dnsx.BraveDNS
@@ -230,8 +236,7 @@ func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, sharedKey *[32
 	if serverInfo.RelayTCPAddr != nil {
 		upstreamAddr = serverInfo.RelayTCPAddr
 	}
-	var pc net.Conn
-	pc, err := net.DialTCP("tcp", nil, upstreamAddr)
+	pc, err := proxy.dial("tcp", upstreamAddr.String())
 	if err != nil {
 		log.Errorf("failed to dial %s upstream because %v", serverInfo.String(), err)
 		return nil, err
@@ -376,10 +381,29 @@ func (proxy *Proxy) query(packet []byte, truncate bool) (response []byte, blockl
 		}
 		return
 	}
+	// would-be blocks of answers, in dry-run mode
+	blocklists = state.blocklists
 
 	return
 }
 
+// statusOf returns the status of a transaction that ended with err.
+func statusOf(err error) int {
+	var qerr *dnscryptError
+	if errors.As(err, &qerr) {
+		return qerr.status
+	}
+	return Complete
+}
+
+// logName returns the name s is known by in the query log.
+func (s *ServerInfo) logName() string {
+	if s == nil {
+		return "dnscrypt"
+	}
+	return "dnscrypt:" + s.Name
+}
+
 // HandleUDP handles incoming udp connection speaking plain old DNS
 func HandleUDP(proxy *Proxy, data []byte) (response []byte, err error) {
 	if proxy == nil {
@@ -392,6 +416,8 @@ func HandleUDP(proxy *Proxy, data []byte) (response []byte, err error) {
 	before := time.Now()
 	response, b, s, err = proxy.query(data, true)
 	after := time.Now()
+	qlog.Add(data, response, after.Sub(before), s.logName(), b, statusOf(err))
+	metrics.Add(metrics.DNSQueries, 1, "transport", "dnscrypt", "status", strconv.Itoa(statusOf(err)))
 
 	if proxy.listener != nil {
 		latency := after.Sub(before)
@@ -411,7 +437,8 @@ func HandleUDP(proxy *Proxy, data []byte) (response []byte, err error) {
 			status = qerr.status
 		}
 
-		proxy.listener.OnDNSCryptResponse(&Summary{
+		proxy.respond(&Summary{
+			Version:     schema.DNSSummary,
 			Latency:     latency.Seconds(),
 			Query:       data,
 			Response:    response,
@@ -462,6 +489,8 @@ func HandleTCP(proxy *Proxy, conn net.Conn) {
 	before := time.Now()
 	query, response, b, s, err := proxy.forward(conn)
 	after := time.Now()
+	qlog.Add(query, response, after.Sub(before), s.logName(), b, statusOf(err))
+	metrics.Add(metrics.DNSQueries, 1, "transport", "dnscrypt", "status", strconv.Itoa(statusOf(err)))
 
 	if proxy.listener != nil {
 		latency := after.Sub(before)
@@ -479,7 +508,8 @@ func HandleTCP(proxy *Proxy, conn net.Conn) {
 			status = qerr.status
 		}
 
-		proxy.listener.OnDNSCryptResponse(&Summary{
+		proxy.respond(&Summary{
+			Version:     schema.DNSSummary,
 			Latency:     latency.Seconds(),
 			Query:       query,
 			Response:    response,
@@ -497,6 +527,21 @@ func HandleTCP(proxy *Proxy, conn net.Conn) {
 	}
 }
 
+// SetDialer sets `d` to dial resolvers and relays with, like the tunnel's,
+// so that their sockets are protected from the VPN; nil dials them directly.
+// It must be set before StartProxy.
+func (proxy *Proxy) SetDialer(d *net.Dialer) {
+	proxy.dialer = d
+}
+
+func (proxy *Proxy) dial(network string, addr string) (net.Conn, error) {
+	d := proxy.dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	return d.Dial(network, addr)
+}
+
 func (p *Proxy) SetBraveDNS(b dnsx.BraveDNS) {
 	p.bravedns = b
 }
@@ -622,6 +667,18 @@ func (proxy *Proxy) RemoveServers(servernamescsv string) (int, error) {
 	return c, nil
 }
 
+// Stamps returns the sdns:// stamps of the registered dnscrypt servers.
+func (proxy *Proxy) Stamps() []string {
+	proxy.RLock()
+	defer proxy.RUnlock()
+
+	s := make([]string, 0, len(proxy.registeredServers))
+	for _, r := range proxy.registeredServers {
+		s = append(s, r.stamp.String())
+	}
+	return s
+}
+
 // AddServers registers additional dnscrypt servers
 func (proxy *Proxy) AddServers(serverscsv string) (int, error) {
 	if len(serverscsv) <= 0 {
@@ -633,24 +690,75 @@ func (proxy *Proxy) AddServers(serverscsv string) (int, error) {
 
 	servers := strings.Split(serverscsv, ",")
 	for i, serverStampPair := range servers {
-		if len(serverStampPair) == 0 {
-			return i, fmt.Errorf("Missing stamp for the stamp [%s] definition", serverStampPair)
-		}
-		serverStamp := strings.Split(serverStampPair, "#")
 		// TODO: skip duplicates.
-		stamp, err := stamps.NewServerStampFromString(serverStamp[1])
+		r, err := parseServer(serverStampPair)
 		if err != nil {
-			return i, fmt.Errorf("Stamp error for the stamp [%s] definition: [%v]", serverStampPair, err)
-		}
-		if stamp.Proto == stamps.StampProtoTypeDoH {
-			// TODO: Implement doh
-			return i, fmt.Errorf("DoH with DNSCrypt client not supported", serverStamp)
+			return i, err
 		}
-		proxy.registeredServers[serverStamp[0]] = RegisteredServer{name: serverStamp[0], stamp: stamp}
+		proxy.registeredServers[r.name] = r
 	}
 	return len(servers), nil
 }
 
+// ReplaceServers registers the dnscrypt servers of serverscsv, as AddServers
+// does, in place of those registered, and refreshes them, as Refresh does.
+// The servers registered are left be if any of serverscsv is bad.
+func (proxy *Proxy) ReplaceServers(serverscsv string) (string, error) {
+	if len(serverscsv) <= 0 {
+		return "", fmt.Errorf("specify at least one dns-crypt resolver endpoint")
+	}
+	servers := make(map[string]RegisteredServer)
+	for _, serverStampPair := range strings.Split(serverscsv, ",") {
+		r, err := parseServer(serverStampPair)
+		if err != nil {
+			return "", err
+		}
+		servers[r.name] = r
+	}
+
+	proxy.Lock()
+	for name := range proxy.registeredServers {
+		proxy.serversInfo.unregisterServer(name)
+	}
+	proxy.registeredServers = servers
+	proxy.Unlock()
+
+	return proxy.Refresh()
+}
+
+// ReplaceRoutes sets the anonymous dnscrypt relay routes to routescsv, in
+// place of those set; empty routescsv removes them all.
+func (proxy *Proxy) ReplaceRoutes(routescsv string) int {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	proxy.routes = nil
+	if len(routescsv) > 0 {
+		proxy.routes = strings.Split(routescsv, ",")
+	}
+	return len(proxy.routes)
+}
+
+// parseServer parses serverStampPair, a name#stamp of a dnscrypt server.
+func parseServer(serverStampPair string) (RegisteredServer, error) {
+	if len(serverStampPair) == 0 {
+		return RegisteredServer{}, fmt.Errorf("Missing stamp for the stamp [%s] definition", serverStampPair)
+	}
+	serverStamp := strings.Split(serverStampPair, "#")
+	if len(serverStamp) != 2 {
+		return RegisteredServer{}, fmt.Errorf("Missing stamp for the stamp [%s] definition", serverStampPair)
+	}
+	stamp, err := stamps.NewServerStampFromString(serverStamp[1])
+	if err != nil {
+		return RegisteredServer{}, fmt.Errorf("Stamp error for the stamp [%s] definition: [%v]", serverStampPair, err)
+	}
+	if stamp.Proto == stamps.StampProtoTypeDoH {
+		// TODO: Implement doh
+		return RegisteredServer{}, fmt.Errorf("DoH with DNSCrypt client not supported %v", serverStamp)
+	}
+	return RegisteredServer{name: serverStamp[0], stamp: stamp}, nil
+}
+
 // NewProxy creates a dnscrypt proxy
 func NewProxy(l Listener) *Proxy {
 	suffixes := critbitgo.NewTrie()
@@ -670,5 +778,6 @@ func NewProxy(l Listener) *Proxy {
 		serversInfo:                  NewServersInfo(),
 		liveServers:                  nil,
 		listener:                     l,
+		events:                       dnsx.NewListenerQueue(dnsx.DefaultListenerQueue),
 	}
 }
@@ -0,0 +1,292 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/kv"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxBlockedNames caps the number of distinct blocked names counted.
+	maxBlockedNames = 4096
+	// blockSaveInterval is the least time between counts persisted.
+	blockSaveInterval = 30 * time.Second
+	// blockCountsKey is the key counts are persisted under.
+	blockCountsKey = kv.BlockCounts + "counts"
+)
+
+// BlockCounter is a BraveDNS that counts the names, and the blocklists, that
+// the BraveDNS it wraps blocks, for display.
+type BlockCounter struct {
+	BraveDNS
+	sync.Mutex
+	total int64
+	today int64
+	// day is the local date today counts blocks of.
+	day   string
+	names map[string]int64
+	lists map[string]int64
+	// now returns the time blocks are counted at, if set.
+	now func() time.Time
+	// s is the store counts are persisted to, if any, last at saved.
+	s     kv.KVStore
+	saved time.Time
+}
+
+// storedBlockCounts are the counts of a BlockCounter, as persisted.
+type storedBlockCounts struct {
+	Total int64            `json:"total"`
+	Today int64            `json:"today"`
+	Day   string           `json:"day"`
+	Names map[string]int64 `json:"names"`
+	Lists map[string]int64 `json:"lists"`
+}
+
+// NewBlockCounter returns a BraveDNS that counts blocks by `b`.
+func NewBlockCounter(b BraveDNS) *BlockCounter {
+	return &BlockCounter{
+		BraveDNS: b,
+		names:    make(map[string]int64),
+		lists:    make(map[string]int64),
+	}
+}
+
+func (c *BlockCounter) date() string {
+	now := time.Now()
+	if c.now != nil {
+		now = c.now()
+	}
+	return now.Format("2006-01-02")
+}
+
+// rollover zeroes today's count on a new day.  Must be called under Lock.
+func (c *BlockCounter) rollover() {
+	if d := c.date(); d != c.day {
+		c.day = d
+		c.today = 0
+	}
+}
+
+// SetStore persists counts to `s`, and adds to them those in s from previous
+// sessions; nil `s` unsets the store.
+func (c *BlockCounter) SetStore(s kv.KVStore) {
+	c.Lock()
+	same := c.s == s
+	c.Unlock()
+	if same {
+		return
+	}
+	var sc storedBlockCounts
+	if s != nil {
+		if v, err := s.Get(blockCountsKey); err != nil {
+			log.Warnf("blockcount: loading counts failed: %v", err)
+		} else if len(v) > 0 && json.Unmarshal(v, &sc) != nil {
+			log.Warnf("blockcount: discarding bad counts")
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.s = s
+	c.saved = time.Now()
+	c.rollover()
+	c.total += sc.Total
+	if sc.Day == c.day {
+		c.today += sc.Today
+	}
+	for n, v := range sc.Names {
+		if _, ok := c.names[n]; ok || len(c.names) < maxBlockedNames {
+			c.names[n] += v
+		}
+	}
+	for l, v := range sc.Lists {
+		c.lists[l] += v
+	}
+}
+
+// save persists the counts to the store, if any, if blockSaveInterval has
+// passed since they last were, or if force.
+func (c *BlockCounter) save(force bool) {
+	c.Lock()
+	s := c.s
+	if s == nil || (!force && time.Since(c.saved) < blockSaveInterval) {
+		c.Unlock()
+		return
+	}
+	c.saved = time.Now()
+	v, err := json.Marshal(storedBlockCounts{
+		Total: c.total,
+		Today: c.today,
+		Day:   c.day,
+		Names: c.names,
+		Lists: c.lists,
+	})
+	c.Unlock()
+	if err == nil {
+		err = s.Put(blockCountsKey, v)
+	}
+	if err != nil {
+		log.Warnf("blockcount: persisting counts failed: %v", err)
+	}
+}
+
+// Save persists counts to the store of SetStore, if any, now.
+func (c *BlockCounter) Save() {
+	c.save(true)
+}
+
+// count accounts for a block of name by lists, a csv.
+func (c *BlockCounter) count(name string, lists string) {
+	defer c.save(false)
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	c.Lock()
+	defer c.Unlock()
+	c.rollover()
+	c.total++
+	c.today++
+	for _, l := range strings.Split(lists, ",") {
+		if l = strings.TrimSpace(l); len(l) > 0 {
+			c.lists[l]++
+		}
+	}
+	if _, ok := c.names[name]; !ok && len(c.names) >= maxBlockedNames {
+		// make room by forgetting names blocked only once
+		for n, v := range c.names {
+			if v <= 1 {
+				delete(c.names, n)
+			}
+		}
+		if len(c.names) >= maxBlockedNames {
+			return
+		}
+	}
+	c.names[name]++
+}
+
+// BlockRequest implements BraveDNS.
+func (c *BlockCounter) BlockRequest(q []byte) (string, error) {
+	lists, err := c.BraveDNS.BlockRequest(q)
+	if err == nil {
+		c.NoteBlock(q, lists)
+	}
+	return lists, err
+}
+
+// BlockResponse implements BraveDNS.
+func (c *BlockCounter) BlockResponse(r []byte) (string, error) {
+	lists, err := c.BraveDNS.BlockResponse(r)
+	if err == nil {
+		c.NoteBlock(r, lists)
+	}
+	return lists, err
+}
+
+// NoteBlock counts a block of the name queried in msg, a query or an answer,
+// by lists, a csv, if any; as of blocks the server of a transport reports.
+func (c *BlockCounter) NoteBlock(msg []byte, lists string) {
+	if len(lists) <= 0 {
+		return
+	}
+	m := new(dns.Msg)
+	if m.Unpack(msg) == nil && len(m.Question) == 1 {
+		c.count(m.Question[0].Name, lists)
+	}
+}
+
+// BlockNoter is implemented by BraveDNS that count blocks, including those
+// they didn't make.
+type BlockNoter interface {
+	// NoteBlock counts a block of the name in msg by lists, a csv.
+	NoteBlock(msg []byte, lists string)
+}
+
+// NoteBlock counts a block of the name in msg by lists, a csv, on b, if b
+// counts blocks; as when the server blocks it, and reports so in a header.
+func NoteBlock(b BraveDNS, msg []byte, lists string) {
+	if n, ok := b.(BlockNoter); ok {
+		n.NoteBlock(msg, lists)
+	}
+}
+
+// BlockResponseType implements BlockResponder for the BraveDNS c wraps.
+func (c *BlockCounter) BlockResponseType(msg []byte) int {
+	return BlockResponseType(c.BraveDNS, msg)
+}
+
+type blockCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type blockSnapshot struct {
+	Total int64        `json:"total"`
+	Today int64        `json:"today"`
+	Top   []blockCount `json:"top"`
+	Lists []blockCount `json:"lists"`
+}
+
+// ranked returns counts in m, highest first, at most n if n > 0.
+func ranked(m map[string]int64, n int) []blockCount {
+	r := make([]blockCount, 0, len(m))
+	for k, v := range m {
+		r = append(r, blockCount{k, v})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Count != r[j].Count {
+			return r[i].Count > r[j].Count
+		}
+		return r[i].Name < r[j].Name
+	})
+	if n > 0 && len(r) > n {
+		r = r[:n]
+	}
+	return r
+}
+
+// Snapshot returns a json snapshot of blocks: in all, today (local time),
+// the `n` most blocked names, and blocks per blocklist, highest first.
+func (c *BlockCounter) Snapshot(n int) string {
+	c.Lock()
+	c.rollover()
+	s := blockSnapshot{
+		Total: c.total,
+		Today: c.today,
+		Top:   ranked(c.names, n),
+		Lists: ranked(c.lists, 0),
+	}
+	c.Unlock()
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// BlockedToday returns the number of blocks today, in local time.
+func (c *BlockCounter) BlockedToday() int64 {
+	c.Lock()
+	defer c.Unlock()
+	c.rollover()
+	return c.today
+}
+
+// Reset zeroes all counts.
+func (c *BlockCounter) Reset() {
+	c.Lock()
+	c.total, c.today = 0, 0
+	c.names = make(map[string]int64)
+	c.lists = make(map[string]int64)
+	c.Unlock()
+	c.save(true)
+}
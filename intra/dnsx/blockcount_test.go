@@ -0,0 +1,99 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/kv"
+)
+
+func TestBlockCounter(t *testing.T) {
+	l := NewLocalBlocklists()
+	l.Load("ads", "0.0.0.0 ads.example\n0.0.0.0 both.example\n")
+	l.Load("trackers", "0.0.0.0 both.example\n")
+	c := NewBlockCounter(l)
+	now := time.Date(2021, 3, 1, 23, 0, 0, 0, time.Local)
+	c.now = func() time.Time { return now }
+	var b BraveDNS = c
+
+	for _, name := range []string{"ads.example.", "both.example.", "Both.Example.", "ok.example."} {
+		b.BlockRequest(packQuery(t, name))
+	}
+	var s blockSnapshot
+	if err := json.Unmarshal([]byte(c.Snapshot(1)), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Total != 3 || s.Today != 3 {
+		t.Errorf("Unexpected totals %+v", s)
+	}
+	if len(s.Top) != 1 || s.Top[0] != (blockCount{"both.example", 2}) {
+		t.Errorf("Unexpected top names %+v", s.Top)
+	}
+	if len(s.Lists) != 2 || s.Lists[0] != (blockCount{"ads", 3}) || s.Lists[1] != (blockCount{"trackers", 2}) {
+		t.Errorf("Unexpected lists %+v", s.Lists)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if n := c.BlockedToday(); n != 0 {
+		t.Errorf("Expected no blocks on a new day, got %d", n)
+	}
+	b.BlockRequest(packQuery(t, "ads.example."))
+	if n := c.BlockedToday(); n != 1 {
+		t.Errorf("Expected 1 block today, got %d", n)
+	}
+	c.Reset()
+	if s := c.Snapshot(10); s != `{"total":0,"today":0,"top":[],"lists":[]}` {
+		t.Errorf("Unexpected snapshot after reset %s", s)
+	}
+}
+
+func TestBlockCounterStore(t *testing.T) {
+	l := NewLocalBlocklists()
+	l.Load("ads", "0.0.0.0 ads.example\n")
+	store := kv.NewMemStore()
+	c := NewBlockCounter(l)
+	c.SetStore(store)
+	c.BlockRequest(packQuery(t, "ads.example."))
+	c.Save()
+
+	// the counts of the next session add to those persisted
+	c = NewBlockCounter(l)
+	c.SetStore(store)
+	c.BlockRequest(packQuery(t, "ads.example."))
+	var s blockSnapshot
+	if err := json.Unmarshal([]byte(c.Snapshot(1)), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Total != 2 || s.Today != 2 || len(s.Top) != 1 || s.Top[0].Count != 2 || s.Lists[0].Count != 2 {
+		t.Errorf("Unexpected persisted counts %+v", s)
+	}
+
+	c.Reset()
+	c = NewBlockCounter(l)
+	c.SetStore(store)
+	if n := c.BlockedToday(); n != 0 {
+		t.Errorf("Reset counts persisted: %d", n)
+	}
+}
+
+func TestNoteBlock(t *testing.T) {
+	l := NewLocalBlocklists()
+	c := NewBlockCounter(l)
+	NoteBlock(c, packQuery(t, "server.example."), "ads")
+	NoteBlock(c, packQuery(t, "ok.example."), "")
+	NoteBlock(l, packQuery(t, "server.example."), "ads")
+	var s blockSnapshot
+	if err := json.Unmarshal([]byte(c.Snapshot(1)), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Total != 1 || len(s.Top) != 1 || s.Top[0] != (blockCount{"server.example", 1}) {
+		t.Errorf("Unexpected counts of noted blocks %+v", s)
+	}
+}
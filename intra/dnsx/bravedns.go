@@ -7,17 +7,19 @@
 package dnsx
 
 import (
-	b64 "encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
+	"unsafe"
 
+	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/miekg/dns"
 
 	"github.com/celzero/firestack/intra/xdns"
@@ -40,6 +42,9 @@ type BraveDNS interface {
 
 	GetStamp() (string, error)
 
+	// LockStamp sets the stamp and prevents any subsequent change to it.
+	LockStamp(string) error
+
 	// GetBlocklistStampHeaderKey returns the http-header key for blocklists stamp
 	GetBlocklistStampHeaderKey() string
 
@@ -51,6 +56,68 @@ type BraveDNS interface {
 	BlockResponse([]byte) (string, error)
 }
 
+// aliases returns the names that the name queried in msg is aliased to, in
+// the order of its chain of CNAMEs, followed by targets of CNAMEs not in the
+// chain, if any.
+func aliases(msg *dns.Msg) []string {
+	targets := make(map[string]string)
+	var all []string
+	for _, rr := range msg.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			owner := dns.CanonicalName(cname.Hdr.Name)
+			if _, ok := targets[owner]; !ok {
+				targets[owner] = cname.Target
+			}
+			all = append(all, cname.Target)
+		}
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	var names []string
+	seen := make(map[string]bool)
+	if len(msg.Question) == 1 {
+		name := dns.CanonicalName(msg.Question[0].Name)
+		// bounded by the number of cnames, should the chain loop
+		for i := 0; i < len(all); i++ {
+			target, ok := targets[name]
+			if !ok {
+				break
+			}
+			name = dns.CanonicalName(target)
+			if seen[name] {
+				break
+			}
+			seen[name] = true
+			names = append(names, target)
+		}
+	}
+	for _, target := range all {
+		if !seen[dns.CanonicalName(target)] {
+			seen[dns.CanonicalName(target)] = true
+			names = append(names, target)
+		}
+	}
+	return names
+}
+
+// BlockResponder is implemented by BraveDNS that choose, per rule, the type
+// of answer to queries they block.
+type BlockResponder interface {
+	// BlockResponseType returns the xdns block response type for msg, a
+	// query or an answer that was blocked.
+	BlockResponseType(msg []byte) int
+}
+
+// BlockResponseType returns the xdns block response type b chooses for msg,
+// a query or an answer b blocked, or xdns.BlockDefault.
+func BlockResponseType(b BraveDNS, msg []byte) int {
+	if r, ok := b.(BlockResponder); ok {
+		return r.BlockResponseType(msg)
+	}
+	return xdns.BlockDefault
+}
+
 type bravedns struct {
 	BraveDNS
 	trie  *trie.FrozenTrie
@@ -58,6 +125,14 @@ type bravedns struct {
 	tags  map[string]string
 	mode  int
 	stamp string
+	// locked is true when stamp must not be changed.
+	locked bool
+	// schedules are windows of time blocklist-ids are in effect; see
+	// AddSchedule.
+	schedmu   sync.RWMutex
+	schedules map[string][]*window
+	// now returns the time schedules are evaluated at, if set.
+	now func() time.Time
 }
 
 func (brave *bravedns) OnDeviceBlock() bool {
@@ -74,6 +149,9 @@ func (brave *bravedns) GetStamp() (s string, err error) {
 }
 
 func (brave *bravedns) SetStamp(stamp string) error {
+	if brave.locked {
+		return errors.New("stamp locked")
+	}
 	// validate
 	if _, err := brave.StampToNames(stamp); err != nil {
 		return err
@@ -82,13 +160,27 @@ func (brave *bravedns) SetStamp(stamp string) error {
 	return nil
 }
 
+func (brave *bravedns) LockStamp(stamp string) error {
+	if brave.locked {
+		if brave.stamp == stamp {
+			return nil
+		}
+		return errors.New("stamp already locked")
+	}
+	if err := brave.SetStamp(stamp); err != nil {
+		return err
+	}
+	brave.locked = true
+	return nil
+}
+
 func (brave *bravedns) GetBlocklistStampHeaderKey() string {
 	return http.CanonicalHeaderKey(blocklistHeaderKey)
 }
 
 func (brave *bravedns) StampToNames(stamp string) (string, error) {
 	if len(stamp) <= 0 {
-		errors.New("empty blocklist stamp")
+		return "", errors.New("empty blocklist stamp")
 	}
 
 	var blocklists []string
@@ -144,10 +236,12 @@ func (brave *bravedns) blockUnpackedRequest(msg *dns.Msg) (r string, err error)
 	block, lists := brave.trie.DNlookup(qname, stamp)
 	// TODO: handle empty lists as err?
 	if block {
-		r = strings.Join(brave.keyToNames(lists), ",")
-		return
+		if lists = brave.scheduled(lists); len(lists) > 0 {
+			r = strings.Join(brave.keyToNames(lists), ",")
+			return
+		}
 	}
-	err = fmt.Errorf("%v name not in blocklist %s [%s]", qname, stamp, block)
+	err = fmt.Errorf("%v name not in blocklist %s in effect [%t]", qname, stamp, block)
 	return
 }
 
@@ -169,42 +263,26 @@ func (brave *bravedns) blockUnpackedResponse(msg *dns.Msg) (r string, err error)
 		return
 	}
 
-	cnamed := false
-	anstype := dns.TypeNone
-	ansname := ""
 	// TODO: SVCB/HTTPS tools.ietf.org/html/draft-ietf-dnsop-svcb-https-01
-	for _, a := range msg.Answer {
-		switch a.(type) {
-		case *dns.CNAME:
-			cnamed = true
-		case *dns.A:
-			anstype = dns.TypeA
-			ansname = a.Header().Name
-		case *dns.AAAA:
-			anstype = dns.TypeAAAA
-			ansname = a.Header().Name
-		default:
-			// nothing to do
-		}
-	}
-	if cnamed == false || len(ansname) <= 0 {
+	names := aliases(msg)
+	if len(names) <= 0 {
 		err = fmt.Errorf("not cnamed")
 		return
 	}
-	if anstype != dns.TypeAAAA && anstype != dns.TypeA {
-		err = fmt.Errorf("not a or aaaa")
-		return
-	}
-	// err when incoming name != ascii, ignore
-	ansname, _ = xdns.NormalizeQName(ansname)
-
-	block, lists := brave.trie.DNlookup(ansname, stamp)
-	// TODO: handle empty lists as err?
-	if block {
-		r = strings.Join(brave.keyToNames(lists), ",")
-		return
+	// trackers cloak behind first-party names anywhere in the chain
+	for _, name := range names {
+		// err when incoming name != ascii, ignore
+		name, _ = xdns.NormalizeQName(name)
+		block, lists := brave.trie.DNlookup(name, stamp)
+		// TODO: handle empty lists as err?
+		if block {
+			if lists = brave.scheduled(lists); len(lists) > 0 {
+				r = strings.Join(brave.keyToNames(lists), ",")
+				return
+			}
+		}
 	}
-	err = fmt.Errorf("%v cloaked domain not in blocklist %s", ansname, stamp)
+	err = fmt.Errorf("%v cloaked domains not in blocklist %s", names, stamp)
 	return
 }
 
@@ -220,6 +298,10 @@ func NewBraveDNSRemote(listinfo string) (BraveDNS, error) {
 	}, nil
 }
 
+// NewBraveDNSLocal returns a BraveDNS that blocks on-device with the trie
+// compiled into the files at `t` and `rank`, which are mapped into memory
+// rather than read onto the heap, and so mustn't change while in use; of
+// `conf`, its basic config, and `listinfo`, its blocklists.
 func NewBraveDNSLocal(t string, rank string,
 	conf string, listinfo string) (BraveDNS, error) {
 
@@ -227,28 +309,88 @@ func NewBraveDNSLocal(t string, rank string,
 		return nil, errors.New("missing data, unable to build blocklist")
 	}
 
-	err, trie := trie.Build(t, rank, conf, listinfo)
+	td, unmapTD, err := mapTrie(t)
+	if err != nil {
+		return nil, err
+	}
+	rd, unmapRD, err := mapTrie(rank)
+	if err != nil {
+		unmapTD()
+		return nil, err
+	}
+	unmap := func() {
+		unmapTD()
+		unmapRD()
+	}
 
+	nodecount, err := trie.LoadNodecount_BasicConfig(conf)
 	if err != nil {
+		unmap()
+		return nil, err
+	}
+	var dir trie.RankDirectory
+	dir.Init(rd, td, *nodecount*2+1, trie.L1, trie.L2, nil)
+	ft := &trie.FrozenTrie{}
+	ft.Init(td, dir, *nodecount)
+	if err := ft.LoadTag(listinfo); err != nil {
+		unmap()
 		return nil, err
 	}
 
 	flags, tags, err := load(listinfo)
 
 	if err != nil {
+		unmap()
 		return nil, err
 	}
 
-	// TODO: find a better place
-	runtime.GC()
-
 	// https://docs.pi-hole.net/ftldns/blockingmode/
-	return &bravedns{
-		trie:  &trie,
+	brave := &bravedns{
+		trie:  ft,
 		flags: flags,
 		tags:  tags,
 		mode:  localBlock,
-	}, nil
+	}
+	// the trie, and so the mapping, is brave's alone
+	runtime.SetFinalizer(brave, func(*bravedns) { unmap() })
+	return brave, nil
+}
+
+// littleEndian is true if the host is, as the trie files are.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// mapTrie maps the trie file at path, of little-endian uint16s, into memory,
+// and returns them, and a func to unmap them.  On big-endian hosts, they are
+// read onto the heap instead.
+func mapTrie(path string) ([]uint16, func(), error) {
+	b, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() {
+		if err := unmap(); err != nil {
+			log.Warnf("unmapping %s failed: %v", path, err)
+		}
+	}
+	if len(b) < 2 || len(b)%2 != 0 || len(b)/2 > 1<<30 {
+		release()
+		return nil, nil, fmt.Errorf("trie file %s of bad size %d", path, len(b))
+	}
+	n := len(b) / 2
+	if !littleEndian {
+		u16 := make([]uint16, n)
+		for i := range u16 {
+			u16[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+		release()
+		return u16, func() {}, nil
+	}
+	// maps are page-aligned, and files read onto the heap word-aligned
+	u16 := (*[1 << 30]uint16)(unsafe.Pointer(&b[0]))[:n:n]
+	return u16, release, nil
 }
 
 func load(blacklistconfigjson string) ([]string, map[string]string, error) {
@@ -286,91 +428,26 @@ func load(blacklistconfigjson string) ([]string, map[string]string, error) {
 }
 
 func (brave *bravedns) decode(stamp string, ver string) (tags []string, err error) {
-	decoder := b64.StdEncoding
-	if ver == "0" {
-		stamp, err = url.QueryUnescape(stamp)
-	} else if ver == "1" {
-		stamp, err = url.PathUnescape(stamp)
-		decoder = b64.URLEncoding
-	} else {
-		err = fmt.Errorf("version does not exist", ver)
-	}
-	if err != nil {
-		return nil, err
-	}
-
-	buf, err := decoder.DecodeString(stamp)
+	u16, err := decodeFlags(stamp, ver)
 	if err != nil {
 		return
 	}
-
-	var u16 []uint16
-	if ver == "0" {
-		u16 = stringtouint(string(buf))
-	} else if ver == "1" {
-		u16 = bytestouint(buf)
-	} else {
-		err = fmt.Errorf("unimplemented header stamp version %v", ver)
-		return
-	}
 	return brave.flagstotag(u16)
 }
 
 func (brave *bravedns) flagstotag(flags []uint16) ([]string, error) {
-	// flags has to be an array of 16-bit integers.
-
-	// first index always contains the header
-	header := uint16(flags[0])
-	// store of each big-endian position of set bits in header
-	tagIndices := []int{}
-	values := []string{}
-	var mask uint16
-
-	// b1000,0000,0000,0000
-	mask = 0x8000
-
-	// read first 16 header bits from msb to lsb
-	// and capture indices of set bits in tagIndices
-	for i := 0; i < 16; i++ {
-		if (header << i) == 0 {
-			break
-		}
-		if (header & mask) == mask {
-			tagIndices = append(tagIndices, i)
-		}
-		mask = mask >> 1 // shift to read the next msb bit
-	}
-	// the number of set bits in header must correspond to total
-	// blocklist "flags" excluding the header at position 0
-	if len(tagIndices) != (len(flags) - 1) {
-		err := fmt.Errorf("%v %v flags and header mismatch", tagIndices, flags)
+	ids, err := flagsToIDs(flags)
+	if err != nil {
 		return nil, err
 	}
-
-	// for all blocklist flags excluding the header
-	// figure out the blocklist-ids
-	for i := 1; i < len(flags); i++ {
-		// 16 blocklists are represented by one flag
-		// that is, one bit per blocklist
-		var flag = uint16(flags[i])
-		// get the index of the current flag in the header
-		var index = tagIndices[i-1]
-		mask = 0x8000
-		// for each of the 16 bits in the flag
-		// capture the set bits and calculate
-		// its actual decimal value, the blocklist-id
-		for j := 0; j < 16; j++ {
-			if (flag << j) == 0 {
-				break
-			}
-			if (flag & mask) == mask {
-				pos := (index * 16) + j
-				// from the decimal value which is its
-				// blocklist-id, fetch its metadata
-				values = append(values, brave.flags[pos])
-			}
-			mask = mask >> 1
+	values := []string{}
+	for _, id := range ids {
+		if id >= len(brave.flags) {
+			return nil, fmt.Errorf("blocklist-id %d out of range", id)
 		}
+		// from the decimal value which is its
+		// blocklist-id, fetch its metadata
+		values = append(values, brave.flags[id])
 	}
 	return values, nil
 }
@@ -0,0 +1,516 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/diag"
+	"github.com/celzero/firestack/intra/kv"
+	"github.com/celzero/firestack/intra/qlog"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultCacheSize is the number of responses cached if unspecified.
+	defaultCacheSize = 1024
+	// maxCacheTTL caps how long any response is cached.
+	maxCacheTTL = 24 * time.Hour
+	// negativeTTL is how long responses without a TTL to go by are cached.
+	negativeTTL = 30 * time.Second
+	// prefetchFraction is the fraction of its TTL left on a response once it
+	// is due for a refresh, if it is popular.
+	prefetchFraction = 5
+)
+
+type cacheEntry struct {
+	q      []byte    // query that msg answers, to refresh msg with
+	msg    *dns.Msg  // response, as received
+	stored time.Time // when msg was cached
+	expiry time.Time
+	// hits is the number of times msg, or a response it replaced, was served
+	hits       int64
+	refreshing bool
+}
+
+// CachingTransport answers repeat queries from responses cached for as long
+// as their TTLs allow, and forwards the rest to the Transport it wraps.
+// Responses to the most queried names may be refreshed ahead of expiry.
+type CachingTransport struct {
+	sync.RWMutex
+	Transport
+	size  int
+	cache map[string]*cacheEntry
+	hits  int64
+	total int64
+	// prefetch is the number of most queried names refreshed before expiry.
+	prefetch   int
+	prefetches int64
+	// s is the store responses are persisted to, if any.
+	s kv.KVStore
+}
+
+// storedEntry is a cacheEntry as persisted.
+type storedEntry struct {
+	Q      []byte    `json:"q"`
+	R      []byte    `json:"r"`
+	Stored time.Time `json:"stored"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// NewCachingTransport returns a Transport that caches up to `size`
+// responses of `t`; a size of zero or less picks a default.
+func NewCachingTransport(t Transport, size int) Transport {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	return &CachingTransport{
+		Transport: t,
+		size:      size,
+		cache:     make(map[string]*cacheEntry),
+	}
+}
+
+// Inner implements Wrapper.
+func (c *CachingTransport) Inner() Transport {
+	return c.Transport
+}
+
+func cacheKey(m *dns.Msg) (string, bool) {
+	if len(m.Question) != 1 {
+		return "", false
+	}
+	q := m.Question[0]
+	return strings.ToLower(q.Name) + ":" + strconv.Itoa(int(q.Qtype)) + ":" + strconv.Itoa(int(q.Qclass)), true
+}
+
+// Query answers q from cache if possible; otherwise from the inner Transport.
+func (c *CachingTransport) Query(q []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return c.Transport.Query(q)
+	}
+	key, ok := cacheKey(msg)
+	if !ok {
+		return c.Transport.Query(q)
+	}
+
+	c.Lock()
+	c.total++
+	c.Unlock()
+	if r := c.get(key, msg.Id); r != nil {
+		qlog.CacheHit()
+		return r, nil
+	}
+
+	r, err := c.Transport.Query(q)
+	if err == nil {
+		c.put(key, q, r)
+	}
+	return r, err
+}
+
+// cached answers q from cache alone, or returns nil on a miss.
+func (c *CachingTransport) cached(q []byte) []byte {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return nil
+	}
+	key, ok := cacheKey(msg)
+	if !ok {
+		return nil
+	}
+	c.Lock()
+	c.total++
+	c.Unlock()
+	r := c.get(key, msg.Id)
+	if r != nil {
+		qlog.CacheHit()
+	}
+	return r
+}
+
+// cacheOnly answers queries from the CachingTransport it wraps, if any, and SERVFAILs
+// the rest, without a query upstream.
+type cacheOnly struct {
+	Transport
+}
+
+// CacheOnly returns a Transport that answers queries from the CachingTransport in `t`'s
+// chain of wrappers alone, as when the tunnel is paused; misses are SERVFAILed.
+func CacheOnly(t Transport) Transport {
+	return &cacheOnly{t}
+}
+
+// Inner implements Wrapper.
+func (o *cacheOnly) Inner() Transport {
+	return o.Transport
+}
+
+// Query implements Transport.
+func (o *cacheOnly) Query(q []byte) ([]byte, error) {
+	var r []byte
+	walk(o.Transport, func(t Transport) bool {
+		c, ok := t.(*CachingTransport)
+		if ok {
+			r = c.cached(q)
+		}
+		return ok
+	})
+	if r != nil {
+		return r, nil
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return nil, err
+	}
+	return new(dns.Msg).SetRcode(msg, dns.RcodeServerFailure).Pack()
+}
+
+// SetPrefetch refreshes responses to the `n` most queried names as they near
+// expiry, so that the names never miss the cache while in use; zero disables
+// refreshes.
+func (c *CachingTransport) SetPrefetch(n int) {
+	c.Lock()
+	c.prefetch = n
+	c.Unlock()
+}
+
+// SetCachePrefetch sets the CachingTransport in `t`'s chain of wrappers to
+// refresh responses to its `n` most queried names ahead of expiry.
+func SetCachePrefetch(t Transport, n int) error {
+	found := walk(t, func(t Transport) bool {
+		c, ok := t.(*CachingTransport)
+		if ok {
+			c.SetPrefetch(n)
+		}
+		return ok
+	})
+	if !found {
+		return errors.New("no caching transport")
+	}
+	return nil
+}
+
+// Prefetches returns the number of responses refreshed ahead of expiry.
+func (c *CachingTransport) Prefetches() int64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.prefetches
+}
+
+// popular reports whether e is among the c.prefetch most served entries.
+// Must be called under Lock.
+func (c *CachingTransport) popular(e *cacheEntry) bool {
+	ahead := 0
+	for _, o := range c.cache {
+		if o.hits > e.hits {
+			if ahead++; ahead >= c.prefetch {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// refresh re-sends e's query upstream, and caches the response.
+func (c *CachingTransport) refresh(key string, e *cacheEntry) {
+	r, err := c.Transport.Query(e.q)
+	if err != nil {
+		log.Debugf("cache refresh of %s failed: %v", key, err)
+		c.Lock()
+		e.refreshing = false
+		c.Unlock()
+		return
+	}
+	c.put(key, e.q, r)
+	c.Lock()
+	c.prefetches++
+	c.Unlock()
+}
+
+// Hits returns the number of queries answered from cache, and the number of
+// queries handled in all.
+func (c *CachingTransport) Hits() (hits int64, total int64) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.hits, c.total
+}
+
+// SetBraveDNS sets b on the inner Transport, and evicts responses that
+// were cached under the previous blocklists.
+func (c *CachingTransport) SetBraveDNS(b BraveDNS) {
+	c.Clear()
+	c.Transport.SetBraveDNS(b)
+}
+
+// Clear evicts all cached responses, say, on a network change.
+func (c *CachingTransport) Clear() {
+	c.Lock()
+	c.cache = make(map[string]*cacheEntry)
+	s := c.s
+	c.Unlock()
+	if s != nil {
+		if err := kv.Forget(s, c.prefix()); err != nil {
+			log.Warnf("cache: forgetting persisted responses failed: %v", err)
+		}
+	}
+}
+
+// prefix is the prefix of the keys c persists responses under.
+func (c *CachingTransport) prefix() string {
+	return kv.DNSCache + c.Transport.GetURL() + "|"
+}
+
+// SetStore persists responses c caches to `s`, and caches those in s from
+// previous sessions that are yet to expire; nil `s` unsets the store.
+func (c *CachingTransport) SetStore(s kv.KVStore) {
+	c.Lock()
+	c.s = s
+	c.Unlock()
+	if s == nil {
+		return
+	}
+
+	prefix := c.prefix()
+	now := time.Now()
+	var stale []string
+	err := s.Scan(prefix, kv.VisitFunc(func(k string, v []byte) bool {
+		var se storedEntry
+		m := new(dns.Msg)
+		if json.Unmarshal(v, &se) != nil || now.After(se.Expiry) || m.Unpack(se.R) != nil {
+			stale = append(stale, k)
+			return true
+		}
+		c.Lock()
+		defer c.Unlock()
+		if len(c.cache) >= c.size {
+			return false
+		}
+		c.cache[strings.TrimPrefix(k, prefix)] = &cacheEntry{q: se.Q, msg: m, stored: se.Stored, expiry: se.Expiry}
+		return true
+	}))
+	if err != nil {
+		log.Warnf("cache: loading persisted responses failed: %v", err)
+	}
+	for _, k := range stale {
+		s.Put(k, nil)
+	}
+}
+
+// SetCacheStore sets the CachingTransport in `t`'s chain of wrappers to
+// persist its responses to `s`.
+func SetCacheStore(t Transport, s kv.KVStore) error {
+	found := walk(t, func(t Transport) bool {
+		c, ok := t.(*CachingTransport)
+		if ok {
+			c.SetStore(s)
+		}
+		return ok
+	})
+	if !found {
+		return errors.New("no caching transport")
+	}
+	return nil
+}
+
+// persist writes e, of r, for key to s, and forgets the dropped keys in it.
+func (c *CachingTransport) persist(s kv.KVStore, key string, e *cacheEntry, r []byte, dropped []string) {
+	prefix := c.prefix()
+	for _, k := range dropped {
+		s.Put(prefix+k, nil)
+	}
+	if e == nil {
+		return
+	}
+	v, err := json.Marshal(storedEntry{Q: e.q, R: r, Stored: e.stored, Expiry: e.expiry})
+	if err == nil {
+		err = s.Put(prefix+key, v)
+	}
+	if err != nil {
+		log.Warnf("cache: persisting %s failed: %v", key, err)
+	}
+}
+
+// SetSize caches up to `size` responses, evicting those past it; a size of
+// zero or less picks the default.
+func (c *CachingTransport) SetSize(size int) {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	var dropped []string
+	c.Lock()
+	c.size = size
+	if len(c.cache) > size {
+		dropped = c.evict(time.Now())
+	}
+	s := c.s
+	c.Unlock()
+	if s != nil {
+		c.persist(s, "", nil, nil, dropped)
+	}
+}
+
+// SetCacheSize sets the CachingTransport in `t`'s chain of wrappers to cache
+// up to `size` responses.
+func SetCacheSize(t Transport, size int) error {
+	found := walk(t, func(t Transport) bool {
+		c, ok := t.(*CachingTransport)
+		if ok {
+			c.SetSize(size)
+		}
+		return ok
+	})
+	if !found {
+		return errors.New("no caching transport")
+	}
+	return nil
+}
+
+// ClearCache evicts all responses cached by the CachingTransport in `t`'s
+// chain of wrappers.
+func ClearCache(t Transport) error {
+	found := walk(t, func(t Transport) bool {
+		c, ok := t.(*CachingTransport)
+		if ok {
+			c.Clear()
+		}
+		return ok
+	})
+	if !found {
+		return errors.New("no caching transport")
+	}
+	return nil
+}
+
+// get returns the cached response for key with id as its query id and TTLs
+// that reflect the time elapsed since it was cached, or nil on a miss.
+func (c *CachingTransport) get(key string, id uint16) []byte {
+	c.RLock()
+	e := c.cache[key]
+	c.RUnlock()
+	now := time.Now()
+	if e == nil || now.After(e.expiry) {
+		return nil
+	}
+
+	m := e.msg.Copy()
+	m.Id = id
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl > age {
+				h.Ttl -= age
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+	r, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	c.Lock()
+	c.hits++
+	e.hits++
+	lifetime := e.expiry.Sub(e.stored)
+	if c.prefetch > 0 && !e.refreshing && e.expiry.Sub(now) < lifetime/prefetchFraction && c.popular(e) {
+		e.refreshing = true
+		diag.Go(diag.DNS, func() {
+			c.refresh(key, e)
+		})
+	}
+	c.Unlock()
+	return r
+}
+
+// put caches r, the response to q, for key, if it is cacheable.
+func (c *CachingTransport) put(key string, q []byte, r []byte) {
+	m := new(dns.Msg)
+	if err := m.Unpack(r); err != nil {
+		return
+	}
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl, ok := minTTL(m)
+	if !ok {
+		ttl = negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+
+	now := time.Now()
+	e := &cacheEntry{q: append([]byte(nil), q...), msg: m, stored: now, expiry: now.Add(ttl)}
+	var dropped []string
+	c.Lock()
+	if old, ok := c.cache[key]; ok {
+		e.hits = old.hits
+	} else if len(c.cache) >= c.size {
+		dropped = c.evict(now)
+	}
+	c.cache[key] = e
+	s := c.s
+	c.Unlock()
+	if s != nil {
+		c.persist(s, key, e, r, dropped)
+	}
+}
+
+// evict drops expired entries, or else an arbitrary one, to make room, and
+// returns the keys dropped.  Must be called under Lock.
+func (c *CachingTransport) evict(now time.Time) (dropped []string) {
+	for k, e := range c.cache {
+		if now.After(e.expiry) {
+			delete(c.cache, k)
+			dropped = append(dropped, k)
+		}
+	}
+	for k := range c.cache {
+		if len(c.cache) < c.size {
+			return
+		}
+		delete(c.cache, k)
+		dropped = append(dropped, k)
+	}
+	return
+}
+
+// minTTL returns the lowest TTL of records in m's answer and authority
+// sections; for negative answers, the SOA minimum caps it (RFC 2308).
+// Returns false if m has no such records.
+func minTTL(m *dns.Msg) (time.Duration, bool) {
+	var min uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			ttl := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok && len(m.Answer) == 0 && soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			if !found || ttl < min {
+				min = ttl
+				found = true
+			}
+		}
+	}
+	return time.Duration(min) * time.Second, found
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/kv"
+	"github.com/miekg/dns"
+)
+
+type fakeTransport struct {
+	queries int
+	ttl     uint32
+	rcode   int
+}
+
+func (f *fakeTransport) Query(q []byte) ([]byte, error) {
+	f.queries++
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	r.SetRcode(msg, f.rcode)
+	if f.rcode == dns.RcodeSuccess {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: f.ttl},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+	}
+	return r.Pack()
+}
+
+func (f *fakeTransport) GetURL() string {
+	return "fake"
+}
+
+func (f *fakeTransport) SetBraveDNS(BraveDNS) {}
+
+func query(t *testing.T, tr Transport, name string, id uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	q.Id = id
+	b, _ := q.Pack()
+	r, err := tr.Query(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(r); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestCacheHit(t *testing.T) {
+	f := &fakeTransport{ttl: 60}
+	c := NewCachingTransport(f, 0)
+
+	query(t, c, "example.com.", 1)
+	r := query(t, c, "EXAMPLE.com.", 2)
+	if f.queries != 1 {
+		t.Errorf("Expected 1 upstream query, got %d", f.queries)
+	}
+	if r.Id != 2 {
+		t.Errorf("Cached response has id %d", r.Id)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].Header().Ttl > 60 {
+		t.Errorf("Wrong cached answer %v", r.Answer)
+	}
+	query(t, c, "example.org.", 3)
+	if f.queries != 2 {
+		t.Errorf("Expected a miss for another name")
+	}
+	if hits, total := c.(*CachingTransport).Hits(); hits != 1 || total != 3 {
+		t.Errorf("Wrong hits %d/%d", hits, total)
+	}
+	if Unwrap(c) != f {
+		t.Error("Unwrap should return the inner transport")
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	f := &fakeTransport{ttl: 1}
+	c := NewCachingTransport(f, 0)
+	query(t, c, "example.com.", 1)
+	time.Sleep(1100 * time.Millisecond)
+	query(t, c, "example.com.", 2)
+	if f.queries != 2 {
+		t.Errorf("Expired response answered from cache")
+	}
+}
+
+func TestCacheSkipsFailures(t *testing.T) {
+	f := &fakeTransport{rcode: dns.RcodeServerFailure}
+	c := NewCachingTransport(f, 0)
+	query(t, c, "example.com.", 1)
+	query(t, c, "example.com.", 2)
+	if f.queries != 2 {
+		t.Errorf("SERVFAIL should not be cached")
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	f := &fakeTransport{ttl: 60}
+	c := NewCachingTransport(f, 2).(*CachingTransport)
+	query(t, c, "a.example.", 1)
+	query(t, c, "b.example.", 2)
+	query(t, c, "c.example.", 3)
+	if len(c.cache) > 2 {
+		t.Errorf("Cache grew beyond its size: %d", len(c.cache))
+	}
+}
+
+func TestSetCacheSize(t *testing.T) {
+	f := &fakeTransport{ttl: 60}
+	c := NewCachingTransport(f, 4).(*CachingTransport)
+	for i, name := range []string{"a.example.", "b.example.", "c.example."} {
+		query(t, c, name, uint16(i))
+	}
+	if err := SetCacheSize(NewCoalescer(c), 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.cache) > 1 {
+		t.Errorf("Cache not shrunk: %d", len(c.cache))
+	}
+	if err := ClearCache(c); err != nil || len(c.cache) != 0 {
+		t.Errorf("Cache not cleared: %d, %v", len(c.cache), err)
+	}
+	if err := SetCacheSize(f, 1); err == nil {
+		t.Error("Sized a transport without a cache")
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+	store := kv.NewMemStore()
+	f := &fakeTransport{ttl: 60}
+	c := NewCachingTransport(f, 0)
+	if err := SetCacheStore(c, store); err != nil {
+		t.Fatal(err)
+	}
+	query(t, c, "example.com.", 1)
+
+	// a cache of the next session answers from the store
+	f2 := &fakeTransport{ttl: 60}
+	c2 := NewCachingTransport(f2, 0)
+	SetCacheStore(NewCoalescer(c2), store)
+	if r := query(t, c2, "example.com.", 2); f2.queries != 0 || len(r.Answer) != 1 || r.Id != 2 {
+		t.Errorf("Persisted response not answered: %d upstream, %v", f2.queries, r)
+	}
+
+	ClearCache(c2)
+	f3 := &fakeTransport{ttl: 60}
+	c3 := NewCachingTransport(f3, 0)
+	SetCacheStore(c3, store)
+	if query(t, c3, "example.com.", 3); f3.queries != 1 {
+		t.Error("Cleared response answered from the store")
+	}
+	if err := SetCacheStore(f3, store); err == nil {
+		t.Error("Stored a transport without a cache")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	f := &fakeTransport{ttl: 1}
+	c := NewCachingTransport(f, 0).(*CachingTransport)
+	if err := SetCachePrefetch(NewTruncationRetrier(c, f), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetCachePrefetch(f, 1); err == nil {
+		t.Error("Expected error without a caching transport")
+	}
+
+	query(t, c, "example.com.", 1)
+	query(t, c, "example.org.", 2)
+	query(t, c, "example.org.", 3)
+	query(t, c, "example.org.", 3)
+	// Near expiry, only the most queried name is refreshed.
+	time.Sleep(850 * time.Millisecond)
+	query(t, c, "example.com.", 4)
+	query(t, c, "example.org.", 5)
+	for i := 0; i < 100 && c.Prefetches() < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := c.Prefetches(); n != 1 {
+		t.Fatalf("Expected 1 prefetch, got %d", n)
+	}
+	if f.queries != 3 {
+		t.Errorf("Expected 3 upstream queries, got %d", f.queries)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	query(t, c, "example.org.", 6)
+	if f.queries != 3 {
+		t.Error("Refreshed response not served")
+	}
+	query(t, c, "example.com.", 7)
+	if f.queries != 4 {
+		t.Error("Unpopular response should have expired")
+	}
+}
+
+func TestCacheOnly(t *testing.T) {
+	f := &fakeTransport{ttl: 60}
+	c := NewCachingTransport(f, 0)
+	query(t, c, "example.com.", 1)
+
+	o := CacheOnly(c)
+	if r := query(t, o, "example.com.", 2); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Errorf("Expected cached answer, got %v", r)
+	}
+	if r := query(t, o, "example.org.", 3); r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected servfail on a miss, got %v", r)
+	}
+	if r := query(t, CacheOnly(f), "example.com.", 4); r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected servfail sans cache, got %v", r)
+	}
+	if f.queries != 1 {
+		t.Errorf("Expected no upstream queries, got %d", f.queries-1)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// call is an upstream query in flight, that identical queries wait on.
+type call struct {
+	done chan struct{}
+	res  []byte
+	err  error
+}
+
+// Coalescer sends identical queries (same name, type, and class) that are
+// in flight at the same time as a single query to the Transport it wraps,
+// and fans the answer out to all of them.
+type Coalescer struct {
+	sync.Mutex
+	Transport
+	calls     map[string]*call
+	coalesced int64
+}
+
+// NewCoalescer returns a Transport that coalesces identical queries to `t`.
+func NewCoalescer(t Transport) Transport {
+	return &Coalescer{Transport: t, calls: make(map[string]*call)}
+}
+
+// Inner implements Wrapper.
+func (c *Coalescer) Inner() Transport {
+	return c.Transport
+}
+
+// Query implements Transport.
+func (c *Coalescer) Query(q []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return c.Transport.Query(q)
+	}
+	key, ok := cacheKey(msg)
+	if !ok {
+		return c.Transport.Query(q)
+	}
+
+	c.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.coalesced++
+		c.Unlock()
+		<-cl.done
+		if cl.err != nil {
+			return nil, cl.err
+		}
+		return withID(cl.res, msg.Id), nil
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.Unlock()
+
+	cl.res, cl.err = c.Transport.Query(q)
+	c.Lock()
+	delete(c.calls, key)
+	c.Unlock()
+	close(cl.done)
+	return cl.res, cl.err
+}
+
+// Coalesced returns the number of queries answered with another's answer.
+func (c *Coalescer) Coalesced() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.coalesced
+}
+
+// withID returns a copy of the response r with id as its query id.
+func withID(r []byte, id uint16) []byte {
+	b := append([]byte(nil), r...)
+	if len(b) >= 2 {
+		b[0] = byte(id >> 8)
+		b[1] = byte(id)
+	}
+	return b
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// blockingTransport answers queries once release is closed.
+type blockingTransport struct {
+	fakeTransport
+	sync.Mutex
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingTransport) Query(q []byte) ([]byte, error) {
+	b.Lock()
+	first := b.queries == 0
+	b.Unlock()
+	if first {
+		close(b.started)
+	}
+	<-b.release
+	b.Lock()
+	defer b.Unlock()
+	return b.fakeTransport.Query(q)
+}
+
+func TestCoalesce(t *testing.T) {
+	b := &blockingTransport{
+		fakeTransport: fakeTransport{ttl: 60},
+		started:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	c := NewCoalescer(b).(*Coalescer)
+
+	const n = 5
+	ids := make(chan uint16, n)
+	var wg sync.WaitGroup
+	ask := func(id uint16) {
+		defer wg.Done()
+		msg := query(t, c, "example.com.", id)
+		if len(msg.Answer) != 1 {
+			t.Error("Missing answer")
+		}
+		ids <- msg.Id
+	}
+	wg.Add(1)
+	go ask(1)
+	<-b.started
+	for i := 2; i <= n; i++ {
+		wg.Add(1)
+		go ask(uint16(i))
+	}
+	// Wait for the rest to join the query in flight.
+	for c.Coalesced() < n-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(b.release)
+	wg.Wait()
+	close(ids)
+
+	if b.queries != 1 {
+		t.Errorf("Expected 1 upstream query, got %d", b.queries)
+	}
+	seen := make(map[uint16]bool)
+	for id := range ids {
+		seen[id] = true
+	}
+	if len(seen) != n {
+		t.Errorf("Answers with wrong ids %v", seen)
+	}
+}
+
+func TestCoalesceDistinct(t *testing.T) {
+	f := &fakeTransport{ttl: 60}
+	c := NewCoalescer(f)
+	query(t, c, "example.com.", 1)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	b, _ := q.Pack()
+	c.Query(b)
+	if f.queries != 2 {
+		t.Errorf("Sequential queries should not be coalesced")
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEs caps the length of the CNAME chains Describe follows.
+const maxCNAMEs = 16
+
+// Description is the question of a query, and its answer, as summaries
+// report them, so that apps needn't parse queries and responses themselves.
+type Description struct {
+	// QName is the name queried, without the trailing dot, and QType, its type.
+	QName string
+	QType int
+	// RCode is the rcode of the response, or -1 if there's none.
+	RCode int
+	// IPs is the csv of ips of the A and AAAA answers.
+	IPs string
+	// CNAMEs is the csv of the names QName is aliased to, in order.
+	CNAMEs string
+}
+
+// Describe returns the Description of query q and its response res, either
+// of which may be nil or malformed, and then left undescribed.
+func Describe(q []byte, res []byte) *Description {
+	d := &Description{RCode: -1}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err == nil && len(msg.Question) == 1 {
+		d.QName = strings.TrimSuffix(msg.Question[0].Name, ".")
+		d.QType = int(msg.Question[0].Qtype)
+	}
+	if len(res) == 0 {
+		return d
+	}
+	msg = new(dns.Msg)
+	if err := msg.Unpack(res); err != nil {
+		return d
+	}
+	d.RCode = msg.Rcode
+	if len(d.QName) == 0 && len(msg.Question) == 1 {
+		d.QName = strings.TrimSuffix(msg.Question[0].Name, ".")
+		d.QType = int(msg.Question[0].Qtype)
+	}
+	var ips []string
+	aliases := make(map[string]string)
+	for _, rr := range msg.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			ips = append(ips, v.A.String())
+		case *dns.AAAA:
+			ips = append(ips, v.AAAA.String())
+		case *dns.CNAME:
+			aliases[dns.CanonicalName(v.Hdr.Name)] = v.Target
+		}
+	}
+	d.IPs = strings.Join(ips, ",")
+	var chain []string
+	name := dns.CanonicalName(d.QName)
+	for len(chain) < maxCNAMEs {
+		target, ok := aliases[name]
+		if !ok {
+			break
+		}
+		chain = append(chain, strings.TrimSuffix(target, "."))
+		name = dns.CanonicalName(target)
+	}
+	d.CNAMEs = strings.Join(chain, ",")
+	return d
+}
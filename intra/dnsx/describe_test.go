@@ -0,0 +1,54 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDescribe(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	qb, _ := q.Pack()
+
+	d := Describe(qb, nil)
+	if d.QName != "www.example.com" || d.QType != int(dns.TypeA) || d.RCode != -1 || d.IPs != "" {
+		t.Errorf("query alone: %+v", d)
+	}
+
+	res := new(dns.Msg)
+	res.SetReply(q)
+	hdr := func(name string, t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: t, Class: dns.ClassINET, Ttl: 60}
+	}
+	// out of order, as some resolvers answer
+	res.Answer = []dns.RR{
+		&dns.CNAME{Hdr: hdr("cdn.example.net.", dns.TypeCNAME), Target: "edge.example.org."},
+		&dns.CNAME{Hdr: hdr("WWW.example.com.", dns.TypeCNAME), Target: "cdn.example.net."},
+		&dns.A{Hdr: hdr("edge.example.org.", dns.TypeA), A: net.ParseIP("192.0.2.1")},
+		&dns.A{Hdr: hdr("edge.example.org.", dns.TypeA), A: net.ParseIP("192.0.2.2")},
+	}
+	rb, _ := res.Pack()
+	d = Describe(qb, rb)
+	if d.RCode != dns.RcodeSuccess || d.IPs != "192.0.2.1,192.0.2.2" || d.CNAMEs != "cdn.example.net,edge.example.org" {
+		t.Errorf("answer: %+v", d)
+	}
+
+	res.Answer = nil
+	res.Rcode = dns.RcodeNameError
+	rb, _ = res.Pack()
+	// the question is taken from the response, if the query is malformed
+	if d = Describe([]byte{1, 2}, rb); d.RCode != dns.RcodeNameError || d.QName != "www.example.com" {
+		t.Errorf("nxdomain: %+v", d)
+	}
+	if d = Describe(nil, []byte{1}); d.RCode != -1 || len(d.QName) > 0 {
+		t.Errorf("malformed: %+v", d)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation statuses of answers.
+const (
+	// DNSSECOff is the status of answers that weren't validated.
+	DNSSECOff = 0
+	// DNSSECSecure answers were signed, and the signatures verified, or the
+	// upstream resolver vouched for them with the AD flag.
+	DNSSECSecure = 1
+	// DNSSECInsecure answers were unsigned.
+	DNSSECInsecure = 2
+	// DNSSECBogus answers were signed, but the signatures didn't verify.
+	DNSSECBogus = 3
+)
+
+const (
+	// keyTTL is how long DNSKEY sets of zones are cached for.
+	keyTTL = time.Hour
+	// maxKeySets caps the number of zones whose DNSKEY sets are cached.
+	maxKeySets = 256
+)
+
+// QueryFunc sends a dns query upstream, and returns the answer.
+type QueryFunc func(q []byte) ([]byte, error)
+
+type keySet struct {
+	keys   []*dns.DNSKEY
+	expiry time.Time
+}
+
+// Validator validates DNSSEC signatures on answers to queries for names in
+// a set of zones.  It trusts the upstream resolver's AD flag, as the resolver
+// is reached over an authenticated channel; otherwise, it verifies RRSIGs
+// against the signing zone's DNSKEY set.  The DNSKEY set is only checked to
+// be self-signed; its chain of trust up to the root is not verified.
+type Validator struct {
+	sync.Mutex
+	zones      []string
+	failClosed bool
+	keys       map[string]*keySet
+}
+
+// NewValidator returns a Validator for names in (and under) `zones`, a
+// comma-separated list, or for all names if zones is ".".  If `failClosed`,
+// Policy turns answers that don't validate into errors.
+func NewValidator(zones string, failClosed bool) (*Validator, error) {
+	v := &Validator{failClosed: failClosed, keys: make(map[string]*keySet)}
+	for _, z := range strings.Split(zones, ",") {
+		z = strings.TrimSpace(z)
+		if len(z) == 0 {
+			continue
+		}
+		if _, ok := dns.IsDomainName(z); !ok {
+			return nil, errors.New("invalid dnssec zone " + z)
+		}
+		v.zones = append(v.zones, dns.CanonicalName(z))
+	}
+	if len(v.zones) == 0 {
+		return nil, errors.New("no dnssec zones")
+	}
+	return v, nil
+}
+
+// Covers reports whether the name queried in msg is in one of v's zones.
+func (v *Validator) Covers(msg *dns.Msg) bool {
+	if v == nil || len(msg.Question) != 1 {
+		return false
+	}
+	name := dns.CanonicalName(msg.Question[0].Name)
+	for _, z := range v.zones {
+		if dns.IsSubDomain(z, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithDO returns msg packed with the DNSSEC OK (DO) bit set, so that
+// signatures are sent along with the answer.
+func WithDO(msg *dns.Msg) ([]byte, error) {
+	m := msg.Copy()
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return m.Pack()
+}
+
+// Validate returns the DNSSEC status of r, fetching DNSKEY sets of signers
+// with `query` as needed.
+func (v *Validator) Validate(r []byte, query QueryFunc) int {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(r); err != nil {
+		return DNSSECBogus
+	}
+	if msg.AuthenticatedData {
+		return DNSSECSecure
+	}
+	section := msg.Answer
+	if len(section) == 0 {
+		// negative answers are proven by signed NSEC/NSEC3 and SOA records
+		section = msg.Ns
+	}
+	return v.verify(section, query)
+}
+
+// verify checks that every RRset in rrs is covered by a valid RRSIG.
+func (v *Validator) verify(rrs []dns.RR, query QueryFunc) int {
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	sets := make(map[setKey][]dns.RR)
+	sigs := make(map[setKey][]*dns.RRSIG)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k := setKey{dns.CanonicalName(h.Name), sig.TypeCovered}
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		k := setKey{dns.CanonicalName(h.Name), h.Rrtype}
+		sets[k] = append(sets[k], rr)
+	}
+	if len(sets) == 0 || len(sigs) == 0 {
+		return DNSSECInsecure
+	}
+	for k, set := range sets {
+		ok := false
+		for _, sig := range sigs[k] {
+			if v.verifySig(sig, set, query) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return DNSSECBogus
+		}
+	}
+	return DNSSECSecure
+}
+
+func (v *Validator) verifySig(sig *dns.RRSIG, set []dns.RR, query QueryFunc) bool {
+	if !sig.ValidityPeriod(time.Now()) {
+		return false
+	}
+	for _, key := range v.dnskeys(sig.SignerName, query) {
+		if key.KeyTag() == sig.KeyTag && sig.Verify(key, set) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// dnskeys returns the self-signed DNSKEY set of zone, or nil.
+func (v *Validator) dnskeys(zone string, query QueryFunc) []*dns.DNSKEY {
+	zone = dns.CanonicalName(zone)
+	now := time.Now()
+	v.Lock()
+	ks := v.keys[zone]
+	v.Unlock()
+	if ks != nil && now.Before(ks.expiry) {
+		return ks.keys
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(zone, dns.TypeDNSKEY)
+	b, err := WithDO(q)
+	if err != nil {
+		return nil
+	}
+	r, err := query(b)
+	if err != nil {
+		return nil
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(r); err != nil {
+		return nil
+	}
+	var keys []*dns.DNSKEY
+	var set []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range msg.Answer {
+		switch x := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, x)
+			set = append(set, x)
+		case *dns.RRSIG:
+			if x.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, x)
+			}
+		}
+	}
+	signed := false
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && sig.ValidityPeriod(now) && sig.Verify(key, set) == nil {
+				signed = true
+			}
+		}
+	}
+	if !signed {
+		keys = nil
+	}
+
+	v.Lock()
+	if len(v.keys) >= maxKeySets {
+		v.keys = make(map[string]*keySet)
+	}
+	v.keys[zone] = &keySet{keys: keys, expiry: now.Add(keyTTL)}
+	v.Unlock()
+	return keys
+}
+
+// Reject reports whether answers of DNSSEC `status` are to be refused.
+func (v *Validator) Reject(status int) bool {
+	if v == nil || !v.failClosed {
+		return false
+	}
+	return status == DNSSECBogus || status == DNSSECInsecure
+}
+
+// StripDNSSEC returns r without DNSSEC records, for clients that didn't
+// ask for them.
+func StripDNSSEC(r []byte) []byte {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(r); err != nil {
+		return r
+	}
+	strip := func(rrs []dns.RR) []dns.RR {
+		out := rrs[:0]
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				continue
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+	if b, err := msg.Pack(); err == nil {
+		return b
+	}
+	return r
+}
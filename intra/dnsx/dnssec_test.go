@@ -0,0 +1,163 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"crypto"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type signedZone struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+	keyQs  int
+}
+
+func newSignedZone(t *testing.T) *signedZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signedZone{key: key, signer: priv.(crypto.Signer)}
+}
+
+func (z *signedZone) sign(t *testing.T, set []dns.RR) *dns.RRSIG {
+	h := set[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.signer, set); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// query answers DNSKEY queries for the zone.
+func (z *signedZone) query(t *testing.T) QueryFunc {
+	return func(q []byte) ([]byte, error) {
+		z.keyQs++
+		msg := new(dns.Msg)
+		if err := msg.Unpack(q); err != nil {
+			return nil, err
+		}
+		r := new(dns.Msg)
+		r.SetReply(msg)
+		r.Answer = []dns.RR{z.key, z.sign(t, []dns.RR{z.key})}
+		return r.Pack()
+	}
+}
+
+func (z *signedZone) answer(t *testing.T, ip string, signed bool) []byte {
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip),
+	}
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	r.Response = true
+	r.Answer = []dns.RR{a}
+	if signed {
+		r.Answer = append(r.Answer, z.sign(t, []dns.RR{a}))
+	}
+	b, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestValidate(t *testing.T) {
+	z := newSignedZone(t)
+	v, err := NewValidator("example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := z.answer(t, "192.0.2.1", true)
+	if s := v.Validate(good, z.query(t)); s != DNSSECSecure {
+		t.Errorf("Expected secure, got %d", s)
+	}
+	if s := v.Validate(good, z.query(t)); s != DNSSECSecure || z.keyQs != 1 {
+		t.Errorf("Expected cached keys %d %d", s, z.keyQs)
+	}
+
+	// Swap the signed address for another.
+	msg := new(dns.Msg)
+	msg.Unpack(good)
+	msg.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.99")
+	forged, _ := msg.Pack()
+	if s := v.Validate(forged, z.query(t)); s != DNSSECBogus {
+		t.Errorf("Expected bogus, got %d", s)
+	}
+	if !v.Reject(DNSSECBogus) {
+		t.Error("Fail closed validator should reject bogus answers")
+	}
+
+	unsigned := z.answer(t, "192.0.2.1", false)
+	if s := v.Validate(unsigned, z.query(t)); s != DNSSECInsecure {
+		t.Errorf("Expected insecure, got %d", s)
+	}
+	msg.Unpack(unsigned)
+	msg.AuthenticatedData = true
+	ad, _ := msg.Pack()
+	if s := v.Validate(ad, z.query(t)); s != DNSSECSecure {
+		t.Errorf("Expected AD to be trusted, got %d", s)
+	}
+
+	stripped := new(dns.Msg)
+	stripped.Unpack(StripDNSSEC(good))
+	if len(stripped.Answer) != 1 {
+		t.Errorf("RRSIG not stripped %v", stripped.Answer)
+	}
+}
+
+func TestValidatorZones(t *testing.T) {
+	if _, err := NewValidator(" ,", false); err == nil {
+		t.Error("Expected error without zones")
+	}
+	v, _ := NewValidator("example.com,example.org", false)
+	q := new(dns.Msg)
+	q.SetQuestion("a.b.EXAMPLE.org.", dns.TypeA)
+	if !v.Covers(q) {
+		t.Error("Subdomain not covered")
+	}
+	q.SetQuestion("example.net.", dns.TypeA)
+	if v.Covers(q) {
+		t.Error("Other zone covered")
+	}
+	if v.Reject(DNSSECBogus) {
+		t.Error("Fail open validator should not reject")
+	}
+	root, _ := NewValidator(".", false)
+	if !root.Covers(q) {
+		t.Error("Root should cover all names")
+	}
+
+	b, err := WithDO(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Unpack(b)
+	if opt := q.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("DO bit not set")
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import "sync/atomic"
+
+var dryRun int32
+
+// SetDryRun turns the monitor-only blocking mode on or off.  In this mode
+// transports still evaluate every query and answer against their BraveDNS,
+// and report the blocklists that would have blocked them, but answer with
+// the real answers, so that users can audit blocklists before enforcing them.
+func SetDryRun(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&dryRun, v)
+}
+
+// DryRun reports whether blocking is in monitor-only mode; see SetDryRun.
+func DryRun() bool {
+	return atomic.LoadInt32(&dryRun) == 1
+}
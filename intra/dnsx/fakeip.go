@@ -0,0 +1,272 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxFakeIPs caps the number of fake ips handed out, after which they're
+	// handed out afresh, from the first.
+	maxFakeIPs = 16384
+	// fakeTTL is the TTL of fake answers, so that apps ask again, rather
+	// than hold on to a fake ip that may since be handed out afresh.
+	fakeTTL = 1
+)
+
+// fake is a fake ip handed out for a name.
+type fake struct {
+	name string   // canonical
+	ip   net.IP   // fake
+	real []net.IP // the name's ips, as last answered
+}
+
+// pool hands out the ips of one cidr in turn.
+type pool struct {
+	base  net.IP // of the cidr, 4 or 16 bytes long
+	size  uint64 // number of ips handed out in turn
+	next  uint64 // offset into the cidr of the next ip to hand out
+	taken map[uint64]*fake
+}
+
+func newPool(cidr *net.IPNet) *pool {
+	ones, bits := cidr.Mask.Size()
+	size := uint64(maxFakeIPs)
+	if hostbits := bits - ones; hostbits < 16 {
+		// but for the network and broadcast addresses
+		size = (uint64(1) << uint(hostbits)) - 2
+	}
+	base := cidr.IP.To4()
+	if base == nil {
+		base = cidr.IP.To16()
+	}
+	return &pool{base: base, size: size, taken: make(map[uint64]*fake)}
+}
+
+// ip returns the ip at offset off into p's cidr.
+func (p *pool) ip(off uint64) net.IP {
+	ip := append(net.IP{}, p.base...)
+	if len(ip) == net.IPv4len {
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)+uint32(off))
+		return ip
+	}
+	lo := ip[net.IPv6len-8:]
+	binary.BigEndian.PutUint64(lo, binary.BigEndian.Uint64(lo)+off)
+	return ip
+}
+
+// FakeIPs answers A and AAAA queries with fake ips, from reserved cidrs,
+// one per name, and maps them back to the names and their real ips, so that
+// flows to fake ips are matched to the names they were for, long after the
+// real ips have changed, or the apps cached them.  Answers that are blocked,
+// or have no ips, are left as they are.
+type FakeIPs struct {
+	sync.RWMutex
+	cidrs  []*net.IPNet
+	v4     *pool
+	v6     *pool
+	byName map[string]*fake // canonical name and qtype to its fake
+	byIP   map[string]*fake
+}
+
+// NewFakeIPs returns FakeIPs that hands out ips from `cidrs`, a csv of one
+// IPv4 cidr, one IPv6 cidr, or one of each, like "198.18.0.0/15,fd66::/64".
+func NewFakeIPs(cidrs string) (*FakeIPs, error) {
+	f := &FakeIPs{byName: make(map[string]*fake), byIP: make(map[string]*fake)}
+	for _, s := range strings.Split(cidrs, ",") {
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		if ones, bits := cidr.Mask.Size(); bits-ones < 2 {
+			return nil, fmt.Errorf("fake ip cidr %s too small", s)
+		}
+		v6 := cidr.IP.To4() == nil
+		if (v6 && f.v6 != nil) || (!v6 && f.v4 != nil) {
+			return nil, fmt.Errorf("more than one fake ip cidr of the family of %s", s)
+		}
+		f.cidrs = append(f.cidrs, cidr)
+		if v6 {
+			f.v6 = newPool(cidr)
+		} else {
+			f.v4 = newPool(cidr)
+		}
+	}
+	if f.v4 == nil && f.v6 == nil {
+		return nil, errors.New("no fake ip cidrs")
+	}
+	return f, nil
+}
+
+func fakeKey(name string, qtype uint16) string {
+	return dns.TypeToString[qtype] + " " + name
+}
+
+// take returns the fake ip for name, of qtype's family, with real as the
+// name's ips, or nil if there's no cidr of that family.
+func (f *FakeIPs) take(name string, qtype uint16, real []net.IP) net.IP {
+	p := f.v4
+	if qtype == dns.TypeAAAA {
+		p = f.v6
+	}
+	if p == nil {
+		return nil
+	}
+	f.Lock()
+	defer f.Unlock()
+	k := fakeKey(name, qtype)
+	if e := f.byName[k]; e != nil {
+		e.real = real
+		return e.ip
+	}
+	off := p.next + 1 // past the network address
+	p.next = (p.next + 1) % p.size
+	if old := p.taken[off]; old != nil {
+		// handed out afresh: the oldest name loses its fake ip
+		delete(f.byName, fakeKey(old.name, qtype))
+		delete(f.byIP, old.ip.String())
+	}
+	e := &fake{name: name, ip: p.ip(off), real: real}
+	p.taken[off] = e
+	f.byName[k] = e
+	f.byIP[e.ip.String()] = e
+	return e.ip
+}
+
+func (f *FakeIPs) get(ip net.IP) *fake {
+	if f == nil || ip == nil {
+		return nil
+	}
+	f.RLock()
+	defer f.RUnlock()
+	return f.byIP[ip.String()]
+}
+
+// Contains reports whether ip is in the cidrs of f, whether or not it was
+// handed out.
+func (f *FakeIPs) Contains(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+	for _, cidr := range f.cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFake reports whether ip is a fake ip handed out by f, and not since
+// handed out afresh.
+func (f *FakeIPs) IsFake(ip net.IP) bool {
+	return f.get(ip) != nil
+}
+
+// Name returns the name, without the trailing dot, that the fake `ip` was
+// handed out for, or "" if ip isn't a fake ip.
+func (f *FakeIPs) Name(ip net.IP) string {
+	if e := f.get(ip); e != nil {
+		return strings.TrimSuffix(e.name, ".")
+	}
+	return ""
+}
+
+// Real returns a real ip of the name that the fake `ip` was handed out for,
+// or nil if ip isn't a fake ip.
+func (f *FakeIPs) Real(ip net.IP) net.IP {
+	e := f.get(ip)
+	if e == nil {
+		return nil
+	}
+	f.RLock()
+	defer f.RUnlock()
+	if len(e.real) == 0 {
+		return nil
+	}
+	return e.real[0]
+}
+
+// Faking returns a Transport that answers as `t` does, but with fake ips
+// from f; or t itself, if f is nil.
+func (f *FakeIPs) Faking(t Transport) Transport {
+	if f == nil || t == nil {
+		return t
+	}
+	return &faker{Transport: t, f: f}
+}
+
+// faker is a Transport whose answers are faked by FakeIPs.
+type faker struct {
+	Transport
+	f *FakeIPs
+}
+
+// Inner implements Wrapper.
+func (k *faker) Inner() Transport {
+	return k.Transport
+}
+
+// Query implements Transport.
+func (k *faker) Query(q []byte) ([]byte, error) {
+	res, err := k.Transport.Query(q)
+	if err != nil {
+		return res, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(res); err != nil || len(msg.Question) != 1 {
+		return res, nil
+	}
+	qtype := msg.Question[0].Qtype
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return res, nil
+	}
+	var real []net.IP
+	var owner string
+	kept := msg.Answer[:0]
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		}
+		if ip == nil || rr.Header().Rrtype != qtype {
+			kept = append(kept, rr)
+			continue
+		}
+		if ip.IsUnspecified() {
+			// blocked
+			return res, nil
+		}
+		real = append(real, ip)
+		owner = rr.Header().Name
+	}
+	if len(real) == 0 {
+		return res, nil
+	}
+	ip := k.f.take(dns.CanonicalName(msg.Question[0].Name), qtype, real)
+	if ip == nil {
+		return res, nil
+	}
+	hdr := dns.RR_Header{Name: owner, Rrtype: qtype, Class: dns.ClassINET, Ttl: fakeTTL}
+	if qtype == dns.TypeA {
+		kept = append(kept, &dns.A{Hdr: hdr, A: ip})
+	} else {
+		kept = append(kept, &dns.AAAA{Hdr: hdr, AAAA: ip})
+	}
+	msg.Answer = kept
+	return msg.Pack()
+}
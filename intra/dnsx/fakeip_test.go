@@ -0,0 +1,84 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFakeIPs(t *testing.T) {
+	for _, bad := range []string{"", "198.18.0.0/31", "198.18.0.0/15,10.0.0.0/8", "fake"} {
+		if _, err := NewFakeIPs(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+	f, err := NewFakeIPs("198.18.0.0/15, fd66::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := f.Faking(&fakeTransport{ttl: 60})
+
+	r := queryType(t, tr, "www.example.com.", dns.TypeA)
+	if len(r.Answer) != 1 {
+		t.Fatalf("Wrong answer %v", r)
+	}
+	a := r.Answer[0].(*dns.A)
+	if !a.A.Equal(net.ParseIP("198.18.0.1")) || a.Hdr.Ttl != fakeTTL {
+		t.Errorf("Wrong fake %v", a)
+	}
+	if !f.IsFake(a.A) || f.Name(a.A) != "www.example.com" || !f.Real(a.A).Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Fake %s not mapped back", a.A)
+	}
+	// names keep their fake ips
+	if r := queryType(t, tr, "WWW.example.com.", dns.TypeA); !r.Answer[0].(*dns.A).A.Equal(a.A) {
+		t.Errorf("Name given another fake %v", r.Answer[0])
+	}
+	if r := queryType(t, tr, "example.org.", dns.TypeA); !r.Answer[0].(*dns.A).A.Equal(net.ParseIP("198.18.0.2")) {
+		t.Errorf("Wrong next fake %v", r.Answer[0])
+	}
+	if f.IsFake(net.ParseIP("192.0.2.1")) || f.Real(net.ParseIP("198.18.9.9")) != nil {
+		t.Error("Real ip taken for fake")
+	}
+	if !f.Contains(net.ParseIP("198.18.9.9")) || !f.Contains(net.ParseIP("fd66::1")) || f.Contains(net.ParseIP("192.0.2.1")) {
+		t.Error("Wrong cidrs")
+	}
+
+	// blocked, and empty, answers aren't faked
+	if r := queryType(t, f.Faking(&fakeTransport{rcode: dns.RcodeNameError}), "nx.example.com.", dns.TypeA); len(r.Answer) != 0 {
+		t.Errorf("Empty answer faked %v", r)
+	}
+	if r := queryType(t, tr, "www.example.com.", dns.TypeMX); !r.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("MX answer faked %v", r)
+	}
+
+	var nilf *FakeIPs
+	if nilf.Faking(tr) != tr || nilf.IsFake(a.A) || nilf.Name(a.A) != "" {
+		t.Error("Nil FakeIPs should fake nothing")
+	}
+}
+
+func TestFakeIPsAfresh(t *testing.T) {
+	f, err := NewFakeIPs("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := f.Faking(&fakeTransport{ttl: 60})
+	var ips []net.IP
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		ips = append(ips, queryType(t, tr, name, dns.TypeA).Answer[0].(*dns.A).A)
+	}
+	// a /30 has two ips to hand out, so the first is handed out afresh
+	if !ips[2].Equal(ips[0]) || f.Name(ips[0]) != "c.example" {
+		t.Errorf("Wrong fakes %v, %s", ips, f.Name(ips[0]))
+	}
+	if r := queryType(t, tr, "a.example.", dns.TypeAAAA); !r.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("AAAA faked without an IPv6 cidr %v", r)
+	}
+}
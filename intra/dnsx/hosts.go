@@ -0,0 +1,164 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// hostsTTL is the TTL of answers from static records.
+const hostsTTL = 60
+
+// Hosts answers A and AAAA queries for names with static records, like an
+// /etc/hosts file would, and forwards all other queries to the Transport it
+// wraps.  A name with records of only one family gets empty answers for the
+// other.
+type Hosts struct {
+	sync.RWMutex
+	Transport
+	names map[string][]net.IP
+}
+
+// NewHosts returns a Transport that answers from static records before `t`.
+func NewHosts(t Transport) Transport {
+	return &Hosts{Transport: t, names: make(map[string][]net.IP)}
+}
+
+// Inner implements Wrapper.
+func (h *Hosts) Inner() Transport {
+	return h.Transport
+}
+
+// Add maps hostname to `ipcsv`, a comma-separated list of ips, in addition
+// to any ips it already maps to.
+func (h *Hosts) Add(hostname string, ipcsv string) error {
+	var ips []net.IP
+	for _, v := range strings.Split(ipcsv, ",") {
+		ip := net.ParseIP(strings.TrimSpace(v))
+		if ip == nil {
+			return errors.New("invalid ip " + v)
+		}
+		ips = append(ips, ip)
+	}
+	return h.add(hostname, ips)
+}
+
+func (h *Hosts) add(hostname string, ips []net.IP) error {
+	if _, ok := dns.IsDomainName(hostname); !ok || len(hostname) == 0 {
+		return errors.New("invalid hostname " + hostname)
+	}
+	name := dns.CanonicalName(hostname)
+	h.Lock()
+	h.names[name] = append(h.names[name], ips...)
+	h.Unlock()
+	return nil
+}
+
+// Load adds records from `hosts`, in the hosts file format: an ip followed
+// by its hostnames on each line, with comments starting with #.  Returns the
+// number of hostnames added.  Malformed lines are skipped.
+func (h *Hosts) Load(hosts string) (int, error) {
+	n := 0
+	s := bufio.NewScanner(strings.NewReader(hosts))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			if h.add(name, []net.IP{ip}) == nil {
+				n++
+			}
+		}
+	}
+	return n, s.Err()
+}
+
+// Remove drops all records of hostname.
+func (h *Hosts) Remove(hostname string) {
+	h.Lock()
+	delete(h.names, dns.CanonicalName(hostname))
+	h.Unlock()
+}
+
+// Clear drops all records.
+func (h *Hosts) Clear() {
+	h.Lock()
+	h.names = make(map[string][]net.IP)
+	h.Unlock()
+}
+
+// Query answers q from static records if possible; otherwise from the
+// inner Transport.
+func (h *Hosts) Query(q []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil || len(msg.Question) != 1 {
+		return h.Transport.Query(q)
+	}
+	question := msg.Question[0]
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return h.Transport.Query(q)
+	}
+	h.RLock()
+	ips, ok := h.names[dns.CanonicalName(question.Name)]
+	h.RUnlock()
+	if !ok {
+		return h.Transport.Query(q)
+	}
+	return answer(msg, ips).Pack()
+}
+
+// answer returns a response to msg with those of ips that are of the family
+// queried for.
+func answer(msg *dns.Msg, ips []net.IP) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(msg)
+	r.RecursionAvailable = true
+	question := msg.Question[0]
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: hostsTTL}
+		ip4 := ip.To4()
+		if question.Qtype == dns.TypeA && ip4 != nil {
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if question.Qtype == dns.TypeAAAA && ip4 == nil {
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return r
+}
+
+// LoadHosts adds records from `hosts`, in the hosts file format, to the
+// Hosts in `t`'s chain of wrappers, and returns the number of hostnames added.
+func LoadHosts(t Transport, hosts string) (int, error) {
+	var n int
+	var err error
+	found := walk(t, func(t Transport) bool {
+		h, ok := t.(*Hosts)
+		if ok {
+			n, err = h.Load(hosts)
+		}
+		return ok
+	})
+	if !found {
+		return 0, errors.New("no hosts transport")
+	}
+	return n, err
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const hostsFile = `
+# lan
+192.168.1.10   nas.lan  nas
+fd00::10       nas.lan
+not-an-ip      bad.lan
+10.0.0.1       # no names
+`
+
+func TestHosts(t *testing.T) {
+	f := &fakeTransport{ttl: 60}
+	tr := NewHosts(f)
+	n, err := LoadHosts(NewCoalescer(tr), hostsFile)
+	if err != nil || n != 3 {
+		t.Fatalf("Loaded %d names, %v", n, err)
+	}
+
+	r := query(t, tr, "NAS.lan.", 1)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.168.1.10" {
+		t.Errorf("Wrong answer %v", r.Answer)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("nas.lan.", dns.TypeAAAA)
+	b, _ := q.Pack()
+	res, _ := tr.Query(b)
+	r.Unpack(res)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::10" {
+		t.Errorf("Wrong answer %v", r.Answer)
+	}
+	q.SetQuestion("nas.", dns.TypeAAAA)
+	b, _ = q.Pack()
+	res, _ = tr.Query(b)
+	r.Unpack(res)
+	if len(r.Answer) != 0 || r.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected empty answer %v", r)
+	}
+	if f.queries != 0 {
+		t.Errorf("Static names sent upstream")
+	}
+
+	query(t, tr, "bad.lan.", 2)
+	if f.queries != 1 {
+		t.Error("Unknown name not sent upstream")
+	}
+
+	h := tr.(*Hosts)
+	if err := h.Add("svc.internal", "10.1.1.1, x"); err == nil {
+		t.Error("Expected error for bad ip")
+	}
+	if err := h.Add("svc.internal", "10.1.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	if r := query(t, tr, "svc.internal.", 3); len(r.Answer) != 1 {
+		t.Error("Added record not answered")
+	}
+	h.Remove("svc.internal")
+	query(t, tr, "svc.internal.", 4)
+	if f.queries != 2 {
+		t.Error("Removed record answered")
+	}
+
+	if _, err := LoadHosts(f, hostsFile); err == nil {
+		t.Error("Expected error without a hosts transport")
+	}
+}
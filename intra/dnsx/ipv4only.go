@@ -0,0 +1,105 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// IPv4Only, when on, answers AAAA queries with empty answers (NODATA) without
+// sending them upstream, and strips AAAA records from all other answers, so
+// that apps on networks with broken IPv6 fall back to IPv4 right away rather
+// than after timing out.
+type IPv4Only struct {
+	on int32
+	Transport
+}
+
+// NewIPv4Only returns a Transport that hides IPv6 answers of `t`, if `on`.
+func NewIPv4Only(t Transport, on bool) Transport {
+	f := &IPv4Only{Transport: t}
+	f.Set(on)
+	return f
+}
+
+// Inner implements Wrapper.
+func (f *IPv4Only) Inner() Transport {
+	return f.Transport
+}
+
+// Set turns f on or off, say, as the device moves between networks.
+func (f *IPv4Only) Set(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&f.on, v)
+}
+
+// On reports whether f is on.
+func (f *IPv4Only) On() bool {
+	return atomic.LoadInt32(&f.on) == 1
+}
+
+// Query implements Transport.
+func (f *IPv4Only) Query(q []byte) ([]byte, error) {
+	if !f.On() {
+		return f.Transport.Query(q)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil || len(msg.Question) != 1 {
+		return f.Transport.Query(q)
+	}
+	if msg.Question[0].Qtype == dns.TypeAAAA {
+		return answer(msg, nil).Pack()
+	}
+	res, err := f.Transport.Query(q)
+	if err != nil {
+		return res, err
+	}
+	return stripAAAA(res), nil
+}
+
+// stripAAAA returns r without AAAA records in its answer section.
+func stripAAAA(r []byte) []byte {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(r); err != nil {
+		return r
+	}
+	kept := msg.Answer[:0]
+	for _, rr := range msg.Answer {
+		if rr.Header().Rrtype != dns.TypeAAAA {
+			kept = append(kept, rr)
+		}
+	}
+	if len(kept) == len(msg.Answer) {
+		return r
+	}
+	msg.Answer = kept
+	if b, err := msg.Pack(); err == nil {
+		return b
+	}
+	return r
+}
+
+// SetIPv4Only turns the IPv4Only in `t`'s chain of wrappers on or off.
+func SetIPv4Only(t Transport, on bool) error {
+	found := walk(t, func(t Transport) bool {
+		f, ok := t.(*IPv4Only)
+		if ok {
+			f.Set(on)
+		}
+		return ok
+	})
+	if !found {
+		return errors.New("no ipv4only transport")
+	}
+	return nil
+}
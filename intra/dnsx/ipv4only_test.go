@@ -0,0 +1,48 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func queryType(t *testing.T, tr Transport, name string, qtype uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	b, _ := q.Pack()
+	r, err := tr.Query(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(r); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestIPv4Only(t *testing.T) {
+	f := &fakeTransport{ttl: 60}
+	tr := NewIPv4Only(f, false)
+
+	queryType(t, tr, "example.com.", dns.TypeAAAA)
+	if f.queries != 1 {
+		t.Error("AAAA query not forwarded while off")
+	}
+	if err := SetIPv4Only(tr, true); err != nil {
+		t.Fatal(err)
+	}
+	r := queryType(t, tr, "example.com.", dns.TypeAAAA)
+	if f.queries != 1 || len(r.Answer) != 0 || r.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected local nodata, got %v", r)
+	}
+	if r := queryType(t, tr, "example.com.", dns.TypeA); len(r.Answer) != 1 {
+		t.Error("A answer stripped")
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/celzero/firestack/intra/diag"
+	"github.com/celzero/gotrie/trie"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// Stages of blocklists loading, as in BlocklistLoadListener.
+const (
+	// BlocklistStageTags is the file tags read, so that stamps can be set.
+	BlocklistStageTags = "tags"
+	// BlocklistStageTrie is the trie of the blocklists being built, which
+	// takes the bulk of the time.
+	BlocklistStageTrie = "trie"
+	// BlocklistStageReady is the blocklists ready, and applied to queries.
+	BlocklistStageReady = "ready"
+)
+
+// LoadingBlocklist is the name of the blocklist that queries are blocked by
+// while strict blocklists load.
+const LoadingBlocklist = "loading"
+
+var errBlocklistsLoading = errors.New("blocklists loading")
+
+// BlocklistLoadListener is told of the progress of blocklists loading in
+// the background, from NewBraveDNSLazy.
+type BlocklistLoadListener interface {
+	// OnBlocklistProgress is called as loading reaches `stage`, one of the
+	// BlocklistStage*, `percent` of the way through.
+	OnBlocklistProgress(stage string, percent int)
+	// OnBlocklistLoaded is called once loading is done, with `err`, or
+	// empty, if the blocklists are ready.
+	OnBlocklistLoaded(err string)
+}
+
+// lazybravedns is a local bravedns whose trie is built in the background.
+// Till it is, queries are let through, or, if strict, blocked.
+type lazybravedns struct {
+	*bravedns
+	sync.RWMutex
+	ready  bool
+	strict bool
+}
+
+// NewBraveDNSLazy is like NewBraveDNSLocal, but only reads the file tags of
+// the blocklists before it returns, so that stamps can be set right away;
+// their trie is built in the background, with `l`, if any, told of its
+// progress.  Till the blocklists are ready, queries are let through, or, if
+// `strict`, blocked, as by the blocklist LoadingBlocklist.  Should loading
+// fail, queries are let through.
+func NewBraveDNSLazy(t string, rank string, conf string, listinfo string, l BlocklistLoadListener, strict bool) (BraveDNS, error) {
+	if len(t) <= 0 || len(rank) <= 0 || len(conf) <= 0 || len(listinfo) <= 0 {
+		return nil, errors.New("missing data, unable to build blocklist")
+	}
+	return newLazyBraveDNS(listinfo, func() (*trie.FrozenTrie, error) {
+		err, ft := trie.Build(t, rank, conf, listinfo)
+		if err != nil {
+			return nil, err
+		}
+		return &ft, nil
+	}, l, strict)
+}
+
+func newLazyBraveDNS(listinfo string, build func() (*trie.FrozenTrie, error), l BlocklistLoadListener, strict bool) (BraveDNS, error) {
+	flags, tags, err := load(listinfo)
+	if err != nil {
+		return nil, err
+	}
+	brave := &lazybravedns{
+		bravedns: &bravedns{flags: flags, tags: tags, mode: localBlock},
+		strict:   strict,
+	}
+	progress(l, BlocklistStageTags, 10)
+	diag.Go(diag.DNS, func() {
+		brave.load(build, l)
+	})
+	return brave, nil
+}
+
+func progress(l BlocklistLoadListener, stage string, percent int) {
+	if l != nil {
+		l.OnBlocklistProgress(stage, percent)
+	}
+}
+
+// load builds the trie, and readies brave.
+func (brave *lazybravedns) load(build func() (*trie.FrozenTrie, error), l BlocklistLoadListener) {
+	progress(l, BlocklistStageTrie, 20)
+	ft, err := build()
+	// TODO: find a better place
+	runtime.GC()
+
+	brave.Lock()
+	if err == nil {
+		brave.trie = ft
+	}
+	brave.ready = true
+	brave.strict = false
+	brave.Unlock()
+
+	if err != nil {
+		log.Errorf("blocklists failed to load: %v", err)
+		if l != nil {
+			l.OnBlocklistLoaded(err.Error())
+		}
+		return
+	}
+	log.Infof("blocklists loaded")
+	progress(l, BlocklistStageReady, 100)
+	if l != nil {
+		l.OnBlocklistLoaded("")
+	}
+}
+
+// loaded reports whether the trie is ready to look up; and, if it isn't,
+// the names of the blocklists queries are blocked by till it is, if any.
+func (brave *lazybravedns) loaded() (bool, string) {
+	brave.RLock()
+	defer brave.RUnlock()
+	if brave.ready && brave.trie != nil {
+		return true, ""
+	}
+	if brave.strict {
+		return false, LoadingBlocklist
+	}
+	return false, ""
+}
+
+func (brave *lazybravedns) BlockRequest(q []byte) (string, error) {
+	if ok, r := brave.loaded(); !ok {
+		if len(r) > 0 {
+			return r, nil
+		}
+		return "", errBlocklistsLoading
+	}
+	return brave.bravedns.BlockRequest(q)
+}
+
+func (brave *lazybravedns) BlockResponse(q []byte) (string, error) {
+	// answers to queries let through while strict are left be
+	if ok, _ := brave.loaded(); !ok {
+		return "", errBlocklistsLoading
+	}
+	return brave.bravedns.BlockResponse(q)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/celzero/gotrie/trie"
+	"github.com/miekg/dns"
+)
+
+type loadListener struct {
+	stages []string
+	done   chan string
+}
+
+func (l *loadListener) OnBlocklistProgress(stage string, percent int) {
+	l.stages = append(l.stages, stage)
+}
+
+func (l *loadListener) OnBlocklistLoaded(err string) {
+	l.done <- err
+}
+
+func writeListinfo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lazyblock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	p := filepath.Join(dir, "filetag.json")
+	tags := `{"ABC": {"value": 0, "vname": "ads", "subg": "", "group": "privacy"}}`
+	if err := ioutil.WriteFile(p, []byte(tags), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func aQuery() []byte {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, _ := q.Pack()
+	return b
+}
+
+func TestLazyBlocklists(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		release := make(chan struct{})
+		l := &loadListener{done: make(chan string, 1)}
+		b, err := newLazyBraveDNS(writeListinfo(t), func() (*trie.FrozenTrie, error) {
+			<-release
+			return nil, errors.New("bad trie")
+		}, l, strict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.OnDeviceBlock() {
+			t.Error("lazy blocklists not on-device")
+		}
+		// file tags are read up front, so that stamps can be set
+		if tag := b.(*lazybravedns).tags["ABC"]; tag != "privacy:ads" {
+			t.Errorf("file tag %q", tag)
+		}
+
+		r, err := b.BlockRequest(aQuery())
+		if strict && (err != nil || r != LoadingBlocklist) {
+			t.Errorf("strict, while loading: %q, %v", r, err)
+		}
+		if !strict && err == nil {
+			t.Errorf("while loading, blocked by %q", r)
+		}
+
+		close(release)
+		if e := <-l.done; e != "bad trie" {
+			t.Errorf("loaded with %q", e)
+		}
+		if r, err := b.BlockRequest(aQuery()); err == nil {
+			t.Errorf("strict %t, failed to load, blocked by %q", strict, r)
+		}
+		if len(l.stages) != 2 || l.stages[0] != BlocklistStageTags || l.stages[1] != BlocklistStageTrie {
+			t.Errorf("stages %v", l.stages)
+		}
+	}
+}
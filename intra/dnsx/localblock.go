@@ -0,0 +1,437 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// hostsLocalNames are names hosts files map to loopback for the machine
+// itself, and which aren't blocked.
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// blockNode is a node of a trie of domain labels, from the tld down.
+type blockNode struct {
+	children map[string]*blockNode
+	// ids of lists that block this exact name
+	exact []int
+	// ids of lists that block this name and all names under it
+	subtree []int
+	// ids of lists with exceptions for this name and all names under it
+	allow []int
+}
+
+func (n *blockNode) empty() bool {
+	return len(n.children) == 0 && len(n.exact) == 0 && len(n.subtree) == 0 && len(n.allow) == 0
+}
+
+func (n *blockNode) child(label string, create bool) *blockNode {
+	c := n.children[label]
+	if c == nil && create {
+		if n.children == nil {
+			n.children = make(map[string]*blockNode)
+		}
+		c = &blockNode{}
+		n.children[label] = c
+	}
+	return c
+}
+
+// labels returns the labels of name, from the tld down.
+func labels(name string) []string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if len(name) == 0 {
+		return nil
+	}
+	l := strings.Split(name, ".")
+	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+		l[i], l[j] = l[j], l[i]
+	}
+	return l
+}
+
+func addID(ids []int, id int) []int {
+	for _, v := range ids {
+		if v == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+func removeID(ids []int, id int) []int {
+	for i, v := range ids {
+		if v == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+// LocalBlocklists is a BraveDNS that blocks names in named blocklists loaded
+// on-device, like hosts files or Adblock Plus lists, in place of the bravedns
+// blocklist trie.  Lists are loaded and re-loaded one at a time, and its
+// stamp is a comma-separated list of names of lists in effect; an empty stamp
+// puts all lists in effect.
+type LocalBlocklists struct {
+	sync.RWMutex
+	root *blockNode
+	// lists maps ids to list names; removed lists are ""
+	lists []string
+	stamp string
+	// locked is true when stamp must not be changed.
+	locked bool
+	// schedules are windows of time lists are in effect; see AddSchedule.
+	schedules map[string][]*window
+	// now returns the time schedules are evaluated at, if set.
+	now func() time.Time
+}
+
+// NewLocalBlocklists returns empty LocalBlocklists; see Load.
+func NewLocalBlocklists() *LocalBlocklists {
+	return &LocalBlocklists{root: &blockNode{}}
+}
+
+// id returns the id of list name, creating one if needed.  Must be called
+// under Lock.
+func (b *LocalBlocklists) id(name string) int {
+	for i, n := range b.lists {
+		if n == name {
+			return i
+		}
+	}
+	b.lists = append(b.lists, name)
+	return len(b.lists) - 1
+}
+
+// clear removes list id from all nodes under n, and prunes empty nodes.
+// Must be called under Lock.
+func clearList(n *blockNode, id int) {
+	n.exact = removeID(n.exact, id)
+	n.subtree = removeID(n.subtree, id)
+	n.allow = removeID(n.allow, id)
+	for label, c := range n.children {
+		clearList(c, id)
+		if c.empty() {
+			delete(n.children, label)
+		}
+	}
+}
+
+// blockRule is a parsed line of a blocklist.
+type blockRule struct {
+	name string
+	// subtree rules match the name and all names under it
+	subtree bool
+	// allow rules are exceptions to blocking
+	allow bool
+}
+
+// abpOptions are Adblock Plus rule options that don't change the meaning of
+// a rule for dns; rules with any other options are meant for browsers.
+var abpOptions = map[string]bool{
+	"important": true,
+	"all":       true,
+	"document":  true,
+}
+
+// parseABP parses line, an Adblock Plus rule of the ||domain^ form, or an
+// exception of the @@||domain^ form.
+func parseABP(line string) (r blockRule, ok bool) {
+	if strings.HasPrefix(line, "@@") {
+		r.allow = true
+		line = line[2:]
+	}
+	if !strings.HasPrefix(line, "||") {
+		return r, false
+	}
+	line = line[2:]
+	if i := strings.IndexByte(line, '$'); i >= 0 {
+		for _, opt := range strings.Split(line[i+1:], ",") {
+			if !abpOptions[strings.TrimSpace(opt)] {
+				return r, false
+			}
+		}
+		line = line[:i]
+	}
+	// the separator ^ ends the domain; a trailing | anchors it, to no effect
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "|"), "^")
+	if strings.ContainsAny(line, "/*^| \t") {
+		// paths and wildcards match urls, not names
+		return r, false
+	}
+	r.name = strings.ToLower(strings.TrimSuffix(line, "."))
+	r.subtree = true
+	return r, isBlockable(r.name)
+}
+
+func isBlockable(name string) bool {
+	_, ok := dns.IsDomainName(name)
+	return ok && len(name) > 0 && !hostsLocalNames[name]
+}
+
+// isCosmetic reports whether line is an Adblock Plus element hiding rule,
+// like example.com##.ad, which is for browsers and not for dns.
+func isCosmetic(line string) bool {
+	for _, sep := range []string{"##", "#@#", "#?#", "#$#"} {
+		if strings.Contains(line, sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRules parses `list`, a blocklist of lines in the hosts file format
+// (0.0.0.0 ads.example.com), of just names (ads.example.com), or of Adblock
+// Plus rules (||ads.example.com^ and @@||ok.ads.example.com^), which may be
+// mixed.  Hosts lines are taken to block names mapped to unspecified or
+// loopback addresses, as blocking hosts files do.  Other lines are skipped.
+func parseRules(list string) []blockRule {
+	var rules []blockRule
+	s := bufio.NewScanner(strings.NewReader(list))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || line[0] == '!' || line[0] == '[' {
+			// abp comments and headers
+			continue
+		}
+		if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") {
+			if r, ok := parseABP(line); ok {
+				rules = append(rules, r)
+			}
+			continue
+		}
+		if isCosmetic(line) {
+			continue
+		}
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 1 {
+			ip := net.ParseIP(fields[0])
+			if ip == nil || !(ip.IsUnspecified() || ip.IsLoopback()) {
+				continue
+			}
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if isBlockable(name) {
+				rules = append(rules, blockRule{name: name})
+			}
+		}
+	}
+	return rules
+}
+
+// Load (re)loads the blocklist `name` from `list`, of hosts file lines or
+// Adblock Plus rules (see parseRules), replacing any list previously loaded
+// as name, and leaving all other lists as they are.  Returns the number of
+// rules loaded.
+func (b *LocalBlocklists) Load(name string, list string) (int, error) {
+	if len(name) == 0 || strings.Contains(name, ",") {
+		return 0, errors.New("invalid blocklist name " + name)
+	}
+	rules := parseRules(list)
+
+	b.Lock()
+	defer b.Unlock()
+	id := b.id(name)
+	clearList(b.root, id)
+	for _, r := range rules {
+		node := b.root
+		for _, l := range labels(r.name) {
+			node = node.child(l, true)
+		}
+		switch {
+		case r.allow:
+			node.allow = addID(node.allow, id)
+		case r.subtree:
+			node.subtree = addID(node.subtree, id)
+		default:
+			node.exact = addID(node.exact, id)
+		}
+	}
+	return len(rules), nil
+}
+
+// LoadFile (re)loads the blocklist `name` from the file at `path`.
+func (b *LocalBlocklists) LoadFile(name string, path string) (int, error) {
+	hosts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return b.Load(name, string(hosts))
+}
+
+// Remove unloads the blocklist `name`.
+func (b *LocalBlocklists) Remove(name string) {
+	b.Lock()
+	defer b.Unlock()
+	for i, n := range b.lists {
+		if n == name {
+			clearList(b.root, i)
+			b.lists[i] = ""
+		}
+	}
+}
+
+// inEffect reports whether list id is in effect under b's stamp and
+// schedules.  Must be called under RLock.
+func (b *LocalBlocklists) inEffect(id int) bool {
+	name := b.lists[id]
+	if len(name) == 0 || !b.scheduled(name) {
+		return false
+	}
+	if len(b.stamp) == 0 {
+		return true
+	}
+	for _, s := range strings.Split(b.stamp, ",") {
+		if strings.TrimSpace(s) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the csv names of lists in effect that block name, unless
+// an exception in any list in effect allows it.
+func (b *LocalBlocklists) lookup(name string) string {
+	b.RLock()
+	defer b.RUnlock()
+	var ids []int
+	node := b.root
+	for _, l := range labels(name) {
+		if node = node.child(l, false); node == nil {
+			break
+		}
+		for _, id := range node.allow {
+			if b.inEffect(id) {
+				return ""
+			}
+		}
+		for _, id := range node.subtree {
+			ids = addID(ids, id)
+		}
+	}
+	if node != nil {
+		for _, id := range node.exact {
+			ids = addID(ids, id)
+		}
+	}
+	var lists []string
+	for _, id := range ids {
+		if b.inEffect(id) {
+			lists = append(lists, b.lists[id])
+		}
+	}
+	return strings.Join(lists, ",")
+}
+
+// OnDeviceBlock implements BraveDNS; local lists always block on-device.
+func (b *LocalBlocklists) OnDeviceBlock() bool {
+	return true
+}
+
+// SetStamp implements BraveDNS; `stamp` is a csv of names of lists to put
+// in effect, or empty for all lists.
+func (b *LocalBlocklists) SetStamp(stamp string) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.locked {
+		return errors.New("stamp locked")
+	}
+	b.stamp = stamp
+	return nil
+}
+
+// GetStamp implements BraveDNS.
+func (b *LocalBlocklists) GetStamp() (string, error) {
+	b.RLock()
+	defer b.RUnlock()
+	return b.stamp, nil
+}
+
+// LockStamp implements BraveDNS.
+func (b *LocalBlocklists) LockStamp(stamp string) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.locked {
+		if b.stamp == stamp {
+			return nil
+		}
+		return errors.New("stamp already locked")
+	}
+	b.stamp = stamp
+	b.locked = true
+	return nil
+}
+
+// GetBlocklistStampHeaderKey implements BraveDNS.  Local lists aren't
+// applied by servers, and so there's no header to look for.
+func (b *LocalBlocklists) GetBlocklistStampHeaderKey() string {
+	return ""
+}
+
+// StampToNames implements BraveDNS; stamps are list names already.
+func (b *LocalBlocklists) StampToNames(stamp string) (string, error) {
+	if len(stamp) <= 0 {
+		return "", errors.New("empty blocklist stamp")
+	}
+	return stamp, nil
+}
+
+// BlockRequest implements BraveDNS, and returns the names of lists that
+// block the name queried in q.
+func (b *LocalBlocklists) BlockRequest(q []byte) (string, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return "", err
+	}
+	if len(msg.Question) != 1 {
+		return "", errors.New("one question too many")
+	}
+	if lists := b.lookup(msg.Question[0].Name); len(lists) > 0 {
+		return lists, nil
+	}
+	return "", errors.New("name not in local blocklists")
+}
+
+// BlockResponse implements BraveDNS, and returns the names of lists that
+// block any of the names the answer r is aliased to.
+func (b *LocalBlocklists) BlockResponse(r []byte) (string, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(r); err != nil {
+		return "", err
+	}
+	for _, name := range aliases(msg) {
+		if lists := b.lookup(name); len(lists) > 0 {
+			return lists, nil
+		}
+	}
+	return "", errors.New("aliases not in local blocklists")
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const adsHosts = `
+127.0.0.1  localhost
+0.0.0.0    ads.example.com tracker.example.net # trackers
+::         ipv6.ads.example
+192.168.1.1 router.lan
+plain.example.org
+`
+
+func packQuery(t *testing.T, name string) []byte {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLocalBlocklists(t *testing.T) {
+	var b BraveDNS = NewLocalBlocklists()
+	l := b.(*LocalBlocklists)
+	n, err := l.Load("ads", adsHosts)
+	if err != nil || n != 4 {
+		t.Fatalf("Loaded %d names, %v", n, err)
+	}
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(path, []byte("0.0.0.0 tracker.example.net\n"), 0600)
+	if _, err := l.LoadFile("privacy", path); err != nil {
+		t.Fatal(err)
+	}
+
+	if lists, err := b.BlockRequest(packQuery(t, "Tracker.Example.net.")); err != nil || lists != "ads,privacy" {
+		t.Errorf("Wrong lists %q %v", lists, err)
+	}
+	for _, name := range []string{"localhost.", "router.lan.", "sub.ads.example.com.", "example.com."} {
+		if _, err := b.BlockRequest(packQuery(t, name)); err == nil {
+			t.Errorf("%s should not be blocked", name)
+		}
+	}
+	if _, err := b.BlockRequest(packQuery(t, "plain.example.org.")); err != nil {
+		t.Error("Name-only line not blocked")
+	}
+
+	// Stamps select lists in effect.
+	b.SetStamp("privacy")
+	if _, err := b.BlockRequest(packQuery(t, "ads.example.com.")); err == nil {
+		t.Error("List not in effect blocked")
+	}
+	b.SetStamp("")
+
+	// Reloading a list replaces it, without touching the others.
+	l.Load("ads", "0.0.0.0 new.example\n")
+	if _, err := b.BlockRequest(packQuery(t, "ads.example.com.")); err == nil {
+		t.Error("Reloaded list kept stale names")
+	}
+	if lists, _ := b.BlockRequest(packQuery(t, "tracker.example.net.")); lists != "privacy" {
+		t.Errorf("Other list changed %q", lists)
+	}
+	l.Remove("privacy")
+	if _, err := b.BlockRequest(packQuery(t, "tracker.example.net.")); err == nil {
+		t.Error("Removed list blocked")
+	}
+
+	// CNAME cloaking
+	r := new(dns.Msg)
+	r.SetQuestion("innocent.example.", dns.TypeA)
+	r.Answer = []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "innocent.example.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "new.example.",
+	}}
+	res, _ := r.Pack()
+	if lists, err := b.BlockResponse(res); err != nil || lists != "ads" {
+		t.Errorf("Cloaked name not blocked %q %v", lists, err)
+	}
+}
+
+func TestLocalBlocklistsABP(t *testing.T) {
+	l := NewLocalBlocklists()
+	abp := `[Adblock Plus 2.0]
+! Title: test list
+||ads.example.com^
+||track.example.org^$important
+||cosmetic.example.net^$third-party
+example.com##.banner
+||paths.example.net/ads/*
+@@||ok.ads.example.com^
+`
+	if n, err := l.Load("abp", abp); err != nil || n != 3 {
+		t.Fatalf("Expected 3 rules, got %d %v", n, err)
+	}
+	var b BraveDNS = l
+	for _, name := range []string{"ads.example.com.", "x.y.ads.example.com.", "track.example.org."} {
+		if lists, err := b.BlockRequest(packQuery(t, name)); err != nil || lists != "abp" {
+			t.Errorf("%s not blocked %q %v", name, lists, err)
+		}
+	}
+	for _, name := range []string{"ok.ads.example.com.", "a.ok.ads.example.com.", "example.com.", "cosmetic.example.net.", "paths.example.net."} {
+		if _, err := b.BlockRequest(packQuery(t, name)); err == nil {
+			t.Errorf("%s blocked", name)
+		}
+	}
+
+	// Exceptions apply to blocks of other lists, too.
+	l.Load("hosts", "0.0.0.0 ok.ads.example.com\n")
+	if _, err := b.BlockRequest(packQuery(t, "ok.ads.example.com.")); err == nil {
+		t.Error("Exception ignored")
+	}
+	// but only while the list with the exception is in effect.
+	b.SetStamp("hosts")
+	if lists, _ := b.BlockRequest(packQuery(t, "ok.ads.example.com.")); lists != "hosts" {
+		t.Errorf("Exception of list not in effect applied %q", lists)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	cname := func(owner, target string) dns.RR {
+		return &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: target,
+		}
+	}
+	r := new(dns.Msg)
+	r.SetQuestion("www.shop.example.", dns.TypeA)
+	// out of order, with a loop and a stray record
+	r.Answer = []dns.RR{
+		cname("metrics.shop.example.", "shop.tracker.example."),
+		cname("www.Shop.example.", "metrics.shop.example."),
+		cname("shop.tracker.example.", "www.shop.example."),
+		cname("other.example.", "stray.example."),
+	}
+	got := aliases(r)
+	want := []string{"metrics.shop.example.", "shop.tracker.example.", "www.shop.example.", "stray.example."}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	}
+
+	// Blocked intermediate names in the chain block the answer.
+	l := NewLocalBlocklists()
+	l.Load("trackers", "||tracker.example^\n")
+	r.Answer = r.Answer[1:2]
+	r.Answer = append(r.Answer, cname("metrics.shop.example.", "shop.tracker.example."),
+		cname("shop.tracker.example.", "cdn.example."))
+	res, _ := r.Pack()
+	if lists, err := l.BlockResponse(res); err != nil || lists != "trackers" {
+		t.Errorf("Cloaked intermediate name not blocked %q %v", lists, err)
+	}
+	if aliases(new(dns.Msg)) != nil {
+		t.Error("Expected no aliases")
+	}
+}
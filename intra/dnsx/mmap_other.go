@@ -0,0 +1,21 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package dnsx
+
+import "io/ioutil"
+
+// mapFile reads the file at path into memory, where mmap isn't supported.
+func mapFile(path string) ([]byte, func() error, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, func() error { return nil }, nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Query types miekg/dns doesn't know of yet.
+const (
+	TypeSVCB  uint16 = 64
+	TypeHTTPS uint16 = 65
+)
+
+// Actions on filtered query types.
+const (
+	// FilterRefuse answers with REFUSED.
+	FilterRefuse = 0
+	// FilterEmpty answers with an empty answer (NODATA), which clients take
+	// to mean the name has no such records.
+	FilterEmpty = 1
+)
+
+// DefaultFilteredQtypes are query types that leak metadata, or carry ips
+// and keys (like HTTPS records with ECH configs and ip hints) that bypass
+// filtering of A and AAAA answers.
+const DefaultFilteredQtypes = "ANY,HTTPS,SVCB,NULL"
+
+// QtypeFilter answers queries of filtered types locally, without sending
+// them upstream, and forwards all others to the Transport it wraps.
+type QtypeFilter struct {
+	sync.RWMutex
+	Transport
+	actions map[uint16]int
+}
+
+// NewQtypeFilter returns a Transport that filters query types before `t`.
+// No types are filtered until set to be.
+func NewQtypeFilter(t Transport) Transport {
+	return &QtypeFilter{Transport: t, actions: make(map[uint16]int)}
+}
+
+// Inner implements Wrapper.
+func (f *QtypeFilter) Inner() Transport {
+	return f.Transport
+}
+
+// parseQtype returns the query type named s, like HTTPS, TYPE65, or 65.
+func parseQtype(s string) (uint16, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	switch s {
+	case "SVCB":
+		return TypeSVCB, nil
+	case "HTTPS":
+		return TypeHTTPS, nil
+	}
+	if t, ok := dns.StringToType[s]; ok {
+		return t, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16)
+	if err != nil {
+		return 0, errors.New("unknown query type " + s)
+	}
+	return uint16(n), nil
+}
+
+// Set filters `qtypes`, a comma-separated list of query types, with `action`.
+func (f *QtypeFilter) Set(qtypes string, action int) error {
+	if action != FilterRefuse && action != FilterEmpty {
+		return errors.New("unknown filter action")
+	}
+	var types []uint16
+	for _, v := range strings.Split(qtypes, ",") {
+		if len(strings.TrimSpace(v)) == 0 {
+			continue
+		}
+		t, err := parseQtype(v)
+		if err != nil {
+			return err
+		}
+		types = append(types, t)
+	}
+	f.Lock()
+	for _, t := range types {
+		f.actions[t] = action
+	}
+	f.Unlock()
+	return nil
+}
+
+// Unset stops filtering `qtypes`, a comma-separated list of query types.
+func (f *QtypeFilter) Unset(qtypes string) {
+	f.Lock()
+	defer f.Unlock()
+	for _, v := range strings.Split(qtypes, ",") {
+		if t, err := parseQtype(v); err == nil {
+			delete(f.actions, t)
+		}
+	}
+}
+
+// Query implements Transport.
+func (f *QtypeFilter) Query(q []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil || len(msg.Question) != 1 {
+		return f.Transport.Query(q)
+	}
+	f.RLock()
+	action, ok := f.actions[msg.Question[0].Qtype]
+	f.RUnlock()
+	if !ok {
+		return f.Transport.Query(q)
+	}
+	if action == FilterEmpty {
+		return answer(msg, nil).Pack()
+	}
+	return new(dns.Msg).SetRcode(msg, dns.RcodeRefused).Pack()
+}
+
+// FilterQtypes filters `qtypes` with `action` on the QtypeFilter in `t`'s
+// chain of wrappers.  See QtypeFilter.Set.
+func FilterQtypes(t Transport, qtypes string, action int) error {
+	var err error
+	found := walk(t, func(t Transport) bool {
+		f, ok := t.(*QtypeFilter)
+		if ok {
+			err = f.Set(qtypes, action)
+		}
+		return ok
+	})
+	if !found {
+		return errors.New("no qtype filter")
+	}
+	return err
+}
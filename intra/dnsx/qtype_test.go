@@ -0,0 +1,46 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQtypeFilter(t *testing.T) {
+	f := &fakeTransport{ttl: 60}
+	tr := NewQtypeFilter(f)
+	if err := FilterQtypes(tr, DefaultFilteredQtypes, FilterEmpty); err != nil {
+		t.Fatal(err)
+	}
+	if err := FilterQtypes(tr, "TYPE99", FilterRefuse); err != nil {
+		t.Fatal(err)
+	}
+	if err := FilterQtypes(tr, "BOGUS", FilterRefuse); err == nil {
+		t.Error("Expected error for unknown type")
+	}
+
+	if r := queryType(t, tr, "example.com.", TypeHTTPS); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Errorf("Expected nodata, got %v", r)
+	}
+	if r := queryType(t, tr, "example.com.", dns.TypeANY); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Errorf("Expected nodata, got %v", r)
+	}
+	if r := queryType(t, tr, "example.com.", dns.TypeSPF); r.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected refused, got %v", r)
+	}
+	if f.queries != 0 {
+		t.Error("Filtered queries sent upstream")
+	}
+	queryType(t, tr, "example.com.", dns.TypeA)
+	tr.(*QtypeFilter).Unset("any")
+	queryType(t, tr, "example.com.", dns.TypeANY)
+	if f.queries != 2 {
+		t.Errorf("Expected 2 upstream queries, got %d", f.queries)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"sync"
+
+	"github.com/celzero/firestack/intra/diag"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// DefaultListenerQueue is the number of listener calls queued by default.
+const DefaultListenerQueue = 64
+
+// ListenerQueue calls listeners, in the order the calls are pushed, on a
+// goroutine of its own, so that slow listeners, like those across gobind,
+// don't hold up queries.  Once full, it drops its oldest call to queue the
+// next.  Queues of size 0, and nil queues, call listeners as calls are pushed.
+type ListenerQueue struct {
+	sync.Mutex
+	idle    *sync.Cond // signalled once calls are drained
+	calls   []func()
+	size    int
+	running bool // whether a goroutine is delivering calls
+	dropped int64
+}
+
+// NewListenerQueue returns a queue of up to `size` calls.
+func NewListenerQueue(size int) *ListenerQueue {
+	q := &ListenerQueue{}
+	q.idle = sync.NewCond(&q.Mutex)
+	q.SetSize(size)
+	return q
+}
+
+// SetSize sets q to queue up to `size` calls, dropping its oldest calls
+// if it holds more; size <= 0 calls listeners as calls are pushed.
+func (q *ListenerQueue) SetSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.size = size
+	if n := len(q.calls) - size; n > 0 && size > 0 {
+		q.drop(n)
+	}
+}
+
+// Push queues `call`, or, if q is of size 0, calls it once the calls queued
+// before it are done.
+func (q *ListenerQueue) Push(call func()) {
+	if q == nil {
+		call()
+		return
+	}
+	q.Lock()
+	if q.size <= 0 {
+		for q.running {
+			q.idle.Wait()
+		}
+		q.Unlock()
+		call()
+		return
+	}
+	if len(q.calls) >= q.size {
+		q.drop(len(q.calls) - q.size + 1)
+	}
+	q.calls = append(q.calls, call)
+	if !q.running {
+		q.running = true
+		diag.Go(diag.DNS, q.deliver)
+	}
+	q.Unlock()
+}
+
+// drop drops the `n` oldest calls; q must be locked.
+func (q *ListenerQueue) drop(n int) {
+	q.dropped += int64(n)
+	log.Warnf("listener queue full; dropped %d calls, %d in all", n, q.dropped)
+	q.calls = append(q.calls[:0], q.calls[n:]...)
+}
+
+func (q *ListenerQueue) deliver() {
+	for {
+		q.Lock()
+		if len(q.calls) == 0 {
+			q.running = false
+			q.idle.Broadcast()
+			q.Unlock()
+			return
+		}
+		call := q.calls[0]
+		q.calls[0] = nil
+		q.calls = q.calls[1:]
+		q.Unlock()
+		call()
+	}
+}
+
+// Flush waits till the calls queued so far, and any queued meanwhile, are done.
+func (q *ListenerQueue) Flush() {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	for q.running {
+		q.idle.Wait()
+	}
+	q.Unlock()
+}
+
+// Dropped returns the number of calls q dropped as it was full.
+func (q *ListenerQueue) Dropped() int64 {
+	if q == nil {
+		return 0
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.dropped
+}
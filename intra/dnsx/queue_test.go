@@ -0,0 +1,55 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListenerQueueDropsOldest(t *testing.T) {
+	q := NewListenerQueue(2)
+	stall := make(chan struct{})
+	var got []int
+	// the first call holds up those after it, as a slow listener would
+	started := make(chan struct{})
+	q.Push(func() {
+		close(started)
+		<-stall
+		got = append(got, 0)
+	})
+	<-started
+	for i := 1; i <= 4; i++ {
+		i := i
+		q.Push(func() { got = append(got, i) })
+	}
+	close(stall)
+	q.Flush()
+	if want := []int{0, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+	if d := q.Dropped(); d != 2 {
+		t.Errorf("dropped %d", d)
+	}
+}
+
+func TestListenerQueueSync(t *testing.T) {
+	for _, q := range []*ListenerQueue{nil, NewListenerQueue(0)} {
+		called := false
+		q.Push(func() { called = true })
+		if !called {
+			t.Errorf("queue %v: not called as pushed", q)
+		}
+	}
+	q := NewListenerQueue(4)
+	q.SetSize(0)
+	called := false
+	q.Push(func() { called = true })
+	if !called {
+		t.Error("resized queue: not called as pushed")
+	}
+}
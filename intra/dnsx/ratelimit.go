@@ -0,0 +1,127 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/events"
+	"github.com/celzero/firestack/intra/metrics"
+	"github.com/celzero/firestack/intra/throttle"
+	"github.com/miekg/dns"
+)
+
+var errRateLimited = errors.New("over rate limit")
+
+// RateLimiter answers queries over its rate, of queries per second in
+// bursts of up to its burst, with REFUSED, without sending them, so that an
+// app flooding dns doesn't get the user's resolver account throttled.
+type RateLimiter struct {
+	sync.Mutex
+	Transport
+	b        *throttle.Bucket // nil if unlimited
+	qps      int
+	burst    int
+	limiting bool      // whether queries are being refused
+	refused  time.Time // when the last query was refused
+	limited  int64
+}
+
+// limitQuiet is how long queries must go unrefused for a limit to end.
+const limitQuiet = time.Second
+
+// NewRateLimiter returns a Transport that sends up to `qps` queries per
+// second to `t`, in bursts of up to `burst`; see RateLimiter.Set.
+func NewRateLimiter(t Transport, qps int, burst int) Transport {
+	r := &RateLimiter{Transport: t}
+	r.Set(qps, burst)
+	return r
+}
+
+// Inner implements Wrapper.
+func (r *RateLimiter) Inner() Transport {
+	return r.Transport
+}
+
+// Set limits r to `qps` queries per second, in bursts of up to `burst`, or
+// of a second's worth if burst <= 0; qps <= 0 limits nothing.
+func (r *RateLimiter) Set(qps int, burst int) {
+	if burst <= 0 {
+		burst = qps
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.b = throttle.NewRate(qps, burst)
+	r.qps, r.burst = qps, burst
+	r.limiting = false
+}
+
+// Limited returns the number of queries r refused.
+func (r *RateLimiter) Limited() int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.limited
+}
+
+// allow reports whether a query may be sent, and tells of r starting to
+// refuse queries, and of it ending once queries go unrefused for limitQuiet.
+func (r *RateLimiter) allow() bool {
+	now := time.Now()
+	r.Lock()
+	ok := r.b.Allow(1)
+	started := !ok && !r.limiting
+	ended := ok && r.limiting && now.Sub(r.refused) >= limitQuiet
+	if !ok {
+		r.limited++
+		r.refused = now
+	}
+	r.limiting = (r.limiting || started) && !ended
+	qps, burst := r.qps, r.burst
+	r.Unlock()
+
+	url := r.GetURL()
+	if !ok {
+		metrics.Add(metrics.DNSRateLimited, 1, "transport", url)
+	}
+	if started {
+		events.Publish(events.RateLimitStarted, url, fmt.Sprintf("%d qps, %d burst", qps, burst))
+	} else if ended {
+		events.Publish(events.RateLimitEnded, url, "")
+	}
+	return ok
+}
+
+// Query implements Transport.
+func (r *RateLimiter) Query(q []byte) ([]byte, error) {
+	if r.allow() {
+		return r.Transport.Query(q)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return nil, errRateLimited
+	}
+	return new(dns.Msg).SetRcode(msg, dns.RcodeRefused).Pack()
+}
+
+// SetRateLimit limits the RateLimiter in `t`'s chain of wrappers to `qps`
+// queries per second, in bursts of up to `burst`.  See RateLimiter.Set.
+func SetRateLimit(t Transport, qps int, burst int) error {
+	found := walk(t, func(t Transport) bool {
+		r, ok := t.(*RateLimiter)
+		if ok {
+			r.Set(qps, burst)
+		}
+		return ok
+	})
+	if !found {
+		return errors.New("no rate limiter")
+	}
+	return nil
+}
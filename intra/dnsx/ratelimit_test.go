@@ -0,0 +1,45 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimiter(t *testing.T) {
+	f := &fakeTransport{ttl: 60}
+	tr := NewRateLimiter(f, 1, 3)
+	for i := 0; i < 5; i++ {
+		r := queryType(t, tr, "example.com.", dns.TypeA)
+		if i < 3 && r.Rcode != dns.RcodeSuccess {
+			t.Errorf("query %d in burst: %v", i, r)
+		}
+		if i >= 3 && r.Rcode != dns.RcodeRefused {
+			t.Errorf("query %d over burst: %v", i, r)
+		}
+	}
+	if f.queries != 3 {
+		t.Errorf("%d queries sent upstream, want 3", f.queries)
+	}
+	if n := tr.(*RateLimiter).Limited(); n != 2 {
+		t.Errorf("limited %d, want 2", n)
+	}
+
+	if err := SetRateLimit(NewQtypeFilter(tr), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if r := queryType(t, tr, "example.com.", dns.TypeA); r.Rcode != dns.RcodeSuccess {
+			t.Errorf("unlimited query %d: %v", i, r)
+		}
+	}
+	if err := SetRateLimit(f, 1, 1); err == nil {
+		t.Error("rate limit set on a transport without a limiter")
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Actions of rewrite rules.  The first three are taken before the query is
+// sent upstream, and the last on the upstream answer.
+const (
+	// RewriteIP answers A and AAAA queries with the rule's comma-separated ips.
+	RewriteIP = 0
+	// RewriteCNAME aliases the name to the rule's target name, which is then
+	// resolved upstream in its place.
+	RewriteCNAME = 1
+	// RewriteNXDomain answers all queries with NXDOMAIN.
+	RewriteNXDomain = 2
+	// RewriteDropIPs removes ips in the rule's comma-separated cidrs from
+	// answers; answers left without any ips become NXDOMAIN.
+	RewriteDropIPs = 3
+)
+
+type rule struct {
+	Pattern string `json:"pattern"`
+	Action  int    `json:"action"`
+	Value   string `json:"value"`
+	ips     []net.IP
+	nets    []*net.IPNet
+	target  string
+}
+
+// matches reports whether name, in canonical form, matches r's pattern:
+// a name, "*." and a name for the names under it, or "*" for all names.
+func (r *rule) matches(name string) bool {
+	switch {
+	case r.Pattern == "*":
+		return true
+	case strings.HasPrefix(r.Pattern, "*."):
+		parent := r.Pattern[2:]
+		return name != parent && dns.IsSubDomain(parent, name)
+	default:
+		return name == r.Pattern
+	}
+}
+
+// Rewriter rewrites queries and answers as per user-defined rules, and
+// forwards queries to the Transport it wraps.  Rules are evaluated in the
+// order they were added, and the first to match a name applies.
+type Rewriter struct {
+	sync.RWMutex
+	Transport
+	rules []*rule
+}
+
+// NewRewriter returns a Transport that rewrites queries to, and answers
+// from, `t`.
+func NewRewriter(t Transport) Transport {
+	return &Rewriter{Transport: t}
+}
+
+// Inner implements Wrapper.
+func (w *Rewriter) Inner() Transport {
+	return w.Transport
+}
+
+// Add appends a rule that takes `action` on names that match `pattern`,
+// with the action's `value`, if any.
+func (w *Rewriter) Add(pattern string, action int, value string) error {
+	pattern = strings.TrimSpace(pattern)
+	r := &rule{Action: action, Value: value}
+	if pattern == "*" {
+		r.Pattern = pattern
+	} else {
+		name := strings.TrimPrefix(pattern, "*.")
+		if _, ok := dns.IsDomainName(name); !ok || len(name) == 0 {
+			return errors.New("invalid rewrite pattern " + pattern)
+		}
+		r.Pattern = pattern[:len(pattern)-len(name)] + dns.CanonicalName(name)
+	}
+
+	switch action {
+	case RewriteIP:
+		for _, v := range strings.Split(value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(v))
+			if ip == nil {
+				return errors.New("invalid rewrite ip " + v)
+			}
+			r.ips = append(r.ips, ip)
+		}
+	case RewriteCNAME:
+		if _, ok := dns.IsDomainName(value); !ok || len(value) == 0 {
+			return errors.New("invalid rewrite target " + value)
+		}
+		r.target = dns.CanonicalName(value)
+	case RewriteNXDomain:
+	case RewriteDropIPs:
+		for _, v := range strings.Split(value, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(v))
+			if err != nil {
+				return err
+			}
+			r.nets = append(r.nets, n)
+		}
+	default:
+		return errors.New("unknown rewrite action")
+	}
+
+	w.Lock()
+	w.rules = append(w.rules, r)
+	w.Unlock()
+	return nil
+}
+
+// Clear drops all rules.
+func (w *Rewriter) Clear() {
+	w.Lock()
+	w.rules = nil
+	w.Unlock()
+}
+
+// Rules returns w's rules as a json array.
+func (w *Rewriter) Rules() string {
+	w.RLock()
+	defer w.RUnlock()
+	if len(w.rules) == 0 {
+		return "[]"
+	}
+	b, err := json.Marshal(w.rules)
+	if err != nil {
+		return "[]"
+	}
+	return string(b)
+}
+
+// match returns the first rule that matches name for the given stage.
+func (w *Rewriter) match(name string, after bool) *rule {
+	w.RLock()
+	defer w.RUnlock()
+	for _, r := range w.rules {
+		if (r.Action == RewriteDropIPs) == after && r.matches(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Query implements Transport.
+func (w *Rewriter) Query(q []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil || len(msg.Question) != 1 {
+		return w.Transport.Query(q)
+	}
+	question := msg.Question[0]
+	name := dns.CanonicalName(question.Name)
+
+	if r := w.match(name, false); r != nil {
+		switch r.Action {
+		case RewriteIP:
+			if question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA {
+				return answer(msg, r.ips).Pack()
+			}
+			// no other records
+			return answer(msg, nil).Pack()
+		case RewriteNXDomain:
+			return new(dns.Msg).SetRcode(msg, dns.RcodeNameError).Pack()
+		case RewriteCNAME:
+			return w.alias(msg, r.target)
+		}
+	}
+
+	res, err := w.Transport.Query(q)
+	if err != nil {
+		return res, err
+	}
+	if r := w.match(name, true); r != nil {
+		return dropIPs(msg, res, r.nets), nil
+	}
+	return res, nil
+}
+
+// alias resolves target in place of the name queried in msg, and answers
+// with a CNAME to target followed by target's records.
+func (w *Rewriter) alias(msg *dns.Msg, target string) ([]byte, error) {
+	question := msg.Question[0]
+	aq := msg.Copy()
+	aq.Question[0].Name = target
+	b, err := aq.Pack()
+	if err != nil {
+		return nil, err
+	}
+	res, err := w.Transport.Query(b)
+	if err != nil {
+		return res, err
+	}
+	ans := new(dns.Msg)
+	if err := ans.Unpack(res); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	r.SetRcode(msg, ans.Rcode)
+	r.RecursionAvailable = true
+	r.Answer = append([]dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: hostsTTL},
+		Target: target,
+	}}, ans.Answer...)
+	r.Ns = ans.Ns
+	return r.Pack()
+}
+
+// dropIPs removes address records in nets from res, the answer to msg.
+func dropIPs(msg *dns.Msg, res []byte, nets []*net.IPNet) []byte {
+	ans := new(dns.Msg)
+	if err := ans.Unpack(res); err != nil {
+		return res
+	}
+	in := func(ip net.IP) bool {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	kept := ans.Answer[:0]
+	dropped, addrs := false, 0
+	for _, rr := range ans.Answer {
+		var ip net.IP
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		}
+		if ip != nil && in(ip) {
+			dropped = true
+			continue
+		}
+		if ip != nil {
+			addrs++
+		}
+		kept = append(kept, rr)
+	}
+	if !dropped {
+		return res
+	}
+	if addrs == 0 {
+		b, err := new(dns.Msg).SetRcode(msg, dns.RcodeNameError).Pack()
+		if err != nil {
+			return res
+		}
+		return b
+	}
+	ans.Answer = kept
+	if b, err := ans.Pack(); err == nil {
+		return b
+	}
+	return res
+}
+
+// AddRewrite appends a rule to the Rewriter in `t`'s chain of wrappers;
+// see Rewriter.Add.
+func AddRewrite(t Transport, pattern string, action int, value string) error {
+	var err error
+	found := walk(t, func(t Transport) bool {
+		w, ok := t.(*Rewriter)
+		if ok {
+			err = w.Add(pattern, action, value)
+		}
+		return ok
+	})
+	if !found {
+		return errors.New("no rewriter")
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRewrite(t *testing.T) {
+	f := &fakeTransport{ttl: 60}
+	tr := NewRewriter(f)
+	must := func(pattern string, action int, value string) {
+		if err := AddRewrite(tr, pattern, action, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	must("printer.home", RewriteIP, "10.0.0.5")
+	must("*.ads.example", RewriteNXDomain, "")
+	must("old.example", RewriteCNAME, "new.example")
+	must("*", RewriteDropIPs, "192.0.2.0/24")
+
+	if r := query(t, tr, "printer.home.", 1); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "10.0.0.5" {
+		t.Errorf("Wrong ip rewrite %v", r.Answer)
+	}
+	if r := query(t, tr, "x.ads.example.", 2); r.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected nxdomain, got %d", r.Rcode)
+	}
+	if f.queries != 0 {
+		t.Error("Rewritten queries sent upstream")
+	}
+
+	// The fake upstream answers every name with 192.0.2.1, which is dropped.
+	if r := query(t, tr, "ads.example.", 3); r.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected dropped answer to be nxdomain, got %v", r)
+	}
+	r := query(t, tr, "old.example.", 4)
+	if len(r.Answer) < 1 || r.Answer[0].(*dns.CNAME).Target != "new.example." {
+		t.Errorf("Wrong alias %v", r.Answer)
+	}
+	if f.queries != 2 {
+		t.Errorf("Expected 2 upstream queries, got %d", f.queries)
+	}
+
+	if !strings.Contains(tr.(*Rewriter).Rules(), `"pattern":"*.ads.example."`) {
+		t.Errorf("Wrong rules %s", tr.(*Rewriter).Rules())
+	}
+	tr.(*Rewriter).Clear()
+	if tr.(*Rewriter).Rules() != "[]" {
+		t.Error("Rules not cleared")
+	}
+}
+
+func TestBadRewrite(t *testing.T) {
+	w := NewRewriter(&fakeTransport{}).(*Rewriter)
+	if err := w.Add("a..b", RewriteNXDomain, ""); err == nil {
+		t.Error("Expected error for bad pattern")
+	}
+	if err := w.Add("a.b", RewriteIP, "x"); err == nil {
+		t.Error("Expected error for bad ip")
+	}
+	if err := w.Add("a.b", RewriteDropIPs, "10.0.0.0"); err == nil {
+		t.Error("Expected error for bad cidr")
+	}
+	if err := w.Add("a.b", 9, ""); err == nil {
+		t.Error("Expected error for bad action")
+	}
+}
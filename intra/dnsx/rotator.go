@@ -0,0 +1,134 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Modes of distributing queries among a Rotator's transports.
+const (
+	// RoundRobin sends each query to the next transport in turn.
+	RoundRobin = 0
+	// HashDomain sends all queries for a registrable domain (eTLD+1) to the
+	// same transport, so that each resolver sees only a slice of the domains
+	// visited, but all of the names under any one of them.
+	HashDomain = 1
+)
+
+// Rotator distributes queries across a set of transports, so that no single
+// resolver sees all of them.  Which resolver answered how many queries is
+// kept only in memory, for Stats.
+type Rotator struct {
+	sync.Mutex
+	mode       int
+	transports []Transport
+	counts     []int64
+	next       int
+}
+
+// NewRotator returns an empty Rotator that distributes queries per `mode`.
+// Transports are added with Add.
+func NewRotator(mode int) (*Rotator, error) {
+	if mode != RoundRobin && mode != HashDomain {
+		return nil, errors.New("unknown rotation mode")
+	}
+	return &Rotator{mode: mode}, nil
+}
+
+// Add adds t to the transports queries are distributed across.
+func (r *Rotator) Add(t Transport) {
+	r.Lock()
+	r.transports = append(r.transports, t)
+	r.counts = append(r.counts, 0)
+	r.Unlock()
+}
+
+// registrable returns the eTLD+1 of the name queried in q, or the name
+// itself if it has none.
+func registrable(q []byte) string {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil || len(msg.Question) != 1 {
+		return ""
+	}
+	name := strings.TrimSuffix(strings.ToLower(msg.Question[0].Name), ".")
+	if d, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		return d
+	}
+	return name
+}
+
+// pick returns the index of the transport to send q to.  Must be called
+// under Lock, with at least one transport.
+func (r *Rotator) pick(q []byte) int {
+	if r.mode == HashDomain {
+		h := fnv.New32a()
+		h.Write([]byte(registrable(q)))
+		return int(h.Sum32() % uint32(len(r.transports)))
+	}
+	i := r.next % len(r.transports)
+	r.next = i + 1
+	return i
+}
+
+// Query implements Transport.
+func (r *Rotator) Query(q []byte) ([]byte, error) {
+	r.Lock()
+	if len(r.transports) == 0 {
+		r.Unlock()
+		return nil, errors.New("no transports to rotate")
+	}
+	i := r.pick(q)
+	t := r.transports[i]
+	r.counts[i]++
+	r.Unlock()
+	return t.Query(q)
+}
+
+// GetURL returns the comma-separated urls of r's transports.
+func (r *Rotator) GetURL() string {
+	r.Lock()
+	defer r.Unlock()
+	urls := make([]string, len(r.transports))
+	for i, t := range r.transports {
+		urls[i] = t.GetURL()
+	}
+	return strings.Join(urls, ",")
+}
+
+// SetBraveDNS sets b on all of r's transports.
+func (r *Rotator) SetBraveDNS(b BraveDNS) {
+	r.Lock()
+	transports := r.transports
+	r.Unlock()
+	for _, t := range transports {
+		t.SetBraveDNS(b)
+	}
+}
+
+// Stats returns a json object of the number of queries sent to each
+// transport, keyed by url.
+func (r *Rotator) Stats() string {
+	r.Lock()
+	counts := make(map[string]int64, len(r.transports))
+	for i, t := range r.transports {
+		counts[t.GetURL()] += r.counts[i]
+	}
+	r.Unlock()
+	b, err := json.Marshal(counts)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
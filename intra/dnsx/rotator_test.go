@@ -0,0 +1,70 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type namedTransport struct {
+	fakeTransport
+	url string
+}
+
+func (n *namedTransport) GetURL() string {
+	return n.url
+}
+
+func TestRoundRobin(t *testing.T) {
+	r, err := NewRotator(RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := &namedTransport{url: "a"}, &namedTransport{url: "b"}
+	r.Add(a)
+	r.Add(b)
+	for i := 0; i < 4; i++ {
+		query(t, r, "example.com.", uint16(i))
+	}
+	if a.queries != 2 || b.queries != 2 {
+		t.Errorf("Uneven rotation %d %d", a.queries, b.queries)
+	}
+	if r.GetURL() != "a,b" {
+		t.Errorf("Wrong url %s", r.GetURL())
+	}
+	var stats map[string]int64
+	if err := json.Unmarshal([]byte(r.Stats()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats["a"] != 2 || stats["b"] != 2 {
+		t.Errorf("Wrong stats %v", stats)
+	}
+}
+
+func TestHashDomain(t *testing.T) {
+	r, _ := NewRotator(HashDomain)
+	a, b := &namedTransport{url: "a"}, &namedTransport{url: "b"}
+	r.Add(a)
+	r.Add(b)
+	for _, name := range []string{"example.co.uk.", "www.example.co.uk.", "cdn.a.example.co.uk."} {
+		query(t, r, name, 1)
+	}
+	if a.queries != 3 && b.queries != 3 {
+		t.Errorf("Names of one domain sent to different resolvers %d %d", a.queries, b.queries)
+	}
+}
+
+func TestEmptyRotator(t *testing.T) {
+	if _, err := NewRotator(7); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+	r, _ := NewRotator(RoundRobin)
+	if _, err := r.Query(nil); err == nil {
+		t.Error("Expected error without transports")
+	}
+}
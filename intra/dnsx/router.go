@@ -0,0 +1,244 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/miekg/dns"
+)
+
+// Router sends queries for names under configured domain suffixes to the
+// transports routed to them, like a corporate Do53 resolver for *.corp.example,
+// and all other queries to the Transport it wraps (split-horizon dns).  Routes
+// may also name transports registered with the Router, as may its Chooser,
+// which, if set, picks the transport of each query ahead of the routes.
+type Router struct {
+	sync.RWMutex
+	Transport
+	// routes maps canonical suffixes to transports
+	routes map[string]Transport
+	// named maps canonical suffixes to the ids of registered transports
+	named map[string]string
+	// registered maps ids to transports
+	registered map[string]Transport
+	chooser    Chooser
+}
+
+// Chooser picks the transport of each query, by the id it's registered with
+// on a Router, say, the Tor-backed resolver for *.onion names.  It is
+// called as queries arrive, so it must return quickly.
+type Chooser interface {
+	// Choose returns the id of the transport to send the query of `qname`
+	// and `qtype` to, or "" to route it as the Router would.
+	Choose(qname string, qtype int) string
+}
+
+// NewRouter returns a Transport that routes queries not covered by any
+// route to `fallback`.
+func NewRouter(fallback Transport) Transport {
+	return &Router{
+		Transport:  fallback,
+		routes:     make(map[string]Transport),
+		named:      make(map[string]string),
+		registered: make(map[string]Transport),
+	}
+}
+
+// Inner implements Wrapper.
+func (r *Router) Inner() Transport {
+	return r.Transport
+}
+
+// Route sends queries for `suffix` and names under it to `t`, in place of
+// any transport previously routed to suffix.  A nil t removes the route.
+func (r *Router) Route(suffix string, t Transport) error {
+	suffix, err := routeSuffix(suffix)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	delete(r.named, suffix)
+	if t == nil {
+		delete(r.routes, suffix)
+	} else {
+		r.routes[suffix] = t
+	}
+	return nil
+}
+
+// RouteTo sends queries for `suffix` and names under it to the transport
+// registered as `id`, whichever it is when they're sent, in place of any
+// transport previously routed to suffix.  An empty id removes the route.
+func (r *Router) RouteTo(suffix string, id string) error {
+	suffix, err := routeSuffix(suffix)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	delete(r.routes, suffix)
+	if len(id) == 0 {
+		delete(r.named, suffix)
+	} else {
+		r.named[suffix] = id
+	}
+	return nil
+}
+
+// Register registers `t` as `id`, for routes and the Chooser to name, in
+// place of any transport previously registered as id.  A nil t unregisters
+// it; queries routed to ids not registered go to the fallback.
+func (r *Router) Register(id string, t Transport) error {
+	if len(id) == 0 {
+		return errors.New("no transport id")
+	}
+	r.Lock()
+	defer r.Unlock()
+	if t == nil {
+		delete(r.registered, id)
+	} else {
+		r.registered[id] = t
+	}
+	return nil
+}
+
+// SetChooser sets `c` to pick the transports of queries; nil unsets it.
+func (r *Router) SetChooser(c Chooser) {
+	r.Lock()
+	r.chooser = c
+	r.Unlock()
+}
+
+func routeSuffix(suffix string) (string, error) {
+	suffix = strings.TrimPrefix(strings.TrimSpace(suffix), "*.")
+	if _, ok := dns.IsDomainName(suffix); !ok || len(suffix) == 0 || suffix == "." {
+		return "", errors.New("invalid route suffix " + suffix)
+	}
+	return dns.CanonicalName(suffix), nil
+}
+
+// route returns the transport for name: that of its longest routed suffix,
+// or else the fallback.
+func (r *Router) route(name string) Transport {
+	name = dns.CanonicalName(name)
+	r.RLock()
+	defer r.RUnlock()
+	if len(r.routes) == 0 && len(r.named) == 0 {
+		return r.Transport
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if t, ok := r.routes[name[off:]]; ok {
+			return t
+		}
+		if id, ok := r.named[name[off:]]; ok {
+			if t, ok := r.registered[id]; ok {
+				return t
+			}
+			log.Warnf("router: %s routed to unregistered transport %s", name, id)
+			return r.Transport
+		}
+	}
+	return r.Transport
+}
+
+// chosen returns the transport the Chooser, if any, picks for q, or nil.
+func (r *Router) chosen(q dns.Question) Transport {
+	r.RLock()
+	c := r.chooser
+	r.RUnlock()
+	if c == nil {
+		return nil
+	}
+	id := c.Choose(q.Name, int(q.Qtype))
+	if len(id) == 0 {
+		return nil
+	}
+	r.RLock()
+	t, ok := r.registered[id]
+	r.RUnlock()
+	if !ok {
+		log.Warnf("router: %s chosen for unregistered transport %s", q.Name, id)
+		return nil
+	}
+	return t
+}
+
+// Query implements Transport.
+func (r *Router) Query(q []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil || len(msg.Question) != 1 {
+		return r.Transport.Query(q)
+	}
+	if t := r.chosen(msg.Question[0]); t != nil {
+		return t.Query(q)
+	}
+	return r.route(msg.Question[0].Name).Query(q)
+}
+
+// SetBraveDNS sets b on the fallback and all routed, and registered, transports.
+func (r *Router) SetBraveDNS(b BraveDNS) {
+	r.RLock()
+	transports := []Transport{r.Transport}
+	for _, t := range r.routes {
+		transports = append(transports, t)
+	}
+	for _, t := range r.registered {
+		transports = append(transports, t)
+	}
+	r.RUnlock()
+	for _, t := range transports {
+		t.SetBraveDNS(b)
+	}
+}
+
+// AddRoute routes queries for `suffix` to `route` on the Router in `t`'s
+// chain of wrappers; a nil route removes it.  See Router.Route.
+func AddRoute(t Transport, suffix string, route Transport) error {
+	return onRouter(t, func(r *Router) error { return r.Route(suffix, route) })
+}
+
+// AddRouteTo routes queries for `suffix` to the transport registered as
+// `id` on the Router in `t`'s chain of wrappers.  See Router.RouteTo.
+func AddRouteTo(t Transport, suffix string, id string) error {
+	return onRouter(t, func(r *Router) error { return r.RouteTo(suffix, id) })
+}
+
+// RegisterTransport registers `route` as `id` on the Router in `t`'s chain
+// of wrappers.  See Router.Register.
+func RegisterTransport(t Transport, id string, route Transport) error {
+	return onRouter(t, func(r *Router) error { return r.Register(id, route) })
+}
+
+// SetChooser sets `c` to pick the transports of queries on the Router in
+// `t`'s chain of wrappers.  See Router.SetChooser.
+func SetChooser(t Transport, c Chooser) error {
+	return onRouter(t, func(r *Router) error {
+		r.SetChooser(c)
+		return nil
+	})
+}
+
+// onRouter calls f with the Router in `t`'s chain of wrappers.
+func onRouter(t Transport, f func(*Router) error) error {
+	var err error
+	found := walk(t, func(t Transport) bool {
+		r, ok := t.(*Router)
+		if ok {
+			err = f(r)
+		}
+		return ok
+	})
+	if !found {
+		return errors.New("no router")
+	}
+	return err
+}
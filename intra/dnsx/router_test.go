@@ -0,0 +1,100 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import "testing"
+
+func TestRouter(t *testing.T) {
+	public, corp, lab := &namedTransport{url: "public"}, &namedTransport{url: "corp"}, &namedTransport{url: "lab"}
+	r := NewRouter(public)
+	if err := AddRoute(r, "*.corp.example", corp); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRoute(r, "lab.corp.example.", lab); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRoute(r, ".", lab); err == nil {
+		t.Error("Expected error for root route")
+	}
+
+	query(t, r, "wiki.CORP.example.", 1)
+	query(t, r, "corp.example.", 2)
+	query(t, r, "gpu.lab.corp.example.", 3)
+	query(t, r, "example.com.", 4)
+	query(t, r, "notcorp.example.", 5)
+	if corp.queries != 2 || lab.queries != 1 || public.queries != 2 {
+		t.Errorf("Wrong routing %d %d %d", corp.queries, lab.queries, public.queries)
+	}
+
+	AddRoute(r, "corp.example", nil)
+	query(t, r, "wiki.corp.example.", 6)
+	if public.queries != 3 {
+		t.Error("Removed route still in use")
+	}
+	if r.GetURL() != "public" {
+		t.Errorf("Wrong url %s", r.GetURL())
+	}
+}
+
+type onionChooser struct{}
+
+func (onionChooser) Choose(qname string, qtype int) string {
+	if qname == "x.onion." && qtype == 1 {
+		return "tor"
+	}
+	if qname == "y.onion." {
+		return "gone"
+	}
+	return ""
+}
+
+func TestRouterRegistered(t *testing.T) {
+	public, tor, corp := &namedTransport{url: "public"}, &namedTransport{url: "tor"}, &namedTransport{url: "corp"}
+	r := NewRouter(public)
+	if err := RegisterTransport(r, "corp", corp); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterTransport(r, "", corp); err == nil {
+		t.Error("Expected error for no id")
+	}
+	if err := AddRouteTo(r, "corp.example", "corp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRouteTo(r, "lab.example", "lab"); err != nil {
+		t.Fatal(err)
+	}
+	query(t, r, "wiki.corp.example.", 1)
+	query(t, r, "gpu.lab.example.", 2)
+	if corp.queries != 1 || public.queries != 1 {
+		t.Errorf("Wrong routing %d %d", corp.queries, public.queries)
+	}
+
+	if err := RegisterTransport(r, "tor", tor); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetChooser(r, onionChooser{}); err != nil {
+		t.Fatal(err)
+	}
+	query(t, r, "x.onion.", 3)
+	query(t, r, "y.onion.", 4)
+	query(t, r, "wiki.corp.example.", 5)
+	if tor.queries != 1 || public.queries != 2 || corp.queries != 2 {
+		t.Errorf("Wrong choices %d %d %d", tor.queries, public.queries, corp.queries)
+	}
+
+	// routes of transports and of ids replace one another
+	AddRoute(r, "corp.example", tor)
+	query(t, r, "wiki.corp.example.", 6)
+	AddRouteTo(r, "corp.example", "corp")
+	query(t, r, "wiki.corp.example.", 7)
+	if tor.queries != 2 || corp.queries != 3 {
+		t.Errorf("Wrong replaced routes %d %d", tor.queries, corp.queries)
+	}
+	if err := SetChooser(public, nil); err == nil {
+		t.Error("Expected error for no router")
+	}
+}
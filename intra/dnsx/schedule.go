@@ -0,0 +1,208 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// window is a time of day, from start up to end, on some days of the week.
+// Windows that end before they start run past midnight into the next day.
+type window struct {
+	// days is a bitmask of time.Weekday; 0 means all days.
+	days uint8
+	// start and end are minutes since midnight.
+	start, end int
+}
+
+// parseClock parses hh:mm into minutes since midnight.
+func parseClock(s string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 2 {
+		return 0, errors.New("invalid time " + s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, errors.New("invalid time " + s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, errors.New("invalid time " + s)
+	}
+	return h*60 + m, nil
+}
+
+// newWindow parses days, a csv of weekdays (mon,tue) or empty for all days,
+// and the times of day from and to, as hh:mm in local time.
+func newWindow(days, from, to string) (*window, error) {
+	w := &window{}
+	for _, d := range strings.Split(days, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if len(d) == 0 {
+			continue
+		}
+		if len(d) > 3 {
+			d = d[:3]
+		}
+		day, ok := weekdays[d]
+		if !ok {
+			return nil, errors.New("invalid day " + d)
+		}
+		w.days |= 1 << uint(day)
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	if w.start == w.end {
+		return nil, errors.New("empty window")
+	}
+	return w, nil
+}
+
+func (w *window) on(day time.Weekday) bool {
+	return w.days == 0 || w.days&(1<<uint(day)) != 0
+}
+
+// contains reports whether t falls in w.
+func (w *window) contains(t time.Time) bool {
+	min := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.on(t.Weekday()) && min >= w.start && min < w.end
+	}
+	// past midnight: the latter part belongs to the previous day's window
+	if min >= w.start {
+		return w.on(t.Weekday())
+	}
+	return min < w.end && w.on((t.Weekday()+6)%7)
+}
+
+// Scheduler is implemented by BraveDNS whose blocklists may be put in
+// effect on schedules, evaluated as queries are blocked.
+type Scheduler interface {
+	// AddSchedule puts blocklist `name` in effect only on `days` from `from`
+	// to `to`, as LocalBlocklists.AddSchedule does.
+	AddSchedule(name, days, from, to string) error
+	// ClearSchedule puts blocklist `name` back in effect all the time.
+	ClearSchedule(name string)
+}
+
+// inEffect reports whether any of windows contains now; no windows at all
+// are in effect all the time.
+func inEffect(windows []*window, now time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddSchedule puts the list `name` in effect only during the window `from`
+// to `to`, hh:mm in local time, on `days`, a csv of weekdays (mon,tue,...)
+// or empty for every day, in addition to any other windows of the list.
+// Lists without windows are in effect all the time.  A window from 22:00 to
+// 06:00 runs past midnight.
+func (b *LocalBlocklists) AddSchedule(name, days, from, to string) error {
+	w, err := newWindow(days, from, to)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.schedules == nil {
+		b.schedules = make(map[string][]*window)
+	}
+	b.schedules[name] = append(b.schedules[name], w)
+	return nil
+}
+
+// ClearSchedule puts the list `name` back in effect all the time.
+func (b *LocalBlocklists) ClearSchedule(name string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.schedules, name)
+}
+
+// scheduled reports whether list name is in effect at this time.  Must be
+// called under RLock.
+func (b *LocalBlocklists) scheduled(name string) bool {
+	windows, ok := b.schedules[name]
+	if !ok {
+		return true
+	}
+	now := time.Now()
+	if b.now != nil {
+		now = b.now()
+	}
+	return inEffect(windows, now)
+}
+
+// AddSchedule puts the blocklist-id `name` of the stamp in effect only
+// during the window `from` to `to` on `days`, as LocalBlocklists.AddSchedule.
+// Schedules apply to blocklists on-device; those the server blocks on, in
+// remote mode, are as its stamp says.
+func (brave *bravedns) AddSchedule(name, days, from, to string) error {
+	w, err := newWindow(days, from, to)
+	if err != nil {
+		return err
+	}
+	brave.schedmu.Lock()
+	defer brave.schedmu.Unlock()
+	if brave.schedules == nil {
+		brave.schedules = make(map[string][]*window)
+	}
+	brave.schedules[name] = append(brave.schedules[name], w)
+	return nil
+}
+
+// ClearSchedule puts the blocklist-id `name` back in effect all the time.
+func (brave *bravedns) ClearSchedule(name string) {
+	brave.schedmu.Lock()
+	defer brave.schedmu.Unlock()
+	delete(brave.schedules, name)
+}
+
+// scheduled returns those of the blocklist-ids in lists in effect at this
+// time.
+func (brave *bravedns) scheduled(lists []string) []string {
+	brave.schedmu.RLock()
+	defer brave.schedmu.RUnlock()
+	if len(brave.schedules) == 0 {
+		return lists
+	}
+	now := time.Now()
+	if brave.now != nil {
+		now = brave.now()
+	}
+	var on []string
+	for _, l := range lists {
+		if inEffect(brave.schedules[l], now) {
+			on = append(on, l)
+		}
+	}
+	return on
+}
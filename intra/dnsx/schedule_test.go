@@ -0,0 +1,107 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	for _, bad := range [][3]string{
+		{"mon", "9:00", "9:00"},
+		{"someday", "9:00", "17:00"},
+		{"", "25:00", "17:00"},
+		{"", "9", "17:00"},
+	} {
+		if _, err := newWindow(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("Invalid window %v parsed", bad)
+		}
+	}
+
+	// 2021-03-01 is a Monday.
+	at := func(day int, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2021, 3, day, c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+	work, _ := newWindow("Monday,tue", "09:00", "17:00")
+	if !work.contains(at(1, "09:00")) || work.contains(at(1, "17:00")) || work.contains(at(3, "12:00")) {
+		t.Error("Work hours window mismatch")
+	}
+	night, _ := newWindow("fri", "22:00", "06:00")
+	if !night.contains(at(5, "23:30")) || !night.contains(at(6, "05:59")) {
+		t.Error("Window past midnight not in effect")
+	}
+	if night.contains(at(5, "05:00")) || night.contains(at(6, "22:30")) {
+		t.Error("Window past midnight in effect on other days")
+	}
+}
+
+func TestLocalBlocklistsSchedule(t *testing.T) {
+	l := NewLocalBlocklists()
+	l.Load("social", "0.0.0.0 social.example\n")
+	l.Load("ads", "0.0.0.0 ads.example\n")
+	now := time.Date(2021, 3, 1, 8, 0, 0, 0, time.Local)
+	l.now = func() time.Time { return now }
+	if err := l.AddSchedule("social", "", "09:00", "17:00"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.BlockRequest(packQuery(t, "social.example.")); err == nil {
+		t.Error("Blocked outside schedule")
+	}
+	if _, err := l.BlockRequest(packQuery(t, "ads.example.")); err != nil {
+		t.Error("Unscheduled list not in effect")
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := l.BlockRequest(packQuery(t, "social.example.")); err != nil {
+		t.Error("Not blocked during schedule")
+	}
+	now = now.Add(8 * time.Hour)
+	l.AddSchedule("social", "", "18:00", "19:00")
+	if _, err := l.BlockRequest(packQuery(t, "social.example.")); err != nil {
+		t.Error("Not blocked during second window")
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := l.BlockRequest(packQuery(t, "social.example.")); err == nil {
+		t.Error("Blocked outside schedule")
+	}
+	l.ClearSchedule("social")
+	if _, err := l.BlockRequest(packQuery(t, "social.example.")); err != nil {
+		t.Error("Not blocked after schedule cleared")
+	}
+}
+
+func TestBraveDNSSchedule(t *testing.T) {
+	var _ Scheduler = NewLocalBlocklists()
+	brave := testBraveDNS(3)
+	var _ Scheduler = brave
+	now := time.Date(2021, 3, 1, 8, 0, 0, 0, time.Local)
+	brave.now = func() time.Time { return now }
+	if err := brave.AddSchedule("1", "mon", "09:00", "17:00"); err != nil {
+		t.Fatal(err)
+	}
+	if err := brave.AddSchedule("1", "", "9:00", "9:00"); err == nil {
+		t.Error("Invalid window added")
+	}
+
+	if on := brave.scheduled([]string{"0", "1"}); len(on) != 1 || on[0] != "0" {
+		t.Errorf("Expected only list 0 in effect, got %v", on)
+	}
+	now = now.Add(2 * time.Hour)
+	if on := brave.scheduled([]string{"0", "1"}); len(on) != 2 {
+		t.Errorf("Expected lists 0 and 1 in effect, got %v", on)
+	}
+	now = now.Add(24 * time.Hour)
+	if on := brave.scheduled([]string{"1"}); len(on) != 0 {
+		t.Errorf("List 1 in effect on another day: %v", on)
+	}
+	brave.ClearSchedule("1")
+	if on := brave.scheduled([]string{"1"}); len(on) != 1 {
+		t.Error("List 1 not in effect after schedule cleared")
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	b64 "encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxBlocklistID is the largest blocklist-id a stamp can hold: its header
+// has 16 bits, one per flag of 16 blocklists each.
+const maxBlocklistID = 16*16 - 1
+
+// stampVersion is the version of stamps EncodeStamp returns.
+const stampVersion = "1"
+
+// splitStamp returns the encoded flags and the version of stamp.
+func splitStamp(stamp string) (flags string, ver string) {
+	s := strings.Split(stamp, ":")
+	if len(s) > 1 {
+		return s[1], s[0]
+	}
+	return stamp, "0"
+}
+
+// decodeFlags decodes stamp, of version ver, into 16-bit flags.
+func decodeFlags(stamp string, ver string) (u16 []uint16, err error) {
+	decoder := b64.StdEncoding
+	if ver == "0" {
+		stamp, err = url.QueryUnescape(stamp)
+	} else if ver == "1" {
+		stamp, err = url.PathUnescape(stamp)
+		decoder = b64.URLEncoding
+	} else {
+		err = fmt.Errorf("version %s does not exist", ver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := decoder.DecodeString(stamp)
+	if err != nil {
+		return
+	}
+
+	if ver == "0" {
+		u16 = stringtouint(string(buf))
+	} else if ver == "1" {
+		u16 = bytestouint(buf)
+	} else {
+		err = fmt.Errorf("unimplemented header stamp version %v", ver)
+	}
+	if err == nil && len(u16) == 0 {
+		err = errors.New("empty stamp")
+	}
+	return
+}
+
+// flagsToIDs returns the blocklist-ids set in flags.
+func flagsToIDs(flags []uint16) ([]int, error) {
+	// flags has to be an array of 16-bit integers.
+
+	// first index always contains the header
+	header := uint16(flags[0])
+	// store of each big-endian position of set bits in header
+	tagIndices := []int{}
+	ids := []int{}
+	var mask uint16
+
+	// b1000,0000,0000,0000
+	mask = 0x8000
+
+	// read first 16 header bits from msb to lsb
+	// and capture indices of set bits in tagIndices
+	for i := 0; i < 16; i++ {
+		if (header << i) == 0 {
+			break
+		}
+		if (header & mask) == mask {
+			tagIndices = append(tagIndices, i)
+		}
+		mask = mask >> 1 // shift to read the next msb bit
+	}
+	// the number of set bits in header must correspond to total
+	// blocklist "flags" excluding the header at position 0
+	if len(tagIndices) != (len(flags) - 1) {
+		err := fmt.Errorf("%v %v flags and header mismatch", tagIndices, flags)
+		return nil, err
+	}
+
+	// for all blocklist flags excluding the header
+	// figure out the blocklist-ids
+	for i := 1; i < len(flags); i++ {
+		// 16 blocklists are represented by one flag
+		// that is, one bit per blocklist
+		var flag = uint16(flags[i])
+		// get the index of the current flag in the header
+		var index = tagIndices[i-1]
+		mask = 0x8000
+		// for each of the 16 bits in the flag
+		// capture the set bits and calculate
+		// its actual decimal value, the blocklist-id
+		for j := 0; j < 16; j++ {
+			if (flag << j) == 0 {
+				break
+			}
+			if (flag & mask) == mask {
+				ids = append(ids, (index*16)+j)
+			}
+			mask = mask >> 1
+		}
+	}
+	return ids, nil
+}
+
+// idsToFlags is the inverse of flagsToIDs.
+func idsToFlags(ids []int) ([]uint16, error) {
+	var blocks [16]uint16
+	for _, id := range ids {
+		if id < 0 || id > maxBlocklistID {
+			return nil, fmt.Errorf("blocklist-id %d out of range", id)
+		}
+		blocks[id/16] |= 0x8000 >> uint(id%16)
+	}
+	flags := []uint16{0}
+	for i, b := range blocks {
+		if b != 0 {
+			flags[0] |= 0x8000 >> uint(i)
+			flags = append(flags, b)
+		}
+	}
+	return flags, nil
+}
+
+func parseIDs(csv string) ([]int, error) {
+	var ids []int
+	for _, v := range strings.Split(csv, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no blocklist-ids")
+	}
+	return ids, nil
+}
+
+func joinIDs(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
+
+// EncodeStamp returns the blocklist stamp, as the BraveDNS SetStamp expects,
+// of `ids`, a csv of blocklist-ids.
+func EncodeStamp(ids string) (string, error) {
+	v, err := parseIDs(ids)
+	if err != nil {
+		return "", err
+	}
+	flags, err := idsToFlags(v)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, len(flags)*2)
+	for i, f := range flags {
+		binary.LittleEndian.PutUint16(buf[i*2:], f)
+	}
+	return stampVersion + ":" + b64.URLEncoding.EncodeToString(buf), nil
+}
+
+// DecodeStamp returns the csv of blocklist-ids, in ascending order, in the
+// blocklist `stamp`.
+func DecodeStamp(stamp string) (string, error) {
+	if len(stamp) <= 0 {
+		return "", errors.New("empty blocklist stamp")
+	}
+	flags, err := decodeFlags(splitStamp(stamp))
+	if err != nil {
+		return "", err
+	}
+	ids, err := flagsToIDs(flags)
+	if err != nil {
+		return "", err
+	}
+	sort.Ints(ids)
+	return joinIDs(ids), nil
+}
+
+// StampToBlocklistNames returns the csv of group:names of blocklists in the
+// blocklist `stamp`, as described by `listinfo`, the path to the blocklists
+// config json; as BraveDNS.StampToNames does, without a BraveDNS.
+func StampToBlocklistNames(stamp string, listinfo string) (string, error) {
+	flags, tags, err := load(listinfo)
+	if err != nil {
+		return "", err
+	}
+	brave := &bravedns{flags: flags, tags: tags}
+	return brave.StampToNames(stamp)
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testListinfo = `{
+	"AAA": {"value": 0, "vname": "ads", "group": "privacy", "subg": ""},
+	"BBB": {"value": 1, "vname": "trackers", "group": "privacy", "subg": ""},
+	"CCC": {"value": 2, "vname": "gambling", "group": "parental", "subg": "vice"}
+}`
+
+func TestStamp(t *testing.T) {
+	for _, bad := range []string{"", "a,b", "256", "-1"} {
+		if _, err := EncodeStamp(bad); err == nil {
+			t.Errorf("Invalid ids %q encoded", bad)
+		}
+	}
+	stamp, err := EncodeStamp("17, 0,1,255")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := DecodeStamp(stamp)
+	if err != nil || ids != "0,1,17,255" {
+		t.Errorf("Expected 0,1,17,255, got %q %v", ids, err)
+	}
+	if _, err := DecodeStamp("1:AIA="); err == nil {
+		t.Error("Expected header mismatch")
+	}
+	if _, err := DecodeStamp("9:AAAA"); err == nil {
+		t.Error("Expected unknown version")
+	}
+
+	dir, err := ioutil.TempDir("", "stamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "listinfo.json")
+	ioutil.WriteFile(path, []byte(testListinfo), 0600)
+	stamp, _ = EncodeStamp("0,2")
+	if names, err := StampToBlocklistNames(stamp, path); err != nil || names != "privacy:ads,vice:gambling" {
+		t.Errorf("Unexpected names %q %v", names, err)
+	}
+	stamp, _ = EncodeStamp("3")
+	if _, err := StampToBlocklistNames(stamp, path); err == nil {
+		t.Error("Expected out of range blocklist-id")
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SvcParamKeys of SVCB and HTTPS records harvested.
+const (
+	svcbIPv4Hint = 4
+	svcbIPv6Hint = 6
+)
+
+// maxHints caps the number of names whose hints are kept.
+const maxHints = 1024
+
+// svcb is the subset of an SVCB (or HTTPS) record's data that is harvested.
+type svcb struct {
+	priority uint16
+	target   string
+	ips      []net.IP
+}
+
+// parseSVCB parses rdata, the wire format of an SVCB record's data.
+func parseSVCB(rdata []byte) (*svcb, error) {
+	if len(rdata) < 3 {
+		return nil, errors.New("svcb: short rdata")
+	}
+	s := &svcb{priority: binary.BigEndian.Uint16(rdata)}
+	target, off, err := dns.UnpackDomainName(rdata, 2)
+	if err != nil {
+		return nil, err
+	}
+	s.target = target
+	for off < len(rdata) {
+		if off+4 > len(rdata) {
+			return nil, errors.New("svcb: short param")
+		}
+		key := binary.BigEndian.Uint16(rdata[off:])
+		n := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		off += 4
+		if off+n > len(rdata) {
+			return nil, errors.New("svcb: short param value")
+		}
+		v := rdata[off : off+n]
+		off += n
+		switch key {
+		case svcbIPv4Hint, svcbIPv6Hint:
+			size := net.IPv4len
+			if key == svcbIPv6Hint {
+				size = net.IPv6len
+			}
+			if n%size != 0 {
+				return nil, errors.New("svcb: bad ip hint")
+			}
+			for i := 0; i < n; i += size {
+				s.ips = append(s.ips, append(net.IP(nil), v[i:i+size]...))
+			}
+		}
+	}
+	return s, nil
+}
+
+type hint struct {
+	ips    []net.IP
+	expiry time.Time
+}
+
+// hintStore keeps ip hints of names, harvested from answers, for as long as
+// their TTLs.
+type hintStore struct {
+	sync.RWMutex
+	m map[string]*hint
+}
+
+var hints = &hintStore{m: make(map[string]*hint)}
+
+func (s *hintStore) put(name string, h *hint) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.m[name]; !ok && len(s.m) >= maxHints {
+		now := time.Now()
+		for k, v := range s.m {
+			if now.After(v.expiry) {
+				delete(s.m, k)
+			}
+		}
+		if len(s.m) >= maxHints {
+			s.m = make(map[string]*hint)
+		}
+	}
+	s.m[name] = h
+}
+
+func (s *hintStore) get(name string) *hint {
+	s.RLock()
+	h := s.m[dns.CanonicalName(name)]
+	s.RUnlock()
+	if h == nil || time.Now().After(h.expiry) {
+		return nil
+	}
+	return h
+}
+
+// harvest keeps hints from SVCB and HTTPS records in the answer r.
+func harvest(r []byte) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(r); err != nil {
+		return
+	}
+	for _, rr := range msg.Answer {
+		h := rr.Header()
+		if h.Rrtype != TypeSVCB && h.Rrtype != TypeHTTPS {
+			continue
+		}
+		// miekg/dns v1.1.31 predates SVCB, and so keeps its data as is.
+		raw, ok := rr.(*dns.RFC3597)
+		if !ok {
+			continue
+		}
+		b, err := hex.DecodeString(raw.Rdata)
+		if err != nil {
+			continue
+		}
+		s, err := parseSVCB(b)
+		// priority 0 is an alias, without params
+		if err != nil || s.priority == 0 || len(s.ips) == 0 {
+			continue
+		}
+		ttl := time.Duration(h.Ttl) * time.Second
+		if ttl > maxCacheTTL {
+			ttl = maxCacheTTL
+		}
+		hints.put(dns.CanonicalName(h.Name), &hint{ips: s.ips, expiry: time.Now().Add(ttl)})
+	}
+}
+
+// HintedIPs returns the comma-separated ip hints that HTTPS or SVCB answers
+// for `hostname` carried, or "" if there are none.
+func HintedIPs(hostname string) string {
+	h := hints.get(hostname)
+	if h == nil {
+		return ""
+	}
+	ips := make([]string, len(h.ips))
+	for i, ip := range h.ips {
+		ips[i] = ip.String()
+	}
+	return strings.Join(ips, ",")
+}
+
+// HintHarvester keeps ip hints from HTTPS and SVCB answers of the Transport
+// it wraps, for HintedIPs.
+type HintHarvester struct {
+	Transport
+}
+
+// NewHintHarvester returns a Transport that harvests hints from answers of `t`.
+func NewHintHarvester(t Transport) Transport {
+	return &HintHarvester{Transport: t}
+}
+
+// Inner implements Wrapper.
+func (h *HintHarvester) Inner() Transport {
+	return h.Transport
+}
+
+// Query implements Transport.
+func (h *HintHarvester) Query(q []byte) ([]byte, error) {
+	res, err := h.Transport.Query(q)
+	if err == nil {
+		harvest(res)
+	}
+	return res, err
+}
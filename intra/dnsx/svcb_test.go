@@ -0,0 +1,71 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// funcTransport answers queries with f.
+type funcTransport struct {
+	f func(*dns.Msg) *dns.Msg
+}
+
+func (t *funcTransport) Query(q []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return nil, err
+	}
+	return t.f(msg).Pack()
+}
+
+func (t *funcTransport) GetURL() string {
+	return "func"
+}
+
+func (t *funcTransport) SetBraveDNS(BraveDNS) {}
+
+func TestHintHarvester(t *testing.T) {
+	rdata := []byte{
+		0x00, 0x01, // priority
+		0x00,                   // target "."
+		0x00, 0x01, 0x00, 0x03, // alpn
+		0x02, 'h', '2',
+		0x00, 0x04, 0x00, 0x08, // ipv4hint
+		192, 0, 2, 1, 192, 0, 2, 2,
+		0x00, 0x05, 0x00, 0x04, // ech, which isn't harvested
+		0xfe, 0x0d, 0x00, 0x01,
+	}
+	rdata = append(rdata, 0x00, 0x06, 0x00, 0x10) // ipv6hint
+	rdata = append(rdata, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1)
+
+	up := &funcTransport{func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, &dns.RFC3597{
+			Hdr:   dns.RR_Header{Name: q.Question[0].Name, Rrtype: TypeHTTPS, Class: dns.ClassINET, Ttl: 300},
+			Rdata: hex.EncodeToString(rdata),
+		})
+		return r
+	}}
+	tr := NewHintHarvester(up)
+	queryType(t, tr, "Hinted.example.", TypeHTTPS)
+
+	if ips := HintedIPs("hinted.example"); ips != "192.0.2.1,192.0.2.2,2001:db8::1" {
+		t.Errorf("Wrong hints %q", ips)
+	}
+	if HintedIPs("other.example") != "" {
+		t.Error("Hints for unknown name")
+	}
+
+	if _, err := parseSVCB(rdata[:12]); err == nil {
+		t.Error("Expected error for truncated rdata")
+	}
+}
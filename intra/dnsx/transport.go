@@ -0,0 +1,53 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+// Transport is a DNS query transport.  Its method set is that of
+// doh.Transport, and so the two are interchangeable; wrappers in this
+// package decorate any Transport with additional behaviour.
+type Transport interface {
+	// Given a DNS query (including ID), returns a DNS response with matching
+	// ID, or an error if no response was received.
+	Query(q []byte) ([]byte, error)
+	// Return the server URL used to initialize this transport.
+	GetURL() string
+	// SetBraveDNS sets bravedns variable
+	SetBraveDNS(BraveDNS)
+}
+
+// Wrapper is a Transport that decorates another.
+type Wrapper interface {
+	Transport
+	// Inner returns the decorated Transport.
+	Inner() Transport
+}
+
+// Unwrap returns the innermost Transport that t decorates, or t itself.
+func Unwrap(t Transport) Transport {
+	for {
+		w, ok := t.(Wrapper)
+		if !ok {
+			return t
+		}
+		t = w.Inner()
+	}
+}
+
+// walk calls f on t and on each Transport that t decorates in turn, until f
+// returns true.  Reports whether f returned true.
+func walk(t Transport, f func(Transport) bool) bool {
+	for {
+		if f(t) {
+			return true
+		}
+		w, ok := t.(Wrapper)
+		if !ok {
+			return false
+		}
+		t = w.Inner()
+	}
+}
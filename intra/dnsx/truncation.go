@@ -0,0 +1,82 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// TruncationRetrier retries queries whose answers come back truncated (TC=1)
+// from a datagram transport, like DNS53 over UDP, on a fallback transport
+// that isn't size-limited, like DNS53 over TCP, DoT, or DoH (RFC 7766).
+// The truncated answer is returned only if the fallback fails.
+type TruncationRetrier struct {
+	// 64-bit counters first, for atomic ops on 32-bit platforms.
+	retries  int64
+	failures int64
+	Transport
+	fallback Transport
+}
+
+// NewTruncationRetrier returns a Transport that queries `t`, and `fallback`
+// on truncated answers from t.
+func NewTruncationRetrier(t Transport, fallback Transport) Transport {
+	return &TruncationRetrier{Transport: t, fallback: fallback}
+}
+
+// Inner implements Wrapper.
+func (r *TruncationRetrier) Inner() Transport {
+	return r.Transport
+}
+
+// Query implements Transport.
+func (r *TruncationRetrier) Query(q []byte) ([]byte, error) {
+	res, _, err := r.query(q)
+	return res, err
+}
+
+// query is Query, and reports whether the answer is of the fallback.
+func (r *TruncationRetrier) query(q []byte) ([]byte, bool, error) {
+	res, err := r.Transport.Query(q)
+	if err != nil || len(res) < xdns.MinDNSPacketSize || !xdns.HasTCFlag(res) {
+		return res, false, err
+	}
+
+	atomic.AddInt64(&r.retries, 1)
+	full, ferr := r.fallback.Query(q)
+	if ferr != nil || len(full) < xdns.MinDNSPacketSize {
+		atomic.AddInt64(&r.failures, 1)
+		log.Warnf("truncated answer retry on %s failed: %v", r.fallback.GetURL(), ferr)
+		return res, false, nil
+	}
+	return full, true, nil
+}
+
+// QueryRetrying queries t, and reports whether the answer is of a retry on
+// a fallback, as when t is a TruncationRetrier whose transport truncated it.
+func QueryRetrying(t Transport, q []byte) ([]byte, bool, error) {
+	if r, ok := t.(*TruncationRetrier); ok {
+		return r.query(q)
+	}
+	res, err := t.Query(q)
+	return res, false, err
+}
+
+// SetBraveDNS sets b on both transports.
+func (r *TruncationRetrier) SetBraveDNS(b BraveDNS) {
+	r.Transport.SetBraveDNS(b)
+	r.fallback.SetBraveDNS(b)
+}
+
+// Retries returns the number of truncated answers retried, and the number
+// of those retries that failed.
+func (r *TruncationRetrier) Retries() (retries int64, failures int64) {
+	return atomic.LoadInt64(&r.retries), atomic.LoadInt64(&r.failures)
+}
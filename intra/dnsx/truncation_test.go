@@ -0,0 +1,73 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func mkQuery(t *testing.T, name string, id uint16) []byte {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	q.Id = id
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+type truncatingTransport struct {
+	fakeTransport
+}
+
+func (f *truncatingTransport) Query(q []byte) ([]byte, error) {
+	r, err := f.fakeTransport.Query(q)
+	if err == nil {
+		r[2] |= 2 // TC
+	}
+	return r, err
+}
+
+type failingTransport struct {
+	fakeTransport
+}
+
+func (f *failingTransport) Query(q []byte) ([]byte, error) {
+	f.queries++
+	return nil, errors.New("fake failure")
+}
+
+func TestTruncationRetry(t *testing.T) {
+	udp := &truncatingTransport{fakeTransport{ttl: 60}}
+	tcp := &fakeTransport{ttl: 60}
+	r := NewTruncationRetrier(udp, tcp).(*TruncationRetrier)
+	if res := query(t, r, "example.com.", 1); res.Truncated {
+		t.Error("Expected the full answer")
+	}
+	if tcp.queries != 1 {
+		t.Errorf("Expected a retry, got %d", tcp.queries)
+	}
+	if _, retried, err := QueryRetrying(r, mkQuery(t, "example.com.", 3)); err != nil || !retried {
+		t.Errorf("Expected the retry reported, got %t %v", retried, err)
+	}
+	if _, retried, _ := QueryRetrying(tcp, mkQuery(t, "example.com.", 4)); retried {
+		t.Error("Transports other than retriers never retry")
+	}
+
+	bad := &failingTransport{}
+	r = NewTruncationRetrier(udp, bad).(*TruncationRetrier)
+	if res := query(t, r, "example.com.", 2); !res.Truncated {
+		t.Error("Expected the truncated answer as a last resort")
+	}
+	if retries, failures := r.Retries(); retries != 1 || failures != 1 {
+		t.Errorf("Wrong retries %d/%d", retries, failures)
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"bufio"
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/celzero/firestack/intra/xdns"
+)
+
+// UserBlocklist is the name of the blocklist that user rules block as.
+const UserBlocklist = "user"
+
+// RulesListener is notified of changes to user rules, so that the host app
+// may persist them, and restore them with UserRules.Load.
+type RulesListener interface {
+	// OnRulesChanged is called with all rules, one per line, after a rule is
+	// added or removed.  It must not block.
+	OnRulesChanged(rules string)
+}
+
+type userRule struct {
+	pattern string
+	// re is set for regex rules.
+	re *regexp.Regexp
+	// domain is set for Adblock Plus rules, which match it and all names
+	// under it; otherwise pattern is a name or a glob.
+	domain string
+	// allow is set for exceptions.
+	allow bool
+	// response is the xdns block response type of names the rule blocks.
+	response int
+}
+
+// responseOption ends rules that set their own type of answer to blocked
+// queries, as in ||example.com^$response=nxdomain; see xdns.BlockResponseName.
+const responseOption = "$response="
+
+// String returns r as a rule line, which newUserRule parses back to r.
+func (r *userRule) String() string {
+	if r.response == xdns.BlockDefault {
+		return r.pattern
+	}
+	return r.pattern + responseOption + xdns.BlockResponseName(r.response)
+}
+
+// newUserRule parses pattern: a name (ads.example.com), a glob with *
+// (*.doubleclick.net, ads*.example.com), or a regex between slashes
+// (/^ad[0-9]+\./), all matched against names without the trailing dot; or
+// an Adblock Plus rule (||example.com^) or exception (@@||example.com^) for
+// a domain and all names under it.  Rules may end with responseOption.
+func newUserRule(pattern string) (*userRule, error) {
+	pattern = strings.TrimSpace(pattern)
+	response := xdns.BlockDefault
+	if i := strings.LastIndex(pattern, responseOption); i > 0 {
+		var err error
+		if response, err = xdns.BlockResponseType(pattern[i+len(responseOption):]); err != nil {
+			return nil, err
+		}
+		pattern = pattern[:i]
+	}
+	r, err := parseUserRule(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if r.allow && response != xdns.BlockDefault {
+		return nil, errors.New("exceptions don't block " + pattern)
+	}
+	r.response = response
+	return r, nil
+}
+
+func parseUserRule(pattern string) (*userRule, error) {
+	if strings.HasPrefix(pattern, "||") || strings.HasPrefix(pattern, "@@") {
+		abp, ok := parseABP(pattern)
+		if !ok {
+			return nil, errors.New("invalid rule " + pattern)
+		}
+		return newDomainRule(abp.name, abp.allow), nil
+	}
+	if len(pattern) > 2 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+		re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &userRule{pattern: pattern, re: re}, nil
+	}
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if len(pattern) == 0 {
+		return nil, errors.New("empty rule")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		if _, ok := dns.IsDomainName(pattern); !ok {
+			return nil, errors.New("invalid rule " + pattern)
+		}
+	}
+	return &userRule{pattern: pattern}, nil
+}
+
+// newDomainRule returns a rule for domain, in lower case without the
+// trailing dot, and all names under it.
+func newDomainRule(domain string, allow bool) *userRule {
+	pattern := "||" + domain + "^"
+	if allow {
+		pattern = "@@" + pattern
+	}
+	return &userRule{pattern: pattern, domain: domain, allow: allow}
+}
+
+// matches reports whether name, in lower case without the trailing dot,
+// matches r.
+func (r *userRule) matches(name string) bool {
+	if r.re != nil {
+		return r.re.MatchString(name)
+	}
+	if len(r.domain) > 0 {
+		return name == r.domain || strings.HasSuffix(name, "."+r.domain)
+	}
+	ok, _ := path.Match(r.pattern, name)
+	return ok
+}
+
+// UserRules is a BraveDNS that blocks names matching rules users add at
+// runtime, and otherwise defers to the BraveDNS it wraps, if any, for its
+// compiled blocklists.  Names blocked by user rules are blocked as being in
+// UserBlocklist, regardless of stamps.  Exceptions (see AddAllow) take
+// precedence over all rules and blocklists.
+type UserRules struct {
+	BraveDNS
+	sync.RWMutex
+	rules    []*userRule
+	listener RulesListener
+}
+
+// NewUserRules returns UserRules evaluated alongside `b`, which may be nil.
+func NewUserRules(b BraveDNS) *UserRules {
+	return &UserRules{BraveDNS: b}
+}
+
+// SetListener sets the listener notified of changes to rules, or unsets it
+// if nil.
+func (u *UserRules) SetListener(l RulesListener) {
+	u.Lock()
+	u.listener = l
+	u.Unlock()
+}
+
+// Add adds the rule `pattern`; see newUserRule for its syntax.  Adding an
+// existing rule replaces it.
+func (u *UserRules) Add(pattern string) error {
+	r, err := newUserRule(pattern)
+	if err != nil {
+		return err
+	}
+	u.add(r)
+	return nil
+}
+
+// AddAllow never blocks `domain` and names under it, whatever the rules and
+// blocklists in effect say, so that users can unbreak sites.
+func (u *UserRules) AddAllow(domain string) error {
+	return u.Add("@@||" + domain + "^")
+}
+
+// AddDeny blocks `domain` and names under it, unless allowed.
+func (u *UserRules) AddDeny(domain string) error {
+	return u.Add("||" + domain + "^")
+}
+
+// AddDenyWithResponse is AddDeny, with blocked queries answered with the xdns
+// block response type `response`, in place of the default.
+func (u *UserRules) AddDenyWithResponse(domain string, response int) error {
+	r, err := newUserRule("||" + domain + "^")
+	if err != nil {
+		return err
+	}
+	if response < xdns.BlockDefault || response > xdns.BlockRefused {
+		return errors.New("unknown block response type")
+	}
+	r.response = response
+	u.add(r)
+	return nil
+}
+
+// RemoveAllow removes the exception for `domain` added by AddAllow.
+func (u *UserRules) RemoveAllow(domain string) {
+	u.Remove("@@||" + domain + "^")
+}
+
+// RemoveDeny removes the rule for `domain` added by AddDeny.
+func (u *UserRules) RemoveDeny(domain string) {
+	u.Remove("||" + domain + "^")
+}
+
+func (u *UserRules) add(r *userRule) {
+	u.Lock()
+	for i, v := range u.rules {
+		if v.pattern == r.pattern {
+			same := v.response == r.response
+			u.rules[i] = r
+			u.Unlock()
+			if !same {
+				u.changed()
+			}
+			return
+		}
+	}
+	u.rules = append(u.rules, r)
+	u.Unlock()
+	u.changed()
+}
+
+// Remove removes the rule `pattern`, if present.
+func (u *UserRules) Remove(pattern string) {
+	r, err := newUserRule(pattern)
+	if err != nil {
+		return
+	}
+	u.Lock()
+	removed := false
+	for i, v := range u.rules {
+		if v.pattern == r.pattern {
+			u.rules = append(u.rules[:i], u.rules[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	u.Unlock()
+	if removed {
+		u.changed()
+	}
+}
+
+// Load replaces all rules with `rules`, one per line, as persisted by the
+// host app from OnRulesChanged.  Blank lines and lines starting with # are
+// skipped.  The listener is not notified.  Returns the number of rules loaded.
+func (u *UserRules) Load(rules string) (int, error) {
+	var loaded []*userRule
+	s := bufio.NewScanner(strings.NewReader(rules))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		r, err := newUserRule(line)
+		if err != nil {
+			return 0, err
+		}
+		loaded = append(loaded, r)
+	}
+	u.Lock()
+	u.rules = loaded
+	u.Unlock()
+	return len(loaded), nil
+}
+
+// Rules returns all rules, one per line, in the order they were added.
+func (u *UserRules) Rules() string {
+	u.RLock()
+	defer u.RUnlock()
+	patterns := make([]string, len(u.rules))
+	for i, r := range u.rules {
+		patterns[i] = r.String()
+	}
+	return strings.Join(patterns, "\n")
+}
+
+func (u *UserRules) changed() {
+	u.RLock()
+	l := u.listener
+	u.RUnlock()
+	if l != nil {
+		l.OnRulesChanged(u.Rules())
+	}
+}
+
+// verdict returns whether any rule blocks name, and whether any exception
+// allows it.
+func (u *UserRules) verdict(name string) (block bool, allow bool) {
+	return u.match(name) != nil, u.allows(name)
+}
+
+func (u *UserRules) allows(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	u.RLock()
+	defer u.RUnlock()
+	for _, r := range u.rules {
+		if r.allow && r.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the first rule that blocks name, if not allowed.
+func (u *UserRules) match(name string) *userRule {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	u.RLock()
+	defer u.RUnlock()
+	var block *userRule
+	for _, r := range u.rules {
+		if !r.matches(name) {
+			continue
+		}
+		if r.allow {
+			return nil
+		}
+		if block == nil {
+			block = r
+		}
+	}
+	return block
+}
+
+// BlockResponseType implements BlockResponder, with the type of answer set
+// by the first rule that blocks the name queried, or any of the names it is
+// aliased to, in msg.
+func (u *UserRules) BlockResponseType(msg []byte) int {
+	m := new(dns.Msg)
+	if err := m.Unpack(msg); err != nil || len(m.Question) != 1 {
+		return xdns.BlockDefault
+	}
+	names := append([]string{m.Question[0].Name}, aliases(m)...)
+	for _, name := range names {
+		if r := u.match(name); r != nil {
+			return r.response
+		}
+	}
+	return xdns.BlockDefault
+}
+
+// OnDeviceBlock implements BraveDNS; user rules always block on-device.
+func (u *UserRules) OnDeviceBlock() bool {
+	return true
+}
+
+// SetStamp implements BraveDNS.
+func (u *UserRules) SetStamp(stamp string) error {
+	if u.BraveDNS == nil {
+		return errors.New("no blocklists")
+	}
+	return u.BraveDNS.SetStamp(stamp)
+}
+
+// GetStamp implements BraveDNS.
+func (u *UserRules) GetStamp() (string, error) {
+	if u.BraveDNS == nil {
+		return "", errors.New("no blocklists")
+	}
+	return u.BraveDNS.GetStamp()
+}
+
+// LockStamp implements BraveDNS.
+func (u *UserRules) LockStamp(stamp string) error {
+	if u.BraveDNS == nil {
+		return errors.New("no blocklists")
+	}
+	return u.BraveDNS.LockStamp(stamp)
+}
+
+// GetBlocklistStampHeaderKey implements BraveDNS.
+func (u *UserRules) GetBlocklistStampHeaderKey() string {
+	if u.BraveDNS == nil {
+		return ""
+	}
+	return u.BraveDNS.GetBlocklistStampHeaderKey()
+}
+
+// StampToNames implements BraveDNS.
+func (u *UserRules) StampToNames(stamp string) (string, error) {
+	if u.BraveDNS == nil {
+		return "", errors.New("no blocklists")
+	}
+	return u.BraveDNS.StampToNames(stamp)
+}
+
+// BlockRequest implements BraveDNS.
+func (u *UserRules) BlockRequest(q []byte) (string, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return "", err
+	}
+	if len(msg.Question) != 1 {
+		return "", errors.New("one question too many")
+	}
+	block, allow := u.verdict(msg.Question[0].Name)
+	if allow {
+		return "", errors.New("name allowed by user rules")
+	}
+	if block {
+		return UserBlocklist, nil
+	}
+	if u.BraveDNS == nil || !u.BraveDNS.OnDeviceBlock() {
+		return "", errors.New("name not in user rules")
+	}
+	return u.BraveDNS.BlockRequest(q)
+}
+
+// BlockResponse implements BraveDNS, and blocks answers aliased to names
+// that match user rules.  Answers to allowed names, and aliased to allowed
+// names, are never blocked.
+func (u *UserRules) BlockResponse(r []byte) (string, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(r); err != nil {
+		return "", err
+	}
+	if len(msg.Question) == 1 {
+		if _, allow := u.verdict(msg.Question[0].Name); allow {
+			return "", errors.New("name allowed by user rules")
+		}
+	}
+	for _, name := range aliases(msg) {
+		block, allow := u.verdict(name)
+		if allow {
+			return "", errors.New("alias allowed by user rules")
+		}
+		if block {
+			return UserBlocklist, nil
+		}
+	}
+	if u.BraveDNS == nil || !u.BraveDNS.OnDeviceBlock() {
+		return "", errors.New("aliases not in user rules")
+	}
+	return u.BraveDNS.BlockResponse(r)
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dnsx
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/celzero/firestack/intra/xdns"
+)
+
+type rulesRecorder struct {
+	rules []string
+}
+
+func (r *rulesRecorder) OnRulesChanged(rules string) {
+	r.rules = append(r.rules, rules)
+}
+
+func TestUserRules(t *testing.T) {
+	local := NewLocalBlocklists()
+	local.Load("ads", "0.0.0.0 ads.example.com\n")
+	u := NewUserRules(local)
+	var b BraveDNS = u
+	rec := &rulesRecorder{}
+	u.SetListener(rec)
+
+	for _, bad := range []string{"", "/[/", "a[b"} {
+		if err := u.Add(bad); err == nil {
+			t.Errorf("Invalid rule %q added", bad)
+		}
+	}
+	u.Add("*.doubleclick.net")
+	u.Add(`/^ad[0-9]+\./`)
+	u.Add("*.doubleclick.net")
+	if len(rec.rules) != 2 || rec.rules[1] != "*.doubleclick.net\n/^ad[0-9]+\\./" {
+		t.Errorf("Unexpected notifications %q", rec.rules)
+	}
+
+	for name, lists := range map[string]string{
+		"x.DoubleClick.net.": UserBlocklist,
+		"ad42.example.org.":  UserBlocklist,
+		"ads.example.com.":   "ads",
+	} {
+		if got, err := b.BlockRequest(packQuery(t, name)); err != nil || got != lists {
+			t.Errorf("%s: expected %q, got %q %v", name, lists, got, err)
+		}
+	}
+	for _, name := range []string{"doubleclick.net.", "ad.example.org.", "example.com."} {
+		if _, err := b.BlockRequest(packQuery(t, name)); err == nil {
+			t.Errorf("%s blocked", name)
+		}
+	}
+
+	u.Remove("*.doubleclick.net")
+	if _, err := b.BlockRequest(packQuery(t, "x.doubleclick.net.")); err == nil {
+		t.Error("Removed rule blocked")
+	}
+
+	// Restore persisted rules.
+	if n, err := u.Load(rec.rules[1] + "\n# comment\n"); err != nil || n != 2 {
+		t.Errorf("Loaded %d, %v", n, err)
+	}
+	if len(rec.rules) != 3 {
+		t.Error("Load should not notify")
+	}
+	if _, err := b.BlockRequest(packQuery(t, "x.doubleclick.net.")); err != nil {
+		t.Error("Loaded rule not applied")
+	}
+
+	if _, err := NewUserRules(nil).BlockRequest(packQuery(t, "example.com.")); err == nil {
+		t.Error("Empty rules blocked")
+	}
+}
+
+func TestUserRulesOverrides(t *testing.T) {
+	local := NewLocalBlocklists()
+	local.Load("ads", "||example.com^\n")
+	u := NewUserRules(local)
+	var b BraveDNS = u
+
+	u.Add("*.cdn.example.net")
+	if err := u.AddAllow("ok.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	u.AddAllow("static.cdn.example.net")
+	u.AddDeny("tracker.example.org")
+	if err := u.AddDeny("bad domain"); err == nil {
+		t.Error("Invalid domain denied")
+	}
+
+	for _, name := range []string{"ok.example.com.", "a.ok.example.com.", "static.cdn.example.net."} {
+		if _, err := b.BlockRequest(packQuery(t, name)); err == nil {
+			t.Errorf("Allowed name %s blocked", name)
+		}
+	}
+	for name, lists := range map[string]string{
+		"www.example.com.":       "ads",
+		"img.cdn.example.net.":   UserBlocklist,
+		"x.tracker.example.org.": UserBlocklist,
+	} {
+		if got, err := b.BlockRequest(packQuery(t, name)); err != nil || got != lists {
+			t.Errorf("%s: expected %q, got %q %v", name, lists, got, err)
+		}
+	}
+
+	// Allow wins over deny.
+	u.AddDeny("ok.example.com")
+	if _, err := b.BlockRequest(packQuery(t, "ok.example.com.")); err == nil {
+		t.Error("Deny overrode allow")
+	}
+	u.RemoveAllow("ok.example.com")
+	if got, _ := b.BlockRequest(packQuery(t, "ok.example.com.")); got != UserBlocklist {
+		t.Errorf("Expected deny after allow removed, got %q", got)
+	}
+	u.RemoveDeny("ok.example.com")
+	if got, _ := b.BlockRequest(packQuery(t, "ok.example.com.")); got != "ads" {
+		t.Errorf("Expected blocklist, got %q", got)
+	}
+
+	// Overrides persist as rules.
+	v := NewUserRules(nil)
+	if n, err := v.Load(u.Rules()); err != nil || n != 3 {
+		t.Errorf("Loaded %d, %v: %q", n, err, u.Rules())
+	}
+}
+
+func TestUserRulesResponse(t *testing.T) {
+	u := NewUserRules(nil)
+	if err := u.Add("||nx.example^$response=nxdomain"); err != nil {
+		t.Fatal(err)
+	}
+	u.AddDenyWithResponse("refused.example", xdns.BlockRefused)
+	u.AddDeny("plain.example")
+	for _, bad := range []string{"||a.example^$response=bogus", "@@||a.example^$response=empty"} {
+		if err := u.Add(bad); err == nil {
+			t.Errorf("Invalid rule %q added", bad)
+		}
+	}
+	if rules := u.Rules(); rules != "||nx.example^$response=nxdomain\n||refused.example^$response=refused\n||plain.example^" {
+		t.Errorf("Unexpected rules %q", rules)
+	}
+
+	defer xdns.SetBlockResponse(xdns.BlockUnspecified)
+	xdns.SetBlockResponse(xdns.BlockEmpty)
+	for name, rcode := range map[string]int{
+		"a.nx.example.":    dns.RcodeNameError,
+		"refused.example.": dns.RcodeRefused,
+		"plain.example.":   dns.RcodeSuccess,
+	} {
+		q := packQuery(t, name)
+		ans, err := xdns.BlockResponseOfType(q, BlockResponseType(u, q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ans.Rcode != rcode || len(ans.Answer) != 0 {
+			t.Errorf("%s: unexpected answer %v", name, ans)
+		}
+	}
+
+	// Re-adding a rule replaces its response type.
+	u.AddDeny("nx.example")
+	if kind := BlockResponseType(u, packQuery(t, "nx.example.")); kind != xdns.BlockDefault {
+		t.Errorf("Expected default response, got %d", kind)
+	}
+	u.Remove("||refused.example^")
+	if kind := BlockResponseType(u, packQuery(t, "refused.example.")); kind != xdns.BlockDefault {
+		t.Errorf("Removed rule still applies %d", kind)
+	}
+	if kind := BlockResponseType(NewLocalBlocklists(), packQuery(t, "x.")); kind != xdns.BlockDefault {
+		t.Errorf("Expected default response, got %d", kind)
+	}
+}
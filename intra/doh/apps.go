@@ -0,0 +1,55 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import "sync"
+
+// Apps maps apps (uids) to the transports their queries are sent to, in
+// place of the default transport.  The zero value is an empty map.
+type Apps struct {
+	sync.RWMutex
+	m map[int]Transport
+}
+
+// Set sends queries from uid to t; a nil t reverts uid to the default.
+func (a *Apps) Set(uid int, t Transport) {
+	a.Lock()
+	defer a.Unlock()
+	if t == nil {
+		delete(a.m, uid)
+		return
+	}
+	if a.m == nil {
+		a.m = make(map[int]Transport)
+	}
+	a.m[uid] = t
+}
+
+// Get returns the transport for uid, or nil if uid uses the default.
+func (a *Apps) Get(uid int) Transport {
+	a.RLock()
+	defer a.RUnlock()
+	return a.m[uid]
+}
+
+// All returns the transports of all apps, one per app.
+func (a *Apps) All() []Transport {
+	a.RLock()
+	defer a.RUnlock()
+	all := make([]Transport, 0, len(a.m))
+	for _, t := range a.m {
+		all = append(all, t)
+	}
+	return all
+}
+
+// Len returns the number of apps with transports of their own.
+func (a *Apps) Len() int {
+	a.RLock()
+	defer a.RUnlock()
+	return len(a.m)
+}
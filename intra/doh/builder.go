@@ -0,0 +1,289 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/doh/ipmap"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// defaultHandshakeTimeout caps TLS handshakes with DoH servers.
+	defaultHandshakeTimeout = 10 * time.Second
+	// defaultResponseTimeout caps the wait for responses; the same value as
+	// Android DNS-over-TLS.
+	defaultResponseTimeout = 20 * time.Second
+)
+
+// TransportBuilder sets up DoH transports, one setting at a time, for
+// the settings NewTransport doesn't take.  Its setters return the builder
+// itself, so that calls can be chained, and errors are reported by Build.
+type TransportBuilder struct {
+	url              string
+	ips              []string
+	dialer           *net.Dialer
+	auth             ClientAuth
+	listener         Listener
+	decider          Decider
+	listenerQueue    int
+	connectTimeout   time.Duration
+	handshakeTimeout time.Duration
+	responseTimeout  time.Duration
+	readIdleTimeout  time.Duration
+	pingTimeout      time.Duration
+	nopad            bool
+	proxyAddr        string
+	proxyAuth        *proxy.Auth
+	pins             pins
+	pinErr           error
+}
+
+// pins are SHA256 digests of TBS certificates.
+type pins map[[sha256.Size]byte]bool
+
+// NewTransportBuilder returns a builder of transports that pad queries,
+// and connect directly, with the default timeouts.
+func NewTransportBuilder() *TransportBuilder {
+	return &TransportBuilder{
+		handshakeTimeout: defaultHandshakeTimeout,
+		responseTimeout:  defaultResponseTimeout,
+		readIdleTimeout:  defaultReadIdleTimeout,
+		pingTimeout:      defaultPingTimeout,
+		listenerQueue:    dnsx.DefaultListenerQueue,
+	}
+}
+
+// SetURL sets the url of the DoH server, which must be https.
+func (b *TransportBuilder) SetURL(rawurl string) *TransportBuilder {
+	b.url = rawurl
+	return b
+}
+
+// SetIPs sets `ips`, a csv of domains or ips of the DoH server, to use if
+// its hostname doesn't resolve, or resolves to ips that don't work.
+func (b *TransportBuilder) SetIPs(ips string) *TransportBuilder {
+	b.ips = nil
+	if len(ips) > 0 {
+		b.ips = strings.Split(ips, ",")
+	}
+	return b
+}
+
+// SetDialer sets the dialer the transport dials with; nil is a zero dialer.
+func (b *TransportBuilder) SetDialer(d *net.Dialer) *TransportBuilder {
+	b.dialer = d
+	return b
+}
+
+// SetAuth sets `auth` to provide client certificates, if the server asks.
+func (b *TransportBuilder) SetAuth(auth ClientAuth) *TransportBuilder {
+	b.auth = auth
+	return b
+}
+
+// SetListener sets `l` to receive the status of each query once complete.
+func (b *TransportBuilder) SetListener(l Listener) *TransportBuilder {
+	b.listener = l
+	return b
+}
+
+// SetListenerQueue sets up to `size` calls to the listener to be queued,
+// and made apart from queries, dropping the oldest once full; size <= 0 calls
+// the listener as queries complete (default: 64).
+func (b *TransportBuilder) SetListenerQueue(size int) *TransportBuilder {
+	b.listenerQueue = size
+	return b
+}
+
+// SetDecider sets `d` to decide on queries before they're sent.
+func (b *TransportBuilder) SetDecider(d Decider) *TransportBuilder {
+	b.decider = d
+	return b
+}
+
+// SetTimeouts caps connects, TLS handshakes, and the wait for responses, in
+// millis; a value <= 0 leaves the timeout as it is: for connects, that of
+// the dialer, and for the others, 10s and 20s.
+func (b *TransportBuilder) SetTimeouts(connectMs int, handshakeMs int, responseMs int) *TransportBuilder {
+	if connectMs > 0 {
+		b.connectTimeout = time.Duration(connectMs) * time.Millisecond
+	}
+	if handshakeMs > 0 {
+		b.handshakeTimeout = time.Duration(handshakeMs) * time.Millisecond
+	}
+	if responseMs > 0 {
+		b.responseTimeout = time.Duration(responseMs) * time.Millisecond
+	}
+	return b
+}
+
+// SetHealthCheck sets HTTP/2 connections that go `readIdleMs` without a
+// frame from the server to be pinged, and closed if the ping goes unanswered
+// for `pingMs`; a value <= 0 leaves it as it is, 1s for both.
+func (b *TransportBuilder) SetHealthCheck(readIdleMs int, pingMs int) *TransportBuilder {
+	if readIdleMs > 0 {
+		b.readIdleTimeout = time.Duration(readIdleMs) * time.Millisecond
+	}
+	if pingMs > 0 {
+		b.pingTimeout = time.Duration(pingMs) * time.Millisecond
+	}
+	return b
+}
+
+// SetPins sets `hashes`, a csv of hex SHA256 digests of TBS certificates,
+// as in DNS stamps, one of which must be in the chain the server presents;
+// empty `hashes` pins none.  Bad digests are reported by Build.
+func (b *TransportBuilder) SetPins(hashes string) *TransportBuilder {
+	b.pins, b.pinErr = nil, nil
+	for _, h := range strings.Split(hashes, ",") {
+		if len(h) == 0 {
+			continue
+		}
+		d, err := hex.DecodeString(h)
+		if err != nil || len(d) != sha256.Size {
+			b.pinErr = fmt.Errorf("Bad certificate pin: %s", h)
+			continue
+		}
+		if b.pins == nil {
+			b.pins = make(pins)
+		}
+		var pin [sha256.Size]byte
+		copy(pin[:], d)
+		b.pins[pin] = true
+	}
+	return b
+}
+
+// SetPadding sets whether queries are padded, as in RFC 8467 (default: on).
+func (b *TransportBuilder) SetPadding(on bool) *TransportBuilder {
+	b.nopad = !on
+	return b
+}
+
+// SetProxy sets the socks5 proxy at ip:port, with `username` and `password`,
+// if any, to dial the DoH server through; empty `ip` unsets it.  Connections
+// through proxies aren't split.
+func (b *TransportBuilder) SetProxy(ip string, port string, username string, password string) *TransportBuilder {
+	b.proxyAddr, b.proxyAuth = "", nil
+	if len(ip) > 0 {
+		b.proxyAddr = net.JoinHostPort(ip, port)
+	}
+	if len(username) > 0 || len(password) > 0 {
+		b.proxyAuth = &proxy.Auth{User: username, Password: password}
+	}
+	return b
+}
+
+// Build returns a DoH DNSTransport, ready for use, as set up by b.
+func (b *TransportBuilder) Build() (Transport, error) {
+	dialer := b.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if b.connectTimeout > 0 {
+		d := *dialer
+		d.Timeout = b.connectTimeout
+		dialer = &d
+	}
+	parsedurl, err := url.Parse(b.url)
+	if err != nil {
+		return nil, err
+	}
+	if parsedurl.Scheme != "https" {
+		return nil, fmt.Errorf("Bad scheme: %s", parsedurl.Scheme)
+	}
+	// Resolve the hostname and put those addresses first.
+	portStr := parsedurl.Port()
+	var port int
+	if len(portStr) > 0 {
+		port, err = strconv.Atoi(portStr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		port = 443
+	}
+	t := &transport{
+		url:      b.url,
+		hostname: parsedurl.Hostname(),
+		port:     port,
+		listener: b.listener,
+		decider:  b.decider,
+		events:   dnsx.NewListenerQueue(b.listenerQueue),
+		dialer:   dialer,
+		ips:      ipmap.NewIPMap(dialer.Resolver),
+		nopad:    b.nopad,
+	}
+	if len(b.proxyAddr) > 0 {
+		if _, _, err := net.SplitHostPort(b.proxyAddr); err != nil {
+			return nil, errors.New("bad proxy address")
+		}
+		if t.proxy, err = proxy.SOCKS5("tcp", b.proxyAddr, b.proxyAuth, dialer); err != nil {
+			return nil, err
+		}
+	}
+
+	ipset := t.ips.Of(t.hostname, b.ips)
+	if ipset.Empty() {
+		// IPs instead resolved just-in-time with ipmap.Get in transport.dial
+		log.Warnf("zero bootstrap ips %s", t.hostname)
+	}
+
+	// Supply a client certificate during TLS handshakes.
+	var tlsconfig *tls.Config
+	if b.auth != nil {
+		signer := newClientAuthWrapper(b.auth)
+		tlsconfig = &tls.Config{
+			GetClientCertificate: signer.GetClientCertificate,
+		}
+	}
+	if b.pinErr != nil {
+		return nil, b.pinErr
+	}
+	if len(b.pins) > 0 {
+		if tlsconfig == nil {
+			tlsconfig = &tls.Config{}
+		}
+		tlsconfig.VerifyConnection = b.pins.verify
+	}
+
+	// Override the dial function.
+	ht := &http.Transport{
+		Dial:                  t.dial,
+		TLSHandshakeTimeout:   b.handshakeTimeout,
+		ResponseHeaderTimeout: b.responseTimeout,
+		TLSClientConfig:       tlsconfig,
+	}
+	t.h2 = configureH2(ht, b.readIdleTimeout, b.pingTimeout)
+	t.client.Transport = ht
+	return t, nil
+}
+
+// verify checks that one of the certificates the server presented is
+// pinned, on top of the usual verification.
+func (p pins) verify(cs tls.ConnectionState) error {
+	for _, c := range cs.PeerCertificates {
+		if p[sha256.Sum256(c.RawTBSCertificate)] {
+			return nil
+		}
+	}
+	return errors.New("No pinned certificate")
+}
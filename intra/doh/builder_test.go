@@ -0,0 +1,96 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBuilder(t *testing.T) {
+	doh, err := NewTransportBuilder().
+		SetURL(testURL).
+		SetIPs("8.8.8.8,8.8.4.4").
+		SetTimeouts(1000, 2000, 0).
+		SetProxy("127.0.0.1", "1080", "u", "p").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := doh.(*transport)
+	if tr.dialer.Timeout != time.Second {
+		t.Errorf("connect timeout %v", tr.dialer.Timeout)
+	}
+	ht := tr.client.Transport.(*http.Transport)
+	if ht.TLSHandshakeTimeout != 2*time.Second || ht.ResponseHeaderTimeout != defaultResponseTimeout {
+		t.Errorf("timeouts %v %v", ht.TLSHandshakeTimeout, ht.ResponseHeaderTimeout)
+	}
+	if tr.proxy == nil {
+		t.Error("no proxy")
+	}
+	if ips := tr.ips.Get(tr.hostname).GetAll(); len(ips) < 2 {
+		t.Errorf("bootstrap ips %v", ips)
+	}
+}
+
+func TestBuilderBadURL(t *testing.T) {
+	if _, err := NewTransportBuilder().SetURL("http://dns.google").Build(); err == nil {
+		t.Error("http url built")
+	}
+	if _, err := NewTransportBuilder().Build(); err == nil {
+		t.Error("no url built")
+	}
+}
+
+func TestBuilderNoPadding(t *testing.T) {
+	doh, err := NewTransportBuilder().SetURL(testURL).SetPadding(false).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := makeTestRoundTripper()
+	doh.(*transport).client.Transport = rt
+	go doh.Query(simpleQueryBytes)
+	req := <-rt.req
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != len(simpleQueryBytes) {
+		t.Errorf("query of %d bytes sent as %d", len(simpleQueryBytes), len(body))
+	}
+}
+
+func TestBuilderPins(t *testing.T) {
+	if _, err := NewTransportBuilder().SetURL(testURL).SetPins("abcd").Build(); err == nil {
+		t.Error("bad pin built")
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	cert := server.Certificate()
+	tbs := sha256.Sum256(cert.RawTBSCertificate)
+	other := sha256.Sum256([]byte("other"))
+	doh, err := NewTransportBuilder().SetURL(testURL).SetPins(hex.EncodeToString(other[:]) + "," + hex.EncodeToString(tbs[:])).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := doh.(*transport).client.Transport.(*http.Transport).TLSClientConfig.VerifyConnection
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); err != nil {
+		t.Errorf("pinned cert: %v", err)
+	}
+	unpinned, _ := NewTransportBuilder().SetURL(testURL).SetPins(hex.EncodeToString(other[:])).Build()
+	verify = unpinned.(*transport).client.Transport.(*http.Transport).TLSClientConfig.VerifyConnection
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); err == nil {
+		t.Error("unpinned cert verified")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"errors"
+	"time"
+
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/xdns"
+)
+
+// Actions of Decisions.
+const (
+	// Proceed sends the query on, as if there were no Decider.
+	Proceed = 0
+	// Block answers the query as blocklists do.
+	Block = 1
+	// AnswerWith answers the query with the Decision's Response.
+	AnswerWith = 2
+	// Redirect sends the query to the Decision's Via, in place of the transport.
+	Redirect = 3
+)
+
+// DecidedBlocklist is the Blocklists of Summaries of queries a Decider blocked.
+const DecidedBlocklist = "decider"
+
+// Decision is a Decider's decision on a query.
+type Decision struct {
+	// Action is one of Proceed, Block, AnswerWith, Redirect.
+	Action int
+	// Response is the answer of AnswerWith, whose ID is set to the query's.
+	Response []byte
+	// Via is the transport of Redirect.
+	Via Transport
+}
+
+// Decider decides, ahead of the transport, what becomes of each query, so
+// that apps can set policies of their own: prompt the user, or pick a
+// transport per domain.  It is called as queries arrive, so it must return
+// quickly.
+type Decider interface {
+	// Decide returns the decision on `query`, sent to the transport of `url`;
+	// nil is Proceed.
+	Decide(url string, query []byte) *Decision
+}
+
+// SetDecider sets `d` to decide on queries to `t`, a DoH transport, before
+// they're sent; nil unsets it.
+func SetDecider(t Transport, d Decider) error {
+	dt, ok := dnsx.Unwrap(t).(*transport)
+	if !ok {
+		return errors.New("not a doh transport")
+	}
+	dt.deciderLock.Lock()
+	dt.decider = d
+	dt.deciderLock.Unlock()
+	return nil
+}
+
+func (t *transport) getDecider() Decider {
+	t.deciderLock.RLock()
+	defer t.deciderLock.RUnlock()
+	return t.decider
+}
+
+// decide applies the decision of t's Decider, if any, on q, and reports
+// whether it did, with the response, and the blocklists and error of it, and
+// whether Via retried it on a fallback, as a dnsx.TruncationRetrier does;
+// queries to Proceed, or Redirect to t itself, or nowhere, are left to t.
+func (t *transport) decide(q []byte) (response []byte, blocklists string, elapsed time.Duration, qerr *queryError, retried, decided bool) {
+	d := t.getDecider()
+	if d == nil || len(q) < 2 {
+		return
+	}
+	start := time.Now()
+	dec := d.Decide(t.url, q)
+	if dec == nil {
+		return
+	}
+	switch dec.Action {
+	case Block:
+		kind := xdns.BlockDefault
+		if b := t.bravedns; b != nil {
+			kind = dnsx.BlockResponseType(b, q)
+		}
+		ans, err := xdns.BlockResponseOfType(q, kind)
+		if err == nil {
+			response, err = ans.Pack()
+		}
+		if err != nil {
+			response, qerr = tryServfail(q), &queryError{BadQuery, err}
+		}
+		blocklists = DecidedBlocklist
+	case AnswerWith:
+		if len(dec.Response) < 2 {
+			response, qerr = tryServfail(q), &queryError{InternalError, errors.New("decided answer too short")}
+			break
+		}
+		response = append([]byte(nil), dec.Response...)
+		copy(response, q[:2])
+	case Redirect:
+		if dec.Via == nil || dnsx.Unwrap(dec.Via) == dnsx.Transport(t) {
+			return
+		}
+		var err error
+		if response, retried, err = dnsx.QueryRetrying(dec.Via, q); err != nil {
+			qerr = &queryError{SendFailed, err}
+			if len(response) == 0 {
+				response = tryServfail(q)
+			}
+		}
+	default:
+		return
+	}
+	return response, blocklists, time.Since(start), qerr, retried, true
+}
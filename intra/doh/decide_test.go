@@ -0,0 +1,134 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/celzero/firestack/intra/dnsx"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type fakeDecider struct {
+	d *Decision
+}
+
+func (f *fakeDecider) Decide(url string, query []byte) *Decision {
+	return f.d
+}
+
+// newDecidedTransport returns a DoH transport, with `d` as its Decider, whose
+// queries that are sent fail the test.
+func newDecidedTransport(t *testing.T, d *Decision) (Transport, *fakeListener) {
+	listener := &fakeListener{}
+	doh, err := NewTransportBuilder().SetURL(testURL).SetListener(listener).SetDecider(&fakeDecider{d}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := makeTestRoundTripper()
+	doh.(*transport).client.Transport = rt
+	go func() {
+		if _, ok := <-rt.req; ok {
+			t.Error("decided query sent")
+		}
+	}()
+	t.Cleanup(func() { close(rt.req) })
+	return doh, listener
+}
+
+func TestDecideBlock(t *testing.T) {
+	doh, listener := newDecidedTransport(t, &Decision{Action: Block})
+	resp, err := doh.Query(simpleQueryBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mustUnpack(resp)
+	if m.Header.ID != simpleQuery.Header.ID || len(m.Answers) == 0 {
+		t.Errorf("block response %v", m)
+	}
+	doh.(*transport).events.Flush()
+	if s := listener.summary; s.Status != Complete || s.Blocklists != DecidedBlocklist {
+		t.Errorf("block summary %d %s", s.Status, s.Blocklists)
+	}
+}
+
+func TestDecideAnswerWith(t *testing.T) {
+	answer := simpleQuery
+	answer.Header.ID = 0
+	answer.Header.Response = true
+	answer.Header.RCode = dnsmessage.RCodeNameError
+	doh, listener := newDecidedTransport(t, &Decision{Action: AnswerWith, Response: mustPack(&answer)})
+	resp, err := doh.Query(simpleQueryBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mustUnpack(resp)
+	if m.Header.ID != simpleQuery.Header.ID || m.Header.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("answer %v", m)
+	}
+	doh.(*transport).events.Flush()
+	if s := listener.summary; s.Status != Complete || len(s.Blocklists) > 0 {
+		t.Errorf("answer summary %d %s", s.Status, s.Blocklists)
+	}
+}
+
+func TestDecideRedirect(t *testing.T) {
+	via := newFakeTransport()
+	defer via.Close()
+	doh, listener := newDecidedTransport(t, &Decision{Action: Redirect, Via: via})
+	want := []byte{0xbe, 0xef, 8, 9, 10}
+	go func() {
+		if q := <-via.query; !bytes.Equal(q, simpleQueryBytes) {
+			t.Errorf("redirected query %v", q)
+		}
+		via.response <- want
+	}()
+	resp, err := doh.Query(simpleQueryBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, want) {
+		t.Errorf("redirected response %v", resp)
+	}
+	doh.(*transport).events.Flush()
+	if s := listener.summary; s.Status != Complete || !bytes.Equal(s.Response, want) {
+		t.Errorf("redirect summary %d %v", s.Status, s.Response)
+	}
+	if listener.summary.Retried {
+		t.Error("redirect summary retried")
+	}
+}
+
+func TestDecideRedirectRetried(t *testing.T) {
+	udp, tcp := newFakeTransport(), newFakeTransport()
+	defer udp.Close()
+	defer tcp.Close()
+	via := dnsx.NewTruncationRetrier(udp, tcp)
+	doh, listener := newDecidedTransport(t, &Decision{Action: Redirect, Via: via})
+	truncated := append([]byte(nil), simpleQueryBytes...)
+	truncated[2] |= 0x82 // QR, TC
+	want := append([]byte(nil), simpleQueryBytes...)
+	want[2] |= 0x80 // QR
+	go func() {
+		<-udp.query
+		udp.response <- truncated
+		<-tcp.query
+		tcp.response <- want
+	}()
+	resp, err := doh.Query(simpleQueryBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, want) {
+		t.Errorf("retried response %v", resp)
+	}
+	doh.(*transport).events.Flush()
+	if s := listener.summary; !s.Retried || !bytes.Equal(s.Response, want) {
+		t.Errorf("retried summary %t %v", s.Retried, s.Response)
+	}
+}
@@ -36,32 +36,48 @@ import (
 	"net/http"
 	"net/http/httptrace"
 	"net/textproto"
-	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/celzero/firestack/intra/codes"
+	"github.com/celzero/firestack/intra/diag"
 	"github.com/celzero/firestack/intra/dnsx"
-	"github.com/celzero/firestack/intra/xdns"
 	"github.com/celzero/firestack/intra/doh/ipmap"
+	"github.com/celzero/firestack/intra/events"
+	"github.com/celzero/firestack/intra/faults"
+	"github.com/celzero/firestack/intra/kv"
+	"github.com/celzero/firestack/intra/metrics"
+	"github.com/celzero/firestack/intra/qlog"
+	"github.com/celzero/firestack/intra/schema"
 	"github.com/celzero/firestack/intra/split"
+	"github.com/celzero/firestack/intra/trace"
+	"github.com/celzero/firestack/intra/xbuf"
+	"github.com/celzero/firestack/intra/xdns"
+	"github.com/celzero/firestack/intra/xlog"
 	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/miekg/dns"
 	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/proxy"
 )
 
+// Statuses of transactions, of the codes package's code space.
 const (
 	// Complete : Transaction completed successfully
-	Complete = iota
+	Complete = codes.OK
 	// SendFailed : Failed to send query
-	SendFailed
+	SendFailed = codes.SendFailed
 	// HTTPError : Got a non-200 HTTP status
-	HTTPError
+	HTTPError = codes.HTTPError
 	// BadQuery : Malformed input
-	BadQuery
+	BadQuery = codes.BadQuery
 	// BadResponse : Response was invalid
-	BadResponse
+	BadResponse = codes.BadResponse
 	// InternalError : This should never happen
-	InternalError
+	InternalError = codes.InternalError
+	// Overloaded : Shed, as too many queries were in-flight
+	Overloaded = codes.Overloaded
 )
 
 // If the server sends an invalid reply, we start a "servfail hangover"
@@ -71,6 +87,7 @@ const hangoverDuration = 10 * time.Second
 
 // Summary is a summary of a DNS transaction, reported when it is complete.
 type Summary struct {
+	Version    int     // Schema version, schema.DNSSummary
 	Latency    float64 // Response (or failure) latency in seconds
 	Query      []byte
 	Response   []byte
@@ -78,6 +95,28 @@ type Summary struct {
 	Status     int
 	HTTPStatus int    // Zero unless Status is Complete or HTTPError
 	Blocklists string // csv separated list of blocklists names, if any.
+	DNSSEC     int    // dnsx.DNSSEC* status of Response; DNSSECOff if not validated.
+	// Since schema.DNSSummary 3, as in dnsx.Description
+	QName  string // The name queried, without the trailing dot.
+	QType  int    // The type queried.
+	RCode  int    // The rcode of Response, or -1 if there's none.
+	IPs    string // csv of the ips answered.
+	CNAMEs string // csv of the names QName is aliased to, in order.
+	// Since schema.DNSSummary 4
+	Retried bool // Whether Response is of a retry of a truncated answer.
+}
+
+// describe sets the fields of s parsed from its Query and Response.
+func (s *Summary) describe() *Summary {
+	d := dnsx.Describe(s.Query, s.Response)
+	s.QName, s.QType, s.RCode, s.IPs, s.CNAMEs = d.QName, d.QType, d.RCode, d.IPs, d.CNAMEs
+	return s
+}
+
+// Field returns the named field of s as a string, or "" if s has no such
+// field; see schema.Field.
+func (s *Summary) Field(name string) string {
+	return schema.Field(s, name)
 }
 
 // A Token is an opaque handle used to match responses to queries.
@@ -105,16 +144,30 @@ type Transport interface {
 // TODO: Keep a context here so that queries can be canceled.
 type transport struct {
 	Transport
-	url      string
-	hostname string
-	port     int
-	ips      ipmap.IPMap
-	client   http.Client
-	dialer   *net.Dialer
-	listener Listener
-	bravedns dnsx.BraveDNS
+	url                string
+	hostname           string
+	port               int
+	ips                ipmap.IPMap
+	client             http.Client
+	dialer             *net.Dialer
+	listener           Listener
+	bravedns           dnsx.BraveDNS
+	proxy              proxy.Dialer // socks5 proxy the server is dialed through, if any
+	nopad              bool         // whether queries are sent as they are, unpadded
+	h2                 *h2pool      // health-checked HTTP/2 connections, if any
+	drainLock          sync.Mutex
+	inflight           int           // queries in-flight
+	drained            chan struct{} // closed once draining with none in-flight; nil until draining
+	connsLock          sync.Mutex
+	conns              map[*trackedConn]bool // dialed, and not yet closed
 	hangoverLock       sync.RWMutex
 	hangoverExpiration time.Time
+	hangoverNoted      bool // whether HangoverStarted has no HangoverEnded yet
+	dnssecLock         sync.RWMutex
+	dnssec             *dnsx.Validator
+	deciderLock        sync.RWMutex
+	decider            Decider
+	events             *dnsx.ListenerQueue // of calls to listener
 }
 
 // Wait up to three seconds for the TCP handshake to complete.
@@ -141,7 +194,7 @@ func (t *transport) dial(network, addr string) (net.Conn, error) {
 	confirmed := ips.Confirmed()
 	if confirmed != nil {
 		log.Debugf("Trying confirmed IP %s for addr %s", confirmed.String(), addr)
-		if conn, err = split.DialWithSplitRetry(t.dialer, tcpaddr(confirmed), nil); err == nil {
+		if conn, err = t.dialRecorded(ips, confirmed, tcpaddr); err == nil {
 			log.Infof("Confirmed IP %s worked", confirmed.String())
 			return conn, nil
 		}
@@ -150,12 +203,13 @@ func (t *transport) dial(network, addr string) (net.Conn, error) {
 	}
 
 	log.Debugf("Trying all IPs")
+	// GetAll ranks IPs by their recent connect latency and success rate.
 	for _, ip := range ips.GetAll() {
 		if ip.Equal(confirmed) {
 			// Don't try this IP twice.
 			continue
 		}
-		if conn, err = split.DialWithSplitRetry(t.dialer, tcpaddr(ip), nil); err == nil {
+		if conn, err = t.dialRecorded(ips, ip, tcpaddr); err == nil {
 			log.Infof("Found working IP: %s", ip.String())
 			return conn, nil
 		}
@@ -163,6 +217,71 @@ func (t *transport) dial(network, addr string) (net.Conn, error) {
 	return nil, err
 }
 
+// dialRecorded dials ip, through t's proxy if any, and records the connect
+// latency or failure in ips.
+func (t *transport) dialRecorded(ips *ipmap.IPSet, ip net.IP, tcpaddr func(net.IP) *net.TCPAddr) (net.Conn, error) {
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if t.proxy != nil {
+		conn, err = t.proxy.Dial("tcp", tcpaddr(ip).String())
+	} else {
+		conn, err = split.DialWithSplitRetry(t.dialer, tcpaddr(ip), nil)
+	}
+	if err != nil {
+		ips.Failed(ip)
+		return nil, err
+	}
+	ips.Succeeded(ip, time.Since(start))
+	return t.track(conn), nil
+}
+
+// trackedConn is a connection to the DoH server, that is forgotten by its
+// transport once closed.
+type trackedConn struct {
+	net.Conn
+	t    *transport
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.t.connsLock.Lock()
+		delete(c.t.conns, c)
+		c.t.connsLock.Unlock()
+		diag.SocketClosed(diag.DoH)
+	})
+	return c.Conn.Close()
+}
+
+// track has t remember conn until it is closed, for closeAllConns.
+func (t *transport) track(conn net.Conn) net.Conn {
+	c := &trackedConn{Conn: conn, t: t}
+	diag.SocketOpened(diag.DoH)
+	t.connsLock.Lock()
+	if t.conns == nil {
+		t.conns = make(map[*trackedConn]bool)
+	}
+	t.conns[c] = true
+	t.connsLock.Unlock()
+	return c
+}
+
+// closeAllConns closes all connections to the DoH server, idle or not,
+// failing the queries in-flight on them.
+func (t *transport) closeAllConns() {
+	t.connsLock.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.connsLock.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	t.closeIdleConns()
+}
+
 // NewTransport returns a DoH DNSTransport, ready for use.
 // This is a POST-only DoH implementation, so the DoH template should be a URL.
 // `rawurl` is the DoH template in string form.
@@ -172,61 +291,197 @@ func (t *transport) dial(network, addr string) (net.Conn, error) {
 //   timeout but will not mutate it otherwise.
 // `auth` will provide a client certificate if required by the TLS server.
 // `listener` will receive the status of each DNS query when it is complete.
+// See TransportBuilder for transports set up otherwise.
 func NewTransport(rawurl string, addrs []string, dialer *net.Dialer, auth ClientAuth, listener Listener) (Transport, error) {
-	if dialer == nil {
-		dialer = &net.Dialer{}
+	b := NewTransportBuilder().SetURL(rawurl).SetDialer(dialer).SetAuth(auth).SetListener(listener)
+	b.ips = addrs
+	return b.Build()
+}
+
+// SetIPListener sets `l` to be notified whenever the confirmed IP of the
+// DoH server behind transport `t` changes; nil `l` unsets the listener.
+func SetIPListener(t Transport, l ipmap.Listener) error {
+	dt, ok := dnsx.Unwrap(t).(*transport)
+	if !ok {
+		return errors.New("not a doh transport")
 	}
-	parsedurl, err := url.Parse(rawurl)
-	if err != nil {
-		return nil, err
+	dt.ips.SetListener(l)
+	return nil
+}
+
+// SetKVStore sets `s` to persist the confirmed IPs of the DoH server behind
+// transport `t` to; nil `s` unsets the store.
+func SetKVStore(t Transport, s kv.KVStore) error {
+	dt, ok := dnsx.Unwrap(t).(*transport)
+	if !ok {
+		return errors.New("not a doh transport")
 	}
-	if parsedurl.Scheme != "https" {
-		return nil, fmt.Errorf("Bad scheme: %s", parsedurl.Scheme)
+	dt.ips.SetStore(s)
+	return nil
+}
+
+// SetDNSSEC validates answers of the DoH server behind transport `t` to queries
+// in `zones`, a comma-separated list; "." validates all answers.  If `failClosed`,
+// answers that are unsigned, or whose signatures don't verify, are turned into
+// SERVFAILs.  Empty zones turns validation off.
+func SetDNSSEC(t Transport, zones string, failClosed bool) error {
+	dt, ok := dnsx.Unwrap(t).(*transport)
+	if !ok {
+		return errors.New("not a doh transport")
 	}
-	// Resolve the hostname and put those addresses first.
-	portStr := parsedurl.Port()
-	var port int
-	if len(portStr) > 0 {
-		port, err = strconv.Atoi(portStr)
-		if err != nil {
-			return nil, err
+	var v *dnsx.Validator
+	if len(strings.TrimSpace(zones)) > 0 {
+		var err error
+		if v, err = dnsx.NewValidator(zones, failClosed); err != nil {
+			return err
 		}
-	} else {
-		port = 443
 	}
-	t := &transport{
-		url:      rawurl,
-		hostname: parsedurl.Hostname(),
-		port:     port,
-		listener: listener,
-		dialer:   dialer,
-		ips:      ipmap.NewIPMap(dialer.Resolver),
+	dt.dnssecLock.Lock()
+	dt.dnssec = v
+	dt.dnssecLock.Unlock()
+	return nil
+}
+
+func (t *transport) validator() *dnsx.Validator {
+	t.dnssecLock.RLock()
+	defer t.dnssecLock.RUnlock()
+	return t.dnssec
+}
+
+// rawQuery sends q upstream, bypassing validation, for DNSKEYs to validate with.
+func (t *transport) rawQuery(q []byte) ([]byte, error) {
+	response, _, _, _, qerr := t.doQuery(q)
+	if qerr != nil {
+		return nil, qerr
+	}
+	return response, nil
+}
+
+// PinIPs restricts the DoH server behind transport `t` to `ipcsv`, a comma-separated
+// list of IP addresses, which bypasses bootstrap resolution entirely.  If `hostname`
+// is empty, the pins apply to the hostname of transport's url.
+func PinIPs(t Transport, hostname string, ipcsv string) error {
+	dt, ok := dnsx.Unwrap(t).(*transport)
+	if !ok {
+		return errors.New("not a doh transport")
+	}
+	if len(hostname) <= 0 {
+		hostname = dt.hostname
+	}
+	if _, err := dt.ips.Pin(hostname, strings.Split(ipcsv, ",")); err != nil {
+		return err
+	}
+	// Connections to unpinned IPs must not be reused.
+	dt.closeIdleConns()
+	return nil
+}
+
+// UnpinIPs removes pins set by PinIPs on the DoH server behind transport `t`.
+func UnpinIPs(t Transport, hostname string) error {
+	dt, ok := dnsx.Unwrap(t).(*transport)
+	if !ok {
+		return errors.New("not a doh transport")
+	}
+	if len(hostname) <= 0 {
+		hostname = dt.hostname
 	}
+	dt.ips.Unpin(hostname)
+	return nil
+}
+
+// InHangover reports whether the DoH server behind transport `t` is in
+// servfail hangover, as when it is unreachable.
+func InHangover(t Transport) bool {
+	dt, ok := dnsx.Unwrap(t).(*transport)
+	return ok && dt.inHangover()
+}
 
-	ipset := t.ips.Of(t.hostname, addrs)
-	if ipset.Empty() {
-		// IPs instead resolved just-in-time with ipmap.Get in transport.dial
-		log.Warnf("zero bootstrap ips %s", t.hostname)
+// ResetNetwork readies the DoH server behind transport `t` for a network
+// change: it closes all connections, even those with queries in-flight, as
+// they are bound to the network since left, ends servfail hangover, forgets
+// confirmed IPs, and resolves bootstrap addresses afresh.  It blocks on I/O.
+func ResetNetwork(t Transport) error {
+	dt, ok := dnsx.Unwrap(t).(*transport)
+	if !ok {
+		return errors.New("not a doh transport")
 	}
+	dt.closeAllConns()
+	dt.hangoverLock.Lock()
+	dt.hangoverExpiration = time.Time{}
+	dt.hangoverLock.Unlock()
+	// publishes HangoverEnded, if it was in hangover
+	dt.inHangover()
+	dt.ips.Reset()
+	return nil
+}
 
-	// Supply a client certificate during TLS handshakes.
-	var tlsconfig *tls.Config
-	if auth != nil {
-		signer := newClientAuthWrapper(auth)
-		tlsconfig = &tls.Config{
-			GetClientCertificate: signer.GetClientCertificate,
+// Drain waits up to `timeoutms` for the queries in-flight on the DoH transport
+// `t` to complete, and then closes its idle connections, as when it's swapped
+// out for another.  Queries sent to `t` once it's draining are answered with
+// SERVFAIL, unsent.  Reports whether all queries completed in time; those that
+// didn't have their connections closed once they do.
+func Drain(t Transport, timeoutms int) bool {
+	dt, ok := dnsx.Unwrap(t).(*transport)
+	if !ok {
+		return true
+	}
+	dt.drainLock.Lock()
+	if dt.drained == nil {
+		dt.drained = make(chan struct{})
+		if dt.inflight == 0 {
+			close(dt.drained)
 		}
 	}
+	drained := dt.drained
+	dt.drainLock.Unlock()
+
+	timer := time.NewTimer(time.Duration(timeoutms) * time.Millisecond)
+	defer timer.Stop()
+	dt.closeIdleConns()
+	select {
+	case <-drained:
+		dt.closeIdleConns()
+		return true
+	case <-timer.C:
+		// the last query to complete closes the idle connections
+		return false
+	}
+}
+
+// begin counts a query in-flight, unless t is draining, and reports whether
+// it did.
+func (t *transport) begin() bool {
+	t.drainLock.Lock()
+	defer t.drainLock.Unlock()
+	if t.drained != nil {
+		return false
+	}
+	t.inflight++
+	return true
+}
 
-	// Override the dial function.
-	t.client.Transport = &http.Transport{
-		Dial:                  t.dial,
-		ForceAttemptHTTP2:     true,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ResponseHeaderTimeout: 20 * time.Second, // Same value as Android DNS-over-TLS
-		TLSClientConfig:       tlsconfig,
+// end uncounts a query in-flight, and closes the idle connections of t once
+// the last one of a draining t completes.
+func (t *transport) end() {
+	t.drainLock.Lock()
+	t.inflight--
+	last := t.drained != nil && t.inflight == 0
+	if last {
+		close(t.drained)
+	}
+	t.drainLock.Unlock()
+	if last {
+		t.closeIdleConns()
+	}
+}
+
+func (t *transport) closeIdleConns() {
+	if ht, ok := t.client.Transport.(*http.Transport); ok {
+		ht.CloseIdleConnections()
+	}
+	if t.h2 != nil {
+		t.h2.closeConns()
 	}
-	return t, nil
 }
 
 type queryError struct {
@@ -242,6 +497,11 @@ func (e *queryError) Unwrap() error {
 	return e.err
 }
 
+// Code returns the status of e, as a code of the codes package.
+func (e *queryError) Code() int {
+	return e.status
+}
+
 type httpError struct {
 	status int
 }
@@ -263,9 +523,14 @@ func (t *transport) doQuery(q []byte) (response []byte, blocklists string, serve
 	}
 
 	start := time.Now()
+	// blocklists that would have blocked q, in dry-run mode
+	var dryBlocklists string
 	if err := t.prepareOnDeviceBlock(); err == nil {
 		response, blocklists, err = t.applyBlocklists(q)
-		if err == nil { // blocklist applied only when err is nil
+		if err == nil && dnsx.DryRun() {
+			dryBlocklists, response = blocklists, nil
+			log.Debugf("dry-run: would have blocked with %s", blocklists)
+		} else if err == nil { // blocklist applied only when err is nil
 			elapsed = time.Since(start)
 			return
 		}
@@ -275,10 +540,11 @@ func (t *transport) doQuery(q []byte) (response []byte, blocklists string, serve
 		log.Debugf("forward query: no local block")
 	}
 
-	t.hangoverLock.RLock()
-	inHangover := time.Now().Before(t.hangoverExpiration)
-	t.hangoverLock.RUnlock()
-	if inHangover {
+	if d := faults.DNSLatency(); d > 0 {
+		time.Sleep(d)
+	}
+
+	if t.inHangover() || faults.InHangover() {
 		response = tryServfail(q)
 		qerr = &queryError{HTTPError, errors.New("Forwarder is in servfail hangover")}
 		elapsed = time.Since(start)
@@ -286,11 +552,16 @@ func (t *transport) doQuery(q []byte) (response []byte, blocklists string, serve
 	}
 
 	// Add padding to the raw query
-	q, err := AddEdnsPadding(q)
-	if err != nil {
-		elapsed = time.Since(start)
-		qerr = &queryError{InternalError, err}
-		return
+	if t.nopad {
+		// copied, as the query ID is zeroed below
+		q = append([]byte(nil), q...)
+	} else {
+		var err error
+		if q, err = AddEdnsPadding(q); err != nil {
+			elapsed = time.Since(start)
+			qerr = &queryError{InternalError, err}
+			return
+		}
 	}
 
 	// Zero out the query ID.
@@ -303,11 +574,13 @@ func (t *transport) doQuery(q []byte) (response []byte, blocklists string, serve
 	// restore dns query id
 	binary.BigEndian.PutUint16(q, id)
 
+	if len(dryBlocklists) > 0 {
+		blocklists = dryBlocklists
+	}
+
 	if qerr != nil { // only on send-request errors
 		if qerr.status != SendFailed {
-			t.hangoverLock.Lock()
-			t.hangoverExpiration = time.Now().Add(hangoverDuration)
-			t.hangoverLock.Unlock()
+			t.startHangover(qerr)
 		}
 
 		response = tryServfail(q)
@@ -319,6 +592,40 @@ func (t *transport) doQuery(q []byte) (response []byte, blocklists string, serve
 	return
 }
 
+// inHangover reports whether t is in servfail hangover, and publishes
+// HangoverEnded once, when it is over.
+func (t *transport) inHangover() bool {
+	t.hangoverLock.RLock()
+	in := time.Now().Before(t.hangoverExpiration)
+	noted := t.hangoverNoted
+	t.hangoverLock.RUnlock()
+	if in || !noted {
+		return in
+	}
+	t.hangoverLock.Lock()
+	ended := t.hangoverNoted && !time.Now().Before(t.hangoverExpiration)
+	if ended {
+		t.hangoverNoted = false
+	}
+	t.hangoverLock.Unlock()
+	if ended {
+		events.Publish(events.HangoverEnded, t.url, "")
+	}
+	return false
+}
+
+// startHangover puts t in servfail hangover on qerr.
+func (t *transport) startHangover(qerr *queryError) {
+	t.hangoverLock.Lock()
+	started := !t.hangoverNoted
+	t.hangoverExpiration = time.Now().Add(hangoverDuration)
+	t.hangoverNoted = true
+	t.hangoverLock.Unlock()
+	if started {
+		events.Publish(events.HangoverStarted, t.url, qerr.Error())
+	}
+}
+
 func (t *transport) sendRequest(id uint16, q []byte) (response []byte, hostname string, server *net.TCPAddr, blocklists string, elapsed time.Duration, qerr *queryError) {
 	hostname = t.hostname
 
@@ -345,7 +652,8 @@ func (t *transport) sendRequest(id uint16, q []byte) (response []byte, hostname
 		}
 	}()
 
-	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewBuffer(q))
+	debug := xlog.Enabled(xlog.LevelDebug, "doh")
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(q))
 	if err != nil {
 		elapsed = time.Since(start)
 		qerr = &queryError{InternalError, err}
@@ -353,69 +661,25 @@ func (t *transport) sendRequest(id uint16, q []byte) (response []byte, hostname
 	}
 
 	// Add a trace to the request in order to expose the server's IP address.
-	// Only GotConn performs any action; the other methods just provide debug logs.
 	// GotConn runs before client.Do() returns, so there is no data race when
 	// reading the variables it has set.
-	trace := httptrace.ClientTrace{
-		GetConn: func(hostPort string) {
-			log.Debugf("%d GetConn(%s)", id, hostPort)
-		},
-		GotConn: func(info httptrace.GotConnInfo) {
-			log.Debugf("%d GotConn(%v)", id, info)
-			if info.Conn == nil {
-				return
-			}
-			conn = info.Conn
-			// info.Conn is a DuplexConn, so RemoteAddr is actually a TCPAddr.
-			server = conn.RemoteAddr().(*net.TCPAddr)
-		},
-		PutIdleConn: func(err error) {
-			log.Debugf("%d PutIdleConn(%v)", id, err)
-		},
-		GotFirstResponseByte: func() {
-			log.Debugf("%d GotFirstResponseByte()", id)
-		},
-		Got100Continue: func() {
-			log.Debugf("%d Got100Continue()", id)
-		},
-		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
-			log.Debugf("%d Got1xxResponse(%d, %v)", id, code, header)
-			return nil
-		},
-		DNSStart: func(info httptrace.DNSStartInfo) {
-			log.Debugf("%d DNSStart(%v)", id, info)
-		},
-		DNSDone: func(info httptrace.DNSDoneInfo) {
-			log.Debugf("%d, DNSDone(%v)", id, info)
-		},
-		ConnectStart: func(network, addr string) {
-			start = time.Now() // re...start
-			log.Debugf("%d ConnectStart(%s, %s)", id, network, addr)
-		},
-		ConnectDone: func(network, addr string, err error) {
-			log.Debugf("%d ConnectDone(%s, %s, %v)", id, network, addr, err)
-		},
-		TLSHandshakeStart: func() {
-			log.Debugf("%d TLSHandshakeStart()", id)
-		},
-		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
-			log.Debugf("%d TLSHandshakeDone(%v, %v)", id, state, err)
-		},
-		WroteHeaders: func() {
-			log.Debugf("%d WroteHeaders()", id)
-		},
-		WroteRequest: func(info httptrace.WroteRequestInfo) {
-			log.Debugf("%d WroteRequest(%v)", id, info)
-		},
+	trace := newTrace(id, debug, func(c net.Conn) {
+		conn = c
+		// c is a DuplexConn, so RemoteAddr is actually a TCPAddr.
+		server = conn.RemoteAddr().(*net.TCPAddr)
+	}, func() {
+		start = time.Now() // re...start
+	})
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	// set as-is, as the keys are canonical, and the values never modified
+	req.Header[contentTypeHeader] = mimetypes
+	req.Header[acceptHeader] = mimetypes
+	req.Header[userAgentHeader] = userAgents
+
+	if debug {
+		log.Debugf("%d Sending query", id)
 	}
-	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &trace))
-
-	const mimetype = "application/dns-message"
-	req.Header.Set("Content-Type", mimetype)
-	req.Header.Set("Accept", mimetype)
-	req.Header.Set("User-Agent", "Intra")
-
-	log.Debugf("%d Sending query", id)
 	httpResponse, err := t.client.Do(req)
 
 	if err != nil {
@@ -424,8 +688,10 @@ func (t *transport) sendRequest(id uint16, q []byte) (response []byte, hostname
 		return
 	}
 
-	log.Debugf("%d Got response", id)
-	response, err = ioutil.ReadAll(httpResponse.Body)
+	if debug {
+		log.Debugf("%d Got response", id)
+	}
+	response, err = readBody(httpResponse)
 	elapsed = time.Since(start)
 
 	if err != nil {
@@ -433,17 +699,21 @@ func (t *transport) sendRequest(id uint16, q []byte) (response []byte, hostname
 		return
 	}
 	httpResponse.Body.Close()
-	log.Debugf("%d Closed response", id)
+	if debug {
+		log.Debugf("%d Closed response", id)
+	}
 
 	// Update the hostname, which could have changed due to a redirect.
 	hostname = httpResponse.Request.URL.Hostname()
 
 	if httpResponse.StatusCode != http.StatusOK {
-		reqBuf := new(bytes.Buffer)
-		req.Write(reqBuf)
-		respBuf := new(bytes.Buffer)
-		httpResponse.Write(respBuf)
-		log.Debugf("%d request: %s\nresponse: %s", id, reqBuf.String(), respBuf.String())
+		if debug {
+			reqBuf := new(bytes.Buffer)
+			req.Write(reqBuf)
+			respBuf := new(bytes.Buffer)
+			httpResponse.Write(respBuf)
+			log.Debugf("%d request: %s\nresponse: %s", id, reqBuf.String(), respBuf.String())
+		}
 
 		qerr = &queryError{HTTPError, &httpError{httpResponse.StatusCode}}
 		return
@@ -468,13 +738,137 @@ func (t *transport) sendRequest(id uint16, q []byte) (response []byte, hostname
 	return
 }
 
-func (t *transport) Query(q []byte) ([]byte, error) {
-	var token Token
-	if t.listener != nil {
-		token = t.listener.OnQuery(t.url)
+// Headers of DoH requests.
+const (
+	contentTypeHeader = "Content-Type"
+	acceptHeader      = "Accept"
+	userAgentHeader   = "User-Agent"
+)
+
+var (
+	mimetypes  = []string{"application/dns-message"}
+	userAgents = []string{"Intra"}
+)
+
+// newTrace returns a trace of request `id` that calls gotConn with the conn
+// it's sent on, and connectStart as a conn is dialed for it, and, only if
+// `debug`, logs the rest of its progress, as those logs cost allocations
+// per request.
+func newTrace(id uint16, debug bool, gotConn func(net.Conn), connectStart func()) *httptrace.ClientTrace {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if debug {
+				log.Debugf("%d GotConn(%v)", id, info)
+			}
+			if info.Conn != nil {
+				gotConn(info.Conn)
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			connectStart()
+			if debug {
+				log.Debugf("%d ConnectStart(%s, %s)", id, network, addr)
+			}
+		},
+	}
+	if !debug {
+		return trace
+	}
+	trace.GetConn = func(hostPort string) {
+		log.Debugf("%d GetConn(%s)", id, hostPort)
+	}
+	trace.PutIdleConn = func(err error) {
+		log.Debugf("%d PutIdleConn(%v)", id, err)
+	}
+	trace.GotFirstResponseByte = func() {
+		log.Debugf("%d GotFirstResponseByte()", id)
+	}
+	trace.Got100Continue = func() {
+		log.Debugf("%d Got100Continue()", id)
+	}
+	trace.Got1xxResponse = func(code int, header textproto.MIMEHeader) error {
+		log.Debugf("%d Got1xxResponse(%d, %v)", id, code, header)
+		return nil
+	}
+	trace.DNSStart = func(info httptrace.DNSStartInfo) {
+		log.Debugf("%d DNSStart(%v)", id, info)
+	}
+	trace.DNSDone = func(info httptrace.DNSDoneInfo) {
+		log.Debugf("%d, DNSDone(%v)", id, info)
 	}
+	trace.ConnectDone = func(network, addr string, err error) {
+		log.Debugf("%d ConnectDone(%s, %s, %v)", id, network, addr, err)
+	}
+	trace.TLSHandshakeStart = func() {
+		log.Debugf("%d TLSHandshakeStart()", id)
+	}
+	trace.TLSHandshakeDone = func(state tls.ConnectionState, err error) {
+		log.Debugf("%d TLSHandshakeDone(%v, %v)", id, state, err)
+	}
+	trace.WroteHeaders = func() {
+		log.Debugf("%d WroteHeaders()", id)
+	}
+	trace.WroteRequest = func(info httptrace.WroteRequestInfo) {
+		log.Debugf("%d WroteRequest(%v)", id, info)
+	}
+	return trace
+}
+
+// readBody reads the body of res, in one allocation if its length is known.
+func readBody(res *http.Response) ([]byte, error) {
+	if n := res.ContentLength; n > 0 && n <= math.MaxUint16 {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(res.Body, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	return ioutil.ReadAll(res.Body)
+}
 
-	response, blocklists, server, elapsed, qerr := t.doQuery(q)
+func (t *transport) Query(q []byte) ([]byte, error) {
+	if !t.begin() {
+		return tryServfail(q), &queryError{SendFailed, errDraining}
+	}
+	defer t.end()
+
+	respond := t.notify()
+
+	tid := trace.StartQuery(q)
+
+	var server *net.TCPAddr
+	dnssec := dnsx.DNSSECOff
+	// queries the Decider, if any, decided on are neither sent nor validated
+	response, blocklists, elapsed, qerr, retried, decided := t.decide(q)
+	if !decided {
+		// Queries to validate are sent with the DO bit set, for signatures.
+		sq := q
+		v := t.validator()
+		validate, clientDO := false, false
+		if v != nil {
+			msg := new(dns.Msg)
+			if err := msg.Unpack(q); err == nil && v.Covers(msg) {
+				if b, err := dnsx.WithDO(msg); err == nil {
+					sq = b
+					validate = true
+					opt := msg.IsEdns0()
+					clientDO = opt != nil && opt.Do()
+				}
+			}
+		}
+		response, blocklists, server, elapsed, qerr = t.doQuery(sq)
+
+		// Answers blocked on-device aren't signed.
+		if validate && qerr == nil && (len(blocklists) == 0 || dnsx.DryRun()) {
+			dnssec = v.Validate(response, t.rawQuery)
+			if v.Reject(dnssec) {
+				response = tryServfail(q)
+				qerr = &queryError{BadResponse, fmt.Errorf("dnssec validation failed: %d", dnssec)}
+			} else if !clientDO {
+				response = dnsx.StripDNSSEC(response)
+			}
+		}
+	}
 
 	var err error
 	status := Complete
@@ -490,6 +884,17 @@ func (t *transport) Query(q []byte) ([]byte, error) {
 		}
 	}
 
+	qlog.Add(q, response, elapsed, t.url, blocklists, status)
+	metrics.Add(metrics.DNSQueries, 1, "transport", "doh", "status", strconv.Itoa(status))
+
+	if tid != 0 {
+		if len(blocklists) > 0 {
+			trace.Event(tid, trace.StageBlocklist, blocklists)
+		}
+		trace.Event(tid, trace.StageTransport, fmt.Sprintf("%s %s status=%d in %dms", t.url, server, status, elapsed.Milliseconds()))
+		trace.Answer(tid, response)
+	}
+
 	if t.listener != nil {
 		latency := elapsed
 		var ip string
@@ -497,7 +902,8 @@ func (t *transport) Query(q []byte) ([]byte, error) {
 			ip = server.IP.String()
 		}
 
-		t.listener.OnResponse(token, &Summary{
+		respond(&Summary{
+			Version:    schema.DNSSummary,
 			Latency:    latency.Seconds(),
 			Query:      q,
 			Response:   response,
@@ -505,6 +911,8 @@ func (t *transport) Query(q []byte) ([]byte, error) {
 			Status:     status,
 			HTTPStatus: httpStatus,
 			Blocklists: blocklists,
+			DNSSEC:     dnssec,
+			Retried:    retried,
 		})
 	}
 	return response, err
@@ -518,16 +926,22 @@ func (t *transport) SetBraveDNS(b dnsx.BraveDNS) {
 	t.bravedns = b
 }
 
+var (
+	errDraining        = errors.New("transport draining")
+	errNoBraveDNS      = errors.New("t.url or dnsx.bravedns nil")
+	errNoOnDeviceBlock = errors.New("on device block not set")
+)
+
 func (t *transport) prepareOnDeviceBlock() error {
 	b := t.bravedns
 	u := t.url
 
 	if b == nil || len(u) <= 0 {
-		return errors.New("t.url or dnsx.bravedns nil")
+		return errNoBraveDNS
 	}
 
 	if !b.OnDeviceBlock() {
-		return errors.New("on device block not set")
+		return errNoOnDeviceBlock
 	}
 
 	return nil
@@ -536,7 +950,7 @@ func (t *transport) prepareOnDeviceBlock() error {
 func (t *transport) applyBlocklists(q []byte) (response []byte, blocklists string, err error) {
 	bravedns := t.bravedns
 	if bravedns == nil {
-		errors.New("bravedns is nil")
+		err = errors.New("bravedns is nil")
 		return
 	}
 	blocklists, err = bravedns.BlockRequest(q)
@@ -548,7 +962,7 @@ func (t *transport) applyBlocklists(q []byte) (response []byte, blocklists strin
 		return
 	}
 
-	ans, err := xdns.BlockResponseFromMessage(q)
+	ans, err := xdns.BlockResponseOfType(q, dnsx.BlockResponseType(bravedns, q))
 	if err != nil {
 		return
 	}
@@ -565,7 +979,12 @@ func (t *transport) resolveBlock(q []byte, res *http.Response, ans []byte) (bloc
 
 	var err error
 	blocklistNames = t.blocklistsFromHeader(bravedns, res)
-	if len(blocklistNames) > 0 || bravedns.OnDeviceBlock() == false {
+	if len(blocklistNames) > 0 {
+		// blocked by the server, which answered as it would have
+		dnsx.NoteBlock(bravedns, ans, blocklistNames)
+		return
+	}
+	if bravedns.OnDeviceBlock() == false {
 		return
 	}
 
@@ -579,7 +998,12 @@ func (t *transport) resolveBlock(q []byte, res *http.Response, ans []byte) (bloc
 		return
 	}
 
-	msg, err := xdns.BlockResponseFromMessage(q)
+	if dnsx.DryRun() {
+		log.Debugf("dry-run: would have blocked answer with %s", blocklistNames)
+		return
+	}
+
+	msg, err := xdns.BlockResponseOfType(q, dnsx.BlockResponseType(bravedns, ans))
 	if err != nil {
 		log.Warnf("could not pack blocked dns ans %v", err)
 		return
@@ -618,7 +1042,13 @@ func forwardQuery(t Transport, q []byte, c io.Writer) error {
 	}
 	// Use a combined write to ensure atomicity.  Otherwise, writes from two
 	// responses could be interleaved.
-	rlbuf := make([]byte, rlen+2)
+	b := xbuf.Get(rlen + 2)
+	diag.BufferTaken(diag.DoH)
+	defer func() {
+		xbuf.Put(b)
+		diag.BufferReturned(diag.DoH)
+	}()
+	rlbuf := *b
 	binary.BigEndian.PutUint16(rlbuf, uint16(rlen))
 	copy(rlbuf[2:], resp)
 	n, err := c.Write(rlbuf)
@@ -669,7 +1099,9 @@ func Accept(t Transport, c io.ReadWriteCloser) {
 			log.Warnf("Incomplete query: %d < %d", n, qlen)
 			break
 		}
-		go forwardQueryAndCheck(t, q, c)
+		if !queries.submit(func() { forwardQueryAndCheck(t, q, c) }) {
+			shed(t, q, c)
+		}
 	}
 	// TODO: Cancel outstanding queries at this point.
 	c.Close()
@@ -696,4 +1128,3 @@ func tryServfail(q []byte) []byte {
 	}
 	return response
 }
-
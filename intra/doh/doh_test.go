@@ -36,6 +36,8 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/celzero/firestack/intra/dnsx"
+
 	"golang.org/x/net/dns/dnsmessage"
 )
 
@@ -332,6 +334,43 @@ func TestResponse(t *testing.T) {
 	}
 }
 
+// Check that unsigned answers are refused when failing closed.
+func TestDNSSECFailClosed(t *testing.T) {
+	doh, _ := NewTransport(testURL, ips, nil, nil, nil)
+	transport := doh.(*transport)
+	rt := makeTestRoundTripper()
+	transport.client.Transport = rt
+	if err := SetDNSSEC(doh, "bad..zone", true); err == nil {
+		t.Error("Expected error for bad zone")
+	}
+	if err := SetDNSSEC(doh, ".", true); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		<-rt.req
+		r, w := io.Pipe()
+		rt.resp <- &http.Response{
+			StatusCode: 200,
+			Body:       r,
+			Request:    &http.Request{URL: parsedURL},
+		}
+		var modifiedQuery dnsmessage.Message = simpleQuery
+		modifiedQuery.Header.ID = 0
+		modifiedQuery.Header.Response = true
+		w.Write(mustPack(&modifiedQuery))
+		w.Close()
+	}()
+
+	resp, err := doh.Query(simpleQueryBytes)
+	if err == nil {
+		t.Error("Expected unsigned answer to be refused")
+	}
+	if respParsed := mustUnpack(resp); respParsed.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Expected servfail, got %v", respParsed.Header.RCode)
+	}
+}
+
 // Simulate an empty response.  (This is not a compliant server
 // behavior.)
 func TestEmptyResponse(t *testing.T) {
@@ -466,6 +505,7 @@ func TestListener(t *testing.T) {
 	}()
 
 	doh.Query(simpleQueryBytes)
+	transport.events.Flush()
 	s := listener.summary
 	if s.Latency < 0 {
 		t.Errorf("Negative latency: %f", s.Latency)
@@ -482,6 +522,10 @@ func TestListener(t *testing.T) {
 	if s.Status != Complete {
 		t.Errorf("Wrong status: %d", s.Status)
 	}
+	// the response is malformed, so only the query is described
+	if s.QName != "www.example.com" || s.QType != int(dnsmessage.TypeA) || s.RCode != -1 {
+		t.Errorf("Wrong description: %s %d %d", s.QName, s.QType, s.RCode)
+	}
 }
 
 type socket struct {
@@ -855,3 +899,218 @@ func TestServfail(t *testing.T) {
 	}
 }
 
+
+func TestDryRun(t *testing.T) {
+	listener := &fakeListener{}
+	doh, _ := NewTransport(testURL, ips, nil, nil, listener)
+	transport := doh.(*transport)
+	rt := makeTestRoundTripper()
+	transport.client.Transport = rt
+	b := dnsx.NewLocalBlocklists()
+	b.Load("ads", "0.0.0.0 www.example.com\n")
+	doh.SetBraveDNS(b)
+
+	dnsx.SetDryRun(true)
+	defer dnsx.SetDryRun(false)
+	go func() {
+		<-rt.req
+		r, w := io.Pipe()
+		rt.resp <- &http.Response{
+			StatusCode: 200,
+			Body:       r,
+			Request:    &http.Request{URL: parsedURL},
+		}
+		var modifiedQuery dnsmessage.Message = simpleQuery
+		modifiedQuery.Header.ID = 0
+		modifiedQuery.Header.Response = true
+		modifiedQuery.Header.RCode = dnsmessage.RCodeNameError
+		w.Write(mustPack(&modifiedQuery))
+		w.Close()
+	}()
+	resp, err := doh.Query(simpleQueryBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mustUnpack(resp).Header.RCode != dnsmessage.RCodeNameError {
+		t.Error("Expected the real answer in dry-run mode")
+	}
+	transport.events.Flush()
+	if listener.summary.Blocklists != "ads" {
+		t.Errorf("Expected would-be blocklists, got %q", listener.summary.Blocklists)
+	}
+
+	// Enforced, the query isn't sent.
+	dnsx.SetDryRun(false)
+	resp, err = doh.Query(simpleQueryBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := mustUnpack(resp); r.Header.RCode != dnsmessage.RCodeSuccess || len(r.Answers) != 1 {
+		t.Errorf("Expected blocked answer, got %v", r)
+	}
+	transport.events.Flush()
+	if listener.summary.Blocklists != "ads" {
+		t.Errorf("Expected blocklists, got %q", listener.summary.Blocklists)
+	}
+}
+
+// serverBlocks is a BraveDNS that leaves blocking to the server.
+type serverBlocks struct {
+	dnsx.BraveDNS
+}
+
+func (serverBlocks) OnDeviceBlock() bool {
+	return false
+}
+
+func (serverBlocks) GetBlocklistStampHeaderKey() string {
+	return "X-Nile-Flags"
+}
+
+func (serverBlocks) StampToNames(stamp string) (string, error) {
+	return "ads", nil
+}
+
+// Check that blocks the server reports in its header are counted.
+func TestServerBlockCounted(t *testing.T) {
+	doh, _ := NewTransport(testURL, ips, nil, nil, nil)
+	transport := doh.(*transport)
+	rt := makeTestRoundTripper()
+	transport.client.Transport = rt
+	c := dnsx.NewBlockCounter(serverBlocks{})
+	doh.SetBraveDNS(c)
+
+	go func() {
+		<-rt.req
+		r, w := io.Pipe()
+		rt.resp <- &http.Response{
+			StatusCode: 200,
+			Body:       r,
+			Header:     http.Header{"X-Nile-Flags": []string{"1:stamp"}},
+			Request:    &http.Request{URL: parsedURL},
+		}
+		var blocked dnsmessage.Message = simpleQuery
+		blocked.Header.ID = 0
+		blocked.Header.Response = true
+		w.Write(mustPack(&blocked))
+		w.Close()
+	}()
+	if _, err := doh.Query(simpleQueryBytes); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.BlockedToday(); n != 1 {
+		t.Errorf("Expected the server's block counted, got %d", n)
+	}
+}
+
+// Check that a network change ends hangover, forgets the confirmed IP, and
+// closes connections in use.
+func TestResetNetwork(t *testing.T) {
+	doh, _ := NewTransport(testURL, ips, nil, nil, nil)
+	transport := doh.(*transport)
+	ip := net.ParseIP(ips[0])
+	transport.ips.Get(transport.hostname).Confirm(ip)
+	transport.startHangover(&queryError{SendFailed, errors.New("unreachable")})
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := transport.track(client)
+
+	if err := ResetNetwork(doh); err != nil {
+		t.Fatal(err)
+	}
+	if transport.inHangover() {
+		t.Error("Hangover should end on a network change")
+	}
+	if c := transport.ips.Get(transport.hostname).Confirmed(); c != nil {
+		t.Errorf("Confirmed IP %s should be forgotten", c)
+	}
+	if _, err := conn.Write([]byte{0}); err != io.ErrClosedPipe {
+		t.Errorf("Connection in use should be closed, got %v", err)
+	}
+	if n := len(transport.conns); n != 0 {
+		t.Errorf("%d closed connections still tracked", n)
+	}
+	if err := ResetNetwork(nil); err == nil {
+		t.Error("Expected error for non-doh transport")
+	}
+}
+
+// Check that Drain waits for queries in-flight.
+func TestDrain(t *testing.T) {
+	doh, _ := NewTransport(testURL, ips, nil, nil, nil)
+	transport := doh.(*transport)
+	rt := makeTestRoundTripper()
+	transport.client.Transport = rt
+
+	done := make(chan struct{})
+	go func() {
+		doh.Query(simpleQueryBytes)
+		close(done)
+	}()
+	req := <-rt.req
+	if Drain(doh, 10) {
+		t.Error("Drained with a query in-flight")
+	}
+	r, w := io.Pipe()
+	rt.resp <- &http.Response{
+		StatusCode: 200,
+		Body:       r,
+		Request:    req,
+	}
+	var response dnsmessage.Message = simpleQuery
+	response.Header.ID = 0
+	w.Write(mustPack(&response))
+	w.Close()
+	<-done
+	if !Drain(doh, 10) {
+		t.Error("Not drained with no queries in-flight")
+	}
+	// queries to a draining transport are answered unsent
+	resp, err := doh.Query(simpleQueryBytes)
+	var qerr *queryError
+	if !errors.As(err, &qerr) || qerr.status != SendFailed {
+		t.Errorf("Query to a drained transport: %v", err)
+	}
+	if len(resp) == 0 {
+		t.Error("Query to a drained transport unanswered")
+	}
+	select {
+	case <-rt.req:
+		t.Error("Query to a drained transport sent")
+	default:
+	}
+	if !Drain(nil, 10) {
+		t.Error("Non-doh transports have nothing to drain")
+	}
+}
+
+// immediateRoundTripper answers each request with `response` at once.
+type immediateRoundTripper struct {
+	response []byte
+}
+
+func (r *immediateRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	return &http.Response{
+		StatusCode:    200,
+		ContentLength: int64(len(r.response)),
+		Body:          ioutil.NopCloser(bytes.NewReader(r.response)),
+		Request:       req,
+	}, nil
+}
+
+func BenchmarkQuery(b *testing.B) {
+	doh, _ := NewTransport(testURL, ips, nil, nil, nil)
+	transport := doh.(*transport)
+	var response dnsmessage.Message = simpleQuery
+	response.Header.ID = 0
+	transport.client.Transport = &immediateRoundTripper{mustPack(&response)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := doh.Query(simpleQueryBytes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
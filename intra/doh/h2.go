@@ -0,0 +1,197 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/diag"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// defaultReadIdleTimeout is how long an HTTP/2 connection goes without
+	// a frame before it is pinged.
+	defaultReadIdleTimeout = 1 * time.Second
+	// defaultPingTimeout is how long a ping goes unanswered before its
+	// connection is closed as dead.
+	defaultPingTimeout = 1 * time.Second
+	// h2IdleTimeout is how long an HTTP/2 connection goes unused before it
+	// is closed, so that idle connections aren't pinged forever.
+	h2IdleTimeout = 30 * time.Second
+)
+
+// h2pool is the pool of the HTTP/2 connections of a DoH transport.  Unlike
+// the pool http2.ConfigureTransport sets up, it health-checks connections:
+// those that go `readIdle` without a frame are pinged, and dropped if the
+// ping goes unanswered for `ping`, so that connections that die silently,
+// as on network changes, fail in a second or two, rather than stall queries
+// till the response timeout.
+type h2pool struct {
+	sync.Mutex
+	t2     *http2.Transport
+	conns  map[string][]*http2.ClientConn    // addr -> conns
+	idlers map[*http2.ClientConn]*time.Timer // conn -> closes it once idle
+}
+
+// h2RoundTripper sends requests over the pooled connections of its
+// transport, if any, and else has net/http dial anew.
+type h2RoundTripper struct {
+	t2 *http2.Transport
+}
+
+func (rt h2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := rt.t2.RoundTrip(req)
+	if err == http2.ErrNoCachedConn {
+		return nil, http.ErrSkipAltProtocol
+	}
+	return res, err
+}
+
+// errRoundTripper fails requests with err; net/http sniffs for it, by its
+// RoundTripErr method, to fail the dial of the connection it was made for.
+type errRoundTripper struct {
+	err error
+}
+
+func (rt errRoundTripper) RoundTripErr() error {
+	return rt.err
+}
+
+func (rt errRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, rt.err
+}
+
+// configureH2 sets up t1 to speak HTTP/2, where servers do, over connections
+// health-checked as in h2pool.
+func configureH2(t1 *http.Transport, readIdle time.Duration, ping time.Duration) *h2pool {
+	p := &h2pool{
+		conns:  make(map[string][]*http2.ClientConn),
+		idlers: make(map[*http2.ClientConn]*time.Timer),
+	}
+	p.t2 = &http2.Transport{
+		ConnPool:        p,
+		ReadIdleTimeout: readIdle,
+		PingTimeout:     ping,
+	}
+	if t1.TLSClientConfig == nil {
+		t1.TLSClientConfig = &tls.Config{}
+	}
+	t1.TLSClientConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	t1.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{
+		http2.NextProtoTLS: p.upgrade,
+	}
+	t1.RegisterProtocol("https", h2RoundTripper{p.t2})
+	return p
+}
+
+// upgrade pools c, just dialed to `authority`, a host:port, once it has
+// negotiated HTTP/2.
+func (p *h2pool) upgrade(authority string, c *tls.Conn) http.RoundTripper {
+	cc, err := p.t2.NewClientConn(c)
+	if err != nil {
+		diag.Go(diag.DoH, func() {
+			c.Close()
+		})
+		return errRoundTripper{err}
+	}
+	p.Lock()
+	p.conns[authority] = append(p.conns[authority], cc)
+	p.idlers[cc] = time.AfterFunc(h2IdleTimeout, func() {
+		p.retire(cc)
+	})
+	p.Unlock()
+	// net/http drops, and redials, conns whose round-trips fail with
+	// http2.ErrNoCachedConn, as of those once dropped from the pool.
+	return p.t2
+}
+
+// GetClientConn implements http2.ClientConnPool.
+func (p *h2pool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	p.Lock()
+	defer p.Unlock()
+	for _, cc := range p.conns[addr] {
+		if cc.CanTakeNewRequest() {
+			p.idlers[cc].Reset(h2IdleTimeout)
+			return cc, nil
+		}
+	}
+	return nil, http2.ErrNoCachedConn
+}
+
+// MarkDead implements http2.ClientConnPool.  It is called for connections
+// that failed health checks, or that closed.
+func (p *h2pool) MarkDead(cc *http2.ClientConn) {
+	p.Lock()
+	defer p.Unlock()
+	p.removeLocked(cc)
+}
+
+func (p *h2pool) removeLocked(cc *http2.ClientConn) {
+	idler, ok := p.idlers[cc]
+	if !ok {
+		return
+	}
+	idler.Stop()
+	delete(p.idlers, cc)
+	for addr, conns := range p.conns {
+		for i, c := range conns {
+			if c != cc {
+				continue
+			}
+			conns = append(conns[:i], conns[i+1:]...)
+			if len(conns) == 0 {
+				delete(p.conns, addr)
+			} else {
+				p.conns[addr] = conns
+			}
+			return
+		}
+	}
+}
+
+// retire drops cc from the pool, and closes it once its requests complete,
+// or, at the latest, after the default response timeout.
+func (p *h2pool) retire(cc *http2.ClientConn) {
+	p.Lock()
+	p.removeLocked(cc)
+	p.Unlock()
+	diag.Go(diag.DoH, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultResponseTimeout)
+		defer cancel()
+		if err := cc.Shutdown(ctx); err != nil {
+			log.Debugf("h2 shutdown: %v", err)
+			cc.Close()
+		}
+	})
+}
+
+// closeConns drops all connections, and closes them once their requests
+// complete.
+func (p *h2pool) closeConns() {
+	p.Lock()
+	conns := make([]*http2.ClientConn, 0, len(p.idlers))
+	for cc := range p.idlers {
+		conns = append(conns, cc)
+	}
+	p.Unlock()
+	for _, cc := range conns {
+		p.retire(cc)
+	}
+}
+
+// size returns the number of pooled connections.
+func (p *h2pool) size() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.idlers)
+}
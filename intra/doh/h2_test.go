@@ -0,0 +1,123 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallListener accepts conns that, once stalled, read nothing more, as
+// conns that died silently.
+type stallListener struct {
+	net.Listener
+	stall chan struct{}
+}
+
+type stallConn struct {
+	net.Conn
+	stall  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *stallConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.stall:
+		<-c.closed // reads nothing till closed, as on a dead path
+		return 0, io.EOF
+	default:
+		return c.Conn.Read(b)
+	}
+}
+
+func (c *stallConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (l *stallListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &stallConn{Conn: c, stall: l.stall, closed: make(chan struct{})}, nil
+}
+
+func TestH2HealthCheck(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	l := &stallListener{server.Listener, make(chan struct{})}
+	server.Listener = l
+	server.StartTLS()
+	defer server.Close()
+
+	ht := &http.Transport{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig.Clone(),
+	}
+	p := configureH2(ht, 100*time.Millisecond, 100*time.Millisecond)
+	client := &http.Client{Transport: ht}
+
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Fatalf("proto %s", res.Proto)
+	}
+	if n := p.size(); n != 1 {
+		t.Fatalf("%d conns pooled", n)
+	}
+
+	// Stalled, the conn fails its health check, and is dropped.
+	close(l.stall)
+	deadline := time.Now().Add(2 * time.Second)
+	for p.size() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("dead conn still pooled")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestH2CloseConns(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	ht := &http.Transport{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig.Clone(),
+	}
+	p := configureH2(ht, time.Second, time.Second)
+	client := &http.Client{Transport: ht}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if n := p.size(); n != 1 {
+		t.Fatalf("%d conns pooled", n)
+	}
+	p.closeConns()
+	if n := p.size(); n != 0 {
+		t.Fatalf("%d conns pooled after close", n)
+	}
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
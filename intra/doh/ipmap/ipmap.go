@@ -25,10 +25,17 @@ package ipmap
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/events"
+	"github.com/celzero/firestack/intra/kv"
 	"github.com/eycorsican/go-tun2socks/common/log"
 )
 
@@ -42,6 +49,32 @@ type IPMap interface {
 	// Of creates an IPSet for this hostname bootstrapped with given IPs.
 	// Subsequent calls to Of return a new, overriden IPSet.
 	Of(hostname string, ips []string) *IPSet
+
+	// SetListener sets l to be notified of confirmed IP changes; nil unsets.
+	SetListener(l Listener)
+
+	// SetStore sets kv to persist confirmed IPs to, so that they may seed
+	// hostnames that fail to resolve in later sessions; nil unsets.
+	SetStore(kv kv.KVStore)
+
+	// Pin restricts this hostname to the given IPs, bypassing resolution.
+	Pin(hostname string, ips []string) (*IPSet, error)
+
+	// Unpin undoes Pin, restoring resolved and bootstrap IPs of this hostname,
+	// or, if it was pinned before it was ever resolved, forgetting it, so that
+	// Get resolves it afresh.
+	Unpin(hostname string)
+
+	// Reset forgets confirmed IPs and connect stats, as learnt on a network
+	// since left, and resolves every hostname afresh.  It blocks on I/O.
+	Reset()
+}
+
+// Listener is notified when the confirmed IP of a hostname changes.
+type Listener interface {
+	// OnIPChanged is called with the hostname and its previously and newly
+	// confirmed IPs, either of which may be empty.  It must not block.
+	OnIPChanged(hostname string, prev string, next string)
 }
 
 // NewIPMap returns a fresh IPMap.
@@ -57,6 +90,70 @@ type ipMap struct {
 	sync.RWMutex
 	m map[string]*IPSet
 	r *net.Resolver
+	l Listener
+	s kv.KVStore
+}
+
+func (m *ipMap) SetListener(l Listener) {
+	m.Lock()
+	m.l = l
+	m.Unlock()
+}
+
+func (m *ipMap) listener() Listener {
+	m.RLock()
+	defer m.RUnlock()
+	return m.l
+}
+
+func (m *ipMap) SetStore(s kv.KVStore) {
+	m.Lock()
+	m.s = s
+	sets := make([]*IPSet, 0, len(m.m))
+	for _, set := range m.m {
+		sets = append(sets, set)
+	}
+	m.Unlock()
+
+	// Seed existing sets with IPs remembered from previous sessions.
+	for _, set := range sets {
+		if ips := m.remembered(set.hostname); len(ips) > 0 {
+			set.Lock()
+			set.seed = append(set.seed, ips...)
+			set.Unlock()
+			set.bootstrap()
+		}
+	}
+}
+
+func (m *ipMap) store() kv.KVStore {
+	m.RLock()
+	defer m.RUnlock()
+	return m.s
+}
+
+// Returns the IP last confirmed for hostname, if persisted.
+func (m *ipMap) remembered(hostname string) []string {
+	s := m.store()
+	if s == nil {
+		return nil
+	}
+	v, err := s.Get(kv.IPMap + hostname)
+	if err != nil || len(v) == 0 {
+		return nil
+	}
+	return []string{string(v)}
+}
+
+// Persists ip as the one last confirmed for hostname.
+func (m *ipMap) remember(hostname string, ip net.IP) {
+	s := m.store()
+	if s == nil || ip == nil {
+		return
+	}
+	if err := s.Put(kv.IPMap+hostname, []byte(ip.String())); err != nil {
+		log.Warnf("Failed to persist ip for %s: %v", hostname, err)
+	}
 }
 
 func (m *ipMap) Get(hostname string) *IPSet {
@@ -67,7 +164,7 @@ func (m *ipMap) Get(hostname string) *IPSet {
 		return s
 	}
 
-	s = &IPSet{r: m.r}
+	s = &IPSet{r: m.r, seed: m.remembered(hostname), hostname: hostname, m: m}
 	s.Add(hostname)
 
 	if s.Empty() {
@@ -94,14 +191,55 @@ func (m *ipMap) Get(hostname string) *IPSet {
 // One IP can be marked as confirmed to be working correctly.
 type IPSet struct {
 	sync.RWMutex
-	ips       []net.IP      // All known IPs for the server.
-	confirmed net.IP        // IP address confirmed to be working
-	r         *net.Resolver // Resolver to use for hostname resolution
-	seed      []string      // Bootstrap IPs
+	ips       []net.IP           // All known IPs for the server.
+	confirmed net.IP             // IP address confirmed to be working
+	r         *net.Resolver      // Resolver to use for hostname resolution
+	seed      []string           // Bootstrap IPs
+	pins      []net.IP           // If non-empty, the only IPs in use.
+	stats     map[string]*ipstat // Connect stats keyed by ip.String()
+	hostname  string             // Hostname this set belongs to
+	m         *ipMap             // Owner of this set, if any
+}
+
+// ipstat tracks recent connect latency and outcomes of a single IP.
+type ipstat struct {
+	rtt  time.Duration // Exponentially weighted moving average of connect latency
+	ok   float64       // Decayed count of successful connects
+	fail float64       // Decayed count of failed connects
+}
+
+const (
+	// Latency assumed for IPs that never connected successfully.
+	defaultRTT = 1 * time.Second
+	// Time typically lost to a failed connect.
+	failPenalty = 3 * time.Second
+	// Counts are halved once they sum beyond this, so recent outcomes dominate.
+	maxOutcomes = 16
+)
+
+// score returns the expected time to connect to an IP with stats st: lower is better.
+func (st *ipstat) score() float64 {
+	if st == nil {
+		st = &ipstat{}
+	}
+	rtt := st.rtt
+	if rtt <= 0 {
+		rtt = defaultRTT
+	}
+	// Laplace-smoothed success rate, so unknown IPs rate at 0.5.
+	rate := (st.ok + 1) / (st.ok + st.fail + 2)
+	return rate*float64(rtt) + (1-rate)*float64(failPenalty)
+}
+
+func (st *ipstat) decay() {
+	if st.ok+st.fail > maxOutcomes {
+		st.ok /= 2
+		st.fail /= 2
+	}
 }
 
 func (m *ipMap) Of(hostname string, ips []string) *IPSet {
-	s := &IPSet{r: m.r, seed: ips}
+	s := &IPSet{r: m.r, seed: ips, hostname: hostname, m: m}
 	s.bootstrap()
 
 	m.Lock()
@@ -111,6 +249,103 @@ func (m *ipMap) Of(hostname string, ips []string) *IPSet {
 	return s
 }
 
+func (m *ipMap) Pin(hostname string, ips []string) (*IPSet, error) {
+	m.Lock()
+	s := m.m[hostname]
+	if s == nil {
+		// Don't resolve hostname, it is pinned.
+		s = &IPSet{r: m.r, hostname: hostname, m: m}
+		m.m[hostname] = s
+	}
+	m.Unlock()
+
+	if err := s.Pin(ips); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *ipMap) Reset() {
+	m.RLock()
+	sets := make([]*IPSet, 0, len(m.m))
+	for _, set := range m.m {
+		sets = append(sets, set)
+	}
+	m.RUnlock()
+
+	for _, set := range sets {
+		set.reset()
+	}
+}
+
+func (m *ipMap) Unpin(hostname string) {
+	m.Lock()
+	defer m.Unlock()
+	s := m.m[hostname]
+	if s == nil {
+		return
+	}
+	s.Unpin()
+	if s.Empty() {
+		// Pinned without being resolved; let Get resolve it.
+		delete(m.m, hostname)
+	}
+}
+
+// Pin restricts the set to ips until Unpin is called.
+func (s *IPSet) Pin(ips []string) error {
+	var pins []net.IP
+	for _, ip := range ips {
+		if p := net.ParseIP(strings.TrimSpace(ip)); p != nil {
+			pins = append(pins, p)
+		}
+	}
+	if len(pins) == 0 {
+		return errors.New("no valid ips to pin")
+	}
+
+	s.Lock()
+	s.pins = pins
+	prev := s.confirmed
+	if !s.pinned(prev) {
+		s.confirmed = nil
+	}
+	disconfirmed := prev != nil && s.confirmed == nil
+	s.Unlock()
+
+	if disconfirmed {
+		s.notify(prev, nil)
+	}
+	return nil
+}
+
+// Unpin removes any pins, restoring all known IPs.
+func (s *IPSet) Unpin() {
+	s.Lock()
+	s.pins = nil
+	s.Unlock()
+}
+
+// Pinned reports whether the set is restricted to pinned IPs.
+func (s *IPSet) Pinned() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.pins) > 0
+}
+
+// Reports whether ip is allowed by the pins, if any.  Must be called under RLock.
+func (s *IPSet) pinned(ip net.IP) bool {
+	if len(s.pins) == 0 {
+		return true
+	}
+	for _, p := range s.pins {
+		if p.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // Reports whether ip is in the set.  Must be called under RLock.
 func (s *IPSet) has(ip net.IP) bool {
 	for _, oldIP := range s.ips {
@@ -131,17 +366,68 @@ func (s *IPSet) add(ip net.IP) {
 // Add one or more IP addresses to the set.
 // The hostname can be a domain name or an IP address.
 func (s *IPSet) Add(hostname string) {
+	if s.Pinned() {
+		// Pins bypass resolution.
+		return
+	}
+	resolved := s.resolve(hostname)
+	s.Lock()
+	for _, ip := range resolved {
+		s.add(ip)
+	}
+	s.Unlock()
+	s.bootstrap()
+}
+
+// resolve returns the IPs of hostname, and those hinted for it.
+func (s *IPSet) resolve(hostname string) []net.IP {
 	// Don't hold the ipMap lock during blocking I/O.
 	resolved, err := s.r.LookupIPAddr(context.TODO(), hostname)
 	if err != nil {
 		log.Warnf("Failed to resolve %s: %v", hostname, err)
+		events.Publish(events.BootstrapResolved, hostname, err.Error())
+	} else {
+		ips := make([]string, len(resolved))
+		for i, addr := range resolved {
+			ips[i] = addr.IP.String()
+		}
+		events.Publish(events.BootstrapResolved, hostname, strings.Join(ips, ","))
 	}
-	s.Lock()
+	var out []net.IP
 	for _, addr := range resolved {
-		s.add(addr.IP)
+		out = append(out, addr.IP)
+	}
+	// ip hints from HTTPS records seen in answers through the tunnel
+	for _, v := range strings.Split(dnsx.HintedIPs(hostname), ",") {
+		if ip := net.ParseIP(v); ip != nil {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// reset unsets the confirmed IP and connect stats, and, unless pinned,
+// replaces resolved IPs with those the hostname now resolves to, if any.
+func (s *IPSet) reset() {
+	var resolved []net.IP
+	if !s.Pinned() {
+		resolved = s.resolve(s.hostname)
+	}
+	s.Lock()
+	prev := s.confirmed
+	s.confirmed = nil
+	s.stats = nil
+	if len(resolved) > 0 {
+		s.ips = nil
+		for _, ip := range resolved {
+			s.add(ip)
+		}
 	}
 	s.Unlock()
 	s.bootstrap()
+	if prev != nil {
+		s.notify(prev, nil)
+	}
 }
 
 // Adds one or more IP addresses to the set.
@@ -157,21 +443,71 @@ func (s *IPSet) bootstrap() {
 func (s *IPSet) Empty() bool {
 	s.RLock()
 	defer s.RUnlock()
-	return len(s.ips) == 0
+	return len(s.ips) == 0 && len(s.pins) == 0
 }
 
-// GetAll returns a copy of the IP set as a slice in random order.
+// GetAll returns a copy of the IP set as a slice ordered by recent connect
+// latency and success rate, best first.  IPs that rank the same, like
+// those yet to be dialed, appear in random order.
 // The slice is owned by the caller, but the elements are owned by the set.
 func (s *IPSet) GetAll() []net.IP {
 	s.RLock()
 	c := append([]net.IP{}, s.ips...)
+	if len(s.pins) > 0 {
+		c = append([]net.IP{}, s.pins...)
+	}
+	scores := make(map[string]float64, len(c))
+	for _, ip := range c {
+		scores[ip.String()] = s.stats[ip.String()].score()
+	}
 	s.RUnlock()
 	rand.Shuffle(len(c), func(i, j int) {
 		c[i], c[j] = c[j], c[i]
 	})
+	sort.SliceStable(c, func(i, j int) bool {
+		return scores[c[i].String()] < scores[c[j].String()]
+	})
 	return c
 }
 
+// Succeeded records that a connection to ip was established in `rtt`.
+func (s *IPSet) Succeeded(ip net.IP, rtt time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	st := s.stat(ip)
+	if st.rtt <= 0 {
+		st.rtt = rtt
+	} else {
+		// Weigh the latest sample at 1/4th.
+		st.rtt = (3*st.rtt + rtt) / 4
+	}
+	st.ok++
+	st.decay()
+}
+
+// Failed records that a connection to ip could not be established.
+func (s *IPSet) Failed(ip net.IP) {
+	s.Lock()
+	defer s.Unlock()
+	st := s.stat(ip)
+	st.fail++
+	st.decay()
+}
+
+// Returns connect stats for ip, creating them if absent.  Must be called under Lock.
+func (s *IPSet) stat(ip net.IP) *ipstat {
+	if s.stats == nil {
+		s.stats = make(map[string]*ipstat)
+	}
+	k := ip.String()
+	st := s.stats[k]
+	if st == nil {
+		st = &ipstat{}
+		s.stats[k] = st
+	}
+	return st
+}
+
 // Confirmed returns the confirmed IP address, or nil if there is no such address.
 func (s *IPSet) Confirmed() net.IP {
 	s.RLock()
@@ -187,18 +523,50 @@ func (s *IPSet) Confirm(ip net.IP) {
 		return
 	}
 	s.Lock()
+	if !s.pinned(ip) {
+		s.Unlock()
+		log.Warnf("Not confirming unpinned ip %s for %s", ip, s.hostname)
+		return
+	}
 	// Add is O(N)
 	s.add(ip)
+	prev := s.confirmed
 	s.confirmed = ip
 	s.Unlock()
+	s.notify(prev, ip)
 }
 
 // Disconfirm sets the confirmed address to nil if the current confirmed address
 // is the provided ip.
 func (s *IPSet) Disconfirm(ip net.IP) {
 	s.Lock()
-	if ip.Equal(s.confirmed) {
+	disconfirmed := ip.Equal(s.confirmed)
+	if disconfirmed {
 		s.confirmed = nil
 	}
 	s.Unlock()
+	if disconfirmed {
+		s.notify(ip, nil)
+	}
+}
+
+// Informs the owner's listener, if any, of a change in the confirmed IP,
+// and persists the newly confirmed IP.  Must not be called under Lock.
+func (s *IPSet) notify(prev, next net.IP) {
+	if s.m == nil {
+		return
+	}
+	s.m.remember(s.hostname, next)
+	l := s.m.listener()
+	if l == nil {
+		return
+	}
+	l.OnIPChanged(s.hostname, ipstr(prev), ipstr(next))
+}
+
+func ipstr(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
 }
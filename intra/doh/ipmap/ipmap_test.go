@@ -20,6 +20,9 @@ import (
 	"net"
 	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/kv"
 )
 
 func TestGetTwice(t *testing.T) {
@@ -171,3 +174,190 @@ func TestResolver(t *testing.T) {
 		t.Error("Fake dialer didn't run")
 	}
 }
+
+func TestRanking(t *testing.T) {
+	m := NewIPMap(nil)
+	s := m.Get("example")
+	s.Add("192.0.2.1")
+	s.Add("192.0.2.2")
+	s.Add("192.0.2.3")
+	fast := net.ParseIP("192.0.2.1")
+	slow := net.ParseIP("192.0.2.2")
+	down := net.ParseIP("192.0.2.3")
+
+	s.Succeeded(slow, 500*time.Millisecond)
+	s.Succeeded(fast, 20*time.Millisecond)
+	s.Failed(down)
+	s.Failed(down)
+
+	for i := 0; i < 10; i++ {
+		ips := s.GetAll()
+		if len(ips) != 3 {
+			t.Fatalf("Wrong IP set size %d", len(ips))
+		}
+		if !ips[0].Equal(fast) || !ips[1].Equal(slow) || !ips[2].Equal(down) {
+			t.Fatalf("Wrong order %v", ips)
+		}
+	}
+
+	// A string of failures demotes the fast IP below the slow one.
+	for i := 0; i < 8; i++ {
+		s.Failed(fast)
+	}
+	if ips := s.GetAll(); !ips[0].Equal(slow) {
+		t.Errorf("Failing IP ranked first %v", ips)
+	}
+}
+
+type fakeListener struct {
+	changes []string
+}
+
+func (l *fakeListener) OnIPChanged(hostname, prev, next string) {
+	l.changes = append(l.changes, hostname+","+prev+","+next)
+}
+
+func TestListener(t *testing.T) {
+	m := NewIPMap(nil)
+	l := &fakeListener{}
+	m.SetListener(l)
+	s := m.Of("example", []string{"192.0.2.1", "192.0.2.2"})
+
+	s.Confirm(net.ParseIP("192.0.2.1"))
+	s.Confirm(net.ParseIP("192.0.2.1")) // unchanged, no event
+	s.Confirm(net.ParseIP("192.0.2.2"))
+	s.Disconfirm(net.ParseIP("192.0.2.1")) // not confirmed, no event
+	s.Disconfirm(net.ParseIP("192.0.2.2"))
+
+	want := []string{
+		"example,,192.0.2.1",
+		"example,192.0.2.1,192.0.2.2",
+		"example,192.0.2.2,",
+	}
+	if len(l.changes) != len(want) {
+		t.Fatalf("Wrong events %v", l.changes)
+	}
+	for i := range want {
+		if l.changes[i] != want[i] {
+			t.Errorf("Event %d: got %s, want %s", i, l.changes[i], want[i])
+		}
+	}
+}
+
+func TestPin(t *testing.T) {
+	m := NewIPMap(nil)
+	s := m.Of("example", []string{"192.0.2.1"})
+	s.Confirm(net.ParseIP("192.0.2.1"))
+
+	p, err := m.Pin("example", []string{"192.0.2.9", "bogus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != s {
+		t.Error("Pin should reuse the existing set")
+	}
+	if s.Confirmed() != nil {
+		t.Error("Unpinned IP should be disconfirmed")
+	}
+	ips := s.GetAll()
+	if len(ips) != 1 || ips[0].String() != "192.0.2.9" {
+		t.Errorf("Wrong pinned IPs %v", ips)
+	}
+	s.Confirm(net.ParseIP("192.0.2.1"))
+	if s.Confirmed() != nil {
+		t.Error("Unpinned IP should not be confirmed")
+	}
+
+	m.Unpin("example")
+	if len(s.GetAll()) != 1 || s.GetAll()[0].String() != "192.0.2.1" {
+		t.Errorf("Unpin should restore bootstrap IPs %v", s.GetAll())
+	}
+
+	if _, err := m.Pin("example", []string{"bogus"}); err == nil {
+		t.Error("Expected error pinning no valid IPs")
+	}
+}
+
+func TestPinUnresolved(t *testing.T) {
+	var dialCount int32
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(context context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dialCount, 1)
+			return nil, errors.New("Fake dialer")
+		},
+	}
+	m := NewIPMap(resolver)
+	if _, err := m.Pin("www.google.com", []string{"192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	s := m.Get("www.google.com")
+	if s.Empty() {
+		t.Error("Pinned set should not be empty")
+	}
+	if atomic.LoadInt32(&dialCount) != 0 {
+		t.Error("Pinned hostname should not be resolved")
+	}
+
+	m.Unpin("www.google.com")
+	if _, ok := m.(*ipMap).m["www.google.com"]; ok {
+		t.Error("Unpinned, unresolved hostname should be forgotten")
+	}
+	m.Get("www.google.com")
+	if atomic.LoadInt32(&dialCount) == 0 {
+		t.Error("Unpinned hostname should be resolved")
+	}
+}
+
+func TestStore(t *testing.T) {
+	var dialCount int32
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(context context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dialCount, 1)
+			return nil, errors.New("Fake dialer")
+		},
+	}
+	store := kv.NewMemStore()
+	m := NewIPMap(resolver)
+	m.SetStore(store)
+	s := m.Of("example", []string{"192.0.2.1"})
+	s.Confirm(net.ParseIP("192.0.2.1"))
+	if v, _ := store.Get(kv.IPMap + "example"); string(v) != "192.0.2.1" {
+		t.Errorf("Confirmed ip not persisted %s", v)
+	}
+
+	// A fresh map seeds unresolvable hostnames with the persisted ip.
+	m2 := NewIPMap(resolver)
+	m2.SetStore(store)
+	ips := m2.Get("example").GetAll()
+	if len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("Persisted ip not restored %v", ips)
+	}
+}
+
+func TestReset(t *testing.T) {
+	m := NewIPMap(nil)
+	l := &fakeListener{}
+	m.SetListener(l)
+	// an ip literal resolves to itself, sans the network
+	s := m.Of("192.0.2.7", []string{"192.0.2.1"})
+	s.Add("192.0.2.8")
+	s.Confirm(net.ParseIP("192.0.2.8"))
+	s.Failed(net.ParseIP("192.0.2.1"))
+
+	m.Reset()
+	if s.Confirmed() != nil {
+		t.Error("Confirmed IP not forgotten")
+	}
+	if len(l.changes) != 2 || l.changes[1] != "192.0.2.7,192.0.2.8," {
+		t.Errorf("Wrong events %v", l.changes)
+	}
+	ips := s.GetAll()
+	if len(ips) != 2 || s.has(net.ParseIP("192.0.2.8")) {
+		t.Errorf("Resolved IPs not replaced %v", ips)
+	}
+	if st := s.stats; st != nil {
+		t.Errorf("Stats not forgotten %v", st)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"errors"
+
+	"github.com/celzero/firestack/intra/dnsx"
+)
+
+// SetListenerQueue sets the listener of `t`, a DoH transport, to be called
+// as in TransportBuilder.SetListenerQueue.
+func SetListenerQueue(t Transport, size int) error {
+	dt, ok := dnsx.Unwrap(t).(*transport)
+	if !ok {
+		return errors.New("not a doh transport")
+	}
+	dt.events.SetSize(size)
+	return nil
+}
+
+// notify tells t's listener, if any, of a query, through t's queue of
+// listener calls, and returns the func that tells it of its Summary.  Should
+// the queue drop the call of the query, the listener is told of it just
+// before its Summary.
+func (t *transport) notify() func(*Summary) {
+	l := t.listener
+	if l == nil {
+		return func(*Summary) {}
+	}
+	// token and queried are accessed only by calls of the queue, one at a time
+	var token Token
+	queried := false
+	query := func() {
+		if !queried {
+			queried = true
+			token = l.OnQuery(t.url)
+		}
+	}
+	t.events.Push(query)
+	return func(s *Summary) {
+		// queries, as from gobind, may not be retained past Query
+		s.Query = append([]byte(nil), s.Query...)
+		t.events.Push(func() {
+			query()
+			l.OnResponse(token, s.describe())
+		})
+	}
+}
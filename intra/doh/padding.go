@@ -24,6 +24,8 @@
 package doh
 
 import (
+	"encoding/binary"
+
 	"golang.org/x/net/dns/dnsmessage"
 )
 
@@ -64,8 +66,54 @@ func getPadding(msgLen int) dnsmessage.Option {
 	return optPadding
 }
 
+// kOptRrLen is the length of an OPT RR whose only option is padding, less
+// the padding itself.
+const kOptRrLen int = kOptRrHeaderLen + kOptPaddingHeaderLen
+
+// padWithoutAdditionals pads rawMsg, if it is well-formed, and has no
+// additional records, like most queries, by appending an OPT RR with padding
+// to it as-is, in a single allocation, rather than unpacking and re-packing
+// it.  Reports whether it did.
+func padWithoutAdditionals(rawMsg []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(rawMsg)
+	if err != nil || h.Response {
+		return nil, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return nil, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, false
+	}
+	if _, err := p.AdditionalHeader(); err != dnsmessage.ErrSectionDone {
+		return nil, false
+	}
+	pad := computePaddingSize(len(rawMsg)+kOptRrHeaderLen, PaddingBlockSize)
+	out := make([]byte, len(rawMsg), len(rawMsg)+kOptRrLen+pad)
+	copy(out, rawMsg)
+	binary.BigEndian.PutUint16(out[10:], 1) // ARCOUNT
+	out = append(out,
+		0,     // DOMAIN NAME: root
+		0, 41, // TYPE: OPT
+		0xff, 0xff, // CLASS: udp payload size, 65535
+		0, 0, 0, 0, // TTL: extended rcode and flags
+		byte((kOptPaddingHeaderLen+pad)>>8), byte(kOptPaddingHeaderLen+pad), // RDLEN
+		0, OptResourcePaddingCode, // OPTION-CODE
+		byte(pad>>8), byte(pad), // OPTION-LENGTH
+	)
+	// zeroed, as out was allocated to fit
+	return out[:len(out)+pad], true
+}
+
 // Add EDNS padding, as defined in RFC7830, to a raw DNS message.
 func AddEdnsPadding(rawMsg []byte) ([]byte, error) {
+	if padded, ok := padWithoutAdditionals(rawMsg); ok {
+		return padded, nil
+	}
 	var msg dnsmessage.Message
 	if err := msg.Unpack(rawMsg); err != nil {
 		return nil, err
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/celzero/firestack/intra/diag"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/metrics"
+	"github.com/celzero/firestack/intra/qlog"
+	"github.com/celzero/firestack/intra/schema"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// Default limits of queries accepted over tcp, by Accept.
+const (
+	// defaultInflight is the most queries forwarded at once.
+	defaultInflight = 64
+	// defaultQueued is the most queries waiting to be forwarded; queries
+	// past it are shed.
+	defaultQueued = 256
+)
+
+var errOverloaded = errors.New("too many queries in-flight")
+
+// pool runs tasks on at most `inflight` goroutines at once, and queues up
+// to `queued` more; tasks past those are refused.  A limit <= 0 is no limit.
+type pool struct {
+	sync.Mutex
+	inflight int
+	queued   int
+	running  int
+	tasks    []func()
+}
+
+// queries is the pool the queries of Accept are forwarded from.
+var queries = &pool{inflight: defaultInflight, queued: defaultQueued}
+
+// SetQueryLimits sets the most queries accepted over tcp that are forwarded
+// at once, to `inflight`, and that wait to be, to `queued`; queries past
+// those are answered with SERVFAIL, and reported with status Overloaded.
+// A limit <= 0 is no limit.  The defaults are 64 and 256.
+func SetQueryLimits(inflight int, queued int) {
+	queries.Lock()
+	queries.inflight, queries.queued = inflight, queued
+	queries.Unlock()
+}
+
+// submit runs f, now, or once a goroutine frees up, or else, if too many
+// tasks are queued, reports false.
+func (p *pool) submit(f func()) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.inflight <= 0 || p.running < p.inflight {
+		p.running++
+		diag.Go(diag.DoH, func() {
+			p.run(f)
+		})
+		return true
+	}
+	if p.queued > 0 && len(p.tasks) >= p.queued {
+		return false
+	}
+	p.tasks = append(p.tasks, f)
+	return true
+}
+
+// run runs f, and then the tasks queued, till there are none left.
+func (p *pool) run(f func()) {
+	for f != nil {
+		f()
+		p.Lock()
+		f = nil
+		if len(p.tasks) > 0 && (p.inflight <= 0 || p.running <= p.inflight) {
+			f = p.tasks[0]
+			p.tasks[0] = nil
+			p.tasks = p.tasks[1:]
+		} else {
+			p.running--
+		}
+		p.Unlock()
+	}
+}
+
+// shed answers q, on c, with SERVFAIL, unsent, and reports it to the
+// listener of t, if it's a DoH transport, with status Overloaded.
+func shed(t Transport, q []byte, c io.Writer) {
+	log.Warnf("shed query: %v", errOverloaded)
+	response := tryServfail(q)
+	qlog.Add(q, response, 0, t.GetURL(), "", Overloaded)
+	metrics.Add(metrics.DNSQueries, 1, "transport", "doh", "status", strconv.Itoa(Overloaded))
+	if dt, ok := dnsx.Unwrap(t).(*transport); ok && dt.listener != nil {
+		dt.notify()(&Summary{
+			Version:  schema.DNSSummary,
+			Query:    q,
+			Response: response,
+			Status:   Overloaded,
+		})
+	}
+	if response == nil {
+		return
+	}
+	b := make([]byte, len(response)+2)
+	binary.BigEndian.PutUint16(b, uint16(len(response)))
+	copy(b[2:], response)
+	c.Write(b)
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package doh
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestPool(t *testing.T) {
+	p := &pool{inflight: 1, queued: 1}
+	block := make(chan struct{})
+	ran := make(chan int, 2)
+	if !p.submit(func() { <-block; ran <- 1 }) {
+		t.Fatal("first task refused")
+	}
+	if !p.submit(func() { ran <- 2 }) {
+		t.Fatal("second task not queued")
+	}
+	if p.submit(func() { ran <- 3 }) {
+		t.Fatal("third task not shed")
+	}
+	close(block)
+	if a, b := <-ran, <-ran; a != 1 || b != 2 {
+		t.Errorf("ran %d, %d", a, b)
+	}
+}
+
+// Queries past the limits are answered with SERVFAIL.
+func TestAcceptOverloaded(t *testing.T) {
+	// Other tests leave queries in-flight, forever, in the shared pool.
+	defer func(p *pool) { queries = p }(queries)
+	queries = &pool{}
+	SetQueryLimits(1, 1)
+
+	doh := newFakeTransport()
+	client, server := makePair()
+	defer client.Close()
+	go Accept(doh, server)
+
+	lbuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lbuf, uint16(len(simpleQueryBytes)))
+	for i := 0; i < 3; i++ {
+		if _, err := client.Write(lbuf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(simpleQueryBytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first query is in-flight, the second queued, and the third shed.
+	if _, err := io.ReadFull(client, lbuf); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lbuf))
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("rcode %v", msg.RCode)
+	}
+	<-doh.query
+}
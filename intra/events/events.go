@@ -0,0 +1,145 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package events delivers typed lifecycle and network events, like a DoH
+// transport entering servfail hangover, to a single Listener set by the app,
+// so that it needn't scrape logs for them.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// Types of events.
+const (
+	// TransportSwitched is the dns transport in-use changing to Source.
+	TransportSwitched = iota + 1
+	// HangoverStarted is transport Source entering servfail hangover
+	// on the error in Detail.
+	HangoverStarted
+	// HangoverEnded is transport Source leaving servfail hangover.
+	HangoverEnded
+	// BootstrapResolved is hostname Source being resolved afresh, to the
+	// csv of ips in Detail, or to none, with the error in Detail.
+	BootstrapResolved
+	// TunnelPaused is the tunnel holding back all traffic.
+	TunnelPaused
+	// TunnelResumed is the tunnel letting traffic through again.
+	TunnelResumed
+	// NetstackError is the network stack failing on the error in Detail.
+	NetstackError
+	// KillSwitchEngaged is the kill switch dropping new flows, as upstream
+	// Source, "dns" or "proxy", is unreachable, on the error in Detail.
+	KillSwitchEngaged
+	// KillSwitchReleased is the kill switch letting new flows through again.
+	KillSwitchReleased
+	// PortalDetected is a captive portal found on the network, at the login
+	// url in Source, if known, for the reason in Detail.
+	PortalDetected
+	// PortalModeStarted is dns for the csv of portal domains in Detail going
+	// to the network's resolver, unblocked, till PortalModeEnded.
+	PortalModeStarted
+	// PortalModeEnded is dns for portal domains back as it was.
+	PortalModeEnded
+	// RateLimitStarted is queries to transport Source being refused, unsent,
+	// as they're over its rate limit, in Detail.
+	RateLimitStarted
+	// RateLimitEnded is queries to transport Source being sent again.
+	RateLimitEnded
+)
+
+var names = map[int]string{
+	TransportSwitched:  "transport-switched",
+	HangoverStarted:    "hangover-started",
+	HangoverEnded:      "hangover-ended",
+	BootstrapResolved:  "bootstrap-resolved",
+	TunnelPaused:       "tunnel-paused",
+	TunnelResumed:      "tunnel-resumed",
+	NetstackError:      "netstack-error",
+	KillSwitchEngaged:  "killswitch-engaged",
+	KillSwitchReleased: "killswitch-released",
+	PortalDetected:     "portal-detected",
+	PortalModeStarted:  "portal-mode-started",
+	PortalModeEnded:    "portal-mode-ended",
+	RateLimitStarted:   "rate-limit-started",
+	RateLimitEnded:     "rate-limit-ended",
+}
+
+// Name returns the name of event type `typ`, or "" if it is unknown.
+func Name(typ int) string {
+	return names[typ]
+}
+
+// Event is a lifecycle or network event.
+type Event struct {
+	Type   int    // One of the types of events.
+	Source string // What the event is about, like the url of a transport.
+	Detail string // More about the event, if anything, like an error.
+	Time   int64  // When the event occurred, in millis since the epoch.
+}
+
+// Listener receives events, one at a time, in the order they occurred.
+type Listener interface {
+	OnEvent(*Event)
+}
+
+// pending is the most events held for delivery; events past it are dropped.
+const pending = 64
+
+var (
+	mu       sync.RWMutex
+	listener Listener
+	queue    = make(chan *Event, pending)
+	start    sync.Once
+)
+
+// SetListener sets `l` to receive events; nil unsets.
+func SetListener(l Listener) {
+	mu.Lock()
+	listener = l
+	mu.Unlock()
+	if l != nil {
+		start.Do(func() {
+			go deliver()
+		})
+	}
+}
+
+func current() Listener {
+	mu.RLock()
+	defer mu.RUnlock()
+	return listener
+}
+
+func deliver() {
+	for e := range queue {
+		if l := current(); l != nil {
+			l.OnEvent(e)
+		}
+	}
+}
+
+// Publish sends an event of type `typ` about `source` to the Listener.
+// It never blocks: events are dropped if the Listener falls behind.
+func Publish(typ int, source string, detail string) {
+	if current() == nil {
+		return
+	}
+	e := &Event{
+		Type:   typ,
+		Source: source,
+		Detail: detail,
+		Time:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	select {
+	case queue <- e:
+	default:
+		log.Debugf("events: dropped %s for %s", Name(typ), source)
+	}
+}
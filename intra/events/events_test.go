@@ -0,0 +1,52 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+type recorder chan *Event
+
+func (r recorder) OnEvent(e *Event) {
+	r <- e
+}
+
+func TestPublish(t *testing.T) {
+	// dropped, with no listener
+	Publish(NetstackError, "netstack", "eof")
+
+	r := make(recorder, 4)
+	SetListener(r)
+	defer SetListener(nil)
+
+	Publish(HangoverStarted, "https://a.example/dns-query", "http 500")
+	Publish(HangoverEnded, "https://a.example/dns-query", "")
+
+	for _, want := range []int{HangoverStarted, HangoverEnded} {
+		select {
+		case e := <-r:
+			if e.Type != want || e.Source != "https://a.example/dns-query" || e.Time <= 0 {
+				t.Errorf("Wrong event %+v, want type %s", e, Name(want))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Missing %s", Name(want))
+		}
+	}
+	select {
+	case e := <-r:
+		t.Errorf("Unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestName(t *testing.T) {
+	if Name(TunnelPaused) != "tunnel-paused" || Name(0) != "" {
+		t.Error("Wrong names")
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package faults injects artificial DNS latency, packet loss, proxy failures,
+// and servfail hangovers so that apps can exercise their degraded-state UI.
+//
+// Faults are compiled in only with the "faults" build tag (debug builds);
+// otherwise, every hook is a no-op and every control call fails.
+package faults
+
+import "errors"
+
+// errDisabled is returned by control calls when faults aren't compiled in.
+var errDisabled = errors.New("faults: not compiled in, build with -tags faults")
+
+// errProxy is the error reported by dials failed on purpose.
+var errProxy = errors.New("faults: simulated proxy failure")
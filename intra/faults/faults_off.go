@@ -0,0 +1,62 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !faults
+// +build !faults
+
+package faults
+
+import "time"
+
+// Enabled reports whether faults are compiled in.
+func Enabled() bool {
+	return false
+}
+
+// SetDNSLatency delays every DNS query by `ms` milliseconds.
+func SetDNSLatency(ms int) error {
+	return errDisabled
+}
+
+// SetPacketLoss drops `percent` of tunneled UDP packets.
+func SetPacketLoss(percent int) error {
+	return errDisabled
+}
+
+// SetProxyFailure fails all proxy dials when `fail` is true.
+func SetProxyFailure(fail bool) error {
+	return errDisabled
+}
+
+// SetHangover forces DoH transports into servfail hangover when `on` is true.
+func SetHangover(on bool) error {
+	return errDisabled
+}
+
+// Reset clears all faults.
+func Reset() error {
+	return errDisabled
+}
+
+// DNSLatency returns the artificial delay to add to a DNS query.
+func DNSLatency() time.Duration {
+	return 0
+}
+
+// DropPacket reports whether the current packet must be dropped.
+func DropPacket() bool {
+	return false
+}
+
+// ProxyFailure returns a non-nil error if a proxy dial must fail.
+func ProxyFailure() error {
+	return nil
+}
+
+// InHangover reports whether a servfail hangover is being simulated.
+func InHangover() bool {
+	return false
+}
@@ -0,0 +1,27 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !faults
+// +build !faults
+
+package faults
+
+import "testing"
+
+func TestFaultsDisabled(t *testing.T) {
+	if Enabled() {
+		t.Fatal("enabled")
+	}
+	if err := SetPacketLoss(100); err != errDisabled {
+		t.Errorf("packet loss set: %v", err)
+	}
+	if err := SetProxyFailure(true); err != errDisabled {
+		t.Errorf("proxy failure set: %v", err)
+	}
+	if DropPacket() || ProxyFailure() != nil || InHangover() || DNSLatency() != 0 {
+		t.Error("fault injected")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build faults
+// +build faults
+
+package faults
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type faults struct {
+	sync.RWMutex
+	dnsLatency time.Duration
+	packetLoss int // percent
+	proxyFail  bool
+	hangover   bool
+}
+
+var f = &faults{}
+
+// Enabled reports whether faults are compiled in.
+func Enabled() bool {
+	return true
+}
+
+// SetDNSLatency delays every DNS query by `ms` milliseconds.
+func SetDNSLatency(ms int) error {
+	if ms < 0 {
+		return fmt.Errorf("faults: negative latency %d", ms)
+	}
+	f.Lock()
+	f.dnsLatency = time.Duration(ms) * time.Millisecond
+	f.Unlock()
+	return nil
+}
+
+// SetPacketLoss drops `percent` of tunneled UDP packets.
+func SetPacketLoss(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("faults: packet loss %d not in [0, 100]", percent)
+	}
+	f.Lock()
+	f.packetLoss = percent
+	f.Unlock()
+	return nil
+}
+
+// SetProxyFailure fails all proxy dials when `fail` is true.
+func SetProxyFailure(fail bool) error {
+	f.Lock()
+	f.proxyFail = fail
+	f.Unlock()
+	return nil
+}
+
+// SetHangover forces DoH transports into servfail hangover when `on` is true.
+func SetHangover(on bool) error {
+	f.Lock()
+	f.hangover = on
+	f.Unlock()
+	return nil
+}
+
+// Reset clears all faults.
+func Reset() error {
+	f.Lock()
+	f.dnsLatency = 0
+	f.packetLoss = 0
+	f.proxyFail = false
+	f.hangover = false
+	f.Unlock()
+	return nil
+}
+
+// DNSLatency returns the artificial delay to add to a DNS query.
+func DNSLatency() time.Duration {
+	f.RLock()
+	defer f.RUnlock()
+	return f.dnsLatency
+}
+
+// DropPacket reports whether the current packet must be dropped.
+func DropPacket() bool {
+	f.RLock()
+	p := f.packetLoss
+	f.RUnlock()
+	return p > 0 && rand.Intn(100) < p
+}
+
+// ProxyFailure returns a non-nil error if a proxy dial must fail.
+func ProxyFailure() error {
+	f.RLock()
+	defer f.RUnlock()
+	if f.proxyFail {
+		return errProxy
+	}
+	return nil
+}
+
+// InHangover reports whether a servfail hangover is being simulated.
+func InHangover() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.hangover
+}
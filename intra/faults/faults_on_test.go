@@ -0,0 +1,70 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build faults
+// +build faults
+
+package faults
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaultsFire(t *testing.T) {
+	defer Reset()
+	if !Enabled() {
+		t.Fatal("not enabled")
+	}
+	if err := SetDNSLatency(25); err != nil {
+		t.Fatal(err)
+	}
+	if d := DNSLatency(); d != 25*time.Millisecond {
+		t.Errorf("latency %v", d)
+	}
+	if err := SetPacketLoss(100); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if !DropPacket() {
+			t.Fatal("packet kept at 100% loss")
+		}
+	}
+	if err := SetProxyFailure(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ProxyFailure(); err != errProxy {
+		t.Errorf("proxy failure %v", err)
+	}
+	if err := SetHangover(true); err != nil {
+		t.Fatal(err)
+	}
+	if !InHangover() {
+		t.Error("no hangover")
+	}
+
+	if err := Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if DNSLatency() != 0 || DropPacket() || ProxyFailure() != nil || InHangover() {
+		t.Error("faults left after reset")
+	}
+}
+
+func TestFaultsBounds(t *testing.T) {
+	defer Reset()
+	if err := SetDNSLatency(-1); err == nil {
+		t.Error("negative latency set")
+	}
+	for _, p := range []int{-1, 101} {
+		if err := SetPacketLoss(p); err == nil {
+			t.Errorf("packet loss %d set", p)
+		}
+	}
+	if DNSLatency() != 0 || DropPacket() {
+		t.Error("bad faults injected")
+	}
+}
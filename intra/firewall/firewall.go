@@ -0,0 +1,833 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package firewall allows or denies new tcp and udp flows through the tunnel
+// by rules on their destination ip or cidr, country, port, protocol, and
+// domain, and routes them to outbounds, and limits their rate, by rules of
+// the same form.
+// Domains of flows are known from the dns answers, seen through Observe,
+// that resolved to their destination ip, by whichever resolver answered.
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/geoip"
+	"github.com/celzero/firestack/intra/outbound"
+	"github.com/celzero/firestack/intra/throttle"
+)
+
+// Verdicts on flows.
+const (
+	// None is no rule matching a flow, which is then up to the Blocker.
+	None = 0
+	// Allow is a flow allowed by a rule.
+	Allow = 1
+	// Deny is a flow denied by a rule.
+	Deny = 2
+)
+
+// Protocols of flows, as IP protocol numbers.
+const (
+	TCP = 6
+	UDP = 17
+)
+
+// Kinds of networks, as set with SetNetwork and matched by rules with net:.
+const (
+	NetworkWifi     = "wifi"
+	NetworkCellular = "cellular"
+	NetworkEthernet = "ethernet"
+)
+
+// rule is one of:
+// allow|deny|route:<outbound>|limit:<kbps> tcp|udp|* <ip|cidr|domain|list:<name>|geo:<country>|*> [<port|port-port>[,...]|*] [uid:<uid>] [net:[!]<network>]
+// Domains match themselves, and if prefixed with "*.", their subdomains too,
+// at ips they're known to be at, from dns answers observed; routes and
+// limits on domains also match flows that tell their names, see OutboundOf.
+// Lists match the domains of the domain list of that name, as set with
+// SetDomainList, and their subdomains, as domains do.
+// Countries, as ISO 3166-1 codes like "IN", match ips in them, as told by
+// the GeoIP database loaded with LoadGeoIP, if any.
+// Rules with uid: match flows of that app alone, and rules with net: only
+// when the network in-use is (or with !, is not) of that kind.
+// Routes, rules with route:, decide the outbound of flows and not verdicts.
+// Limits, rules with limit:, cap the rate of all the flows they match,
+// together, to kbps kilobits per second, each way.
+type rule struct {
+	verdict  int
+	outbound string           // of routes
+	up       *throttle.Bucket // of limits, for bytes sent
+	down     *throttle.Bucket // of limits, for bytes received
+	proto    int32            // 0 for any
+	ipnet    *net.IPNet
+	domain   string // canonical, without "*."
+	sub      bool   // whether subdomains of domain match
+	list     string // of domain lists, lower case
+	country  string // upper case
+	ports    [][2]int
+	hasUID   bool
+	uid      int
+	network  string
+	notnet   bool // whether network must not be in-use, instead
+}
+
+func parseVerdict(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	}
+	return None, fmt.Errorf("unknown verdict %s", s)
+}
+
+func parseProto(s string) (int32, error) {
+	switch strings.ToLower(s) {
+	case "*":
+		return 0, nil
+	case "tcp":
+		return TCP, nil
+	case "udp":
+		return UDP, nil
+	}
+	return 0, fmt.Errorf("unknown protocol %s", s)
+}
+
+func parsePorts(s string) ([][2]int, error) {
+	if s == "*" {
+		return nil, nil
+	}
+	var ports [][2]int
+	for _, p := range strings.Split(s, ",") {
+		lo, hi := p, p
+		if i := strings.Index(p, "-"); i > 0 {
+			lo, hi = p[:i], p[i+1:]
+		}
+		from, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, err
+		}
+		to, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, err
+		}
+		if from < 0 || to > 65535 || from > to {
+			return nil, fmt.Errorf("bad port range %s", p)
+		}
+		ports = append(ports, [2]int{from, to})
+	}
+	return ports, nil
+}
+
+// parseCIDR parses s, a cidr or an ip, into a cidr.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("bad cidr %s", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// newRule parses s into a rule.
+func newRule(s string) (*rule, error) {
+	f := strings.Fields(s)
+	if len(f) < 3 || len(f) > 6 {
+		return nil, fmt.Errorf("rule %q not of the form: verdict proto dest [ports] [uid:] [net:]", s)
+	}
+	r := &rule{}
+	f, err := r.parseQualifiers(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(f) < 3 || len(f) > 4 {
+		return nil, fmt.Errorf("rule %q not of the form: verdict proto dest [ports] [uid:] [net:]", s)
+	}
+	if lv := strings.ToLower(f[0]); strings.HasPrefix(lv, "route:") {
+		if r.outbound = f[0][len("route:"):]; len(r.outbound) == 0 {
+			return nil, fmt.Errorf("route %q without an outbound", s)
+		}
+	} else if strings.HasPrefix(lv, "limit:") {
+		kbps, err := strconv.Atoi(f[0][len("limit:"):])
+		if err != nil || kbps <= 0 {
+			return nil, fmt.Errorf("limit %q without a rate", s)
+		}
+		r.up, r.down = throttle.NewBucket(kbps), throttle.NewBucket(kbps)
+	} else if r.verdict, err = parseVerdict(f[0]); err != nil {
+		return nil, err
+	}
+	if r.proto, err = parseProto(f[1]); err != nil {
+		return nil, err
+	}
+	dest := f[2]
+	if dest == "*" {
+		// any destination
+	} else if strings.HasPrefix(strings.ToLower(dest), "geo:") {
+		if r.country = strings.ToUpper(dest[len("geo:"):]); len(r.country) != 2 {
+			return nil, fmt.Errorf("bad country %s", dest)
+		}
+	} else if strings.HasPrefix(strings.ToLower(dest), "list:") {
+		if r.list = strings.ToLower(dest[len("list:"):]); len(r.list) == 0 {
+			return nil, fmt.Errorf("bad list %s", dest)
+		}
+	} else if ipnet, err := parseCIDR(dest); err == nil {
+		r.ipnet = ipnet
+	} else {
+		if strings.HasPrefix(dest, "*.") {
+			r.sub = true
+			dest = dest[2:]
+		}
+		if _, ok := dns.IsDomainName(dest); !ok || strings.ContainsAny(dest, "*/") {
+			return nil, fmt.Errorf("bad destination %s", f[2])
+		}
+		r.domain = dns.CanonicalName(dest)
+	}
+	if len(f) == 4 {
+		if r.ports, err = parsePorts(f[3]); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// parseQualifiers sets the uid: and net: qualifiers in f on r, and returns
+// the rest of f.
+func (r *rule) parseQualifiers(f []string) ([]string, error) {
+	rest := f[:0:0]
+	for _, v := range f {
+		lv := strings.ToLower(v)
+		if strings.HasPrefix(lv, "uid:") {
+			uid, err := strconv.Atoi(v[4:])
+			if err != nil || r.hasUID {
+				return nil, fmt.Errorf("bad qualifier %s", v)
+			}
+			r.hasUID, r.uid = true, uid
+		} else if strings.HasPrefix(lv, "net:") {
+			n := lv[4:]
+			if strings.HasPrefix(n, "!") {
+				r.notnet = true
+				n = n[1:]
+			}
+			if len(n) == 0 || len(r.network) > 0 {
+				return nil, fmt.Errorf("bad qualifier %s", v)
+			}
+			r.network = n
+		} else {
+			rest = append(rest, v)
+		}
+	}
+	return rest, nil
+}
+
+// String returns r in the canonical form of its rule.
+func (r *rule) String() string {
+	v := "allow"
+	if len(r.outbound) > 0 {
+		v = "route:" + r.outbound
+	} else if r.up != nil {
+		v = "limit:" + strconv.Itoa(r.up.Kbps())
+	} else if r.verdict == Deny {
+		v = "deny"
+	}
+	proto := "*"
+	if r.proto == TCP {
+		proto = "tcp"
+	} else if r.proto == UDP {
+		proto = "udp"
+	}
+	dest := "*"
+	if r.ipnet != nil {
+		dest = r.ipnet.String()
+	} else if len(r.country) > 0 {
+		dest = "geo:" + r.country
+	} else if len(r.list) > 0 {
+		dest = "list:" + r.list
+	} else if len(r.domain) > 0 {
+		dest = strings.TrimSuffix(r.domain, ".")
+		if r.sub {
+			dest = "*." + dest
+		}
+	}
+	ports := "*"
+	if len(r.ports) > 0 {
+		p := make([]string, len(r.ports))
+		for i, pr := range r.ports {
+			p[i] = strconv.Itoa(pr[0])
+			if pr[1] != pr[0] {
+				p[i] += "-" + strconv.Itoa(pr[1])
+			}
+		}
+		ports = strings.Join(p, ",")
+	}
+	f := []string{v, proto, dest, ports}
+	if r.hasUID {
+		f = append(f, "uid:"+strconv.Itoa(r.uid))
+	}
+	if len(r.network) > 0 {
+		n := "net:"
+		if r.notnet {
+			n += "!"
+		}
+		f = append(f, n+r.network)
+	}
+	return strings.Join(f, " ")
+}
+
+func (r *rule) matchesName(name string) bool {
+	if name == r.domain {
+		return true
+	}
+	return r.sub && strings.HasSuffix(name, "."+r.domain)
+}
+
+// matches reports whether r applies to a flow of proto, from app uid, to
+// ip:port, whose ip is known to be that of names, and in country, on network,
+// with domain lists `lists`.
+func (r *rule) matches(proto int32, uid int, ip net.IP, port int, names func() []string, country func() string, network string, lists map[string]domainList) bool {
+	if r.proto != 0 && r.proto != proto {
+		return false
+	}
+	if r.hasUID && r.uid != uid {
+		return false
+	}
+	if len(r.network) > 0 && (r.network == network) == r.notnet {
+		return false
+	}
+	if len(r.ports) > 0 {
+		in := false
+		for _, pr := range r.ports {
+			if port >= pr[0] && port <= pr[1] {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	if r.ipnet != nil {
+		return r.ipnet.Contains(ip)
+	}
+	if len(r.country) > 0 {
+		return r.country == country()
+	}
+	if len(r.domain) > 0 {
+		for _, n := range names() {
+			if r.matchesName(n) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(r.list) > 0 {
+		l := lists[r.list]
+		if len(l) == 0 {
+			return false
+		}
+		for _, n := range names() {
+			if l.has(n) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// domainList is a set of canonical domains.
+type domainList map[string]bool
+
+// has reports whether name, canonical, or a domain it is under, is in l.
+func (l domainList) has(name string) bool {
+	for {
+		if l[name] {
+			return true
+		}
+		i := strings.Index(name, ".")
+		if i < 0 || i == len(name)-1 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// Firewall allows or denies flows by the first of its rules that matches.
+type Firewall struct {
+	sync.RWMutex
+	rules   []*rule
+	bypass  []*net.IPNet
+	geo     *geoip.DB
+	names   *nameStore
+	network string
+	lists   map[string]domainList
+}
+
+// NewFirewall returns a Firewall without any rules.
+func NewFirewall() *Firewall {
+	return &Firewall{names: newNameStore()}
+}
+
+// Add appends `rule`, of the form "verdict proto dest [ports]", as in
+// "deny udp 10.0.0.0/8 53", "allow tcp *.example.com 80,443",
+// "deny * * 6881-6889", "route:work tcp *.corp.example 443", or
+// "limit:1000 * * * uid:10010", to the rules; each rule is added only once.
+func (f *Firewall) Add(rule string) error {
+	r, err := newRule(rule)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	for _, old := range f.rules {
+		if old.String() == r.String() {
+			return nil
+		}
+	}
+	f.rules = append(f.rules, r)
+	return nil
+}
+
+// Insert is like Add, but puts rule `s` ahead of all others, or moves it there.
+func (f *Firewall) Insert(s string) error {
+	r, err := newRule(s)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.removeLocked(r)
+	f.rules = append([]*rule{r}, f.rules...)
+	return nil
+}
+
+// Remove removes `rule`, and reports whether it was one of the rules.
+func (f *Firewall) Remove(rule string) bool {
+	r, err := newRule(rule)
+	if err != nil {
+		return false
+	}
+	f.Lock()
+	defer f.Unlock()
+	return f.removeLocked(r)
+}
+
+// Must be called under Lock.
+func (f *Firewall) removeLocked(r *rule) bool {
+	for i, old := range f.rules {
+		if old.String() == r.String() {
+			f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func appRule(uid int) string {
+	return "deny * * * uid:" + strconv.Itoa(uid)
+}
+
+func wifiOnlyRule(uid int) string {
+	return appRule(uid) + " net:!" + NetworkWifi
+}
+
+// BlockApp denies all flows of app `uid`, ahead of all other rules; or
+// undoes that, if `block` is false.
+func (f *Firewall) BlockApp(uid int, block bool) {
+	if block {
+		f.Insert(appRule(uid))
+	} else {
+		f.Remove(appRule(uid))
+	}
+}
+
+// WifiOnly denies all flows of app `uid` on networks other than wifi,
+// ahead of all other rules; or undoes that, if `only` is false.
+func (f *Firewall) WifiOnly(uid int, only bool) {
+	if only {
+		f.Insert(wifiOnlyRule(uid))
+	} else {
+		f.Remove(wifiOnlyRule(uid))
+	}
+}
+
+// SetNetwork sets the kind of network in-use, like NetworkWifi, for rules
+// with net: qualifiers; "" is a network of unknown kind.
+func (f *Firewall) SetNetwork(kind string) {
+	f.Lock()
+	f.network = strings.ToLower(kind)
+	f.Unlock()
+}
+
+// Load replaces all rules with `rules`, one per line; blank lines and
+// lines beginning with # are skipped.
+func (f *Firewall) Load(rules string) error {
+	var parsed []*rule
+	for _, line := range strings.Split(rules, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := newRule(line)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, r)
+	}
+	f.Lock()
+	f.rules = parsed
+	f.Unlock()
+	return nil
+}
+
+// Clear removes all rules.
+func (f *Firewall) Clear() {
+	f.Lock()
+	f.rules = nil
+	f.Unlock()
+}
+
+// Rules returns the rules, one per line, in the order they are matched.
+func (f *Firewall) Rules() string {
+	f.RLock()
+	defer f.RUnlock()
+	s := make([]string, len(f.rules))
+	for i, r := range f.rules {
+		s[i] = r.String()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Verdict returns the verdict of the first rule that matches a flow of
+// `proto` from app `uid` (-1 if unknown) to ip:port, or None if no rule
+// does, or f is nil.
+func (f *Firewall) Verdict(proto int32, uid int, ip net.IP, port int) int {
+	if r := f.first(kindVerdict, proto, uid, ip, port, ""); r != nil {
+		return r.verdict
+	}
+	return None
+}
+
+// Outbound returns the outbound of the first route that matches a flow of
+// `proto` from app `uid` (-1 if unknown) to ip:port, or "" if no route
+// does, or f is nil; or outbound.Direct, ahead of all routes, if ip is
+// bypassed.
+func (f *Firewall) Outbound(proto int32, uid int, ip net.IP, port int) string {
+	return f.OutboundOf(proto, uid, ip, port, "")
+}
+
+// OutboundOf is like Outbound, but for a flow to `name` at ip:port, as told
+// by the flow itself, say, by its TLS SNI or HTTP Host; routes on domains
+// match name alone, rather than the names ip is known by, unless it's "".
+func (f *Firewall) OutboundOf(proto int32, uid int, ip net.IP, port int, name string) string {
+	if f.Bypassed(ip) {
+		return outbound.Direct
+	}
+	if r := f.first(kindRoute, proto, uid, ip, port, name); r != nil {
+		return r.outbound
+	}
+	return ""
+}
+
+// Limit returns the buckets that bytes sent (up) and received (down) by a
+// flow of `proto` from app `uid` (-1 if unknown) to ip:port are taken from,
+// of the first limit that matches it, or nil buckets if no limit does, or f
+// is nil.
+func (f *Firewall) Limit(proto int32, uid int, ip net.IP, port int) (up *throttle.Bucket, down *throttle.Bucket) {
+	return f.LimitOf(proto, uid, ip, port, "")
+}
+
+// LimitOf is like Limit, but for a flow to `name` at ip:port, as with
+// OutboundOf.
+func (f *Firewall) LimitOf(proto int32, uid int, ip net.IP, port int, name string) (up *throttle.Bucket, down *throttle.Bucket) {
+	if r := f.first(kindLimit, proto, uid, ip, port, name); r != nil {
+		return r.up, r.down
+	}
+	return nil, nil
+}
+
+// SetBypass sets destinations, `cidrs`, a csv of ips and cidrs, like
+// "10.0.0.0/8,fe80::/10,192.0.2.1", that flows to go directly to, bypassing
+// routes and the proxy in-use, if any; say, those of the LAN.  An empty
+// `cidrs` bypasses none.
+func (f *Firewall) SetBypass(cidrs string) error {
+	var bypass []*net.IPNet
+	for _, s := range strings.Split(cidrs, ",") {
+		if s = strings.TrimSpace(s); len(s) == 0 {
+			continue
+		}
+		ipnet, err := parseCIDR(s)
+		if err != nil {
+			return err
+		}
+		bypass = append(bypass, ipnet)
+	}
+	f.Lock()
+	f.bypass = bypass
+	f.Unlock()
+	return nil
+}
+
+// Bypass returns the csv of cidrs set with SetBypass.
+func (f *Firewall) Bypass() string {
+	f.RLock()
+	defer f.RUnlock()
+	s := make([]string, len(f.bypass))
+	for i, ipnet := range f.bypass {
+		s[i] = ipnet.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// Bypassed reports whether flows to ip bypass routes and the proxy.
+func (f *Firewall) Bypassed(ip net.IP) bool {
+	if f == nil || ip == nil {
+		return false
+	}
+	f.RLock()
+	defer f.RUnlock()
+	for _, ipnet := range f.bypass {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRoutes reports whether any of the rules are routes, or any
+// destinations are bypassed.
+func (f *Firewall) HasRoutes() bool {
+	if f == nil {
+		return false
+	}
+	f.RLock()
+	defer f.RUnlock()
+	if len(f.bypass) > 0 {
+		return true
+	}
+	for _, r := range f.rules {
+		if len(r.outbound) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutesDomains reports whether any route or limit is on a domain, for
+// which names of flows are worth sniffing, to pass to OutboundOf and LimitOf.
+func (f *Firewall) RoutesDomains() bool {
+	if f == nil {
+		return false
+	}
+	f.RLock()
+	defer f.RUnlock()
+	for _, r := range f.rules {
+		if r.kind() != kindVerdict && (len(r.domain) > 0 || len(r.list) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// Kinds of rules.
+const (
+	kindVerdict = iota
+	kindRoute
+	kindLimit
+)
+
+func (r *rule) kind() int {
+	if len(r.outbound) > 0 {
+		return kindRoute
+	} else if r.up != nil {
+		return kindLimit
+	}
+	return kindVerdict
+}
+
+// first returns the first rule of `kind` that matches a flow, to `name` if
+// known, or nil.
+func (f *Firewall) first(kind int, proto int32, uid int, ip net.IP, port int, name string) *rule {
+	if f == nil {
+		return nil
+	}
+	var names []string
+	looked := false
+	if len(name) > 0 {
+		names, looked = []string{dns.CanonicalName(name)}, true
+	}
+	lookup := func() []string {
+		if !looked {
+			names, looked = f.names.get(ip), true
+		}
+		return names
+	}
+	cc, located := "", false
+	locate := func() string {
+		if !located {
+			cc, located = f.geo.Country(ip), true
+		}
+		return cc
+	}
+	f.RLock()
+	defer f.RUnlock()
+	for _, r := range f.rules {
+		if r.kind() != kind {
+			continue
+		}
+		if r.matches(proto, uid, ip, port, lookup, locate, f.network, f.lists) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Check returns the verdict on a flow of `proto` from app `uid` to
+// `target`, an ip:port.
+func (f *Firewall) Check(proto int32, uid int, target string) (int, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return None, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return None, errors.New("target not an ip:port")
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return None, err
+	}
+	return f.Verdict(proto, uid, ip, p), nil
+}
+
+// Observe notes the ips in the dns answer `res`, for rules on domains.
+func (f *Firewall) Observe(res []byte) {
+	if f == nil {
+		return
+	}
+	f.names.observe(res)
+}
+
+// LoadGeoIP loads the GeoIP database, an mmdb file like GeoLite2-Country,
+// at `path`, for rules on countries, in place of the one loaded before, if
+// any; an empty `path` unloads it.
+func (f *Firewall) LoadGeoIP(path string) error {
+	var db *geoip.DB
+	if len(path) > 0 {
+		var err error
+		if db, err = geoip.Open(path); err != nil {
+			return err
+		}
+	}
+	f.Lock()
+	f.geo = db
+	f.Unlock()
+	return nil
+}
+
+// Country returns the country of `ip`, as told by the GeoIP database, or
+// "" if it's unknown, or none is loaded.
+func (f *Firewall) Country(ip string) string {
+	f.RLock()
+	geo := f.geo
+	f.RUnlock()
+	return geo.Country(net.ParseIP(ip))
+}
+
+// Note notes that `ip` is known by `name`, for rules on domains, as if from
+// an answer observed; say, as the real ip of a fake ip handed out for name.
+func (f *Firewall) Note(ip net.IP, name string) {
+	if f == nil || ip == nil || len(name) == 0 {
+		return
+	}
+	f.names.note(ip, name)
+}
+
+// SetDomainList sets domain list `name`, for rules on list:<name>, to
+// `domains`, separated by commas or newlines; empty `domains` removes it.
+// A domain prefixed with "*." is the same as one without.
+func (f *Firewall) SetDomainList(name string, domains string) error {
+	name = strings.ToLower(name)
+	if len(name) == 0 || strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("bad list name %q", name)
+	}
+	l := make(domainList)
+	for _, d := range strings.FieldsFunc(domains, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		d = strings.TrimPrefix(strings.TrimSpace(d), "*.")
+		if len(d) == 0 || strings.HasPrefix(d, "#") {
+			continue
+		}
+		if _, ok := dns.IsDomainName(d); !ok || strings.ContainsAny(d, "*/ ") {
+			return fmt.Errorf("list %s: bad domain %s", name, d)
+		}
+		l[dns.CanonicalName(d)] = true
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.lists == nil {
+		f.lists = make(map[string]domainList)
+	}
+	if len(l) == 0 {
+		delete(f.lists, name)
+	} else {
+		f.lists[name] = l
+	}
+	return nil
+}
+
+// Names returns the csv of names `ip` is known by, from answers observed.
+func (f *Firewall) Names(ip string) string {
+	if f == nil {
+		return ""
+	}
+	names := f.names.get(net.ParseIP(ip))
+	for i, n := range names {
+		names[i] = strings.TrimSuffix(n, ".")
+	}
+	return strings.Join(names, ",")
+}
+
+// observer is a Transport whose answers a Firewall observes.
+type observer struct {
+	dnsx.Transport
+	f *Firewall
+}
+
+// Observing returns a Transport that answers as `t` does, for f to Observe.
+func (f *Firewall) Observing(t dnsx.Transport) dnsx.Transport {
+	if f == nil || t == nil {
+		return t
+	}
+	return &observer{Transport: t, f: f}
+}
+
+// Inner implements dnsx.Wrapper.
+func (o *observer) Inner() dnsx.Transport {
+	return o.Transport
+}
+
+// Query implements dnsx.Transport.
+func (o *observer) Query(q []byte) ([]byte, error) {
+	res, err := o.Transport.Query(q)
+	if err == nil {
+		o.f.Observe(res)
+	}
+	return res, err
+}
@@ -0,0 +1,413 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func answer(t *testing.T, name string, cname string, ip string) []byte {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	msg.Response = true
+	owner := name
+	if len(cname) > 0 {
+		msg.Answer = append(msg.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: cname,
+		})
+		owner = cname
+	}
+	msg.Answer = append(msg.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip),
+	})
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRules(t *testing.T) {
+	f := NewFirewall()
+	for _, r := range []string{
+		"allow tcp 10.1.0.0/16 443",
+		"deny * 10.0.0.0/8",
+		"deny udp * 6881-6889,53",
+		"deny tcp 2001:db8::1 *",
+		"allow * *.example.com 80,443",
+		"deny * example.com",
+	} {
+		if err := f.Add(r); err != nil {
+			t.Fatalf("%s: %v", r, err)
+		}
+	}
+	// re-adds are no-ops
+	f.Add("deny * 10.0.0.0/8 *")
+
+	cases := []struct {
+		proto  int32
+		target string
+		want   int
+	}{
+		{TCP, "10.1.2.3:443", Allow},
+		{UDP, "10.1.2.3:443", Deny},
+		{TCP, "10.2.2.3:80", Deny},
+		{UDP, "1.1.1.1:6885", Deny},
+		{UDP, "1.1.1.1:53", Deny},
+		{TCP, "1.1.1.1:53", None},
+		{TCP, "[2001:db8::1]:22", Deny},
+		{TCP, "93.184.216.34:443", None},
+	}
+	for _, c := range cases {
+		if v, err := f.Check(c.proto, -1, c.target); err != nil || v != c.want {
+			t.Errorf("%d %s: got %d %v, want %d", c.proto, c.target, v, err, c.want)
+		}
+	}
+
+	f.Observe(answer(t, "www.example.com.", "cdn.example.net.", "93.184.216.34"))
+	f.Observe(answer(t, "example.com.", "", "93.184.216.35"))
+	if v, _ := f.Check(TCP, -1, "93.184.216.34:443"); v != Allow {
+		t.Errorf("www.example.com via cname: got %d, want allow", v)
+	}
+	if v, _ := f.Check(TCP, -1, "93.184.216.34:22"); v != None {
+		t.Errorf("www.example.com on 22: got %d, want none", v)
+	}
+	// *.example.com matches example.com too, before the deny
+	if v, _ := f.Check(TCP, -1, "93.184.216.35:443"); v != Allow {
+		t.Errorf("example.com: got %d, want allow", v)
+	}
+	if v, _ := f.Check(UDP, -1, "93.184.216.35:4000"); v != Deny {
+		t.Errorf("example.com on 4000: got %d, want deny", v)
+	}
+	if n := f.Names("93.184.216.34"); n != "cdn.example.net,www.example.com" {
+		t.Errorf("Wrong names %s", n)
+	}
+	f.Note(net.ParseIP("192.0.2.1"), "www.example.com")
+	if v, _ := f.Check(TCP, -1, "192.0.2.1:443"); v != Allow {
+		t.Errorf("noted www.example.com: got %d, want allow", v)
+	}
+
+	if !f.Remove("deny udp * 6881-6889,53") {
+		t.Error("Rule not removed")
+	}
+	if v, _ := f.Check(UDP, -1, "1.1.1.1:53"); v != None {
+		t.Errorf("Removed rule applied: %d", v)
+	}
+}
+
+func TestBadRules(t *testing.T) {
+	f := NewFirewall()
+	for _, r := range []string{
+		"",
+		"block tcp * 80",
+		"deny icmp * 80",
+		"deny tcp * 80 extra",
+		"deny tcp * 70000",
+		"deny tcp * 90-80",
+		"deny tcp a*b.com",
+		"deny tcp 10.0.0.0/33",
+	} {
+		if err := f.Add(r); err == nil {
+			t.Errorf("Expected error for %q", r)
+		}
+	}
+	if len(f.Rules()) != 0 {
+		t.Errorf("Bad rules added %s", f.Rules())
+	}
+}
+
+func TestLoad(t *testing.T) {
+	f := NewFirewall()
+	if err := f.Load("# comment\nALLOW TCP 1.2.3.4 443\n\ndeny * * 25\n"); err != nil {
+		t.Fatal(err)
+	}
+	if r := f.Rules(); r != "allow tcp 1.2.3.4/32 443\ndeny * * 25" {
+		t.Errorf("Wrong rules %q", r)
+	}
+	if err := f.Load("deny\n"); err == nil || len(f.Rules()) == 0 {
+		t.Error("Bad load should keep the rules in-use")
+	}
+	var nilf *Firewall
+	if nilf.Verdict(TCP, -1, net.ParseIP("1.2.3.4"), 443) != None {
+		t.Error("Nil firewall should have no verdict")
+	}
+}
+
+func TestAppRules(t *testing.T) {
+	f := NewFirewall()
+	f.Add("allow * 1.2.3.4 443")
+	f.BlockApp(10001, true)
+	f.WifiOnly(10002, true)
+	if r := f.Rules(); r != "deny * * * uid:10002 net:!wifi\ndeny * * * uid:10001\nallow * 1.2.3.4/32 443" {
+		t.Errorf("Wrong rules %q", r)
+	}
+
+	check := func(uid int, want int) {
+		t.Helper()
+		if v, _ := f.Check(TCP, uid, "1.2.3.4:443"); v != want {
+			t.Errorf("uid %d: got %d, want %d", uid, v, want)
+		}
+	}
+	check(10001, Deny)
+	check(10003, Allow)
+	check(-1, Allow)
+	// unknown networks aren't wifi
+	check(10002, Deny)
+	f.SetNetwork(NetworkWifi)
+	check(10002, Allow)
+	f.SetNetwork(NetworkCellular)
+	check(10002, Deny)
+
+	f.BlockApp(10001, false)
+	f.WifiOnly(10002, false)
+	check(10001, Allow)
+	check(10002, Allow)
+
+	if err := f.Add("deny tcp * 80 uid:x"); err == nil {
+		t.Error("Expected error for bad uid")
+	}
+	if err := f.Add("deny tcp * uid:1 uid:2"); err == nil {
+		t.Error("Expected error for two uids")
+	}
+	if err := f.Add("deny tcp * net: uid:2"); err == nil {
+		t.Error("Expected error for empty network")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	f := NewFirewall()
+	if f.HasRoutes() {
+		t.Error("No routes expected")
+	}
+	for _, r := range []string{
+		"deny * 10.0.0.0/8",
+		"route:ss1 tcp *.example.com 443",
+		"route:wg * 10.0.0.0/8 * uid:10001",
+		"Route:Direct * * 53",
+	} {
+		if err := f.Add(r); err != nil {
+			t.Fatalf("%s: %v", r, err)
+		}
+	}
+	if err := f.Add("route: tcp * 80"); err == nil {
+		t.Error("Expected error for route without an outbound")
+	}
+	if !f.HasRoutes() {
+		t.Error("Routes expected")
+	}
+	f.Observe(answer(t, "www.example.com.", "", "93.184.216.34"))
+	ip := net.ParseIP
+	cases := []struct {
+		proto int32
+		uid   int
+		ip    string
+		port  int
+		want  string
+	}{
+		{TCP, -1, "93.184.216.34", 443, "ss1"},
+		{UDP, -1, "93.184.216.34", 443, ""},
+		{UDP, 10001, "10.1.1.1", 4000, "wg"},
+		{UDP, 10002, "10.1.1.1", 53, "Direct"},
+		{TCP, -1, "1.1.1.1", 80, ""},
+	}
+	for _, c := range cases {
+		if o := f.Outbound(c.proto, c.uid, ip(c.ip), c.port); o != c.want {
+			t.Errorf("%d %d %s:%d: got %q, want %q", c.proto, c.uid, c.ip, c.port, o, c.want)
+		}
+	}
+	// routes aren't verdicts
+	if v := f.Verdict(TCP, -1, ip("93.184.216.34"), 443); v != None {
+		t.Errorf("Route gave verdict %d", v)
+	}
+	if v := f.Verdict(UDP, 10001, ip("10.1.1.1"), 4000); v != Deny {
+		t.Errorf("Got verdict %d, want deny", v)
+	}
+	if !f.Remove("route:ss1 tcp *.example.com 443") {
+		t.Error("Route not removed")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	f := NewFirewall()
+	for _, r := range []string{
+		"limit:1000 * * * uid:10010",
+		"Limit:64 udp * 53",
+		"route:wg * 10.0.0.0/8",
+	} {
+		if err := f.Add(r); err != nil {
+			t.Fatalf("%s: %v", r, err)
+		}
+	}
+	for _, r := range []string{"limit: tcp * 80", "limit:0 tcp * 80", "limit:fast tcp * 80"} {
+		if err := f.Add(r); err == nil {
+			t.Errorf("%s: expected error for limit without a rate", r)
+		}
+	}
+	ip := net.ParseIP
+	up, down := f.Limit(TCP, 10010, ip("10.1.1.1"), 443)
+	if up == nil || down == nil || up == down || up.Kbps() != 1000 {
+		t.Fatalf("Wrong buckets %v %v", up, down)
+	}
+	// flows matching the same limit share its buckets
+	if up2, _ := f.Limit(UDP, 10010, ip("1.1.1.1"), 4000); up2 != up {
+		t.Error("Buckets not shared")
+	}
+	if up, _ := f.Limit(UDP, -1, ip("1.1.1.1"), 53); up.Kbps() != 64 {
+		t.Errorf("Wrong rate %d", up.Kbps())
+	}
+	if up, down := f.Limit(TCP, -1, ip("1.1.1.1"), 443); up != nil || down != nil {
+		t.Error("Unlimited flow limited")
+	}
+	// limits aren't verdicts, or routes
+	if v := f.Verdict(TCP, 10010, ip("1.1.1.1"), 443); v != None {
+		t.Errorf("Limit gave verdict %d", v)
+	}
+	if o := f.Outbound(TCP, 10010, ip("10.1.1.1"), 443); o != "wg" {
+		t.Errorf("Got outbound %q, want wg", o)
+	}
+	if !f.Remove("limit:1000 * * * uid:10010") {
+		t.Error("Limit not removed")
+	}
+}
+
+func TestBypass(t *testing.T) {
+	f := NewFirewall()
+	if err := f.SetBypass("10.0.0.0/8, fe80::/10,192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetBypass("10.0.0.0/8,lan"); err == nil {
+		t.Error("Expected error for bad cidr")
+	}
+	if b := f.Bypass(); b != "10.0.0.0/8,fe80::/10,192.0.2.1/32" {
+		t.Errorf("Wrong bypass %s", b)
+	}
+	if !f.HasRoutes() {
+		t.Error("Bypass should route")
+	}
+	f.Add("route:ss1 * * *")
+	ip := net.ParseIP
+	for _, c := range []struct {
+		ip   string
+		want string
+	}{
+		{"10.1.2.3", "direct"},
+		{"fe80::1", "direct"},
+		{"192.0.2.1", "direct"},
+		{"192.0.2.2", "ss1"},
+	} {
+		if o := f.Outbound(TCP, -1, ip(c.ip), 443); o != c.want {
+			t.Errorf("%s: got %q, want %q", c.ip, o, c.want)
+		}
+	}
+	f.SetBypass("")
+	if o := f.Outbound(UDP, -1, ip("10.1.2.3"), 53); o != "ss1" {
+		t.Errorf("Bypass not cleared, got %q", o)
+	}
+}
+
+func TestCountries(t *testing.T) {
+	f := NewFirewall()
+	if err := f.Load("deny * GEO:xx *\nroute:direct tcp geo:IN 443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Add("deny * geo:xyz *"); err == nil {
+		t.Error("Expected error for bad country")
+	}
+	if s := f.Rules(); s != "deny * geo:XX *\nroute:direct tcp geo:IN 443" {
+		t.Errorf("Wrong rules %q", s)
+	}
+	// no GeoIP database: no ip is in any country
+	if v := f.Verdict(TCP, -1, net.ParseIP("192.0.2.1"), 443); v != None {
+		t.Error("Country rule matched without a GeoIP database")
+	}
+	if c := f.Country("192.0.2.1"); c != "" {
+		t.Errorf("Country without a GeoIP database: %q", c)
+	}
+	if err := f.LoadGeoIP("/nonexistent.mmdb"); err == nil {
+		t.Error("Expected error for missing GeoIP database")
+	}
+	if err := f.LoadGeoIP(""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNamedRoutes(t *testing.T) {
+	f := NewFirewall()
+	if f.RoutesDomains() {
+		t.Error("No routes on domains")
+	}
+	f.Load("deny * blocked.example *\nroute:ss1 tcp *.example.com 443")
+	if !f.RoutesDomains() {
+		t.Error("Expected routes on domains")
+	}
+	ip := net.ParseIP("192.0.2.1")
+	f.Note(ip, "other.example")
+	if o := f.OutboundOf(TCP, -1, ip, 443, "WWW.example.com"); o != "ss1" {
+		t.Errorf("Named flow not routed, got %q", o)
+	}
+	f.Note(ip, "www.example.com")
+	// a named flow matches its name alone
+	if o := f.OutboundOf(TCP, -1, ip, 443, "other.example"); o != "" {
+		t.Errorf("Flow routed by names of its ip, got %q", o)
+	}
+	if o := f.Outbound(TCP, -1, ip, 443); o != "ss1" {
+		t.Errorf("Flow not routed by names of its ip, got %q", o)
+	}
+}
+
+func TestDomainLists(t *testing.T) {
+	f := NewFirewall()
+	if err := f.Load("deny * list:Ads *\nroute:tor tcp list:onion 443"); err != nil {
+		t.Fatal(err)
+	}
+	if r := f.Rules(); r != "deny * list:ads *\nroute:tor tcp list:onion 443" {
+		t.Errorf("Wrong rules %q", r)
+	}
+	if err := f.Load("deny * list: *"); err == nil {
+		t.Error("Expected error for list without a name")
+	}
+	if err := f.SetDomainList("ads", "bad domain!"); err == nil {
+		t.Error("Expected error for bad domain")
+	}
+	f.Observe(answer(t, "tracker.ads.example.", "", "192.0.2.1"))
+	f.Observe(answer(t, "www.example.com.", "", "192.0.2.2"))
+	// a rule on a list not set matches nothing
+	if v, _ := f.Check(TCP, -1, "192.0.2.1:443"); v != None {
+		t.Errorf("Unset list matched: %d", v)
+	}
+	if err := f.SetDomainList("ads", "# ads\nads.example,\n*.cdn.example\n"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := f.Check(TCP, -1, "192.0.2.1:443"); v != Deny {
+		t.Errorf("Subdomain of listed domain: got %d, want deny", v)
+	}
+	if v, _ := f.Check(TCP, -1, "192.0.2.2:443"); v != None {
+		t.Errorf("Unlisted domain: got %d, want none", v)
+	}
+	if !f.RoutesDomains() {
+		t.Error("Expected routes on domains")
+	}
+	f.SetDomainList("onion", "www.example.com")
+	if o := f.OutboundOf(TCP, -1, net.ParseIP("198.51.100.1"), 443, "www.example.com"); o != "tor" {
+		t.Errorf("Named flow not routed by list, got %q", o)
+	}
+	if err := f.SetDomainList("ads", ""); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := f.Check(TCP, -1, "192.0.2.1:443"); v != None {
+		t.Errorf("Removed list matched: %d", v)
+	}
+	var nilf *Firewall
+	if nilf.Names("192.0.2.1") != "" {
+		t.Error("Nil firewall should know no names")
+	}
+}
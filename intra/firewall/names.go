@@ -0,0 +1,147 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package firewall
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxIPs caps the number of ips mapped to names.
+	maxIPs = 8192
+	// minNameTTL is the least time an ip is known by its names, as apps
+	// connect to ips well past the TTLs of answers they cached.
+	minNameTTL = 10 * time.Minute
+)
+
+type names struct {
+	m map[string]time.Time // names to their expiry
+}
+
+// nameStore maps ips to the names they were answers for.
+type nameStore struct {
+	sync.RWMutex
+	m map[string]*names
+}
+
+func newNameStore() *nameStore {
+	return &nameStore{m: make(map[string]*names)}
+}
+
+// observe maps ips in the answer res to the names queried and aliased.
+func (s *nameStore) observe(res []byte) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(res); err != nil || len(msg.Question) != 1 {
+		return
+	}
+	all := []string{dns.CanonicalName(msg.Question[0].Name)}
+	var ips []net.IP
+	var ttl uint32
+	for _, rr := range msg.Answer {
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			all = append(all, dns.CanonicalName(v.Target))
+		case *dns.A:
+			ips = append(ips, v.A)
+		case *dns.AAAA:
+			ips = append(ips, v.AAAA)
+		default:
+			continue
+		}
+		if h := rr.Header(); h.Ttl > ttl {
+			ttl = h.Ttl
+		}
+	}
+	if len(ips) == 0 {
+		return
+	}
+	d := time.Duration(ttl) * time.Second
+	if d < minNameTTL {
+		d = minNameTTL
+	}
+	expiry := time.Now().Add(d)
+
+	s.Lock()
+	defer s.Unlock()
+	for _, ip := range ips {
+		k := ip.String()
+		n := s.m[k]
+		if n == nil {
+			if len(s.m) >= maxIPs {
+				s.evictLocked()
+			}
+			n = &names{m: make(map[string]time.Time)}
+			s.m[k] = n
+		}
+		for _, name := range all {
+			n.m[name] = expiry
+		}
+	}
+}
+
+// note maps ip to name, as if answered for it.
+func (s *nameStore) note(ip net.IP, name string) {
+	expiry := time.Now().Add(minNameTTL)
+	s.Lock()
+	defer s.Unlock()
+	k := ip.String()
+	n := s.m[k]
+	if n == nil {
+		if len(s.m) >= maxIPs {
+			s.evictLocked()
+		}
+		n = &names{m: make(map[string]time.Time)}
+		s.m[k] = n
+	}
+	n.m[dns.CanonicalName(name)] = expiry
+}
+
+// evictLocked drops expired ips, or all of them, if none have expired.
+// Must be called under Lock.
+func (s *nameStore) evictLocked() {
+	now := time.Now()
+	for k, n := range s.m {
+		for name, exp := range n.m {
+			if now.After(exp) {
+				delete(n.m, name)
+			}
+		}
+		if len(n.m) == 0 {
+			delete(s.m, k)
+		}
+	}
+	if len(s.m) >= maxIPs {
+		s.m = make(map[string]*names)
+	}
+}
+
+// get returns the canonical names ip is known by, sorted.
+func (s *nameStore) get(ip net.IP) []string {
+	if ip == nil {
+		return nil
+	}
+	now := time.Now()
+	s.RLock()
+	defer s.RUnlock()
+	n := s.m[ip.String()]
+	if n == nil {
+		return nil
+	}
+	out := make([]string, 0, len(n.m))
+	for name, exp := range n.m {
+		if now.Before(exp) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flow is an active flow, as listed by Tunnel.Flows.
+type Flow struct {
+	ID            int64  `json:"id"`
+	Proto         string `json:"proto"`  // "tcp" or "udp"
+	Source        string `json:"source"` // the app's address, ip:port
+	Target        string `json:"target"` // the address the app sent to, ip:port
+	UID           int    `json:"uid"`    // the app, or -1 if unknown
+	Age           int64  `json:"age"`    // millis since the flow began
+	UploadBytes   int64  `json:"up"`
+	DownloadBytes int64  `json:"down"`
+	Route         string `json:"route"` // one of the Route* constants
+}
+
+// flow is an entry of the flow table.  up and down come first, to be 64-bit
+// aligned for atomic access on 32-bit platforms.
+type flow struct {
+	up    int64
+	down  int64
+	info  Flow
+	start time.Time
+	close func()
+}
+
+// count adds up and down bytes to f.  A nil flow counts nothing.
+func (f *flow) count(up int64, down int64) {
+	if f == nil {
+		return
+	}
+	atomic.AddInt64(&f.up, up)
+	atomic.AddInt64(&f.down, down)
+}
+
+// flows is the table of active flows.  A nil table has no flows.
+type flows struct {
+	sync.Mutex
+	last int64
+	m    map[int64]*flow
+}
+
+func newFlows() *flows {
+	return &flows{m: make(map[int64]*flow)}
+}
+
+// add enters a flow of proto from source to target, by app uid, along
+// route, and returns it, for remove; close ends the flow.
+func (t *flows) add(proto string, source string, target string, uid int, route string, close func()) *flow {
+	if t == nil {
+		return nil
+	}
+	f := &flow{
+		info:  Flow{Proto: proto, Source: source, Target: target, UID: uid, Route: route},
+		start: time.Now(),
+		close: close,
+	}
+	t.Lock()
+	t.last++
+	f.info.ID = t.last
+	t.m[f.info.ID] = f
+	t.Unlock()
+	return f
+}
+
+// remove drops f from the table, as it ends.
+func (t *flows) remove(f *flow) {
+	if t == nil || f == nil {
+		return
+	}
+	t.Lock()
+	delete(t.m, f.info.ID)
+	t.Unlock()
+}
+
+// list returns the flows in the table, as json, oldest first.
+func (t *flows) list() string {
+	out := []Flow{}
+	if t != nil {
+		now := time.Now()
+		t.Lock()
+		for _, f := range t.m {
+			info := f.info
+			info.Age = int64(now.Sub(f.start) / time.Millisecond)
+			info.UploadBytes = atomic.LoadInt64(&f.up)
+			info.DownloadBytes = atomic.LoadInt64(&f.down)
+			out = append(out, info)
+		}
+		t.Unlock()
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	b, _ := json.Marshal(out)
+	return string(b)
+}
+
+// end ends the flow numbered id, and reports whether there was one.
+func (t *flows) end(id int64) bool {
+	if t == nil {
+		return false
+	}
+	t.Lock()
+	f := t.m[id]
+	t.Unlock()
+	if f == nil {
+		return false
+	}
+	f.close()
+	return true
+}
+
+// endApp ends all flows of app uid, and returns how many there were.
+func (t *flows) endApp(uid int) int {
+	if t == nil {
+		return 0
+	}
+	var ended []*flow
+	t.Lock()
+	for _, f := range t.m {
+		if f.info.UID == uid {
+			ended = append(ended, f)
+		}
+	}
+	t.Unlock()
+	for _, f := range ended {
+		f.close()
+	}
+	return len(ended)
+}
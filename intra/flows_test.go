@@ -0,0 +1,74 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func listed(t *testing.T, ft *flows) []Flow {
+	var out []Flow
+	if err := json.Unmarshal([]byte(ft.list()), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestFlows(t *testing.T) {
+	ft := newFlows()
+	closed := make(map[string]int)
+	add := func(source string, uid int) *flow {
+		return ft.add("tcp", source, "192.0.2.1:443", uid, RouteDirect, func() { closed[source]++ })
+	}
+	a := add("10.0.0.1:1000", 1)
+	b := add("10.0.0.1:1001", 2)
+	c := add("10.0.0.1:1002", 2)
+	a.count(10, 20)
+
+	out := listed(t, ft)
+	if len(out) != 3 {
+		t.Fatalf("%d flows", len(out))
+	}
+	if out[0].ID != a.info.ID || out[1].ID != b.info.ID || out[2].ID != c.info.ID {
+		t.Errorf("flows %+v not oldest first", out)
+	}
+	if f := out[0]; f.Source != "10.0.0.1:1000" || f.UID != 1 || f.UploadBytes != 10 || f.DownloadBytes != 20 || f.Route != RouteDirect {
+		t.Errorf("flow %+v", f)
+	}
+
+	if !ft.end(a.info.ID) || closed["10.0.0.1:1000"] != 1 {
+		t.Error("flow not ended")
+	}
+	if ft.end(-1) {
+		t.Error("ended a flow not in the table")
+	}
+	if n := ft.endApp(2); n != 2 || closed["10.0.0.1:1001"] != 1 || closed["10.0.0.1:1002"] != 1 {
+		t.Errorf("ended %d flows of app", n)
+	}
+
+	// flows leave the table as they end
+	ft.remove(a)
+	ft.remove(b)
+	if out := listed(t, ft); len(out) != 1 || out[0].ID != c.info.ID {
+		t.Errorf("flows %+v", out)
+	}
+	ft.remove(c)
+	if out := listed(t, ft); len(out) != 0 {
+		t.Errorf("flows %+v", out)
+	}
+}
+
+func TestFlowsNil(t *testing.T) {
+	var ft *flows
+	f := ft.add("udp", "10.0.0.1:1000", "192.0.2.1:53", 1, RouteDirect, nil)
+	f.count(1, 1)
+	ft.remove(f)
+	if ft.list() != "[]" || ft.end(1) || ft.endApp(1) != 0 {
+		t.Error("nil table has flows")
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package geoip looks up the countries of ips in MaxMind DB (mmdb) files,
+// like GeoLite2-Country and its look-alikes, for rules on countries.
+// See: https://maxmind.github.io/MaxMind-DB/
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+)
+
+// metadataMarker begins the metadata, at the end of the file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Types of values in the data section.
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBool     = 14
+	typeFloat    = 15
+)
+
+// maxDepth caps the nesting of values, as files may be corrupt.
+const maxDepth = 32
+
+var errCorrupt = errors.New("corrupt mmdb")
+
+// DB is a MaxMind DB, read into memory.
+type DB struct {
+	tree       []byte
+	data       []byte
+	nodes      uint
+	recordSize uint
+	ipVersion  uint
+	v4start    uint // the node of ::/96, under which are IPv4 ips
+	// Type is the database_type of the file, like "GeoLite2-Country".
+	Type string
+}
+
+// Open reads the mmdb file at path.
+func Open(path string) (*DB, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(b)
+}
+
+// New returns the DB in b, the contents of an mmdb file.
+func New(b []byte) (*DB, error) {
+	i := bytes.LastIndex(b, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("not an mmdb: no metadata")
+	}
+	meta, _, err := decode(b[i+len(metadataMarker):], 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errCorrupt
+	}
+	db := &DB{
+		nodes:      uint(toUint(m["node_count"])),
+		recordSize: uint(toUint(m["record_size"])),
+		ipVersion:  uint(toUint(m["ip_version"])),
+	}
+	db.Type, _ = m["database_type"].(string)
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported mmdb record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported mmdb ip version %d", db.ipVersion)
+	}
+	treeSize := db.nodes * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errCorrupt
+	}
+	db.tree = b[:treeSize]
+	db.data = b[treeSize+16 : i]
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < db.nodes; j++ {
+			node = db.record(node, 0)
+		}
+		db.v4start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *DB) record(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+	}
+}
+
+// Lookup returns the data of ip, or nil if the db has none.
+func (db *DB) Lookup(ip net.IP) (interface{}, error) {
+	if db == nil || ip == nil {
+		return nil, nil
+	}
+	node := uint(0)
+	bits := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		node = db.v4start
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < 8*len(bits) && node < db.nodes; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodes {
+		// not found
+		return nil, nil
+	}
+	off := node - db.nodes - 16
+	if off >= uint(len(db.data)) {
+		return nil, errCorrupt
+	}
+	v, _, err := decode(db.data, off, 0)
+	return v, err
+}
+
+// Country returns the ISO 3166-1 code of ip's country, in upper case, or ""
+// if it's unknown, or db is nil.
+func (db *DB) Country(ip net.IP) string {
+	v, err := db.Lookup(ip)
+	if err != nil || v == nil {
+		return ""
+	}
+	m, _ := v.(map[string]interface{})
+	for _, k := range []string{"country", "registered_country"} {
+		if c, ok := m[k].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return strings.ToUpper(code)
+			}
+		}
+	}
+	if code, ok := m["country_code"].(string); ok {
+		return strings.ToUpper(code)
+	}
+	return ""
+}
+
+func toUint(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
+
+// decode returns the value at off in the data section d, and the offset
+// past it.
+func decode(d []byte, off uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errCorrupt
+	}
+	if off >= uint(len(d)) {
+		return nil, 0, errCorrupt
+	}
+	ctrl := d[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		p, next, err := pointer(d, ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := decode(d, p, depth+1)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		if off >= uint(len(d)) {
+			return nil, 0, errCorrupt
+		}
+		typ = 7 + uint(d[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(d)) {
+			return nil, 0, errCorrupt
+		}
+		v := uint(0)
+		for _, b := range d[off : off+n] {
+			v = v<<8 | uint(b)
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := decode(d, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errCorrupt
+			}
+			v, next, err := decode(d, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := decode(d, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(d)) {
+		return nil, 0, errCorrupt
+	}
+	b := d[off : off+size]
+	off += size
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return append([]byte{}, b...), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), off, nil
+	case typeUint16, typeUint32, typeUint64, typeInt32:
+		if size > 8 {
+			return nil, 0, errCorrupt
+		}
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == typeInt32 {
+			return int64(int32(v)), off, nil
+		}
+		return v, off, nil
+	case typeUint128:
+		// too big for any use here
+		return append([]byte{}, b...), off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported mmdb type %d", typ)
+}
+
+// pointer returns the offset pointed to by the pointer with control byte
+// ctrl, whose rest is at off in d, and the offset past the pointer.
+func pointer(d []byte, ctrl byte, off uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	if off+n > uint(len(d)) {
+		return 0, 0, errCorrupt
+	}
+	v := uint(0)
+	if n < 4 {
+		v = uint(ctrl & 0x7)
+	}
+	for _, b := range d[off : off+n] {
+		v = v<<8 | uint(b)
+	}
+	switch n {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+	return v, off + n, nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package geoip
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func mmdbString(s string) []byte {
+	return append([]byte{typeString<<5 | byte(len(s))}, s...)
+}
+
+func mmdbMap(kv ...[]byte) []byte {
+	b := []byte{typeMap<<5 | byte(len(kv)/2)}
+	for _, v := range kv {
+		b = append(b, v...)
+	}
+	return b
+}
+
+func mmdbUint16(v uint16) []byte {
+	return []byte{typeUint16<<5 | 2, byte(v >> 8), byte(v)}
+}
+
+// testDB returns an IPv4 mmdb, of 24-bit records, in which 1.0.0.0/8 is in
+// AU, and 2.0.0.0/8, through a pointer, in IN.
+func testDB() []byte {
+	const nodes = 9
+	au := mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("au")))
+	in := mmdbMap(mmdbString("registered_country"), mmdbMap(mmdbString("iso_code"), mmdbString("IN")))
+	data := append(append([]byte{}, au...), in...)
+	// a pointer (of size 0) to in
+	ptr := len(data)
+	data = append(data, typePointer<<5, byte(len(au)))
+
+	var tree []byte
+	rec := func(v int) {
+		tree = append(tree, byte(v>>16), byte(v>>8), byte(v))
+	}
+	// nodes 0 to 5 take the first six 0 bits of the first byte
+	for i := 0; i < 6; i++ {
+		rec(i + 1)
+		rec(nodes)
+	}
+	rec(7) // node 6: 0000000x
+	rec(8) // node 6: 0000001x
+	rec(nodes)
+	rec(nodes + 16)       // node 7: 00000001, au
+	rec(nodes + 16 + ptr) // node 8: 00000010, in
+	rec(nodes)
+
+	meta := mmdbMap(
+		mmdbString("node_count"), mmdbUint16(nodes),
+		mmdbString("record_size"), mmdbUint16(24),
+		mmdbString("ip_version"), mmdbUint16(4),
+		mmdbString("database_type"), mmdbString("Test-Country"),
+	)
+	var b bytes.Buffer
+	b.Write(tree)
+	b.Write(make([]byte, 16))
+	b.Write(data)
+	b.Write(metadataMarker)
+	b.Write(meta)
+	return b.Bytes()
+}
+
+func TestCountry(t *testing.T) {
+	db, err := New(testDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Type != "Test-Country" {
+		t.Errorf("Wrong type %s", db.Type)
+	}
+	for _, c := range []struct {
+		ip   string
+		want string
+	}{
+		{"1.2.3.4", "AU"},
+		{"2.2.3.4", "IN"},
+		{"3.2.3.4", ""},
+		{"0.1.1.1", ""},
+		{"2001:db8::1", ""},
+	} {
+		if got := db.Country(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.ip, got, c.want)
+		}
+	}
+	var nildb *DB
+	if nildb.Country(net.ParseIP("1.2.3.4")) != "" {
+		t.Error("Nil db should know no countries")
+	}
+}
+
+func TestBadDB(t *testing.T) {
+	if _, err := New([]byte("not an mmdb")); err == nil {
+		t.Error("Expected error for missing metadata")
+	}
+	b := testDB()
+	if _, err := New(b[len(b)-40:]); err == nil {
+		t.Error("Expected error for truncated tree")
+	}
+}
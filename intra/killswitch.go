@@ -0,0 +1,122 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/doh"
+	"github.com/celzero/firestack/intra/events"
+)
+
+// probeInterval is how often a flow is let through a proxy that's down,
+// to find out if it is back up.
+const probeInterval = 5 * time.Second
+
+// Upstreams the kill switch engages for.
+const (
+	upstreamDNS   = "dns"
+	upstreamProxy = "proxy"
+)
+
+// killSwitch drops new flows while the resolver or the proxy is unreachable,
+// rather than let them leak, or hang till they time out.  The resolver is
+// unreachable while in servfail hangover; the proxy, from a failed dial
+// through it upto a successful one.  A nil killSwitch drops nothing.
+type killSwitch struct {
+	sync.Mutex
+	on        bool
+	dns       func() doh.Transport
+	dnsDown   bool
+	proxyErr  error // the last dial through the proxy, if it failed
+	lastProbe time.Time
+	engaged   string // the upstream the switch is engaged for, if any
+}
+
+func newKillSwitch(dns func() doh.Transport) *killSwitch {
+	return &killSwitch{dns: dns}
+}
+
+// set turns the switch on, or off.
+func (k *killSwitch) set(on bool) {
+	k.Lock()
+	k.on = on
+	k.dnsDown = false
+	k.proxyErr = nil
+	k.Unlock()
+	k.update()
+}
+
+// allow reports whether a new flow, through the proxy if `proxied`, may go
+// ahead.  While the proxy is down, a proxied flow is let through now and
+// then, as a probe.
+func (k *killSwitch) allow(proxied bool) (ok bool) {
+	if k == nil {
+		return true
+	}
+	k.Lock()
+	on, dns := k.on, k.dns
+	k.Unlock()
+	if !on {
+		return true
+	}
+	down := doh.InHangover(dns())
+
+	k.Lock()
+	k.dnsDown = down
+	switch {
+	case down:
+		ok = false
+	case proxied && k.proxyErr != nil:
+		if now := time.Now(); now.Sub(k.lastProbe) >= probeInterval {
+			k.lastProbe = now
+			ok = true
+		}
+	default:
+		ok = true
+	}
+	k.Unlock()
+	k.update()
+	return
+}
+
+// proxied records the outcome, err, of a dial through the proxy.
+func (k *killSwitch) proxied(err error) {
+	if k == nil {
+		return
+	}
+	k.Lock()
+	k.proxyErr = err
+	k.Unlock()
+	k.update()
+}
+
+// update publishes the switch engaging, or releasing, if it just did.
+func (k *killSwitch) update() {
+	k.Lock()
+	var upstream, detail string
+	if k.on {
+		if k.dnsDown {
+			upstream, detail = upstreamDNS, "resolver in hangover"
+		} else if k.proxyErr != nil {
+			upstream, detail = upstreamProxy, k.proxyErr.Error()
+		}
+	}
+	prev := k.engaged
+	k.engaged = upstream
+	k.Unlock()
+
+	if upstream == prev {
+		return
+	}
+	if len(upstream) > 0 {
+		events.Publish(events.KillSwitchEngaged, upstream, detail)
+	} else {
+		events.Publish(events.KillSwitchReleased, prev, "")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/doh"
+	"github.com/celzero/firestack/intra/events"
+)
+
+// eventsOf collects the events published, in order.
+type eventsOf chan *events.Event
+
+func (c eventsOf) OnEvent(e *events.Event) {
+	c <- e
+}
+
+func (c eventsOf) next(t *testing.T) *events.Event {
+	select {
+	case e := <-c:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+		return nil
+	}
+}
+
+func TestKillSwitch(t *testing.T) {
+	evs := make(eventsOf, 8)
+	events.SetListener(evs)
+	defer events.SetListener(nil)
+
+	k := newKillSwitch(func() doh.Transport { return nil })
+	if !k.allow(true) {
+		t.Fatal("off switch dropped a flow")
+	}
+	k.proxied(errors.New("proxy down"))
+	if !k.allow(true) {
+		t.Fatal("off switch dropped a flow")
+	}
+
+	k.set(true)
+	k.proxied(errors.New("proxy down"))
+	if e := evs.next(t); e.Type != events.KillSwitchEngaged || e.Source != upstreamProxy || e.Detail != "proxy down" {
+		t.Errorf("event %+v", e)
+	}
+	// one proxied flow is let through, as a probe, and the rest dropped
+	if !k.allow(true) {
+		t.Error("no probe")
+	}
+	if k.allow(true) {
+		t.Error("tripped switch let a proxied flow through")
+	}
+	if !k.allow(false) {
+		t.Error("tripped switch dropped a direct flow")
+	}
+
+	k.proxied(nil)
+	if e := evs.next(t); e.Type != events.KillSwitchReleased || e.Source != upstreamProxy {
+		t.Errorf("event %+v", e)
+	}
+	if !k.allow(true) {
+		t.Error("reset switch dropped a flow")
+	}
+
+	k.proxied(errors.New("proxy down"))
+	evs.next(t)
+	k.set(false)
+	if e := evs.next(t); e.Type != events.KillSwitchReleased {
+		t.Errorf("event %+v", e)
+	}
+	if !k.allow(true) || !k.allow(true) {
+		t.Error("off switch dropped a flow")
+	}
+}
+
+func TestKillSwitchNil(t *testing.T) {
+	var k *killSwitch
+	k.proxied(errors.New("proxy down"))
+	if !k.allow(true) {
+		t.Error("nil switch dropped a flow")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package kv defines the key-value store stateful components persist to.
+// The host app implements KVStore on top of whatever storage its platform
+// offers; headless deployments may use the in-memory store in this package.
+package kv
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KVStore is a string-keyed store of opaque values.
+type KVStore interface {
+	// Get returns the value of key, or nil if key is absent.
+	Get(key string) ([]byte, error)
+	// Put sets key to value; a nil value deletes key.
+	Put(key string, value []byte) error
+	// Scan calls v.Visit for every key with prefix, in lexical order,
+	// until Visit returns false.
+	Scan(prefix string, v Visitor) error
+}
+
+// Visitor receives entries of a Scan.
+type Visitor interface {
+	// Visit is called with a key and its value; returns false to stop the scan.
+	Visit(key string, value []byte) bool
+}
+
+// VisitFunc is a func that is a Visitor.
+type VisitFunc func(key string, value []byte) bool
+
+// Visit implements Visitor.
+func (f VisitFunc) Visit(key string, value []byte) bool {
+	return f(key, value)
+}
+
+// Namespaces components prefix their keys with.
+const (
+	// IPMap is of the IPs last confirmed for DoH servers, by ipmap.
+	IPMap = "ipmap:"
+	// DNSCache is of the responses cached by dnsx.CachingTransport.
+	DNSCache = "dnscache:"
+	// QueryStats is of the dns query counts of qlog.Stats.
+	QueryStats = "qlog:"
+	// BlockCounts is of the counts of dnsx.BlockCounter.
+	BlockCounts = "blockcount:"
+)
+
+// Forget deletes all keys with prefix from s.
+func Forget(s KVStore, prefix string) error {
+	var keys []string
+	err := s.Scan(prefix, VisitFunc(func(key string, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	for _, k := range keys {
+		if perr := s.Put(k, nil); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+type memStore struct {
+	sync.RWMutex
+	m map[string][]byte
+}
+
+// NewMemStore returns a KVStore that lives only as long as the process.
+func NewMemStore() KVStore {
+	return &memStore{m: make(map[string][]byte)}
+}
+
+func (s *memStore) Get(key string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.m[key], nil
+}
+
+func (s *memStore) Put(key string, value []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if value == nil {
+		delete(s.m, key)
+	} else {
+		s.m[key] = append([]byte{}, value...)
+	}
+	return nil
+}
+
+func (s *memStore) Scan(prefix string, v Visitor) error {
+	s.RLock()
+	var keys []string
+	for k := range s.m {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	vals := make([][]byte, len(keys))
+	for i, k := range keys {
+		vals[i] = s.m[k]
+	}
+	// Don't hold the lock while visiting, v may call back into s.
+	s.RUnlock()
+
+	for i, k := range keys {
+		if !v.Visit(k, vals[i]) {
+			break
+		}
+	}
+	return nil
+}
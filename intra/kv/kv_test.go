@@ -0,0 +1,64 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package kv
+
+import (
+	"testing"
+)
+
+type keys []string
+
+func (k *keys) Visit(key string, value []byte) bool {
+	*k = append(*k, key)
+	return len(*k) < 2
+}
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+	if v, err := s.Get("a"); v != nil || err != nil {
+		t.Error("Expected absent key")
+	}
+	s.Put("x:c", []byte("3"))
+	s.Put("x:a", []byte("1"))
+	s.Put("x:b", []byte("2"))
+	s.Put("y:a", []byte("4"))
+	if v, _ := s.Get("x:b"); string(v) != "2" {
+		t.Errorf("Wrong value %s", v)
+	}
+
+	var k keys
+	s.Scan("x:", &k)
+	if len(k) != 2 || k[0] != "x:a" || k[1] != "x:b" {
+		t.Errorf("Wrong scan %v", k)
+	}
+
+	s.Put("x:a", nil)
+	if v, _ := s.Get("x:a"); v != nil {
+		t.Error("Expected key to be deleted")
+	}
+}
+
+func TestForget(t *testing.T) {
+	s := NewMemStore()
+	s.Put("x:a", []byte("1"))
+	s.Put("x:b", []byte("2"))
+	s.Put("y:a", []byte("3"))
+	if err := Forget(s, "x:"); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	s.Scan("", VisitFunc(func(key string, _ []byte) bool {
+		if key != "y:a" {
+			t.Errorf("Key %s not forgotten", key)
+		}
+		n++
+		return true
+	}))
+	if n != 1 {
+		t.Errorf("Expected 1 key left, got %d", n)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/celzero/firestack/intra/codes"
+)
+
+// Reasons the tunnel stopped, as in LifecycleListener.OnStopped.
+const (
+	// StopDisconnected is the tunnel being disconnected by the app.
+	StopDisconnected = "disconnected"
+)
+
+// LifecycleListener receives the lifecycle of a Tunnel, so that apps
+// needn't infer it from failing reads and writes.  Its methods are called
+// one at a time, and must return quickly.
+type LifecycleListener interface {
+	// OnStarted is called once the tunnel is up, or, if it is already, as
+	// soon as the listener is set.
+	OnStarted()
+	// OnStopped is called once the tunnel is down, for `reason`, one of the
+	// Stop* reasons.
+	OnStopped(reason string)
+	// OnProxyConnected is called on the first flow through proxy `name`,
+	// "proxy" for the one of StartProxy, or the name of an outbound, that
+	// connects, and on the first that connects after it was disconnected.
+	OnProxyConnected(name string)
+	// OnProxyDisconnected is called on the first flow through proxy `name`
+	// that fails to connect, for `reason`, and on the first that fails after
+	// it was connected.
+	OnProxyDisconnected(name string, reason string)
+	// OnFatalError is called once the tunnel fails in a way it can't recover
+	// from, like its TUN device closing under it, with `code`, of the codes
+	// package, and `reason`.  The tunnel should be disconnected.
+	OnFatalError(code int, reason string)
+}
+
+// lifecycle tracks the state of the tunnel, and of its proxies, and calls
+// its listener as they change.
+type lifecycle struct {
+	sync.Mutex
+	cb      sync.Mutex // held while calling listener, to call it in order
+	l       LifecycleListener
+	started bool
+	stopped bool
+	fatal   bool
+	proxies map[string]bool // whether each proxy is up
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{proxies: make(map[string]bool)}
+}
+
+// call calls f with the listener, if any.
+func (c *lifecycle) call(f func(LifecycleListener)) {
+	c.cb.Lock()
+	defer c.cb.Unlock()
+	c.Lock()
+	l := c.l
+	c.Unlock()
+	if l != nil {
+		f(l)
+	}
+}
+
+// setListener sets `l` to receive the lifecycle, and tells it the tunnel
+// started, if it is up already.
+func (c *lifecycle) setListener(l LifecycleListener) {
+	c.Lock()
+	c.l = l
+	up := c.started && !c.stopped
+	c.Unlock()
+	if up {
+		c.call(func(l LifecycleListener) { l.OnStarted() })
+	}
+}
+
+func (c *lifecycle) start() {
+	c.Lock()
+	c.started = true
+	c.Unlock()
+	c.call(func(l LifecycleListener) { l.OnStarted() })
+}
+
+func (c *lifecycle) stop(reason string) {
+	c.Lock()
+	done := c.stopped
+	c.stopped = true
+	c.Unlock()
+	if !done {
+		c.call(func(l LifecycleListener) { l.OnStopped(reason) })
+	}
+}
+
+// proxied records the outcome, err, of a dial through proxy `name`; nil
+// lifecycles record nothing.
+func (c *lifecycle) proxied(name string, err error) {
+	if c == nil {
+		return
+	}
+	up := err == nil
+	c.Lock()
+	was, seen := c.proxies[name]
+	c.proxies[name] = up
+	c.Unlock()
+	if seen && was == up {
+		return
+	}
+	if up {
+		c.call(func(l LifecycleListener) { l.OnProxyConnected(name) })
+	} else {
+		c.call(func(l LifecycleListener) { l.OnProxyDisconnected(name, err.Error()) })
+	}
+}
+
+// forget forgets the state of proxies `names`, or, if none, of all of
+// them, as when they're replaced.
+func (c *lifecycle) forget(names ...string) {
+	c.Lock()
+	if len(names) == 0 {
+		c.proxies = make(map[string]bool)
+	}
+	for _, name := range names {
+		delete(c.proxies, name)
+	}
+	c.Unlock()
+}
+
+// wrote records err, of a write to the TUN device, which is fatal if the
+// device is gone.
+func (c *lifecycle) wrote(err error) {
+	if err == nil || !isTunGone(err) {
+		return
+	}
+	c.Lock()
+	done := c.fatal || c.stopped
+	c.fatal = true
+	c.Unlock()
+	if !done {
+		c.call(func(l LifecycleListener) { l.OnFatalError(codes.BadTun, err.Error()) })
+	}
+}
+
+// isTunGone reports whether err, of a read or write, means the TUN device
+// is closed, or otherwise gone.
+func isTunGone(err error) bool {
+	return errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.EBADF) || errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ENODEV)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/celzero/firestack/intra/codes"
+)
+
+// calls records the calls to a LifecycleListener, in order.
+type calls []string
+
+func (c *calls) OnStarted() {
+	*c = append(*c, "started")
+}
+
+func (c *calls) OnStopped(reason string) {
+	*c = append(*c, "stopped "+reason)
+}
+
+func (c *calls) OnProxyConnected(name string) {
+	*c = append(*c, "connected "+name)
+}
+
+func (c *calls) OnProxyDisconnected(name string, reason string) {
+	*c = append(*c, "disconnected "+name+" "+reason)
+}
+
+func (c *calls) OnFatalError(code int, reason string) {
+	*c = append(*c, "fatal "+strconv.Itoa(code))
+}
+
+func TestLifecycle(t *testing.T) {
+	got := &calls{}
+	c := newLifecycle()
+	c.start()
+	// listeners set late are told the tunnel is up
+	c.setListener(got)
+	c.proxied("p", errors.New("refused"))
+	c.proxied("p", errors.New("refused"))
+	c.proxied("p", nil)
+	c.proxied("p", nil)
+	c.proxied("q", nil)
+	c.forget("p")
+	c.proxied("p", nil)
+	c.wrote(errors.New("transient"))
+	c.wrote(os.ErrClosed)
+	c.wrote(os.ErrClosed)
+	c.stop(StopDisconnected)
+	c.stop(StopDisconnected)
+
+	want := calls{
+		"started",
+		"disconnected p refused",
+		"connected p",
+		"connected q",
+		"connected p",
+		"fatal " + strconv.Itoa(codes.BadTun),
+		"stopped " + StopDisconnected,
+	}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("calls %q, not %q", *got, want)
+	}
+}
+
+func TestLifecycleStopped(t *testing.T) {
+	got := &calls{}
+	c := newLifecycle()
+	c.start()
+	c.stop(StopDisconnected)
+	// listeners set once the tunnel is down aren't told it started, nor
+	// of fatal errors after
+	c.setListener(got)
+	c.wrote(os.ErrClosed)
+	if len(*got) > 0 {
+		t.Errorf("calls %q", *got)
+	}
+}
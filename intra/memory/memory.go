@@ -0,0 +1,137 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package memory sizes the caches, tables, and buffers of a tunnel to a
+// memory limit, and returns memory to the OS, for network extensions whose
+// memory is capped, like those of iOS, at 15MB.
+package memory
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/xbuf"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	// Tight is the limit under which memory is returned to the OS every
+	// minute, and the gc runs most often.
+	Tight = 32 << 20
+	// Roomy is the limit under which relay buffers are small.
+	Roomy = 128 << 20
+
+	// cacheEntryBytes is about the size of a cached dns response.
+	cacheEntryBytes = 1024
+	// sessionBytes is about the size of a udp association: its socket, its
+	// goroutines, and its buffers.
+	sessionBytes = 16 * 1024
+)
+
+// Budget is what a memory limit allows of the tunnel.
+type Budget struct {
+	// Limit is the limit the budget is of, in bytes, or 0 for none.
+	Limit int64
+	// DNSCacheSize is the most dns responses cached, or 0 for the default.
+	DNSCacheSize int
+	// UDPSessions is the most udp associations at once, or 0 for no limit.
+	UDPSessions int
+	// RelayBuffer is the size of the buffers tcp flows are relayed through.
+	RelayBuffer int
+	// GCPercent is as in debug.SetGCPercent, or 0 to leave it be.
+	GCPercent int
+	// ReleaseEvery is how often memory is returned to the OS, or 0 for never,
+	// but as the runtime does on its own.
+	ReleaseEvery time.Duration
+}
+
+// BudgetOf returns the budget of `limit` bytes, or, if it is 0 or less, of
+// no limit.  Caches get a 16th of the limit, and udp associations an 8th.
+func BudgetOf(limit int64) Budget {
+	if limit <= 0 {
+		return Budget{RelayBuffer: xbuf.Medium}
+	}
+	b := Budget{
+		Limit:        limit,
+		DNSCacheSize: clamp(limit/16/cacheEntryBytes, 64, 4096),
+		UDPSessions:  clamp(limit/8/sessionBytes, 32, 4096),
+		RelayBuffer:  xbuf.Medium,
+		GCPercent:    100,
+	}
+	if limit < Roomy {
+		b.RelayBuffer = xbuf.Small
+		b.GCPercent = 50
+	}
+	if limit < Tight {
+		b.GCPercent = 10
+		b.ReleaseEvery = time.Minute
+	}
+	return b
+}
+
+func clamp(n int64, lo int64, hi int64) int {
+	if n < lo {
+		return int(lo)
+	}
+	if n > hi {
+		return int(hi)
+	}
+	return int(n)
+}
+
+var (
+	mu   sync.Mutex
+	gc   = -1 // gc percent before the first limit, or -1 if unset
+	stop chan struct{}
+)
+
+// SetLimit sets the gc, and the release of memory to the OS, to the budget
+// of `limit` bytes, or, if it is 0 or less, back as they were, and returns
+// the budget, for the tunnel to size its caches by.
+func SetLimit(limit int64) Budget {
+	b := BudgetOf(limit)
+	mu.Lock()
+	defer mu.Unlock()
+	if b.GCPercent > 0 {
+		prev := debug.SetGCPercent(b.GCPercent)
+		if gc < 0 {
+			gc = prev
+		}
+	} else if gc >= 0 {
+		debug.SetGCPercent(gc)
+		gc = -1
+	}
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+	if b.ReleaseEvery > 0 {
+		stop = make(chan struct{})
+		go releaseEvery(b.ReleaseEvery, stop)
+	}
+	log.Infof("memory limit %d: %+v", limit, b)
+	return b
+}
+
+// releaseEvery calls Release every `d` till `stop` closes.
+func releaseEvery(d time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			Release()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Release runs the gc, and returns as much memory as it can to the OS.
+func Release() {
+	debug.FreeOSMemory()
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memory
+
+import (
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/xbuf"
+)
+
+func TestBudgetOf(t *testing.T) {
+	none := BudgetOf(0)
+	if none.DNSCacheSize != 0 || none.UDPSessions != 0 || none.GCPercent != 0 || none.RelayBuffer != xbuf.Medium {
+		t.Errorf("no limit: %+v", none)
+	}
+	ios := BudgetOf(15 << 20)
+	if ios.GCPercent != 10 || ios.ReleaseEvery != time.Minute || ios.RelayBuffer != xbuf.Small {
+		t.Errorf("15MB: %+v", ios)
+	}
+	if ios.DNSCacheSize != 960 || ios.UDPSessions != 120 {
+		t.Errorf("15MB sizes: %+v", ios)
+	}
+	big := BudgetOf(4 << 30)
+	if big.DNSCacheSize != 4096 || big.UDPSessions != 4096 || big.ReleaseEvery != 0 || big.RelayBuffer != xbuf.Medium {
+		t.Errorf("4GB: %+v", big)
+	}
+	tiny := BudgetOf(1 << 20)
+	if tiny.DNSCacheSize != 64 || tiny.UDPSessions != 32 {
+		t.Errorf("1MB: %+v", tiny)
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	before := debug.SetGCPercent(100)
+	debug.SetGCPercent(before)
+
+	SetLimit(15 << 20)
+	if stop == nil {
+		t.Error("no release loop")
+	}
+	SetLimit(64 << 20)
+	if stop != nil {
+		t.Error("release loop not stopped")
+	}
+	if gc := debug.SetGCPercent(50); gc != 50 {
+		t.Errorf("gc percent %d", gc)
+	}
+	SetLimit(0)
+	if gc := debug.SetGCPercent(before); gc != before {
+		t.Errorf("gc percent %d not restored to %d", gc, before)
+	}
+}
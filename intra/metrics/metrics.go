@@ -0,0 +1,198 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package metrics counts queries, errors, dial retries, and bytes tunneled,
+// and exports them, along with goroutines and the resources accounted by
+// package diag, in the Prometheus text exposition format, either from Text
+// or from a local http endpoint started with Serve.
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/diag"
+)
+
+// Counters firestack exports.
+const (
+	// DNSQueries counts dns queries by transport ("doh", "dnscrypt") and
+	// status (doh.Complete, doh.SendFailed, and so on).
+	DNSQueries = "firestack_dns_queries_total"
+	// DialRetries counts connections retried with their first segment split.
+	DialRetries = "firestack_dial_retries_total"
+	// TunnelBytes counts bytes tunneled by proto ("tcp", "udp") and
+	// direction ("up", "down").
+	TunnelBytes = "firestack_tunnel_bytes_total"
+	// DNSRateLimited counts dns queries refused, unsent, by the url of the
+	// transport whose rate limit they're over.
+	DNSRateLimited = "firestack_dns_rate_limited_total"
+)
+
+var help = map[string]string{
+	DNSQueries:     "DNS queries by transport and status.",
+	DialRetries:    "Connections retried with a split ClientHello.",
+	TunnelBytes:    "Bytes tunneled by protocol and direction.",
+	DNSRateLimited: "DNS queries refused over rate limits, by transport.",
+}
+
+var (
+	mu sync.RWMutex
+	// all holds counters by name, then by labels.
+	all = make(map[string]map[string]*int64)
+)
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString formats labels, pairs of names and values, like {k="v"}.
+func labelString(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func counter(name string, labels []string) *int64 {
+	l := labelString(labels)
+	mu.RLock()
+	c := all[name][l]
+	mu.RUnlock()
+	if c != nil {
+		return c
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	f := all[name]
+	if f == nil {
+		f = make(map[string]*int64)
+		all[name] = f
+	}
+	if c = f[l]; c == nil {
+		c = new(int64)
+		f[l] = c
+	}
+	return c
+}
+
+// Add adds n to the counter `name` with `labels`, pairs of label names and
+// values, as in Add(DNSQueries, 1, "transport", "doh", "status", "0").
+func Add(name string, n int64, labels ...string) {
+	atomic.AddInt64(counter(name, labels), n)
+}
+
+// Get returns the value of the counter `name` with `labels`.
+func Get(name string, labels ...string) int64 {
+	return atomic.LoadInt64(counter(name, labels))
+}
+
+func sortedKeys(m map[string]*int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(b *strings.Builder, name, typ, desc string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, desc, name, typ)
+}
+
+// Text returns all metrics in the Prometheus text exposition format.
+func Text() string {
+	var b strings.Builder
+
+	mu.RLock()
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	mu.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		writeHeader(&b, name, "counter", help[name])
+		mu.RLock()
+		f := all[name]
+		labels := sortedKeys(f)
+		mu.RUnlock()
+		for _, l := range labels {
+			fmt.Fprintf(&b, "%s%s %d\n", name, l, atomic.LoadInt64(f[l]))
+		}
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	writeHeader(&b, "firestack_goroutines", "gauge", "Goroutines in the process.")
+	fmt.Fprintf(&b, "firestack_goroutines %d\n", runtime.NumGoroutine())
+	writeHeader(&b, "firestack_heap_bytes", "gauge", "Bytes of allocated heap objects.")
+	fmt.Fprintf(&b, "firestack_heap_bytes %d\n", ms.HeapAlloc)
+
+	subs := diag.Subsystems()
+	usage := make([]diag.Usage, len(subs))
+	for i, sub := range subs {
+		usage[i] = diag.Get(sub)
+	}
+	gauges := []struct {
+		name string
+		desc string
+		of   func(diag.Usage) int64
+	}{
+		{"firestack_subsystem_goroutines", "Goroutines held by subsystem.", func(u diag.Usage) int64 { return u.Goroutines }},
+		{"firestack_subsystem_sockets", "Sockets held by subsystem.", func(u diag.Usage) int64 { return u.Sockets }},
+		{"firestack_subsystem_buffers", "Buffers held by subsystem.", func(u diag.Usage) int64 { return u.Buffers }},
+	}
+	for _, g := range gauges {
+		writeHeader(&b, g.name, "gauge", g.desc)
+		for i, sub := range subs {
+			fmt.Fprintf(&b, "%s%s %d\n", g.name, labelString([]string{"subsystem", sub}), g.of(usage[i]))
+		}
+	}
+	return b.String()
+}
+
+// Server serves metrics over http at /metrics.
+type Server struct {
+	srv *http.Server
+	ln  net.Listener
+}
+
+// Serve starts serving metrics at http://`addr`/metrics, where addr is
+// an ip:port, like "127.0.0.1:9100"; port 0 picks a free port.
+func Serve(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, Text())
+	})
+	s := &Server{srv: &http.Server{Handler: mux}, ln: ln}
+	go s.srv.Serve(ln)
+	return s, nil
+}
+
+// Addr returns the ip:port s listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops serving metrics.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/celzero/firestack/intra/diag"
+)
+
+func TestText(t *testing.T) {
+	Add(DNSQueries, 1, "transport", "doh", "status", "0")
+	Add(DNSQueries, 2, "transport", "doh", "status", "0")
+	Add(DNSQueries, 1, "transport", "doh", "status", "1")
+	Add(TunnelBytes, 100, "proto", "tcp", "dir", "up")
+	diag.SocketOpened("test-metrics")
+
+	if n := Get(DNSQueries, "transport", "doh", "status", "0"); n != 3 {
+		t.Errorf("Expected 3 queries, got %d", n)
+	}
+
+	text := Text()
+	for _, want := range []string{
+		"# TYPE firestack_dns_queries_total counter\n",
+		`firestack_dns_queries_total{transport="doh",status="0"} 3` + "\n",
+		`firestack_dns_queries_total{transport="doh",status="1"} 1` + "\n",
+		`firestack_tunnel_bytes_total{proto="tcp",dir="up"} 100` + "\n",
+		`firestack_subsystem_sockets{subsystem="test-metrics"} 1` + "\n",
+		"# TYPE firestack_goroutines gauge\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Missing %q in:\n%s", want, text)
+		}
+	}
+}
+
+func TestLabelEscape(t *testing.T) {
+	if l := labelString([]string{"k", "a\"b\\c\n"}); l != `{k="a\"b\\c\n"}` {
+		t.Errorf("Bad escape %s", l)
+	}
+	if l := labelString(nil); l != "" {
+		t.Errorf("Expected no labels, got %s", l)
+	}
+}
+
+func TestServe(t *testing.T) {
+	Add(DialRetries, 1)
+	s, err := Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	resp, err := http.Get("http://" + s.Addr() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "firestack_dial_retries_total ") {
+		t.Errorf("Missing dial retries in:\n%s", body)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package outbound
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+// ErrAuthRejected is a proxy that refused the credentials it was sent.
+var ErrAuthRejected = errors.New("proxy rejected credentials")
+
+// Credentials provides the credentials of proxies, as the app rotates them.
+type Credentials interface {
+	// Credentials returns the username and password of proxy `name`, as
+	// "username:password", once it rejects the ones it has; or "" if there
+	// are no others.
+	Credentials(name string) string
+}
+
+// Refresher refreshes rejected credentials of proxies from the app's
+// Credentials, if set.  The zero Refresher refreshes none.
+type Refresher struct {
+	sync.RWMutex
+	c Credentials
+}
+
+// Set sets `c` to refresh credentials from; nil unsets it.
+func (r *Refresher) Set(c Credentials) {
+	r.Lock()
+	r.c = c
+	r.Unlock()
+}
+
+// fetch returns the credentials of proxy `name` from the app, or nil if
+// there are none, or r is nil.
+func (r *Refresher) fetch(name string) *proxy.Auth {
+	if r == nil {
+		return nil
+	}
+	r.RLock()
+	c := r.c
+	r.RUnlock()
+	if c == nil {
+		return nil
+	}
+	s := c.Credentials(name)
+	i := strings.Index(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return nil
+	}
+	return &proxy.Auth{User: s[:i], Password: s[i+1:]}
+}
+
+// auth is the credentials, if any, of proxy `name`, refreshed by r once
+// they're rejected.
+type auth struct {
+	sync.RWMutex
+	name string
+	a    *proxy.Auth
+	r    *Refresher
+}
+
+func newAuth(name string, a *proxy.Auth, r *Refresher) *auth {
+	return &auth{name: name, a: a, r: r}
+}
+
+func (x *auth) get() *proxy.Auth {
+	x.RLock()
+	defer x.RUnlock()
+	return x.a
+}
+
+// set sets the credentials to `a`; nil sends none.
+func (x *auth) set(a *proxy.Auth) {
+	x.Lock()
+	x.a = a
+	x.Unlock()
+}
+
+// refresh replaces rejected credentials, `was`, with the app's, and reports
+// whether they're new.  Of dials rejected at once, the first refreshes.
+func (x *auth) refresh(was *proxy.Auth) bool {
+	x.Lock()
+	defer x.Unlock()
+	if x.a != was {
+		return true
+	}
+	a := x.r.fetch(x.name)
+	if a == nil || (was != nil && *a == *was) {
+		return false
+	}
+	x.a = a
+	return true
+}
+
+// dial dials with `f` and the credentials; and, if they're rejected, once
+// more with the refreshed ones, if any.
+func (x *auth) dial(f func(*proxy.Auth) (net.Conn, error)) (net.Conn, error) {
+	a := x.get()
+	c, err := f(a)
+	if err == nil || !rejected(err) || !x.refresh(a) {
+		return c, err
+	}
+	return f(x.get())
+}
+
+// rejected reports whether err, of a dial through a proxy, is its refusal
+// of the credentials sent, as by x/net/proxy for socks5.
+func rejected(err error) bool {
+	return errors.Is(err, ErrAuthRejected) || strings.Contains(err.Error(), "username/password authentication failed")
+}
+
+// authOf returns the credentials `username` and `password`, or nil if
+// either isn't set.
+func authOf(username string, password string) *proxy.Auth {
+	if len(username) == 0 || len(password) == 0 {
+		return nil
+	}
+	return &proxy.Auth{User: username, Password: password}
+}
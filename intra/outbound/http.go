@@ -0,0 +1,127 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package outbound
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/celzero/firestack/intra/split"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// connectTimeout caps the CONNECT handshake with http proxies.
+	connectTimeout = 10 * time.Second
+	// maxConnectHeader caps the size of responses to CONNECT.
+	maxConnectHeader = 4096
+)
+
+// httpProxy connects flows through an http proxy with CONNECT, sending
+// its credentials, if any, as Basic Proxy-Authorization.
+type httpProxy struct {
+	addr    string
+	auth    *auth
+	forward proxy.Dialer
+}
+
+// NewHTTPDialer returns a dialer of tcp through the http proxy at `addr`,
+// an ip:port, with CONNECT, and credentials `a`, if any, refreshed by `r`,
+// if set, as those of proxy `name`, once they're rejected.  The proxy is
+// dialed with `d`, or, if nil, directly.
+func NewHTTPDialer(name string, addr string, a *proxy.Auth, r *Refresher, d proxy.Dialer) proxy.Dialer {
+	return &httpProxy{addr: addr, auth: newAuth(name, a, r), forward: orDirect(d)}
+}
+
+func (h *httpProxy) Kind() string {
+	return HTTP
+}
+
+func (h *httpProxy) DialTCP(addr string) (split.DuplexConn, error) {
+	c, err := h.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.TCPConn), nil
+}
+
+func (h *httpProxy) ListenUDP() (net.PacketConn, error) {
+	return nil, errNoUDP
+}
+
+// Dial connects to addr through the proxy; the conn is a *net.TCPConn.
+func (h *httpProxy) Dial(network string, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("http proxy: network %s not supported", network)
+	}
+	return h.auth.dial(func(a *proxy.Auth) (net.Conn, error) {
+		return connect(h.forward, h.addr, addr, a)
+	})
+}
+
+// connect asks the http proxy at `addr`, dialed with `d`, to CONNECT to
+// `target`.  The response is read a byte at a time, so that none of the
+// bytes after it are buffered away from the conn.
+func connect(d proxy.Dialer, addr string, target string, a *proxy.Auth) (net.Conn, error) {
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if a != nil {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(a.User+":"+a.Password)) + "\r\n"
+	}
+	req += "\r\n"
+	c.SetDeadline(time.Now().Add(connectTimeout))
+	if _, err := c.Write([]byte(req)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	head, err := readHeader(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusProxyAuthRequired:
+		c.Close()
+		return nil, ErrAuthRejected
+	case res.StatusCode/100 != 2:
+		c.Close()
+		return nil, fmt.Errorf("http proxy: connect to %s: %s", target, res.Status)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// readHeader reads the status line and headers of a response from c, upto
+// the blank line that ends them.
+func readHeader(c net.Conn) ([]byte, error) {
+	head := make([]byte, 0, 256)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) >= maxConnectHeader {
+			return nil, fmt.Errorf("http proxy: response header over %d bytes", maxConnectHeader)
+		}
+		if _, err := c.Read(b); err != nil {
+			return nil, err
+		}
+		head = append(head, b[0])
+	}
+	return head, nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package outbound
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// httpProxyAt serves CONNECT on a local port to any target, by echoing the
+// bytes tunneled, for clients with Basic credentials user:pass alone.
+func httpProxyAt(t *testing.T, user string, pass string) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var tries int32
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				req, err := http.ReadRequest(r)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				atomic.AddInt32(&tries, 1)
+				if req.Header.Get("Proxy-Authorization") != want {
+					io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(c, r)
+			}(c)
+		}
+	}()
+	return l.Addr().String(), &tries
+}
+
+type creds string
+
+func (c creds) Credentials(name string) string {
+	return string(c)
+}
+
+func TestHTTPConnect(t *testing.T) {
+	addr, _ := httpProxyAt(t, "u", "p")
+	ip, port, _ := net.SplitHostPort(addr)
+	o := NewOutbounds()
+	if err := o.AddURL("web", "http://u:p@"+addr); err != nil {
+		t.Fatal(err)
+	}
+	c, err := o.Get("web").DialTCP("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Errorf("echo %q, %v", b, err)
+	}
+	if err := o.AddHTTP("bad", "u", "wrong", ip, port); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Get("bad").DialTCP("example.com:443"); !errors.Is(err, ErrAuthRejected) {
+		t.Errorf("rejected credentials: %v", err)
+	}
+	if err := o.SetAuth("bad", "u", "p"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := o.Get("bad").DialTCP("example.com:443"); err != nil {
+		t.Errorf("set credentials: %v", err)
+	} else {
+		c.Close()
+	}
+	if err := o.SetAuth("nope", "u", "p"); err == nil {
+		t.Error("Expected error for missing outbound")
+	}
+}
+
+func TestCredentialsRefresh(t *testing.T) {
+	addr, tries := httpProxyAt(t, "u", "rotated")
+	ip, port, _ := net.SplitHostPort(addr)
+	o := NewOutbounds()
+	if err := o.AddHTTP("web", "u", "old", ip, port); err != nil {
+		t.Fatal(err)
+	}
+	o.SetCredentials(creds("u:old"))
+	if _, err := o.Get("web").DialTCP("example.com:443"); !errors.Is(err, ErrAuthRejected) {
+		t.Errorf("unchanged credentials: %v", err)
+	}
+	o.SetCredentials(creds("u:rotated"))
+	c, err := o.Get("web").DialTCP("example.com:443")
+	if err != nil {
+		t.Fatalf("refreshed credentials: %v", err)
+	}
+	c.Close()
+	// rejected, refreshed and retried; then sent the ones refreshed
+	if n := atomic.LoadInt32(tries); n != 3 {
+		t.Errorf("%d connects", n)
+	}
+	if c, err := o.Get("web").DialTCP("example.com:443"); err != nil {
+		t.Error(err)
+	} else {
+		c.Close()
+	}
+	if n := atomic.LoadInt32(tries); n != 4 {
+		t.Errorf("%d connects, refreshed credentials not kept", n)
+	}
+}
@@ -0,0 +1,433 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package outbound keeps named proxies that flows from the tunnel are
+// routed to, by the routes of the firewall, alongside the tunnel's own
+// direct connections and WireGuard peers.
+package outbound
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	shadowsocks "github.com/Jigsaw-Code/outline-ss-server/client"
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"golang.org/x/net/proxy"
+
+	"github.com/celzero/firestack/intra/split"
+	oss "github.com/celzero/firestack/shadowsocks"
+)
+
+// Names of the outbounds every tunnel has.
+const (
+	// Direct connects flows as if there were no routes, but for the proxy
+	// in-use, if any, which they bypass: directly, or as split.
+	Direct = "direct"
+	// WireGuard carries flows over the tunnel's WireGuard peers.
+	WireGuard = "wg"
+)
+
+// Kinds of outbounds.
+const (
+	SOCKS5      = "socks5"
+	HTTP        = "http"
+	Shadowsocks = "ss"
+)
+
+// Isolation of the streams of Tor outbounds, as in AddTor.
+const (
+	// IsolateNone lets Tor share circuits among all streams.
+	IsolateNone = 0
+	// IsolateDomain keeps streams to different domains on different circuits.
+	IsolateDomain = 1
+	// IsolateUID keeps streams of different apps on different circuits.
+	IsolateUID = 2
+	// IsolateBoth keeps streams apart by app, and by domain.
+	IsolateBoth = IsolateDomain | IsolateUID
+)
+
+var errNoUDP = errors.New("outbound does not support udp")
+
+// Outbound connects flows through a proxy.
+type Outbound interface {
+	// Kind is the kind of outbound, like SOCKS5.
+	Kind() string
+	// DialTCP connects to addr, an ip:port, through the proxy.
+	DialTCP(addr string) (split.DuplexConn, error)
+	// ListenUDP returns a conn that sends to, and receives from, any
+	// ip:port through the proxy.
+	ListenUDP() (net.PacketConn, error)
+}
+
+// Isolated is an outbound whose streams are kept apart by their domain, or
+// app, like a Tor outbound set to isolate them.
+type Isolated interface {
+	Outbound
+	// DialTCPFor is DialTCP of a flow to `domain`, "" if not known, from app
+	// `uid`, -1 if not known.
+	DialTCPFor(addr string, domain string, uid int) (split.DuplexConn, error)
+}
+
+// forward dials proxies themselves: with its dialer, once set, like the
+// tunnel's, whose sockets are protected from the VPN, or else directly.
+type forward struct {
+	sync.RWMutex
+	d proxy.Dialer
+}
+
+// set sets d to dial proxies with; nil dials them directly.
+func (f *forward) set(d *net.Dialer) {
+	f.Lock()
+	defer f.Unlock()
+	if d == nil {
+		f.d = nil
+	} else {
+		f.d = d
+	}
+}
+
+// Dial implements proxy.Dialer.
+func (f *forward) Dial(network string, addr string) (net.Conn, error) {
+	f.RLock()
+	d := f.d
+	f.RUnlock()
+	if d == nil {
+		d = proxy.Direct
+	}
+	return d.Dial(network, addr)
+}
+
+// socks5 connects flows through a socks5 proxy, dialed anew with the
+// credentials of each flow: its own, or, of Tor outbounds that isolate
+// streams, those of its isolation key.
+type socks5 struct {
+	addr    string
+	auth    *auth
+	isolate int
+	forward proxy.Dialer
+}
+
+// NewSOCKS5Dialer returns a dialer of tcp through the socks5 proxy at
+// `addr`, an ip:port, with credentials `a`, if any, refreshed by `r`, if
+// set, as those of proxy `name`, once they're rejected.  The proxy is
+// dialed with `d`, or, if nil, directly.
+func NewSOCKS5Dialer(name string, addr string, a *proxy.Auth, r *Refresher, d proxy.Dialer) proxy.Dialer {
+	return &socks5{addr: addr, auth: newAuth(name, a, r), forward: orDirect(d)}
+}
+
+// orDirect returns d, or, if nil, proxy.Direct.
+func orDirect(d proxy.Dialer) proxy.Dialer {
+	if d == nil {
+		return proxy.Direct
+	}
+	return d
+}
+
+func (s *socks5) Kind() string {
+	return SOCKS5
+}
+
+func (s *socks5) DialTCP(addr string) (split.DuplexConn, error) {
+	c, err := s.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.tcp(c, addr)
+}
+
+// Dial connects to addr through the proxy; the conn is a *net.TCPConn.
+func (s *socks5) Dial(network string, addr string) (net.Conn, error) {
+	return s.auth.dial(func(a *proxy.Auth) (net.Conn, error) {
+		d, err := proxy.SOCKS5("tcp", s.addr, a, s.forward)
+		if err != nil {
+			return nil, err
+		}
+		return d.Dial(network, addr)
+	})
+}
+
+// DialTCPFor dials addr with socks auth of its isolation key, which Tor,
+// as it does by default (IsolateSOCKSAuth), takes to put streams of other
+// keys on other circuits.
+func (s *socks5) DialTCPFor(addr string, domain string, uid int) (split.DuplexConn, error) {
+	if s.isolate == IsolateNone {
+		return s.DialTCP(addr)
+	}
+	d, err := proxy.SOCKS5("tcp", s.addr, isolationAuth(s.isolate, addr, domain, uid), s.forward)
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.tcp(c, addr)
+}
+
+// isolationAuth returns the socks auth of the isolation key of a flow to
+// addr: its app, as the username, and its domain, or else its host, as the
+// password; each "*" if not isolated on.
+func isolationAuth(isolate int, addr string, domain string, uid int) *proxy.Auth {
+	auth := &proxy.Auth{User: "*", Password: "*"}
+	if isolate&IsolateUID != 0 && uid >= 0 {
+		auth.User = "uid-" + strconv.Itoa(uid)
+	}
+	if isolate&IsolateDomain != 0 {
+		if len(domain) == 0 {
+			domain, _, _ = net.SplitHostPort(addr)
+		}
+		if domain = strings.ToLower(strings.TrimSuffix(domain, ".")); len(domain) > 0 && len(domain) <= 255 {
+			auth.Password = domain
+		}
+	}
+	return auth
+}
+
+func (s *socks5) tcp(c net.Conn, addr string) (split.DuplexConn, error) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		return tc, nil
+	}
+	c.Close()
+	return nil, fmt.Errorf("socks5 conn to %s not tcp", addr)
+}
+
+// ListenUDP is unsupported: x/net/proxy has no udp associate.
+func (s *socks5) ListenUDP() (net.PacketConn, error) {
+	return nil, errNoUDP
+}
+
+type ss struct {
+	c shadowsocks.Client
+}
+
+func (s *ss) Kind() string {
+	return Shadowsocks
+}
+
+func (s *ss) DialTCP(addr string) (split.DuplexConn, error) {
+	c, err := s.c.DialTCP(nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &ssConn{c}, nil
+}
+
+func (s *ss) ListenUDP() (net.PacketConn, error) {
+	return s.c.ListenUDP(nil)
+}
+
+// ssConn is a shadowsocks conn that is a split.DuplexConn.
+type ssConn struct {
+	onet.DuplexConn
+}
+
+func (c *ssConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.DuplexConn, r)
+}
+
+// Outbounds is a set of outbounds, by name.
+type Outbounds struct {
+	sync.RWMutex
+	m     map[string]Outbound
+	creds *Refresher
+	fwd   *forward
+}
+
+// NewOutbounds returns an empty set of outbounds.
+func NewOutbounds() *Outbounds {
+	return &Outbounds{m: make(map[string]Outbound), creds: &Refresher{}, fwd: &forward{}}
+}
+
+// SetDialer sets `d` to dial the proxies of all outbounds with, like that
+// of protect.MakeDialer, so that their sockets are protected from the VPN;
+// nil dials them directly.  Tunnels set their own dialer on the outbounds
+// set on them.
+func (o *Outbounds) SetDialer(d *net.Dialer) {
+	o.fwd.set(d)
+}
+
+// SetCredentials sets `c` to provide the socks5 and http outbounds with
+// new credentials once theirs are rejected; nil unsets it.
+func (o *Outbounds) SetCredentials(c Credentials) {
+	o.creds.Set(c)
+}
+
+// SetAuth sets the credentials of socks5 or http outbound `name` to
+// `username` and `password`, or none, if either is empty, for its next flows.
+func (o *Outbounds) SetAuth(name string, username string, password string) error {
+	var x *auth
+	switch ob := o.Get(name).(type) {
+	case *socks5:
+		if ob.isolate == IsolateNone {
+			x = ob.auth
+		}
+	case *httpProxy:
+		x = ob.auth
+	}
+	if x == nil {
+		return fmt.Errorf("outbound %s has no credentials to set", name)
+	}
+	x.set(authOf(username, password))
+	return nil
+}
+
+func (o *Outbounds) add(name string, ob Outbound) error {
+	if len(name) == 0 || strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("bad outbound name %q", name)
+	}
+	if name == Direct || name == WireGuard {
+		return fmt.Errorf("outbound name %s reserved", name)
+	}
+	o.Lock()
+	o.m[name] = ob
+	o.Unlock()
+	return nil
+}
+
+// AddSOCKS5 adds, or replaces, outbound `name`: a socks5 proxy at ip:port,
+// authenticated with `username` and `password`, if set.  It carries tcp alone.
+func (o *Outbounds) AddSOCKS5(name string, username string, password string, ip string, port string) error {
+	return o.add(name, NewSOCKS5Dialer(name, net.JoinHostPort(ip, port), authOf(username, password), o.creds, o.fwd).(*socks5))
+}
+
+// AddHTTP adds, or replaces, outbound `name`: an http proxy at ip:port,
+// tunneled through with CONNECT, and authenticated with `username` and
+// `password`, if set, as Basic Proxy-Authorization.  It carries tcp alone.
+func (o *Outbounds) AddHTTP(name string, username string, password string, ip string, port string) error {
+	return o.add(name, NewHTTPDialer(name, net.JoinHostPort(ip, port), authOf(username, password), o.creds, o.fwd).(*httpProxy))
+}
+
+// AddTor adds, or replaces, outbound `name`: the socks port of Tor at
+// ip:port, with its streams isolated by `isolate`, one of the Isolate*
+// values, so that unrelated flows don't share circuits.  It carries tcp alone.
+func (o *Outbounds) AddTor(name string, ip string, port string, isolate int) error {
+	if isolate < IsolateNone || isolate > IsolateBoth {
+		return fmt.Errorf("bad tor isolation %d", isolate)
+	}
+	return o.add(name, &socks5{addr: net.JoinHostPort(ip, port), auth: newAuth(name, nil, nil), isolate: isolate, forward: o.fwd})
+}
+
+// AddShadowsocks adds, or replaces, outbound `name`: a shadowsocks proxy at
+// host:port, with `password` and `cipher`, like "chacha20-ietf-poly1305".
+func (o *Outbounds) AddShadowsocks(name string, host string, port int, password string, cipher string) error {
+	return o.addShadowsocks(name, &oss.Config{Host: host, Port: port, Password: password, Cipher: cipher})
+}
+
+// AddShadowsocksPlugin is like AddShadowsocks, but for a proxy whose streams
+// are wrapped by the SIP003 `plugin` with `opts`, like "obfs-local" with
+// "obfs=http;obfs-host=example.com", or "v2ray-plugin" with
+// "tls;host=example.com".  It carries tcp alone, as plugins do.
+func (o *Outbounds) AddShadowsocksPlugin(name string, host string, port int, password string, cipher string, plugin string, opts string) error {
+	return o.addShadowsocks(name, &oss.Config{Host: host, Port: port, Password: password, Cipher: cipher, Plugin: plugin, PluginOpts: opts})
+}
+
+// AddShadowsocksURL adds, or replaces, outbound `name`: the shadowsocks
+// proxy at `url`, an ss:// url or Outline access key, with its plugin, if any.
+func (o *Outbounds) AddShadowsocksURL(name string, url string) error {
+	c, err := oss.ParseURL(url)
+	if err != nil {
+		return err
+	}
+	return o.addShadowsocks(name, c)
+}
+
+// AddURL adds, or replaces, outbound `name`: the proxy at `rawurl`, a
+// socks5:// or http://[user:password@]ip:port url, a tor://ip:port[?isolate=domain|uid|both]
+// url of a Tor socks port, as with AddTor, or a shadowsocks url, as with
+// AddShadowsocksURL.
+func (o *Outbounds) AddURL(name string, rawurl string) error {
+	if strings.HasPrefix(strings.ToLower(rawurl), "ss://") {
+		return o.AddShadowsocksURL(name, rawurl)
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "tor" {
+		isolate, ok := isolations[u.Query().Get("isolate")]
+		if !ok {
+			return fmt.Errorf("bad tor isolation %q", u.Query().Get("isolate"))
+		}
+		return o.AddTor(name, u.Hostname(), u.Port(), isolate)
+	}
+	password, _ := u.User.Password()
+	switch u.Scheme {
+	case SOCKS5:
+		return o.AddSOCKS5(name, u.User.Username(), password, u.Hostname(), u.Port())
+	case HTTP:
+		return o.AddHTTP(name, u.User.Username(), password, u.Hostname(), u.Port())
+	}
+	return fmt.Errorf("unsupported outbound url scheme %q", u.Scheme)
+}
+
+// isolations are the isolations of tor:// urls, by name.
+var isolations = map[string]int{
+	"":       IsolateNone,
+	"none":   IsolateNone,
+	"domain": IsolateDomain,
+	"uid":    IsolateUID,
+	"both":   IsolateBoth,
+}
+
+// CheckShadowsocks checks whether the shadowsocks proxy at `url`, an ss://
+// url or Outline access key, is reachable, relays tcp once authenticated,
+// and relays udp, and times each; and returns the report, as json, like
+// {"reachable":true,"connect_ms":42,"authenticated":true,"relay_ms":120,
+// "udp":false,"udp_ms":0,"error":"..."}.  It blocks till the checks are
+// done, for some seconds if they time out.
+func CheckShadowsocks(url string) string {
+	c, err := oss.ParseURL(url)
+	if err != nil {
+		return (&oss.Report{Error: err.Error()}).JSON()
+	}
+	return oss.Check(c).JSON()
+}
+
+func (o *Outbounds) addShadowsocks(name string, cfg *oss.Config) error {
+	c, err := oss.NewClientWithDialer(cfg, o.fwd)
+	if err != nil {
+		return err
+	}
+	return o.add(name, &ss{c})
+}
+
+// Remove removes outbound `name`, and reports whether there was one.
+func (o *Outbounds) Remove(name string) bool {
+	o.Lock()
+	defer o.Unlock()
+	_, ok := o.m[name]
+	delete(o.m, name)
+	return ok
+}
+
+// Get returns outbound `name`, or nil if there's none, or o is nil.
+func (o *Outbounds) Get(name string) Outbound {
+	if o == nil {
+		return nil
+	}
+	o.RLock()
+	defer o.RUnlock()
+	return o.m[name]
+}
+
+// Names returns the csv of name:kind of outbounds, sorted by name.
+func (o *Outbounds) Names() string {
+	o.RLock()
+	defer o.RUnlock()
+	s := make([]string, 0, len(o.m))
+	for name, ob := range o.m {
+		s = append(s, name+":"+ob.Kind())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
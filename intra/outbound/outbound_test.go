@@ -0,0 +1,207 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package outbound
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+func TestOutbounds(t *testing.T) {
+	o := NewOutbounds()
+	if err := o.AddSOCKS5("tor", "", "", "127.0.0.1", "9050"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.AddShadowsocks("ss1", "127.0.0.1", 8388, "secret", "chacha20-ietf-poly1305"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.AddShadowsocks("ss2", "127.0.0.1", 8388, "secret", "rot13"); err == nil {
+		t.Error("Expected error for bad cipher")
+	}
+	if err := o.AddShadowsocksPlugin("obfs", "127.0.0.1", 8388, "secret", "chacha20-ietf-poly1305", "obfs-local", "obfs=http"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Get("obfs").ListenUDP(); err == nil {
+		t.Error("Expected plugin udp to be unsupported")
+	}
+	if err := o.AddShadowsocksURL("v2", "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpzZWNyZXQ@127.0.0.1:443/?plugin=v2ray-plugin%3Btls"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.AddShadowsocksURL("ss3", "ss://127.0.0.1:443"); err == nil {
+		t.Error("Expected error for bad url")
+	}
+	if err := o.AddURL("tor2", "socks5://u:p@127.0.0.1:9050"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.AddURL("web", "https://127.0.0.1:443"); err == nil {
+		t.Error("Expected error for unsupported scheme")
+	}
+	for _, name := range []string{"", "two words", Direct, WireGuard} {
+		if err := o.AddSOCKS5(name, "", "", "127.0.0.1", "1080"); err == nil {
+			t.Errorf("Expected error for name %q", name)
+		}
+	}
+	if n := o.Names(); n != "obfs:ss,ss1:ss,tor2:socks5,tor:socks5,v2:ss" {
+		t.Errorf("Wrong names %s", n)
+	}
+	if _, err := o.Get("tor").ListenUDP(); err == nil {
+		t.Error("Expected socks5 udp to be unsupported")
+	}
+	if !o.Remove("tor") || o.Remove("tor") || o.Get("tor") != nil {
+		t.Error("Outbound not removed")
+	}
+	var nilo *Outbounds
+	if nilo.Get("ss1") != nil {
+		t.Error("Nil outbounds should have none")
+	}
+}
+
+func TestOutboundsDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	ip, port, _ := net.SplitHostPort(l.Addr().String())
+	var dials int32
+	o := NewOutbounds()
+	o.SetDialer(&net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		atomic.AddInt32(&dials, 1)
+		return nil
+	}})
+	if err := o.AddSOCKS5("socks", "", "", ip, port); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.AddHTTP("http", "", "", ip, port); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.AddShadowsocks("ss", ip, 8388, "secret", "chacha20-ietf-poly1305"); err != nil {
+		t.Fatal(err)
+	}
+	// Proxies that close connections fail the dials, but only once dialed.
+	for _, name := range []string{"socks", "http"} {
+		o.Get(name).DialTCP("example.com:80")
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("%d of 2 dials through the dialer", n)
+	}
+	if c, err := o.Get("ss").ListenUDP(); err == nil {
+		c.Close()
+	}
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Errorf("%d of 3 dials through the dialer", n)
+	}
+}
+
+func TestIsolationAuth(t *testing.T) {
+	for _, c := range []struct {
+		isolate    int
+		addr       string
+		domain     string
+		uid        int
+		user, pass string
+	}{
+		{IsolateDomain, "1.2.3.4:443", "Example.com.", 10123, "*", "example.com"},
+		{IsolateDomain, "1.2.3.4:443", "", 10123, "*", "1.2.3.4"},
+		{IsolateUID, "1.2.3.4:443", "example.com", 10123, "uid-10123", "*"},
+		{IsolateUID, "1.2.3.4:443", "example.com", -1, "*", "*"},
+		{IsolateBoth, "1.2.3.4:443", "example.com", 10123, "uid-10123", "example.com"},
+	} {
+		a := isolationAuth(c.isolate, c.addr, c.domain, c.uid)
+		if a.User != c.user || a.Password != c.pass {
+			t.Errorf("isolation %d of %s %s %d: %s:%s", c.isolate, c.addr, c.domain, c.uid, a.User, a.Password)
+		}
+	}
+}
+
+// socksAuths serves socks5 on a local port, refusing every connect once it
+// has the username and password of the client, which it sends to auths.
+func socksAuths(t *testing.T, auths chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				b := make([]byte, 512)
+				// greeting: ver, nmethods, methods; choose user/pass
+				if _, err := io.ReadFull(c, b[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(c, b[:b[1]]); err != nil {
+					return
+				}
+				c.Write([]byte{5, 2})
+				// auth: ver, ulen, user, plen, pass
+				if _, err := io.ReadFull(c, b[:2]); err != nil {
+					return
+				}
+				user := make([]byte, b[1])
+				io.ReadFull(c, user)
+				io.ReadFull(c, b[:1])
+				pass := make([]byte, b[0])
+				io.ReadFull(c, pass)
+				auths <- string(user) + ":" + string(pass)
+				c.Write([]byte{1, 1})
+			}(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTorIsolation(t *testing.T) {
+	auths := make(chan string, 4)
+	ip, port, _ := net.SplitHostPort(socksAuths(t, auths))
+	o := NewOutbounds()
+	if err := o.AddURL("tor", "tor://"+net.JoinHostPort(ip, port)+"?isolate=both"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.AddURL("tor2", "tor://127.0.0.1:9050?isolate=app"); err == nil {
+		t.Error("Expected error for bad isolation")
+	}
+	if err := o.AddTor("tor3", "127.0.0.1", "9050", 4); err == nil {
+		t.Error("Expected error for bad isolation")
+	}
+	iso, ok := o.Get("tor").(Isolated)
+	if !ok {
+		t.Fatal("tor outbound not isolated")
+	}
+	for _, c := range []struct {
+		domain string
+		uid    int
+		want   string
+	}{
+		{"a.example", 1, "uid-1:a.example"},
+		{"b.example", 2, "uid-2:b.example"},
+	} {
+		if _, err := iso.DialTCPFor("1.2.3.4:443", c.domain, c.uid); err == nil {
+			t.Error("Expected refused connect")
+		}
+		if got := <-auths; got != c.want {
+			t.Errorf("auth %s, not %s", got, c.want)
+		}
+	}
+}
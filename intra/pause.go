@@ -0,0 +1,82 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"sync"
+	"time"
+)
+
+// pause holds back flows while the tunnel is paused.  Pauses may expire
+// on their own, after which resumed is called.  A nil pause is never on.
+type pause struct {
+	sync.RWMutex
+	on        bool
+	cacheOnly bool
+	gen       int // counts pauses, so that stale timers are told apart
+	timer     *time.Timer
+}
+
+// paused reports whether flows are held back, and if so, whether dns
+// queries may yet be answered from cache.
+func (p *pause) paused() (on bool, cacheOnly bool) {
+	if p == nil {
+		return false, false
+	}
+	p.RLock()
+	defer p.RUnlock()
+	return p.on, p.on && p.cacheOnly
+}
+
+// start pauses for d, or until stop if d is 0, and calls resumed once the
+// pause expires.  Reports whether p wasn't already on.
+func (p *pause) start(cacheOnly bool, d time.Duration, resumed func()) bool {
+	p.Lock()
+	defer p.Unlock()
+	started := !p.on
+	p.on = true
+	p.cacheOnly = cacheOnly
+	p.gen++
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if d > 0 {
+		gen := p.gen
+		p.timer = time.AfterFunc(d, func() {
+			if p.expire(gen) {
+				resumed()
+			}
+		})
+	}
+	return started
+}
+
+// expire stops the pause numbered gen, if it's still on.
+func (p *pause) expire(gen int) bool {
+	p.Lock()
+	defer p.Unlock()
+	if !p.on || p.gen != gen {
+		return false
+	}
+	p.on = false
+	p.timer = nil
+	return true
+}
+
+// stop unpauses, and reports whether p was on.
+func (p *pause) stop() bool {
+	p.Lock()
+	defer p.Unlock()
+	stopped := p.on
+	p.on = false
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	return stopped
+}
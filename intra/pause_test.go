@@ -0,0 +1,78 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPause(t *testing.T) {
+	p := &pause{}
+	if on, _ := p.paused(); on {
+		t.Fatal("paused")
+	}
+	if !p.start(true, 0, nil) {
+		t.Error("not started")
+	}
+	if on, cacheOnly := p.paused(); !on || !cacheOnly {
+		t.Errorf("paused %t, cache-only %t", on, cacheOnly)
+	}
+	if p.start(false, 0, nil) {
+		t.Error("started twice")
+	}
+	if _, cacheOnly := p.paused(); cacheOnly {
+		t.Error("cache-only not updated")
+	}
+	if !p.stop() {
+		t.Error("not stopped")
+	}
+	if p.stop() {
+		t.Error("stopped twice")
+	}
+	if on, cacheOnly := p.paused(); on || cacheOnly {
+		t.Errorf("paused %t, cache-only %t after stop", on, cacheOnly)
+	}
+}
+
+func TestPauseExpires(t *testing.T) {
+	p := &pause{}
+	resumed := make(chan struct{})
+	p.start(false, 10*time.Millisecond, func() { close(resumed) })
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("not resumed")
+	}
+	if on, _ := p.paused(); on {
+		t.Error("paused after expiry")
+	}
+}
+
+func TestPauseStaleTimer(t *testing.T) {
+	p := &pause{}
+	stale := make(chan struct{}, 1)
+	p.start(false, 10*time.Millisecond, func() { stale <- struct{}{} })
+	// a pause till resumed replaces the one that expires
+	p.start(false, 0, nil)
+	time.Sleep(30 * time.Millisecond)
+	if on, _ := p.paused(); !on {
+		t.Error("resumed by a stale timer")
+	}
+	select {
+	case <-stale:
+		t.Error("stale timer fired")
+	default:
+	}
+}
+
+func TestPauseNil(t *testing.T) {
+	var p *pause
+	if on, cacheOnly := p.paused(); on || cacheOnly {
+		t.Error("nil pause on")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package portal
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/events"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/miekg/dns"
+)
+
+// DefaultDuration is how long portal mode lasts, unless told otherwise.
+const DefaultDuration = 5 * time.Minute
+
+// Mode is portal mode: for a while, queries for the domains of a captive
+// portal, and for names under them, go to the network's resolver, which
+// the portal answers, and aren't blocked, as blocklists aren't set on it.
+type Mode struct {
+	sync.RWMutex
+	domains  map[string]bool // canonical names
+	resolver dnsx.Transport
+	timer    *time.Timer
+	gen      int // of the timer, bumped on each Enter
+}
+
+// NewMode returns a Mode that is off.
+func NewMode() *Mode {
+	return &Mode{}
+}
+
+// Enter turns m on, for `domains`, with queries for them sent to `resolver`,
+// for `d`, or, if 0 or less, DefaultDuration; entering m while on restarts it
+// with the new domains.
+func (m *Mode) Enter(domains []string, resolver dnsx.Transport, d time.Duration) error {
+	if resolver == nil {
+		return errors.New("portal: no resolver")
+	}
+	set := make(map[string]bool)
+	for _, domain := range domains {
+		domain = strings.TrimPrefix(strings.TrimSpace(domain), "*.")
+		if _, ok := dns.IsDomainName(domain); !ok || len(domain) == 0 || domain == "." {
+			return errors.New("portal: invalid domain " + domain)
+		}
+		set[dns.CanonicalName(domain)] = true
+	}
+	if len(set) == 0 {
+		return errors.New("portal: no domains")
+	}
+	if d <= 0 {
+		d = DefaultDuration
+	}
+	m.Lock()
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.domains, m.resolver = set, resolver
+	m.gen++
+	gen := m.gen
+	m.timer = time.AfterFunc(d, func() {
+		m.expire(gen)
+	})
+	m.Unlock()
+	log.Infof("portal: mode on for %v: %v", d, domains)
+	events.Publish(events.PortalModeStarted, "portal", strings.Join(domains, ","))
+	return nil
+}
+
+// Exit turns m off, if on.
+func (m *Mode) Exit() {
+	m.Lock()
+	on := m.domains != nil
+	m.off()
+	m.Unlock()
+	if on {
+		log.Infof("portal: mode off")
+		events.Publish(events.PortalModeEnded, "portal", "")
+	}
+}
+
+// expire turns m off, if it is still on by the timer of Enter `gen`.
+func (m *Mode) expire(gen int) {
+	m.Lock()
+	current := m.timer != nil && m.gen == gen
+	if current {
+		m.off()
+	}
+	m.Unlock()
+	if current {
+		log.Infof("portal: mode expired")
+		events.Publish(events.PortalModeEnded, "portal", "")
+	}
+}
+
+// off turns m off; must be called under Lock.
+func (m *Mode) off() {
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.domains, m.resolver, m.timer = nil, nil, nil
+}
+
+// On reports whether m is on.
+func (m *Mode) On() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.domains != nil
+}
+
+// route returns the resolver for `name`, if m is on, and name is of a portal
+// domain, or else nil.
+func (m *Mode) route(name string) dnsx.Transport {
+	m.RLock()
+	defer m.RUnlock()
+	if m.domains == nil {
+		return nil
+	}
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if m.domains[name[off:]] {
+			return m.resolver
+		}
+	}
+	return nil
+}
+
+// relaxed sends queries for portal domains, while its Mode is on, to the
+// network's resolver, and the rest to the Transport it wraps.
+type relaxed struct {
+	dnsx.Transport
+	m *Mode
+}
+
+// Wrap returns a Transport that, while m is on, sends queries for portal
+// domains to m's resolver, and all others, and all queries while m is off,
+// to `t`.
+func (m *Mode) Wrap(t dnsx.Transport) dnsx.Transport {
+	return &relaxed{Transport: t, m: m}
+}
+
+// Inner implements dnsx.Wrapper.
+func (r *relaxed) Inner() dnsx.Transport {
+	return r.Transport
+}
+
+// Query implements dnsx.Transport.
+func (r *relaxed) Query(q []byte) ([]byte, error) {
+	if !r.m.On() {
+		return r.Transport.Query(q)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil || len(msg.Question) != 1 {
+		return r.Transport.Query(q)
+	}
+	if resolver := r.m.route(msg.Question[0].Name); resolver != nil {
+		return resolver.Query(q)
+	}
+	return r.Transport.Query(q)
+}
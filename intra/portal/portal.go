@@ -0,0 +1,225 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package portal detects captive portals, which hold networks hostage till
+// the user logs in, and which DoH, and blocklists, keep from loading; and
+// relaxes dns for the portal's domains for a while, so that it can.
+package portal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/celzero/firestack/intra/diag"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/events"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/miekg/dns"
+)
+
+// probeTimeout caps each probe, http or dns.
+const probeTimeout = 5 * time.Second
+
+// probe is a url that, off portals, answers with `status`, and a body that
+// has `body`, if set.
+type probe struct {
+	url    string
+	status int
+	body   string
+}
+
+// probes are tried in turn, till one is conclusive.
+var probes = []probe{
+	{url: "http://connectivitycheck.gstatic.com/generate_204", status: http.StatusNoContent},
+	{url: "http://captive.apple.com/hotspot-detect.html", status: http.StatusOK, body: "Success"},
+}
+
+// Reasons portals are detected for, as in Result.
+const (
+	// ReasonNone is no portal found.
+	ReasonNone = ""
+	// ReasonRedirect is a probe redirected, to the login url of the portal.
+	ReasonRedirect = "redirect"
+	// ReasonContent is a probe answered with content other than expected.
+	ReasonContent = "content"
+	// ReasonDNS is the network's resolver answering names that don't exist,
+	// as portals that rewrite NXDOMAINs to their own ip do.
+	ReasonDNS = "dns"
+	// ReasonUnreachable is no probe answering, portal or not.
+	ReasonUnreachable = "unreachable"
+)
+
+// Result is the outcome of Detect.
+type Result struct {
+	// Portal is whether a captive portal was found.
+	Portal bool `json:"portal"`
+	// Reason is why, as one of the Reason*.
+	Reason string `json:"reason"`
+	// URL is that of the login page of the portal, if known.
+	URL string `json:"url"`
+	// Domains are the domains of the portal, and of the probes, to relax dns
+	// for, as in Mode.Enter.
+	Domains []string `json:"domains"`
+}
+
+// JSON returns r as json.
+func (r *Result) JSON() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+// Detect probes for a captive portal with http requests, over `dialer`,
+// which must bypass the tunnel, and, if `resolver` isn't nil, with queries to
+// it, the network's resolver; a portal found is published as the event
+// events.PortalDetected.
+func Detect(dialer *net.Dialer, resolver dnsx.Transport) *Result {
+	r := detect(dialer, resolver)
+	if r.Portal {
+		log.Infof("portal: detected at %s (%s)", r.URL, r.Reason)
+		events.Publish(events.PortalDetected, r.URL, r.Reason)
+	}
+	return r
+}
+
+func detect(dialer *net.Dialer, resolver dnsx.Transport) *Result {
+	r := &Result{Domains: probeDomains()}
+	if resolver != nil && rewritesNXDomain(resolver) {
+		r.Portal, r.Reason = true, ReasonDNS
+	}
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true},
+		Timeout:   probeTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	reached := false
+	for _, p := range probes {
+		portal, login, err := p.try(client)
+		if err != nil {
+			log.Debugf("portal: probe %s: %v", p.url, err)
+			continue
+		}
+		reached = true
+		if !portal {
+			break
+		}
+		r.Portal = true
+		if len(login) > 0 {
+			r.Reason, r.URL = ReasonRedirect, login
+		} else {
+			r.Reason, r.URL = ReasonContent, p.url
+		}
+		if u, err := url.Parse(r.URL); err == nil && len(u.Hostname()) > 0 {
+			r.Domains = appendUnique(r.Domains, u.Hostname())
+		}
+		break
+	}
+	if !reached && !r.Portal {
+		r.Reason = ReasonUnreachable
+	}
+	return r
+}
+
+// try reports whether p finds a portal, and its login url, if it redirects;
+// or errs, if p couldn't be fetched.
+func (p probe) try(client *http.Client) (bool, string, error) {
+	res, err := client.Get(p.url)
+	if err != nil {
+		return false, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 && res.StatusCode < 400 {
+		login, err := res.Location()
+		if err != nil {
+			return true, "", nil
+		}
+		return true, login.String(), nil
+	}
+	if res.StatusCode != p.status {
+		return true, "", nil
+	}
+	if len(p.body) > 0 {
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		if err != nil {
+			return false, "", err
+		}
+		return !strings.Contains(string(body), p.body), "", nil
+	}
+	return false, "", nil
+}
+
+// rewritesNXDomain reports whether `resolver` answers a name that can't
+// exist with an address.
+func rewritesNXDomain(resolver dnsx.Transport) bool {
+	label := make([]byte, 8)
+	if _, err := rand.Read(label); err != nil {
+		return false
+	}
+	// names under example. never resolve (RFC 6761)
+	q, err := new(dns.Msg).SetQuestion(hex.EncodeToString(label)+".example.", dns.TypeA).Pack()
+	if err != nil {
+		return false
+	}
+	type answer struct {
+		r   []byte
+		err error
+	}
+	c := make(chan answer, 1)
+	diag.Go(diag.DNS, func() {
+		r, err := resolver.Query(q)
+		c <- answer{r, err}
+	})
+	var a answer
+	select {
+	case a = <-c:
+	case <-time.After(probeTimeout):
+		return false
+	}
+	if a.err != nil {
+		return false
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(a.r); err != nil {
+		return false
+	}
+	for _, rr := range msg.Answer {
+		if _, ok := rr.(*dns.A); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func probeDomains() []string {
+	var domains []string
+	for _, p := range probes {
+		if u, err := url.Parse(p.url); err == nil {
+			domains = appendUnique(domains, u.Hostname())
+		}
+	}
+	return domains
+}
+
+func appendUnique(s []string, v string) []string {
+	for _, x := range s {
+		if x == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package portal
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/miekg/dns"
+)
+
+// fakeResolver answers every A query with `ip`, or NXDOMAIN if nil.
+type fakeResolver struct {
+	ip      net.IP
+	queries int
+}
+
+func (f *fakeResolver) Query(q []byte) ([]byte, error) {
+	f.queries++
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg).SetReply(msg)
+	if f.ip == nil {
+		r.Rcode = dns.RcodeNameError
+	} else {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   f.ip,
+		})
+	}
+	return r.Pack()
+}
+
+func (f *fakeResolver) GetURL() string {
+	return "fake"
+}
+
+func (f *fakeResolver) SetBraveDNS(dnsx.BraveDNS) {}
+
+func withProbes(t *testing.T, h http.HandlerFunc) {
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	saved := probes
+	probes = []probe{{url: server.URL + "/generate_204", status: http.StatusNoContent}}
+	t.Cleanup(func() { probes = saved })
+}
+
+func TestDetectNone(t *testing.T) {
+	withProbes(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if r := detect(nil, &fakeResolver{}); r.Portal || r.Reason != ReasonNone {
+		t.Errorf("no portal: %+v", r)
+	}
+}
+
+func TestDetectRedirect(t *testing.T) {
+	withProbes(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://login.portal.example/welcome", http.StatusFound)
+	})
+	r := detect(nil, nil)
+	if !r.Portal || r.Reason != ReasonRedirect || r.URL != "http://login.portal.example/welcome" {
+		t.Fatalf("redirect: %+v", r)
+	}
+	if d := r.Domains[len(r.Domains)-1]; d != "login.portal.example" {
+		t.Errorf("portal domain %s", d)
+	}
+}
+
+func TestDetectContent(t *testing.T) {
+	withProbes(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>log in</html>"))
+	})
+	if r := detect(nil, nil); !r.Portal || r.Reason != ReasonContent {
+		t.Errorf("content: %+v", r)
+	}
+}
+
+func TestDetectDNS(t *testing.T) {
+	withProbes(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if r := detect(nil, &fakeResolver{ip: net.IPv4(10, 0, 0, 1)}); !r.Portal || r.Reason != ReasonDNS {
+		t.Errorf("nxdomain rewritten: %+v", r)
+	}
+}
+
+func TestDetectUnreachable(t *testing.T) {
+	saved := probes
+	probes = []probe{{url: "http://127.0.0.1:1/", status: http.StatusNoContent}}
+	defer func() { probes = saved }()
+	if r := detect(nil, nil); r.Portal || r.Reason != ReasonUnreachable {
+		t.Errorf("unreachable: %+v", r)
+	}
+}
+
+func query(t *testing.T, tr dnsx.Transport, name string) {
+	q, _ := new(dns.Msg).SetQuestion(name, dns.TypeA).Pack()
+	if _, err := tr.Query(q); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMode(t *testing.T) {
+	inner, network := &fakeResolver{}, &fakeResolver{}
+	m := NewMode()
+	tr := m.Wrap(inner)
+
+	query(t, tr, "login.portal.example.")
+	if inner.queries != 1 || network.queries != 0 {
+		t.Fatalf("off: inner %d, network %d", inner.queries, network.queries)
+	}
+
+	if err := m.Enter([]string{"portal.example"}, network, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	query(t, tr, "login.portal.example.")
+	query(t, tr, "elsewhere.example.")
+	if inner.queries != 2 || network.queries != 1 {
+		t.Errorf("on: inner %d, network %d", inner.queries, network.queries)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if m.On() {
+		t.Fatal("mode on past its duration")
+	}
+	query(t, tr, "login.portal.example.")
+	if network.queries != 1 {
+		t.Errorf("expired: network %d", network.queries)
+	}
+
+	if err := m.Enter([]string{"a..example"}, network, 0); err == nil {
+		t.Error("entered with a bad domain")
+	}
+	if err := m.Enter([]string{"portal.example"}, nil, 0); err == nil {
+		t.Error("entered without a resolver")
+	}
+	m.Enter([]string{"portal.example"}, network, 0)
+	m.Exit()
+	if m.On() {
+		t.Error("mode on after exit")
+	}
+}
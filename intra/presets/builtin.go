@@ -0,0 +1,85 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package presets
+
+// builtin is the catalog built in, of version 1.  Later versions are to be
+// had from Update.
+const builtin = `{
+  "version": 1,
+  "presets": [
+    {
+      "id": "rethinkdns",
+      "name": "RethinkDNS",
+      "url": "https://basic.rethinkdns.com/dns-query",
+      "ips": [],
+      "ecs": false,
+      "dnssec": true,
+      "logging": "none",
+      "filtering": "none"
+    },
+    {
+      "id": "cloudflare",
+      "name": "Cloudflare",
+      "url": "https://cloudflare-dns.com/dns-query",
+      "ips": ["1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001"],
+      "ecs": false,
+      "dnssec": true,
+      "logging": "temporary",
+      "filtering": "none"
+    },
+    {
+      "id": "cloudflare-security",
+      "name": "Cloudflare (malware blocking)",
+      "url": "https://security.cloudflare-dns.com/dns-query",
+      "ips": ["1.1.1.2", "1.0.0.2", "2606:4700:4700::1112", "2606:4700:4700::1002"],
+      "ecs": false,
+      "dnssec": true,
+      "logging": "temporary",
+      "filtering": "malware"
+    },
+    {
+      "id": "google",
+      "name": "Google",
+      "url": "https://dns.google/dns-query",
+      "ips": ["8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844"],
+      "ecs": true,
+      "dnssec": true,
+      "logging": "temporary",
+      "filtering": "none"
+    },
+    {
+      "id": "quad9",
+      "name": "Quad9",
+      "url": "https://dns.quad9.net/dns-query",
+      "ips": ["9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"],
+      "ecs": false,
+      "dnssec": true,
+      "logging": "none",
+      "filtering": "malware"
+    },
+    {
+      "id": "quad9-ecs",
+      "name": "Quad9 (with ECS)",
+      "url": "https://dns11.quad9.net/dns-query",
+      "ips": ["9.9.9.11", "149.112.112.11", "2620:fe::11", "2620:fe::fe:11"],
+      "ecs": true,
+      "dnssec": true,
+      "logging": "none",
+      "filtering": "malware"
+    },
+    {
+      "id": "adguard",
+      "name": "AdGuard",
+      "url": "https://dns.adguard.com/dns-query",
+      "ips": ["94.140.14.14", "94.140.15.15", "2a10:50c0::ad1:ff", "2a10:50c0::ad2:ff"],
+      "ecs": false,
+      "dnssec": true,
+      "logging": "temporary",
+      "filtering": "ads"
+    }
+  ]
+}`
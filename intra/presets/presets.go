@@ -0,0 +1,229 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package presets is a catalog of well-known DoH resolvers, with their
+// bootstrap ips and what they offer, for apps to pick from rather than
+// hardcode.  The catalog built in can be replaced by later versions of it.
+package presets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Logging policies of resolvers.
+const (
+	// LogNone is a resolver that keeps no logs of queries.
+	LogNone = "none"
+	// LogTemporary is a resolver that keeps logs of queries for a day or two,
+	// and then, if at all, without the ips of clients.
+	LogTemporary = "temporary"
+	// LogFull is a resolver that keeps logs of queries.
+	LogFull = "full"
+)
+
+// Filtering of resolvers.
+const (
+	// FilterNone is a resolver that answers every query.
+	FilterNone = "none"
+	// FilterMalware is a resolver that blocks malware and phishing domains.
+	FilterMalware = "malware"
+	// FilterAds is a resolver that blocks ads and trackers, and malware.
+	FilterAds = "ads"
+)
+
+// Capabilities of Filter.
+const (
+	CapDNSSEC   = "dnssec"
+	CapECS      = "ecs"
+	CapNoECS    = "noecs"
+	CapNoLog    = "nolog"
+	CapMalware  = "malware"
+	CapAds      = "ads"
+	CapNoFilter = "nofilter"
+)
+
+// Preset is a resolver of the catalog.
+type Preset struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// URL is the url of the DoH server; IPs are its ips, to bootstrap it with.
+	URL string   `json:"url"`
+	IPs []string `json:"ips"`
+	// ECS is whether the resolver sends subnets of clients upstream
+	// (EDNS Client Subnet, RFC 7871); DNSSEC, whether it validates.
+	ECS    bool `json:"ecs"`
+	DNSSEC bool `json:"dnssec"`
+	// Logging is one of the Log* policies; Filtering, one of Filter*.
+	Logging   string `json:"logging"`
+	Filtering string `json:"filtering"`
+}
+
+// catalog is a version of the catalog, as json.
+type catalog struct {
+	Version int       `json:"version"`
+	Presets []*Preset `json:"presets"`
+}
+
+var (
+	mu  sync.RWMutex
+	cur *catalog
+)
+
+func init() {
+	c, err := parse(builtin)
+	if err != nil {
+		panic(err)
+	}
+	cur = c
+}
+
+// Version returns the version of the catalog in-use.
+func Version() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return cur.Version
+}
+
+// List returns the presets of the catalog, as a json array.
+func List() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return marshal(cur.Presets)
+}
+
+// Get returns preset `id`, as json, or "" if there's none.
+func Get(id string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, p := range cur.Presets {
+		if p.ID == id {
+			return marshal(p)
+		}
+	}
+	return ""
+}
+
+// Filter returns the presets with all of `caps`, a csv of the Cap* values,
+// as a json array; unknown caps match none.
+func Filter(caps string) string {
+	var want []string
+	for _, c := range strings.Split(caps, ",") {
+		if c = strings.TrimSpace(strings.ToLower(c)); len(c) > 0 {
+			want = append(want, c)
+		}
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	ps := make([]*Preset, 0, len(cur.Presets))
+	for _, p := range cur.Presets {
+		if p.has(want) {
+			ps = append(ps, p)
+		}
+	}
+	return marshal(ps)
+}
+
+// Update replaces the catalog with `s`, a json catalog, like
+// {"version":2,"presets":[{"id":"...","url":"https://...",...}]}, if it is
+// valid, and of a later version than the one in-use.
+func Update(s string) error {
+	c, err := parse(s)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if c.Version <= cur.Version {
+		return fmt.Errorf("presets version %d not newer than %d", c.Version, cur.Version)
+	}
+	cur = c
+	return nil
+}
+
+// has reports whether p has all of caps.
+func (p *Preset) has(caps []string) bool {
+	for _, c := range caps {
+		var ok bool
+		switch c {
+		case CapDNSSEC:
+			ok = p.DNSSEC
+		case CapECS:
+			ok = p.ECS
+		case CapNoECS:
+			ok = !p.ECS
+		case CapNoLog:
+			ok = p.Logging == LogNone
+		case CapMalware:
+			ok = p.Filtering == FilterMalware || p.Filtering == FilterAds
+		case CapAds:
+			ok = p.Filtering == FilterAds
+		case CapNoFilter:
+			ok = p.Filtering == FilterNone
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// parse returns the catalog in `s`, if each of its presets is valid.
+func parse(s string) (*catalog, error) {
+	c := &catalog{}
+	if err := json.Unmarshal([]byte(s), c); err != nil {
+		return nil, fmt.Errorf("bad presets: %v", err)
+	}
+	if c.Version <= 0 {
+		return nil, errors.New("presets have no version")
+	}
+	ids := make(map[string]bool, len(c.Presets))
+	for _, p := range c.Presets {
+		if err := p.check(); err != nil {
+			return nil, err
+		}
+		if ids[p.ID] {
+			return nil, fmt.Errorf("preset %s repeated", p.ID)
+		}
+		ids[p.ID] = true
+	}
+	return c, nil
+}
+
+func (p *Preset) check() error {
+	if p == nil || len(p.ID) == 0 {
+		return errors.New("preset has no id")
+	}
+	if u, err := url.Parse(p.URL); err != nil || u.Scheme != "https" || len(u.Host) == 0 {
+		return fmt.Errorf("preset %s: bad url %q", p.ID, p.URL)
+	}
+	for _, ip := range p.IPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("preset %s: bad ip %q", p.ID, ip)
+		}
+	}
+	switch p.Logging {
+	case LogNone, LogTemporary, LogFull:
+	default:
+		return fmt.Errorf("preset %s: bad logging %q", p.ID, p.Logging)
+	}
+	switch p.Filtering {
+	case FilterNone, FilterMalware, FilterAds:
+	default:
+		return fmt.Errorf("preset %s: bad filtering %q", p.ID, p.Filtering)
+	}
+	return nil
+}
+
+func marshal(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
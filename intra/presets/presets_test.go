@@ -0,0 +1,101 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package presets
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func ids(t *testing.T, s string) []string {
+	var ps []*Preset
+	if err := json.Unmarshal([]byte(s), &ps); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, p := range ps {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// restore puts back the catalog built in once t is done.
+func restore(t *testing.T) {
+	t.Cleanup(func() {
+		c, _ := parse(builtin)
+		mu.Lock()
+		cur = c
+		mu.Unlock()
+	})
+}
+
+func TestBuiltin(t *testing.T) {
+	if Version() != 1 {
+		t.Errorf("version %d", Version())
+	}
+	if n := len(ids(t, List())); n < 5 {
+		t.Errorf("%d presets", n)
+	}
+	var p Preset
+	if err := json.Unmarshal([]byte(Get("quad9")), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.URL != "https://dns.quad9.net/dns-query" || len(p.IPs) == 0 || p.Filtering != FilterMalware {
+		t.Errorf("quad9 %+v", p)
+	}
+	if Get("nope") != "" {
+		t.Error("missing preset found")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	got := ids(t, Filter("nolog, noecs,malware"))
+	if len(got) != 1 || got[0] != "quad9" {
+		t.Errorf("nolog noecs malware: %v", got)
+	}
+	for _, id := range ids(t, Filter(CapECS)) {
+		if id != "google" && id != "quad9-ecs" {
+			t.Errorf("ecs: %s", id)
+		}
+	}
+	if got := ids(t, Filter("teleport")); len(got) != 0 {
+		t.Errorf("unknown cap: %v", got)
+	}
+	if len(ids(t, Filter(""))) != len(ids(t, List())) {
+		t.Error("no caps should match all")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	restore(t)
+	next := `{"version":2,"presets":[{"id":"x","name":"X","url":"https://x.example/dns-query","ips":["192.0.2.1"],"logging":"none","filtering":"none"}]}`
+	for _, bad := range []string{
+		`{"version":1,"presets":[]}`,
+		`{"presets":[]}`,
+		`{"version":2,"presets":[{"id":"x","url":"http://x.example","logging":"none","filtering":"none"}]}`,
+		`{"version":2,"presets":[{"id":"x","url":"https://x.example","ips":["x"],"logging":"none","filtering":"none"}]}`,
+		`{"version":2,"presets":[{"id":"x","url":"https://x.example","logging":"some","filtering":"none"}]}`,
+		`{"version":2,"presets":[{"url":"https://x.example","logging":"none","filtering":"none"}]}`,
+		`not json`,
+	} {
+		if err := Update(bad); err == nil {
+			t.Errorf("updated with %s", bad)
+		}
+	}
+	if Version() != 1 {
+		t.Fatal("bad update applied")
+	}
+	if err := Update(next); err != nil {
+		t.Fatal(err)
+	}
+	if Version() != 2 || len(Get("x")) == 0 || len(Get("google")) > 0 {
+		t.Errorf("catalog not updated: %s", List())
+	}
+	if err := Update(next); err == nil {
+		t.Error("same version updated")
+	}
+}
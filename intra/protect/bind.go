@@ -0,0 +1,116 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// NetworkBinder binds sockets to Android Networks.  This is a wrapper for
+// Android's Network.bindSocket().
+type NetworkBinder interface {
+	// BindToNetwork binds `socket` to the Network of `handle`, as in
+	// Network.getNetworkHandle(), and reports whether it did.
+	BindToNetwork(socket int32, handle int64) bool
+}
+
+// Binding binds sockets to a network interface, a source address, or an
+// Android Network, or to any of those set, so that, on multi-homed devices,
+// dns and proxy traffic doesn't leave through the wrong interface.  It may
+// be changed as the device moves between networks, for sockets made after.
+// Sockets that can't be bound as set fail to connect, rather than leak.
+type Binding struct {
+	sync.RWMutex
+	iface  string
+	addr   net.IP
+	handle int64
+	binder NetworkBinder
+}
+
+var defaultBinding = NewBinding()
+
+// NewBinding returns a Binding that binds sockets to nothing.
+func NewBinding() *Binding {
+	return &Binding{}
+}
+
+// DefaultBinding returns the Binding of the dialers and listen configs of
+// MakeDialer and MakeListenConfig.
+func DefaultBinding() *Binding {
+	return defaultBinding
+}
+
+// SetInterface binds sockets to the interface `name`, like "wlan0"; empty
+// name unbinds them.
+func (b *Binding) SetInterface(name string) {
+	b.Lock()
+	b.iface = strings.TrimSpace(name)
+	b.Unlock()
+}
+
+// SetAddr binds the sockets of dialers to the source address `ip`, which
+// must be of the family of the addresses they dial; empty ip unbinds them.
+// Listening sockets are bound to the address they listen on, instead.
+func (b *Binding) SetAddr(ip string) error {
+	var addr net.IP
+	if ip = strings.TrimSpace(ip); len(ip) > 0 {
+		if addr = net.ParseIP(ip); addr == nil {
+			return fmt.Errorf("bad source address %s", ip)
+		}
+	}
+	b.Lock()
+	b.addr = addr
+	b.Unlock()
+	return nil
+}
+
+// SetNetwork binds sockets, with `binder`, to the Android Network of
+// `handle`; a handle of 0, or a nil binder, unbinds them.
+func (b *Binding) SetNetwork(handle int64, binder NetworkBinder) {
+	b.Lock()
+	if handle == 0 || binder == nil {
+		handle, binder = 0, nil
+	}
+	b.handle, b.binder = handle, binder
+	b.Unlock()
+}
+
+// String returns the interface, source address, and Network b binds to.
+func (b *Binding) String() string {
+	b.RLock()
+	defer b.RUnlock()
+	return fmt.Sprintf("iface(%s) addr(%s) network(%d)", b.iface, b.addr, b.handle)
+}
+
+// bind binds `fd`, a socket of `network`, like "tcp6", as set; listening
+// sockets aren't bound to the source address.
+func (b *Binding) bind(network string, fd int, listen bool) error {
+	if b == nil {
+		return nil
+	}
+	b.RLock()
+	iface, addr, handle, binder := b.iface, b.addr, b.handle, b.binder
+	b.RUnlock()
+	v6 := strings.HasSuffix(network, "6")
+	if len(iface) > 0 {
+		if err := bindToInterface(fd, iface, v6); err != nil {
+			return fmt.Errorf("bind %s socket to %s: %v", network, iface, err)
+		}
+	}
+	if addr != nil && !listen {
+		if err := bindToAddr(fd, addr, v6); err != nil {
+			return fmt.Errorf("bind %s socket to %s: %v", network, addr, err)
+		}
+	}
+	if binder != nil && !binder.BindToNetwork(int32(fd), handle) {
+		return fmt.Errorf("bind %s socket to network %d failed", network, handle)
+	}
+	return nil
+}
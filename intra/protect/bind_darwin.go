@@ -0,0 +1,23 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"net"
+	"syscall"
+)
+
+func bindToInterface(fd int, iface string, v6 bool) error {
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	if v6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_BOUND_IF, i.Index)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_BOUND_IF, i.Index)
+}
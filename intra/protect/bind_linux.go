@@ -0,0 +1,13 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import "syscall"
+
+func bindToInterface(fd int, iface string, v6 bool) error {
+	return syscall.BindToDevice(fd, iface)
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package protect
+
+import (
+	"errors"
+	"net"
+)
+
+func bindToInterface(fd int, iface string, v6 bool) error {
+	return errors.New("binding to interfaces not supported on this platform")
+}
+
+func bindToAddr(fd int, addr net.IP, v6 bool) error {
+	return errors.New("binding to source addresses not supported on this platform")
+}
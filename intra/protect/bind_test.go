@@ -0,0 +1,97 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package protect
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+type fakeBinder struct {
+	ok      bool
+	handles []int64
+}
+
+func (n *fakeBinder) BindToNetwork(fd int32, handle int64) bool {
+	n.handles = append(n.handles, handle)
+	return n.ok
+}
+
+func TestBindAddr(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Accept()
+
+	b := NewBinding()
+	if err := b.SetAddr("bogus"); err == nil {
+		t.Error("bad source address set")
+	}
+	if err := b.SetAddr("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	d := MakeBoundDialer(&fakeProtector{}, b)
+	conn, err := d.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("bound to %s", ip)
+	}
+	conn.Close()
+
+	b.SetAddr("::1")
+	if _, err := d.Dial("tcp4", l.Addr().String()); err == nil {
+		t.Error("dialed from a source address of another family")
+	}
+	// listeners aren't bound to the source address
+	c := MakeBoundListenConfig(nil, b)
+	pc, err := c.ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+}
+
+func TestBindNetwork(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Accept()
+
+	b := NewBinding()
+	n := &fakeBinder{ok: true}
+	b.SetNetwork(100, n)
+	d := MakeBoundDialer(nil, b)
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(n.handles) != 1 || n.handles[0] != 100 {
+		t.Errorf("bound to %v", n.handles)
+	}
+
+	n.ok = false
+	if _, err := d.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("dialed with a socket not bound")
+	}
+	b.SetNetwork(0, n)
+	conn, err = d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(n.handles) != 2 {
+		t.Errorf("unbound socket bound: %v", n.handles)
+	}
+}
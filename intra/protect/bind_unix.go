@@ -0,0 +1,29 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package protect
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func bindToAddr(fd int, addr net.IP, v6 bool) error {
+	if v4 := addr.To4(); v4 != nil && !v6 {
+		sa := &syscall.SockaddrInet4{}
+		copy(sa.Addr[:], v4)
+		return syscall.Bind(fd, sa)
+	} else if v4 == nil && v6 {
+		sa := &syscall.SockaddrInet6{}
+		copy(sa.Addr[:], addr.To16())
+		return syscall.Bind(fd, sa)
+	}
+	return errors.New("source address of another family")
+}
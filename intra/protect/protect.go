@@ -45,7 +45,20 @@ type Blocker interface {
 	Block(protocol int32, uid int, source string, target string) bool
 }
 
+// ConnectionOwner identifies the app that owns a connection.
+type ConnectionOwner interface {
+	// GetUid returns the uid of the app that owns the connection from source
+	// to target, or -1 if it couldn't be determined.
+	// This is a wrapper for Android's ConnectivityManager.getConnectionOwnerUid(),
+	// needed as /proc/net is inaccessible to apps on Android 10 and above.
+	// protocol is 6 for TCP and 17 for UDP; source and target are as in Blocker.
+	GetUid(protocol int32, source string, target string) int
+}
+
 // Protector provides the ability to bypass a VPN on Android, pre-Lollipop.
+// Dialers made with it protect every socket the tunnel dials on its own:
+// those of DoH and DNSCrypt servers, proxies and outbounds, and bootstrap
+// lookups.
 type Protector interface {
 	// Protect a socket, i.e. exclude it from the VPN.
 	// This is needed in order to avoid routing loops for the VPN's own sockets.
@@ -60,14 +73,21 @@ type Protector interface {
 	GetResolvers() string
 }
 
-func makeControl(p Protector) func(string, string, syscall.RawConn) error {
+// makeControl protects sockets with p, if not nil, and binds them with b.
+func makeControl(p Protector, b *Binding, listen bool) func(string, string, syscall.RawConn) error {
 	return func(network, address string, c syscall.RawConn) error {
-		return c.Control(func(fd uintptr) {
-			if !p.Protect(int32(fd)) {
+		var berr error
+		err := c.Control(func(fd uintptr) {
+			if p != nil && !p.Protect(int32(fd)) {
 				// TODO: Record and report these errors.
 				log.Errorf("Failed to protect a %s socket", network)
 			}
+			berr = b.bind(network, int(fd), listen)
 		})
+		if err != nil {
+			return err
+		}
+		return berr
 	}
 }
 
@@ -111,14 +131,20 @@ func replaceIP(addr string, ips []string) (string, error) {
 	return net.JoinHostPort(newIP, port), nil
 }
 
-// MakeDialer creates a new Dialer.  Recipients can safely mutate
-// any public field except Control and Resolver, which are both populated.
+// MakeDialer creates a new Dialer, whose sockets are bound by DefaultBinding.
+// Recipients can safely mutate any public field except Control and Resolver,
+// which are both populated, if `p` isn't nil.
 func MakeDialer(p Protector) *net.Dialer {
-	if p == nil {
-		return &net.Dialer{}
-	}
+	return MakeBoundDialer(p, defaultBinding)
+}
+
+// MakeBoundDialer is like MakeDialer, but its sockets are bound by `b`.
+func MakeBoundDialer(p Protector, b *Binding) *net.Dialer {
 	d := &net.Dialer{
-		Control: makeControl(p),
+		Control: makeControl(p, b, false),
+	}
+	if p == nil {
+		return d
 	}
 	resolverDialer := func(ctx context.Context, network, address string) (net.Conn, error) {
 		resolvers := strings.Split(p.GetResolvers(), ",")
@@ -136,12 +162,15 @@ func MakeDialer(p Protector) *net.Dialer {
 }
 
 // MakeListenConfig returns a new ListenConfig that creates protected
-// listener sockets.
+// listener sockets, bound by DefaultBinding.
 func MakeListenConfig(p Protector) *net.ListenConfig {
-	if p == nil {
-		return &net.ListenConfig{}
-	}
+	return MakeBoundListenConfig(p, defaultBinding)
+}
+
+// MakeBoundListenConfig is like MakeListenConfig, but its sockets are bound
+// by `b`.
+func MakeBoundListenConfig(p Protector, b *Binding) *net.ListenConfig {
 	return &net.ListenConfig{
-		Control: makeControl(p),
+		Control: makeControl(p, b, true),
 	}
 }
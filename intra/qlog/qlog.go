@@ -0,0 +1,146 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package qlog keeps a bounded log of recent DNS transactions on-device,
+// for apps to show a live DNS log with.  The log is off until enabled with
+// a size; entries beyond it overwrite the oldest.  Aggregate statistics of
+// all transactions are kept whether or not the log is on.
+package qlog
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxSize caps the number of entries the log may be sized to.
+const maxSize = 10000
+
+// Entry is a DNS transaction.
+type Entry struct {
+	Time       int64  `json:"time"` // unix millis
+	Name       string `json:"qname"`
+	Type       uint16 `json:"qtype"`
+	Rcode      int    `json:"rcode"`   // -1 if there was no response
+	Latency    int64  `json:"latency"` // millis
+	Transport  string `json:"transport"`
+	Blocklists string `json:"blocklists,omitempty"`
+	Status     int    `json:"status"` // transport-specific status
+}
+
+var (
+	mu sync.Mutex
+	// ring holds entries; once full, next is the index of the oldest.
+	ring []Entry
+	next int
+	full bool
+)
+
+// Enable sizes the log to hold the `size` most recent transactions, up to
+// 10000; zero or less turns it off.  Resizing discards all entries.
+func Enable(size int) {
+	if size > maxSize {
+		size = maxSize
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if size <= 0 {
+		ring = nil
+	} else {
+		ring = make([]Entry, size)
+	}
+	next, full = 0, false
+}
+
+// Enabled reports whether transactions are being logged.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return ring != nil
+}
+
+// Add logs the query q, answered with r (if not nil) by `transport` after
+// `latency`, with those of `blocklists` that matched, and the transport's
+// `status`.
+func Add(q []byte, r []byte, latency time.Duration, transport string, blocklists string, status int) {
+	e := Entry{
+		Time:       time.Now().UnixNano() / int64(time.Millisecond),
+		Rcode:      -1,
+		Latency:    int64(latency / time.Millisecond),
+		Transport:  transport,
+		Blocklists: blocklists,
+		Status:     status,
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err == nil && len(msg.Question) == 1 {
+		e.Name = msg.Question[0].Name
+		e.Type = msg.Question[0].Qtype
+	}
+	if len(r) >= 4 {
+		// low 4 bits of the header's flags; extended rcodes are ignored
+		e.Rcode = int(r[3] & 0x0f)
+	}
+	stats.count(&e, latency)
+	stats.save(false)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if ring == nil {
+		return
+	}
+	ring[next] = e
+	if next++; next == len(ring) {
+		next, full = 0, true
+	}
+}
+
+// entries returns logged entries, newest first, up to n if n > 0.
+// Must be called under mu.
+func entries(n int) []Entry {
+	count := next
+	if full {
+		count = len(ring)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+	out := make([]Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, ring[(next-i+len(ring))%len(ring)])
+	}
+	return out
+}
+
+// Dump returns a json array of the `n` most recent transactions, newest
+// first, or of all logged transactions if n is zero or less.
+func Dump(n int) string {
+	mu.Lock()
+	var out []Entry
+	if ring != nil {
+		out = entries(n)
+	}
+	mu.Unlock()
+	if len(out) == 0 {
+		return "[]"
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return "[]"
+	}
+	return string(b)
+}
+
+// Clear discards all logged transactions, but keeps logging.
+func Clear() {
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range ring {
+		ring[i] = Entry{}
+	}
+	next, full = 0, false
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package qlog
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/celzero/firestack/intra/kv"
+	"github.com/miekg/dns"
+)
+
+func pack(t *testing.T, name string, rcode int) (q []byte, r []byte) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	q, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = new(dns.Msg).SetRcode(msg, rcode).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func dump(t *testing.T, n int) []Entry {
+	var out []Entry
+	if err := json.Unmarshal([]byte(Dump(n)), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestQlog(t *testing.T) {
+	q, r := pack(t, "a.example.", dns.RcodeSuccess)
+	Add(q, r, time.Millisecond, "off", "", 0)
+	if Enabled() || Dump(0) != "[]" {
+		t.Fatal("Logged while off")
+	}
+
+	Enable(2)
+	defer Enable(0)
+	Add(q, r, 5*time.Millisecond, "doh", "", 0)
+	q, r = pack(t, "b.example.", dns.RcodeNameError)
+	Add(q, r, 0, "doh", "ads", 0)
+	q, _ = pack(t, "c.example.", 0)
+	Add(q, nil, 0, "dnscrypt", "", 2)
+
+	out := dump(t, 0)
+	if len(out) != 2 || out[0].Name != "c.example." || out[1].Name != "b.example." {
+		t.Fatalf("Wrong entries %v", out)
+	}
+	if out[0].Rcode != -1 || out[0].Status != 2 || out[1].Rcode != dns.RcodeNameError || out[1].Blocklists != "ads" {
+		t.Errorf("Wrong fields %v", out)
+	}
+	if out := dump(t, 1); len(out) != 1 || out[0].Name != "c.example." {
+		t.Errorf("Wrong latest entry %v", out)
+	}
+
+	Clear()
+	if Dump(0) != "[]" || !Enabled() {
+		t.Error("Clear should empty the log, and keep it on")
+	}
+}
+
+func TestStats(t *testing.T) {
+	ResetStats()
+	defer ResetStats()
+	for i := 0; i < 3; i++ {
+		q, r := pack(t, "a.example.", dns.RcodeSuccess)
+		Add(q, r, time.Duration(10*(i+1))*time.Millisecond, "doh", "", 0)
+	}
+	q, r := pack(t, "ads.example.", dns.RcodeSuccess)
+	Add(q, r, 0, "doh", "ads", 0)
+	Add(q, nil, time.Second, "dnscrypt", "", 1)
+	CacheHit()
+
+	var s snapshot
+	if err := json.Unmarshal([]byte(Stats()), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Total != 6 || s.Blocked != 1 || s.Failed != 1 || s.CacheHits != 1 {
+		t.Errorf("Wrong counts %+v", s)
+	}
+	if d := s.Transports["doh"]; d.Count != 4 || d.P50 != 10 || d.P99 != 20 {
+		t.Errorf("Wrong doh stats %+v", d)
+	}
+	if len(s.Top) != 2 || s.Top[0].Name != "a.example." || s.Top[0].Count != 3 {
+		t.Errorf("Wrong top domains %v", s.Top)
+	}
+}
+
+func TestStatsStore(t *testing.T) {
+	ResetStats()
+	defer SetStore(nil)
+	defer ResetStats()
+	store := kv.NewMemStore()
+	SetStore(store)
+	q, r := pack(t, "a.example.", dns.RcodeSuccess)
+	Add(q, r, 0, "doh", "", 0)
+	CacheHit()
+	SaveStats()
+
+	// the counts of the next session add to those persisted
+	stats = newCounters()
+	SetStore(store)
+	Add(q, r, 0, "doh", "", 0)
+	var s snapshot
+	if err := json.Unmarshal([]byte(Stats()), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Total != 3 || s.CacheHits != 1 || len(s.Top) != 1 || s.Top[0].Count != 2 {
+		t.Errorf("Wrong counts %+v", s)
+	}
+
+	ResetStats()
+	stats = newCounters()
+	SetStore(store)
+	if stats.total != 0 {
+		t.Errorf("Reset counts persisted: %d", stats.total)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ResetStats()
+	defer ResetStats()
+	q, r := pack(t, "a.example.", dns.RcodeSuccess)
+	Add(q, r, 5*time.Millisecond, "doh", "", 0)
+	Add(q, r, 40*time.Millisecond, "doh", "", 0)
+	Add(q, r, 3*time.Second, "doh", "", 0)
+	Add(q, nil, 10*time.Second, "doh", "", 1)
+
+	if h := HealthOf("dnscrypt"); h != nil {
+		t.Errorf("Unexpected health %+v", h)
+	}
+	h := HealthOf("doh")
+	if h == nil || h.Count != 4 || h.Failed != 1 || h.Success != 0.75 || h.P50 != 40 {
+		t.Errorf("Wrong health %+v", h)
+	}
+
+	var s snapshot
+	if err := json.Unmarshal([]byte(Stats()), &s); err != nil {
+		t.Fatal(err)
+	}
+	d := s.Transports["doh"]
+	if len(s.Buckets) != len(buckets) || len(d.Histogram) != len(buckets)+1 {
+		t.Fatalf("Wrong histogram %v %v", s.Buckets, d.Histogram)
+	}
+	// 5ms, 40ms, 3s, and 10s in buckets of 10, 50, 5000, and above all bounds
+	want := []int64{1, 0, 1, 0, 0, 0, 0, 0, 1, 1}
+	for i, n := range want {
+		if d.Histogram[i] != n {
+			t.Errorf("Wrong histogram %v, want %v", d.Histogram, want)
+			break
+		}
+	}
+}
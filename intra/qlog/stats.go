@@ -0,0 +1,358 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package qlog
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/kv"
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	// samples is the number of recent latencies kept per transport.
+	samples = 256
+	// maxNames caps the number of distinct names counted for top domains.
+	maxNames = 4096
+	// topN is the number of top domains in a snapshot.
+	topN = 10
+	// saveInterval is the least time between counts persisted to the store.
+	saveInterval = 30 * time.Second
+	// statsKey is the key counts are persisted under.
+	statsKey = kv.QueryStats + "counts"
+)
+
+// buckets are the upper bounds, in millis, of latency histograms; the last
+// bucket, of latencies above all bounds, is implicit.
+var buckets = []int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+type transportStats struct {
+	count     int64
+	failed    int64
+	latencies []int64 // ring of recent latencies, in millis
+	failures  []bool  // ring of whether recent queries failed, as latencies
+	next      int
+	histogram []int64 // counts of latencies by buckets
+}
+
+func newTransportStats() *transportStats {
+	return &transportStats{histogram: make([]int64, len(buckets)+1)}
+}
+
+// bucket returns the index of the histogram bucket of ms.
+func bucket(ms int64) int {
+	for i, b := range buckets {
+		if ms <= b {
+			return i
+		}
+	}
+	return len(buckets)
+}
+
+// recentSuccess returns the fraction of recent queries that didn't fail.
+func (ts *transportStats) recentSuccess() float64 {
+	if len(ts.failures) == 0 {
+		return 0
+	}
+	ok := 0
+	for _, f := range ts.failures {
+		if !f {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(ts.failures))
+}
+
+type counters struct {
+	sync.Mutex
+	total      int64
+	blocked    int64
+	failed     int64
+	cacheHits  int64
+	transports map[string]*transportStats
+	names      map[string]int64
+	// s is the store counts are persisted to, if any, last at saved.
+	s     kv.KVStore
+	saved time.Time
+}
+
+// storedCounts are the counts persisted across sessions; the latencies of
+// transports are not.
+type storedCounts struct {
+	Total     int64            `json:"total"`
+	Blocked   int64            `json:"blocked"`
+	Failed    int64            `json:"failed"`
+	CacheHits int64            `json:"cache_hits"`
+	Names     map[string]int64 `json:"names"`
+}
+
+var stats = newCounters()
+
+func newCounters() *counters {
+	return &counters{
+		transports: make(map[string]*transportStats),
+		names:      make(map[string]int64),
+	}
+}
+
+// count accounts for e.
+func (c *counters) count(e *Entry, latency time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.total++
+	if len(e.Blocklists) > 0 {
+		c.blocked++
+	}
+	failed := e.Status != 0 || e.Rcode < 0
+	if failed {
+		c.failed++
+	}
+
+	ts := c.transports[e.Transport]
+	if ts == nil {
+		ts = newTransportStats()
+		c.transports[e.Transport] = ts
+	}
+	ts.count++
+	if failed {
+		ts.failed++
+	}
+	ms := int64(latency / time.Millisecond)
+	ts.histogram[bucket(ms)]++
+	if len(ts.latencies) < samples {
+		ts.latencies = append(ts.latencies, ms)
+		ts.failures = append(ts.failures, failed)
+	} else {
+		ts.latencies[ts.next] = ms
+		ts.failures[ts.next] = failed
+		ts.next = (ts.next + 1) % samples
+	}
+
+	if len(e.Name) == 0 {
+		return
+	}
+	if _, ok := c.names[e.Name]; !ok && len(c.names) >= maxNames {
+		// make room by forgetting names seen only once
+		for name, n := range c.names {
+			if n <= 1 {
+				delete(c.names, name)
+			}
+		}
+		if len(c.names) >= maxNames {
+			return
+		}
+	}
+	c.names[e.Name]++
+}
+
+// save persists the counts to the store, if any, if saveInterval has passed
+// since they last were, or if force.
+func (c *counters) save(force bool) {
+	c.Lock()
+	s := c.s
+	if s == nil || (!force && time.Since(c.saved) < saveInterval) {
+		c.Unlock()
+		return
+	}
+	c.saved = time.Now()
+	v, err := json.Marshal(storedCounts{
+		Total:     c.total,
+		Blocked:   c.blocked,
+		Failed:    c.failed,
+		CacheHits: c.cacheHits,
+		Names:     c.names,
+	})
+	c.Unlock()
+	if err == nil {
+		err = s.Put(statsKey, v)
+	}
+	if err != nil {
+		log.Warnf("qlog: persisting stats failed: %v", err)
+	}
+}
+
+// SetStore persists counts to `s`, and adds to them those in s from previous
+// sessions; nil `s` unsets the store.
+func SetStore(s kv.KVStore) {
+	stats.Lock()
+	same := stats.s == s
+	stats.Unlock()
+	if same {
+		return
+	}
+	var sc storedCounts
+	if s != nil {
+		if v, err := s.Get(statsKey); err != nil {
+			log.Warnf("qlog: loading stats failed: %v", err)
+		} else if len(v) > 0 && json.Unmarshal(v, &sc) != nil {
+			log.Warnf("qlog: discarding bad stats")
+		}
+	}
+	stats.Lock()
+	stats.s = s
+	stats.saved = time.Now()
+	stats.total += sc.Total
+	stats.blocked += sc.Blocked
+	stats.failed += sc.Failed
+	stats.cacheHits += sc.CacheHits
+	for name, n := range sc.Names {
+		if _, ok := stats.names[name]; ok || len(stats.names) < maxNames {
+			stats.names[name] += n
+		}
+	}
+	stats.Unlock()
+}
+
+// SaveStats persists counts to the store of SetStore, if any, now.
+func SaveStats() {
+	stats.save(true)
+}
+
+// CacheHit accounts for a query answered from a cache, without a transport.
+func CacheHit() {
+	stats.Lock()
+	stats.total++
+	stats.cacheHits++
+	stats.Unlock()
+	stats.save(false)
+}
+
+// percentile returns the p-th percentile of sorted.
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+type transportSnapshot struct {
+	Count int64 `json:"count"`
+	P50   int64 `json:"p50"`
+	P90   int64 `json:"p90"`
+	P99   int64 `json:"p99"`
+	// Failed is the number of queries that failed.
+	Failed int64 `json:"failed"`
+	// Success is the fraction of the recent queries that didn't fail.
+	Success float64 `json:"success"`
+	// Histogram counts latencies by Buckets.
+	Histogram []int64 `json:"histogram"`
+}
+
+// snapshotOf returns the snapshot of ts.  Must be called under stats.Lock.
+func snapshotOf(ts *transportStats) transportSnapshot {
+	sorted := append([]int64(nil), ts.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return transportSnapshot{
+		Count:     ts.count,
+		P50:       percentile(sorted, 50),
+		P90:       percentile(sorted, 90),
+		P99:       percentile(sorted, 99),
+		Failed:    ts.failed,
+		Success:   ts.recentSuccess(),
+		Histogram: append([]int64(nil), ts.histogram...),
+	}
+}
+
+// Health is the health of a transport: how many queries it answered, and
+// how many of them failed; latency percentiles (millis) and the fraction
+// of queries that didn't fail, both of recent queries.
+type Health struct {
+	Count   int64
+	Failed  int64
+	P50     int64
+	P90     int64
+	P99     int64
+	Success float64
+}
+
+// HealthOf returns the health of `transport`, a url or dnscrypt server, as
+// named in the query log; or nil if it hasn't answered any queries.
+func HealthOf(transport string) *Health {
+	stats.Lock()
+	ts := stats.transports[transport]
+	if ts == nil {
+		stats.Unlock()
+		return nil
+	}
+	s := snapshotOf(ts)
+	stats.Unlock()
+	return &Health{
+		Count:   s.Count,
+		Failed:  s.Failed,
+		P50:     s.P50,
+		P90:     s.P90,
+		P99:     s.P99,
+		Success: s.Success,
+	}
+}
+
+type nameCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type snapshot struct {
+	Total      int64                        `json:"total"`
+	Blocked    int64                        `json:"blocked"`
+	Failed     int64                        `json:"failed"`
+	CacheHits  int64                        `json:"cache_hits"`
+	Transports map[string]transportSnapshot `json:"transports"`
+	Buckets    []int64                      `json:"buckets"`
+	Top        []nameCount                  `json:"top"`
+}
+
+// Stats returns a json snapshot of counts of dns queries: in all, blocked,
+// failed, and answered from cache; of each transport, query and failure
+// counts, latency percentiles (millis), recent success rate, and a latency
+// histogram by the upper bounds (millis) in buckets; and the most queried names.
+func Stats() string {
+	stats.Lock()
+	s := snapshot{
+		Total:      stats.total,
+		Blocked:    stats.blocked,
+		Failed:     stats.failed,
+		CacheHits:  stats.cacheHits,
+		Transports: make(map[string]transportSnapshot, len(stats.transports)),
+		Buckets:    buckets,
+		Top:        make([]nameCount, 0, len(stats.names)),
+	}
+	for name, ts := range stats.transports {
+		s.Transports[name] = snapshotOf(ts)
+	}
+	for name, n := range stats.names {
+		s.Top = append(s.Top, nameCount{name, n})
+	}
+	stats.Unlock()
+
+	sort.Slice(s.Top, func(i, j int) bool {
+		if s.Top[i].Count != s.Top[j].Count {
+			return s.Top[i].Count > s.Top[j].Count
+		}
+		return s.Top[i].Name < s.Top[j].Name
+	})
+	if len(s.Top) > topN {
+		s.Top = s.Top[:topN]
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// ResetStats zeroes all counts.
+func ResetStats() {
+	stats.Lock()
+	stats.total, stats.blocked, stats.failed, stats.cacheHits = 0, 0, 0, 0
+	stats.transports = make(map[string]*transportStats)
+	stats.names = make(map[string]int64)
+	stats.Unlock()
+	stats.save(true)
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package quota enforces soft limits per app (uid) on concurrent connections,
+// dns queries per hour, and bytes per day.  Bytes are accounted as connections
+// close, and so a connection in progress may overshoot the limit; the next
+// connection is the one that is held back.
+package quota
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Kinds of quotas.
+const (
+	Conns   = "conns"
+	Queries = "queries"
+	Bytes   = "bytes"
+)
+
+// Actions taken once a quota is exceeded.
+const (
+	// Block refuses connections and dns queries.
+	Block = 0
+	// Throttle holds connections and dns queries back by Penalty.
+	Throttle = 1
+)
+
+// Penalty is the delay by which throttled connections and queries are held back.
+const Penalty = 2 * time.Second
+
+const (
+	queryWindow = time.Hour
+	byteWindow  = 24 * time.Hour
+)
+
+// Listener is notified when an app exceeds one of its quotas.
+type Listener interface {
+	// OnQuotaExceeded is called once per window with uid, the kind of
+	// quota exceeded, its limit, and the action taken.  It must not block.
+	OnQuotaExceeded(uid int, kind string, limit int64, action int)
+}
+
+type usage struct {
+	maxConns   int64
+	maxQueries int64
+	maxBytes   int64
+	action     int
+
+	conns   int64
+	queries int64
+	bytes   int64
+	// start of the current query and byte windows
+	queryStart time.Time
+	byteStart  time.Time
+	// kinds already notified in their current window
+	notified map[string]bool
+}
+
+// Quotas tracks usage of apps against their quotas.
+type Quotas struct {
+	sync.Mutex
+	apps map[int]*usage
+	l    Listener
+}
+
+// NewQuotas returns Quotas that notify `l`, if not nil.
+func NewQuotas(l Listener) *Quotas {
+	return &Quotas{apps: make(map[int]*usage), l: l}
+}
+
+// Set limits uid to maxConns concurrent connections, maxQueries dns queries
+// an hour and maxBytes a day, with `action` taken on exceeding any of them.
+// Zero or negative limits are unlimited.
+func (q *Quotas) Set(uid int, maxConns int, maxQueries int, maxBytes int64, action int) error {
+	if action != Block && action != Throttle {
+		return errors.New("unknown quota action")
+	}
+	q.Lock()
+	defer q.Unlock()
+	u := q.apps[uid]
+	if u == nil {
+		now := time.Now()
+		u = &usage{queryStart: now, byteStart: now, notified: make(map[string]bool)}
+		q.apps[uid] = u
+	}
+	u.maxConns = int64(maxConns)
+	u.maxQueries = int64(maxQueries)
+	u.maxBytes = maxBytes
+	u.action = action
+	return nil
+}
+
+// Remove lifts all quotas on uid.
+func (q *Quotas) Remove(uid int) {
+	q.Lock()
+	delete(q.apps, uid)
+	q.Unlock()
+}
+
+// Has reports whether any app has quotas.
+func (q *Quotas) Has() bool {
+	if q == nil {
+		return false
+	}
+	q.Lock()
+	defer q.Unlock()
+	return len(q.apps) > 0
+}
+
+// Must be called under Lock.
+func (u *usage) roll(now time.Time) {
+	if now.Sub(u.queryStart) >= queryWindow {
+		u.queries = 0
+		u.queryStart = now
+		delete(u.notified, Queries)
+	}
+	if now.Sub(u.byteStart) >= byteWindow {
+		u.bytes = 0
+		u.byteStart = now
+		delete(u.notified, Bytes)
+	}
+}
+
+// exceeded returns the action to take on uid exceeding its kind quota,
+// and a func that notifies q's listener once per window, to be called
+// after unlocking.  Must be called under Lock.
+func (q *Quotas) exceeded(uid int, u *usage, kind string, limit int64) (action int, notify func()) {
+	notify = func() {}
+	if !u.notified[kind] && q.l != nil {
+		u.notified[kind] = true
+		l, action := q.l, u.action
+		notify = func() { l.OnQuotaExceeded(uid, kind, limit, action) }
+	}
+	return u.action, notify
+}
+
+// enforce runs notify, and reports whether to admit a request after
+// holding it back if action is Throttle.  Must not be called under Lock.
+func enforce(action int, notify func()) bool {
+	notify()
+	if action == Throttle {
+		time.Sleep(Penalty)
+		return true
+	}
+	return false
+}
+
+// Open admits a connection from uid, and reports whether it may go ahead.
+// Throttled connections are held back before Open returns.  Every admitted
+// connection must be matched with a call to Close.
+func (q *Quotas) Open(uid int) bool {
+	if q == nil {
+		return true
+	}
+	q.Lock()
+	u := q.apps[uid]
+	if u == nil {
+		q.Unlock()
+		return true
+	}
+	u.roll(time.Now())
+	var action int
+	var notify func()
+	if u.maxBytes > 0 && u.bytes >= u.maxBytes {
+		action, notify = q.exceeded(uid, u, Bytes, u.maxBytes)
+	} else if u.maxConns > 0 && u.conns >= u.maxConns {
+		action, notify = q.exceeded(uid, u, Conns, u.maxConns)
+	}
+	if notify == nil || action == Throttle {
+		u.conns++
+	}
+	q.Unlock()
+	if notify == nil {
+		return true
+	}
+	return enforce(action, notify)
+}
+
+// Close accounts for a connection from uid closing after transferring n bytes.
+func (q *Quotas) Close(uid int, n int64) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	u := q.apps[uid]
+	if u == nil {
+		return
+	}
+	u.roll(time.Now())
+	if u.conns > 0 {
+		u.conns--
+	}
+	if u.maxConns > 0 && u.conns < u.maxConns {
+		// notify again the next time u is at capacity
+		delete(u.notified, Conns)
+	}
+	u.bytes += n
+}
+
+// Query admits a dns query from uid, and reports whether it may go ahead.
+// Throttled queries are held back before Query returns.
+func (q *Quotas) Query(uid int) bool {
+	if q == nil {
+		return true
+	}
+	q.Lock()
+	u := q.apps[uid]
+	if u == nil {
+		q.Unlock()
+		return true
+	}
+	u.roll(time.Now())
+	u.queries++
+	if u.maxQueries <= 0 || u.queries <= u.maxQueries {
+		q.Unlock()
+		return true
+	}
+	action, notify := q.exceeded(uid, u, Queries, u.maxQueries)
+	q.Unlock()
+	return enforce(action, notify)
+}
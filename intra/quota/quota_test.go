@@ -0,0 +1,85 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package quota
+
+import (
+	"testing"
+)
+
+type fakeListener struct {
+	kinds []string
+}
+
+func (l *fakeListener) OnQuotaExceeded(uid int, kind string, limit int64, action int) {
+	l.kinds = append(l.kinds, kind)
+}
+
+func TestConns(t *testing.T) {
+	l := &fakeListener{}
+	q := NewQuotas(l)
+	if err := q.Set(10010, 2, 0, 0, Block); err != nil {
+		t.Fatal(err)
+	}
+	if !q.Open(10010) || !q.Open(10010) {
+		t.Fatal("Connections within quota refused")
+	}
+	if q.Open(10010) || q.Open(10010) {
+		t.Error("Connection over quota admitted")
+	}
+	if !q.Open(10020) {
+		t.Error("App without quota refused")
+	}
+	q.Close(10010, 0)
+	if !q.Open(10010) {
+		t.Error("Connection refused after another closed")
+	}
+	if q.Open(10010) {
+		t.Error("Connection over quota admitted")
+	}
+	if len(l.kinds) != 2 || l.kinds[0] != Conns || l.kinds[1] != Conns {
+		t.Errorf("Wrong events %v", l.kinds)
+	}
+}
+
+func TestQueriesAndBytes(t *testing.T) {
+	l := &fakeListener{}
+	q := NewQuotas(l)
+	q.Set(10010, 0, 1, 100, Block)
+	if !q.Query(10010) {
+		t.Error("Query within quota refused")
+	}
+	if q.Query(10010) || q.Query(10010) {
+		t.Error("Query over quota admitted")
+	}
+
+	if !q.Open(10010) {
+		t.Fatal("Connection within quota refused")
+	}
+	q.Close(10010, 150)
+	if q.Open(10010) {
+		t.Error("Connection over byte quota admitted")
+	}
+	if len(l.kinds) != 2 || l.kinds[0] != Queries || l.kinds[1] != Bytes {
+		t.Errorf("Wrong events %v", l.kinds)
+	}
+
+	q.Remove(10010)
+	if !q.Query(10010) || !q.Open(10010) {
+		t.Error("Removed quota still enforced")
+	}
+	if err := q.Set(10010, 1, 1, 1, 7); err == nil {
+		t.Error("Expected error for unknown action")
+	}
+}
+
+func TestNil(t *testing.T) {
+	var q *Quotas
+	if q.Has() || !q.Open(1) || !q.Query(1) {
+		t.Error("Nil quotas should admit everything")
+	}
+	q.Close(1, 1)
+}
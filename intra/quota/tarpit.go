@@ -0,0 +1,100 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxTarpitDelay caps the delay, beyond which most stub resolvers time out.
+const maxTarpitDelay = 3 * time.Second
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Tarpit delays, rather than drops, dns answers to apps that query faster
+// than the rate it allows, so that bursts from misbehaving apps are smoothed
+// out without breaking them entirely.  Each app gets a token bucket that
+// refills at qps and holds up to twice as many tokens.
+type Tarpit struct {
+	sync.Mutex
+	qps     float64
+	delay   time.Duration
+	buckets map[int]*bucket
+	// stats
+	total   int64
+	delayed int64
+	waited  time.Duration
+}
+
+// NewTarpit returns a Tarpit that delays answers by delayms (millis)
+// to apps querying faster than qps queries per second.
+func NewTarpit(qps int, delayms int) (*Tarpit, error) {
+	d := time.Duration(delayms) * time.Millisecond
+	if qps <= 0 {
+		return nil, errors.New("tarpit qps must be positive")
+	}
+	if d <= 0 || d > maxTarpitDelay {
+		return nil, errors.New("tarpit delay out of range")
+	}
+	return &Tarpit{qps: float64(qps), delay: d, buckets: make(map[int]*bucket)}, nil
+}
+
+// Delay accounts for a query from uid, and returns how long to hold its
+// answer back, if at all.
+func (t *Tarpit) Delay(uid int) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	t.total++
+	b := t.buckets[uid]
+	if b == nil {
+		b = &bucket{tokens: 2 * t.qps, last: now}
+		t.buckets[uid] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * t.qps
+	if b.tokens > 2*t.qps {
+		b.tokens = 2 * t.qps
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	t.delayed++
+	t.waited += t.delay
+	return t.delay
+}
+
+// Wait holds the caller back for as long as Delay(uid) says to.
+func (t *Tarpit) Wait(uid int) {
+	if d := t.Delay(uid); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Stats returns the number of queries seen and delayed, and the total
+// delay imposed (millis), as json.
+func (t *Tarpit) Stats() string {
+	t.Lock()
+	s := map[string]int64{
+		"total":    t.total,
+		"delayed":  t.delayed,
+		"delay_ms": int64(t.waited / time.Millisecond),
+	}
+	t.Unlock()
+	b, _ := json.Marshal(s)
+	return string(b)
+}
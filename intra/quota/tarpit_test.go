@@ -0,0 +1,51 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package quota
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTarpit(t *testing.T) {
+	if _, err := NewTarpit(0, 100); err == nil {
+		t.Error("Expected error for zero qps")
+	}
+	if _, err := NewTarpit(1, 10000); err == nil {
+		t.Error("Expected error for long delay")
+	}
+	tp, err := NewTarpit(2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A burst of up to 2*qps goes through undelayed.
+	for i := 0; i < 4; i++ {
+		if d := tp.Delay(10010); d != 0 {
+			t.Fatalf("Query %d delayed by %v", i, d)
+		}
+	}
+	if d := tp.Delay(10010); d != 100*time.Millisecond {
+		t.Errorf("Expected delay, got %v", d)
+	}
+	if d := tp.Delay(10020); d != 0 {
+		t.Error("Other apps should not be delayed")
+	}
+
+	var stats map[string]int64
+	if err := json.Unmarshal([]byte(tp.Stats()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats["total"] != 6 || stats["delayed"] != 1 || stats["delay_ms"] != 100 {
+		t.Errorf("Wrong stats %v", stats)
+	}
+
+	var nilpit *Tarpit
+	if nilpit.Delay(1) != 0 {
+		t.Error("Nil tarpit should not delay")
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package rdap looks up registration data (RDAP, RFC 9082) of ips, domains,
+// and autonomous systems.  Lookups are resolved and dialed through the
+// tunnel's own dns transport and egress, so that they don't leak outside it.
+package rdap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// bootstrap redirects queries to the registry that is authoritative for them.
+	bootstrap = "https://rdap.org/"
+	// maxBody caps the size of a response read.
+	maxBody = 256 * 1024
+	timeout = 20 * time.Second
+)
+
+var (
+	asn    = regexp.MustCompile(`(?i)^as(\d+)$`)
+	domain = regexp.MustCompile(`(?i)^([a-z0-9_-]+\.)+[a-z0-9-]+\.?$`)
+)
+
+// Querier answers raw dns queries, like a doh.Transport.
+type Querier interface {
+	Query(q []byte) ([]byte, error)
+}
+
+// DialFunc dials addr over network, like net.Dialer.Dial.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// Client looks up registration data.
+type Client struct {
+	dns  Querier
+	dial DialFunc
+	hc   *http.Client
+}
+
+// NewClient returns a Client that resolves hostnames with `q` and
+// connects to them with `dial`.
+func NewClient(q Querier, dial DialFunc) *Client {
+	c := &Client{dns: q, dial: dial}
+	c.hc = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         c.dialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			// Lookups are rare; no point in idle connections.
+			DisableKeepAlives: true,
+		},
+	}
+	return c
+}
+
+// Lookup returns the RDAP (json) record of `query`, an ip address,
+// an autonomous system number (like AS13335), or a domain name.
+func (c *Client) Lookup(query string) (string, error) {
+	query = strings.TrimSpace(query)
+	path, err := pathOf(query)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, bootstrap+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxBody))
+		return "", fmt.Errorf("rdap: %s status %d", query, res.StatusCode)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBody))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func pathOf(query string) (string, error) {
+	if len(query) == 0 {
+		return "", errors.New("rdap: empty query")
+	}
+	if ip := net.ParseIP(query); ip != nil {
+		return "ip/" + ip.String(), nil
+	}
+	if m := asn.FindStringSubmatch(query); m != nil {
+		return "autnum/" + m[1], nil
+	}
+	if !domain.MatchString(query) {
+		return "", errors.New("rdap: not an ip, asn, or domain " + query)
+	}
+	return "domain/" + strings.TrimSuffix(strings.ToLower(query), "."), nil
+}
+
+func (c *Client) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := c.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = c.dial("tcp", net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolve returns the ips of host, resolved with c's dns transport.
+func (c *Client) resolve(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	var ips []net.IP
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host), qtype)
+		q, err := msg.Pack()
+		if err != nil {
+			return nil, err
+		}
+		r, err := c.dns.Query(q)
+		if err != nil {
+			continue
+		}
+		ans := new(dns.Msg)
+		if err := ans.Unpack(r); err != nil {
+			continue
+		}
+		for _, rr := range ans.Answer {
+			switch a := rr.(type) {
+			case *dns.A:
+				ips = append(ips, a.A)
+			case *dns.AAAA:
+				ips = append(ips, a.AAAA)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("rdap: no ips for " + host)
+	}
+	return ips, nil
+}
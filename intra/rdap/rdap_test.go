@@ -0,0 +1,70 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package rdap
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type fakeQuerier struct {
+	queries int
+}
+
+func (f *fakeQuerier) Query(q []byte) ([]byte, error) {
+	f.queries++
+	msg := new(dns.Msg)
+	msg.Unpack(q)
+	r := new(dns.Msg)
+	r.SetReply(msg)
+	if msg.Question[0].Qtype == dns.TypeA {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+	}
+	return r.Pack()
+}
+
+func TestPath(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":    "ip/192.0.2.1",
+		"2001:db8::1":  "ip/2001:db8::1",
+		"AS13335":      "autnum/13335",
+		"Example.COM.": "domain/example.com",
+	}
+	for q, want := range tests {
+		if got, err := pathOf(q); err != nil || got != want {
+			t.Errorf("%s: got %s %v, want %s", q, got, err, want)
+		}
+	}
+	if _, err := pathOf(""); err == nil {
+		t.Error("Expected error for empty query")
+	}
+	if _, err := pathOf("not a domain"); err == nil {
+		t.Error("Expected error for bad query")
+	}
+}
+
+func TestDialResolves(t *testing.T) {
+	f := &fakeQuerier{}
+	var dialed string
+	c := NewClient(f, func(network, addr string) (net.Conn, error) {
+		dialed = addr
+		return nil, net.UnknownNetworkError("fake")
+	})
+	c.dialContext(context.TODO(), "tcp", "rdap.example:443")
+	if f.queries != 2 {
+		t.Errorf("Expected A and AAAA queries, got %d", f.queries)
+	}
+	if dialed != "192.0.2.1:443" {
+		t.Errorf("Dialed %s", dialed)
+	}
+}
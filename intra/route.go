@@ -0,0 +1,37 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/celzero/firestack/intra/firewall"
+	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/settings"
+)
+
+// ownerUID returns the app that owns the flow of proto from src to dst, as
+// told by o, or else /proc/net; or -1.
+func ownerUID(o protect.ConnectionOwner, proto int32, src net.IP, sport int, dst net.IP, dport int) int {
+	if o != nil {
+		source := net.JoinHostPort(src.String(), strconv.Itoa(sport))
+		target := net.JoinHostPort(dst.String(), strconv.Itoa(dport))
+		if uid := o.GetUid(proto, source, target); uid >= 0 {
+			return uid
+		}
+	}
+	network := "tcp"
+	if proto == firewall.UDP {
+		network = "udp"
+	}
+	procEntry := settings.FindProcNetEntry(network, src, sport, dst, dport)
+	if procEntry != nil {
+		return procEntry.UserID
+	}
+	return -1
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package schema versions the summaries firestack reports to its clients.
+// Gobind exports struct fields as getters, and a client built against an
+// older firestack has no getters for fields added since; clients instead
+// check a summary's Version before relying on a field, or read fields by
+// name with Field, which returns "" for fields the summary doesn't have.
+//
+// Bump a version whenever fields are added to or change meaning in its
+// summary; fields are never removed or renamed.
+package schema
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Versions of summaries.
+const (
+	// DNSSummary is the version of doh.Summary and dnscrypt.Summary.
+	// 2: doh.Summary.DNSSEC
+	// 3: QName, QType, RCode, IPs, CNAMEs
+	// 4: doh.Summary.Retried
+	DNSSummary = 4
+	// TCPSummary is the version of intra.TCPSocketSummary.
+	// 2: Source, Target, UID, Route, Blocked
+	// 3: Domain
+	TCPSummary = 3
+	// UDPSummary is the version of intra.UDPSocketSummary.
+	// 2: Source, Target, UID, Route, Blocked
+	// 3: Domain
+	UDPSummary = 3
+)
+
+// Field returns the value of the exported field `name` of struct v (or a
+// pointer to one) as a string.  Fields of nested structs are named with dots,
+// like "Retry.Split".  Byte slices are base64 encoded.  Returns "" if there's
+// no such field, or if it or a struct on its path is nil.
+func Field(v interface{}, name string) string {
+	rv := reflect.ValueOf(v)
+	for _, part := range strings.Split(name, ".") {
+		for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+			if rv.IsNil() {
+				return ""
+			}
+			rv = rv.Elem()
+		}
+		if rv.Kind() != reflect.Struct || len(part) == 0 {
+			return ""
+		}
+		f, ok := rv.Type().FieldByName(part)
+		if !ok || len(f.PkgPath) > 0 {
+			// missing or unexported
+			return ""
+		}
+		rv = rv.FieldByIndex(f.Index)
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Struct, reflect.Func, reflect.Chan:
+		return ""
+	case reflect.Slice:
+		if b, ok := rv.Interface().([]byte); ok {
+			return base64.StdEncoding.EncodeToString(b)
+		}
+		return ""
+	}
+	return fmt.Sprint(rv.Interface())
+}
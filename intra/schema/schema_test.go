@@ -0,0 +1,49 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package schema
+
+import "testing"
+
+type inner struct {
+	Split int16
+}
+
+type outer struct {
+	Version int
+	Name    string
+	Latency float64
+	Data    []byte
+	Retry   *inner
+	hidden  int
+}
+
+func TestField(t *testing.T) {
+	s := &outer{Version: 2, Name: "x", Latency: 0.5, Data: []byte{1, 2}, hidden: 3}
+	cases := map[string]string{
+		"Version":     "2",
+		"Name":        "x",
+		"Latency":     "0.5",
+		"Data":        "AQI=",
+		"Retry.Split": "",
+		"Retry":       "",
+		"hidden":      "",
+		"Missing":     "",
+		"Name.Length": "",
+	}
+	for name, want := range cases {
+		if got := Field(s, name); got != want {
+			t.Errorf("Field(%s) = %q, want %q", name, got, want)
+		}
+	}
+	s.Retry = &inner{Split: 40}
+	if got := Field(s, "Retry.Split"); got != "40" {
+		t.Errorf("Nested field %q", got)
+	}
+	if got := Field(nil, "Version"); got != "" {
+		t.Errorf("Field of nil %q", got)
+	}
+}
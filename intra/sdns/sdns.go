@@ -0,0 +1,254 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sdns parses sdns:// DNS stamps (dnscrypt.info/stamps-specifications)
+// into the transports they describe, with their bootstrap ips and the
+// hashes of the certificates they pin, so that one stamp sets up a resolver.
+package sdns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Protos of stamps.
+const (
+	// Do53 is plain dns, over udp and tcp.
+	Do53 = "do53"
+	// DNSCrypt is a DNSCrypt resolver.
+	DNSCrypt = "dnscrypt"
+	// DoH is a DNS-over-HTTPS resolver.
+	DoH = "doh"
+	// DoT is a DNS-over-TLS resolver.
+	DoT = "dot"
+	// DoQ is a DNS-over-QUIC resolver.
+	DoQ = "doq"
+	// DNSCryptRelay is a relay of anonymized DNSCrypt.
+	DNSCryptRelay = "dnscrypt-relay"
+)
+
+const scheme = "sdns://"
+
+// protos are the protos of stamps, by the ids they start with.
+var protos = map[byte]string{
+	0x00: Do53,
+	0x01: DNSCrypt,
+	0x02: DoH,
+	0x03: DoT,
+	0x04: DoQ,
+	0x81: DNSCryptRelay,
+}
+
+// defaultPorts are the ports of the servers of stamps that leave them out.
+var defaultPorts = map[string]string{
+	Do53:          "53",
+	DNSCrypt:      "443",
+	DoH:           "443",
+	DoT:           "853",
+	DoQ:           "853",
+	DNSCryptRelay: "443",
+}
+
+// Informal properties of stamps' servers.
+const (
+	propDNSSEC   = 1 << 0
+	propNoLog    = 1 << 1
+	propNoFilter = 1 << 2
+)
+
+var errShort = errors.New("stamp too short")
+
+// Stamp is a parsed stamp.  Fields not of its Proto are left empty.
+type Stamp struct {
+	Proto string `json:"proto"`
+	// Addr is the ip:port of the server, "" if it is to be resolved from
+	// Hostname, as DoH and DoT stamps may leave it out.
+	Addr string `json:"addr"`
+	// Hostname is the host of the server, of its TLS certificate for DoH,
+	// DoT, DoQ, and its provider name for DNSCrypt; Port is its port.
+	Hostname string `json:"hostname"`
+	Port     string `json:"port"`
+	// Path and URL are the path and the https url of DoH servers.
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// PublicKey is the hex of the public key of DNSCrypt servers.
+	PublicKey string `json:"public_key"`
+	// Hashes are the hex SHA256 digests of TBS certificates, one of which
+	// must be in the chain of DoH, DoT, DoQ servers.
+	Hashes []string `json:"hashes"`
+	// Bootstrap are the ips of resolvers of Hostname, if any.
+	Bootstrap []string `json:"bootstrap"`
+	DNSSEC    bool     `json:"dnssec"`
+	NoLog     bool     `json:"nolog"`
+	NoFilter  bool     `json:"nofilter"`
+}
+
+// Parse returns the Stamp `s`, an sdns:// string.
+func Parse(s string) (*Stamp, error) {
+	if !strings.HasPrefix(s, scheme) {
+		return nil, fmt.Errorf("stamp not %s", scheme)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s[len(scheme):], "="))
+	if err != nil {
+		return nil, fmt.Errorf("bad stamp: %v", err)
+	}
+	if len(b) < 1 {
+		return nil, errShort
+	}
+	st := &Stamp{}
+	proto, ok := protos[b[0]]
+	if !ok {
+		return nil, fmt.Errorf("stamp of unknown proto %#x", b[0])
+	}
+	st.Proto = proto
+	r := &reader{b: b[1:]}
+	if proto != DNSCryptRelay {
+		props := r.props()
+		st.DNSSEC = props&propDNSSEC != 0
+		st.NoLog = props&propNoLog != 0
+		st.NoFilter = props&propNoFilter != 0
+	}
+	addr := r.lp()
+	switch proto {
+	case DNSCrypt:
+		st.PublicKey = hex.EncodeToString([]byte(r.lp()))
+		st.Hostname = r.lp()
+	case DoH, DoT, DoQ:
+		for _, h := range r.vlp() {
+			if len(h) > 0 {
+				st.Hashes = append(st.Hashes, hex.EncodeToString([]byte(h)))
+			}
+		}
+		st.Hostname, st.Port = hostPort(r.lp(), defaultPorts[proto])
+		if proto == DoH {
+			st.Path = r.lp()
+		}
+		if r.more() {
+			st.Bootstrap = r.vlp()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.more() {
+		return nil, errors.New("stamp has trailing bytes")
+	}
+	if len(addr) > 0 {
+		port := st.Port
+		if len(port) == 0 {
+			port = defaultPorts[proto]
+		}
+		host, p := hostPort(addr, port)
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("stamp addr %s not an ip", addr)
+		}
+		st.Addr = net.JoinHostPort(host, p)
+	}
+	if len(st.Addr) == 0 && len(st.Hostname) == 0 {
+		return nil, errors.New("stamp has no server")
+	}
+	if proto == DoH {
+		host := st.Hostname
+		if st.Port != "443" {
+			host = net.JoinHostPort(host, st.Port)
+		}
+		st.URL = "https://" + host + st.Path
+	}
+	return st, nil
+}
+
+// JSON returns st as json.
+func (st *Stamp) JSON() string {
+	b, _ := json.Marshal(st)
+	return string(b)
+}
+
+// HashesCSV returns the csv of the Hashes of st.
+func (st *Stamp) HashesCSV() string {
+	return strings.Join(st.Hashes, ",")
+}
+
+// BootstrapCSV returns the csv of the Bootstrap ips of st.
+func (st *Stamp) BootstrapCSV() string {
+	return strings.Join(st.Bootstrap, ",")
+}
+
+// hostPort splits s, a host, [ipv6], or either with a :port, into its host
+// and port, `port` if it has none.
+func hostPort(s string, port string) (string, string) {
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		return h, p
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), port
+}
+
+// reader reads the fields of a stamp, and its first error.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) more() bool {
+	return len(r.b) > 0
+}
+
+func (r *reader) props() uint64 {
+	if len(r.b) < 8 {
+		r.fail()
+		return 0
+	}
+	p := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return p
+}
+
+// lp reads a length-prefixed string.
+func (r *reader) lp() string {
+	if len(r.b) < 1 || len(r.b) < 1+int(r.b[0]) {
+		r.fail()
+		return ""
+	}
+	n := int(r.b[0])
+	s := string(r.b[1 : 1+n])
+	r.b = r.b[1+n:]
+	return s
+}
+
+// vlp reads a set of length-prefixed strings, whose lengths but the last
+// have their high bit set.
+func (r *reader) vlp() []string {
+	var s []string
+	for {
+		if len(r.b) < 1 {
+			r.fail()
+			return nil
+		}
+		n := int(r.b[0] &^ 0x80)
+		last := r.b[0]&0x80 == 0
+		if len(r.b) < 1+n {
+			r.fail()
+			return nil
+		}
+		s = append(s, string(r.b[1:1+n]))
+		r.b = r.b[1+n:]
+		if last {
+			return s
+		}
+	}
+}
+
+func (r *reader) fail() {
+	if r.err == nil {
+		r.err = errShort
+	}
+	r.b = nil
+}
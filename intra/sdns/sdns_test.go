@@ -0,0 +1,114 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sdns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+// encode returns the stamp of proto id `id`, with props, and fields, each
+// already length-prefixed.
+func encode(id byte, props byte, fields ...[]byte) string {
+	b := []byte{id, props, 0, 0, 0, 0, 0, 0, 0}
+	for _, f := range fields {
+		b = append(b, f...)
+	}
+	return scheme + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func lp(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func TestDoH(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 32)
+	s := stamps.ServerStamp{
+		Proto:         stamps.StampProtoTypeDoH,
+		ServerAddrStr: "9.9.9.9",
+		Hashes:        [][]uint8{hash},
+		ProviderName:  "dns.example:8443",
+		Path:          "/dns-query",
+		Props:         stamps.ServerInformalPropertyDNSSEC | stamps.ServerInformalPropertyNoLog,
+	}
+	st, err := Parse(s.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Proto != DoH || st.Addr != "9.9.9.9:8443" || st.Hostname != "dns.example" || st.URL != "https://dns.example:8443/dns-query" {
+		t.Errorf("doh %s", st.JSON())
+	}
+	if !st.DNSSEC || !st.NoLog || st.NoFilter {
+		t.Errorf("props %s", st.JSON())
+	}
+	if st.HashesCSV() != hex.EncodeToString(hash) {
+		t.Errorf("hashes %v", st.Hashes)
+	}
+}
+
+func TestDNSCrypt(t *testing.T) {
+	pk := bytes.Repeat([]byte{0x01}, 32)
+	s := stamps.ServerStamp{
+		Proto:         stamps.StampProtoTypeDNSCrypt,
+		ServerAddrStr: "[2001:db8::1]:5443",
+		ServerPk:      pk,
+		ProviderName:  "2.dnscrypt-cert.example",
+	}
+	st, err := Parse(s.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Proto != DNSCrypt || st.Addr != "[2001:db8::1]:5443" || st.Hostname != "2.dnscrypt-cert.example" || st.PublicKey != hex.EncodeToString(pk) {
+		t.Errorf("dnscrypt %s", st.JSON())
+	}
+}
+
+func TestDo53(t *testing.T) {
+	st, err := Parse(encode(0x00, propNoFilter, lp("1.1.1.1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Proto != Do53 || st.Addr != "1.1.1.1:53" || !st.NoFilter {
+		t.Errorf("do53 %s", st.JSON())
+	}
+}
+
+func TestDoTBootstrap(t *testing.T) {
+	// no addr, one empty hash, and two bootstrap ips
+	s := encode(0x03, 0, lp(""), []byte{0}, lp("dot.example"), append([]byte{0x80 | 7}, "1.2.3.4"...), lp("5.6.7.8"))
+	st, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Proto != DoT || st.Addr != "" || st.Hostname != "dot.example" || st.Port != "853" || len(st.Hashes) != 0 {
+		t.Errorf("dot %s", st.JSON())
+	}
+	if st.BootstrapCSV() != "1.2.3.4,5.6.7.8" {
+		t.Errorf("bootstrap %v", st.Bootstrap)
+	}
+}
+
+func TestBadStamps(t *testing.T) {
+	for _, s := range []string{
+		"https://dns.example",
+		"sdns://!!",
+		scheme,
+		encode(0x42, 0, lp("1.1.1.1")),
+		encode(0x00, 0, lp("dns.example")),
+		encode(0x00, 0, []byte{9, '1'}),
+		encode(0x00, 0, lp("1.1.1.1"), lp("extra")),
+		encode(0x03, 0, lp(""), []byte{0}, lp("")),
+	} {
+		if st, err := Parse(s); err == nil {
+			t.Errorf("%s parsed as %s", s, st.JSON())
+		}
+	}
+}
@@ -55,6 +55,14 @@ const ProxyModeSOCKS5 int = 1
 // ProxyModeHTTPS forwards packets to a HTTPS proxy.
 const ProxyModeHTTPS int = 2
 
+// DNSPort is the port of DNS requests trapped by the *Port DNS modes,
+// whatever their destination.
+const DNSPort int = 53
+
+// DoTPort is the port of DNS-over-TLS (and DNS-over-QUIC) requests, which
+// the *Port DNS modes refuse with TunMode.TrapDoT.
+const DoTPort int = 853
+
 // TunMode specifies blocking and dns modes
 type TunMode struct {
 	// DNSMode specifies the kind of DNS traffic to be trapped and routed to DoH servers
@@ -63,6 +71,21 @@ type TunMode struct {
 	BlockMode int
 	// ProxyMode determines where the traffic is forwarded to.
 	ProxyMode int
+	// TrapDoT, in the *Port DNS modes, refuses connections to DoTPort, which
+	// can't be answered without the resolver's certificate, so that apps fall
+	// back to DNS on DNSPort, which is trapped.
+	TrapDoT bool
+}
+
+// TrapsAllDNS reports whether DNS requests are trapped whatever their
+// destination, as in DNSModePort, DNSModeCryptPort, and DNSModeProxyPort.
+func (t *TunMode) TrapsAllDNS() bool {
+	return t.DNSMode == DNSModePort || t.DNSMode == DNSModeCryptPort || t.DNSMode == DNSModeProxyPort
+}
+
+// RefusesDoT reports whether connections to `port` are refused, as TrapDoT.
+func (t *TunMode) RefusesDoT(port int) bool {
+	return t.TrapDoT && port == DoTPort && t.TrapsAllDNS()
 }
 
 // DNSOptions define https or socks5 proxy options
@@ -0,0 +1,126 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package settings
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/codes"
+)
+
+// maxAuditEntries caps the number of audit events retained in memory.
+const maxAuditEntries = 256
+
+// ManagedConfig holds constraints pushed by an administrator, typically
+// read from Android's managed-configurations (work profile) by the host app.
+// Once sealed, a ManagedConfig cannot be altered for the rest of the session,
+// and so a tampered UI cannot undo the constraints it enforces.
+type ManagedConfig struct {
+	sync.RWMutex
+	// resolver is the only resolver permitted, if non-empty.
+	resolver string
+	// blocklists is the blocklist stamp that must always be in-use, if non-empty.
+	blocklists string
+	// sealed is set once the admin's constraints are final.
+	sealed bool
+	// audit is a bounded log of "unix-millis,event" entries.
+	audit []string
+}
+
+// NewManagedConfig returns an empty, unsealed ManagedConfig.
+func NewManagedConfig() *ManagedConfig {
+	return &ManagedConfig{}
+}
+
+// LockResolver restricts the DNS resolver to `url`: the url of a DoH server,
+// the sdns:// stamp of a DNSCrypt server, or the ip:port of a Do53 server,
+// as in DNSOptions.IPPort.
+func (m *ManagedConfig) LockResolver(url string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.sealed {
+		return codes.New(codes.Managed, "managed config sealed")
+	}
+	m.resolver = url
+	return nil
+}
+
+// LockBlocklists pins on-device and remote blocking to `stamp` such
+// that blocklists cannot be disabled or altered.
+func (m *ManagedConfig) LockBlocklists(stamp string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.sealed {
+		return codes.New(codes.Managed, "managed config sealed")
+	}
+	m.blocklists = stamp
+	return nil
+}
+
+// Seal prevents any further changes to m.
+func (m *ManagedConfig) Seal() {
+	m.Lock()
+	m.sealed = true
+	m.Unlock()
+	m.Audit("sealed")
+}
+
+// Sealed reports whether m can no longer be changed.
+func (m *ManagedConfig) Sealed() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.sealed
+}
+
+// LockedResolver returns the locked resolver, or an empty string if unlocked.
+func (m *ManagedConfig) LockedResolver() string {
+	m.RLock()
+	defer m.RUnlock()
+	return m.resolver
+}
+
+// LockedBlocklists returns the locked blocklist stamp, or an empty string if unlocked.
+func (m *ManagedConfig) LockedBlocklists() string {
+	m.RLock()
+	defer m.RUnlock()
+	return m.blocklists
+}
+
+// AllowResolver reports whether `url`, as in LockResolver, may be used as the
+// DNS resolver, and records an audit event if it may not.
+func (m *ManagedConfig) AllowResolver(url string) bool {
+	r := m.LockedResolver()
+	if len(r) <= 0 || r == url {
+		return true
+	}
+	m.Audit("denied resolver " + url)
+	return false
+}
+
+// Audit records `event` in the audit log.
+func (m *ManagedConfig) Audit(event string) {
+	// csv-separated entries; strip separators from the event itself
+	event = strings.NewReplacer(",", " ", "\n", " ").Replace(event)
+	entry := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10) + "," + event
+
+	m.Lock()
+	defer m.Unlock()
+	if len(m.audit) >= maxAuditEntries {
+		m.audit = m.audit[1:]
+	}
+	m.audit = append(m.audit, entry)
+}
+
+// AuditLog returns newline-separated "unix-millis,event" entries, oldest first.
+func (m *ManagedConfig) AuditLog() string {
+	m.RLock()
+	defer m.RUnlock()
+	return strings.Join(m.audit, "\n")
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package settings
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/celzero/firestack/intra/codes"
+)
+
+func TestLock(t *testing.T) {
+	m := NewManagedConfig()
+	if len(m.LockedResolver()) > 0 || len(m.LockedBlocklists()) > 0 {
+		t.Fatal("new config locked")
+	}
+	if err := m.LockResolver("https://a.example/dns-query"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LockBlocklists("1:AAA="); err != nil {
+		t.Fatal(err)
+	}
+	if r := m.LockedResolver(); r != "https://a.example/dns-query" {
+		t.Errorf("resolver %q", r)
+	}
+	if b := m.LockedBlocklists(); b != "1:AAA=" {
+		t.Errorf("blocklists %q", b)
+	}
+	// locks may be changed until sealed
+	if err := m.LockResolver("https://b.example/dns-query"); err != nil {
+		t.Fatal(err)
+	}
+	if r := m.LockedResolver(); r != "https://b.example/dns-query" {
+		t.Errorf("resolver %q", r)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	m := NewManagedConfig()
+	m.LockResolver("https://a.example/dns-query")
+	if m.Sealed() {
+		t.Fatal("new config sealed")
+	}
+	m.Seal()
+	if !m.Sealed() {
+		t.Fatal("not sealed")
+	}
+	if err := m.LockResolver("https://b.example/dns-query"); codes.Of(err) != codes.Managed {
+		t.Errorf("sealed resolver locked: %v", err)
+	}
+	if err := m.LockBlocklists("1:AAA="); codes.Of(err) != codes.Managed {
+		t.Errorf("sealed blocklists locked: %v", err)
+	}
+	if r := m.LockedResolver(); r != "https://a.example/dns-query" {
+		t.Errorf("resolver %q", r)
+	}
+	if b := m.LockedBlocklists(); len(b) > 0 {
+		t.Errorf("blocklists %q", b)
+	}
+}
+
+func TestAllowResolver(t *testing.T) {
+	m := NewManagedConfig()
+	if !m.AllowResolver("https://any.example/dns-query") {
+		t.Error("unlocked config denied")
+	}
+	m.LockResolver("https://a.example/dns-query")
+	for _, c := range []struct {
+		url   string
+		allow bool
+	}{
+		{"https://a.example/dns-query", true},
+		{"https://b.example/dns-query", false},
+		{"https://a.example/dns-query/", false},
+		{"", false},
+	} {
+		if got := m.AllowResolver(c.url); got != c.allow {
+			t.Errorf("AllowResolver(%q) = %t", c.url, got)
+		}
+	}
+	// allowed resolvers aren't audited
+	log := strings.Split(m.AuditLog(), "\n")
+	if len(log) != 3 {
+		t.Fatalf("audit %q", log)
+	}
+	if !strings.HasSuffix(log[0], ",denied resolver https://b.example/dns-query") {
+		t.Errorf("audit %q", log[0])
+	}
+}
+
+func TestAudit(t *testing.T) {
+	m := NewManagedConfig()
+	if len(m.AuditLog()) > 0 {
+		t.Fatal("new config audited")
+	}
+	m.Audit("a,b\nc")
+	entry := m.AuditLog()
+	i := strings.Index(entry, ",")
+	if _, err := strconv.ParseInt(entry[:i], 10, 64); err != nil {
+		t.Errorf("entry %q: %v", entry, err)
+	}
+	// separators in events are stripped
+	if entry[i+1:] != "a b c" {
+		t.Errorf("entry %q", entry)
+	}
+}
+
+func TestAuditRing(t *testing.T) {
+	m := NewManagedConfig()
+	n := maxAuditEntries + 10
+	for i := 0; i < n; i++ {
+		m.Audit(strconv.Itoa(i))
+	}
+	log := strings.Split(m.AuditLog(), "\n")
+	if len(log) != maxAuditEntries {
+		t.Fatalf("%d entries", len(log))
+	}
+	// the oldest are dropped, and the rest kept oldest first
+	for j, entry := range log {
+		want := "," + strconv.Itoa(n-maxAuditEntries+j)
+		if !strings.HasSuffix(entry, want) {
+			t.Fatalf("entry %d: %q, not *%s", j, entry, want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sniff tells the names that flows are for from their first bytes:
+// the SNI of TLS ClientHellos, and the Host of HTTP/1 requests.
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Jigsaw-Code/getsni"
+)
+
+// MaxBytes is the most bytes read to sniff a name from: a TLS record, or
+// HTTP request headers, run no longer than this.
+const MaxBytes = 16*1024 + 5
+
+const recordHeaderLen = 5
+
+var methods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// Name returns the name in b, the first bytes of a flow, in lower case and
+// without a port, or "" if there's none.  more reports whether more bytes
+// of the flow may yet tell it.
+func Name(b []byte) (name string, more bool) {
+	if len(b) == 0 {
+		return "", true
+	}
+	if b[0] == 0x16 {
+		return tlsName(b)
+	}
+	return httpName(b)
+}
+
+func tlsName(b []byte) (string, bool) {
+	if len(b) < recordHeaderLen {
+		return "", true
+	}
+	end := recordHeaderLen + int(binary.BigEndian.Uint16(b[3:5]))
+	if len(b) < end {
+		return "", end <= MaxBytes
+	}
+	sni, err := getsni.GetSNI(b[:end])
+	if err != nil {
+		return "", false
+	}
+	return strings.ToLower(sni), false
+}
+
+func httpName(b []byte) (string, bool) {
+	method := false
+	for _, m := range methods {
+		n := len(m)
+		if len(b) < n && strings.HasPrefix(m, string(b)) {
+			// too short to tell
+			return "", true
+		}
+		if bytes.HasPrefix(b, []byte(m)) {
+			method = true
+			break
+		}
+	}
+	if !method {
+		return "", false
+	}
+	lines := bytes.Split(b, []byte("\r\n"))
+	// the last line may not be complete
+	for _, line := range lines[1 : len(lines)-1] {
+		if len(line) == 0 {
+			// end of headers
+			return "", false
+		}
+		i := bytes.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(string(line[:i]), "host") {
+			continue
+		}
+		host := strings.TrimSpace(string(line[i+1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.ToLower(strings.Trim(host, "[]")), false
+	}
+	return "", len(b) < MaxBytes
+}
+
+type result struct {
+	b   []byte
+	err error
+}
+
+// Sniff reads from r till the name in its first bytes is told, or can't
+// be, or `wait` passes, and returns the name, if any, and a reader that
+// reads the bytes read, then the rest of r.
+func Sniff(r io.Reader, wait time.Duration) (name string, replay io.Reader) {
+	var got []byte
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		var more bool
+		if name, more = Name(got); !more || len(got) >= MaxBytes {
+			return name, &replayer{buf: got, r: r}
+		}
+		pending := make(chan result, 1)
+		go func() {
+			b := make([]byte, MaxBytes)
+			n, err := r.Read(b)
+			pending <- result{b[:n], err}
+		}()
+		select {
+		case res := <-pending:
+			got = append(got, res.b...)
+			if res.err != nil {
+				name, _ = Name(got)
+				return name, &replayer{buf: got, err: res.err}
+			}
+		case <-timeout.C:
+			// the read pending is replayed, once done
+			return "", &replayer{buf: got, pending: pending, r: r}
+		}
+	}
+}
+
+// replayer reads buf, then the result of the read pending, if any, then r,
+// or err if set.
+type replayer struct {
+	buf     []byte
+	pending chan result
+	r       io.Reader
+	err     error
+}
+
+func (p *replayer) Read(b []byte) (int, error) {
+	if len(p.buf) == 0 && p.pending != nil {
+		res := <-p.pending
+		p.pending = nil
+		p.buf = res.b
+		if res.err != nil {
+			p.err = res.err
+		}
+	}
+	if len(p.buf) > 0 {
+		n := copy(b, p.buf)
+		p.buf = p.buf[n:]
+		return n, nil
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.r.Read(b)
+}
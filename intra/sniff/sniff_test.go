@@ -0,0 +1,96 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sniff
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the ClientHello that crypto/tls sends for sni.
+func clientHello(t *testing.T, sni string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go tls.Client(c, &tls.Config{ServerName: sni}).Handshake()
+	b := make([]byte, MaxBytes)
+	n, err := s.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	return b[:n]
+}
+
+func TestTLS(t *testing.T) {
+	hello := clientHello(t, "www.Example.com")
+	if name, more := Name(hello); name != "www.example.com" || more {
+		t.Errorf("Wrong name %q, more %v", name, more)
+	}
+	if name, more := Name(hello[:len(hello)/2]); name != "" || !more {
+		t.Errorf("Short hello: name %q, more %v", name, more)
+	}
+	if name, more := Name(hello[:3]); name != "" || !more {
+		t.Errorf("Short header: name %q, more %v", name, more)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	for _, c := range []struct {
+		b    string
+		name string
+		more bool
+	}{
+		{"GET / HTTP/1.1\r\nUser-Agent: x\r\nHOST: Example.com:8080\r\n\r\n", "example.com", false},
+		{"POST /a HTTP/1.1\r\nHost: [2001:db8::1]\r\n", "2001:db8::1", false},
+		{"GET / HTTP/1.1\r\nHost: exam", "", true},
+		{"GET / HTTP/1.0\r\n\r\n", "", false},
+		{"GE", "", true},
+		{"SSH-2.0-OpenSSH\r\n", "", false},
+	} {
+		if name, more := Name([]byte(c.b)); name != c.name || more != c.more {
+			t.Errorf("%q: got %q %v, want %q %v", c.b, name, more, c.name, c.more)
+		}
+	}
+}
+
+func TestSniff(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\nbody"
+	c, s := net.Pipe()
+	go func() {
+		// in two writes, as in two segments
+		c.Write([]byte(req[:20]))
+		c.Write([]byte(req[20:]))
+		c.Close()
+	}()
+	name, replay := Sniff(s, time.Second)
+	if name != "example.com" {
+		t.Errorf("Wrong name %q", name)
+	}
+	if b, _ := ioutil.ReadAll(replay); string(b) != req {
+		t.Errorf("Wrong replay %q", b)
+	}
+}
+
+func TestSniffTimeout(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	name, replay := Sniff(s, 10*time.Millisecond)
+	if name != "" {
+		t.Errorf("Wrong name %q", name)
+	}
+	// bytes sent after the wait are read all the same
+	go c.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(replay, b); err != nil || !bytes.Equal(b, []byte("hello")) {
+		t.Errorf("Wrong replay %q %v", b, err)
+	}
+}
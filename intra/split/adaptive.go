@@ -0,0 +1,98 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package split
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptiveTTL is how long a destination is remembered to need splitting.
+	adaptiveTTL = 6 * time.Hour
+	// maxAdaptiveHosts caps the number of destinations remembered.
+	maxAdaptiveHosts = 1024
+)
+
+// Adaptive dials destinations normally, and retries with splitting if the
+// hello is met with a reset or a timeout.  Destinations for which splitting
+// worked are remembered, so that later connections to them are split right
+// away instead of paying for the probe again.
+type Adaptive struct {
+	sync.Mutex
+	hosts map[string]time.Time // destination ip => expiry
+}
+
+// NewAdaptive returns an Adaptive dialer that remembers nothing yet.
+func NewAdaptive() *Adaptive {
+	return &Adaptive{hosts: make(map[string]time.Time)}
+}
+
+// Dial connects to addr with dialer, and splits the first segment as per
+// `strategy` (DefaultStrategy if nil) either right away, if addr needed
+// splitting before, or on retry.  If `stats` is non-nil, it will be populated
+// with retry-related information.
+func (a *Adaptive) Dial(dialer *net.Dialer, addr *net.TCPAddr, stats *RetryStats, strategy *Strategy) (DuplexConn, error) {
+	key := addr.IP.String()
+	if a.needsSplit(key) {
+		return DialWithSplitStrategy(dialer, addr, strategy)
+	}
+	c, err := DialWithSplitRetryStrategy(dialer, addr, stats, strategy)
+	if r, ok := c.(*retrier); ok {
+		r.onRetry = func(ok bool) {
+			if ok {
+				a.remember(key)
+			}
+		}
+	}
+	return c, err
+}
+
+// NeedsSplit reports whether connections to ip are split right away.
+func (a *Adaptive) NeedsSplit(ip string) bool {
+	return a.needsSplit(ip)
+}
+
+// Clear forgets all destinations, say, after a network change.
+func (a *Adaptive) Clear() {
+	a.Lock()
+	a.hosts = make(map[string]time.Time)
+	a.Unlock()
+}
+
+func (a *Adaptive) needsSplit(key string) bool {
+	a.Lock()
+	defer a.Unlock()
+	exp, ok := a.hosts[key]
+	if ok && time.Now().After(exp) {
+		delete(a.hosts, key)
+		return false
+	}
+	return ok
+}
+
+func (a *Adaptive) remember(key string) {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	if len(a.hosts) >= maxAdaptiveHosts {
+		// Evict expired entries, or else any one entry.
+		for k, exp := range a.hosts {
+			if now.After(exp) {
+				delete(a.hosts, k)
+			}
+		}
+		for k := range a.hosts {
+			if len(a.hosts) < maxAdaptiveHosts {
+				break
+			}
+			delete(a.hosts, k)
+		}
+	}
+	a.hosts[key] = now.Add(adaptiveTTL)
+}
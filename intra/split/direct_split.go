@@ -29,19 +29,26 @@ type DuplexConn interface {
 
 type splitter struct {
 	*net.TCPConn
-	used bool // Initially false.  Becomes true after the first write.
+	used     bool // Initially false.  Becomes true after the first write.
+	strategy *Strategy
 }
 
 // DialWithSplit returns a TCP connection that always splits the initial upstream segment.
 // Like net.Conn, it is intended for two-threaded use, with one thread calling
 // Read and CloseRead, and another calling Write, ReadFrom, and CloseWrite.
 func DialWithSplit(d *net.Dialer, addr *net.TCPAddr) (DuplexConn, error) {
+	return DialWithSplitStrategy(d, addr, nil)
+}
+
+// DialWithSplitStrategy is like DialWithSplit, but splits the initial upstream
+// segment as per `strategy`, or DefaultStrategy if nil.
+func DialWithSplitStrategy(d *net.Dialer, addr *net.TCPAddr, strategy *Strategy) (DuplexConn, error) {
 	conn, err := d.Dial(addr.Network(), addr.String())
 	if err != nil {
 		return nil, err
 	}
 
-	return &splitter{TCPConn: conn.(*net.TCPConn)}, nil
+	return &splitter{TCPConn: conn.(*net.TCPConn), strategy: strategy}, nil
 }
 
 // Write-related functions
@@ -54,13 +61,12 @@ func (s *splitter) Write(b []byte) (int, error) {
 
 	// Setting `used` to true ensures that this code only runs once per socket.
 	s.used = true
-	b1, b2 := splitHello(b)
-	n1, err := conn.Write(b1)
-	if err != nil {
-		return n1, err
+	n, err := s.strategy.send(conn, s.strategy.split(b))
+	// TLS records may have been re-framed, and so more than len(b) sent.
+	if err == nil || n > len(b) {
+		n = len(b)
 	}
-	n2, err := conn.Write(b2)
-	return n1 + n2, err
+	return n, err
 }
 
 func (s *splitter) ReadFrom(reader io.Reader) (bytes int64, err error) {
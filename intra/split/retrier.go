@@ -17,12 +17,15 @@ package split
 import (
 	"errors"
 	"io"
-	"math/rand"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Jigsaw-Code/getsni"
+
+	"github.com/celzero/firestack/intra/metrics"
+	"github.com/celzero/firestack/intra/xbuf"
 )
 
 type RetryStats struct {
@@ -56,12 +59,17 @@ type retrier struct {
 	// hello is the contents written before the first read.  It is initially empty,
 	// and is cleared when the first byte is received.
 	hello []byte
+	// strategy determines how hello is split when retrying.
+	strategy *Strategy
 	// Flag indicating when retry is finished or unnecessary.
 	retryCompleteFlag chan struct{}
 	// Flags indicating whether the caller has called CloseRead and CloseWrite.
 	readCloseFlag  chan struct{}
 	writeCloseFlag chan struct{}
 	stats          *RetryStats
+	// onRetry, if set, is called with the outcome of a retry caused by a
+	// reset or a timeout, which is how middleboxes typically censor a hello.
+	onRetry func(ok bool)
 }
 
 // Helper functions for reading flags.
@@ -118,6 +126,12 @@ const DefaultTimeout time.Duration = 0
 // `addr` is the destination.
 // If `stats` is non-nil, it will be populated with retry-related information.
 func DialWithSplitRetry(dialer *net.Dialer, addr *net.TCPAddr, stats *RetryStats) (DuplexConn, error) {
+	return DialWithSplitRetryStrategy(dialer, addr, stats, nil)
+}
+
+// DialWithSplitRetryStrategy is like DialWithSplitRetry, but splits the
+// retried segment as per `strategy`, or DefaultStrategy if nil.
+func DialWithSplitRetryStrategy(dialer *net.Dialer, addr *net.TCPAddr, stats *RetryStats, strategy *Strategy) (DuplexConn, error) {
 	before := time.Now()
 	conn, err := dialer.Dial(addr.Network(), addr.String())
 	if err != nil {
@@ -136,6 +150,7 @@ func DialWithSplitRetry(dialer *net.Dialer, addr *net.TCPAddr, stats *RetryStats
 		addr:              addr,
 		conn:              conn.(*net.TCPConn),
 		timeout:           timeout(before, after),
+		strategy:          strategy,
 		retryCompleteFlag: make(chan struct{}),
 		readCloseFlag:     make(chan struct{}),
 		writeCloseFlag:    make(chan struct{}),
@@ -159,8 +174,12 @@ func (r *retrier) Read(buf []byte) (n int, err error) {
 			if errors.As(err, &neterr) {
 				r.stats.Timeout = neterr.Timeout()
 			}
+			censored := r.stats.Timeout || errors.Is(err, syscall.ECONNRESET)
 			// Read failed.  Retry.
 			n, err = r.retry(buf)
+			if censored && r.onRetry != nil {
+				r.onRetry(err == nil)
+			}
 		}
 		close(r.retryCompleteFlag)
 		// Unset read deadline.
@@ -172,18 +191,16 @@ func (r *retrier) Read(buf []byte) (n int, err error) {
 }
 
 func (r *retrier) retry(buf []byte) (n int, err error) {
+	metrics.Add(metrics.DialRetries, 1)
 	r.conn.Close()
 	var newConn net.Conn
 	if newConn, err = r.dialer.Dial(r.addr.Network(), r.addr.String()); err != nil {
 		return
 	}
 	r.conn = newConn.(*net.TCPConn)
-	first, second := splitHello(r.hello)
-	r.stats.Split = int16(len(first))
-	if _, err = r.conn.Write(first); err != nil {
-		return
-	}
-	if _, err = r.conn.Write(second); err != nil {
+	segments := r.strategy.split(r.hello)
+	r.stats.Split = int16(len(segments[0]))
+	if _, err = r.strategy.send(r.conn, segments); err != nil {
 		return
 	}
 	// While we were creating the new socket, the caller might have called CloseRead
@@ -211,24 +228,6 @@ func (r *retrier) CloseRead() error {
 	return r.conn.CloseRead()
 }
 
-func splitHello(hello []byte) ([]byte, []byte) {
-	if len(hello) == 0 {
-		return hello, hello
-	}
-	const (
-		MIN_SPLIT int = 32
-		MAX_SPLIT int = 64
-	)
-
-	// Random number in the range [MIN_SPLIT, MAX_SPLIT]
-	s := MIN_SPLIT + rand.Intn(MAX_SPLIT+1-MIN_SPLIT)
-	limit := len(hello) / 2
-	if s > limit {
-		s = limit
-	}
-	return hello[:s], hello[s:]
-}
-
 // Write-related functions
 func (r *retrier) Write(b []byte) (int, error) {
 	// Double-checked locking pattern.  This avoids lock acquisition on
@@ -277,7 +276,9 @@ func (r *retrier) Write(b []byte) (int, error) {
 func copyOnce(dst io.Writer, src io.Reader) (int64, error) {
 	// This buffer is large enough to hold any ordinary first write
 	// without introducing extra splitting.
-	buf := make([]byte, 2048)
+	b := xbuf.Get(xbuf.Small)
+	defer xbuf.Put(b)
+	buf := *b
 	n, err := src.Read(buf)
 	if err != nil {
 		return 0, err
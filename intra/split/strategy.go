@@ -0,0 +1,217 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package split
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+const (
+	minSplit = 32
+	maxSplit = 64
+	// maxFragments caps the number of segments the first write is split into.
+	maxFragments = 64
+	// desyncWait is how long the low-ttl segment is given to hit the wire.
+	desyncWait = 2 * time.Millisecond
+	// maxDelay caps the wait between segments, beyond which servers may time out.
+	maxDelay = 500 * time.Millisecond
+)
+
+// Strategy configures how the initial upstream segment is split.
+type Strategy struct {
+	// Offsets are byte offsets into the first write at which to cut it.
+	// Takes precedence over Fragments, if non-empty.
+	Offsets []int
+	// Fragments is the number of segments to cut the first write into.
+	// The first cut is at a random offset in [32, 64], and the rest of the
+	// write is divided evenly among the remaining segments.
+	Fragments int
+	// HelloOnly restricts splitting to writes that carry a TLS ClientHello.
+	HelloOnly bool
+	// Delay is the wait between writing consecutive segments.
+	Delay time.Duration
+	// DesyncTTL, if non-zero, is the TTL (or hop limit) the first segment is
+	// sent with.  The segment expires before reaching the server but not
+	// before the middlebox sees it; the kernel later retransmits it with the
+	// usual TTL, and so the server receives segments out of order, which
+	// stateful filters that reassemble in order fail to match on.
+	DesyncTTL int
+	// RecordSizes, if non-empty, are the payload sizes of TLS records that a
+	// ClientHello is re-framed into before it is split into segments.
+	RecordSizes []int
+}
+
+// DefaultStrategy cuts every first write into two segments.
+var DefaultStrategy = &Strategy{Fragments: 2}
+
+// NewStrategy returns a Strategy that splits at comma-separated byte
+// `offsets`, or else into `fragments` segments; `helloOnly` restricts
+// splitting to TLS ClientHellos.
+func NewStrategy(offsets string, fragments int, helloOnly bool) (*Strategy, error) {
+	s := &Strategy{Fragments: fragments, HelloOnly: helloOnly}
+	for _, v := range strings.Split(offsets, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		o, err := strconv.Atoi(v)
+		if err != nil || o <= 0 {
+			return nil, errors.New("invalid split offset " + v)
+		}
+		s.Offsets = append(s.Offsets, o)
+	}
+	if len(s.Offsets) > maxFragments {
+		return nil, errors.New("too many split offsets")
+	}
+	if len(s.Offsets) == 0 && (fragments < 2 || fragments > maxFragments) {
+		return nil, errors.New("fragments must be between 2 and " + strconv.Itoa(maxFragments))
+	}
+	sort.Ints(s.Offsets)
+	return s, nil
+}
+
+// SetDesync sets s to wait `delay` between segments, and to send the first
+// segment with `ttl` if non-zero.
+func (s *Strategy) SetDesync(delay time.Duration, ttl int) error {
+	if delay < 0 || delay > maxDelay {
+		return errors.New("split delay out of range")
+	}
+	if ttl < 0 || ttl > 255 {
+		return errors.New("desync ttl out of range")
+	}
+	s.Delay = delay
+	s.DesyncTTL = ttl
+	return nil
+}
+
+// SetRecordSizes sets s to re-frame ClientHellos into TLS records of
+// comma-separated payload `sizes`; an empty csv disables re-framing.
+func (s *Strategy) SetRecordSizes(sizes string) error {
+	var rs []int
+	for _, v := range strings.Split(sizes, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		// records carry no more than 2^14 bytes of plaintext
+		if err != nil || n <= 0 || n > 1<<14 {
+			return errors.New("invalid tls record size " + v)
+		}
+		rs = append(rs, n)
+	}
+	s.RecordSizes = rs
+	return nil
+}
+
+// isClientHello reports whether b begins with a TLS handshake record
+// carrying a ClientHello.
+func isClientHello(b []byte) bool {
+	const (
+		recordTypeHandshake = 0x16
+		handshakeTypeHello  = 0x01
+	)
+	return len(b) > 5 && b[0] == recordTypeHandshake && b[5] == handshakeTypeHello
+}
+
+// split cuts b into segments per s. A nil s is DefaultStrategy.
+func (s *Strategy) split(b []byte) [][]byte {
+	if s == nil {
+		s = DefaultStrategy
+	}
+	if len(b) == 0 || (s.HelloOnly && !isClientHello(b)) {
+		return [][]byte{b}
+	}
+	if len(s.RecordSizes) > 0 && isClientHello(b) {
+		b = fragmentRecords(b, s.RecordSizes)
+	}
+
+	var cuts []int
+	if len(s.Offsets) > 0 {
+		cuts = s.Offsets
+	} else {
+		cuts = evenCuts(len(b), s.Fragments)
+	}
+
+	segments := make([][]byte, 0, len(cuts)+1)
+	prev := 0
+	for _, c := range cuts {
+		if c <= prev || c >= len(b) {
+			continue
+		}
+		segments = append(segments, b[prev:c])
+		prev = c
+	}
+	return append(segments, b[prev:])
+}
+
+// evenCuts returns offsets that cut n bytes into `fragments` segments,
+// the first of which is between minSplit and maxSplit bytes long.
+func evenCuts(n int, fragments int) []int {
+	if fragments < 2 {
+		return nil
+	}
+	// Random number in the range [minSplit, maxSplit]
+	first := minSplit + rand.Intn(maxSplit+1-minSplit)
+	if limit := n / 2; first > limit {
+		first = limit
+	}
+	cuts := []int{first}
+	rest := n - first
+	step := rest / (fragments - 1)
+	if step <= 0 {
+		return cuts
+	}
+	for i := 1; i < fragments-1; i++ {
+		cuts = append(cuts, first+i*step)
+	}
+	return cuts
+}
+
+// send writes segments to conn as per s, and returns the bytes written.
+// A nil s is DefaultStrategy.
+func (s *Strategy) send(conn *net.TCPConn, segments [][]byte) (n int, err error) {
+	if s == nil {
+		s = DefaultStrategy
+	}
+	for i, seg := range segments {
+		if i > 0 && s.Delay > 0 {
+			time.Sleep(s.Delay)
+		}
+		desync := i == 0 && len(segments) > 1 && s.DesyncTTL > 0
+		var ttl int
+		if desync {
+			var terr error
+			if ttl, terr = setTTL(conn, s.DesyncTTL); terr != nil {
+				log.Warnf("split: desync ttl not set: %v", terr)
+				desync = false
+			}
+		}
+		var m int
+		m, err = conn.Write(seg)
+		n += m
+		if desync {
+			// Let the low-ttl segment out before restoring ttl.
+			time.Sleep(desyncWait)
+			if _, terr := setTTL(conn, ttl); terr != nil {
+				log.Warnf("split: ttl not restored: %v", terr)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
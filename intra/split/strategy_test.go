@@ -0,0 +1,237 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package split
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func joined(segments [][]byte) []byte {
+	return bytes.Join(segments, nil)
+}
+
+func TestDefaultStrategy(t *testing.T) {
+	b := make([]byte, 200)
+	segments := (*Strategy)(nil).split(b)
+	if len(segments) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(segments))
+	}
+	if n := len(segments[0]); n < minSplit || n > maxSplit {
+		t.Errorf("Unexpected split: %d", n)
+	}
+	if !bytes.Equal(joined(segments), b) {
+		t.Error("Segments do not add up")
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	s, err := NewStrategy("40, 2,500", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 100)
+	segments := s.split(b)
+	if len(segments) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", len(segments))
+	}
+	if len(segments[0]) != 2 || len(segments[1]) != 38 || len(segments[2]) != 60 {
+		t.Errorf("Wrong segment lengths %d %d %d", len(segments[0]), len(segments[1]), len(segments[2]))
+	}
+}
+
+func TestFragments(t *testing.T) {
+	s, err := NewStrategy("", 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 400)
+	segments := s.split(b)
+	if len(segments) != 5 {
+		t.Fatalf("Expected 5 segments, got %d", len(segments))
+	}
+	if !bytes.Equal(joined(segments), b) {
+		t.Error("Segments do not add up")
+	}
+}
+
+func TestHelloOnly(t *testing.T) {
+	s, err := NewStrategy("", 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 200)
+	if len(s.split(plain)) != 1 {
+		t.Error("Non-ClientHello should not be split")
+	}
+	hello := make([]byte, 200)
+	hello[0], hello[5] = 0x16, 0x01
+	if len(s.split(hello)) != 2 {
+		t.Error("ClientHello should be split")
+	}
+}
+
+func TestBadStrategy(t *testing.T) {
+	if _, err := NewStrategy("a,b", 2, false); err == nil {
+		t.Error("Expected error for bad offsets")
+	}
+	if _, err := NewStrategy("", 1, false); err == nil {
+		t.Error("Expected error for too few fragments")
+	}
+}
+
+func TestDesync(t *testing.T) {
+	s, err := NewStrategy("8,16", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetDesync(time.Second, 4); err == nil {
+		t.Error("Expected error for long delay")
+	}
+	if err := s.SetDesync(time.Millisecond, 300); err == nil {
+		t.Error("Expected error for bad ttl")
+	}
+	if err := s.SetDesync(time.Millisecond, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := DialWithSplitStrategy(&net.Dialer{}, ln.Addr().(*net.TCPAddr), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	b := make([]byte, 64)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	if n, err := conn.Write(b); err != nil || n != len(b) {
+		t.Fatalf("Write failed %d %v", n, err)
+	}
+	// Loopback is a single hop, so even the low-ttl segment arrives.
+	got := make([]byte, len(b))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Error("Segments corrupted")
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+	a := NewAdaptive()
+
+	conn, err := a.Dial(&net.Dialer{}, addr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := make([]byte, 128)
+	conn.Write(hello)
+	io.ReadFull(server, make([]byte, len(hello)))
+	// Reset the connection, as a censor would.
+	server.SetLinger(0)
+	server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		retried, err := ln.AcceptTCP()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer retried.Close()
+		io.ReadFull(retried, make([]byte, len(hello)))
+		retried.Write([]byte{1})
+	}()
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if !a.NeedsSplit(addr.IP.String()) {
+		t.Fatal("Split destination not remembered")
+	}
+	c2, err := a.Dial(&net.Dialer{}, addr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if _, ok := c2.(*splitter); !ok {
+		t.Error("Expected remembered destination to be split right away")
+	}
+	a.Clear()
+	if a.NeedsSplit(addr.IP.String()) {
+		t.Error("Expected destination to be forgotten")
+	}
+}
+
+func TestRecordSizes(t *testing.T) {
+	payload := make([]byte, 100)
+	payload[0] = 0x01 // ClientHello
+	for i := 1; i < len(payload); i++ {
+		payload[i] = byte(i)
+	}
+	hello := append([]byte{0x16, 0x03, 0x01, 0x00, byte(len(payload))}, payload...)
+
+	s, err := NewStrategy("1000", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRecordSizes("a"); err == nil {
+		t.Error("Expected error for bad record size")
+	}
+	if err := s.SetRecordSizes("10,40"); err != nil {
+		t.Fatal(err)
+	}
+	out := joined(s.split(hello))
+	// 100 bytes of payload in records of 10, 40, 40, 10
+	if len(out) != len(hello)+3*tlsHeaderLen {
+		t.Fatalf("Wrong length %d", len(out))
+	}
+	var got []byte
+	var sizes []int
+	for len(out) > 0 {
+		if out[0] != 0x16 || out[1] != 0x03 || out[2] != 0x01 {
+			t.Fatal("Bad record header")
+		}
+		n := int(out[3])<<8 | int(out[4])
+		sizes = append(sizes, n)
+		got = append(got, out[tlsHeaderLen:tlsHeaderLen+n]...)
+		out = out[tlsHeaderLen+n:]
+	}
+	if len(sizes) != 4 || sizes[0] != 10 || sizes[1] != 40 || sizes[2] != 40 || sizes[3] != 10 {
+		t.Errorf("Wrong record sizes %v", sizes)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("Payload corrupted")
+	}
+}
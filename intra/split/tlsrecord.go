@@ -0,0 +1,48 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package split
+
+import (
+	"encoding/binary"
+)
+
+// tlsHeaderLen is the length of a TLS record header: content type (1),
+// legacy version (2), and payload length (2).
+const tlsHeaderLen = 5
+
+// fragmentRecords re-frames the first TLS record in b as consecutive records
+// that carry `sizes` bytes of its payload each; the last size repeats until
+// the payload runs out.  Filters that reassemble TCP segments but parse only
+// the first TLS record then miss the SNI.
+// Bytes in b past the first record are left as-is.
+func fragmentRecords(b []byte, sizes []int) []byte {
+	if len(b) < tlsHeaderLen || len(sizes) == 0 {
+		return b
+	}
+	rlen := int(binary.BigEndian.Uint16(b[3:tlsHeaderLen]))
+	if tlsHeaderLen+rlen > len(b) {
+		// The record spans writes; leave it be.
+		return b
+	}
+	payload := b[tlsHeaderLen : tlsHeaderLen+rlen]
+	rest := b[tlsHeaderLen+rlen:]
+
+	out := make([]byte, 0, len(b)+tlsHeaderLen*len(sizes))
+	for i := 0; len(payload) > 0; i++ {
+		n := sizes[len(sizes)-1]
+		if i < len(sizes) {
+			n = sizes[i]
+		}
+		if n > len(payload) {
+			n = len(payload)
+		}
+		out = append(out, b[0], b[1], b[2], byte(n>>8), byte(n))
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+	}
+	return append(out, rest...)
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package split
+
+import (
+	"errors"
+	"net"
+)
+
+func setTTL(conn *net.TCPConn, ttl int) (int, error) {
+	return 0, errors.New("ttl not supported on this platform")
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux || darwin
+// +build linux darwin
+
+package split
+
+import (
+	"net"
+	"syscall"
+)
+
+// setTTL sets the TTL (hop limit, for IPv6) of packets sent on conn to ttl,
+// and returns the previous value.
+func setTTL(conn *net.TCPConn, ttl int) (prev int, err error) {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TTL
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if prev, serr = syscall.GetsockoptInt(int(fd), level, opt); serr != nil {
+			return
+		}
+		serr = syscall.SetsockoptInt(int(fd), level, opt, ttl)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return prev, serr
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package stub is a plain dns (Do53) server, on a local udp and tcp port,
+// or a DNS-over-TLS server, on a local tcp port, that answers queries with
+// any dns Transport; for desktops and routers, where there's no TUN device
+// to intercept dns on, for Private DNS on Android, and for tests.
+package stub
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/celzero/firestack/intra/diag"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxUDPSize caps responses over udp, whatever size the query's EDNS0
+	// allows; that of DNS Flag Day 2020.
+	maxUDPSize = 1232
+	// tcpIdleTimeout closes tcp conns that go without a query (RFC 7766).
+	tcpIdleTimeout = 10 * time.Second
+	// writeTimeout caps the write of a response.
+	writeTimeout = 5 * time.Second
+	// maxPipelined is the most queries a tcp conn has in-flight at once.
+	maxPipelined = 16
+)
+
+var errStopped = errors.New("stub stopped")
+
+// Server answers dns queries on a udp and a tcp socket, bound to the same
+// address, or on a tls socket alone, with its Transport.
+type Server struct {
+	sync.RWMutex
+	t     dnsx.Transport
+	udp   net.PacketConn // nil for DoT
+	tcp   net.Listener
+	conns map[net.Conn]bool
+	wg    sync.WaitGroup
+	done  bool
+}
+
+// Start returns a Server listening on `addr`, an ip:port, on udp and tcp,
+// for queries to answer with `t`.  Port 0 picks a free port, the same for
+// both; see Addr.
+func Start(addr string, t dnsx.Transport) (*Server, error) {
+	if t == nil {
+		return nil, errors.New("no transport")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// bind udp to the port tcp got, should addr have asked for any
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	s := &Server{t: t, udp: pc, tcp: ln, conns: make(map[net.Conn]bool)}
+	diag.SocketOpened(diag.Listeners)
+	diag.SocketOpened(diag.Listeners)
+	s.wg.Add(2)
+	diag.Go(diag.Listeners, s.serveUDP)
+	diag.Go(diag.Listeners, s.serveTCP)
+	log.Infof("stub: listening on %s", ln.Addr())
+	return s, nil
+}
+
+// StartTLS returns a Server listening on `addr`, an ip:port, for queries
+// over TLS (RFC 7858) to answer with `t`, as the server of `certPEM` and
+// its private key `keyPEM`, both PEM-encoded.  The certificate must be of
+// the name clients connect to, like the hostname set for Private DNS, and
+// chain to a root they trust.
+func StartTLS(addr string, certPEM string, keyPEM string, t dnsx.Transport) (*Server, error) {
+	if t == nil {
+		return nil, errors.New("no transport")
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+	ln, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"dot"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{t: t, tcp: ln, conns: make(map[net.Conn]bool)}
+	diag.SocketOpened(diag.Listeners)
+	s.wg.Add(1)
+	diag.Go(diag.Listeners, s.serveTCP)
+	log.Infof("stub: listening for DoT on %s", ln.Addr())
+	return s, nil
+}
+
+// Addr returns the ip:port s listens on.
+func (s *Server) Addr() string {
+	return s.tcp.Addr().String()
+}
+
+// SetTransport sets `t`, non-nil, to answer queries from now on.
+func (s *Server) SetTransport(t dnsx.Transport) {
+	if t == nil {
+		return
+	}
+	s.Lock()
+	s.t = t
+	s.Unlock()
+}
+
+func (s *Server) transport() dnsx.Transport {
+	s.RLock()
+	defer s.RUnlock()
+	return s.t
+}
+
+// Stop closes the sockets of s, and its tcp conns, and waits for its queries
+// in-flight to complete.
+func (s *Server) Stop() error {
+	s.Lock()
+	if s.done {
+		s.Unlock()
+		return errStopped
+	}
+	s.done = true
+	err := s.tcp.Close()
+	diag.SocketClosed(diag.Listeners)
+	if s.udp != nil {
+		if uerr := s.udp.Close(); err == nil {
+			err = uerr
+		}
+		diag.SocketClosed(diag.Listeners)
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// answer returns the response, from the transport, to q, or else a SERVFAIL,
+// or nil if q isn't a dns query.
+func (s *Server) answer(q []byte) (*dns.Msg, []byte) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil || msg.Response {
+		log.Debugf("stub: bad query: %v", err)
+		return nil, nil
+	}
+	r, err := s.transport().Query(q)
+	if err == nil || len(r) > 0 {
+		return msg, r
+	}
+	log.Debugf("stub: query failed: %v", err)
+	r, err = new(dns.Msg).SetRcode(msg, dns.RcodeServerFailure).Pack()
+	if err != nil {
+		return nil, nil
+	}
+	return msg, r
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	b := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := s.udp.ReadFrom(b)
+		if err != nil {
+			if !s.stopped() {
+				log.Warnf("stub: udp read: %v", err)
+			}
+			return
+		}
+		q := append([]byte(nil), b[:n]...)
+		s.wg.Add(1)
+		diag.Go(diag.Listeners, func() {
+			defer s.wg.Done()
+			s.replyUDP(q, addr)
+		})
+	}
+}
+
+func (s *Server) replyUDP(q []byte, addr net.Addr) {
+	msg, r := s.answer(q)
+	if r == nil {
+		return
+	}
+	if r, _ = truncate(msg, r); r == nil {
+		return
+	}
+	if _, err := s.udp.WriteTo(r, addr); err != nil {
+		log.Debugf("stub: udp write to %v: %v", addr, err)
+	}
+}
+
+// truncate fits r, the response to q, to the size q allows over udp,
+// 512 bytes but for EDNS0, dropping records and setting TC as need be, so
+// that the client retries over tcp.
+func truncate(q *dns.Msg, r []byte) ([]byte, error) {
+	size := dns.MinMsgSize
+	if opt := q.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > maxUDPSize {
+		size = maxUDPSize
+	}
+	if len(r) <= size {
+		return r, nil
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(r); err != nil {
+		return nil, err
+	}
+	m.Truncate(size)
+	return m.Pack()
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			if !s.stopped() {
+				log.Warnf("stub: tcp accept: %v", err)
+			}
+			return
+		}
+		if !s.track(c) {
+			c.Close()
+			return
+		}
+		s.wg.Add(1)
+		diag.Go(diag.Listeners, func() {
+			defer s.wg.Done()
+			s.serveConn(c)
+		})
+	}
+}
+
+func (s *Server) stopped() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.done
+}
+
+// track adds c to the conns of s, closed on Stop, unless s is stopped.
+func (s *Server) track(c net.Conn) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.done {
+		return false
+	}
+	s.conns[c] = true
+	diag.SocketOpened(diag.Listeners)
+	return true
+}
+
+func (s *Server) untrack(c net.Conn) {
+	s.Lock()
+	delete(s.conns, c)
+	s.Unlock()
+	diag.SocketClosed(diag.Listeners)
+}
+
+// serveConn answers the queries on c, each prefixed with its length, as
+// they come; responses go out as they complete, most maxPipelined at once,
+// and not necessarily in order (RFC 7766).
+func (s *Server) serveConn(c net.Conn) {
+	var mu sync.Mutex // held while writing to c
+	var pending sync.WaitGroup
+	inflight := make(chan struct{}, maxPipelined)
+	defer func() {
+		pending.Wait()
+		c.Close()
+		s.untrack(c)
+	}()
+	lbuf := make([]byte, 2)
+	for {
+		c.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := io.ReadFull(c, lbuf); err != nil {
+			if err != io.EOF {
+				log.Debugf("stub: tcp read: %v", err)
+			}
+			return
+		}
+		q := make([]byte, binary.BigEndian.Uint16(lbuf))
+		if _, err := io.ReadFull(c, q); err != nil {
+			log.Debugf("stub: tcp query: %v", err)
+			return
+		}
+		inflight <- struct{}{}
+		pending.Add(1)
+		diag.Go(diag.Listeners, func() {
+			defer func() {
+				<-inflight
+				pending.Done()
+			}()
+			_, r := s.answer(q)
+			if r == nil || len(r) > dns.MaxMsgSize {
+				return
+			}
+			b := make([]byte, len(r)+2)
+			binary.BigEndian.PutUint16(b, uint16(len(r)))
+			copy(b[2:], r)
+			mu.Lock()
+			defer mu.Unlock()
+			c.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := c.Write(b); err != nil {
+				log.Debugf("stub: tcp write: %v", err)
+				c.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package stub
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/celzero/firestack/intra/diag"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/miekg/dns"
+)
+
+// fakeTransport answers with `answers` A records, or fails.
+type fakeTransport struct {
+	answers int
+	fail    bool
+}
+
+func (f *fakeTransport) Query(q []byte) ([]byte, error) {
+	if f.fail {
+		return nil, errors.New("no route")
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(q); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg).SetReply(msg)
+	for i := 0; i < f.answers; i++ {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	return r.Pack()
+}
+
+func (f *fakeTransport) GetURL() string {
+	return "fake"
+}
+
+func (f *fakeTransport) SetBraveDNS(dnsx.BraveDNS) {}
+
+func exchange(t *testing.T, net string, addr string) *dns.Msg {
+	q := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	c := &dns.Client{Net: net}
+	r, _, err := c.Exchange(q, addr)
+	if err != nil {
+		t.Fatalf("%s: %v", net, err)
+	}
+	return r
+}
+
+func TestServer(t *testing.T) {
+	s, err := Start("127.0.0.1:0", &fakeTransport{answers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	for _, proto := range []string{"udp", "tcp"} {
+		r := exchange(t, proto, s.Addr())
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.Truncated {
+			t.Errorf("%s: %v", proto, r)
+		}
+	}
+
+	// a response too big for udp is truncated there, and not over tcp
+	s.SetTransport(&fakeTransport{answers: 100})
+	if r := exchange(t, "udp", s.Addr()); !r.Truncated || len(r.Answer) >= 100 {
+		t.Errorf("udp: truncated %t with %d answers", r.Truncated, len(r.Answer))
+	}
+	if r := exchange(t, "tcp", s.Addr()); r.Truncated || len(r.Answer) != 100 {
+		t.Errorf("tcp: truncated %t with %d answers", r.Truncated, len(r.Answer))
+	}
+
+	s.SetTransport(&fakeTransport{fail: true})
+	if r := exchange(t, "udp", s.Addr()); r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("failed query answered with %s", dns.RcodeToString[r.Rcode])
+	}
+}
+
+// Queries on a tcp conn are answered in turn, and the conn is left open.
+func TestServerPipelined(t *testing.T) {
+	s, err := Start("127.0.0.1:0", &fakeTransport{answers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c, err := dns.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 4; i++ {
+		q := new(dns.Msg).SetQuestion(fmt.Sprintf("%d.example.com.", i), dns.TypeA)
+		if err := c.WriteMsg(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		r, err := c.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[r.Question[0].Name] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("answered %v", seen)
+	}
+}
+
+func TestServerStop(t *testing.T) {
+	s, err := Start("127.0.0.1:0", &fakeTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(); err == nil {
+		t.Error("stopped twice")
+	}
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("tcp conn left open")
+	}
+	if n := diag.Get(diag.Listeners).Sockets; n != 0 {
+		t.Errorf("%d sockets held after stop", n)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package stub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// selfSigned returns a PEM certificate, and its key, for 127.0.0.1.
+func selfSigned(t *testing.T) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "stub"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	return string(certPEM), string(keyPEM), cert
+}
+
+func TestServerTLS(t *testing.T) {
+	certPEM, keyPEM, cert := selfSigned(t)
+	s, err := StartTLS("127.0.0.1:0", certPEM, keyPEM, &fakeTransport{answers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: roots}}
+	q := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	r, _, err := c.Exchange(q, s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Errorf("over tls: %v", r)
+	}
+
+	// plain tcp isn't answered
+	if _, _, err := (&dns.Client{Net: "tcp", Timeout: time.Second}).Exchange(q, s.Addr()); err == nil {
+		t.Error("answered over plain tcp")
+	}
+}
+
+func TestServerTLSBadCert(t *testing.T) {
+	certPEM, _, _ := selfSigned(t)
+	_, keyPEM, _ := selfSigned(t)
+	if _, err := StartTLS("127.0.0.1:0", certPEM, keyPEM, &fakeTransport{}); err == nil {
+		t.Error("started with a key not of its cert")
+	}
+}
@@ -26,9 +26,12 @@
 package intra
 
 import (
-	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -36,11 +39,25 @@ import (
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 
+	"github.com/celzero/firestack/intra/codes"
+	"github.com/celzero/firestack/intra/diag"
 	"github.com/celzero/firestack/intra/dnscrypt"
+	"github.com/celzero/firestack/intra/dnsx"
+	"github.com/celzero/firestack/intra/faults"
+	"github.com/celzero/firestack/intra/firewall"
+	"github.com/celzero/firestack/intra/metrics"
+	"github.com/celzero/firestack/intra/outbound"
 	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/quota"
+	"github.com/celzero/firestack/intra/schema"
 	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/sniff"
 	"github.com/celzero/firestack/intra/doh"
 	"github.com/celzero/firestack/intra/split"
+	"github.com/celzero/firestack/intra/throttle"
+	"github.com/celzero/firestack/intra/trace"
+	"github.com/celzero/firestack/intra/usage"
+	"github.com/celzero/firestack/intra/xbuf"
 )
 
 // TCPHandler is a core TCP handler that also supports DOH and splitting control.
@@ -48,18 +65,42 @@ type TCPHandler interface {
 	core.TCPConnHandler
 	SetDNS(doh.Transport)
 	SetAlwaysSplitHTTPS(bool)
-	blockConn(localConn net.Conn, target *net.TCPAddr) bool
-	dnsOverride(net.Conn, *net.TCPAddr) bool
+	SetSplitStrategy(*split.Strategy)
+	ClearSplitCache()
+	setPause(*pause)
+	setKillSwitch(*killSwitch)
+	setMeter(*usage.Meter)
+	setFlows(*flows)
+	setLifecycle(*lifecycle)
+	setWireGuard(*wireguard)
+	setRelayBuffer(size int)
+	setCredentials(*outbound.Refresher)
+	blockConn(localConn net.Conn, target *net.TCPAddr, uid int) bool
+	dnsOverride(net.Conn, *net.TCPAddr, int) bool
 	SetDNSCryptProxy(*dnscrypt.Proxy)
 	SetProxyOptions(*settings.ProxyOptions) error
 	SetDNSOptions(*settings.DNSOptions) error
+	SetQuotas(*quota.Quotas)
+	SetTarpit(*quota.Tarpit)
+	SetAppDNS(uid int, dns doh.Transport)
+	AppDNS() []doh.Transport
+	SetFirewall(*firewall.Firewall)
+	SetFakeIPs(*dnsx.FakeIPs)
+	SetConnectionOwner(protect.ConnectionOwner)
+	SetOutbounds(*outbound.Outbounds)
+	SetTimeouts(keepalive time.Duration, idle time.Duration)
+	Dial(network, addr string) (net.Conn, error)
 }
 
 type tcpHandler struct {
 	TCPHandler
+	sync.RWMutex
 	fakedns          net.TCPAddr
 	dns              doh.Atomic
+	apps             doh.Apps
 	alwaysSplitHTTPS bool
+	splitStrategy    *split.Strategy
+	adaptive         *split.Adaptive
 	dialer           *net.Dialer
 	blocker          protect.Blocker
 	tunMode          *settings.TunMode
@@ -67,10 +108,27 @@ type tcpHandler struct {
 	dnscrypt         *dnscrypt.Proxy
 	dnsproxy         *net.TCPAddr
 	proxy            proxy.Dialer
+	quotas           *quota.Quotas
+	tarpit           *quota.Tarpit
+	fw               *firewall.Firewall
+	fakes            *dnsx.FakeIPs
+	owner            protect.ConnectionOwner
+	wireguard        *wireguard
+	obs              *outbound.Outbounds
+	pause            *pause
+	killSwitch       *killSwitch
+	meter            *usage.Meter
+	flows            *flows
+	lifecycle        *lifecycle
+	keepalive        time.Duration // of upstream sockets; 0 for the default, < 0 for none
+	idle             time.Duration // after which flows are closed; 0 for never
+	relayBuffer      int           // size of the buffers flows are relayed through
+	creds            *outbound.Refresher
 }
 
 // TCPSocketSummary provides information about each TCP socket, reported when it is closed.
 type TCPSocketSummary struct {
+	Version       int   // Schema version, schema.TCPSummary
 	DownloadBytes int64 // Total bytes downloaded.
 	UploadBytes   int64 // Total bytes uploaded.
 	Duration      int32 // Duration in seconds.
@@ -78,9 +136,51 @@ type TCPSocketSummary struct {
 	Synack        int32 // TCP handshake latency (ms)
 	// Retry is non-nil if retry was possible.  Retry.Split is non-zero if a retry occurred.
 	Retry *split.RetryStats
+	// Since schema.TCPSummary 2
+	Source  string // The app's address, ip:port.
+	Target  string // The address the app connected to, ip:port.
+	UID     int    // The app that owned the socket, or -1 if unknown.
+	Route   string // How the socket was routed, one of the Route* constants.
+	Blocked bool   // Whether the socket was firewalled.
+	// Since schema.TCPSummary 3
+	// Domain is the name the socket told, by its SNI or Host, or that of the
+	// fake ip it connected to, or else the csv of names its target was
+	// answered for, by any resolver, if known.
+	Domain string
 }
 
-// TCPListener is notified when a socket closes.
+// Routes of sockets, as reported by TCPSocketSummary and UDPSocketSummary.
+const (
+	// RouteDirect is a socket connected directly to its target.
+	RouteDirect = "direct"
+	// RouteSplit is a socket connected directly, with its ClientHello split.
+	RouteSplit = "split"
+	// RouteProxy is a socket connected through the socks5 or http proxy, or,
+	// as "proxy:<name>", through outbound <name>, as routed by the firewall.
+	RouteProxy = "proxy"
+	// RouteDNSProxy is a dns socket redirected to the dns proxy.
+	RouteDNSProxy = "dnsproxy"
+	// RouteDNS is a dns socket answered by the in-tunnel resolver.
+	RouteDNS = "dns"
+	// RouteFirewalled is a socket the firewall blocked.
+	RouteFirewalled = "firewalled"
+	// RoutePaused is a socket held back while the tunnel was paused.
+	RoutePaused = "paused"
+	// RouteKilled is a socket the kill switch dropped, as the resolver or the
+	// proxy was unreachable.
+	RouteKilled = "killed"
+	// RouteTrapped is a DNS-over-TLS socket refused so that the app falls
+	// back to DNS on port 53, which is trapped; see settings.TunMode.TrapDoT.
+	RouteTrapped = "trapped"
+)
+
+// Field returns the named field of s as a string, or "" if s has no such
+// field; see schema.Field.
+func (s *TCPSocketSummary) Field(name string) string {
+	return schema.Field(s, name)
+}
+
+// TCPListener is notified when a socket closes, or is firewalled.
 type TCPListener interface {
 	OnTCPSocketClosed(*TCPSocketSummary)
 }
@@ -92,38 +192,143 @@ type TCPListener interface {
 func NewTCPHandler(fakedns net.TCPAddr, dialer *net.Dialer, blocker protect.Blocker,
 	tunMode *settings.TunMode, listener TCPListener) TCPHandler {
 	return &tcpHandler{
-		fakedns:  fakedns,
-		dialer:   dialer,
-		blocker:  blocker,
-		tunMode:  tunMode,
-		listener: listener,
+		fakedns:     fakedns,
+		dialer:      dialer,
+		blocker:     blocker,
+		tunMode:     tunMode,
+		listener:    listener,
+		adaptive:    split.NewAdaptive(),
+		relayBuffer: xbuf.Medium,
 	}
 }
 
+// metered counts bytes read from r, as they're read, with count.
+type metered struct {
+	r     io.Reader
+	count func(n int64)
+}
+
+func (m *metered) Read(b []byte) (int, error) {
+	n, err := m.r.Read(b)
+	if n > 0 {
+		m.count(int64(n))
+	}
+	return n, err
+}
+
+// sniffWait is how long flows are waited on for their first bytes, to sniff
+// their names from, before they're routed without.
+const sniffWait = 2 * time.Second
+
+// sniffed is a local conn whose first bytes, read to sniff its name from, are
+// read again, from r.
+type sniffed struct {
+	core.TCPConn
+	r io.Reader
+}
+
+func (c *sniffed) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// writer hides the ReadFrom of the conns relayed to, which, with readers
+// that aren't sockets, allocate a buffer per flow.
+type writer struct {
+	io.Writer
+}
+
+// relay copies src to dst, as io.Copy, through a pooled buffer of `size`.
+func relay(dst io.Writer, src io.Reader, size int) (int64, error) {
+	b := xbuf.Get(size)
+	diag.BufferTaken(diag.Tunnel)
+	defer func() {
+		xbuf.Put(b)
+		diag.BufferReturned(diag.Tunnel)
+	}()
+	return io.CopyBuffer(writer{dst}, src, *b)
+}
+
 // TODO: Propagate TCP RST using local.Abort(), on appropriate errors.
-func (h *tcpHandler) handleUpload(local core.TCPConn, remote split.DuplexConn, upload chan int64) {
-	bytes, _ := remote.ReadFrom(local)
+func (h *tcpHandler) handleUpload(local core.TCPConn, remote split.DuplexConn, upload chan int64, count func(int64)) {
+	bytes, _ := relay(remote, &metered{local, count}, h.relayBuffer)
 	local.CloseRead()
 	remote.CloseWrite()
 	upload <- bytes
 }
 
-func (h *tcpHandler) handleDownload(local core.TCPConn, remote split.DuplexConn) (bytes int64, err error) {
-	bytes, err = io.Copy(local, remote)
+func (h *tcpHandler) handleDownload(local core.TCPConn, remote split.DuplexConn, count func(int64)) (bytes int64, err error) {
+	bytes, err = relay(local, &metered{remote, count}, h.relayBuffer)
 	local.CloseWrite()
 	remote.CloseRead()
 	return
 }
 
-func (h *tcpHandler) forward(local net.Conn, remote split.DuplexConn, summary *TCPSocketSummary) {
+// reapIdle closes local and remote once no byte is relayed between them for
+// `idle`, if positive.  Returns touch, to call as bytes are relayed, and
+// stop, to call once they are closed.
+func reapIdle(idle time.Duration, local io.Closer, remote io.Closer) (touch func(), stop func()) {
+	if idle <= 0 {
+		return func() {}, func() {}
+	}
+	var last int64 = time.Now().UnixNano()
+	var done int32
+	var t *time.Timer
+	t = time.AfterFunc(idle, func() {
+		if atomic.LoadInt32(&done) != 0 {
+			return
+		}
+		quiet := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&last))
+		if quiet < idle {
+			t.Reset(idle - quiet)
+			return
+		}
+		log.Infof("closing tcp flow idle for %v", quiet)
+		local.Close()
+		remote.Close()
+	})
+	touch = func() {
+		atomic.StoreInt64(&last, time.Now().UnixNano())
+	}
+	stop = func() {
+		atomic.StoreInt32(&done, 1)
+		t.Stop()
+	}
+	return
+}
+
+// forward relays bytes between local and remote, as fast as buckets up
+// and down, if any, let it.
+func (h *tcpHandler) forward(local net.Conn, remote split.DuplexConn, summary *TCPSocketSummary, up *throttle.Bucket, down *throttle.Bucket) {
 	localtcp := local.(core.TCPConn)
 	upload := make(chan int64)
 	start := time.Now()
-	go h.handleUpload(localtcp, remote, upload)
-	download, _ := h.handleDownload(localtcp, remote)
+	uid, dst := summary.UID, summary.Target
+	touch, stop := reapIdle(h.idle, local, remote)
+	defer stop()
+	f := h.flows.add("tcp", summary.Source, dst, uid, summary.Route, func() {
+		local.Close()
+		remote.Close()
+	})
+	defer h.flows.remove(f)
+	diag.Go(diag.Tunnel, func() {
+		h.handleUpload(localtcp, remote, upload, func(n int64) {
+			touch()
+			f.count(n, 0)
+			h.meter.Add(uid, "tcp", dst, n, 0)
+			up.Wait(int(n))
+		})
+	})
+	download, _ := h.handleDownload(localtcp, remote, func(n int64) {
+		touch()
+		f.count(0, n)
+		h.meter.Add(uid, "tcp", dst, 0, n)
+		down.Wait(int(n))
+	})
 	summary.DownloadBytes = download
 	summary.UploadBytes = <-upload
 	summary.Duration = int32(time.Since(start).Seconds())
+	metrics.Add(metrics.TunnelBytes, summary.UploadBytes, "proto", "tcp", "dir", "up")
+	metrics.Add(metrics.TunnelBytes, summary.DownloadBytes, "proto", "tcp", "dir", "down")
 	h.listener.OnTCPSocketClosed(summary)
 }
 
@@ -151,8 +356,7 @@ func (h *tcpHandler) isDNSProxy(addr *net.TCPAddr) bool {
 	if h.tunMode.DNSMode == settings.DNSModeProxyIP {
 		return addr.IP.Equal(h.fakedns.IP) && addr.Port == h.fakedns.Port
 	} else if h.tunMode.DNSMode == settings.DNSModeProxyPort {
-		// h.fakedns.Port always expected to be 53?
-		return addr.Port == h.fakedns.Port
+		return addr.Port == settings.DNSPort
 	}
 	return false
 }
@@ -161,8 +365,7 @@ func (h *tcpHandler) isDoh(addr *net.TCPAddr) bool {
 	if h.tunMode.DNSMode == settings.DNSModeIP {
 		return addr.IP.Equal(h.fakedns.IP) && addr.Port == h.fakedns.Port
 	} else if h.tunMode.DNSMode == settings.DNSModePort {
-		// h.fakedns.Port always expected to be 53?
-		return addr.Port == h.fakedns.Port
+		return addr.Port == settings.DNSPort
 	}
 	return false
 }
@@ -171,43 +374,88 @@ func (h *tcpHandler) isDNSCrypt(addr *net.TCPAddr) bool {
 	if h.tunMode.DNSMode == settings.DNSModeCryptIP {
 		return addr.IP.Equal(h.fakedns.IP) && addr.Port == h.fakedns.Port
 	} else if h.tunMode.DNSMode == settings.DNSModeCryptPort {
-		// h.fakedns.Port always expected to be 53?
-		return addr.Port == h.fakedns.Port
+		return addr.Port == settings.DNSPort
 	}
 	return false
 }
 
-func (h *tcpHandler) dnsOverride(conn net.Conn, addr *net.TCPAddr) bool {
+// dnsOverride handles conn if it is a dns connection to addr from app uid.
+func (h *tcpHandler) dnsOverride(conn net.Conn, addr *net.TCPAddr, uid int) bool {
 
 	if h.isDoh(addr) {
-		dns := h.dns.Load()
-		go doh.Accept(dns, conn)
+		dns := h.apps.Get(uid)
+		if dns == nil {
+			dns = h.dns.Load()
+		}
+		dns = h.fakeIPs().Faking(h.firewall().Observing(dns))
+		if on, _ := h.pause.paused(); on {
+			dns = dnsx.CacheOnly(dns)
+		}
+		dns = &charged{Transport: dns, uid: uid, quotas: h.quota(), tarpit: h.dnsTarpit()}
+		diag.Go(diag.DoH, func() {
+			doh.Accept(dns, conn)
+		})
 		return true
 	} else if h.isDNSCrypt(addr) {
-		go dnscrypt.HandleTCP(h.dnscrypt, conn)
+		dcrypt := h.dnscrypt
+		diag.Go(diag.DNSCrypt, func() {
+			dnscrypt.HandleTCP(dcrypt, conn)
+		})
 		return true
 	}
 	// assert h.tunMode.DNSMode == settings.DNSModeNone
 	return false
 }
 
-func (h *tcpHandler) blockConn(localConn net.Conn, target *net.TCPAddr) (block bool) {
+// charged charges each query to its transport to the quota of app uid, and
+// answers those over quota with a servfail, as dns over udp is.
+type charged struct {
+	doh.Transport
+	uid    int
+	quotas *quota.Quotas
+	tarpit *quota.Tarpit
+}
+
+// Inner implements dnsx.Wrapper.
+func (c *charged) Inner() dnsx.Transport {
+	return c.Transport
+}
+
+// Query implements dnsx.Transport.
+func (c *charged) Query(q []byte) ([]byte, error) {
+	if !c.quotas.Query(c.uid) {
+		log.Warnf("dns query over quota for uid %d", c.uid)
+		return doh.Servfail(q)
+	}
+	c.tarpit.Wait(c.uid)
+	return c.Transport.Query(q)
+}
+
+func (h *tcpHandler) blockConn(localConn net.Conn, target *net.TCPAddr, owner int) (block bool) {
 	// BlockModeNone returns false, BlockModeSink returns true
 	if h.tunMode.BlockMode == settings.BlockModeSink {
 		return true
-	} else if h.tunMode.BlockMode == settings.BlockModeNone {
-		return false
 	}
-	// Implict: BlockModeFilter or BlockModeFilterProc
 	localtcp := localConn.(core.TCPConn)
 	localaddr := localtcp.LocalAddr().(*net.TCPAddr)
 
+	// firewall rules apply in all other block modes
+	switch h.firewall().Verdict(firewall.TCP, owner, target.IP, target.Port) {
+	case firewall.Deny:
+		log.Infof("firewall rule denied connection from %s to %s", localaddr.String(), target.String())
+		return true
+	case firewall.Allow:
+		return false
+	}
+
+	if h.tunMode.BlockMode == settings.BlockModeNone {
+		return false
+	}
+	// Implict: BlockModeFilter or BlockModeFilterProc
+
 	uid := -1
 	if h.tunMode.BlockMode == settings.BlockModeFilterProc {
-		procEntry := settings.FindProcNetEntry("tcp", localaddr.IP, localaddr.Port, target.IP, target.Port)
-		if procEntry != nil {
-			uid = procEntry.UserID
-		}
+		uid = owner
 	}
 
 	block = h.blocker.Block(6 /*TCP*/, uid, localaddr.String(), target.String())
@@ -220,6 +468,11 @@ func (h *tcpHandler) blockConn(localConn net.Conn, target *net.TCPAddr) (block b
 	return
 }
 
+// uid returns the app that owns the local to target connection, or -1.
+func (h *tcpHandler) uid(localaddr *net.TCPAddr, target *net.TCPAddr) int {
+	return ownerUID(h.connectionOwner(), firewall.TCP, localaddr.IP, localaddr.Port, target.IP, target.Port)
+}
+
 // TODO: move these to settings pkg
 func (h *tcpHandler) socks5Proxy() bool {
 	return h.tunMode.ProxyMode == settings.ProxyModeSOCKS5
@@ -235,61 +488,241 @@ func (h *tcpHandler) hasProxy() bool {
 
 // TODO: Request upstream to make `conn` a `core.TCPConn` so we can avoid a type assertion.
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	if h.blockConn(conn, target) {
+	localaddr := conn.LocalAddr().(*net.TCPAddr)
+	summary := TCPSocketSummary{
+		Version: schema.TCPSummary,
+		Source:  localaddr.String(),
+		Target:  target.String(),
+		UID:     -1,
+	}
+	summary.ServerPort = filteredPort(target)
+	// the owner is needed to apply firewall rules, quotas and per-app dns,
+	// and to summarize
+	uid := h.uid(localaddr, target)
+	summary.UID = uid
+
+	if on, cacheOnly := h.pause.paused(); on && !(cacheOnly && h.isDoh(target)) {
+		summary.Route = RoutePaused
+		summary.Blocked = true
+		h.listener.OnTCPSocketClosed(&summary)
+		return codes.New(codes.Paused, "tcp connection paused")
+	}
+
+	// flows to fake ips are for the names they were handed out for
+	fakename := ""
+	if fakes := h.fakeIPs(); fakes.Contains(target.IP) {
+		real := fakes.Real(target.IP)
+		if real == nil {
+			// handed out before a restart, or since afresh; the app must ask again
+			return codes.Errorf(codes.UnknownFakeIP, "tcp connection to unknown fake ip %s", target.IP)
+		}
+		fakename = fakes.Name(target.IP)
+		h.firewall().Note(real, fakename)
+		target = &net.TCPAddr{IP: real, Port: target.Port}
+	}
+	summary.Domain = fakename
+	if len(fakename) == 0 {
+		summary.Domain = h.firewall().Names(target.IP.String())
+	}
+
+	if h.blockConn(conn, target, uid) {
+		summary.Route = RouteFirewalled
+		summary.Blocked = true
+		h.listener.OnTCPSocketClosed(&summary)
 		// an error here results in a core.tcpConn.Abort
-		return fmt.Errorf("tcp connection firewalled")
+		return codes.New(codes.Firewalled, "tcp connection firewalled")
+	}
+
+	if h.tunMode.RefusesDoT(target.Port) {
+		summary.Route = RouteTrapped
+		summary.Blocked = true
+		h.listener.OnTCPSocketClosed(&summary)
+		return codes.New(codes.Trapped, "tcp dns-over-tls connection refused")
+	}
+
+	quotas := h.quota()
+	tarpit := h.dnsTarpit()
+
+	if h.isDNSCrypt(target) {
+		// dnscrypt answers one query per connection; doh queries are
+		// charged one by one as they are read, in dnsOverride
+		if !quotas.Query(uid) {
+			return codes.New(codes.OverQuota, "tcp dns over quota")
+		}
+		tarpit.Wait(uid)
 	}
 
-	if h.dnsOverride(conn, target) {
+	if h.dnsOverride(conn, target, uid) {
 		return nil
 	}
 
-	var summary TCPSocketSummary
-	summary.ServerPort = filteredPort(target)
+	trace.Flow(target.IP.String(), "tcp "+target.String())
+
+	if !quotas.Open(uid) {
+		return codes.New(codes.OverQuota, "tcp connection over quota")
+	}
+
+	// apps send their first bytes only once Handle returns, so flows whose
+	// names are sniffed for routes on domains connect after
+	if len(fakename) == 0 && h.sniffs(target) {
+		diag.Go(diag.Tunnel, func() {
+			name, replay := sniff.Sniff(conn, sniffWait)
+			local := &sniffed{conn.(core.TCPConn), replay}
+			if err := h.connect(local, target, "", name, uid, &summary); err != nil {
+				log.Warnf("tcp connection to %s (%s) failed: %v", target, name, err)
+				local.Abort()
+			}
+		})
+		return nil
+	}
+	return h.connect(conn, target, fakename, fakename, uid, &summary)
+}
+
+// sniffs reports whether flows to target are sniffed for their names.
+func (h *tcpHandler) sniffs(target *net.TCPAddr) bool {
+	port := filteredPort(target)
+	return (port == 80 || port == 443) && h.firewall().RoutesDomains()
+}
+
+// connect connects the flow on conn, from app uid, to target, known to be
+// `name`, if not "", through its route, and relays bytes between them.
+// fakename, if not "", is the name of the fake ip the app connected to.
+func (h *tcpHandler) connect(conn net.Conn, target *net.TCPAddr, fakename string, name string, uid int, summary *TCPSocketSummary) error {
+	quotas := h.quota()
+	if len(name) > 0 {
+		summary.Domain = name
+	}
+	route := h.firewall().OutboundOf(firewall.TCP, uid, target.IP, target.Port, name)
+	var via outbound.Outbound
+	if via = h.wireguard.via(route, target.IP, target.Port); via != nil {
+		route = outbound.WireGuard
+	} else if len(route) > 0 && route != outbound.Direct {
+		// flows routed to missing outbounds fail, rather than leak
+		if via = h.outbounds().Get(route); via == nil {
+			quotas.Close(uid, 0)
+			return codes.Errorf(codes.NoOutbound, "tcp connection routed to missing outbound %s", route)
+		}
+	}
+
+	proxied := via == nil && h.proxy != nil && (h.socks5Proxy() || h.httpsProxy()) && route != outbound.Direct
+	if !h.isDNSProxy(target) && !h.killSwitch.allow(proxied) {
+		quotas.Close(uid, 0)
+		summary.Route = RouteKilled
+		summary.Blocked = true
+		h.listener.OnTCPSocketClosed(summary)
+		return codes.New(codes.Killed, "tcp connection dropped by the kill switch")
+	}
+
+	up, down := h.firewall().LimitOf(firewall.TCP, uid, target.IP, target.Port, name)
+
 	start := time.Now()
 	var c split.DuplexConn
 	var err error
+	// subsystem the upstream socket is accounted against
+	sub := diag.Tunnel
+	dialer := h.flowDialer()
+	// proxies resolve names of fake ips themselves
+	dest := target.String()
+	if len(fakename) > 0 {
+		dest = net.JoinHostPort(fakename, strconv.Itoa(target.Port))
+	}
 
 	// TODO: Cancel dialing if c is closed
 	// Ref: https://stackoverflow.com/questions/63656117/
 	// Ref: https://stackoverflow.com/questions/40328025
-	if p := h.proxy; (h.socks5Proxy() || h.httpsProxy()) && p != nil {
+	if via != nil {
+		sub = diag.Proxy
+		summary.Route = RouteProxy + ":" + route
+		if iso, ok := via.(outbound.Isolated); ok {
+			c, err = iso.DialTCPFor(dest, name, uid)
+		} else {
+			c, err = via.DialTCP(dest)
+		}
+		h.lifecycle.proxied(route, err)
+	} else if p := h.proxy; (h.socks5Proxy() || h.httpsProxy()) && p != nil && route != outbound.Direct {
 		var generic net.Conn
+		sub = diag.Proxy
+		summary.Route = RouteProxy
+		if err = faults.ProxyFailure(); err != nil {
+			quotas.Close(uid, 0)
+			return err
+		}
 		// deprecated: https://github.com/golang/go/issues/25104
-		generic, err = p.Dial(target.Network(), target.String())
+		generic, err = p.Dial(target.Network(), dest)
+		h.killSwitch.proxied(err)
+		h.lifecycle.proxied(upstreamProxy, err)
 		if generic != nil {
-			c = generic.(*net.TCPConn)
+			tc := generic.(*net.TCPConn)
+			h.setKeepAlive(tc)
+			c = tc
 		}
 	} else if summary.ServerPort == 443 {
-		if h.alwaysSplitHTTPS {
-			c, err = split.DialWithSplit(h.dialer, target)
-		} else {
+		summary.Route = RouteSplit
+		c, err = dialHinted(target, summary.Domain, func(addr *net.TCPAddr) (split.DuplexConn, error) {
+			if h.alwaysSplitHTTPS {
+				return split.DialWithSplitStrategy(dialer, addr, h.splitStrategy)
+			}
 			summary.Retry = &split.RetryStats{}
-			c, err = split.DialWithSplitRetry(h.dialer, target, summary.Retry)
-		}
+			return h.adaptive.Dial(dialer, addr, summary.Retry, h.splitStrategy)
+		})
 	} else if summary.ServerPort == 53 && h.isDNSProxy(target) {
 		var generic net.Conn
+		summary.Route = RouteDNSProxy
 		target = h.dnsproxy
-		generic, err = h.dialer.Dial(target.Network(), target.String())
+		generic, err = dialer.Dial(target.Network(), target.String())
 		if generic != nil {
 			c = generic.(*net.TCPConn)
 		}
 	} else {
-		var generic net.Conn
-		generic, err = h.dialer.Dial(target.Network(), target.String())
-		if generic != nil {
-			c = generic.(*net.TCPConn)
-		}
+		summary.Route = RouteDirect
+		c, err = dialHinted(target, summary.Domain, func(addr *net.TCPAddr) (split.DuplexConn, error) {
+			generic, err := dialer.Dial(addr.Network(), addr.String())
+			if err != nil {
+				return nil, err
+			}
+			return generic.(*net.TCPConn), nil
+		})
 	}
 	if err != nil {
+		quotas.Close(uid, 0)
+		if sub == diag.Proxy {
+			return codes.Wrap(codes.ProxyFailed, err)
+		}
 		return err
 	}
 	summary.Synack = int32(time.Since(start).Seconds() * 1000)
-	go h.forward(conn, c, &summary)
+	diag.SocketOpened(sub)
+	diag.Go(diag.Tunnel, func() {
+		h.forward(conn, c, summary, up, down)
+		diag.SocketClosed(sub)
+		quotas.Close(uid, summary.DownloadBytes+summary.UploadBytes)
+	})
 	log.Infof("new proxy connection for target: %s:%s", target.Network(), target.String())
 	return nil
 }
 
+// dialHinted dials target with dial, and should that fail, the ips that
+// HTTPS answers hinted at for any of names, a csv, in turn, on target's port.
+func dialHinted(target *net.TCPAddr, names string, dial func(*net.TCPAddr) (split.DuplexConn, error)) (split.DuplexConn, error) {
+	c, err := dial(target)
+	if err == nil || len(names) == 0 {
+		return c, err
+	}
+	for _, name := range strings.Split(names, ",") {
+		for _, v := range strings.Split(dnsx.HintedIPs(name), ",") {
+			ip := net.ParseIP(v)
+			if ip == nil || ip.Equal(target.IP) {
+				continue
+			}
+			if hc, herr := dial(&net.TCPAddr{IP: ip, Port: target.Port}); herr == nil {
+				log.Infof("tcp connection to %s (%s) failed, dialed hinted ip %s", target, name, ip)
+				return hc, nil
+			}
+		}
+	}
+	return nil, err
+}
+
 func (h *tcpHandler) SetDNS(dns doh.Transport) {
 	h.dns.Store(dns)
 }
@@ -298,6 +731,173 @@ func (h *tcpHandler) SetAlwaysSplitHTTPS(s bool) {
 	h.alwaysSplitHTTPS = s
 }
 
+func (h *tcpHandler) SetSplitStrategy(s *split.Strategy) {
+	h.splitStrategy = s
+}
+
+// Dial connects to addr through the proxy in-use, if any, like connections
+// from the tunnel do.
+func (h *tcpHandler) Dial(network, addr string) (net.Conn, error) {
+	if p := h.proxy; (h.socks5Proxy() || h.httpsProxy()) && p != nil {
+		return p.Dial(network, addr)
+	}
+	return h.dialer.Dial(network, addr)
+}
+
+// SetTimeouts sets the interval of keepalive probes on upstream sockets of
+// new flows, 0 for the default of 15s, or < 0 for none; and how long flows
+// may go without a byte sent or received before they're closed, or 0 for no limit.
+func (h *tcpHandler) SetTimeouts(keepalive time.Duration, idle time.Duration) {
+	h.keepalive = keepalive
+	h.idle = idle
+}
+
+// flowDialer returns a dialer for upstream sockets of flows.
+func (h *tcpHandler) flowDialer() *net.Dialer {
+	if h.keepalive == 0 {
+		return h.dialer
+	}
+	d := *h.dialer
+	d.KeepAlive = h.keepalive
+	return &d
+}
+
+// proxyDialer returns the dialer of the proxy of SetProxyOptions, so that its
+// sockets are protected, as flows' are, or nil to dial it directly.
+func (h *tcpHandler) proxyDialer() proxy.Dialer {
+	if h.dialer == nil {
+		return nil
+	}
+	return h.dialer
+}
+
+// setKeepAlive sets keepalives on c, an upstream socket dialed by others.
+func (h *tcpHandler) setKeepAlive(c *net.TCPConn) {
+	if h.keepalive < 0 {
+		c.SetKeepAlive(false)
+	} else if h.keepalive > 0 {
+		c.SetKeepAlive(true)
+		c.SetKeepAlivePeriod(h.keepalive)
+	}
+}
+
+func (h *tcpHandler) SetQuotas(q *quota.Quotas) {
+	h.Lock()
+	h.quotas = q
+	h.Unlock()
+}
+
+func (h *tcpHandler) quota() *quota.Quotas {
+	h.RLock()
+	defer h.RUnlock()
+	return h.quotas
+}
+
+func (h *tcpHandler) SetTarpit(t *quota.Tarpit) {
+	h.Lock()
+	h.tarpit = t
+	h.Unlock()
+}
+
+func (h *tcpHandler) dnsTarpit() *quota.Tarpit {
+	h.RLock()
+	defer h.RUnlock()
+	return h.tarpit
+}
+
+func (h *tcpHandler) SetAppDNS(uid int, dns doh.Transport) {
+	h.apps.Set(uid, dns)
+}
+
+// AppDNS returns the transports set by SetAppDNS.
+func (h *tcpHandler) AppDNS() []doh.Transport {
+	return h.apps.All()
+}
+
+func (h *tcpHandler) SetFirewall(f *firewall.Firewall) {
+	h.Lock()
+	h.fw = f
+	h.Unlock()
+}
+
+func (h *tcpHandler) firewall() *firewall.Firewall {
+	h.RLock()
+	defer h.RUnlock()
+	return h.fw
+}
+
+func (h *tcpHandler) SetFakeIPs(f *dnsx.FakeIPs) {
+	h.Lock()
+	h.fakes = f
+	h.Unlock()
+}
+
+func (h *tcpHandler) fakeIPs() *dnsx.FakeIPs {
+	h.RLock()
+	defer h.RUnlock()
+	return h.fakes
+}
+
+func (h *tcpHandler) SetConnectionOwner(o protect.ConnectionOwner) {
+	h.Lock()
+	h.owner = o
+	h.Unlock()
+}
+
+func (h *tcpHandler) connectionOwner() protect.ConnectionOwner {
+	h.RLock()
+	defer h.RUnlock()
+	return h.owner
+}
+
+func (h *tcpHandler) setWireGuard(w *wireguard) {
+	h.wireguard = w
+}
+
+func (h *tcpHandler) SetOutbounds(o *outbound.Outbounds) {
+	h.Lock()
+	h.obs = o
+	h.Unlock()
+}
+
+func (h *tcpHandler) outbounds() *outbound.Outbounds {
+	h.RLock()
+	defer h.RUnlock()
+	return h.obs
+}
+
+func (h *tcpHandler) setPause(p *pause) {
+	h.pause = p
+}
+
+func (h *tcpHandler) setKillSwitch(k *killSwitch) {
+	h.killSwitch = k
+}
+
+func (h *tcpHandler) setMeter(m *usage.Meter) {
+	h.meter = m
+}
+
+func (h *tcpHandler) setFlows(f *flows) {
+	h.flows = f
+}
+
+func (h *tcpHandler) setLifecycle(c *lifecycle) {
+	h.lifecycle = c
+}
+
+func (h *tcpHandler) setRelayBuffer(size int) {
+	h.relayBuffer = size
+}
+
+func (h *tcpHandler) setCredentials(r *outbound.Refresher) {
+	h.creds = r
+}
+
+func (h *tcpHandler) ClearSplitCache() {
+	h.adaptive.Clear()
+}
+
 func (h *tcpHandler) SetDNSCryptProxy(dcrypt *dnscrypt.Proxy) {
 	h.dnscrypt = dcrypt
 }
@@ -312,11 +912,11 @@ func (h *tcpHandler) SetProxyOptions(po *settings.ProxyOptions) error {
 	var fproxy proxy.Dialer
 	var err error
 	if h.socks5Proxy() {
-		fproxy, err = proxy.SOCKS5("tcp", po.IPPort, po.Auth, proxy.Direct)
+		fproxy = outbound.NewSOCKS5Dialer(upstreamProxy, po.IPPort, po.Auth, h.creds, h.proxyDialer())
 	} else if h.httpsProxy() {
-		err = fmt.Errorf("http-proxy not supported")
+		fproxy = outbound.NewHTTPDialer(upstreamProxy, po.IPPort, po.Auth, h.creds, h.proxyDialer())
 	} else {
-		err = fmt.Errorf("proxy mode not set")
+		err = codes.New(codes.ProxyUnsupported, "proxy mode not set")
 	}
 	if err != nil {
 		h.proxy = nil
@@ -0,0 +1,48 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/celzero/firestack/intra/firewall"
+	"github.com/celzero/firestack/intra/outbound"
+	"github.com/celzero/firestack/intra/quota"
+)
+
+// TestTCPSetters sets the handler's state as flows read it; run with -race.
+func TestTCPSetters(t *testing.T) {
+	h := &tcpHandler{}
+	fw := firewall.NewFirewall()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			h.SetFirewall(fw)
+			h.SetQuotas(quota.NewQuotas(nil))
+			h.SetFakeIPs(nil)
+			h.SetConnectionOwner(nil)
+			h.SetOutbounds(outbound.NewOutbounds())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			h.firewall()
+			h.quota()
+			h.fakeIPs()
+			h.connectionOwner()
+			h.outbounds()
+		}
+	}()
+	wg.Wait()
+	if h.firewall() != fw {
+		t.Error("firewall not set")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package throttle limits the rate of bytes through the tunnel with token
+// buckets, shared by all flows they're attached to.
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// MinBurst is the fewest bytes a Bucket holds, so that a udp packet of any
+// size may pass a Bucket of any rate.
+const MinBurst = 64 * 1024
+
+// Bucket holds upto a second's worth of bytes, at its rate, refilled as
+// time passes.  A nil Bucket limits nothing.
+type Bucket struct {
+	sync.Mutex
+	kbps   int
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	sleep  func(time.Duration) // for tests
+}
+
+// NewBucket returns a full Bucket that refills at `kbps`, kilobits per
+// second, or nil if kbps isn't positive.
+func NewBucket(kbps int) *Bucket {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1000 / 8
+	burst := rate
+	if burst < MinBurst {
+		burst = MinBurst
+	}
+	return &Bucket{
+		kbps:   kbps,
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		sleep:  time.Sleep,
+	}
+}
+
+// NewRate returns a full Bucket of `burst` tokens that refills at `perSec`
+// tokens per second, for limiting the rate of events, like queries, rather
+// than of bytes; or nil if perSec isn't positive.  burst < 1 holds a
+// second's worth of tokens.
+func NewRate(perSec int, burst int) *Bucket {
+	if perSec <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = perSec
+	}
+	return &Bucket{
+		rate:   float64(perSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		sleep:  time.Sleep,
+	}
+}
+
+// Kbps returns the rate of b, in kilobits per second, or 0 if b is nil.
+func (b *Bucket) Kbps() int {
+	if b == nil {
+		return 0
+	}
+	return b.kbps
+}
+
+// Must be called under Lock.
+func (b *Bucket) refillLocked(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Wait takes n bytes from b, and if it hasn't as many, blocks till it is
+// refilled for them.  Meant for streams, which slow down as Wait blocks.
+func (b *Bucket) Wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.Lock()
+	b.refillLocked(time.Now())
+	// go into debt, so that flows sharing b wait their turn
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.Unlock()
+	if debt > 0 {
+		b.sleep(time.Duration(debt / b.rate * float64(time.Second)))
+	}
+}
+
+// Allow takes n bytes from b, and reports whether it had as many.  Meant
+// for packets, which are dropped, rather than held back, if not allowed.
+func (b *Bucket) Allow(n int) bool {
+	if b == nil || n <= 0 {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.refillLocked(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	if NewBucket(0) != nil {
+		t.Error("Bucket of no rate")
+	}
+	b := NewBucket(8000) // 1MB/s
+	if b.Kbps() != 8000 {
+		t.Errorf("Wrong rate %d", b.Kbps())
+	}
+	var slept time.Duration
+	b.sleep = func(d time.Duration) { slept += d }
+
+	b.Wait(1000 * 1000)
+	if slept != 0 {
+		t.Errorf("Full bucket waited %v", slept)
+	}
+	b.Wait(500 * 1000)
+	if slept < 400*time.Millisecond || slept > 500*time.Millisecond {
+		t.Errorf("Wrong wait %v", slept)
+	}
+	if b.Allow(1) {
+		t.Error("Empty bucket allowed a packet")
+	}
+}
+
+func TestBucketAllow(t *testing.T) {
+	b := NewBucket(8) // 1KB/s, and MinBurst
+	if !b.Allow(MinBurst) {
+		t.Error("Full bucket disallowed a packet")
+	}
+	if b.Allow(MinBurst) {
+		t.Error("Empty bucket allowed a packet")
+	}
+	b.last = b.last.Add(-2 * time.Second)
+	if !b.Allow(1000) {
+		t.Error("Refilled bucket disallowed a packet")
+	}
+
+	var nilb *Bucket
+	nilb.Wait(1 << 30)
+	if !nilb.Allow(1<<30) || nilb.Kbps() != 0 {
+		t.Error("Nil bucket should limit nothing")
+	}
+}
+
+func TestRate(t *testing.T) {
+	if NewRate(0, 10) != nil {
+		t.Error("Rate of no rate")
+	}
+	b := NewRate(2, 0) // a burst of a second's worth
+	if !b.Allow(1) || !b.Allow(1) || b.Allow(1) {
+		t.Error("Wrong burst")
+	}
+	b.last = b.last.Add(-time.Second)
+	if !b.Allow(2) || b.Allow(1) {
+		t.Error("Wrong refill")
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package trace follows a DNS query through its stages (transport, blocklists)
+// and on to the flows made to its answers, when tracing is enabled.
+// Traces are retained in a bounded ring and are dumped as JSON per domain.
+package trace
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Stages a trace moves through.
+const (
+	StageQuery     = "query"
+	StageBlocklist = "blocklist"
+	StageTransport = "transport"
+	StageAnswer    = "answer"
+	StageFlow      = "flow"
+)
+
+const (
+	// maxTraces caps the number of traces retained.
+	maxTraces = 256
+	// maxEvents caps the number of events per trace.
+	maxEvents = 64
+	// maxIPs caps the number of answer ips mapped back to traces.
+	maxIPs = 1024
+)
+
+// ID identifies a trace; zero is no trace.
+type ID int64
+
+type event struct {
+	Millis int64  `json:"ms"`
+	Stage  string `json:"stage"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type record struct {
+	ID     ID      `json:"id"`
+	Domain string  `json:"domain"`
+	Start  int64   `json:"start"`
+	Events []event `json:"events"`
+}
+
+var (
+	mu      sync.Mutex
+	enabled bool
+	last    ID
+	ring    []*record // oldest first
+	byID    = make(map[ID]*record)
+	byIP    = make(map[string]ID)
+	ipOrder []string // insertion order of byIP keys
+)
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Enable turns tracing on or off; turning it off discards all traces.
+func Enable(on bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	enabled = on
+	if !on {
+		ring = nil
+		byID = make(map[ID]*record)
+		byIP = make(map[string]ID)
+		ipOrder = nil
+	}
+}
+
+// Enabled reports whether tracing is on.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return enabled
+}
+
+// Start begins a trace for a query to domain, and returns its ID.
+// Returns zero when tracing is off.
+func Start(domain string) ID {
+	mu.Lock()
+	defer mu.Unlock()
+	if !enabled {
+		return 0
+	}
+	last++
+	r := &record{ID: last, Domain: strings.TrimSuffix(strings.ToLower(domain), "."), Start: millis(time.Now())}
+	if len(ring) >= maxTraces {
+		delete(byID, ring[0].ID)
+		ring = ring[1:]
+	}
+	ring = append(ring, r)
+	byID[r.ID] = r
+	r.add(StageQuery, domain)
+	return r.ID
+}
+
+// StartQuery is like Start, but for the domain in the raw dns query q.
+func StartQuery(q []byte) ID {
+	if !Enabled() {
+		return 0
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(q); err != nil || len(msg.Question) <= 0 {
+		return 0
+	}
+	return Start(msg.Question[0].Name)
+}
+
+// Must be called with mu held.
+func (r *record) add(stage, detail string) {
+	if len(r.Events) >= maxEvents {
+		return
+	}
+	r.Events = append(r.Events, event{millis(time.Now()), stage, detail})
+}
+
+// Event records detail at stage of trace id; no-op if id is zero or expired.
+func Event(id ID, stage string, detail string) {
+	if id == 0 {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if r := byID[id]; r != nil {
+		r.add(stage, detail)
+	}
+}
+
+// Answer records the raw dns response res in trace id, and remembers its
+// A and AAAA records so that flows to them are traced back to id.
+func Answer(id ID, res []byte) {
+	if id == 0 {
+		return
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(res); err != nil {
+		Event(id, StageAnswer, "unparseable")
+		return
+	}
+	var ips []string
+	for _, rr := range msg.Answer {
+		switch a := rr.(type) {
+		case *dns.A:
+			ips = append(ips, a.A.String())
+		case *dns.AAAA:
+			ips = append(ips, a.AAAA.String())
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	r := byID[id]
+	if r == nil {
+		return
+	}
+	r.add(StageAnswer, dns.RcodeToString[msg.Rcode]+" "+strings.Join(ips, ","))
+	for _, ip := range ips {
+		if _, ok := byIP[ip]; !ok {
+			if len(ipOrder) >= maxIPs {
+				delete(byIP, ipOrder[0])
+				ipOrder = ipOrder[1:]
+			}
+			ipOrder = append(ipOrder, ip)
+		}
+		byIP[ip] = id
+	}
+}
+
+// Flow records a connection to ip in the trace of the query that answered
+// with ip, if any.
+func Flow(ip string, detail string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !enabled {
+		return
+	}
+	if r := byID[byIP[ip]]; r != nil {
+		r.add(StageFlow, detail)
+	}
+}
+
+// Dump returns the retained traces for domain as a JSON array, oldest first.
+// An empty domain dumps all traces.
+func Dump(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	mu.Lock()
+	out := make([]*record, 0)
+	for _, r := range ring {
+		if len(domain) <= 0 || r.Domain == domain {
+			out = append(out, r)
+		}
+	}
+	b, err := json.Marshal(out)
+	mu.Unlock()
+	if err != nil {
+		return "[]"
+	}
+	return string(b)
+}
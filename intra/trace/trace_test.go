@@ -0,0 +1,70 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package trace
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDisabled(t *testing.T) {
+	Enable(false)
+	if id := Start("example.com"); id != 0 {
+		t.Error("Expected no trace when disabled")
+	}
+	if Dump("") != "[]" {
+		t.Error("Expected empty dump")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	Enable(true)
+	defer Enable(false)
+
+	q := new(dns.Msg)
+	q.SetQuestion("Example.com.", dns.TypeA)
+	qb, _ := q.Pack()
+	id := StartQuery(qb)
+	if id == 0 {
+		t.Fatal("Expected a trace")
+	}
+	Event(id, StageTransport, "doh")
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	rb, _ := r.Pack()
+	Answer(id, rb)
+	Flow("192.0.2.1", "tcp 192.0.2.1:443")
+	Flow("192.0.2.2", "tcp 192.0.2.2:443") // untraced
+
+	var out []record
+	if err := json.Unmarshal([]byte(Dump("example.com")), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 {
+		t.Fatalf("Expected 1 trace, got %d", len(out))
+	}
+	stages := []string{StageQuery, StageTransport, StageAnswer, StageFlow}
+	if len(out[0].Events) != len(stages) {
+		t.Fatalf("Wrong events %v", out[0].Events)
+	}
+	for i, s := range stages {
+		if out[0].Events[i].Stage != s {
+			t.Errorf("Event %d: got %s, want %s", i, out[0].Events[i].Stage, s)
+		}
+	}
+	if Dump("other.com") != "[]" {
+		t.Error("Expected no traces for other.com")
+	}
+}
@@ -24,19 +24,37 @@
 package intra
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 
+	"github.com/celzero/firestack/intra/codes"
+	"github.com/celzero/firestack/intra/diag"
 	"github.com/celzero/firestack/intra/dnscrypt"
 	"github.com/celzero/firestack/intra/dnsx"
 	"github.com/celzero/firestack/intra/doh"
+	"github.com/celzero/firestack/intra/events"
+	"github.com/celzero/firestack/intra/firewall"
+	"github.com/celzero/firestack/intra/kv"
+	"github.com/celzero/firestack/intra/memory"
+	"github.com/celzero/firestack/intra/outbound"
+	"github.com/celzero/firestack/intra/portal"
 	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/qlog"
+	"github.com/celzero/firestack/intra/quota"
+	"github.com/celzero/firestack/intra/rdap"
+	"github.com/celzero/firestack/intra/sdns"
 	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/split"
+	"github.com/celzero/firestack/intra/usage"
+	"github.com/celzero/firestack/intra/wg"
 	"github.com/celzero/firestack/tunnel"
 )
 
@@ -56,12 +74,129 @@ type Tunnel interface {
 	GetDNS() doh.Transport
 	// Set the DNSTransport.  This method must be called before connecting the transport
 	// to the TUN device.  The transport can be changed at any time during operation, but
-	// must not be nil.
-	SetDNS(doh.Transport)
-	// Set DNSMode, BlockMode, and ProxyMode.
-	SetTunMode(int, int, int)
+	// must not be nil.  Errs if the managed config doesn't allow it.
+	SetDNS(doh.Transport) error
+	// SetDNSTransport swaps in `dns`, non-nil, for the transport in-use, while
+	// the tunnel is running, or else errs, as when the managed config doesn't
+	// allow it.  Queries in-flight on the transport swapped out are drained in
+	// the background before its connections are closed.
+	SetDNSTransport(dns doh.Transport) error
+	// NewDNSTransport returns a DoH transport for `url`, with `ips`, a csv of
+	// its ips, if known, that dials as the tunnel does, and reports to its
+	// listener, to be set with SetDNSTransport.
+	NewDNSTransport(url string, ips string) (doh.Transport, error)
+	// SetDNSStamp sets up the resolver of `stamp`, an sdns:// DNS stamp: a DoH
+	// transport, pinned to its certificate hashes, if any, as SetDNSTransport;
+	// a DNSCrypt proxy, as StartDNSCryptProxy; or a Do53 server, as
+	// StartDNSProxy.  DoT, DoQ, and relay stamps err.  The DNSMode, as set by
+	// SetTunMode, picks which of them is in-use.
+	SetDNSStamp(stamp string) error
+	// SetQueryDecider sets `d` to decide on each query to the DoH transport
+	// in-use, and those set later, before it is sent: to block it, answer it,
+	// redirect it to another transport, or let it proceed; nil unsets it.
+	SetQueryDecider(d doh.Decider)
+	// SetListenerQueue sets up to `size` calls to the Listener, of the DoH
+	// transport in-use, those set later, and the DNSCrypt proxy, to be queued,
+	// and made apart from queries, dropping the oldest once full; size <= 0
+	// calls the Listener as queries complete (default: 64).
+	SetListenerQueue(size int)
+	// Set DNSMode, BlockMode, and ProxyMode.  Errs, and sets none of them, if
+	// the managed config doesn't allow the resolver of the DNSMode.
+	SetTunMode(int, int, int) error
+	// SetTrapDoT, if `on`, refuses connections to port 853 in the DNSMode*Port
+	// modes, which trap DNS on port 53 whatever its destination, so that apps
+	// with a hardcoded DNS-over-TLS resolver fall back to port 53, and get the
+	// resolver and blocklists in-use; see settings.TunMode.TrapDoT.
+	SetTrapDoT(on bool)
+	// SetFakeIPs answers A and AAAA queries to the DoH transports with fake
+	// ips from `cidrs`, a csv of an IPv4 cidr, an IPv6 cidr, or both, like
+	// "198.18.0.0/15,fd66:f83a:c650::/64", one per name, and sends flows to
+	// fake ips on to the real ips of those names, or to the names themselves,
+	// through proxies.  Firewall rules on domains so match flows to names
+	// however long apps cache their ips.  An empty `cidrs` stops faking.
+	SetFakeIPs(cidrs string) error
+	// Flows returns the active TCP connections and UDP associations, oldest
+	// first, as a json array of Flow.  A flow's Age is in millis, and its
+	// bytes are as relayed so far.
+	Flows() string
+	// CloseFlow ends the active flow numbered `id`, as listed by Flows, and
+	// reports whether there was one.
+	CloseFlow(id int64) bool
+	// CloseAppFlows ends all active flows of app `uid`, and returns how many
+	// there were.
+	CloseAppFlows(uid int) int
 	// When set to true, Intra will pre-emptively split all HTTPS connections.
 	SetAlwaysSplitHTTPS(bool)
+	// SetSplitStrategy sets how HTTPS connections are split: at byte offsets
+	// (csv), or else into a number of fragments, and optionally only when
+	// the first segment is a TLS ClientHello.  Segments are sent delayms
+	// apart, and if desyncTTL is non-zero, the first segment is sent with
+	// that TTL so that it reaches the server out of order.  If recordSizes
+	// (csv) is not empty, ClientHellos are first re-framed into TLS records
+	// of those payload sizes.
+	SetSplitStrategy(offsets string, fragments int, helloOnly bool, delayms int, desyncTTL int, recordSizes string) error
+	// SetQuotas enforces per-app quotas on connections, dns queries, and bytes;
+	// nil lifts all quotas.
+	SetQuotas(*quota.Quotas)
+	// SetTarpit delays dns answers to apps that query faster than the tarpit
+	// allows; nil disables the tarpit.
+	SetTarpit(*quota.Tarpit)
+	// SetAppDNS sends dns queries from app `uid` to `dns` in place of the
+	// default transport; nil reverts uid to the default.  For instance, an app
+	// may bypass DoH by routing it to a transport to the network's resolver.
+	// The transport is set up with the blocklists, query decider, and portal
+	// mode as the default transport is, its truncated answers are retried on
+	// the default transport, and it errs if the managed config doesn't allow
+	// it.
+	SetAppDNS(uid int, dns doh.Transport) error
+	// ClearSplitCache forgets destinations that were found to need splitting,
+	// so that they are probed afresh, say, on a network change.
+	ClearSplitCache()
+	// OnNetworkChanged is to be called as the underlying network changes, say,
+	// from Wi-Fi to cellular.  It clears the split cache, and, in the
+	// background, closes pooled DoH connections, ends servfail hangovers,
+	// forgets confirmed IPs, and resolves DoH servers' bootstrap addresses
+	// afresh, rather than waiting for connections on the network since left
+	// to time out.
+	OnNetworkChanged()
+	// Pause holds back new tcp and udp flows, and udp packets, for `seconds`,
+	// or until Resume if 0, without tearing down the TUN device or the
+	// netstack.  If `dnsFromCache`, DoH queries are answered from the cache
+	// alone, if any, and SERVFAILed on a miss; else they are held back, too.
+	// TCP connections in progress are left be.  Pausing a paused tunnel
+	// restarts its pause.
+	Pause(seconds int, dnsFromCache bool)
+	// Resume undoes Pause.
+	Resume()
+	// IsPaused reports whether the tunnel is paused.
+	IsPaused() bool
+	// SetKillSwitch, if `on`, drops new flows, but for dns, while the DoH
+	// transport in-use is in servfail hangover, and new flows through the
+	// socks5 or http proxy from a failed dial through it upto a successful
+	// one; a proxied flow is let through every few seconds to find out.  The
+	// Listener of package events is told as the switch engages and releases.
+	SetKillSwitch(on bool)
+	// Usage returns a json snapshot of bytes sent (up) and received (down),
+	// per app, and per app and destination, since the tunnel connected, or
+	// the last reset, and starts counting afresh if `reset`.  TCP and UDP bytes
+	// are counted as they flow, and not as connections close.
+	Usage(reset bool) string
+	// SetUsageListener sends `l` a Usage snapshot, and resets the counts,
+	// every `seconds`; nil `l`, or 0 seconds, stops the snapshots.
+	SetUsageListener(l usage.Listener, seconds int)
+	// SetTCPTimeouts sets the interval of keepalive probes on upstream sockets
+	// of new TCP flows, 0 for the default of 15s, or -1 for none; and how long
+	// TCP flows may go without a byte sent or received before they're closed,
+	// to reap dead flows, or 0 for no limit.  Long-lived flows, such as push
+	// and SSH, need an `idleSecs` longer than their own keepalive interval.
+	SetTCPTimeouts(keepaliveSecs int, idleSecs int)
+	// SetUDPNAT sets how long UDP associations last without a packet,
+	// `timeoutSecs`, or 0 to leave it be (5 minutes, by default); and the most
+	// associations at once, `maxSessions`, or 0 for no limit, past which an
+	// existing one is evicted for each new one, as `evict`, one of EvictIdlest,
+	// EvictOldest, or EvictNone, which refuses new ones instead; other values
+	// of `evict` are refused, with a BadConfig error.
+	SetUDPNAT(timeoutSecs int, maxSessions int, evict int) error
 	// StartDNSCryptProxy starts a DNSCrypt proxy instance for resolvers
 	// (csv of dns-stamps) and relays (csv of dns-stamps).
 	StartDNSCryptProxy(string, string, Listener) (string, error)
@@ -81,18 +216,137 @@ type Tunnel interface {
 	SetBraveDNS(dnsx.BraveDNS) error
 	// GetBraveDNS gets bravedns in-use by various dns transports
 	GetBraveDNS() dnsx.BraveDNS
+	// SetManagedConfig enforces admin constraints (ex: from work profiles) on this session.
+	// A DoH transport in-use that isn't allowed is swapped for the locked resolver; other
+	// resolvers in-use that aren't allowed, or a sealed config in-use, err.
+	SetManagedConfig(*settings.ManagedConfig) error
+	// GetManagedConfig gets the managed config in-use, if any.
+	GetManagedConfig() *settings.ManagedConfig
+	// SetDNSCoalescing holds DNS answers bound for the TUN device for up to windowms
+	// (millis) to write them out together; 0 disables. A TunWriter that implements
+	// tunnel.BatchWriter receives them as concatenated IP packets in one call.
+	SetDNSCoalescing(windowms int)
+	// LookupRDAP returns the registration data (json) of an ip, asn, or domain,
+	// resolved with the DNSTransport in-use and fetched through the tunnel's egress.
+	LookupRDAP(query string) (string, error)
+	// SetFirewall applies the rules of `f` to all new tcp and udp flows, ahead
+	// of the Blocker, in all block modes but sink, and its routes to pick the
+	// outbounds of flows; nil removes the firewall.
+	SetFirewall(f *firewall.Firewall)
+	// SetOutbounds sets the outbounds that the firewall routes flows to, by
+	// name, besides outbound.Direct and outbound.WireGuard. Flows routed to
+	// outbounds that aren't set fail.
+	SetOutbounds(o *outbound.Outbounds)
+	// SetProxyCredentials sets `c` to provide the socks5 or http proxy of
+	// StartProxy, named "proxy", with new credentials once it rejects its own,
+	// as when the app rotates them; nil unsets it.  Outbounds take theirs from
+	// outbound.Outbounds.SetCredentials.
+	SetProxyCredentials(c outbound.Credentials)
+	// SetConnectionOwner sets `o` to identify the apps that own new tcp and udp
+	// flows, ahead of /proc/net, for firewall rules, quotas, and per-app dns.
+	SetConnectionOwner(o protect.ConnectionOwner)
+	// StartCapture writes packets to and from the TUN device to a pcap file at
+	// `path`, rotated once it is `maxBytes` big through upto `files` files, and
+	// only dns packets if `dnsOnly`.  Replaces the capture in progress, if any.
+	StartCapture(path string, maxBytes int64, files int, dnsOnly bool) error
+	// StopCapture stops the capture in progress, if any.
+	StopCapture() error
+	// SetWireGuard carries tcp and udp flows to the AllowedIPs of the peers
+	// in `config`, a wg-quick(8) config, over WireGuard, as it does flows the
+	// firewall routes to outbound.WireGuard, and the rest as before; empty
+	// `config` stops WireGuard.  DNS (port 53) is left to the dns transports,
+	// and flows routed to other outbounds by the firewall to those.  Flows
+	// carried over WireGuard bypass the proxy, and are dialed from the
+	// interface's Address, at its MTU, through a userspace netstack; other
+	// protocols, like icmp, aren't carried.  Names of flows, as to fake ips,
+	// are resolved over the peers by the DNS servers of `config`, and aren't
+	// dialed without any.
+	SetWireGuard(config string) error
+	// WireGuardStatus returns a json array of the endpoint, latest handshake
+	// (unix millis), and bytes received and sent of each WireGuard peer.
+	WireGuardStatus() string
+	// ApplyConfig sets the tunnel up as `config`, a json Config (see
+	// ParseConfig); sections it leaves out are left as they are.  Bad
+	// configs are refused before any of them is applied.
+	ApplyConfig(config string) error
+	// SetLifecycleListener sets `l` to receive the lifecycle of the tunnel,
+	// and of its proxies; nil unsets.
+	SetLifecycleListener(l LifecycleListener)
+	// SetMemoryLimit sizes the dns caches, the udp nat table, and the buffers
+	// of tcp relays to a budget of `bytes`, as in memory.BudgetOf, and has the
+	// gc run, and memory return to the OS, as often as it calls for; 0 lifts
+	// the limit.
+	SetMemoryLimit(bytes int64)
+	// OnLowMemory evicts all cached dns responses, and returns what memory it
+	// can to the OS; to be called as the OS warns of memory pressure.
+	OnLowMemory()
+	// SetKVStore persists the state of the tunnel to `s`: the ips of the DoH
+	// servers, the dns caches of the transports in-use, and those set later,
+	// the query stats of qlog, and the counts of a dnsx.BlockCounter set as
+	// the BraveDNS; nil `s` unsets the store.
+	SetKVStore(s kv.KVStore)
+	// DetectPortal probes for a captive portal over the underlying network,
+	// and, if `resolver` isn't nil, with queries to it, the network's
+	// resolver, and returns a json portal.Result.  Portals found are
+	// published as the event events.PortalDetected, for the app to prompt
+	// the user to log in.
+	DetectPortal(resolver doh.Transport) string
+	// EnterPortalMode sends dns queries for `domains`, a csv, like those of a
+	// portal.Result, and for names under them, to `resolver`, the network's
+	// resolver, unblocked, for `seconds`, or 0 for 5 minutes, so that the
+	// portal can load; see portal.Mode.
+	EnterPortalMode(domains string, resolver doh.Transport, seconds int) error
+	// ExitPortalMode ends portal mode, if on.
+	ExitPortalMode()
+}
+
+// defaultMTU is the MTU of the TUN device, unless told otherwise.
+const defaultMTU = 1500
+
+// The tcp/ip stacks of NewTunnel.
+const (
+	// StackLWIP is tun2socks' lwIP, the default.
+	StackLWIP = "lwip"
+	// StackGVisor is gVisor's netstack.
+	StackGVisor = "gvisor"
+)
+
+// defaultTransport is the default dns transport of an intratunnel, or nil, as
+// the values of an atomic.Value must all be of one type.
+type defaultTransport struct {
+	doh.Transport
 }
 
 type intratunnel struct {
 	tunnel.Tunnel
 	tcp          TCPHandler
 	udp          UDPHandler
-	dns          doh.Transport
+	dns          atomic.Value // defaultTransport
 	tunmode      *settings.TunMode
 	dnscrypt     *dnscrypt.Proxy
 	proxyOptions *settings.ProxyOptions
 	dnsOptions   *settings.DNSOptions
 	bravedns     dnsx.BraveDNS
+	managed      *settings.ManagedConfig
+	coalescer    *tunnel.CoalescingWriter
+	capmu        sync.Mutex
+	capture      atomic.Value // *tunnel.Capture
+	dialer       *net.Dialer
+	config       *net.ListenConfig
+	wireguard    *wireguard
+	mtu          int
+	pause        *pause
+	killSwitch   *killSwitch
+	meter        *usage.Meter
+	flows        *flows
+	listener     Listener
+	lifecycle    *lifecycle
+	budget       *memory.Budget // of SetMemoryLimit, or nil if none
+	portal       *portal.Mode
+	creds        *outbound.Refresher // of the proxy of StartProxy
+	decider      doh.Decider         // of SetQueryDecider, if any
+	queue        int                 // of SetListenerQueue, or -1 if unset
+	kvstore      kv.KVStore          // of SetKVStore, if any
 }
 
 // NewTunnel creates a connected Intra session.
@@ -103,25 +357,79 @@ type intratunnel struct {
 //    These will normally be localhost with a high-numbered port.
 // `dohdns` is the initial DOH transport.
 // `tunWriter` is the downstream VPN tunnel.  IntraTunnel.Disconnect() will close `tunWriter`.
+// `mtu` is the MTU of the TUN device, or 0 for the default of 1500.  The MSS of TCP SYNs to
+//    and from the TUN device is clamped to fit it.
+// `stack` is the tcp/ip stack, StackLWIP, the default if empty, or StackGVisor.
 // `dialer` and `config` will be used for all network activity.
 // `listener` will be notified at the completion of every tunneled socket.
-func NewTunnel(fakedns string, dohdns doh.Transport, tunWriter io.WriteCloser, dialer *net.Dialer, blocker protect.Blocker, config *net.ListenConfig, listener Listener) (Tunnel, error) {
+func NewTunnel(fakedns string, dohdns doh.Transport, tunWriter io.WriteCloser, mtu int, stack string, dialer *net.Dialer, blocker protect.Blocker, config *net.ListenConfig, listener Listener) (Tunnel, error) {
 	if tunWriter == nil {
-		return nil, errors.New("Must provide a valid TUN writer")
+		return nil, codes.New(codes.BadTun, "Must provide a valid TUN writer")
 	}
-	core.RegisterOutputFn(tunWriter.Write)
+	if mtu <= 0 {
+		mtu = defaultMTU
+	} else if mtu < tunnel.MinMTU || mtu > tunnel.MaxMTU {
+		return nil, codes.Errorf(codes.BadMTU, "mtu %d not in [%d, %d]", mtu, tunnel.MinMTU, tunnel.MaxMTU)
+	}
+	coalescer := tunnel.NewCoalescingWriter(tunWriter)
 	t := &intratunnel{
-		Tunnel: tunnel.NewTunnel(tunWriter, core.NewLWIPStack()),
-		tunmode: settings.DefaultTunMode(),
+		tunmode:   settings.DefaultTunMode(),
+		coalescer: coalescer,
+		dialer:    dialer,
+		config:    config,
+		wireguard: newWireGuard(),
+		mtu:       mtu,
+		pause:     &pause{},
+		meter:     usage.NewMeter(),
+		flows:     newFlows(),
+		listener:  listener,
+		lifecycle: newLifecycle(),
+		creds:     &outbound.Refresher{},
+		queue:     -1,
 	}
+	t.killSwitch = newKillSwitch(t.GetDNS)
+	t.portal = portal.NewMode()
+	t.dns.Store(defaultTransport{})
+	t.capture.Store((*tunnel.Capture)(nil))
 	if err := t.registerConnectionHandlers(fakedns, dialer, blocker, config, listener); err != nil {
 		return nil, err
 	}
-	t.SetDNS(dohdns)
+	var s core.LWIPStack
+	switch stack {
+	case StackLWIP, "":
+		core.RegisterOutputFn(t.output)
+		core.RegisterUDPConnHandler(t.udp)
+		core.RegisterTCPConnHandler(t.tcp)
+		s = core.NewLWIPStack()
+	case StackGVisor:
+		var err error
+		if s, err = tunnel.NewGVisorStack(mtu, t.tcp, t.udp, t.output); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, codes.Errorf(codes.BadConfig, "unknown stack %q", stack)
+	}
+	t.Tunnel = tunnel.NewTunnel(coalescer, s)
+	if err := t.SetDNS(dohdns); err != nil {
+		return nil, err
+	}
+	t.lifecycle.start()
 	return t, nil
 }
 
-// Registers Intra's custom UDP and TCP connection handlers to the tun2socks core.
+// output writes packets of the tcp/ip stack to the TUN device.
+func (t *intratunnel) output(b []byte) (int, error) {
+	tunnel.ClampMSS(b, t.mtu)
+	t.capturing().Packet(b)
+	n, err := t.coalescer.Write(b)
+	if err != nil {
+		events.Publish(events.NetstackError, "tun", err.Error())
+		t.lifecycle.wrote(err)
+	}
+	return n, err
+}
+
+// Makes Intra's custom UDP and TCP connection handlers, for the tcp/ip stack.
 func (t *intratunnel) registerConnectionHandlers(fakedns string, dialer *net.Dialer, blocker protect.Blocker, config *net.ListenConfig, listener Listener) error {
 	// RFC 4787 REQ-5 requires a timeout no shorter than 5 minutes.
 	timeout, _ := time.ParseDuration("5m")
@@ -131,39 +439,540 @@ func (t *intratunnel) registerConnectionHandlers(fakedns string, dialer *net.Dia
 		return err
 	}
 	t.udp = NewUDPHandler(*udpfakedns, timeout, blocker, t.tunmode, config, listener)
-	core.RegisterUDPConnHandler(t.udp)
+	t.udp.setPause(t.pause)
+	t.udp.setKillSwitch(t.killSwitch)
+	t.udp.setMeter(t.meter)
+	t.udp.setFlows(t.flows)
+	t.udp.setWireGuard(t.wireguard)
 
 	tcpfakedns, err := net.ResolveTCPAddr("tcp", fakedns)
 	if err != nil {
 		return err
 	}
 	t.tcp = NewTCPHandler(*tcpfakedns, dialer, blocker, t.tunmode, listener)
-	core.RegisterTCPConnHandler(t.tcp)
+	t.tcp.setPause(t.pause)
+	t.tcp.setKillSwitch(t.killSwitch)
+	t.tcp.setMeter(t.meter)
+	t.tcp.setFlows(t.flows)
+	t.tcp.setLifecycle(t.lifecycle)
+	t.tcp.setWireGuard(t.wireguard)
+	t.tcp.setCredentials(t.creds)
 	return nil
 }
 
-func (t *intratunnel) SetDNS(dns doh.Transport) {
-	bravedns := t.bravedns
-	t.dns = dns
-	t.udp.SetDNS(dns)
-	t.tcp.SetDNS(dns)
-	dns.SetBraveDNS(bravedns)
+func (t *intratunnel) SetDNS(dns doh.Transport) error {
+	_, err := t.swapDNS(dns)
+	return err
+}
+
+// swapDNS sets dns as the default transport, and returns the one it replaced.
+func (t *intratunnel) swapDNS(dns doh.Transport) (doh.Transport, error) {
+	if dns == nil {
+		return nil, codes.New(codes.NoDNS, "no dns transport")
+	}
+	if err := t.allowResolver(dns.GetURL()); err != nil {
+		return nil, err
+	}
+	prev := t.dns.Swap(defaultTransport{dns}).(defaultTransport).Transport
+	relaxed := t.prepare(dns)
+	t.udp.SetDNS(relaxed)
+	t.tcp.SetDNS(relaxed)
+	events.Publish(events.TransportSwitched, dns.GetURL(), "")
+	return prev, nil
+}
+
+// prepare sets dns up with the blocklists, cache size, query decider, and
+// listener queue in-use, and returns it wrapped to harvest ip hints, and for
+// portal mode.
+func (t *intratunnel) prepare(dns doh.Transport) doh.Transport {
+	dns.SetBraveDNS(t.bravedns)
+	if b := t.budget; b != nil {
+		dnsx.SetCacheSize(dns, b.DNSCacheSize)
+	}
+	if d := t.decider; d != nil {
+		doh.SetDecider(dns, d)
+	}
+	if t.queue >= 0 {
+		doh.SetListenerQueue(dns, t.queue)
+	}
+	if s := t.kvstore; s != nil {
+		// transports other than doh have no ips, and some no cache, to persist
+		doh.SetKVStore(dns, s)
+		dnsx.SetCacheStore(dns, s)
+	}
+	// ip hints of HTTPS answers are dialed should the ips of flows fail
+	return t.portal.Wrap(dnsx.NewHintHarvester(dns))
+}
+
+// defaultDNS forwards queries to the default transport of t, as it is at the
+// time of each query.
+type defaultDNS struct {
+	t *intratunnel
+}
+
+func (d defaultDNS) Query(q []byte) ([]byte, error) {
+	dns := d.t.GetDNS()
+	if dns == nil {
+		return nil, codes.New(codes.NoDNS, "no dns transport")
+	}
+	return dns.Query(q)
+}
+
+func (d defaultDNS) GetURL() string {
+	if dns := d.t.GetDNS(); dns != nil {
+		return dns.GetURL()
+	}
+	return ""
+}
+
+// SetBraveDNS is a no-op; the default transport is set up by t.
+func (d defaultDNS) SetBraveDNS(dnsx.BraveDNS) {}
+
+func (t *intratunnel) SetListenerQueue(size int) {
+	if size < 0 {
+		size = 0
+	}
+	t.queue = size
+	if dns := t.GetDNS(); dns != nil {
+		if err := doh.SetListenerQueue(dns, size); err != nil {
+			log.Warnf("listener queue not set on %s: %v", dns.GetURL(), err)
+		}
+	}
+	for _, dns := range t.tcp.AppDNS() {
+		// transports other than doh have no listener queue
+		doh.SetListenerQueue(dns, size)
+	}
+	if p := t.dnscrypt; p != nil {
+		p.SetListenerQueue(size)
+	}
+}
+
+func (t *intratunnel) SetQueryDecider(d doh.Decider) {
+	t.decider = d
+	if dns := t.GetDNS(); dns != nil {
+		if err := doh.SetDecider(dns, d); err != nil {
+			log.Warnf("query decider not set on %s: %v", dns.GetURL(), err)
+		}
+	}
+	for _, dns := range t.tcp.AppDNS() {
+		// transports other than doh take no decider
+		doh.SetDecider(dns, d)
+	}
 }
 
 func (t *intratunnel) GetDNS() doh.Transport {
-	return t.dns
+	return t.dns.Load().(defaultTransport).Transport
+}
+
+// drainTimeout is how long the queries of swapped out transports are given to
+// complete; the same as DoH transports wait for responses.
+const drainTimeout = 20 * time.Second
+
+func (t *intratunnel) SetDNSTransport(dns doh.Transport) error {
+	prev, err := t.swapDNS(dns)
+	if err != nil {
+		return err
+	}
+	if prev != nil && prev != dns {
+		diag.Go(diag.DoH, func() {
+			if !doh.Drain(prev, int(drainTimeout/time.Millisecond)) {
+				log.Warnf("transport %s swapped out with queries in-flight", prev.GetURL())
+			}
+		})
+	}
+	return nil
+}
+
+func (t *intratunnel) NewDNSTransport(url string, ips string) (doh.Transport, error) {
+	return newDoH(&DNSConfig{DoH: url, IPs: ips}, t.dialer, t.listener)
+}
+
+func (t *intratunnel) SetDNSStamp(stamp string) error {
+	st, err := sdns.Parse(stamp)
+	if err != nil {
+		return codes.Wrap(codes.BadConfig, err)
+	}
+	switch st.Proto {
+	case sdns.DoH:
+		var ips string
+		if len(st.Addr) > 0 {
+			ips, _, _ = net.SplitHostPort(st.Addr)
+		}
+		dns, err := doh.NewTransportBuilder().
+			SetURL(st.URL).
+			SetIPs(ips).
+			SetPins(st.HashesCSV()).
+			SetDialer(bootstrapDialer(t.dialer, st.Bootstrap)).
+			SetListener(t.listener).
+			Build()
+		if err != nil {
+			return codes.Wrap(codes.BadConfig, err)
+		}
+		return t.SetDNSTransport(dns)
+	case sdns.DNSCrypt:
+		// resolvers are a csv of name#stamp
+		return t.setDNSCrypt(st.Hostname+"#"+stamp, "")
+	case sdns.Do53:
+		ip, port, err := net.SplitHostPort(st.Addr)
+		if err != nil {
+			return codes.Wrap(codes.BadConfig, err)
+		}
+		return t.StartDNSProxy(ip, port)
+	}
+	return codes.Errorf(codes.BadConfig, "no transport of %s stamps", st.Proto)
 }
 
-func (t *intratunnel) SetTunMode(dnsmode int, blockmode int, proxymode int) {
+// bootstrapDialer returns d, but for its names resolved by the plain dns
+// resolvers at `ips`, in turn, if any, as DNS stamps recommend.
+func bootstrapDialer(d *net.Dialer, ips []string) *net.Dialer {
+	if len(ips) == 0 {
+		return d
+	}
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	var next uint32
+	bd := *d
+	bd.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			ip := ips[int(atomic.AddUint32(&next, 1)-1)%len(ips)]
+			if _, _, err := net.SplitHostPort(ip); err != nil {
+				ip = net.JoinHostPort(strings.Trim(ip, "[]"), "53")
+			}
+			return d.DialContext(ctx, network, ip)
+		},
+	}
+	return &bd
+}
+
+func (t *intratunnel) SetTunMode(dnsmode int, blockmode int, proxymode int) error {
+	if err := t.allowMode(dnsmode); err != nil {
+		return err
+	}
 	t.tunmode.SetMode(dnsmode, blockmode, proxymode)
+	return nil
+}
+
+func (t *intratunnel) SetTrapDoT(on bool) {
+	t.tunmode.TrapDoT = on
+}
+
+func (t *intratunnel) Flows() string {
+	return t.flows.list()
+}
+
+func (t *intratunnel) CloseFlow(id int64) bool {
+	return t.flows.end(id)
+}
+
+func (t *intratunnel) CloseAppFlows(uid int) int {
+	return t.flows.endApp(uid)
+}
+
+func (t *intratunnel) SetFakeIPs(cidrs string) error {
+	var f *dnsx.FakeIPs
+	if len(cidrs) > 0 {
+		var err error
+		if f, err = dnsx.NewFakeIPs(cidrs); err != nil {
+			return err
+		}
+	}
+	t.tcp.SetFakeIPs(f)
+	t.udp.SetFakeIPs(f)
+	return nil
 }
 
 func (t *intratunnel) SetAlwaysSplitHTTPS(s bool) {
 	t.tcp.SetAlwaysSplitHTTPS(s)
 }
 
+func (t *intratunnel) SetSplitStrategy(offsets string, fragments int, helloOnly bool, delayms int, desyncTTL int, recordSizes string) error {
+	s, err := split.NewStrategy(offsets, fragments, helloOnly)
+	if err != nil {
+		return err
+	}
+	if err = s.SetDesync(time.Duration(delayms)*time.Millisecond, desyncTTL); err != nil {
+		return err
+	}
+	if err = s.SetRecordSizes(recordSizes); err != nil {
+		return err
+	}
+	t.tcp.SetSplitStrategy(s)
+	return nil
+}
+
+func (t *intratunnel) SetQuotas(q *quota.Quotas) {
+	t.tcp.SetQuotas(q)
+	t.udp.SetQuotas(q)
+}
+
+func (t *intratunnel) SetTarpit(tp *quota.Tarpit) {
+	t.tcp.SetTarpit(tp)
+	t.udp.SetTarpit(tp)
+}
+
+func (t *intratunnel) SetAppDNS(uid int, dns doh.Transport) error {
+	if dns == nil {
+		t.tcp.SetAppDNS(uid, nil)
+		t.udp.SetAppDNS(uid, nil)
+		return nil
+	}
+	if err := t.allowResolver(dns.GetURL()); err != nil {
+		return err
+	}
+	if dns != t.GetDNS() {
+		// truncated answers, as from the network's resolver over udp, are
+		// retried on the default transport
+		dns = dnsx.NewTruncationRetrier(dns, defaultDNS{t})
+	}
+	relaxed := t.prepare(dns)
+	t.tcp.SetAppDNS(uid, relaxed)
+	t.udp.SetAppDNS(uid, relaxed)
+	return nil
+}
+
+func (t *intratunnel) SetFirewall(f *firewall.Firewall) {
+	t.tcp.SetFirewall(f)
+	t.udp.SetFirewall(f)
+}
+
+func (t *intratunnel) SetConnectionOwner(o protect.ConnectionOwner) {
+	t.tcp.SetConnectionOwner(o)
+	t.udp.SetConnectionOwner(o)
+}
+
+func (t *intratunnel) SetProxyCredentials(c outbound.Credentials) {
+	t.creds.Set(c)
+}
+
+func (t *intratunnel) SetOutbounds(o *outbound.Outbounds) {
+	if o != nil {
+		o.SetDialer(t.dialer)
+	}
+	t.tcp.SetOutbounds(o)
+	t.udp.SetOutbounds(o)
+	t.lifecycle.forget()
+}
+
+func (t *intratunnel) SetLifecycleListener(l LifecycleListener) {
+	t.lifecycle.setListener(l)
+}
+
+func (t *intratunnel) SetMemoryLimit(bytes int64) {
+	b := memory.SetLimit(bytes)
+	t.budget = &b
+	for _, dns := range append(t.tcp.AppDNS(), t.GetDNS()) {
+		if dns != nil {
+			// transports without a cache have nothing to size
+			dnsx.SetCacheSize(dns, b.DNSCacheSize)
+		}
+	}
+	t.udp.setSessionCap(b.UDPSessions)
+	t.tcp.setRelayBuffer(b.RelayBuffer)
+}
+
+func (t *intratunnel) OnLowMemory() {
+	n := 0
+	for _, dns := range append(t.tcp.AppDNS(), t.GetDNS()) {
+		if dns != nil && dnsx.ClearCache(dns) == nil {
+			n++
+		}
+	}
+	memory.Release()
+	log.Infof("low memory: cleared %d dns caches", n)
+}
+
+func (t *intratunnel) SetKVStore(s kv.KVStore) {
+	t.kvstore = s
+	for _, dns := range append(t.tcp.AppDNS(), t.GetDNS()) {
+		if dns != nil {
+			doh.SetKVStore(dns, s)
+			dnsx.SetCacheStore(dns, s)
+		}
+	}
+	qlog.SetStore(s)
+	if c, ok := t.bravedns.(*dnsx.BlockCounter); ok {
+		c.SetStore(s)
+	}
+}
+
+func (t *intratunnel) DetectPortal(resolver doh.Transport) string {
+	return portal.Detect(t.dialer, resolver).JSON()
+}
+
+func (t *intratunnel) EnterPortalMode(domains string, resolver doh.Transport, seconds int) error {
+	if resolver == nil {
+		return codes.New(codes.NoDNS, "portal mode needs a resolver")
+	}
+	if err := t.allowResolver(resolver.GetURL()); err != nil {
+		return err
+	}
+	return t.portal.Enter(strings.Split(domains, ","), resolver, time.Duration(seconds)*time.Second)
+}
+
+func (t *intratunnel) ExitPortalMode() {
+	t.portal.Exit()
+}
+
+func (t *intratunnel) ClearSplitCache() {
+	t.tcp.ClearSplitCache()
+}
+
+func (t *intratunnel) OnNetworkChanged() {
+	t.ClearSplitCache()
+	transports := append(t.tcp.AppDNS(), t.GetDNS())
+	diag.Go(diag.DoH, func() {
+		seen := make(map[doh.Transport]bool)
+		for _, dns := range transports {
+			if dns == nil || seen[dns] {
+				continue
+			}
+			seen[dns] = true
+			// transports other than doh have no connections pooled
+			if err := doh.ResetNetwork(dns); err == nil {
+				log.Infof("reset doh %s for the network change", dns.GetURL())
+			}
+		}
+	})
+}
+
+func (t *intratunnel) Pause(seconds int, dnsFromCache bool) {
+	d := time.Duration(seconds) * time.Second
+	if t.pause.start(dnsFromCache, d, t.resumed) {
+		events.Publish(events.TunnelPaused, "tunnel", "")
+	}
+}
+
+func (t *intratunnel) Resume() {
+	if t.pause.stop() {
+		t.resumed()
+	}
+}
+
+func (t *intratunnel) resumed() {
+	events.Publish(events.TunnelResumed, "tunnel", "")
+}
+
+func (t *intratunnel) SetKillSwitch(on bool) {
+	t.killSwitch.set(on)
+}
+
+func (t *intratunnel) Usage(reset bool) string {
+	return t.meter.Snapshot(reset).JSON()
+}
+
+func (t *intratunnel) SetUsageListener(l usage.Listener, seconds int) {
+	t.meter.Report(l, time.Duration(seconds)*time.Second)
+}
+
+func (t *intratunnel) SetTCPTimeouts(keepaliveSecs int, idleSecs int) {
+	t.tcp.SetTimeouts(time.Duration(keepaliveSecs)*time.Second, time.Duration(idleSecs)*time.Second)
+}
+
+func (t *intratunnel) SetUDPNAT(timeoutSecs int, maxSessions int, evict int) error {
+	return t.udp.SetNAT(time.Duration(timeoutSecs)*time.Second, maxSessions, evict)
+}
+
+func (t *intratunnel) IsPaused() bool {
+	on, _ := t.pause.paused()
+	return on
+}
+
+func (t *intratunnel) SetDNSCoalescing(windowms int) {
+	t.coalescer.SetWindow(time.Duration(windowms) * time.Millisecond)
+}
+
+// Disconnect implements tunnel.Tunnel, and stops the capture in progress
+// and WireGuard.
+func (t *intratunnel) Disconnect() {
+	t.pause.stop()
+	t.meter.Report(nil, 0)
+	t.Tunnel.Disconnect()
+	t.StopCapture()
+	t.wireguard.swap(nil)
+	qlog.SaveStats()
+	if c, ok := t.bravedns.(*dnsx.BlockCounter); ok {
+		c.Save()
+	}
+	t.lifecycle.stop(StopDisconnected)
+}
+
+// Write implements tunnel.Tunnel, capturing packets from the TUN device.
+func (t *intratunnel) Write(data []byte) (int, error) {
+	t.capturing().Packet(data)
+	tunnel.ClampMSS(data, t.mtu)
+	n, err := t.Tunnel.Write(data)
+	if err != nil {
+		events.Publish(events.NetstackError, "netstack", err.Error())
+	}
+	return n, err
+}
+
+func (t *intratunnel) capturing() *tunnel.Capture {
+	return t.capture.Load().(*tunnel.Capture)
+}
+
+func (t *intratunnel) StartCapture(path string, maxBytes int64, files int, dnsOnly bool) error {
+	c, err := tunnel.NewCapture(path, maxBytes, files, dnsOnly)
+	if err != nil {
+		return err
+	}
+	return t.swapCapture(c)
+}
+
+func (t *intratunnel) StopCapture() error {
+	return t.swapCapture(nil)
+}
+
+// swapCapture replaces the capture in progress with c, and closes it.
+func (t *intratunnel) swapCapture(c *tunnel.Capture) error {
+	t.capmu.Lock()
+	prev := t.capturing()
+	t.capture.Store(c)
+	t.capmu.Unlock()
+	return prev.Close()
+}
+
+func (t *intratunnel) SetWireGuard(config string) error {
+	if len(config) == 0 {
+		return t.wireguard.swap(nil)
+	}
+	c, err := wg.ParseConfig(config)
+	if err != nil {
+		return err
+	}
+	var r *net.Resolver
+	if t.dialer != nil {
+		r = t.dialer.Resolver
+	}
+	d, err := wg.NewDevice(c, t.config, r)
+	if err != nil {
+		return err
+	}
+	return t.wireguard.swap(d)
+}
+
+func (t *intratunnel) WireGuardStatus() string {
+	if d := t.wireguard.device(); d != nil {
+		return d.Status()
+	}
+	return "[]"
+}
+
+func (t *intratunnel) LookupRDAP(query string) (string, error) {
+	dns := t.GetDNS()
+	if dns == nil {
+		return "", codes.New(codes.NoDNS, "no dns transport")
+	}
+	return rdap.NewClient(dns, t.tcp.Dial).Lookup(query)
+}
+
 func (t *intratunnel) StartDNSProxy(ip string, port string) (err error) {
 	d := settings.NewDNSOptions(ip, port)
+	if err = t.allowResolver(d.IPPort); err != nil {
+		return
+	}
 	if err = t.tcp.SetDNSOptions(d); err == nil {
 		t.udp.SetDNSOptions(d)
 	}
@@ -183,9 +992,16 @@ func (t *intratunnel) StartDNSCryptProxy(resolvers string, relays string, listen
 	var err error
 	bravedns := t.bravedns
 	if t.dnscrypt != nil {
-		return "", fmt.Errorf("only one instance of dns-crypt proxy allowed")
+		return "", codes.New(codes.DNSCryptBusy, "only one instance of dns-crypt proxy allowed")
+	}
+	if err = t.allowDNSCrypt(resolvers); err != nil {
+		return "", err
 	}
 	p := dnscrypt.NewProxy(listener)
+	p.SetDialer(t.dialer)
+	if t.queue >= 0 {
+		p.SetListenerQueue(t.queue)
+	}
 	if _, err = p.AddServers(resolvers); err == nil {
 		if len(relays) > 0 {
 			_, err = p.AddRoutes(relays)
@@ -202,13 +1018,43 @@ func (t *intratunnel) StartDNSCryptProxy(resolvers string, relays string, listen
 	return p.StartProxy()
 }
 
+// setDNSCrypt starts a DNSCrypt proxy for `resolvers` and `relays`, or, if one
+// is running, swaps them in place of its own, as it can't be stopped in the
+// DNSModeCrypt* modes.
+func (t *intratunnel) setDNSCrypt(resolvers string, relays string) error {
+	p := t.dnscrypt
+	if p == nil {
+		_, err := t.StartDNSCryptProxy(resolvers, relays, t.listener)
+		return err
+	}
+	if err := t.allowDNSCrypt(resolvers); err != nil {
+		return err
+	}
+	if _, err := p.ReplaceServers(resolvers); err != nil {
+		return err
+	}
+	p.ReplaceRoutes(relays)
+	return nil
+}
+
+// allowDNSCrypt errs unless the managed config, if any, allows all of
+// `resolvers`, a csv of name#stamp.
+func (t *intratunnel) allowDNSCrypt(resolvers string) error {
+	for _, r := range strings.Split(resolvers, ",") {
+		if err := t.allowResolver(r[strings.Index(r, "#")+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (t *intratunnel) StopDNSCryptProxy() error {
 	// TODO: implement this as a TunMode method?
 	if t.tunmode.DNSMode == settings.DNSModeCryptIP || t.tunmode.DNSMode == settings.DNSModeCryptPort {
-		return fmt.Errorf("dns-crypt-mode for the current session is active")
+		return codes.New(codes.DNSCryptBusy, "dns-crypt-mode for the current session is active")
 	}
 	if t.dnscrypt == nil {
-		return fmt.Errorf("no dns-crypt instance running")
+		return codes.New(codes.DNSCryptBusy, "no dns-crypt instance running")
 	}
 	err := t.dnscrypt.StopProxy()
 	t.udp.SetDNSCryptProxy(nil)
@@ -224,6 +1070,9 @@ func (t *intratunnel) GetDNSCryptProxy() *dnscrypt.Proxy {
 
 func (t *intratunnel) StartProxy(uname string, pwd string, ip string, port string) (err error) {
 	p := settings.NewAuthProxyOptions(uname, pwd, ip, port)
+	// failures of the previous proxy, if any, are no longer of interest
+	t.killSwitch.proxied(nil)
+	t.lifecycle.forget(upstreamProxy)
 	if err = t.tcp.SetProxyOptions(p); err != nil {
 		t.proxyOptions = nil
 		return
@@ -242,14 +1091,24 @@ func (t *intratunnel) GetProxyOptions() string {
 }
 
 func (t *intratunnel) SetBraveDNS(b dnsx.BraveDNS) error {
-	doh := t.dns
+	if err := t.enforceBlocklists(b); err != nil {
+		return err
+	}
+
+	doh := t.GetDNS()
 	dnscrypt := t.dnscrypt
 
 	t.bravedns = b
+	if c, ok := b.(*dnsx.BlockCounter); ok && t.kvstore != nil {
+		c.SetStore(t.kvstore)
+	}
 
 	if doh != nil {
 		doh.SetBraveDNS(b)
 	}
+	for _, dns := range t.tcp.AppDNS() {
+		dns.SetBraveDNS(b)
+	}
 	if dnscrypt != nil {
 		dnscrypt.SetBraveDNS(b)
 	}
@@ -260,3 +1119,104 @@ func (t *intratunnel) SetBraveDNS(b dnsx.BraveDNS) error {
 func (t *intratunnel) GetBraveDNS() dnsx.BraveDNS {
 	return t.bravedns
 }
+
+func (t *intratunnel) SetManagedConfig(m *settings.ManagedConfig) error {
+	prev := t.managed
+	if prev != nil && prev.Sealed() {
+		return codes.New(codes.Managed, "managed config sealed")
+	}
+	if m == nil {
+		t.managed = nil
+		return nil
+	}
+	t.managed = m
+	if err := t.allowMode(t.tunmode.DNSMode); err != nil {
+		// the DoH transport in-use is swapped for the locked one; other
+		// resolvers are left to the app, and m refused until then
+		if err = t.swapLockedResolver(m); err != nil {
+			t.managed = prev
+			return err
+		}
+	}
+	if err := t.enforceBlocklists(t.bravedns); err != nil {
+		t.managed = prev
+		return err
+	}
+	return nil
+}
+
+// swapLockedResolver sets a DoH transport to the resolver locked by m in place
+// of the one in-use, if the DNSMode is one of DoH.
+func (t *intratunnel) swapLockedResolver(m *settings.ManagedConfig) error {
+	if !dohMode(t.tunmode.DNSMode) {
+		return codes.Errorf(codes.Managed, "managed config: resolvers of dns mode %d not allowed", t.tunmode.DNSMode)
+	}
+	dns, err := t.NewDNSTransport(m.LockedResolver(), "")
+	if err != nil {
+		return codes.Wrap(codes.Managed, err)
+	}
+	return t.SetDNSTransport(dns)
+}
+
+// allowResolver errs unless the managed config, if any, allows `url`, as in
+// settings.ManagedConfig.LockResolver.
+func (t *intratunnel) allowResolver(url string) error {
+	if m := t.managed; m != nil && !m.AllowResolver(url) {
+		return codes.Errorf(codes.Managed, "managed config: resolver %s not allowed", url)
+	}
+	return nil
+}
+
+// allowMode errs unless the managed config, if any, allows the resolver, if
+// any, that DNSMode `dnsmode` sends queries to.
+func (t *intratunnel) allowMode(dnsmode int) error {
+	switch {
+	case dohMode(dnsmode):
+		if dns := t.GetDNS(); dns != nil {
+			return t.allowResolver(dns.GetURL())
+		}
+	case dnsmode == settings.DNSModeCryptIP || dnsmode == settings.DNSModeCryptPort:
+		if p := t.dnscrypt; p != nil {
+			for _, stamp := range p.Stamps() {
+				if err := t.allowResolver(stamp); err != nil {
+					return err
+				}
+			}
+		}
+	case dnsmode == settings.DNSModeProxyIP || dnsmode == settings.DNSModeProxyPort:
+		if d := t.dnsOptions; d != nil {
+			return t.allowResolver(d.IPPort)
+		}
+	}
+	return nil
+}
+
+// dohMode reports whether queries in DNSMode `dnsmode` go to DoH transports.
+func dohMode(dnsmode int) bool {
+	return dnsmode == settings.DNSModeIP || dnsmode == settings.DNSModePort
+}
+
+func (t *intratunnel) GetManagedConfig() *settings.ManagedConfig {
+	return t.managed
+}
+
+// enforceBlocklists locks b to the blocklists mandated by the managed config, if any.
+func (t *intratunnel) enforceBlocklists(b dnsx.BraveDNS) error {
+	m := t.managed
+	if m == nil {
+		return nil
+	}
+	stamp := m.LockedBlocklists()
+	if len(stamp) <= 0 {
+		return nil
+	}
+	if b == nil {
+		m.Audit("denied blocklists removal")
+		return codes.New(codes.Managed, "managed config: blocklists cannot be disabled")
+	}
+	if err := b.LockStamp(stamp); err != nil {
+		m.Audit("denied blocklists change")
+		return err
+	}
+	return nil
+}
@@ -30,7 +30,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/proxy"
@@ -38,54 +40,155 @@ import (
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 
+	"github.com/celzero/firestack/intra/codes"
+	"github.com/celzero/firestack/intra/diag"
 	"github.com/celzero/firestack/intra/dnscrypt"
+	"github.com/celzero/firestack/intra/dnsx"
 	"github.com/celzero/firestack/intra/doh"
+	"github.com/celzero/firestack/intra/faults"
+	"github.com/celzero/firestack/intra/firewall"
+	"github.com/celzero/firestack/intra/metrics"
+	"github.com/celzero/firestack/intra/outbound"
 	"github.com/celzero/firestack/intra/protect"
+	"github.com/celzero/firestack/intra/quota"
+	"github.com/celzero/firestack/intra/schema"
 	"github.com/celzero/firestack/intra/settings"
+	"github.com/celzero/firestack/intra/throttle"
+	"github.com/celzero/firestack/intra/trace"
+	"github.com/celzero/firestack/intra/usage"
 )
 
-// UDPSocketSummary describes a non-DNS UDP association, reported when it is discarded.
+// UDPSocketSummary describes a UDP association, reported when it is discarded.
 type UDPSocketSummary struct {
+	Version       int   // Schema version, schema.UDPSummary
 	UploadBytes   int64 // Amount uploaded (bytes)
 	DownloadBytes int64 // Amount downloaded (bytes)
 	Duration      int32 // How long the socket was open (seconds)
+	// Since schema.UDPSummary 2
+	Source  string // The app's address, ip:port.
+	Target  string // The address the app sent to, ip:port, if known.
+	UID     int    // The app that owned the socket, or -1 if unknown.
+	Route   string // How the socket was routed, one of the Route* constants.
+	Blocked bool   // Whether the socket was firewalled.
+	// Since schema.UDPSummary 3
+	// Domain is the name of the fake ip the app sent to, or else the csv of
+	// names its target was answered for, by any resolver, if known.
+	Domain string
 }
 
-// UDPListener is notified when a non-DNS UDP association is discarded.
+// Field returns the named field of s as a string, or "" if s has no such
+// field; see schema.Field.
+func (s *UDPSocketSummary) Field(name string) string {
+	return schema.Field(s, name)
+}
+
+// UDPListener is notified when a UDP association is discarded, or firewalled.
 type UDPListener interface {
 	OnUDPSocketClosed(*UDPSocketSummary)
 }
 
 type tracker struct {
+	// unix nanos of the last packet, accessed atomically; first, to be
+	// 64-bit aligned on 32-bit platforms
+	last     int64
 	conn     interface{} // net.Conn and net.PacketConn
 	start    time.Time
-	upload   int64        // Non-DNS upload bytes
-	download int64        // Non-DNS download bytes
-	ip       *net.UDPAddr // masked addr
+	upload   int64            // Non-DNS upload bytes
+	download int64            // Non-DNS download bytes
+	ip       *net.UDPAddr     // masked addr
+	sub      string           // subsystem conn is accounted against
+	uid      int              // app conn belongs to, if known, or -1
+	source   string           // app's addr
+	target   string           // addr the app first sent to, if known
+	domain   string           // names of target, if known
+	route    string           // how conn is routed, a Route* constant
+	up       *throttle.Bucket // limits bytes sent, if not nil
+	down     *throttle.Bucket // limits bytes received, if not nil
+	cone     bool             // whether answers are from where conn reports, any host, as in full-cone nat
+	flow     *flow            // of conn in the flow table
+	quotas   *quota.Quotas    // conn was opened against, and is closed against
 }
 
 func makeTracker(conn interface{}) *tracker {
-	return &tracker{conn, time.Now(), 0, 0, nil}
+	now := time.Now()
+	return &tracker{
+		last:  now.UnixNano(),
+		conn:  conn,
+		start: now,
+		sub:   diag.Tunnel,
+		uid:   -1,
+		route: RouteDirect,
+	}
+}
+
+// touch notes a packet on t's association.
+func (t *tracker) touch() {
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+// summary returns the summary of t's association, as it is discarded.
+func (t *tracker) summary() *UDPSocketSummary {
+	return &UDPSocketSummary{
+		Version:       schema.UDPSummary,
+		UploadBytes:   t.upload,
+		DownloadBytes: t.download,
+		Duration:      int32(time.Since(t.start).Seconds()),
+		Source:        t.source,
+		Target:        t.target,
+		UID:           t.uid,
+		Route:         t.route,
+		Domain:        t.domain,
+	}
 }
 
 // UDPHandler adds DOH support to the base UDPConnHandler interface.
 type UDPHandler interface {
 	core.UDPConnHandler
 	SetDNS(dns doh.Transport)
-	blockConn(localudp core.UDPConn, target *net.UDPAddr) bool
+	setPause(*pause)
+	setKillSwitch(*killSwitch)
+	setMeter(*usage.Meter)
+	setFlows(*flows)
+	setWireGuard(*wireguard)
+	setSessionCap(max int)
+	blockConn(localudp core.UDPConn, target *net.UDPAddr, uid int) bool
 	SetDNSCryptProxy(*dnscrypt.Proxy)
 	SetProxyOptions(*settings.ProxyOptions) error
 	SetDNSOptions(*settings.DNSOptions) error
+	SetQuotas(*quota.Quotas)
+	SetTarpit(*quota.Tarpit)
+	SetAppDNS(uid int, dns doh.Transport)
+	SetFirewall(*firewall.Firewall)
+	SetFakeIPs(*dnsx.FakeIPs)
+	SetConnectionOwner(protect.ConnectionOwner)
+	SetOutbounds(*outbound.Outbounds)
+	SetNAT(timeout time.Duration, max int, evict int) error
 }
 
+// Policies on which UDP association to evict, once there are as many as
+// the most allowed, for a new one.
+const (
+	// EvictIdlest evicts the association with the longest since a packet.
+	EvictIdlest = 0
+	// EvictOldest evicts the association made first.
+	EvictOldest = 1
+	// EvictNone evicts none, and refuses new associations instead.
+	EvictNone = 2
+)
+
 type udpHandler struct {
 	UDPHandler
 	sync.RWMutex
 
 	timeout  time.Duration
+	maxConns int // most associations in udpConns, or 0 for no limit
+	capConns int // most associations the memory budget allows, or 0 for no limit
+	evict    int // an Evict* policy, for when udpConns is full
+	pending  int // associations admitted, but not yet in udpConns
 	udpConns map[core.UDPConn]*tracker
 	fakedns  net.UDPAddr
 	dns      doh.Transport
+	apps     doh.Apps
 	config   *net.ListenConfig
 	blocker  protect.Blocker
 	tunMode  *settings.TunMode
@@ -93,6 +196,17 @@ type udpHandler struct {
 	dnscrypt *dnscrypt.Proxy
 	dnsproxy *net.UDPAddr
 	proxy    proxy.Dialer
+	quotas   *quota.Quotas
+	tarpit   *quota.Tarpit
+	fw       *firewall.Firewall
+	fakes    *dnsx.FakeIPs
+	owner    protect.ConnectionOwner
+	wg       *wireguard
+	obs      *outbound.Outbounds
+	pause    *pause
+	kill     *killSwitch
+	meter    *usage.Meter
+	flows    *flows
 }
 
 // NewUDPHandler makes a UDP handler with Intra-style DNS redirection:
@@ -116,10 +230,12 @@ func NewUDPHandler(fakedns net.UDPAddr, timeout time.Duration, blocker protect.B
 
 func (h *udpHandler) fetchUDPInput(conn core.UDPConn, t *tracker) {
 	buf := core.NewBytes(core.BufSize)
+	diag.BufferTaken(diag.Tunnel)
 
 	defer func() {
 		h.Close(conn)
 		core.FreeBytes(buf)
+		diag.BufferReturned(diag.Tunnel)
 	}()
 
 	for {
@@ -133,11 +249,11 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, t *tracker) {
 		case net.PacketConn:
 			// reads a packet from t.conn copying it to buf
 			n, addr, err = c.ReadFrom(buf)
-			c.SetDeadline(time.Now().Add(h.timeout))
+			c.SetDeadline(time.Now().Add(h.natTimeout()))
 		case net.Conn:
 			// c is already dialed-in to some addr in udpHandler.Connect
 			n, err = c.Read(buf)
-			c.SetDeadline(time.Now().Add(h.timeout))
+			c.SetDeadline(time.Now().Add(h.natTimeout()))
 		default:
 			err = errors.New("failed to read from proxy udp conn")
 		}
@@ -146,15 +262,31 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, t *tracker) {
 			return
 		}
 
+		if faults.DropPacket() {
+			continue
+		}
+
 		var udpaddr *net.UDPAddr
-		if t.ip == nil && addr != nil {
+		if t.cone && addr != nil {
+			udpaddr = answerAddr(addr, t.ip)
+		} else if t.ip == nil && addr != nil {
 			udpaddr = addr.(*net.UDPAddr)
 		} else {
 			// overwrite source-addr as set in t.ip
 			udpaddr = t.ip
 		}
 
+		// answers of resolvers other than the tunnel's own, to apps that
+		// send dns elsewhere, tell the domains of their later flows, too
+		if udpaddr.Port == 53 {
+			h.firewall().Observe(buf[:n])
+		}
+
 		t.download += int64(n)
+		t.touch()
+		t.flow.count(0, int64(n))
+		h.meter.Add(t.uid, "udp", udpaddr.String(), 0, int64(n))
+		t.down.Wait(n)
 		// writes data to conn (tun) with addr as source
 		_, err = conn.WriteFrom(buf[:n], udpaddr)
 		if err != nil {
@@ -164,27 +296,65 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, t *tracker) {
 	}
 }
 
-func (h *udpHandler) blockConn(localudp core.UDPConn, target *net.UDPAddr) (block bool) {
+// answerAddr returns addr, as reported by a conn that may not use
+// *net.UDPAddr, like shadowsocks', or def if addr isn't a specified ip:port
+// of the same family as def, which the app can't be answered from.
+func answerAddr(addr net.Addr, def *net.UDPAddr) *net.UDPAddr {
+	if addr == nil {
+		return def
+	}
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		host, port, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return def
+		}
+		ip := net.ParseIP(host)
+		p, err := strconv.Atoi(port)
+		if ip == nil || err != nil {
+			return def
+		}
+		a = &net.UDPAddr{IP: ip, Port: p}
+	}
+	if a == nil || a.IP == nil || a.IP.IsUnspecified() {
+		return def
+	}
+	if def != nil && (a.IP.To4() == nil) != (def.IP.To4() == nil) {
+		return def
+	}
+	return a
+}
+
+func (h *udpHandler) blockConn(localudp core.UDPConn, target *net.UDPAddr, owner int) (block bool) {
 	// BlockModeNone returns false, BlockModeSink returns true
 	if h.tunMode.BlockMode == settings.BlockModeSink {
 		return true
 	}
+	localaddr := localudp.LocalAddr() //.(*net.UDPAddr)
+
+	// firewall rules apply in all other block modes
+	if target != nil {
+		switch h.firewall().Verdict(firewall.UDP, owner, target.IP, target.Port) {
+		case firewall.Deny:
+			log.Infof("firewall rule denied udp connection from %s to %s", localaddr.String(), target.String())
+			return true
+		case firewall.Allow:
+			return false
+		}
+	}
+
 	if h.tunMode.BlockMode == settings.BlockModeNone {
 		return false
 	}
 	// Implict: BlockModeFilter or BlockModeFilterProc
-	localaddr := localudp.LocalAddr() //.(*net.UDPAddr)
-	return h.blockConnAddr(localaddr, target)
+	return h.blockConnAddr(localaddr, target, owner)
 }
 
-func (h *udpHandler) blockConnAddr(source *net.UDPAddr, target *net.UDPAddr) (block bool) {
+func (h *udpHandler) blockConnAddr(source *net.UDPAddr, target *net.UDPAddr, owner int) (block bool) {
 
 	uid := -1
 	if h.tunMode.BlockMode == settings.BlockModeFilterProc {
-		procEntry := settings.FindProcNetEntry("udp", source.IP, source.Port, target.IP, target.Port)
-		if procEntry != nil {
-			uid = procEntry.UserID
-		}
+		uid = owner
 	}
 
 	block = h.blocker.Block(17 /*UDP*/, uid, source.String(), target.String())
@@ -196,47 +366,212 @@ func (h *udpHandler) blockConnAddr(source *net.UDPAddr, target *net.UDPAddr) (bl
 	return block
 }
 
+// uid returns the app that owns the source to target association, or -1.
+func (h *udpHandler) uid(source *net.UDPAddr, target *net.UDPAddr) int {
+	return ownerUID(h.connectionOwner(), firewall.UDP, source.IP, source.Port, target.IP, target.Port)
+}
+
+// admitQuery reports whether t's app may send another dns query, and
+// if not, answers the query, q, with a servfail on conn.  Queries over
+// the tarpit's rate are held back before admitQuery returns.
+func (h *udpHandler) admitQuery(t *tracker, conn core.UDPConn, q []byte) bool {
+	if h.quota().Query(t.uid) {
+		h.dnsTarpit().Wait(t.uid)
+		return true
+	}
+	log.Warnf("dns query over quota for uid %d", t.uid)
+	if resp, err := doh.Servfail(q); err == nil {
+		conn.WriteFrom(resp, t.ip)
+	}
+	return false
+}
+
 // Connect connects the proxy server. Note that target can be nil.
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
-	if h.blockConn(conn, target) {
+	source := conn.LocalAddr()
+	dst := ""
+	uid := -1
+	if target != nil {
+		dst = target.String()
+		// the owner is needed to apply firewall rules, quotas and per-app dns,
+		// and to summarize
+		uid = h.uid(source, target)
+	}
+
+	if on, cacheOnly := h.pause.paused(); on && (target == nil || !(cacheOnly && h.isDoh(target))) {
+		h.listener.OnUDPSocketClosed(&UDPSocketSummary{
+			Version: schema.UDPSummary,
+			Source:  source.String(),
+			Target:  dst,
+			UID:     uid,
+			Route:   RoutePaused,
+			Blocked: true,
+		})
+		return codes.New(codes.Paused, "udp connection paused")
+	}
+
+	// flows to fake ips are for the names they were handed out for, and are
+	// answered from the fake ips
+	var fakeip *net.UDPAddr
+	domain := ""
+	if fakes := h.fakeIPs(); target != nil && fakes.Contains(target.IP) {
+		real := fakes.Real(target.IP)
+		if real == nil {
+			// handed out before a restart, or since afresh; the app must ask again
+			return codes.Errorf(codes.UnknownFakeIP, "udp connection to unknown fake ip %s", target.IP)
+		}
+		domain = fakes.Name(target.IP)
+		h.firewall().Note(real, domain)
+		fakeip = target
+		target = &net.UDPAddr{IP: real, Port: target.Port}
+	} else if target != nil {
+		domain = h.firewall().Names(target.IP.String())
+	}
+
+	if h.blockConn(conn, target, uid) {
+		h.listener.OnUDPSocketClosed(&UDPSocketSummary{
+			Version: schema.UDPSummary,
+			Source:  source.String(),
+			Target:  dst,
+			UID:     uid,
+			Route:   RouteFirewalled,
+			Blocked: true,
+			Domain:  domain,
+		})
 		// an error here results in a core.udpConn.Close
-		return fmt.Errorf("udp connection firewalled")
+		return codes.New(codes.Firewalled, "udp connection firewalled")
 	}
 
-	proxymode := h.hasProxy() && (h.socks5Proxy() || h.httpsProxy())
+	if target != nil && h.tunMode.RefusesDoT(target.Port) {
+		h.listener.OnUDPSocketClosed(&UDPSocketSummary{
+			Version: schema.UDPSummary,
+			Source:  source.String(),
+			Target:  dst,
+			UID:     uid,
+			Route:   RouteTrapped,
+			Blocked: true,
+		})
+		return codes.New(codes.Trapped, "udp dns-over-quic connection refused")
+	}
+
+	quotas := h.quota()
+	if target != nil {
+		trace.Flow(target.IP.String(), "udp "+dst)
+	}
+	if !quotas.Open(uid) {
+		return codes.New(codes.OverQuota, "udp connection over quota")
+	}
+
+	route := ""
+	var via outbound.Outbound
+	if target != nil {
+		route = h.firewall().Outbound(firewall.UDP, uid, target.IP, target.Port)
+		if via = h.wg.via(route, target.IP, target.Port); via != nil {
+			route = outbound.WireGuard
+		}
+	}
+	if via == nil && len(route) > 0 && route != outbound.Direct {
+		// flows routed to missing outbounds fail, rather than leak
+		if via = h.outbounds().Get(route); via == nil {
+			quotas.Close(uid, 0)
+			return codes.Errorf(codes.NoOutbound, "udp connection routed to missing outbound %s", route)
+		}
+	}
+	proxymode := h.hasProxy() && (h.socks5Proxy() || h.httpsProxy()) && route != outbound.Direct
+	isdns := target != nil && (h.isDoh(target) || h.isDNSCrypt(target, nil) || h.isDNSProxy(target))
+	if !isdns && !h.kill.allow(proxymode && via == nil) {
+		quotas.Close(uid, 0)
+		h.listener.OnUDPSocketClosed(&UDPSocketSummary{
+			Version: schema.UDPSummary,
+			Source:  source.String(),
+			Target:  dst,
+			UID:     uid,
+			Route:   RouteKilled,
+			Blocked: true,
+		})
+		return codes.New(codes.Killed, "udp connection dropped by the kill switch")
+	}
+
+	if !h.admit() {
+		quotas.Close(uid, 0)
+		return codes.New(codes.NATFull, "udp nat table full")
+	}
 
 	var c interface{}
 	var err error
-	if proxymode {
+	if via != nil {
+		c, err = via.ListenUDP()
+	} else if proxymode {
 		// deprecated: https://github.com/golang/go/issues/25104
 		// FIXME: target can be nil: What happens then?
-		c, err = h.proxy.Dial(target.Network(), target.String())
+		if err = faults.ProxyFailure(); err == nil {
+			c, err = h.proxy.Dial(target.Network(), target.String())
+		}
+		h.kill.proxied(err)
 	} else {
 		bindAddr := &net.UDPAddr{IP: nil, Port: 0}
 		c, err = h.config.ListenPacket(context.TODO(), bindAddr.Network(), bindAddr.String())
 	}
 
 	if err != nil {
-		log.Errorf("failed to bind udp addr %s %w", target.String(), err)
+		h.unreserve()
+		quotas.Close(uid, 0)
+		log.Errorf("failed to bind udp addr %s %v", target.String(), err)
 		return err
 	}
 
 	t := makeTracker(c)
+	t.uid = uid
+	t.quotas = quotas
+	t.source = source.String()
+	t.target = dst
+	t.domain = domain
+	if target != nil {
+		t.up, t.down = h.firewall().Limit(firewall.UDP, uid, target.IP, target.Port)
+	}
 
-	if proxymode {
+	if via != nil {
+		// answers are from whichever host via reports, so that hosts other
+		// than target, as with stun, may reach the app through the same
+		// mapping; or from target, for hosts that can't be told apart
 		t.ip = target
+		t.cone = true
+		t.sub = diag.Proxy
+		t.route = RouteProxy + ":" + route
+	} else if proxymode {
+		t.ip = target
+		t.cone = true
+		t.sub = diag.Proxy
+		t.route = RouteProxy
+	}
+	if fakeip != nil {
+		t.ip = fakeip
+		t.cone = false
 	}
+	diag.SocketOpened(t.sub)
+	t.flow = h.flows.add("udp", t.source, t.target, uid, t.route, func() {
+		h.Close(conn)
+	})
 
 	h.Lock()
 	h.udpConns[conn] = t
+	h.pending--
 	h.Unlock()
-	go h.fetchUDPInput(conn, t)
+	diag.Go(diag.Tunnel, func() {
+		h.fetchUDPInput(conn, t)
+	})
 	log.Infof("new udp proxy (mode: %s) conn to target: %s", proxymode, target.String())
 	return nil
 }
 
 func (h *udpHandler) doDoh(dns doh.Transport, t *tracker, conn core.UDPConn, data []byte) {
+	if !h.admitQuery(t, conn, data) {
+		return
+	}
 	resp, err := dns.Query(data)
+	if err == nil {
+		h.firewall().Observe(resp)
+	}
 
 	if resp != nil {
 		_, err = conn.WriteFrom(resp, t.ip)
@@ -255,10 +590,17 @@ func (h *udpHandler) doDoh(dns doh.Transport, t *tracker, conn core.UDPConn, dat
 }
 
 func (h *udpHandler) doDNSCrypt(p *dnscrypt.Proxy, t *tracker, conn core.UDPConn, data []byte) {
+	if !h.admitQuery(t, conn, data) {
+		return
+	}
+	tid := trace.StartQuery(data)
 	resp, err := dnscrypt.HandleUDP(p, data)
+	trace.Event(tid, trace.StageTransport, fmt.Sprintf("dnscrypt err=%v", err))
 	if err != nil || resp == nil {
 		log.Errorf("dns-crypt udp query failed: %v", err)
 	} else {
+		trace.Answer(tid, resp)
+		h.firewall().Observe(resp)
 		_, err = conn.WriteFrom(resp, t.ip)
 		if err != nil {
 			log.Errorf("dns-crypt udp query reply failed: %v", err)
@@ -275,8 +617,7 @@ func (h *udpHandler) isDNSProxy(addr *net.UDPAddr) bool {
 	if h.tunMode.DNSMode == settings.DNSModeProxyIP {
 		return addr.IP.Equal(h.fakedns.IP) && addr.Port == h.fakedns.Port
 	} else if h.tunMode.DNSMode == settings.DNSModeProxyPort {
-		// h.fakedns.Port always expected to be 53?
-		return addr.Port == h.fakedns.Port
+		return addr.Port == settings.DNSPort
 	}
 	return false
 }
@@ -285,8 +626,7 @@ func (h *udpHandler) isDoh(addr *net.UDPAddr) bool {
 	if h.tunMode.DNSMode == settings.DNSModeIP {
 		return addr.IP.Equal(h.fakedns.IP) && addr.Port == h.fakedns.Port
 	} else if h.tunMode.DNSMode == settings.DNSModePort {
-		// h.fakedns.Port always expected to be 53?
-		return addr.Port == h.fakedns.Port
+		return addr.Port == settings.DNSPort
 	}
 	return false
 }
@@ -295,8 +635,7 @@ func (h *udpHandler) isDNSCrypt(addr *net.UDPAddr, t *tracker) bool {
 	if h.tunMode.DNSMode == settings.DNSModeCryptIP {
 		return addr.IP.Equal(h.fakedns.IP) && addr.Port == h.fakedns.Port
 	} else if h.tunMode.DNSMode == settings.DNSModeCryptPort {
-		// h.fakedns.Port always expected to be 53?
-		return addr.Port == h.fakedns.Port
+		return addr.Port == settings.DNSPort
 	}
 	return false
 }
@@ -311,7 +650,10 @@ func (h *udpHandler) dnsOverride(dns doh.Transport, dcrypt *dnscrypt.Proxy,
 			return false
 		}
 		t.ip = addr
-		go h.doDoh(dns, t, conn, dataCopy)
+		t.route = RouteDNS
+		diag.Go(diag.DoH, func() {
+			h.doDoh(dns, t, conn, dataCopy)
+		})
 		return true
 	} else if h.isDNSCrypt(addr, t) {
 		if dcrypt == nil {
@@ -319,7 +661,10 @@ func (h *udpHandler) dnsOverride(dns doh.Transport, dcrypt *dnscrypt.Proxy,
 			return false
 		}
 		t.ip = addr
-		go h.doDNSCrypt(dcrypt, t, conn, dataCopy)
+		t.route = RouteDNS
+		diag.Go(diag.DNSCrypt, func() {
+			h.doDNSCrypt(dcrypt, t, conn, dataCopy)
+		})
 		return true
 	}
 	// assert h.tunMode.DNSMode == settings.DNSModeNone
@@ -338,29 +683,64 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 	if !ok1 {
 		return fmt.Errorf("connection %v->%v does not exists", conn.LocalAddr(), addr)
 	}
+	if appdns := h.apps.Get(t.uid); appdns != nil {
+		doh = appdns
+	}
+	fakes := h.fakeIPs()
+	doh = fakes.Faking(doh)
+	if on, cacheOnly := h.pause.paused(); on {
+		if !cacheOnly || !h.isDoh(addr) || doh == nil {
+			// held back while paused
+			return nil
+		}
+		doh = dnsx.CacheOnly(doh)
+	}
+
+	if faults.DropPacket() {
+		return nil
+	}
+
+	if fakes.Contains(addr.IP) {
+		real := fakes.Real(addr.IP)
+		if real == nil {
+			return nil
+		}
+		addr = &net.UDPAddr{IP: real, Port: addr.Port}
+	}
 
 	if h.isDNSProxy(addr) {
 		if dnsproxy == nil {
 			log.Errorf("dns proxy nil")
 		} else {
 			t.ip = addr
+			t.cone = false
+			t.route = RouteDNSProxy
 			addr = h.dnsproxy
 		}
 	} else if h.dnsOverride(doh, dcrypt, t, conn, addr, data) {
 		return nil
 	}
 
+	if !t.up.Allow(len(data)) {
+		// dropped over the rate limit, as a congested link would
+		return nil
+	}
+
 	t.upload += int64(len(data))
+	t.touch()
+	t.flow.count(int64(len(data)), 0)
+	h.meter.Add(t.uid, "udp", addr.String(), int64(len(data)), 0)
 
+	timeout := h.natTimeout()
 	switch c := t.conn.(type) {
 	case net.PacketConn:
 		// Update deadline.
-		c.SetDeadline(time.Now().Add(h.timeout))
+		c.SetDeadline(time.Now().Add(timeout))
 		// writes packet payload, data, to addr
 		_, err = c.WriteTo(data, addr)
 	case net.Conn:
 		// Update deadline.
-		c.SetDeadline(time.Now().Add(h.timeout))
+		c.SetDeadline(time.Now().Add(timeout))
 		// c is already dialed-in to some addr in udpHandler.Connect
 		_, err = c.Write(data)
 	default:
@@ -380,7 +760,11 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 
 	h.Lock()
 	defer h.Unlock()
+	h.closeLocked(conn)
+}
 
+// closeLocked releases the association of conn, if any; h must be locked.
+func (h *udpHandler) closeLocked(conn core.UDPConn) {
 	if t, ok := h.udpConns[conn]; ok {
 		switch c := t.conn.(type) {
 		case net.PacketConn:
@@ -389,19 +773,202 @@ func (h *udpHandler) Close(conn core.UDPConn) {
 			c.Close()
 		default:
 		}
+		diag.SocketClosed(t.sub)
+		t.quotas.Close(t.uid, t.upload+t.download)
+		metrics.Add(metrics.TunnelBytes, t.upload, "proto", "udp", "dir", "up")
+		metrics.Add(metrics.TunnelBytes, t.download, "proto", "udp", "dir", "down")
 		// TODO: Cancel any outstanding DoH queries.
-		duration := int32(time.Since(t.start).Seconds())
-		h.listener.OnUDPSocketClosed(&UDPSocketSummary{t.upload, t.download, duration})
+		h.listener.OnUDPSocketClosed(t.summary())
+		h.flows.remove(t.flow)
 		delete(h.udpConns, conn)
 	}
 }
 
+// admit reserves room for a new association, evicting one if need be, and
+// reports whether there is; the room is held till the association is added
+// to udpConns, or given up with unreserve.
+func (h *udpHandler) admit() bool {
+	h.Lock()
+	max := h.maxConns
+	if h.capConns > 0 && (max <= 0 || h.capConns < max) {
+		max = h.capConns
+	}
+	if max <= 0 || len(h.udpConns)+h.pending < max {
+		h.pending++
+		h.Unlock()
+		return true
+	}
+	var victim core.UDPConn
+	var oldest int64
+	if h.evict != EvictNone {
+		for conn, t := range h.udpConns {
+			since := t.start.UnixNano()
+			if h.evict == EvictIdlest {
+				since = atomic.LoadInt64(&t.last)
+			}
+			if victim == nil || since < oldest {
+				victim, oldest = conn, since
+			}
+		}
+	}
+	if victim == nil {
+		h.Unlock()
+		return false
+	}
+	h.closeLocked(victim)
+	h.pending++
+	h.Unlock()
+	log.Infof("udp nat table full, evicted %v", victim.LocalAddr())
+	victim.Close()
+	return true
+}
+
+// unreserve gives up the room reserved by admit.
+func (h *udpHandler) unreserve() {
+	h.Lock()
+	h.pending--
+	h.Unlock()
+}
+
+// validEvict reports whether evict is one of the Evict* policies.
+func validEvict(evict int) bool {
+	return evict == EvictIdlest || evict == EvictOldest || evict == EvictNone
+}
+
+// SetNAT sets how long associations last without a packet, `timeout`, and
+// the most associations, `max`, or 0 for no limit, past which another is
+// evicted by policy `evict`, an Evict* constant, for each new one.  Policies
+// that aren't Evict* constants are refused, and leave h as it is.
+func (h *udpHandler) SetNAT(timeout time.Duration, max int, evict int) error {
+	if !validEvict(evict) {
+		return codes.Errorf(codes.BadConfig, "unknown udp evict policy %d", evict)
+	}
+	h.Lock()
+	if timeout > 0 {
+		h.timeout = timeout
+	}
+	h.maxConns = max
+	h.evict = evict
+	h.Unlock()
+	return nil
+}
+
+func (h *udpHandler) natTimeout() time.Duration {
+	h.RLock()
+	defer h.RUnlock()
+	return h.timeout
+}
+
 func (h *udpHandler) SetDNS(dns doh.Transport) {
 	h.Lock()
 	h.dns = dns
 	h.Unlock()
 }
 
+func (h *udpHandler) SetQuotas(q *quota.Quotas) {
+	h.Lock()
+	h.quotas = q
+	h.Unlock()
+}
+
+func (h *udpHandler) quota() *quota.Quotas {
+	h.RLock()
+	defer h.RUnlock()
+	return h.quotas
+}
+
+func (h *udpHandler) SetAppDNS(uid int, dns doh.Transport) {
+	h.apps.Set(uid, dns)
+}
+
+func (h *udpHandler) SetFirewall(f *firewall.Firewall) {
+	h.Lock()
+	h.fw = f
+	h.Unlock()
+}
+
+func (h *udpHandler) firewall() *firewall.Firewall {
+	h.RLock()
+	defer h.RUnlock()
+	return h.fw
+}
+
+func (h *udpHandler) SetFakeIPs(f *dnsx.FakeIPs) {
+	h.Lock()
+	h.fakes = f
+	h.Unlock()
+}
+
+func (h *udpHandler) fakeIPs() *dnsx.FakeIPs {
+	h.RLock()
+	defer h.RUnlock()
+	return h.fakes
+}
+
+func (h *udpHandler) SetConnectionOwner(o protect.ConnectionOwner) {
+	h.Lock()
+	h.owner = o
+	h.Unlock()
+}
+
+func (h *udpHandler) connectionOwner() protect.ConnectionOwner {
+	h.RLock()
+	defer h.RUnlock()
+	return h.owner
+}
+
+func (h *udpHandler) setPause(p *pause) {
+	h.pause = p
+}
+
+func (h *udpHandler) setKillSwitch(k *killSwitch) {
+	h.kill = k
+}
+
+func (h *udpHandler) setMeter(m *usage.Meter) {
+	h.meter = m
+}
+
+func (h *udpHandler) setFlows(f *flows) {
+	h.flows = f
+}
+
+func (h *udpHandler) setWireGuard(w *wireguard) {
+	h.wg = w
+}
+
+// setSessionCap caps associations at `max`, or, if 0, leaves them to
+// SetNAT alone.
+func (h *udpHandler) setSessionCap(max int) {
+	h.Lock()
+	h.capConns = max
+	h.Unlock()
+}
+
+func (h *udpHandler) SetOutbounds(o *outbound.Outbounds) {
+	h.Lock()
+	h.obs = o
+	h.Unlock()
+}
+
+func (h *udpHandler) outbounds() *outbound.Outbounds {
+	h.RLock()
+	defer h.RUnlock()
+	return h.obs
+}
+
+func (h *udpHandler) SetTarpit(t *quota.Tarpit) {
+	h.Lock()
+	h.tarpit = t
+	h.Unlock()
+}
+
+func (h *udpHandler) dnsTarpit() *quota.Tarpit {
+	h.RLock()
+	defer h.RUnlock()
+	return h.tarpit
+}
+
 func (h *udpHandler) SetDNSCryptProxy(dcrypt *dnscrypt.Proxy) {
 	h.Lock()
 	h.dnscrypt = dcrypt
@@ -436,11 +1003,12 @@ func (h *udpHandler) SetProxyOptions(po *settings.ProxyOptions) error {
 		// x.net.proxy doesn't yet support udp
 		// https://github.com/golang/net/blob/62affa334/internal/socks/socks.go#L233
 		// fproxy, err = proxy.SOCKS5("udp", po.IPPort, po.Auth, proxy.Direct)
-		err = errors.New("udp not supported")
+		err = codes.New(codes.ProxyNoUDP, "udp not supported")
 	} else if h.httpsProxy() {
-		err = fmt.Errorf("http-proxy not supported")
+		// CONNECT carries tcp alone
+		err = codes.New(codes.ProxyNoUDP, "udp not supported")
 	} else {
-		err = errors.New("proxy mode not set")
+		err = codes.New(codes.ProxyUnsupported, "proxy mode not set")
 	}
 	if err != nil {
 		h.proxy = nil
@@ -0,0 +1,111 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/celzero/firestack/intra/codes"
+	"github.com/celzero/firestack/intra/diag"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// strAddr is a net.Addr of any string, like those of conns that don't
+// report *net.UDPAddr.
+type strAddr string
+
+func (a strAddr) Network() string { return "udp" }
+func (a strAddr) String() string  { return string(a) }
+
+func TestAnswerAddr(t *testing.T) {
+	def4 := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	def6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}
+	var nilUDP *net.UDPAddr
+	for _, c := range []struct {
+		name string
+		addr net.Addr
+		def  *net.UDPAddr
+		want string
+	}{
+		{"nil", nil, def4, def4.String()},
+		{"nil udp", nilUDP, def4, def4.String()},
+		{"udp", &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 3478}, def4, "198.51.100.7:3478"},
+		{"string", strAddr("198.51.100.7:3478"), def4, "198.51.100.7:3478"},
+		{"string v6", strAddr("[2001:db8::7]:3478"), def6, "[2001:db8::7]:3478"},
+		{"no default", strAddr("198.51.100.7:3478"), nil, "198.51.100.7:3478"},
+		{"v6 for v4", &net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 3478}, def4, def4.String()},
+		{"v4 for v6", strAddr("198.51.100.7:3478"), def6, def6.String()},
+		{"unspecified v4", &net.UDPAddr{IP: net.IPv4zero, Port: 3478}, def4, def4.String()},
+		{"unspecified v6", strAddr("[::]:3478"), def6, def6.String()},
+		{"no ip", &net.UDPAddr{Port: 3478}, def4, def4.String()},
+		{"hostname", strAddr("stun.example:3478"), def4, def4.String()},
+		{"no port", strAddr("198.51.100.7"), def4, def4.String()},
+		{"bad port", strAddr("198.51.100.7:stun"), def4, def4.String()},
+	} {
+		got := answerAddr(c.addr, c.def)
+		if got == nil || got.String() != c.want {
+			t.Errorf("%s: answerAddr(%v, %v) = %v, not %s", c.name, c.addr, c.def, got, c.want)
+		}
+	}
+}
+
+func TestAdmitReserves(t *testing.T) {
+	const max = 5
+	h := &udpHandler{udpConns: make(map[core.UDPConn]*tracker), maxConns: max, evict: EvictNone}
+	var admitted int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4*max; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h.admit() {
+				atomic.AddInt64(&admitted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if admitted != max {
+		t.Fatalf("%d admitted, not %d", admitted, max)
+	}
+	h.unreserve()
+	if !h.admit() {
+		t.Error("room given up not admitted")
+	}
+	if h.admit() {
+		t.Error("admitted past the max")
+	}
+}
+
+func TestSetNATEvict(t *testing.T) {
+	h := &udpHandler{evict: EvictOldest}
+	for _, evict := range []int{EvictIdlest, EvictOldest, EvictNone} {
+		if err := h.SetNAT(0, 1, evict); err != nil || h.evict != evict {
+			t.Errorf("evict %d: %v", evict, err)
+		}
+	}
+	for _, evict := range []int{-1, EvictNone + 1} {
+		if err := h.SetNAT(0, 2, evict); codes.Of(err) != codes.BadConfig {
+			t.Errorf("evict %d: %v", evict, err)
+		}
+		if h.evict != EvictNone || h.maxConns != 1 {
+			t.Errorf("evict %d set", evict)
+		}
+	}
+}
+
+func TestMakeTracker(t *testing.T) {
+	tr := makeTracker(nil)
+	if tr.last != tr.start.UnixNano() || tr.sub != diag.Tunnel || tr.uid != -1 || tr.route != RouteDirect {
+		t.Errorf("tracker %+v", tr)
+	}
+	if tr.ip != nil || tr.cone || tr.flow != nil || tr.quotas != nil {
+		t.Errorf("tracker %+v", tr)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package usage meters bytes sent (up) and received (down) through the
+// tunnel per app (uid), and per app and destination, as they flow, rather
+// than as connections close, for data-usage dashboards.
+package usage
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxDestinations is the most destinations metered per snapshot: bytes to
+// destinations past it are metered against their app's Other destination.
+const MaxDestinations = 4096
+
+// Other is the destination of bytes metered past MaxDestinations.
+const Other = "other"
+
+// Listener receives snapshots of bytes metered.
+type Listener interface {
+	// OnUsage is called with a Snapshot, as json.  It must not block.
+	OnUsage(snapshot string)
+}
+
+type counts struct {
+	up   int64
+	down int64
+}
+
+type dstKey struct {
+	uid   int
+	proto string
+	dst   string
+}
+
+// Meter counts bytes per app, and per app and destination.  A nil Meter
+// counts nothing.
+type Meter struct {
+	sync.Mutex
+	since time.Time
+	apps  map[int]*counts
+	dsts  map[dstKey]*counts
+	stop  chan struct{} // stops reports in progress, if any
+}
+
+// NewMeter returns a Meter with no bytes counted.
+func NewMeter() *Meter {
+	return &Meter{
+		since: time.Now(),
+		apps:  make(map[int]*counts),
+		dsts:  make(map[dstKey]*counts),
+	}
+}
+
+// Add counts `up` bytes sent, and `down` bytes received, by app `uid`, or -1
+// if unknown, over `proto` ("tcp", "udp") to `dst`, an ip:port.
+func (m *Meter) Add(uid int, proto string, dst string, up int64, down int64) {
+	if m == nil || (up == 0 && down == 0) {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	a := m.apps[uid]
+	if a == nil {
+		a = &counts{}
+		m.apps[uid] = a
+	}
+	a.up += up
+	a.down += down
+
+	k := dstKey{uid, proto, dst}
+	d := m.dsts[k]
+	if d == nil {
+		if len(m.dsts) >= MaxDestinations {
+			k.dst = Other
+			d = m.dsts[k]
+		}
+		if d == nil {
+			d = &counts{}
+			m.dsts[k] = d
+		}
+	}
+	d.up += up
+	d.down += down
+}
+
+// App is the bytes of an app in a Snapshot.
+type App struct {
+	UID  int   `json:"uid"`
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// Destination is the bytes of an app to a destination in a Snapshot.
+type Destination struct {
+	UID   int    `json:"uid"`
+	Proto string `json:"proto"`
+	Dst   string `json:"dst"`
+	Up    int64  `json:"up"`
+	Down  int64  `json:"down"`
+}
+
+// Snapshot is the bytes metered from Since to Until, in unix millis.  Apps
+// are sorted by uid, and destinations by most bytes first.
+type Snapshot struct {
+	Since        int64         `json:"since"`
+	Until        int64         `json:"until"`
+	Apps         []App         `json:"apps"`
+	Destinations []Destination `json:"destinations"`
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Snapshot returns the bytes counted since m was made, or last reset, and
+// starts counting afresh if `reset`.
+func (m *Meter) Snapshot(reset bool) *Snapshot {
+	s := &Snapshot{Apps: []App{}, Destinations: []Destination{}}
+	if m == nil {
+		return s
+	}
+	now := time.Now()
+	m.Lock()
+	s.Since, s.Until = millis(m.since), millis(now)
+	for uid, c := range m.apps {
+		s.Apps = append(s.Apps, App{uid, c.up, c.down})
+	}
+	for k, c := range m.dsts {
+		s.Destinations = append(s.Destinations, Destination{k.uid, k.proto, k.dst, c.up, c.down})
+	}
+	if reset {
+		m.since = now
+		m.apps = make(map[int]*counts)
+		m.dsts = make(map[dstKey]*counts)
+	}
+	m.Unlock()
+
+	sort.Slice(s.Apps, func(i, j int) bool {
+		return s.Apps[i].UID < s.Apps[j].UID
+	})
+	sort.Slice(s.Destinations, func(i, j int) bool {
+		a, b := s.Destinations[i], s.Destinations[j]
+		if a.Up+a.Down != b.Up+b.Down {
+			return a.Up+a.Down > b.Up+b.Down
+		}
+		return a.Dst < b.Dst
+	})
+	return s
+}
+
+// Report sends l a snapshot of the bytes counted since the previous one,
+// and resets the counts, `every` so often, till Report is called again.
+// A nil l, or an `every` of 0, stops reports.
+func (m *Meter) Report(l Listener, every time.Duration) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+	if l == nil || every <= 0 {
+		m.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	m.stop = stop
+	m.Unlock()
+
+	go func() {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				l.OnUsage(m.Snapshot(true).JSON())
+			}
+		}
+	}()
+}
+
+// JSON returns s as json.
+func (s *Snapshot) JSON() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
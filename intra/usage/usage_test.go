@@ -0,0 +1,80 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package usage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeter(t *testing.T) {
+	m := NewMeter()
+	m.Add(10010, "tcp", "192.0.2.1:443", 100, 1000)
+	m.Add(10010, "tcp", "192.0.2.1:443", 10, 0)
+	m.Add(10010, "udp", "192.0.2.2:53", 5, 50)
+	m.Add(-1, "tcp", "192.0.2.3:80", 1, 2)
+
+	s := m.Snapshot(false)
+	if len(s.Apps) != 2 || s.Apps[0] != (App{-1, 1, 2}) || s.Apps[1] != (App{10010, 115, 1050}) {
+		t.Errorf("Wrong apps %+v", s.Apps)
+	}
+	if len(s.Destinations) != 3 || s.Destinations[0] != (Destination{10010, "tcp", "192.0.2.1:443", 110, 1000}) {
+		t.Errorf("Wrong destinations %+v", s.Destinations)
+	}
+	if !strings.Contains(s.JSON(), `"uid":10010,"up":115,"down":1050`) {
+		t.Errorf("Wrong json %s", s.JSON())
+	}
+
+	m.Snapshot(true)
+	if s := m.Snapshot(false); len(s.Apps) != 0 || len(s.Destinations) != 0 {
+		t.Errorf("Counts not reset %+v", s)
+	}
+
+	var nilm *Meter
+	nilm.Add(1, "tcp", "192.0.2.1:443", 1, 1)
+	if s := nilm.Snapshot(true); len(s.Apps) != 0 {
+		t.Error("Nil meter should count nothing")
+	}
+}
+
+func TestMeterOther(t *testing.T) {
+	m := NewMeter()
+	for i := 0; i < MaxDestinations+10; i++ {
+		m.Add(10010, "udp", fmt.Sprintf("192.0.2.1:%d", i+1), 1, 0)
+	}
+	s := m.Snapshot(false)
+	if len(s.Destinations) != MaxDestinations+1 {
+		t.Fatalf("Wrong number of destinations %d", len(s.Destinations))
+	}
+	if d := s.Destinations[0]; d.Dst != Other || d.Up != 10 {
+		t.Errorf("Wrong other destination %+v", d)
+	}
+}
+
+type fakeListener chan string
+
+func (l fakeListener) OnUsage(s string) {
+	select {
+	case l <- s:
+	default:
+	}
+}
+
+func TestReport(t *testing.T) {
+	m := NewMeter()
+	l := make(fakeListener, 4)
+	m.Report(l, 10*time.Millisecond)
+	defer m.Report(nil, 0)
+	m.Add(10010, "tcp", "192.0.2.1:443", 3, 4)
+	for s := range l {
+		if strings.Contains(s, `"up":3,"down":4`) {
+			break
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package wg
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// bind is a conn.Bind over a udp socket listened on with a ListenConfig,
+// like the tunnel's, whose sockets are protected from the VPN.
+type bind struct {
+	lc *net.ListenConfig
+
+	mu sync.Mutex
+	uc *net.UDPConn
+}
+
+func newBind(lc *net.ListenConfig) *bind {
+	if lc == nil {
+		lc = &net.ListenConfig{}
+	}
+	return &bind{lc: lc}
+}
+
+// Open implements conn.Bind.
+func (b *bind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.uc != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+	pc, err := b.lc.ListenPacket(context.Background(), "udp", ":"+strconv.Itoa(int(port)))
+	if err != nil {
+		return nil, 0, err
+	}
+	uc, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, 0, net.UnknownNetworkError("udp")
+	}
+	b.uc = uc
+	return []conn.ReceiveFunc{receive(uc)}, uint16(uc.LocalAddr().(*net.UDPAddr).Port), nil
+}
+
+// receive returns a conn.ReceiveFunc of one packet at a time from uc.
+func receive(uc *net.UDPConn) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, ap, err := uc.ReadFromUDPAddrPort(packets[0])
+		if err != nil {
+			return 0, err
+		}
+		sizes[0] = n
+		eps[0] = &conn.StdNetEndpoint{AddrPort: netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())}
+		return 1, nil
+	}
+}
+
+// Close implements conn.Bind.
+func (b *bind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.uc == nil {
+		return nil
+	}
+	err := b.uc.Close()
+	b.uc = nil
+	return err
+}
+
+// SetMark implements conn.Bind; marks are left to the ListenConfig.
+func (b *bind) SetMark(mark uint32) error {
+	return nil
+}
+
+// Send implements conn.Bind.
+func (b *bind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	e, ok := ep.(*conn.StdNetEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	b.mu.Lock()
+	uc := b.uc
+	b.mu.Unlock()
+	if uc == nil {
+		return net.ErrClosed
+	}
+	for _, buf := range bufs {
+		if _, err := uc.WriteToUDPAddrPort(buf, e.AddrPort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseEndpoint implements conn.Bind, of ip:ports alone.
+func (b *bind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())}, nil
+}
+
+// BatchSize implements conn.Bind.
+func (b *bind) BatchSize() int {
+	return 1
+}
+
+// port returns the port b is open on, or 0 if it isn't.
+func (b *bind) port() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.uc == nil {
+		return 0
+	}
+	return b.uc.LocalAddr().(*net.UDPAddr).Port
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package wg
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// DefaultMTU is the MTU of the interface, unless configured otherwise.
+const DefaultMTU = 1420
+
+// key is a curve25519 private or public key, or a preshared key.
+type key [32]byte
+
+func parseKey(s string) (k key, err error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != len(k) {
+		return k, fmt.Errorf("bad key %q", s)
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+func (k key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+func (k key) isZero() bool {
+	var z key
+	return k == z
+}
+
+// public returns the public key of private key k.
+func (k key) public() (pub key) {
+	curve25519.ScalarBaseMult((*[32]byte)(&pub), (*[32]byte)(&k))
+	return
+}
+
+// GeneratePrivateKey returns a new base64 private key, like `wg genkey`.
+func GeneratePrivateKey() (string, error) {
+	var k key
+	if _, err := rand.Read(k[:]); err != nil {
+		return "", err
+	}
+	clamp(&k)
+	return k.String(), nil
+}
+
+// PublicKey returns the base64 public key of base64 private key `priv`,
+// like `wg pubkey`.
+func PublicKey(priv string) (string, error) {
+	k, err := parseKey(priv)
+	if err != nil {
+		return "", err
+	}
+	return k.public().String(), nil
+}
+
+func clamp(k *key) {
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+}
+
+// Peer is a [Peer] section of a config.
+type Peer struct {
+	PublicKey    key
+	PresharedKey key
+	Endpoint     string
+	AllowedIPs   []*net.IPNet
+	Keepalive    time.Duration
+}
+
+// Config is a WireGuard config, in the format of wg-quick(8).
+type Config struct {
+	PrivateKey key
+	Addresses  []net.IP
+	ListenPort int
+	MTU        int
+	DNS        []netip.Addr // resolves names dialed through the peers
+	Peers      []*Peer
+}
+
+// keys of wg-quick(8) that are meaningless here, and so are ignored.
+var ignored = map[string]bool{
+	"table":      true,
+	"preup":      true,
+	"postup":     true,
+	"predown":    true,
+	"postdown":   true,
+	"saveconfig": true,
+	"fwmark":     true,
+}
+
+// ParseConfig parses a wg-quick(8) config with an [Interface] and one
+// or more [Peer] sections.  DNS servers, if any, resolve the names dialed
+// through the peers, and search domains are ignored; the queries of apps
+// are left to the tunnel's own dns transports.
+func ParseConfig(s string) (*Config, error) {
+	c := &Config{MTU: DefaultMTU}
+	var p *Peer
+	section := ""
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		switch strings.ToLower(line) {
+		case "[interface]":
+			section = "interface"
+			continue
+		case "[peer]":
+			section = "peer"
+			p = &Peer{}
+			c.Peers = append(c.Peers, p)
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: not a key = value", n)
+		}
+		k := strings.ToLower(strings.TrimSpace(kv[0]))
+		v := strings.TrimSpace(kv[1])
+		var err error
+		switch section {
+		case "interface":
+			err = c.set(k, v)
+		case "peer":
+			err = p.set(k, v)
+		default:
+			err = fmt.Errorf("outside a section")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return c, c.validate()
+}
+
+func (c *Config) set(k, v string) (err error) {
+	switch k {
+	case "privatekey":
+		c.PrivateKey, err = parseKey(v)
+	case "address":
+		for _, a := range csv(v) {
+			ip, _, perr := net.ParseCIDR(a)
+			if perr != nil {
+				if ip = net.ParseIP(a); ip == nil {
+					return fmt.Errorf("bad address %q", a)
+				}
+			}
+			c.Addresses = append(c.Addresses, ip)
+		}
+	case "listenport":
+		c.ListenPort, err = strconv.Atoi(v)
+		if err != nil || c.ListenPort < 0 || c.ListenPort > 65535 {
+			return fmt.Errorf("bad port %q", v)
+		}
+	case "dns":
+		for _, a := range csv(v) {
+			// search domains are of no use to dials by name
+			if ip, perr := netip.ParseAddr(a); perr == nil {
+				c.DNS = append(c.DNS, ip.Unmap())
+			}
+		}
+	case "mtu":
+		c.MTU, err = strconv.Atoi(v)
+		if err != nil || c.MTU < 576 || c.MTU > 65535 {
+			return fmt.Errorf("bad mtu %q", v)
+		}
+	default:
+		if !ignored[k] {
+			return fmt.Errorf("unknown interface key %q", k)
+		}
+	}
+	return
+}
+
+func (p *Peer) set(k, v string) (err error) {
+	switch k {
+	case "publickey":
+		p.PublicKey, err = parseKey(v)
+	case "presharedkey":
+		p.PresharedKey, err = parseKey(v)
+	case "endpoint":
+		if _, _, err = net.SplitHostPort(v); err != nil {
+			return fmt.Errorf("bad endpoint %q", v)
+		}
+		p.Endpoint = v
+	case "allowedips":
+		for _, a := range csv(v) {
+			_, ipnet, perr := net.ParseCIDR(a)
+			if perr != nil {
+				return fmt.Errorf("bad allowed ip %q", a)
+			}
+			p.AllowedIPs = append(p.AllowedIPs, ipnet)
+		}
+	case "persistentkeepalive":
+		if v == "off" {
+			p.Keepalive = 0
+			return nil
+		}
+		secs, perr := strconv.Atoi(v)
+		if perr != nil || secs < 0 || secs > 65535 {
+			return fmt.Errorf("bad keepalive %q", v)
+		}
+		p.Keepalive = time.Duration(secs) * time.Second
+	default:
+		return fmt.Errorf("unknown peer key %q", k)
+	}
+	return
+}
+
+func (c *Config) validate() error {
+	if c.PrivateKey.isZero() {
+		return fmt.Errorf("no private key")
+	}
+	if len(c.Addresses) == 0 {
+		return fmt.Errorf("no address")
+	}
+	if len(c.Peers) == 0 {
+		return fmt.Errorf("no peers")
+	}
+	seen := make(map[key]bool)
+	for _, p := range c.Peers {
+		if p.PublicKey.isZero() {
+			return fmt.Errorf("peer without a public key")
+		}
+		if seen[p.PublicKey] {
+			return fmt.Errorf("duplicate peer %s", p.PublicKey)
+		}
+		seen[p.PublicKey] = true
+	}
+	return nil
+}
+
+func csv(s string) (out []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			out = append(out, v)
+		}
+	}
+	return
+}
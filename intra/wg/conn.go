@@ -0,0 +1,180 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package wg
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// maxDatagram is the largest udp payload read from the netstack.
+const maxDatagram = 65535
+
+var errNoFamily = errors.New("wg: no address of the family")
+
+// tcpConn is a tcp conn of the netstack that is a split.DuplexConn.
+type tcpConn struct {
+	*gonet.TCPConn
+}
+
+func (c *tcpConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.TCPConn, r)
+}
+
+type datagram struct {
+	b    []byte
+	from net.Addr
+	err  error
+}
+
+// udpConn is a net.PacketConn over a udp conn of the netstack per family,
+// each bound to the interface's Address of that family, if any.
+type udpConn struct {
+	v4, v6 *gonet.UDPConn
+	in     chan datagram
+	done   chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time // of reads
+}
+
+func newUDPConn(v4, v6 *gonet.UDPConn) *udpConn {
+	c := &udpConn{v4: v4, v6: v6, in: make(chan datagram), done: make(chan struct{})}
+	for _, pc := range c.conns() {
+		go c.pump(pc)
+	}
+	return c
+}
+
+func (c *udpConn) conns() (out []*gonet.UDPConn) {
+	for _, pc := range []*gonet.UDPConn{c.v4, c.v6} {
+		if pc != nil {
+			out = append(out, pc)
+		}
+	}
+	return
+}
+
+// pump reads datagrams from pc until it errs, or c is closed.
+func (c *udpConn) pump(pc *gonet.UDPConn) {
+	for {
+		b := make([]byte, maxDatagram)
+		n, from, err := pc.ReadFrom(b)
+		select {
+		case c.in <- datagram{b[:n], from, err}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *udpConn) readDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		dl := c.readDeadline()
+		var timeout <-chan time.Time
+		var t *time.Timer
+		if !dl.IsZero() {
+			t = time.NewTimer(time.Until(dl))
+			timeout = t.C
+		}
+		select {
+		case d := <-c.in:
+			if t != nil {
+				t.Stop()
+			}
+			return copy(b, d.b), d.from, d.err
+		case <-c.done:
+			if t != nil {
+				t.Stop()
+			}
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			// the deadline may since have been extended
+			if !c.readDeadline().After(dl) {
+				return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
+			}
+		}
+	}
+}
+
+// WriteTo implements net.PacketConn.
+func (c *udpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: net.InvalidAddrError("not a udp address")}
+	}
+	to := *ua
+	pc := c.v6
+	if ip4 := ua.IP.To4(); ip4 != nil {
+		to.IP, pc = ip4, c.v4
+	}
+	if pc == nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: errNoFamily}
+	}
+	return pc.WriteTo(b, &to)
+}
+
+// Close implements net.PacketConn.
+func (c *udpConn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		close(c.done)
+		err = nil
+		for _, pc := range c.conns() {
+			if cerr := pc.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// LocalAddr implements net.PacketConn, and is of the ipv4 conn, if any.
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.conns()[0].LocalAddr()
+}
+
+// SetDeadline implements net.PacketConn.
+func (c *udpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn.
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	for _, pc := range c.conns() {
+		if err := pc.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
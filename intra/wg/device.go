@@ -0,0 +1,334 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package wg carries tcp and udp flows over WireGuard peers, in userspace:
+// wireguard-go's device sends and receives over a udp socket of the tunnel,
+// and a gVisor netstack, at the interface's Address, terminates the flows
+// dialed through it.  Peers are routed to by their most specific AllowedIPs.
+package wg
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+
+	"github.com/celzero/firestack/intra/split"
+)
+
+const (
+	// Kind is the outbound.Outbound kind of a Device.
+	Kind           = "wg"
+	resolveTimeout = 5 * time.Second
+	dialTimeout    = 10 * time.Second
+)
+
+var errClosed = errors.New("wg: device closed")
+
+// Device carries flows to and from WireGuard peers.  It is an
+// outbound.Outbound: flows are dialed through its netstack, from the
+// interface's Address.
+type Device struct {
+	dev      *device.Device
+	net      *netstack.Net
+	bind     *bind
+	resolver *net.Resolver
+	dns      bool // whether names dialed are resolved over the peers
+	peers    []*Peer
+	addr4    netip.Addr // of the interface; invalid if it has none
+	addr6    netip.Addr
+
+	closeOnce sync.Once
+}
+
+// NewDevice starts a device with config c that sends and receives over a
+// udp socket listened on with lc, or directly if nil.  Peer endpoints are
+// resolved with r, or the default resolver if nil; names dialed, over the
+// peers, by the DNS servers of c alone.
+func NewDevice(c *Config, lc *net.ListenConfig, r *net.Resolver) (*Device, error) {
+	if c == nil {
+		return nil, errors.New("wg: missing config")
+	}
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	d := &Device{
+		bind:     newBind(lc),
+		resolver: r,
+		dns:      len(c.DNS) > 0,
+		peers:    c.Peers,
+	}
+	addrs := make([]netip.Addr, 0, len(c.Addresses))
+	for _, ip := range c.Addresses {
+		a, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return nil, fmt.Errorf("wg: bad address %s", ip)
+		}
+		a = a.Unmap()
+		if a.Is4() && !d.addr4.IsValid() {
+			d.addr4 = a
+		} else if a.Is6() && !d.addr6.IsValid() {
+			d.addr6 = a
+		}
+		addrs = append(addrs, a)
+	}
+	uapi, err := d.uapi(c)
+	if err != nil {
+		return nil, err
+	}
+	tun, tnet, err := netstack.CreateNetTUN(addrs, c.DNS, c.MTU)
+	if err != nil {
+		return nil, err
+	}
+	d.net = tnet
+	d.dev = device.NewDevice(tun, d.bind, &device.Logger{
+		Verbosef: func(f string, args ...interface{}) { log.Debugf("wg: "+f, args...) },
+		Errorf:   func(f string, args ...interface{}) { log.Warnf("wg: "+f, args...) },
+	})
+	if err = d.dev.IpcSet(uapi); err != nil {
+		d.dev.Close()
+		return nil, err
+	}
+	if err = d.dev.Up(); err != nil {
+		d.dev.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// uapi returns config c in wireguard-go's configuration protocol, with the
+// endpoints of peers resolved.
+func (d *Device) uapi(c *Config) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", hex.EncodeToString(c.PrivateKey[:]))
+	if c.ListenPort > 0 {
+		fmt.Fprintf(&b, "listen_port=%d\n", c.ListenPort)
+	}
+	b.WriteString("replace_peers=true\n")
+	for _, p := range c.Peers {
+		fmt.Fprintf(&b, "public_key=%s\n", hex.EncodeToString(p.PublicKey[:]))
+		if !p.PresharedKey.isZero() {
+			fmt.Fprintf(&b, "preshared_key=%s\n", hex.EncodeToString(p.PresharedKey[:]))
+		}
+		if len(p.Endpoint) > 0 {
+			ep, err := d.resolve(p.Endpoint)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "endpoint=%s\n", ep)
+		}
+		fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(p.Keepalive/time.Second))
+		b.WriteString("replace_allowed_ips=true\n")
+		for _, n := range p.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", n)
+		}
+	}
+	return b.String(), nil
+}
+
+// resolve returns the endpoint hostport with its host resolved to an ip,
+// with the resolver of d.
+func (d *Device) resolve(hostport string) (netip.AddrPort, error) {
+	host, port, ip, err := splitHostPort(hostport)
+	if err != nil || ip.IsValid() {
+		return netip.AddrPortFrom(ip, port), err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := d.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if len(ips) == 0 {
+		return netip.AddrPort{}, errors.New("wg: no ips for " + host)
+	}
+	return netip.AddrPortFrom(ips[0].Unmap(), port), nil
+}
+
+// lookup returns the dialed hostport with its host resolved to an ip of a
+// family of the interface, over the peers, so that names dialed through
+// them aren't leaked to the network.  Without DNS servers, hosts must be
+// ips.
+func (d *Device) lookup(ctx context.Context, hostport string) (netip.AddrPort, error) {
+	host, port, ip, err := splitHostPort(hostport)
+	if err != nil || ip.IsValid() {
+		return netip.AddrPortFrom(ip, port), err
+	}
+	if !d.dns {
+		return netip.AddrPort{}, errors.New("wg: no dns to resolve " + host)
+	}
+	addrs, err := d.net.LookupContextHost(ctx, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, a := range addrs {
+		if ip, err := netip.ParseAddr(a); err == nil {
+			if ip = ip.Unmap(); ip.Is4() && d.addr4.IsValid() || ip.Is6() && d.addr6.IsValid() {
+				return netip.AddrPortFrom(ip, port), nil
+			}
+		}
+	}
+	return netip.AddrPort{}, errors.New("wg: no routable ips for " + host)
+}
+
+// splitHostPort splits hostport into its host, port, and the host as an ip,
+// if it is one.
+func splitHostPort(hostport string) (host string, port uint16, ip netip.Addr, err error) {
+	host, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return
+	}
+	n, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return
+	}
+	port = uint16(n)
+	if a, perr := netip.ParseAddr(host); perr == nil {
+		ip = a.Unmap()
+	}
+	return
+}
+
+// Routes reports whether ip is in the AllowedIPs of any peer.
+func (d *Device) Routes(ip net.IP) bool {
+	for _, p := range d.peers {
+		for _, n := range p.AllowedIPs {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Kind implements outbound.Outbound.
+func (d *Device) Kind() string {
+	return Kind
+}
+
+// DialTCP implements outbound.Outbound; names are resolved over the peers,
+// by the DNS servers of the interface, if any, and not dialed otherwise.
+func (d *Device) DialTCP(addr string) (split.DuplexConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	ap, err := d.lookup(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := d.net.DialContextTCPAddrPort(ctx, ap)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpConn{c}, nil
+}
+
+// ListenUDP implements outbound.Outbound.  The conn sends from the
+// interface's Address of the family of each destination.
+func (d *Device) ListenUDP() (net.PacketConn, error) {
+	var v4, v6 *gonet.UDPConn
+	var err error
+	if d.addr4.IsValid() {
+		if v4, err = d.net.ListenUDPAddrPort(netip.AddrPortFrom(d.addr4, 0)); err != nil {
+			return nil, err
+		}
+	}
+	if d.addr6.IsValid() {
+		if v6, err = d.net.ListenUDPAddrPort(netip.AddrPortFrom(d.addr6, 0)); err != nil {
+			if v4 != nil {
+				v4.Close()
+			}
+			return nil, err
+		}
+	}
+	return newUDPConn(v4, v6), nil
+}
+
+// Close stops the device and closes its socket.
+func (d *Device) Close() (err error) {
+	err = errClosed
+	d.closeOnce.Do(func() {
+		d.dev.Close()
+		err = nil
+	})
+	return
+}
+
+type peerStatus struct {
+	PublicKey     string `json:"publickey"`
+	Endpoint      string `json:"endpoint,omitempty"`
+	LastHandshake int64  `json:"lasthandshake"` // unix millis, 0 if none
+	Rx            uint64 `json:"rx"`            // bytes
+	Tx            uint64 `json:"tx"`            // bytes
+}
+
+// Status returns a json array of the endpoint, latest handshake, and bytes
+// received and sent of each peer.
+func (d *Device) Status() string {
+	out := make([]peerStatus, 0, len(d.peers))
+	uapi, err := d.dev.IpcGet()
+	if err != nil {
+		log.Warnf("wg: status: %v", err)
+	}
+	var s *peerStatus
+	var secs, nsecs int64
+	done := func() {
+		if s == nil {
+			return
+		}
+		if secs > 0 || nsecs > 0 {
+			s.LastHandshake = secs*1000 + nsecs/int64(time.Millisecond)
+		}
+		out = append(out, *s)
+	}
+	sc := bufio.NewScanner(strings.NewReader(uapi))
+	for sc.Scan() {
+		kv := strings.SplitN(sc.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k, v := kv[0], kv[1]
+		if k == "public_key" {
+			done()
+			s, secs, nsecs = &peerStatus{}, 0, 0
+			if b, err := hex.DecodeString(v); err == nil {
+				s.PublicKey = base64.StdEncoding.EncodeToString(b)
+			}
+			continue
+		}
+		if s == nil {
+			continue
+		}
+		switch k {
+		case "endpoint":
+			s.Endpoint = v
+		case "last_handshake_time_sec":
+			secs, _ = strconv.ParseInt(v, 10, 64)
+		case "last_handshake_time_nsec":
+			nsecs, _ = strconv.ParseInt(v, 10, 64)
+		case "rx_bytes":
+			s.Rx, _ = strconv.ParseUint(v, 10, 64)
+		case "tx_bytes":
+			s.Tx, _ = strconv.ParseUint(v, 10, 64)
+		}
+	}
+	done()
+	b, _ := json.Marshal(out)
+	return string(b)
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package wg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newKey(t *testing.T) (priv, pub string) {
+	priv, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, err = PublicKey(priv); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestParseConfig(t *testing.T) {
+	priv, _ := newKey(t)
+	_, pub := newKey(t)
+	c, err := ParseConfig(fmt.Sprintf(`
+[Interface]
+PrivateKey = %s
+Address = 10.0.0.2/32, fd00::2/128
+DNS = 1.1.1.1, corp.example
+MTU = 1280
+
+[Peer]
+PublicKey = %s
+Endpoint = vpn.example.com:51820
+AllowedIPs = 0.0.0.0/0, ::/0
+PersistentKeepalive = 25
+`, priv, pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MTU != 1280 || len(c.Addresses) != 2 || len(c.DNS) != 1 || len(c.Peers) != 1 {
+		t.Fatalf("Wrong config %+v", c)
+	}
+	p := c.Peers[0]
+	if p.PublicKey.String() != pub || p.Endpoint != "vpn.example.com:51820" ||
+		len(p.AllowedIPs) != 2 || p.Keepalive != 25*time.Second {
+		t.Errorf("Wrong peer %+v", p)
+	}
+
+	for _, bad := range []string{
+		"",
+		"PrivateKey = " + priv,
+		"[Interface]\nPrivateKey = abc\nAddress = 10.0.0.2/32",
+		"[Interface]\nPrivateKey = " + priv + "\nAddress = 10.0.0.2/32",
+		"[Interface]\nPrivateKey = " + priv + "\nAddress = 10.0.0.2/32\nMystery = 1\n[Peer]\nPublicKey = " + pub,
+		"[Interface]\nPrivateKey = " + priv + "\nAddress = 10.0.0.2/32\n[Peer]\nPublicKey = " + pub + "\nAllowedIPs = 10.0.0.0",
+	} {
+		if _, err := ParseConfig(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func listen(t *testing.T) net.PacketConn {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// freePort returns a udp port of loopback that is likely free.
+func freePort(t *testing.T) int {
+	c := listen(t)
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestDevices(t *testing.T) {
+	privA, pubA := newKey(t)
+	privB, pubB := newKey(t)
+	portB := freePort(t)
+
+	ca, err := ParseConfig(fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = 10.0.0.1/32\nDNS = 10.0.0.2\n"+
+		"[Peer]\nPublicKey = %s\nEndpoint = 127.0.0.1:%d\nAllowedIPs = 10.0.0.0/24\n", privA, pubB, portB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := ParseConfig(fmt.Sprintf("[Interface]\nPrivateKey = %s\nAddress = 10.0.0.2/32\nListenPort = %d\n"+
+		"[Peer]\nPublicKey = %s\nAllowedIPs = 10.0.0.1/32\n", privB, portB, pubA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewDevice(ca, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewDevice(cb, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if a.Routes(net.ParseIP("8.8.8.8")) {
+		t.Error("Address outside AllowedIPs routed")
+	}
+	if !a.Routes(net.ParseIP("10.0.0.2")) {
+		t.Error("Address in AllowedIPs not routed")
+	}
+
+	// udp, answered from b's interface address back to a's
+	ub, err := b.net.ListenUDP(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ub.Close()
+	ua, err := a.ListenUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ua.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	ua.SetDeadline(deadline)
+	ub.SetDeadline(deadline)
+	if _, err := ua.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5000}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, from, err := ub.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || !from.(*net.UDPAddr).IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Wrong packet %q from %s", buf[:n], from)
+	}
+	if _, err := ub.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	n, from, err = ua.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" || from.String() != "10.0.0.2:5000" {
+		t.Errorf("Wrong packet %q from %s", buf[:n], from)
+	}
+
+	// tcp
+	l, err := b.net.ListenTCP(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	c, err := a.DialTCP("10.0.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(deadline)
+	if _, err := c.ReadFrom(strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	c.CloseWrite()
+	got, err := io.ReadAll(c)
+	if err != nil || !bytes.Equal(got, []byte("hello")) {
+		t.Errorf("Wrong echo %q %v", got, err)
+	}
+
+	if _, err := a.DialTCP("10.0.0.2:bad"); err == nil {
+		t.Error("Dialed a bad port")
+	}
+
+	// names, resolved over the peers by a's DNS, and not at all by b, which
+	// has none
+	ns, err := b.net.ListenUDP(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	go answer(ns, "echo.example.", net.IPv4(10, 0, 0, 2))
+	c, err = a.DialTCP("echo.example:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := b.DialTCP("echo.example:80"); err == nil {
+		t.Error("Dialed a name without dns")
+	}
+	if s := a.Status(); !strings.Contains(s, pubB) || !strings.Contains(s, `"lasthandshake":1`) {
+		t.Errorf("No handshake in status %s", s)
+	}
+	if err := a.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := a.Close(); err == nil {
+		t.Error("Closed twice")
+	}
+}
+
+// answer answers A queries for name, on c, with ip, and others with no
+// records, until c is closed.
+func answer(c net.PacketConn, name string, ip net.IP) {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q := new(dns.Msg)
+		if q.Unpack(buf[:n]) != nil || len(q.Question) != 1 {
+			continue
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if qq := q.Question[0]; qq.Name == name && qq.Qtype == dns.TypeA {
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   ip,
+			})
+		}
+		if b, err := r.Pack(); err == nil {
+			c.WriteTo(b, from)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intra
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/celzero/firestack/intra/outbound"
+	"github.com/celzero/firestack/intra/wg"
+)
+
+// wireguard holds the WireGuard device in-use, if any, that tcp and udp
+// flows are carried over.  A nil wireguard has no device.
+type wireguard struct {
+	mu sync.Mutex
+	v  atomic.Value // *wg.Device
+}
+
+func newWireGuard() *wireguard {
+	w := &wireguard{}
+	w.v.Store((*wg.Device)(nil))
+	return w
+}
+
+func (w *wireguard) device() *wg.Device {
+	if w == nil {
+		return nil
+	}
+	return w.v.Load().(*wg.Device)
+}
+
+// swap replaces the device in-use with d, and closes it.
+func (w *wireguard) swap(d *wg.Device) error {
+	w.mu.Lock()
+	prev := w.device()
+	w.v.Store(d)
+	w.mu.Unlock()
+	if prev == nil {
+		return nil
+	}
+	return prev.Close()
+}
+
+// via returns the device for a flow to ip:port that the firewall
+// routed to `route`: if route is outbound.WireGuard, or if there's no
+// route, and ip is in the AllowedIPs of its peers, but for dns; or nil.
+func (w *wireguard) via(route string, ip net.IP, port int) outbound.Outbound {
+	d := w.device()
+	if d == nil {
+		return nil
+	}
+	switch route {
+	case outbound.WireGuard:
+		return d
+	case "":
+		if port != 53 && d.Routes(ip) {
+			return d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package xbuf pools the byte slices that relays and query forwarding go
+// through, in a few size classes, so that each packet, query, or flow
+// doesn't allocate afresh; which, in memory-capped network extensions,
+// keeps the heap from growing on gc lag.
+package xbuf
+
+import "sync"
+
+// Size classes of pooled buffers.
+const (
+	// Small fits the first writes of flows, and ordinary dns messages.
+	Small = 2 * 1024
+	// Medium is the buffer io.Copy allocates, for relays.
+	Medium = 32 * 1024
+	// Large fits any dns message over tcp, and its length.
+	Large = 64*1024 + 2
+)
+
+var classes = [...]int{Small, Medium, Large}
+
+var pools [len(classes)]sync.Pool
+
+func init() {
+	for i := range pools {
+		size := classes[i]
+		pools[i].New = func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}
+	}
+}
+
+// Get returns a buffer of `n` bytes, from the pool of the smallest class
+// that fits n, or, if none does, allocated afresh.  Its contents are not
+// zeroed.  Return it with Put once done.
+func Get(n int) *[]byte {
+	for i, size := range classes {
+		if n <= size {
+			b := pools[i].Get().(*[]byte)
+			*b = (*b)[:n]
+			return b
+		}
+	}
+	b := make([]byte, n)
+	return &b
+}
+
+// Put returns `b`, of Get, to its pool; b mustn't be used after.  Buffers
+// not of a class are left to the gc.
+func Put(b *[]byte) {
+	if b == nil {
+		return
+	}
+	for i, size := range classes {
+		if cap(*b) == size {
+			*b = (*b)[:size]
+			pools[i].Put(b)
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package xbuf
+
+import "testing"
+
+func TestClasses(t *testing.T) {
+	for _, c := range []struct{ n, cap int }{
+		{0, Small},
+		{2, Small},
+		{Small, Small},
+		{Small + 1, Medium},
+		{Medium, Medium},
+		{Large, Large},
+		{Large + 1, Large + 1},
+	} {
+		b := Get(c.n)
+		if len(*b) != c.n || cap(*b) != c.cap {
+			t.Errorf("Get(%d): len %d cap %d, not cap %d", c.n, len(*b), cap(*b), c.cap)
+		}
+		Put(b)
+	}
+	Put(nil)
+}
+
+func TestReuse(t *testing.T) {
+	b := Get(10)
+	Put(b)
+	if c := Get(Small); len(*c) != Small {
+		t.Errorf("reused buffer of %d bytes", len(*c))
+	}
+}
+
+func BenchmarkGetPut(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Put(Get(Medium))
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package xdns
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Types of answers to blocked queries.
+const (
+	// BlockDefault answers as set by SetBlockResponse.
+	BlockDefault = 0
+	// BlockUnspecified answers A and AAAA queries with 0.0.0.0 and ::, and
+	// others with a HINFO record.
+	BlockUnspecified = 1
+	// BlockNXDomain answers with NXDOMAIN.
+	BlockNXDomain = 2
+	// BlockEmpty answers with NOERROR and no records.
+	BlockEmpty = 3
+	// BlockRefused answers with REFUSED.
+	BlockRefused = 4
+)
+
+var blockResponse int32 = BlockUnspecified
+
+// SetBlockResponse sets the type of answer to blocked queries that don't
+// ask for one of their own.
+func SetBlockResponse(kind int) error {
+	if kind <= BlockDefault || kind > BlockRefused {
+		return errors.New("unknown block response type")
+	}
+	atomic.StoreInt32(&blockResponse, int32(kind))
+	return nil
+}
+
+// BlockResponseName returns the name of the block response type kind, as
+// used in rules.
+func BlockResponseName(kind int) string {
+	switch kind {
+	case BlockUnspecified:
+		return "unspecified"
+	case BlockNXDomain:
+		return "nxdomain"
+	case BlockEmpty:
+		return "empty"
+	case BlockRefused:
+		return "refused"
+	}
+	return "default"
+}
+
+// BlockResponseType returns the block response type named `name`.
+func BlockResponseType(name string) (int, error) {
+	for kind := BlockDefault; kind <= BlockRefused; kind++ {
+		if strings.EqualFold(name, BlockResponseName(kind)) {
+			return kind, nil
+		}
+	}
+	return BlockDefault, errors.New("unknown block response " + name)
+}
+
+// BlockResponseOfType returns an answer of type kind to the blocked query q.
+func BlockResponseOfType(q []byte, kind int) (*dns.Msg, error) {
+	r := &dns.Msg{}
+	if err := r.Unpack(q); err != nil {
+		return r, err
+	}
+	return BlockedResponseFromMessage(r, kind)
+}
+
+// BlockedResponseFromMessage returns an answer of type kind to the blocked
+// query msg.
+func BlockedResponseFromMessage(msg *dns.Msg, kind int) (*dns.Msg, error) {
+	if kind == BlockDefault {
+		kind = int(atomic.LoadInt32(&blockResponse))
+	}
+	switch kind {
+	case BlockNXDomain, BlockEmpty, BlockRefused:
+		ans := EmptyResponseFromMessage(msg)
+		ans.Rcode = dns.RcodeSuccess
+		if kind == BlockNXDomain {
+			ans.Rcode = dns.RcodeNameError
+		} else if kind == BlockRefused {
+			ans.Rcode = dns.RcodeRefused
+		}
+		return ans, nil
+	}
+	return RefusedResponseFromMessage(msg)
+}
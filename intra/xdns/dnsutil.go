@@ -122,7 +122,7 @@ func BlockResponseFromMessage(q []byte) (*dns.Msg, error) {
 	if err := r.Unpack(q); err != nil {
 		return r, err
 	}
-	return RefusedResponseFromMessage(r)
+	return BlockedResponseFromMessage(r, BlockDefault)
 }
 
 func RefusedResponseFromMessage(srcMsg *dns.Msg) (dstMsg *dns.Msg, err error) {
@@ -0,0 +1,268 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package xlog routes firestack's logs to a Logger set by the embedding app,
+// tagged by the package they are logged from, with key/value fields, and
+// filtered by level, per tag if need be, at runtime.  Logs written with
+// go-tun2socks' log package are routed here too, once a Logger is set.
+package xlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/common/log/simple"
+)
+
+// Levels of logs, as in go-tun2socks' log.LogLevel.
+const (
+	LevelDebug = int(log.DEBUG)
+	LevelInfo  = int(log.INFO)
+	LevelWarn  = int(log.WARN)
+	LevelError = int(log.ERROR)
+	LevelNone  = int(log.NONE)
+)
+
+// Logger receives logs at or above the level set.  `tag` names the package
+// the log is from, like "doh", and `fields` is a json object of the key/value
+// fields of the log, or "" if it has none.
+type Logger interface {
+	Log(level int, tag string, msg string, fields string)
+}
+
+var (
+	mu     sync.RWMutex
+	logger Logger
+	level  = LevelWarn
+	// tags holds levels that override level for tags.
+	tags = make(map[string]int)
+	// min is the least of level and the levels in tags.
+	min = LevelWarn
+)
+
+// SetLogger routes all logs to `l`; nil routes them back to stderr.
+func SetLogger(l Logger) {
+	mu.Lock()
+	logger = l
+	mu.Unlock()
+	if l != nil {
+		log.RegisterLogger(adapter{})
+	} else {
+		log.RegisterLogger(simple.NewSimpleLogger())
+		log.SetLevel(log.LogLevel(Level()))
+	}
+}
+
+// SetLevel sets the level below which logs are dropped.
+func SetLevel(l int) {
+	mu.Lock()
+	level = l
+	updateMinLocked()
+	mu.Unlock()
+	log.SetLevel(log.LogLevel(l))
+}
+
+// Level returns the level set with SetLevel.
+func Level() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return level
+}
+
+// SetTagLevel sets the level below which logs tagged `tag` are dropped, in
+// place of the level set with SetLevel; a negative `l` reverts to it.
+func SetTagLevel(tag string, l int) {
+	mu.Lock()
+	if l < 0 {
+		delete(tags, tag)
+	} else {
+		tags[tag] = l
+	}
+	updateMinLocked()
+	mu.Unlock()
+}
+
+// Must be called under Lock.
+func updateMinLocked() {
+	min = level
+	for _, l := range tags {
+		if l < min {
+			min = l
+		}
+	}
+}
+
+// enabled reports whether logs of lvl tagged tag are logged, and to whom.
+func enabled(lvl int, tag string) (Logger, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	threshold := level
+	if l, ok := tags[tag]; ok {
+		threshold = l
+	}
+	return logger, lvl >= threshold && lvl < LevelNone
+}
+
+// Enabled reports whether logs of `lvl` tagged `tag` are logged, so that
+// costly ones can be skipped, rather than made and dropped.
+func Enabled(lvl int, tag string) bool {
+	_, ok := enabled(lvl, tag)
+	return ok
+}
+
+// callerTag returns the package of the func `skip` frames up the stack.
+func callerTag(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return ""
+	}
+	// github.com/celzero/firestack/intra/doh.(*transport).Query
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// Fields returns the json object of kv, alternating keys and values.
+func Fields(kv ...interface{}) string {
+	if len(kv) == 0 {
+		return ""
+	}
+	m := make(map[string]interface{}, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		k := fmt.Sprint(kv[i])
+		if i+1 >= len(kv) {
+			m[k] = nil
+			break
+		}
+		switch v := kv[i+1].(type) {
+		case nil, bool, string, int, int8, int16, int32, int64,
+			uint, uint8, uint16, uint32, uint64, float32, float64:
+			m[k] = v
+		default:
+			m[k] = fmt.Sprint(v)
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func logw(lvl int, tag string, msg string, kv []interface{}) {
+	l, ok := enabled(lvl, tag)
+	if !ok {
+		return
+	}
+	fields := Fields(kv...)
+	if l != nil {
+		l.Log(lvl, tag, msg, fields)
+		return
+	}
+	if len(fields) > 0 {
+		msg = msg + " " + fields
+	}
+	switch lvl {
+	case LevelDebug:
+		log.Debugf("%s: %s", tag, msg)
+	case LevelInfo:
+		log.Infof("%s: %s", tag, msg)
+	case LevelWarn:
+		log.Warnf("%s: %s", tag, msg)
+	default:
+		log.Errorf("%s: %s", tag, msg)
+	}
+}
+
+// Debugw logs msg tagged `tag` with key/value fields kv, at LevelDebug.
+func Debugw(tag string, msg string, kv ...interface{}) {
+	logw(LevelDebug, tag, msg, kv)
+}
+
+// Infow logs msg tagged `tag` with key/value fields kv, at LevelInfo.
+func Infow(tag string, msg string, kv ...interface{}) {
+	logw(LevelInfo, tag, msg, kv)
+}
+
+// Warnw logs msg tagged `tag` with key/value fields kv, at LevelWarn.
+func Warnw(tag string, msg string, kv ...interface{}) {
+	logw(LevelWarn, tag, msg, kv)
+}
+
+// Errorw logs msg tagged `tag` with key/value fields kv, at LevelError.
+func Errorw(tag string, msg string, kv ...interface{}) {
+	logw(LevelError, tag, msg, kv)
+}
+
+// adapter is a go-tun2socks log.Logger that routes logs to the Logger set,
+// tagged by the package of the func that logged them.
+type adapter struct{}
+
+// skip is the number of frames between adapter.logf and the func that
+// called a go-tun2socks log func: the adapter's method, and log's func.
+const skip = 3
+
+func (adapter) logf(lvl int, format string, args []interface{}) {
+	mu.RLock()
+	l, lowest := logger, min
+	mu.RUnlock()
+	if l == nil || lvl < lowest {
+		return
+	}
+	tag := callerTag(skip)
+	if _, ok := enabled(lvl, tag); !ok {
+		return
+	}
+	l.Log(lvl, tag, fmt.Sprintf(format, args...), "")
+}
+
+// SetLevel implements log.Logger.
+func (adapter) SetLevel(l log.LogLevel) {
+	mu.Lock()
+	level = int(l)
+	updateMinLocked()
+	mu.Unlock()
+}
+
+// Debugf implements log.Logger.
+func (a adapter) Debugf(msg string, args ...interface{}) {
+	a.logf(LevelDebug, msg, args)
+}
+
+// Infof implements log.Logger.
+func (a adapter) Infof(msg string, args ...interface{}) {
+	a.logf(LevelInfo, msg, args)
+}
+
+// Warnf implements log.Logger.
+func (a adapter) Warnf(msg string, args ...interface{}) {
+	a.logf(LevelWarn, msg, args)
+}
+
+// Errorf implements log.Logger.
+func (a adapter) Errorf(msg string, args ...interface{}) {
+	a.logf(LevelError, msg, args)
+}
+
+// Fatalf implements log.Logger, and exits, as go-tun2socks' loggers do.
+func (a adapter) Fatalf(msg string, args ...interface{}) {
+	a.logf(LevelError, msg, args)
+	os.Exit(1)
+}
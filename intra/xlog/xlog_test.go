@@ -0,0 +1,99 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package xlog
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+type entry struct {
+	level  int
+	tag    string
+	msg    string
+	fields string
+}
+
+type recorder struct {
+	sync.Mutex
+	entries []entry
+}
+
+func (r *recorder) Log(level int, tag string, msg string, fields string) {
+	r.Lock()
+	defer r.Unlock()
+	r.entries = append(r.entries, entry{level, tag, msg, fields})
+}
+
+func (r *recorder) take() []entry {
+	r.Lock()
+	defer r.Unlock()
+	e := r.entries
+	r.entries = nil
+	return e
+}
+
+func TestLogger(t *testing.T) {
+	r := &recorder{}
+	SetLogger(r)
+	defer SetLogger(nil)
+	SetLevel(LevelInfo)
+
+	Debugw("doh", "dropped")
+	Infow("doh", "query", "name", "example.com", "n", 2, "err", errors.New("eof"))
+	log.Warnf("legacy %d", 1)
+	log.Debugf("dropped")
+
+	e := r.take()
+	if len(e) != 2 {
+		t.Fatalf("Expected 2 logs, got %v", e)
+	}
+	want := entry{LevelInfo, "doh", "query", `{"err":"eof","n":2,"name":"example.com"}`}
+	if e[0] != want {
+		t.Errorf("Got %v, want %v", e[0], want)
+	}
+	if e[1].level != LevelWarn || e[1].tag != "xlog" || e[1].msg != "legacy 1" {
+		t.Errorf("Legacy log not routed: %v", e[1])
+	}
+}
+
+func TestTagLevel(t *testing.T) {
+	r := &recorder{}
+	SetLogger(r)
+	defer SetLogger(nil)
+	SetLevel(LevelError)
+	SetTagLevel("dnscrypt", LevelDebug)
+	defer SetTagLevel("dnscrypt", -1)
+
+	Infow("doh", "dropped")
+	Debugw("dnscrypt", "kept")
+	log.Infof("dropped too")
+	if e := r.take(); len(e) != 1 || e[0].msg != "kept" {
+		t.Errorf("Wrong logs %v", e)
+	}
+
+	SetTagLevel("xlog", LevelInfo)
+	log.Infof("kept")
+	SetTagLevel("xlog", LevelNone)
+	log.Errorf("dropped")
+	if e := r.take(); len(e) != 1 || e[0].msg != "kept" {
+		t.Errorf("Wrong legacy logs %v", e)
+	}
+	SetTagLevel("xlog", -1)
+}
+
+func TestFields(t *testing.T) {
+	if f := Fields(); f != "" {
+		t.Errorf("Expected no fields, got %s", f)
+	}
+	if f := Fields("odd"); f != `{"odd":null}` {
+		t.Errorf("Wrong odd fields %s", f)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"runtime/debug"
 
 	"github.com/celzero/firestack/outline"
+	"github.com/celzero/firestack/shadowsocks"
 	"github.com/celzero/firestack/tunnel"
 	"github.com/eycorsican/go-tun2socks/common/log"
 )
@@ -62,6 +63,21 @@ func ConnectShadowsocksTunnel(fd int, host string, port int, password, cipher st
 	if err != nil {
 		return nil, err
 	}
-	go tunnel.ProcessInputPackets(t, tun)
+	go tunnel.ProcessInputPackets(t, tun, 0)
 	return t, nil
 }
+
+// ConnectShadowsocksURLTunnel is like ConnectShadowsocksTunnel, but for the
+// Shadowsocks proxy server at `url`, an ss:// URL or Outline access key.
+//
+// Throws an exception if `url` is malformed, or has a plugin.
+func ConnectShadowsocksURLTunnel(fd int, url string, isUDPEnabled bool) (OutlineTunnel, error) {
+	c, err := shadowsocks.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Plugin) > 0 {
+		return nil, fmt.Errorf("Unsupported plugin: %v", c.Plugin)
+	}
+	return ConnectShadowsocksTunnel(fd, c.Host, c.Port, c.Password, c.Cipher, isUDPEnabled)
+}
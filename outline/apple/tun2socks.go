@@ -19,10 +19,10 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"runtime/debug"
-	"time"
 
+	"github.com/celzero/firestack/intra/memory"
 	"github.com/celzero/firestack/outline"
+	"github.com/celzero/firestack/shadowsocks"
 )
 
 // OutlineTunnel embeds the tun2socks.Tunnel interface so it gets exported by gobind.
@@ -35,18 +35,19 @@ type TunWriter interface {
 	io.WriteCloser
 }
 
+// appleMemoryLimit is the memory limit of Apple VPN extensions.
+const appleMemoryLimit = 15 << 20
+
 func init() {
-	// Apple VPN extensions have a memory limit of 15MB. Conserve memory by increasing garbage
-	// collection frequency and returning memory to the OS every minute.
-	debug.SetGCPercent(10)
-	// TODO: Check if this is still needed in go 1.13, which returns memory to the OS
-	// automatically.
-	ticker := time.NewTicker(time.Minute * 1)
-	go func() {
-		for range ticker.C {
-			debug.FreeOSMemory()
-		}
-	}()
+	// Conserve memory by increasing garbage collection frequency and returning memory to the
+	// OS every minute, as the budget of the limit has it.
+	memory.SetLimit(appleMemoryLimit)
+}
+
+// OnLowMemory returns what memory it can to the OS; to be called as the extension is warned
+// of memory pressure.
+func OnLowMemory() {
+	memory.Release()
 }
 
 // ConnectShadowsocksTunnel reads packets from a TUN device and routes it to a Shadowsocks proxy server.
@@ -68,3 +69,18 @@ func ConnectShadowsocksTunnel(tunWriter TunWriter, host string, port int, passwo
 	}
 	return outline.NewTunnel(host, port, password, cipher, isUDPEnabled, tunWriter)
 }
+
+// ConnectShadowsocksURLTunnel is like ConnectShadowsocksTunnel, but for the
+// Shadowsocks proxy server at `url`, an ss:// URL or Outline access key.
+//
+// Sets an error if `url` is malformed, or has a plugin.
+func ConnectShadowsocksURLTunnel(tunWriter TunWriter, url string, isUDPEnabled bool) (OutlineTunnel, error) {
+	c, err := shadowsocks.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Plugin) > 0 {
+		return nil, fmt.Errorf("Unsupported plugin: %v", c.Plugin)
+	}
+	return ConnectShadowsocksTunnel(tunWriter, c.Host, c.Port, c.Password, c.Cipher, isUDPEnabled)
+}
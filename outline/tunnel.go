@@ -27,6 +27,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/eycorsican/go-tun2socks/core"
@@ -45,16 +47,26 @@ type Tunnel interface {
 	// Sets the tunnel's UDP connection handler accordingly, falling back to DNS over TCP if UDP is not supported.
 	// Returns whether UDP proxying is supported in the new network.
 	UpdateUDPSupport() bool
+
+	// UpdateConfig switches the tunnel to the Shadowsocks proxy at `host`:`port`, with `password`
+	// and `cipher`, as when its credentials are rotated.  New connections go through the new proxy;
+	// connections in progress go on through the old one, till they close, and the TUN device is
+	// left as it is.
+	// Returns an error if the parameters are invalid, in which case the tunnel is unchanged.
+	UpdateConfig(host string, port int, password, cipher string) error
 }
 
 type outlinetunnel struct {
 	tunnel.Tunnel
+	sync.Mutex
 	lwipStack    core.LWIPStack
 	host         string
 	port         int
 	password     string
 	cipher       string
 	isUDPEnabled bool // Whether the tunnel supports proxying UDP.
+	tcpHandler   core.TCPConnHandler
+	udpHandler   core.UDPConnHandler
 }
 
 // NewTunnel connects a tunnel to a Shadowsocks proxy server and returns an `outline.Tunnel`.
@@ -78,12 +90,22 @@ func NewTunnel(host string, port int, password, cipher string, isUDPEnabled bool
 	})
 	lwipStack := core.NewLWIPStack()
 	base := tunnel.NewTunnel(tunWriter, lwipStack)
-	t := &outlinetunnel{base, lwipStack, host, port, password, cipher, isUDPEnabled}
+	t := &outlinetunnel{
+		Tunnel:       base,
+		lwipStack:    lwipStack,
+		host:         host,
+		port:         port,
+		password:     password,
+		cipher:       cipher,
+		isUDPEnabled: isUDPEnabled,
+	}
 	t.registerConnectionHandlers()
 	return t, nil
 }
 
 func (t *outlinetunnel) UpdateUDPSupport() bool {
+	t.Lock()
+	defer t.Unlock()
 	client, err := shadowsocks.NewClient(t.host, t.port, t.password, t.cipher)
 	if err != nil {
 		return false
@@ -106,6 +128,29 @@ func (t *outlinetunnel) registerConnectionHandlers() {
 	} else {
 		udpHandler = dnsfallback.NewUDPHandler()
 	}
-	core.RegisterTCPConnHandler(oss.NewTCPHandler(t.host, t.port, t.password, t.cipher))
+	t.tcpHandler = oss.NewTCPHandler(t.host, t.port, t.password, t.cipher)
+	t.udpHandler = udpHandler
+	core.RegisterTCPConnHandler(t.tcpHandler)
 	core.RegisterUDPConnHandler(udpHandler)
 }
+
+func (t *outlinetunnel) UpdateConfig(host string, port int, password, cipher string) error {
+	if port <= 0 || port > math.MaxUint16 {
+		return fmt.Errorf("Invalid port number: %v", port)
+	}
+	client, err := shadowsocks.NewClient(host, port, password, cipher)
+	if err != nil {
+		return fmt.Errorf("Invalid Shadowsocks proxy parameters: %v", err.Error())
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.host, t.port, t.password, t.cipher = host, port, password, cipher
+	// The handlers are updated in place, rather than registered anew, so that the UDP
+	// connections in progress are still found by the handler they were made with.
+	for _, h := range []interface{}{t.tcpHandler, t.udpHandler} {
+		if u, ok := h.(oss.ClientUpdater); ok {
+			u.UpdateClient(client)
+		}
+	}
+	return nil
+}
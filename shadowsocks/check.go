@@ -0,0 +1,101 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shadowsocks
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"time"
+
+	shadowsocks "github.com/Jigsaw-Code/outline-ss-server/client"
+	"github.com/celzero/firestack/intra/diag"
+)
+
+const (
+	// checkURL is requested through proxies, to check they relay tcp.
+	checkURL = "http://example.com"
+	// checkResolver is queried through proxies, to check they relay udp.
+	checkResolver = "1.1.1.1:53"
+)
+
+// Report is the outcome of the checks of a Shadowsocks proxy, by Check.
+type Report struct {
+	// Reachable is whether the server accepts tcp connections, and
+	// ConnectMs, the time taken to connect.
+	Reachable bool  `json:"reachable"`
+	ConnectMs int64 `json:"connect_ms"`
+	// Authenticated is whether a request relayed through the proxy got a
+	// response, which it wouldn't if the password or cipher were wrong, and
+	// RelayMs, the time taken to get it.
+	Authenticated bool  `json:"authenticated"`
+	RelayMs       int64 `json:"relay_ms"`
+	// UDP is whether a dns query relayed through the proxy over udp got an
+	// answer, and UDPMs, the time taken to get it.
+	UDP   bool  `json:"udp"`
+	UDPMs int64 `json:"udp_ms"`
+	// Error is why the first check that failed did, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// JSON returns r as json.
+func (r *Report) JSON() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+func since(start time.Time) int64 {
+	return int64(time.Since(start) / time.Millisecond)
+}
+
+// Check checks whether the proxy of `c` is reachable, relays tcp once
+// authenticated, and relays udp, and times each.  The relay checks run
+// together, and only if the proxy is reachable.
+func Check(c *Config) *Report {
+	r := &Report{}
+	fail := func(err error) {
+		if len(r.Error) == 0 {
+			r.Error = err.Error()
+		}
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(c.Host, strconv.Itoa(c.Port)), tcpTimeoutMs*time.Millisecond)
+	if err != nil {
+		fail(err)
+		return r
+	}
+	conn.Close()
+	r.Reachable, r.ConnectMs = true, since(start)
+
+	client, err := NewClient(c)
+	if err != nil {
+		fail(err)
+		return r
+	}
+	udpDone := make(chan error, 1)
+	diag.Go(diag.Proxy, func() {
+		start := time.Now()
+		err := CheckUDPConnectivityWithDNS(client, shadowsocks.NewAddr(checkResolver, "udp"))
+		if err == nil {
+			r.UDPMs = since(start)
+		}
+		udpDone <- err
+	})
+	start = time.Now()
+	if err := CheckTCPConnectivityWithHTTP(client, checkURL); err != nil {
+		fail(err)
+	} else {
+		r.Authenticated, r.RelayMs = true, since(start)
+	}
+	if err := <-udpDone; err != nil {
+		fail(err)
+	} else {
+		r.UDP = true
+	}
+	return r
+}
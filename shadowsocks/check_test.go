@@ -0,0 +1,52 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shadowsocks
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	r := Check(&Config{Host: "127.0.0.1", Port: port, Password: "p", Cipher: "chacha20-ietf-poly1305"})
+	if r.Reachable || r.Authenticated || r.UDP || len(r.Error) == 0 {
+		t.Errorf("Wrong report %+v", r)
+	}
+}
+
+func TestCheckUnauthenticated(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+	// with a plugin, so udp fails at once
+	r := Check(&Config{Host: "127.0.0.1", Port: port, Password: "p", Cipher: "chacha20-ietf-poly1305", Plugin: ObfsPlugin, PluginOpts: "obfs=http"})
+	if !r.Reachable || r.Authenticated || r.UDP || len(r.Error) == 0 {
+		t.Errorf("Wrong report %+v", r)
+	}
+	if s := r.JSON(); !strings.Contains(s, `"reachable":true`) || !strings.Contains(s, `"udp":false`) {
+		t.Errorf("Wrong json %s", s)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Config is a Shadowsocks proxy, as told by an ss:// URL.
+type Config struct {
+	Host     string
+	Port     int
+	Password string
+	Cipher   string
+	// Plugin is the SIP003 plugin, like "obfs-local", if any, and PluginOpts
+	// its options, like "obfs=http;obfs-host=example.com".
+	Plugin     string
+	PluginOpts string
+	// Tag is the name of the proxy, from the URL's fragment, if any.
+	Tag string
+}
+
+// ParseURL returns the Config of `s`, an ss:// URL, of the SIP002 form,
+// "ss://<userinfo>@<host>:<port>[/][?plugin=<plugin>[;<opts>]][#<tag>]",
+// where userinfo is base64url("<cipher>:<password>"), or the percent-encoded
+// "<cipher>:<password>"; or of the legacy form,
+// "ss://base64(<cipher>:<password>@<host>:<port>)[#<tag>]".  Outline access
+// keys are SIP002 URLs all the same.
+// See: https://shadowsocks.org/guide/sip002.html
+func ParseURL(s string) (*Config, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < len("ss://") || !strings.EqualFold(s[:len("ss://")], "ss://") {
+		return nil, errors.New("not an ss:// url")
+	}
+	s = s[len("ss://"):]
+	c := &Config{}
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		tag, err := url.PathUnescape(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("bad ss url tag: %v", err)
+		}
+		c.Tag = tag
+		s = s[:i]
+	}
+
+	at := strings.LastIndexByte(s, '@')
+	if at < 0 {
+		// legacy: all but the tag is base64
+		b, err := decodeBase64(strings.TrimSuffix(s, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("bad legacy ss url: %v", err)
+		}
+		s = string(b)
+		if at = strings.LastIndexByte(s, '@'); at < 0 {
+			return nil, errors.New("bad legacy ss url: no host")
+		}
+		if err := c.setUserInfo(s[:at], false); err != nil {
+			return nil, err
+		}
+	} else if err := c.setUserInfo(s[:at], true); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse("//" + s[at+1:])
+	if err != nil {
+		return nil, fmt.Errorf("bad ss url: %v", err)
+	}
+	if c.Host = u.Hostname(); len(c.Host) == 0 {
+		return nil, errors.New("bad ss url: no host")
+	}
+	if c.Port, err = strconv.Atoi(u.Port()); err != nil || c.Port <= 0 || c.Port > 65535 {
+		return nil, fmt.Errorf("bad ss url port %q", u.Port())
+	}
+	if plugin := u.Query().Get("plugin"); len(plugin) > 0 {
+		parts := strings.SplitN(plugin, ";", 2)
+		c.Plugin = parts[0]
+		if len(parts) > 1 {
+			c.PluginOpts = parts[1]
+		}
+	}
+	return c, nil
+}
+
+// setUserInfo sets the cipher and password of c from `info`, which is
+// "<cipher>:<password>", or, if `sip002`, also its base64url or percent
+// encoded form.
+func (c *Config) setUserInfo(info string, sip002 bool) error {
+	if sip002 {
+		if plain, err := url.PathUnescape(info); err == nil && strings.Contains(plain, ":") {
+			info = plain
+		} else if b, err := decodeBase64(info); err == nil {
+			info = string(b)
+		} else {
+			return fmt.Errorf("bad ss url userinfo: %v", err)
+		}
+	}
+	i := strings.IndexByte(info, ':')
+	if i <= 0 {
+		return errors.New("bad ss url: no cipher")
+	}
+	c.Cipher, c.Password = strings.ToLower(info[:i]), info[i+1:]
+	return nil
+}
+
+// decodeBase64 decodes s, in the standard or url-safe alphabets, with or
+// without padding, as ss:// URLs in the wild are in all of them.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shadowsocks
+
+import (
+	"testing"
+)
+
+func TestParseURL(t *testing.T) {
+	for _, c := range []struct {
+		url  string
+		want Config
+	}{
+		// SIP002, base64url userinfo without padding
+		{"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1",
+			Config{Host: "192.168.100.1", Port: 8888, Password: "test", Cipher: "aes-128-gcm", Tag: "Example1"}},
+		// SIP002, with a plugin
+		{"ss://cmM0LW1kNTpwYXNzd2Q@192.168.100.1:8888/?plugin=obfs-local%3Bobfs%3Dhttp#Example2",
+			Config{Host: "192.168.100.1", Port: 8888, Password: "passwd", Cipher: "rc4-md5", Plugin: "obfs-local", PluginOpts: "obfs=http", Tag: "Example2"}},
+		// SIP002, percent-encoded userinfo, and an IPv6 host
+		{"ss://2022-blake3-aes-256-gcm:YctPZ6U7xPPcU%2Bgp3u%2B0tx%2FtRizJN9K8y%2BuKlW2qjlI%3D@[::1]:8888",
+			Config{Host: "::1", Port: 8888, Password: "YctPZ6U7xPPcU+gp3u+0tx/tRizJN9K8y+uKlW2qjlI=", Cipher: "2022-blake3-aes-256-gcm"}},
+		// an Outline access key
+		{"ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNz@example.com:443/?outline=1",
+			Config{Host: "example.com", Port: 443, Password: "pass", Cipher: "chacha20-ietf-poly1305"}},
+		// legacy, base64 with padding
+		{"ss://YmYtY2ZiOnRlc3RAMTkyLjE2OC4xMDAuMTo4ODg4#Legacy%20one",
+			Config{Host: "192.168.100.1", Port: 8888, Password: "test", Cipher: "bf-cfb", Tag: "Legacy one"}},
+	} {
+		got, err := ParseURL(c.url)
+		if err != nil {
+			t.Errorf("%s: %v", c.url, err)
+			continue
+		}
+		if *got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.url, *got, c.want)
+		}
+	}
+}
+
+func TestParseBadURL(t *testing.T) {
+	for _, u := range []string{
+		"",
+		"http://example.com",
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1",
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:70000",
+		"ss://!!!@192.168.100.1:8888",
+		"ss://bm9jaXBoZXI@192.168.100.1:8888",
+		"ss://bm90IGEgdXJs",
+	} {
+		if c, err := ParseURL(u); err == nil {
+			t.Errorf("%q: expected error, got %+v", u, c)
+		}
+	}
+}
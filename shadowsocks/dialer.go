@@ -0,0 +1,97 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+//
+// This file incorporates work covered by the following copyright and
+// permission notice:
+//
+//     Copyright 2018 Jigsaw Operations LLC
+//
+//     Licensed under the Apache License, Version 2.0 (the "License");
+//     you may not use this file except in compliance with the License.
+//     You may obtain a copy of the License at
+//
+//          http://www.apache.org/licenses/LICENSE-2.0
+//
+//     Unless required by applicable law or agreed to in writing, software
+//     distributed under the License is distributed on an "AS IS" BASIS,
+//     WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//     See the License for the specific language governing permissions and
+//     limitations under the License.
+
+package shadowsocks
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	shadowsocks "github.com/Jigsaw-Code/outline-ss-server/client"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/Jigsaw-Code/outline-ss-server/slicepool"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Dialer dials Shadowsocks servers, like a net.Dialer whose sockets are
+// protected from the VPN.
+type Dialer interface {
+	Dial(network string, addr string) (net.Conn, error)
+}
+
+// udpBufferSize is the largest udp packet carried, as in outline-ss-server.
+const udpBufferSize = 16 * 1024
+
+var udpPool = slicepool.MakePool(udpBufferSize)
+
+// packetConn relays udp through a Shadowsocks server, as outline-ss-server's
+// client does, over a conn dialed by a Dialer.
+type packetConn struct {
+	*net.UDPConn
+	cipher *ss.Cipher
+}
+
+// WriteTo encrypts `b` and writes it to `addr` through the server.
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target := socks.ParseAddr(addr.String())
+	if target == nil {
+		return 0, errors.New("failed to parse target address")
+	}
+	lazySlice := udpPool.LazySlice()
+	cipherBuf := lazySlice.Acquire()
+	defer lazySlice.Release()
+	saltSize := c.cipher.SaltSize()
+	// leave room for the salt, so that plaintext and ciphertext don't overlap
+	plaintextBuf := append(append(cipherBuf[saltSize:saltSize], target...), b...)
+	buf, err := ss.Pack(cipherBuf, plaintextBuf, c.cipher)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.UDPConn.Write(buf)
+	return len(b), err
+}
+
+// ReadFrom reads from the server, and decrypts into `b`.
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	lazySlice := udpPool.LazySlice()
+	cipherBuf := lazySlice.Acquire()
+	defer lazySlice.Release()
+	n, err := c.UDPConn.Read(cipherBuf)
+	if err != nil {
+		return 0, nil, err
+	}
+	buf, err := ss.Unpack(nil, cipherBuf[:n], c.cipher)
+	if err != nil {
+		return 0, nil, err
+	}
+	src := socks.SplitAddr(buf)
+	if src == nil {
+		return 0, nil, errors.New("failed to read source address")
+	}
+	n = copy(b, buf[len(src):])
+	if len(b) < len(buf)-len(src) {
+		return n, shadowsocks.NewAddr(src.String(), "udp"), io.ErrShortBuffer
+	}
+	return n, shadowsocks.NewAddr(src.String(), "udp"), nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+// maxObfsResponse caps the http response headers of obfs servers.
+const maxObfsResponse = 4096
+
+// obfs is simple-obfs, in http mode: the first bytes sent are the body of
+// an http websocket upgrade request, and the first bytes received follow
+// the headers of its response; bytes after are sent and received as-is.
+// See: https://github.com/shadowsocks/simple-obfs
+type obfs struct {
+	host string // of the Host header, with the port unless 80
+	uri  string
+}
+
+func newObfs(opts map[string]string, host string, port int) (plugin, error) {
+	if mode := opts["obfs"]; mode != "http" {
+		return nil, fmt.Errorf("unsupported obfs mode %q", mode)
+	}
+	if h := opts["obfs-host"]; len(h) > 0 {
+		host = h
+	}
+	if port != 80 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	uri := opts["obfs-uri"]
+	if len(uri) == 0 {
+		uri = "/"
+	}
+	return &obfs{host: host, uri: uri}, nil
+}
+
+func (o *obfs) wrap(c *net.TCPConn) (onet.DuplexConn, error) {
+	return &obfsConn{wrapped: wrapped{c, c}, o: o}, nil
+}
+
+type obfsConn struct {
+	wrapped
+	o       *obfs
+	wmu     sync.Mutex
+	sent    bool // whether the request is sent
+	got     bool // whether the response headers are read
+	pending []byte
+}
+
+func randInt(n int64) int64 {
+	v, err := rand.Int(rand.Reader, big.NewInt(n))
+	if err != nil {
+		return 0
+	}
+	return v.Int64()
+}
+
+// request returns the request headers, for a body of n bytes, as
+// simple-obfs sends them.
+func (o *obfs) request(n int) []byte {
+	key := make([]byte, 16)
+	rand.Read(key)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\n", o.uri)
+	fmt.Fprintf(&b, "Host: %s\r\n", o.host)
+	fmt.Fprintf(&b, "User-Agent: curl/7.%d.%d\r\n", randInt(51), randInt(2))
+	b.WriteString("Upgrade: websocket\r\n")
+	b.WriteString("Connection: Upgrade\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Key: %s\r\n", base64.StdEncoding.EncodeToString(key))
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", n)
+	return b.Bytes()
+}
+
+func (c *obfsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.sent {
+		return c.Conn.Write(b)
+	}
+	if _, err := c.Conn.Write(append(c.o.request(len(b)), b...)); err != nil {
+		return 0, err
+	}
+	c.sent = true
+	return len(b), nil
+}
+
+func (c *obfsConn) Read(b []byte) (int, error) {
+	for !c.got {
+		buf := make([]byte, maxObfsResponse)
+		n, err := c.Conn.Read(buf)
+		c.pending = append(c.pending, buf[:n]...)
+		if i := bytes.Index(c.pending, []byte("\r\n\r\n")); i >= 0 {
+			if !bytes.HasPrefix(c.pending, []byte("HTTP/1.1 101 ")) {
+				return 0, errors.New("bad obfs response")
+			}
+			c.pending = c.pending[i+4:]
+			c.got = true
+		} else if err != nil {
+			return 0, err
+		} else if len(c.pending) >= maxObfsResponse {
+			return 0, errors.New("obfs response too long")
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
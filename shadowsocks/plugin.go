@@ -0,0 +1,217 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	shadowsocks "github.com/Jigsaw-Code/outline-ss-server/client"
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Names of the SIP003 plugins run in-process, as stream wrappers.
+const (
+	// ObfsPlugin is simple-obfs, of which the http mode is supported.
+	ObfsPlugin = "obfs-local"
+	// V2rayPlugin is v2ray-plugin, of which the websocket mode, with or
+	// without tls, is supported.
+	V2rayPlugin = "v2ray-plugin"
+)
+
+var errPluginUDP = errors.New("shadowsocks plugins do not carry udp")
+
+// plugin wraps tcp conns to Shadowsocks servers, as SIP003 plugins would.
+type plugin interface {
+	// wrap returns c wrapped, ready to carry a Shadowsocks stream.
+	wrap(c *net.TCPConn) (onet.DuplexConn, error)
+}
+
+// newPlugin returns the plugin `name`, with options `opts`, like
+// "obfs=http;obfs-host=example.com", for the server at host:port.
+func newPlugin(name string, opts string, host string, port int) (plugin, error) {
+	o := parseOpts(opts)
+	switch name {
+	case ObfsPlugin, "simple-obfs":
+		return newObfs(o, host, port)
+	case V2rayPlugin:
+		return newWebsocket(o)
+	}
+	return nil, fmt.Errorf("unsupported shadowsocks plugin %s", name)
+}
+
+// parseOpts parses SIP003 plugin options: "key=value" pairs, or bare keys,
+// separated by ";", in which "\" escapes ";", "=" and itself.  Bare keys
+// map to "".
+func parseOpts(s string) map[string]string {
+	m := make(map[string]string)
+	var key, cur strings.Builder
+	inValue := false
+	end := func() {
+		if inValue {
+			m[key.String()] = cur.String()
+		} else if cur.Len() > 0 {
+			m[cur.String()] = ""
+		}
+		key.Reset()
+		cur.Reset()
+		inValue = false
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			cur.WriteByte(s[i])
+		case c == ';':
+			end()
+		case c == '=' && !inValue:
+			key.WriteString(cur.String())
+			cur.Reset()
+			inValue = true
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	end()
+	return m
+}
+
+// NewClient returns a Shadowsocks client for the server of `c`, whose
+// streams are wrapped by c.Plugin, if set.  Clients with plugins carry tcp
+// alone, as SIP003 plugins do.
+func NewClient(c *Config) (shadowsocks.Client, error) {
+	return NewClientWithDialer(c, nil)
+}
+
+// NewClientWithDialer is like NewClient, but for a client that dials the
+// server with `d`, and resolves it with d, too, as it dials; or, if d is
+// nil, directly.
+func NewClientWithDialer(c *Config, d Dialer) (shadowsocks.Client, error) {
+	if len(c.Plugin) == 0 && d == nil {
+		return shadowsocks.NewClient(c.Host, c.Port, c.Password, c.Cipher)
+	}
+	var p plugin
+	if len(c.Plugin) > 0 {
+		var err error
+		if p, err = newPlugin(c.Plugin, c.PluginOpts, c.Host, c.Port); err != nil {
+			return nil, err
+		}
+	}
+	host := c.Host
+	if d == nil {
+		ip, err := net.ResolveIPAddr("ip", c.Host)
+		if err != nil {
+			return nil, errors.New("failed to resolve proxy address")
+		}
+		host = ip.IP.String()
+	}
+	cipher, err := ss.NewCipher(c.Cipher, c.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginClient{addr: net.JoinHostPort(host, strconv.Itoa(c.Port)), cipher: cipher, plugin: p, dialer: d}, nil
+}
+
+// pluginClient is a Shadowsocks client whose streams are wrapped by plugin,
+// if any, that dials the server with dialer, if set.
+type pluginClient struct {
+	addr   string
+	cipher *ss.Cipher
+	plugin plugin // nil if none
+	dialer Dialer // nil to dial directly
+}
+
+// dial dials the server over `network`, from `laddr`, if set and dialed
+// directly.
+func (c *pluginClient) dial(network string, laddr net.Addr) (net.Conn, error) {
+	if c.dialer != nil {
+		return c.dialer.Dial(network, c.addr)
+	}
+	return (&net.Dialer{LocalAddr: laddr}).Dial(network, c.addr)
+}
+
+// helloWait is as in outline-ss-server's client: the target address is sent
+// along with the app's first bytes written this soon.
+const helloWait = 10 * time.Millisecond
+
+func (c *pluginClient) DialTCP(laddr *net.TCPAddr, raddr string) (onet.DuplexConn, error) {
+	target := socks.ParseAddr(raddr)
+	if target == nil {
+		return nil, errors.New("failed to parse target address")
+	}
+	var la net.Addr
+	if laddr != nil {
+		la = laddr
+	}
+	dc, err := c.dial("tcp", la)
+	if err != nil {
+		return nil, err
+	}
+	tc, ok := dc.(*net.TCPConn)
+	if !ok {
+		dc.Close()
+		return nil, errors.New("shadowsocks conn not tcp")
+	}
+	var conn onet.DuplexConn = tc
+	if c.plugin != nil {
+		if conn, err = c.plugin.wrap(tc); err != nil {
+			tc.Close()
+			return nil, err
+		}
+	}
+	ssw := ss.NewShadowsocksWriter(conn, c.cipher)
+	if _, err = ssw.LazyWrite(target); err != nil {
+		conn.Close()
+		return nil, errors.New("failed to write target address")
+	}
+	time.AfterFunc(helloWait, func() {
+		ssw.Flush()
+	})
+	ssr := ss.NewShadowsocksReader(conn, c.cipher)
+	return onet.WrapConn(conn, ssr, ssw), nil
+}
+
+func (c *pluginClient) ListenUDP(laddr *net.UDPAddr) (net.PacketConn, error) {
+	if c.plugin != nil {
+		return nil, errPluginUDP
+	}
+	var la net.Addr
+	if laddr != nil {
+		la = laddr
+	}
+	dc, err := c.dial("udp", la)
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := dc.(*net.UDPConn)
+	if !ok {
+		dc.Close()
+		return nil, errors.New("shadowsocks conn not udp")
+	}
+	return &packetConn{UDPConn: uc, cipher: c.cipher}, nil
+}
+
+// wrapped is a conn that a plugin wraps, whose reads and writes are its own,
+// rather than those of tcp beneath, like ReadFrom.
+type wrapped struct {
+	net.Conn
+	tcp *net.TCPConn
+}
+
+func (w *wrapped) CloseRead() error {
+	return w.tcp.CloseRead()
+}
+
+func (w *wrapped) CloseWrite() error {
+	return w.tcp.CloseWrite()
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shadowsocks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseOpts(t *testing.T) {
+	got := parseOpts(`tls;host=example.com;path=/a\;b;k=v\=w`)
+	want := map[string]string{"tls": "", "host": "example.com", "path": "/a;b", "k": "v=w"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong opts %v", got)
+	}
+}
+
+func TestBadPlugins(t *testing.T) {
+	for _, c := range []struct{ name, opts string }{
+		{"kcptun", ""},
+		{ObfsPlugin, "obfs=tls"},
+		{V2rayPlugin, "mode=quic"},
+	} {
+		if _, err := NewClient(&Config{Host: "127.0.0.1", Port: 443, Cipher: "chacha20-ietf-poly1305", Password: "p", Plugin: c.name, PluginOpts: c.opts}); err == nil {
+			t.Errorf("%s %s: expected error", c.name, c.opts)
+		}
+	}
+	c, err := NewClient(&Config{Host: "127.0.0.1", Port: 443, Cipher: "chacha20-ietf-poly1305", Password: "p", Plugin: V2rayPlugin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ListenUDP(nil); err == nil {
+		t.Error("Expected plugins not to carry udp")
+	}
+}
+
+// serve returns a tcp conn to a server that runs handle on its end.
+func serve(t *testing.T, handle func(c net.Conn)) *net.TCPConn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		handle(c)
+	}()
+	c, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestObfs(t *testing.T) {
+	p, err := newPlugin(ObfsPlugin, "obfs=http;obfs-host=example.com", "192.0.2.1", 8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := serve(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		req, err := http.ReadRequest(r)
+		if err != nil || req.Host != "example.com:8080" || req.Header.Get("Upgrade") != "websocket" {
+			t.Errorf("Bad obfs request %+v %v", req, err)
+			return
+		}
+		body := make([]byte, req.ContentLength)
+		io.ReadFull(r, body)
+		c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n" + string(body)))
+		rest := make([]byte, 5)
+		io.ReadFull(r, rest)
+		c.Write(rest)
+	})
+	c, err := p.wrap(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	c.Write([]byte("world"))
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "helloworld" {
+		t.Errorf("Wrong echo %q %v", b, err)
+	}
+}
+
+// readFrame reads a masked frame, as servers do, and returns its payload.
+func readFrame(r io.Reader) (byte, []byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1] & 0x7f)
+	if n == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(r, ext)
+		n = int(ext[0])<<8 | int(ext[1])
+	}
+	mask := make([]byte, 4)
+	io.ReadFull(r, mask)
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+	return hdr[0] & 0x0f, b, nil
+}
+
+func TestWebsocket(t *testing.T) {
+	p, err := newPlugin(V2rayPlugin, "path=/ws;host=example.com;mux=0", "192.0.2.1", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 1000)
+	tc := serve(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		req, err := http.ReadRequest(r)
+		if err != nil || req.URL.Path != "/ws" || req.Host != "example.com" {
+			t.Errorf("Bad websocket request %+v %v", req, err)
+			return
+		}
+		accept := acceptKey(req.Header.Get("Sec-WebSocket-Key"))
+		c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"))
+		// a ping, then the frames echoed, unmasked
+		c.Write([]byte{0x80 | opPing, 1, 'x'})
+		for i := 0; i < 3; i++ {
+			op, b, err := readFrame(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if op == opPong {
+				if string(b) != "x" {
+					t.Errorf("Wrong pong %q", b)
+				}
+				continue
+			}
+			hdr := []byte{0x80 | opBinary, byte(len(b))}
+			if len(b) >= 126 {
+				hdr = []byte{0x80 | opBinary, 126, byte(len(b) >> 8), byte(len(b))}
+			}
+			c.Write(append(hdr, b...))
+		}
+	})
+	c, err := p.wrap(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	c.Write(big)
+	b := make([]byte, 5+len(big))
+	if _, err := io.ReadFull(c, b); err != nil || string(b[:5]) != "hello" {
+		t.Errorf("Wrong echo %q %v", b[:5], err)
+	}
+}
+
+func TestWebsocketRefused(t *testing.T) {
+	p, _ := newPlugin(V2rayPlugin, "", "192.0.2.1", 80)
+	tc := serve(t, func(c net.Conn) {
+		http.ReadRequest(bufio.NewReader(c))
+		c.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"))
+	})
+	if _, err := p.wrap(tc); err == nil {
+		t.Error("Expected refused upgrade to fail")
+	}
+}
@@ -2,13 +2,24 @@ package shadowsocks
 
 import (
 	"net"
+	"sync"
 
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
 	shadowsocks "github.com/Jigsaw-Code/outline-ss-server/client"
+	"github.com/celzero/firestack/intra/diag"
 	"github.com/eycorsican/go-tun2socks/core"
 )
 
+// ClientUpdater is a connection handler whose Shadowsocks client can be
+// replaced, as when the proxy's credentials are rotated.
+type ClientUpdater interface {
+	// UpdateClient makes new connections go through `client`; connections
+	// made before are left as they are.
+	UpdateClient(client shadowsocks.Client)
+}
+
 type tcpHandler struct {
+	sync.RWMutex
 	client shadowsocks.Client
 }
 
@@ -23,15 +34,26 @@ func NewTCPHandler(host string, port int, password, cipher string) core.TCPConnH
 	if err != nil {
 		return nil
 	}
-	return &tcpHandler{client}
+	return &tcpHandler{client: client}
+}
+
+func (h *tcpHandler) UpdateClient(client shadowsocks.Client) {
+	h.Lock()
+	h.client = client
+	h.Unlock()
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	proxyConn, err := h.client.DialTCP(nil, target.String())
+	h.RLock()
+	client := h.client
+	h.RUnlock()
+	proxyConn, err := client.DialTCP(nil, target.String())
 	if err != nil {
 		return err
 	}
 	// TODO: Request upstream to make `conn` a `core.TCPConn` so we can avoid this type assertion.
-	go onet.Relay(conn.(core.TCPConn), proxyConn)
+	diag.Go(diag.Proxy, func() {
+		onet.Relay(conn.(core.TCPConn), proxyConn)
+	})
 	return nil
 }
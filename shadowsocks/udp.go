@@ -7,6 +7,7 @@ import (
 	"time"
 
 	shadowsocks "github.com/Jigsaw-Code/outline-ss-server/client"
+	"github.com/celzero/firestack/intra/diag"
 	"github.com/eycorsican/go-tun2socks/core"
 )
 
@@ -37,15 +38,26 @@ func NewUDPHandler(host string, port int, password, cipher string, timeout time.
 	}
 }
 
+func (h *udpHandler) UpdateClient(client shadowsocks.Client) {
+	h.Lock()
+	h.client = client
+	h.Unlock()
+}
+
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
-	proxyConn, err := h.client.ListenUDP(nil)
+	h.Lock()
+	client := h.client
+	h.Unlock()
+	proxyConn, err := client.ListenUDP(nil)
 	if err != nil {
 		return err
 	}
 	h.Lock()
 	h.conns[conn] = proxyConn
 	h.Unlock()
-	go h.handleDownstreamUDP(conn, proxyConn)
+	diag.Go(diag.Proxy, func() {
+		h.handleDownstreamUDP(conn, proxyConn)
+	})
 	return nil
 }
 
@@ -0,0 +1,252 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shadowsocks
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+// v2rayHost is the host v2ray-plugin sends, and verifies, if unset.
+const v2rayHost = "cloudfront.com"
+
+// websocketGUID is appended to keys to accept them, as in RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// websocket is v2ray-plugin, in websocket mode: streams are carried in
+// websocket frames, over tls if set.  Streams aren't multiplexed, which
+// v2ray-plugin servers accept whether or not they're set to mux.
+// See: https://github.com/shadowsocks/v2ray-plugin
+type websocket struct {
+	host string
+	path string
+	tls  *tls.Config
+}
+
+func newWebsocket(opts map[string]string) (plugin, error) {
+	if mode, ok := opts["mode"]; ok && mode != "websocket" {
+		return nil, fmt.Errorf("unsupported v2ray-plugin mode %q", mode)
+	}
+	w := &websocket{host: opts["host"], path: opts["path"]}
+	if len(w.host) == 0 {
+		w.host = v2rayHost
+	}
+	if len(w.path) == 0 {
+		w.path = "/"
+	}
+	if _, ok := opts["tls"]; ok {
+		w.tls = &tls.Config{ServerName: w.host}
+	}
+	return w, nil
+}
+
+func (w *websocket) wrap(c *net.TCPConn) (onet.DuplexConn, error) {
+	var conn net.Conn = c
+	scheme := "ws"
+	if w.tls != nil {
+		tc := tls.Client(c, w.tls)
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tc
+		scheme = "wss"
+	}
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	k := base64.StdEncoding.EncodeToString(key)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: scheme, Host: w.host, Path: w.path},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {k},
+			"Sec-WebSocket-Version": {"13"},
+		},
+		Host: w.host,
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade refused: %s", res.Status)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != acceptKey(k) {
+		return nil, errors.New("bad websocket accept key")
+	}
+	return &wsConn{wrapped: wrapped{conn, c}, r: br}, nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsConn carries a stream in binary websocket frames.
+type wsConn struct {
+	wrapped
+	r    *bufio.Reader
+	wmu  sync.Mutex
+	left uint64 // bytes left in the frame being read
+	mask []byte // of the frame being read, if masked
+	off  int    // into mask
+}
+
+// writeFrame writes a frame of opcode, whose payload is b, masked, as
+// clients must.
+func (c *wsConn) writeFrame(opcode byte, b []byte) error {
+	hdr := make([]byte, 2, 14)
+	hdr[0] = 0x80 | opcode
+	switch n := len(b); {
+	case n < 126:
+		hdr[1] = 0x80 | byte(n)
+	case n <= 0xffff:
+		hdr[1] = 0x80 | 126
+		hdr = append(hdr, byte(n>>8), byte(n))
+	default:
+		hdr[1] = 0x80 | 127
+		hdr = hdr[:10]
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame := append(hdr, mask...)
+	for i, v := range b {
+		frame = append(frame, v^mask[i%4])
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.left == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.left {
+		b = b[:c.left]
+	}
+	n, err := c.r.Read(b)
+	c.unmask(b[:n])
+	c.left -= uint64(n)
+	return n, err
+}
+
+func (c *wsConn) unmask(b []byte) {
+	if c.mask == nil {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.off%4]
+		c.off++
+	}
+}
+
+// nextFrame reads the header of the next frame, and, for control frames,
+// all of it.
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0f
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	c.mask, c.off = nil, 0
+	if hdr[1]&0x80 != 0 {
+		c.mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.r, c.mask); err != nil {
+			return err
+		}
+	}
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.left = n
+		return nil
+	}
+	if n > 125 {
+		return errors.New("websocket control frame too long")
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	c.unmask(payload)
+	switch opcode {
+	case opClose:
+		return io.EOF
+	case opPing:
+		return c.writeFrame(opPong, payload)
+	}
+	// pongs, and unknown opcodes, are ignored
+	return nil
+}
+
+// CloseWrite does nothing, as websocket servers close the stream altogether
+// once it's closed either way; it's closed by Close alone.
+func (c *wsConn) CloseWrite() error {
+	return nil
+}
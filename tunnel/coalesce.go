@@ -0,0 +1,142 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tunnel
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCoalesceWindow caps the delay added to any DNS answer.
+	maxCoalesceWindow = 20 * time.Millisecond
+	// maxCoalescedPackets is the most DNS answers held before a flush.
+	maxCoalescedPackets = 16
+)
+
+// BatchWriter is implemented by TUN writers that accept several IP packets,
+// concatenated back to back, in a single call.  Implementations must split
+// `b` into packets using the length fields of each packet's IP header.
+type BatchWriter interface {
+	WriteBatch(b []byte) (int, error)
+}
+
+// CoalescingWriter holds DNS answers (UDP packets from port 53) bound for
+// the TUN device for a short window, and writes them out together, which
+// cuts the per-packet cost of delivery during query bursts.  All other
+// packets flush held answers and are written out immediately, preserving order.
+type CoalescingWriter struct {
+	sync.Mutex
+	w       io.WriteCloser
+	window  time.Duration
+	pending [][]byte
+	timer   *time.Timer
+}
+
+// NewCoalescingWriter wraps `w`, with coalescing disabled until SetWindow.
+func NewCoalescingWriter(w io.WriteCloser) *CoalescingWriter {
+	return &CoalescingWriter{w: w}
+}
+
+// SetWindow sets how long DNS answers may be held; zero disables coalescing.
+func (c *CoalescingWriter) SetWindow(d time.Duration) {
+	if d < 0 {
+		d = 0
+	} else if d > maxCoalesceWindow {
+		d = maxCoalesceWindow
+	}
+	c.Lock()
+	c.window = d
+	c.Unlock()
+	if d == 0 {
+		c.Flush()
+	}
+}
+
+// Write writes the IP packet `b`, holding it back if it is a DNS answer.
+func (c *CoalescingWriter) Write(b []byte) (int, error) {
+	c.Lock()
+	if c.window <= 0 || !isDNSAnswer(b) {
+		// written under Lock, lest a concurrent flush overtake b
+		defer c.Unlock()
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+		return c.w.Write(b)
+	}
+
+	// b is owned by the caller and is reused once Write returns.
+	c.pending = append(c.pending, append([]byte{}, b...))
+	var err error
+	if len(c.pending) >= maxCoalescedPackets {
+		err = c.flushLocked()
+	} else if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, func() {
+			c.Flush()
+		})
+	}
+	c.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes out all held packets.
+func (c *CoalescingWriter) Flush() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.flushLocked()
+}
+
+// Must be called under Lock.
+func (c *CoalescingWriter) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	pending := c.pending
+	c.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if bw, ok := c.w.(BatchWriter); ok && len(pending) > 1 {
+		sz := 0
+		for _, p := range pending {
+			sz += len(p)
+		}
+		batch := make([]byte, 0, sz)
+		for _, p := range pending {
+			batch = append(batch, p...)
+		}
+		_, err := bw.WriteBatch(batch)
+		return err
+	}
+
+	var err error
+	for _, p := range pending {
+		if _, werr := c.w.Write(p); werr != nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// Close flushes held packets, and closes the underlying writer.
+func (c *CoalescingWriter) Close() error {
+	c.Flush()
+	return c.w.Close()
+}
+
+// isDNSAnswer reports whether the IP packet `b` is a UDP datagram from port 53.
+func isDNSAnswer(b []byte) bool {
+	const udp = 17
+	proto, src, _, ok := transportPorts(b)
+	return ok && proto == udp && src == 53
+}
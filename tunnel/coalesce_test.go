@@ -0,0 +1,160 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tunnel
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeWriter struct {
+	sync.Mutex
+	writes  [][]byte
+	batches [][]byte
+}
+
+func (w *fakeWriter) Write(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.writes = append(w.writes, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+type fakeBatchWriter struct {
+	fakeWriter
+}
+
+func (w *fakeBatchWriter) WriteBatch(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.batches = append(w.batches, append([]byte{}, b...))
+	return len(b), nil
+}
+
+// Returns a minimal IPv4 header followed by a UDP source port.
+func ipv4udp(srcport byte, tag byte) []byte {
+	b := make([]byte, 28)
+	b[0] = 0x45 // v4, ihl 5
+	b[9] = 17   // udp
+	b[21] = srcport
+	b[27] = tag
+	return b
+}
+
+func TestIsDNSAnswer(t *testing.T) {
+	if !isDNSAnswer(ipv4udp(53, 0)) {
+		t.Error("v4 dns answer not detected")
+	}
+	if isDNSAnswer(ipv4udp(80, 0)) {
+		t.Error("non-dns packet detected as dns")
+	}
+	v6 := make([]byte, 48)
+	v6[0] = 0x60
+	v6[6] = 17
+	v6[41] = 53
+	if !isDNSAnswer(v6) {
+		t.Error("v6 dns answer not detected")
+	}
+	if isDNSAnswer([]byte{0x45}) {
+		t.Error("short packet detected as dns")
+	}
+}
+
+func TestCoalesceDisabled(t *testing.T) {
+	w := &fakeWriter{}
+	c := NewCoalescingWriter(w)
+	c.Write(ipv4udp(53, 1))
+	if len(w.writes) != 1 {
+		t.Error("Disabled writer must pass through")
+	}
+}
+
+func TestCoalesceOrder(t *testing.T) {
+	w := &fakeWriter{}
+	c := NewCoalescingWriter(w)
+	c.SetWindow(time.Second)
+	c.Write(ipv4udp(53, 1))
+	c.Write(ipv4udp(53, 2))
+	if len(w.writes) != 0 {
+		t.Fatal("DNS answers must be held")
+	}
+	c.Write(ipv4udp(80, 3))
+	if len(w.writes) != 3 {
+		t.Fatalf("Expected 3 writes, got %d", len(w.writes))
+	}
+	for i, p := range w.writes {
+		if p[27] != byte(i+1) {
+			t.Errorf("Write %d out of order", i)
+		}
+	}
+}
+
+// blockingWriter holds back writes of packets other than dns answers until
+// gate is closed.
+type blockingWriter struct {
+	fakeWriter
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	if !isDNSAnswer(b) {
+		w.entered <- struct{}{}
+		<-w.gate
+	}
+	return w.fakeWriter.Write(b)
+}
+
+func TestCoalesceConcurrentOrder(t *testing.T) {
+	w := &blockingWriter{entered: make(chan struct{}), gate: make(chan struct{})}
+	c := NewCoalescingWriter(w)
+	c.SetWindow(time.Second)
+	wrote := make(chan struct{})
+	go func() {
+		c.Write(ipv4udp(80, 1))
+		close(wrote)
+	}()
+	<-w.entered
+	flushed := make(chan struct{})
+	go func() {
+		c.Write(ipv4udp(53, 2))
+		c.Flush()
+		close(flushed)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(w.gate)
+	<-wrote
+	<-flushed
+
+	if len(w.writes) != 2 || w.writes[0][27] != 1 || w.writes[1][27] != 2 {
+		t.Errorf("Flush overtook a write in progress: %v", w.writes)
+	}
+}
+
+func TestCoalesceBatch(t *testing.T) {
+	w := &fakeBatchWriter{}
+	c := NewCoalescingWriter(w)
+	c.SetWindow(5 * time.Millisecond)
+	a := ipv4udp(53, 1)
+	b := ipv4udp(53, 2)
+	c.Write(a)
+	c.Write(b)
+	time.Sleep(50 * time.Millisecond)
+
+	w.Lock()
+	defer w.Unlock()
+	if len(w.batches) != 1 || len(w.writes) != 0 {
+		t.Fatalf("Expected one batch, got %d batches %d writes", len(w.batches), len(w.writes))
+	}
+	if !bytes.Equal(w.batches[0], append(a, b...)) {
+		t.Error("Batch isn't the concatenation of packets")
+	}
+}
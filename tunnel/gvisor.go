@@ -0,0 +1,382 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	nicID = 1
+	// outQueue is the most packets queued for the TUN device.
+	outQueue = 1024
+	// maxInFlight is the most tcp connections handshaking at once.
+	maxInFlight = 1024
+	// maxEarly is the most udp packets held per association while it connects.
+	maxEarly = 64
+)
+
+var errStackClosed = errors.New("netstack closed")
+
+// gvisor is a core.LWIPStack of gVisor's netstack: it hands tcp connections
+// and udp associations from the TUN device to handlers, as lwIP does.
+type gvisor struct {
+	s    *stack.Stack
+	ep   *channel.Endpoint
+	out  func([]byte) (int, error)
+	tcp  core.TCPConnHandler
+	udp  core.UDPConnHandler
+	stop context.CancelFunc
+
+	mu   sync.Mutex
+	udps map[string]*udpConn // by source ip:port
+}
+
+// NewGVisorStack returns a core.LWIPStack of gVisor's netstack, in place of
+// lwIP, for a TUN device of `mtu`.  As with lwIP, tcp connections are handed
+// to `tcph`, udp packets to `udph`, associated by their source address, and
+// packets to the TUN device are written with `out`.
+func NewGVisorStack(mtu int, tcph core.TCPConnHandler, udph core.UDPConnHandler, out func([]byte) (int, error)) (core.LWIPStack, error) {
+	if tcph == nil || udph == nil || out == nil {
+		return nil, errors.New("netstack needs handlers and an output")
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+	})
+	sack := tcpip.TCPSACKEnabled(true)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return nil, errors.New(err.String())
+	}
+	ep := channel.New(outQueue, uint32(mtu), "")
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		return nil, errors.New(err.String())
+	}
+	// flows are to any address, and answered from it
+	s.SetPromiscuousMode(nicID, true)
+	s.SetSpoofing(nicID, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+
+	ctx, stop := context.WithCancel(context.Background())
+	g := &gvisor{
+		s:    s,
+		ep:   ep,
+		out:  out,
+		tcp:  tcph,
+		udp:  udph,
+		stop: stop,
+		udps: make(map[string]*udpConn),
+	}
+	fwd := tcp.NewForwarder(s, 0, maxInFlight, g.accept)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, fwd.HandlePacket)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, g.receive)
+	go g.output(ctx)
+	return g, nil
+}
+
+// Write implements core.LWIPStack, and takes an ip packet from the TUN device.
+func (g *gvisor) Write(b []byte) (int, error) {
+	var proto tcpip.NetworkProtocolNumber
+	switch header.IPVersion(b) {
+	case header.IPv4Version:
+		proto = header.IPv4ProtocolNumber
+	case header.IPv6Version:
+		proto = header.IPv6ProtocolNumber
+	default:
+		return 0, errors.New("not an ip packet")
+	}
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(b)})
+	g.ep.InjectInbound(proto, pkt)
+	pkt.DecRef()
+	return len(b), nil
+}
+
+// Close implements core.LWIPStack.
+func (g *gvisor) Close() error {
+	g.stop()
+	g.mu.Lock()
+	conns := make([]*udpConn, 0, len(g.udps))
+	for _, c := range g.udps {
+		conns = append(conns, c)
+	}
+	g.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	g.ep.Close()
+	g.s.Close()
+	return nil
+}
+
+// RestartTimeouts implements core.LWIPStack; gVisor's timers need no restart.
+func (g *gvisor) RestartTimeouts() {}
+
+// output writes packets of the netstack to the TUN device, till ctx is done.
+func (g *gvisor) output(ctx context.Context) {
+	for {
+		pkt := g.ep.ReadContext(ctx)
+		if pkt.IsNil() {
+			return
+		}
+		v := pkt.ToView()
+		pkt.DecRef()
+		if _, err := g.out(v.AsSlice()); err != nil {
+			log.Debugf("netstack: output: %v", err)
+		}
+		v.Release()
+	}
+}
+
+// accept hands a tcp connection, once established, to the tcp handler.
+func (g *gvisor) accept(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		log.Debugf("netstack: tcp %v", err)
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	c := &tcpConn{
+		TCPConn: gonet.NewTCPConn(&wq, ep),
+		ep:      ep,
+		src:     &net.TCPAddr{IP: net.IP(id.RemoteAddress.AsSlice()), Port: int(id.RemotePort)},
+		dst:     &net.TCPAddr{IP: net.IP(id.LocalAddress.AsSlice()), Port: int(id.LocalPort)},
+	}
+	go func() {
+		if err := g.tcp.Handle(c, c.dst); err != nil {
+			c.Abort()
+		}
+	}()
+}
+
+// receive hands a udp packet to the association of its source address, or
+// else a new one.
+func (g *gvisor) receive(id stack.TransportEndpointID, pkt stack.PacketBufferPtr) bool {
+	src := &net.UDPAddr{IP: net.IP(id.RemoteAddress.AsSlice()), Port: int(id.RemotePort)}
+	dst := &net.UDPAddr{IP: net.IP(id.LocalAddress.AsSlice()), Port: int(id.LocalPort)}
+	data := pkt.Data().AsRange().ToSlice()
+
+	key := src.String()
+	g.mu.Lock()
+	c, ok := g.udps[key]
+	if !ok {
+		c = &udpConn{g: g, src: src, early: make(chan udpPacket, maxEarly)}
+		g.udps[key] = c
+	}
+	g.mu.Unlock()
+	if !ok {
+		go c.connect(dst)
+	}
+	if err := c.ReceiveTo(data, dst); err != nil {
+		log.Debugf("netstack: udp from %s: %v", key, err)
+	}
+	return true
+}
+
+// writeUDP sends data from `from` to `to` as a udp packet, fragmented to the
+// MTU as needed.
+func (g *gvisor) writeUDP(data []byte, from *net.UDPAddr, to *net.UDPAddr) (int, error) {
+	proto := header.IPv4ProtocolNumber
+	src, dst := from.IP.To4(), to.IP.To4()
+	if src == nil || dst == nil {
+		proto = header.IPv6ProtocolNumber
+		src, dst = from.IP.To16(), to.IP.To16()
+	}
+	r, err := g.s.FindRoute(nicID, tcpip.AddrFromSlice(src), tcpip.AddrFromSlice(dst), proto, false)
+	if err != nil {
+		return 0, errors.New(err.String())
+	}
+	defer r.Release()
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: header.UDPMinimumSize + int(r.MaxHeaderLength()),
+		Payload:            buffer.MakeWithData(data),
+	})
+	defer pkt.DecRef()
+	u := header.UDP(pkt.TransportHeader().Push(header.UDPMinimumSize))
+	pkt.TransportProtocolNumber = udp.ProtocolNumber
+	length := uint16(pkt.Size())
+	u.Encode(&header.UDPFields{
+		SrcPort: uint16(from.Port),
+		DstPort: uint16(to.Port),
+		Length:  length,
+	})
+	xsum := u.CalculateChecksum(checksum.Combine(
+		header.PseudoHeaderChecksum(udp.ProtocolNumber, r.LocalAddress(), r.RemoteAddress(), length),
+		pkt.Data().Checksum(),
+	))
+	// all zeros is no checksum; all ones is its equivalent
+	if xsum != math.MaxUint16 {
+		xsum = ^xsum
+	}
+	u.SetChecksum(xsum)
+	params := stack.NetworkHeaderParams{Protocol: udp.ProtocolNumber, TTL: r.DefaultTTL()}
+	if err := r.WritePacket(params, pkt); err != nil {
+		return 0, errors.New(err.String())
+	}
+	return len(data), nil
+}
+
+// tcpConn is a core.TCPConn of the netstack.  Its local address is of the
+// app, and its remote address is the app's destination, as with lwIP.
+type tcpConn struct {
+	*gonet.TCPConn
+	ep  tcpip.Endpoint
+	src *net.TCPAddr
+	dst *net.TCPAddr
+}
+
+// Sent, Receive, Err, LocalClosed, and Poll are lwIP's callbacks, which
+// the netstack has no use for.
+
+func (c *tcpConn) Sent(len uint16) error     { return nil }
+func (c *tcpConn) Receive(data []byte) error { return nil }
+func (c *tcpConn) Err(err error)             {}
+func (c *tcpConn) LocalClosed() error        { return nil }
+func (c *tcpConn) Poll() error               { return nil }
+
+func (c *tcpConn) LocalAddr() net.Addr {
+	return c.src
+}
+
+func (c *tcpConn) RemoteAddr() net.Addr {
+	return c.dst
+}
+
+// Abort resets the connection.
+func (c *tcpConn) Abort() {
+	c.ep.Abort()
+}
+
+type udpPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+type udpState int
+
+const (
+	udpConnecting udpState = iota
+	udpConnected
+	udpClosed
+)
+
+// udpConn is a core.UDPConn of the packets from an app's address, to any
+// address.  Packets that arrive while it connects are held back, upto
+// maxEarly, as with lwIP.
+type udpConn struct {
+	g   *gvisor
+	src *net.UDPAddr
+
+	mu    sync.Mutex
+	state udpState
+	early chan udpPacket
+}
+
+// connect connects the association to its first destination, dst, with the
+// udp handler, and then hands it the packets held back meanwhile.
+func (c *udpConn) connect(dst *net.UDPAddr) {
+	if err := c.g.udp.Connect(c, dst); err != nil {
+		c.Close()
+		return
+	}
+	c.mu.Lock()
+	if c.state != udpConnecting {
+		c.mu.Unlock()
+		return
+	}
+	c.state = udpConnected
+	c.mu.Unlock()
+	for {
+		select {
+		case p := <-c.early:
+			if err := c.g.udp.ReceiveTo(c, p.data, p.addr); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// LocalAddr implements core.UDPConn, and is the app's address.
+func (c *udpConn) LocalAddr() *net.UDPAddr {
+	return c.src
+}
+
+// ReceiveTo implements core.UDPConn.
+func (c *udpConn) ReceiveTo(data []byte, addr *net.UDPAddr) error {
+	c.mu.Lock()
+	state := c.state
+	if state == udpConnecting {
+		defer c.mu.Unlock()
+		select {
+		case c.early <- udpPacket{data: data, addr: addr}:
+			return nil
+		default:
+			return errors.New("udp association not yet connected")
+		}
+	}
+	c.mu.Unlock()
+	if state == udpClosed {
+		return errors.New("udp association closed")
+	}
+	return c.g.udp.ReceiveTo(c, data, addr)
+}
+
+// WriteFrom implements core.UDPConn, and sends data to the app from addr.
+func (c *udpConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	c.mu.Lock()
+	state := c.state
+	c.mu.Unlock()
+	if state != udpConnected {
+		return 0, errors.New("udp association not connected")
+	}
+	return c.g.writeUDP(data, addr, c.src)
+}
+
+// Close implements core.UDPConn.
+func (c *udpConn) Close() error {
+	c.mu.Lock()
+	c.state = udpClosed
+	c.mu.Unlock()
+	key := c.src.String()
+	c.g.mu.Lock()
+	if c.g.udps[key] == c {
+		delete(c.g.udps, key)
+	}
+	c.g.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// echoTCP echoes tcp connections, and sends their targets on `targets`.
+type echoTCP struct {
+	targets chan *net.TCPAddr
+}
+
+func (h *echoTCP) Handle(conn net.Conn, target *net.TCPAddr) error {
+	h.targets <- target
+	go func() {
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+	return nil
+}
+
+// echoUDP echoes udp packets from `from`, and sends their targets on
+// `targets`.
+type echoUDP struct {
+	from    *net.UDPAddr
+	targets chan *net.UDPAddr
+}
+
+func (h *echoUDP) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return nil
+}
+
+func (h *echoUDP) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.targets <- addr
+	_, err := conn.WriteFrom(data, h.from)
+	return err
+}
+
+// app returns a netstack at 10.0.0.2 of an app, whose packets are written
+// to `g`, with the packets of `g` to it by `out`.
+func app(t *testing.T, mtu int) (*stack.Stack, func(core.LWIPStack), func([]byte) (int, error)) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	ep := channel.New(outQueue, uint32(mtu), "")
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		t.Fatal(err)
+	}
+	addr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4([4]byte{10, 0, 0, 2}).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		s.Close()
+	})
+	start := func(g core.LWIPStack) {
+		go func() {
+			for {
+				pkt := ep.ReadContext(ctx)
+				if pkt.IsNil() {
+					return
+				}
+				v := pkt.ToView()
+				pkt.DecRef()
+				g.Write(v.AsSlice())
+				v.Release()
+			}
+		}()
+	}
+	out := func(b []byte) (int, error) {
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(b)})
+		ep.InjectInbound(ipv4.ProtocolNumber, pkt)
+		pkt.DecRef()
+		return len(b), nil
+	}
+	return s, start, out
+}
+
+func TestGVisorStack(t *testing.T) {
+	const mtu = 1280
+	s, start, out := app(t, mtu)
+	tcph := &echoTCP{targets: make(chan *net.TCPAddr, 1)}
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 9), Port: 443}
+	udph := &echoUDP{from: from, targets: make(chan *net.UDPAddr, 2)}
+	g, err := NewGVisorStack(mtu, tcph, udph, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	start(g)
+
+	// tcp
+	dst := tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFrom4([4]byte{192, 0, 2, 1}), Port: 80}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := gonet.DialContextTCP(ctx, s, dst, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := <-tcph.targets; target.String() != "192.0.2.1:80" {
+		t.Errorf("Wrong tcp target %s", target)
+	}
+	big := bytes.Repeat([]byte("firestack"), 1000)
+	go c.Write(big)
+	echo := make([]byte, len(big))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, echo); err != nil || !bytes.Equal(echo, big) {
+		t.Errorf("Wrong tcp echo: %v", err)
+	}
+	c.Close()
+
+	// udp, of a payload larger than the mtu, to two destinations
+	u, err := gonet.DialUDP(s, &tcpip.FullAddress{NIC: nicID, Port: 5353}, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	payload := big[:2*mtu]
+	for _, ip := range []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)} {
+		if _, err := u.WriteTo(payload, &net.UDPAddr{IP: ip, Port: 53}); err != nil {
+			t.Fatal(err)
+		}
+		if target := <-udph.targets; !target.IP.Equal(ip) || target.Port != 53 {
+			t.Errorf("Wrong udp target %s", target)
+		}
+		b := make([]byte, 4*mtu)
+		u.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, addr, err := u.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:n], payload) {
+			t.Errorf("Wrong udp echo of %d bytes", n)
+		}
+		if addr.String() != from.String() {
+			t.Errorf("Wrong udp source %s", addr)
+		}
+	}
+
+	if _, err := g.Write([]byte{0x00}); err == nil {
+		t.Error("Wrote a non-ip packet")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tunnel
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// MinMTU is the smallest MTU of a TUN device, that of IPv6.
+	MinMTU = 1280
+	// MaxMTU is the largest MTU of a TUN device, that of an IP packet.
+	MaxMTU = 65535
+
+	tcpSYN    = 0x02
+	optEnd    = 0
+	optNOP    = 1
+	optMSS    = 2
+	optMSSLen = 4
+)
+
+// ClampMSS lowers the MSS option of the TCP SYN (or SYN-ACK) in IP packet
+// `b` to fit in `mtu`, less the IP and TCP headers, and reports whether it
+// did.  The TCP checksum is updated to match.  Packets that aren't SYNs,
+// IPv4 fragments, and IPv6 packets with extension headers are left as-is.
+func ClampMSS(b []byte, mtu int) bool {
+	b = trimPacket(b)
+	var off, hdr int
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		off = int(b[0]&0x0f) * 4
+		hdr = 40
+		if b[9] != 6 || off < 20 || binary.BigEndian.Uint16(b[6:])&0x1fff != 0 {
+			return false
+		}
+	case len(b) >= 40 && b[0]>>4 == 6:
+		off = 40
+		hdr = 60
+		if b[6] != 6 {
+			return false
+		}
+	default:
+		return false
+	}
+	if len(b) < off+20 {
+		return false
+	}
+	tcp := b[off:]
+	if tcp[13]&tcpSYN == 0 {
+		return false
+	}
+	mss := mtu - hdr
+	if mss <= 0 {
+		return false
+	}
+	end := int(tcp[12]>>4) * 4
+	if end < 20 || end > len(tcp) {
+		return false
+	}
+	for i := 20; i < end; {
+		switch tcp[i] {
+		case optEnd:
+			return false
+		case optNOP:
+			i++
+			continue
+		}
+		if i+1 >= end || tcp[i+1] < 2 || i+int(tcp[i+1]) > end {
+			return false
+		}
+		if tcp[i] == optMSS && tcp[i+1] == optMSSLen {
+			old := binary.BigEndian.Uint16(tcp[i+2:])
+			if int(old) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(tcp[i+2:], uint16(mss))
+			sum := binary.BigEndian.Uint16(tcp[16:])
+			binary.BigEndian.PutUint16(tcp[16:], adjustSum(sum, old, uint16(mss), i%2 == 1))
+			return true
+		}
+		i += int(tcp[i+1])
+	}
+	return false
+}
+
+// adjustSum returns checksum sum updated for a 16-bit value changed from
+// old to new, as in RFC 1624.  The value straddles two words if `odd`.
+func adjustSum(sum, old, new uint16, odd bool) uint16 {
+	if odd {
+		// bytes at odd offsets count towards the low byte of their words
+		old, new = old>>8|old<<8, new>>8|new<<8
+	}
+	acc := uint32(^sum) + uint32(^old) + uint32(new)
+	for acc>>16 != 0 {
+		acc = (acc & 0xffff) + (acc >> 16)
+	}
+	return ^uint16(acc)
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// tcpSum returns the checksum of the tcp segment in ip packet b, which
+// verifies to 0 if its checksum field is right.
+func tcpSum(b []byte) uint16 {
+	src, off := b[12:20], 20
+	if b[0]>>4 == 6 {
+		src, off = b[8:40], 40
+	}
+	seg := b[off:]
+	sum := uint32(6) + uint32(len(seg))
+	for _, w := range [][]byte{src, seg} {
+		for i := 0; i+1 < len(w); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(w[i:]))
+		}
+		if len(w)%2 == 1 {
+			sum += uint32(w[len(w)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// Returns a tcp syn of ip version v, with options opts, and a valid checksum.
+func tcpSYNPacket(v int, opts []byte) []byte {
+	off := 20
+	if v == 6 {
+		off = 40
+	}
+	b := make([]byte, off+20+len(opts))
+	if v == 6 {
+		b[0] = 0x60
+		binary.BigEndian.PutUint16(b[4:], uint16(len(b)-40))
+		b[6] = 6
+		b[23], b[39] = 1, 2
+	} else {
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		b[9] = 6
+		b[12], b[19] = 10, 2
+	}
+	tcp := b[off:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	tcp[12] = byte((20+len(opts))/4) << 4
+	tcp[13] = tcpSYN
+	copy(tcp[20:], opts)
+	binary.BigEndian.PutUint16(tcp[16:], tcpSum(b))
+	return b
+}
+
+func TestClampMSS(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		v    int
+		opts []byte
+		at   int // offset of the mss value in the tcp header
+		want uint16
+	}{
+		{"v4", 4, []byte{optMSS, optMSSLen, 0x05, 0xb4}, 22, 1240},
+		{"v6", 6, []byte{optMSS, optMSSLen, 0x05, 0xa0}, 22, 1220},
+		{"odd", 4, []byte{optNOP, optMSS, optMSSLen, 0x05, 0xb4, optNOP, optNOP, optNOP}, 23, 1240},
+	} {
+		b := tcpSYNPacket(c.v, c.opts)
+		// trailing bytes of the read buffer are ignored
+		buf := append(b, make([]byte, 10)...)
+		if !ClampMSS(buf, 1280) {
+			t.Fatalf("%s: MSS not clamped", c.name)
+		}
+		b = buf[:len(b)]
+		tcp := b[len(b)-20-len(c.opts):]
+		if mss := binary.BigEndian.Uint16(tcp[c.at:]); mss != c.want {
+			t.Errorf("%s: wrong MSS %d", c.name, mss)
+		}
+		if sum := tcpSum(b); sum != 0 {
+			t.Errorf("%s: bad checksum %x", c.name, sum)
+		}
+		if ClampMSS(b, 1280) {
+			t.Errorf("%s: MSS clamped twice", c.name)
+		}
+	}
+
+	small := tcpSYNPacket(4, []byte{optMSS, optMSSLen, 0x04, 0x00})
+	if ClampMSS(small, 1500) {
+		t.Error("Smaller MSS raised")
+	}
+	ack := tcpSYNPacket(4, []byte{optMSS, optMSSLen, 0x05, 0xb4})
+	ack[33] = 0x10
+	if ClampMSS(ack, 1280) {
+		t.Error("Non-SYN clamped")
+	}
+	if ClampMSS(ipv4ports(1000, 2000), 1280) {
+		t.Error("UDP clamped")
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// snaplen is the most bytes of a packet captured.
+	snaplen = 65535
+	// linktypeRaw is the pcap link-type of packets that begin with an IP header.
+	linktypeRaw   = 101
+	pcapHeaderLen = 24
+	pcapRecordLen = 16
+	// minCaptureBytes is the smallest size a capture file is capped to.
+	minCaptureBytes = pcapHeaderLen + pcapRecordLen + vpnMtu
+)
+
+// Capture writes IP packets to pcap files, rotating through a ring of them
+// so as to cap the disk space used.
+type Capture struct {
+	sync.Mutex
+	path     string
+	maxBytes int64
+	files    int
+	dnsOnly  bool
+	f        *os.File
+	size     int64
+}
+
+// NewCapture starts a packet capture at `path`.  Once the file grows past
+// `maxBytes`, it is moved to path.1 (path.1 to path.2, and so on), upto
+// `files` in all, the oldest of which is discarded.  If `dnsOnly` is set,
+// only UDP and TCP packets to or from port 53 are captured.
+func NewCapture(path string, maxBytes int64, files int, dnsOnly bool) (*Capture, error) {
+	if len(path) <= 0 {
+		return nil, errors.New("capture path empty")
+	}
+	if maxBytes < minCaptureBytes {
+		return nil, fmt.Errorf("capture size %d less than %d", maxBytes, minCaptureBytes)
+	}
+	if files < 1 {
+		files = 1
+	}
+	c := &Capture{
+		path:     path,
+		maxBytes: maxBytes,
+		files:    files,
+		dnsOnly:  dnsOnly,
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// open truncates the file at c.path and writes out the pcap header.
+// Must be called under Lock.
+func (c *Capture) open() error {
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	hdr := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2) // major version
+	binary.LittleEndian.PutUint16(hdr[6:], 4) // minor version
+	binary.LittleEndian.PutUint32(hdr[16:], snaplen)
+	binary.LittleEndian.PutUint32(hdr[20:], linktypeRaw)
+	if _, err = f.Write(hdr); err != nil {
+		f.Close()
+		return err
+	}
+	c.f = f
+	c.size = pcapHeaderLen
+	return nil
+}
+
+// rotate moves the files in the ring along by one, and opens c.path afresh.
+// Must be called under Lock.
+func (c *Capture) rotate() error {
+	c.f.Close()
+	c.f = nil
+	for i := c.files - 1; i > 0; i-- {
+		from := c.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", c.path, i-1)
+		}
+		// older files in the ring may not exist yet
+		os.Rename(from, fmt.Sprintf("%s.%d", c.path, i))
+	}
+	return c.open()
+}
+
+// Packet captures the IP packet `b`.  A nil c captures nothing.
+func (c *Capture) Packet(b []byte) {
+	if c == nil {
+		return
+	}
+	if b = trimPacket(b); len(b) == 0 {
+		return
+	}
+	if c.dnsOnly {
+		if !IsDNS(b) {
+			return
+		}
+	}
+	incl := len(b)
+	if incl > snaplen {
+		incl = snaplen
+	}
+	now := time.Now()
+	rec := make([]byte, pcapRecordLen+incl)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(incl))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(b)))
+	copy(rec[pcapRecordLen:], b[:incl])
+
+	c.Lock()
+	defer c.Unlock()
+	if c.f == nil {
+		return
+	}
+	if c.size+int64(len(rec)) > c.maxBytes {
+		if err := c.rotate(); err != nil {
+			return
+		}
+	}
+	if n, err := c.f.Write(rec); err == nil {
+		c.size += int64(n)
+	}
+}
+
+// Close stops the capture.
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+// trimPacket returns the IP packet at the head of `b`, which may be followed
+// by unused bytes of a read buffer, as ProcessInputPackets passes along.
+func trimPacket(b []byte) []byte {
+	n := len(b)
+	if len(b) >= 20 && b[0]>>4 == 4 {
+		n = int(binary.BigEndian.Uint16(b[2:]))
+	} else if len(b) >= 40 && b[0]>>4 == 6 {
+		n = 40 + int(binary.BigEndian.Uint16(b[4:]))
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+	return b[:n]
+}
+
+// IsDNS reports whether the IP packet `b` is a UDP or TCP segment to or
+// from port 53.
+func IsDNS(b []byte) bool {
+	_, src, dst, ok := transportPorts(b)
+	return ok && (src == 53 || dst == 53)
+}
+
+// transportPorts returns the protocol, and the source and destination ports
+// of the UDP or TCP segment in the IP packet `b`.
+func transportPorts(b []byte) (proto byte, src uint16, dst uint16, ok bool) {
+	const tcp, udp = 6, 17
+	if len(b) < 1 {
+		return
+	}
+	var off int
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return
+		}
+		off = int(b[0]&0x0f) * 4
+		proto = b[9]
+	case 6:
+		// IPv6 extension headers aren't looked into.
+		if len(b) < 40 {
+			return
+		}
+		off = 40
+		proto = b[6]
+	default:
+		return
+	}
+	if (proto != tcp && proto != udp) || len(b) < off+4 {
+		return
+	}
+	return proto, binary.BigEndian.Uint16(b[off:]), binary.BigEndian.Uint16(b[off+2:]), true
+}
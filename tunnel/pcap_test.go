@@ -0,0 +1,114 @@
+// Copyright (c) 2021 RethinkDNS and its authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a 28-byte IPv4 UDP packet from srcport to dstport.
+func ipv4ports(srcport, dstport uint16) []byte {
+	b := ipv4udp(0, 0)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[20:], srcport)
+	binary.BigEndian.PutUint16(b[22:], dstport)
+	return b
+}
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tun.pcap")
+
+	c, err := NewCapture(path, minCaptureBytes, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// trailing bytes of the read buffer aren't captured
+	c.Packet(append(ipv4ports(1000, 53), make([]byte, 100)...))
+	c.Close()
+	// a closed capture captures nothing
+	c.Packet(ipv4ports(1000, 53))
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != pcapHeaderLen+pcapRecordLen+28 {
+		t.Fatalf("Wrong capture size %d", len(b))
+	}
+	if binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(b[20:]) != linktypeRaw {
+		t.Error("Bad pcap header")
+	}
+	if incl := binary.LittleEndian.Uint32(b[pcapHeaderLen+8:]); incl != 28 {
+		t.Errorf("Wrong captured length %d", incl)
+	}
+}
+
+func TestCaptureDNSOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dns.pcap")
+
+	c, err := NewCapture(path, minCaptureBytes, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Packet(ipv4ports(1000, 443))
+	c.Packet(ipv4ports(53, 1000))
+	c.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != pcapHeaderLen+pcapRecordLen+28 {
+		t.Errorf("Expected only the dns packet, got %d bytes", fi.Size())
+	}
+}
+
+func TestCaptureRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ring.pcap")
+
+	c, err := NewCapture(path, minCaptureBytes, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1540 bytes hold a header and 35 records of 44 bytes each
+	for i := 0; i < 35*4; i++ {
+		c.Packet(ipv4ports(1000, 80))
+	}
+	c.Close()
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("Missing %s: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Ring holds more files than asked for")
+	}
+
+	if _, err := NewCapture(path, 100, 1, false); err == nil {
+		t.Error("Expected an error for a tiny capture")
+	}
+}
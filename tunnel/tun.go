@@ -57,8 +57,14 @@ func MakeTunFile(fd int) (*os.File, error) {
 }
 
 // ProcessInputPackets reads packets from a TUN device `tun` and writes them to `tunnel`.
-func ProcessInputPackets(tunnel Tunnel, tun *os.File) {
-	buffer := make([]byte, vpnMtu)
+// `mtu` is the MTU of `tun`, or 0 for the default of 1500.
+func ProcessInputPackets(tunnel Tunnel, tun *os.File, mtu int) {
+	if mtu <= 0 {
+		mtu = vpnMtu
+	} else if mtu > MaxMTU {
+		mtu = MaxMTU
+	}
+	buffer := make([]byte, mtu)
 	for tunnel.IsConnected() {
 		len, err := tun.Read(buffer)
 		if err != nil {